@@ -0,0 +1,409 @@
+"""Audit records of restores, tracing which backup was restored where, and the audit trail of operations on backups.
+
+The trail is append-only: every restore, fetch, deletion by retention, hold
+and release adds an entry when it starts and one with its outcome, as a JSON
+line in AUDIT_LOG_FILE and as an object of its own under audit/ in the storage
+of the backup it is about.
+"""
+
+from __future__ import annotations
+
+import getpass
+import json
+import socket
+import tempfile
+import threading
+import uuid
+from collections.abc import Iterable
+from dataclasses import asdict, dataclass, field, replace
+from datetime import datetime, timezone
+from pathlib import Path
+from urllib.parse import urlsplit, urlunsplit
+
+from nestvault import __version__
+from nestvault.backup.base import BackupAdapter
+from nestvault.exceptions import AuditError, StorageError
+from nestvault.logging import get_logger, redact
+from nestvault.manifest import Manifest, format_labels
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("audit")
+
+# Key prefix restore records are kept under, next to the backups
+AUDIT_PREFIX = "restores/"
+# Key prefix the entries of the audit trail are kept under, one object each
+TRAIL_PREFIX = "audit/"
+
+# Operations the audit trail records
+OPERATIONS = ("restore", "fetch", "prune", "hold", "release")
+# 'started' is recorded before an operation acts, then 'success' or 'failure' once it is done
+OUTCOMES = ("started", "success", "failure")
+# Formats `nestvault audit` prints the trail in: a table for people, or one JSON object per line
+TRAIL_OUTPUTS = ("table", "json")
+TRAIL_COLUMNS = ("at", "operation", "outcome", "target", "backup", "user", "destination", "reason")
+
+
+def operator() -> str:
+    """Return who runs this command, e.g. a restore, as 'user@host'."""
+    try:
+        user = getpass.getuser()
+    except (KeyError, OSError):
+        user = "unknown"
+    return f"{user}@{socket.gethostname()}"
+
+
+@dataclass
+class RestoreRecord:
+    """One restore: the backup it applied, what that backup was taken from, and where it went."""
+
+    backup: str
+    # Identity of the backup's source as its manifest records it
+    source: dict[str, str | None]
+    # Engine and location of the database the backup was restored into
+    destination: dict[str, str]
+    started_at: datetime
+    finished_at: datetime
+    succeeded: bool
+    # Tables the restore was limited to, empty when it restored everything
+    tables: list[str] = field(default_factory=list)
+    # 'restore', or 'verification' for a test restore into a scratch database
+    kind: str = "restore"
+    # Validation queries of a verification, with whether each returned true
+    checks: dict[str, bool] = field(default_factory=dict)
+    # Seconds spent in each step of a verification, e.g. 'provision', 'restore' and 'checks'
+    timings: dict[str, float] = field(default_factory=dict)
+    operator: str = field(default_factory=operator)
+    nestvault_version: str = __version__
+
+    @classmethod
+    def of(
+        cls,
+        manifest: Manifest,
+        destination: BackupAdapter,
+        started_at: datetime,
+        finished_at: datetime,
+        succeeded: bool,
+        tables: list[str] | None = None,
+    ) -> RestoreRecord:
+        """Describe the restore of a backup into a destination."""
+        source = {
+            "database": manifest.database,
+            "engine": manifest.engine,
+            "server_version": manifest.server_version,
+            "taken_at": manifest.finished_at.isoformat(),
+            "labels": format_labels(manifest.labels),
+        }
+        return cls(
+            backup=manifest.key,
+            source=source,
+            destination={"engine": destination.engine, "location": destination.location},
+            started_at=started_at,
+            finished_at=finished_at,
+            succeeded=succeeded,
+            tables=list(tables or []),
+        )
+
+    def to_json(self) -> str:
+        data = asdict(self)
+        data["started_at"] = self.started_at.isoformat()
+        data["finished_at"] = self.finished_at.isoformat()
+        return json.dumps(data, indent=2, sort_keys=True)
+
+
+def record_key(record: RestoreRecord) -> str:
+    """Return the key of a restore record, e.g. 'restores/20240115_120000_1a2b3c4d.json'."""
+    return f"{AUDIT_PREFIX}{record.started_at.strftime('%Y%m%d_%H%M%S')}_{uuid.uuid4().hex[:8]}.json"
+
+
+def write_restore_record(storage_adapter: StorageAdapter, record: RestoreRecord) -> str | None:
+    """Log a restore and upload its record to the storage the backup came from.
+
+    A record that cannot be uploaded is only logged, so the outcome of the
+    restore itself is unaffected.
+
+    Returns:
+        The key of the uploaded record, None if the upload failed
+    """
+    logger.info(
+        f"{record.kind.capitalize()} audit: {record.backup} of {record.source['database']} into "
+        f"{record.destination['location']} by {record.operator} "
+        f"{'succeeded' if record.succeeded else 'failed'}"
+    )
+
+    key = record_key(record)
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / Path(key).name
+        local_file.write_text(record.to_json())
+        try:
+            storage_adapter.upload(local_file, key)
+        except StorageError as e:
+            logger.warning(f"Failed to upload restore record {key}: {e}")
+            return None
+
+    logger.info(f"Restore record uploaded: {key}")
+    return key
+
+
+def strip_credentials(dsn: str) -> str:
+    """Return a connection URL without its password, e.g. 'postgresql://app@db:5432/app', or a location as it is."""
+    parts = urlsplit(dsn)
+    if parts.password is not None:
+        userinfo, host = parts.netloc.rsplit("@", 1)
+        user = userinfo.split(":", 1)[0]
+        dsn = urlunsplit(parts._replace(netloc=f"{user}@{host}" if user else host))
+    # Passwords in query parameters, and any configured secret, are redacted too
+    return redact(dsn)
+
+
+@dataclass
+class AuditEvent:
+    """One entry of the audit trail: an operation on a backup, who ran it, and how it went."""
+
+    operation: str
+    backup: str
+    outcome: str
+    at: datetime = field(default_factory=lambda: datetime.now(timezone.utc))
+    # Target of the backup, where the operation knows it
+    target: str | None = None
+    database: str | None = None
+    # Where a restore or fetch wrote the backup, without credentials
+    destination: str | None = None
+    # Why, e.g. the reason of a hold, the retention rule deleting a backup, or the error an operation failed with
+    reason: str = ""
+    user: str = ""
+    # Shared by the entries of one operation, i.e. its start and its outcome
+    id: str = field(default_factory=lambda: uuid.uuid4().hex[:12])
+
+    def to_json(self) -> str:
+        """Return the entry as one JSON line."""
+        data = asdict(self)
+        data["at"] = self.at.isoformat()
+        return json.dumps(data, sort_keys=True)
+
+    @classmethod
+    def from_json(cls, text: str) -> AuditEvent:
+        """Parse an entry.
+
+        Raises:
+            ValueError: If the entry is malformed
+        """
+        data = json.loads(text)
+        try:
+            return cls(
+                operation=data["operation"],
+                backup=data["backup"],
+                outcome=data["outcome"],
+                at=datetime.fromisoformat(data["at"]),
+                target=data.get("target"),
+                database=data.get("database"),
+                destination=data.get("destination"),
+                reason=data.get("reason", ""),
+                user=data.get("user", ""),
+                id=data.get("id", ""),
+            )
+        except (KeyError, TypeError, AttributeError) as e:
+            raise ValueError(f"audit entry is incomplete: {e}")
+
+    def key(self) -> str:
+        """Return the key of the entry in storage, e.g. 'audit/20240115_120000_1a2b3c4d5e6f_started.json'."""
+        return f"{TRAIL_PREFIX}{self.at.strftime('%Y%m%d_%H%M%S')}_{self.id}_{self.outcome}.json"
+
+
+class AuditTrail:
+    """Where the entries of the audit trail are written, and what a failure to write one does.
+
+    Args:
+        path: JSON lines file every entry is appended to, if any
+        to_storage: Also upload every entry under audit/ to the storage of the backup it is about
+        strict: Raise AuditError when an entry cannot be written, refusing the operation,
+            instead of only logging an error
+        user: Who runs the operations; 'user@host' of the process by default
+    """
+
+    def __init__(
+        self, path: Path | None = None, to_storage: bool = False, strict: bool = False, user: str | None = None
+    ):
+        self.path = path
+        self.to_storage = to_storage
+        self.strict = strict
+        self.user = user or operator()
+        self.lock = threading.Lock()
+
+    def record(self, event: AuditEvent, storage_adapter: StorageAdapter | None = None) -> None:
+        """Append an entry to the trail.
+
+        Raises:
+            AuditError: If the entry cannot be written in strict mode
+        """
+        event.user = event.user or self.user
+        failures = []
+        if self.path is not None:
+            try:
+                with self.lock:
+                    self.path.parent.mkdir(parents=True, exist_ok=True)
+                    with self.path.open("a") as trail:
+                        trail.write(event.to_json() + "\n")
+            except OSError as e:
+                failures.append(f"appending to {self.path} failed: {e}")
+        if self.to_storage and storage_adapter is not None:
+            try:
+                _upload_event(storage_adapter, event)
+            except StorageError as e:
+                failures.append(f"uploading {event.key()} failed: {e}")
+
+        what = f"{event.operation} of {event.backup} ({event.outcome})"
+        for failure in failures:
+            logger.error(f"AUDIT TRAIL INCOMPLETE: {what} was not recorded, {failure}")
+        if failures and self.strict:
+            raise AuditError(f"The audit entry of {what} cannot be written: {failures[0]}")
+
+
+def _upload_event(storage_adapter: StorageAdapter, event: AuditEvent) -> None:
+    key = event.key()
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / Path(key).name
+        local_file.write_text(event.to_json() + "\n")
+        storage_adapter.upload(local_file, key)
+
+
+# The trail of this process; without use_audit_trail it is written nowhere
+_trail = AuditTrail()
+
+
+def use_audit_trail(trail: AuditTrail) -> None:
+    """Write the entries of the operations this process runs to a trail, as AUDIT_* configures it."""
+    global _trail
+    _trail = trail
+
+
+def record_start(storage_adapter: StorageAdapter | None, operation: str, backup: str, **fields) -> AuditEvent:
+    """Record in the audit trail that an operation on a backup is starting, before it acts.
+
+    Args:
+        storage_adapter: Storage the backup is kept in
+        operation: One of OPERATIONS
+        backup: Key of the backup, or of the object retention deletes
+        fields: Other fields of the entry, e.g. target, database, destination or reason
+
+    Returns:
+        The entry, to record the outcome of the operation with
+
+    Raises:
+        AuditError: If the entry cannot be written in strict mode
+    """
+    event = AuditEvent(operation, backup, "started", **fields)
+    _trail.record(event, storage_adapter)
+    return event
+
+
+def record_outcome(
+    storage_adapter: StorageAdapter | None, started: AuditEvent, succeeded: bool, reason: str | None = None
+) -> None:
+    """Record in the audit trail how an operation recorded with record_start went.
+
+    Args:
+        storage_adapter: Storage the backup is kept in
+        started: Entry record_start returned
+        succeeded: Whether the operation succeeded
+        reason: Why it failed, if it did; the reason it started with otherwise
+
+    Raises:
+        AuditError: If the entry cannot be written in strict mode
+    """
+    outcome = "success" if succeeded else "failure"
+    event = replace(started, outcome=outcome, at=datetime.now(timezone.utc), reason=reason or started.reason)
+    _trail.record(event, storage_adapter)
+
+
+def read_trail(
+    path: Path | None = None,
+    storages: Iterable[tuple[str, StorageAdapter]] = (),
+    since: datetime | None = None,
+    until: datetime | None = None,
+) -> list[AuditEvent]:
+    """Read the entries of the audit trail from a file and the storage of targets, oldest first.
+
+    An entry kept in several places is returned once. Entries without a
+    target get the one whose storage they were read from.
+
+    Args:
+        path: JSON lines file of the trail, if any
+        storages: Name and storage adapter of every target to read the trail of
+        since: Only return entries at or after this time
+        until: Only return entries before this time
+
+    Raises:
+        StorageError: If the trail cannot be read
+    """
+    events: dict[tuple[str, str], AuditEvent] = {}
+
+    def add(event: AuditEvent) -> None:
+        if since is not None and event.at < since:
+            return
+        if until is not None and event.at >= until:
+            return
+        known = events.setdefault((event.id, event.outcome), event)
+        known.target = known.target or event.target
+
+    if path is not None:
+        try:
+            lines = path.read_text().splitlines()
+        except FileNotFoundError:
+            lines = []
+        except OSError as e:
+            raise StorageError(f"Cannot read the audit trail {path}: {e}")
+        for number, line in enumerate(lines, 1):
+            if not line.strip():
+                continue
+            try:
+                add(AuditEvent.from_json(line))
+            except ValueError as e:
+                logger.warning(f"Skipping malformed audit entry at {path}:{number}: {e}")
+
+    # Keys start with the time of their entry, so older entries need not be downloaded
+    earliest = f"{TRAIL_PREFIX}{since.astimezone(timezone.utc).strftime('%Y%m%d_%H%M%S')}" if since else ""
+    for target, storage_adapter in storages:
+        with tempfile.TemporaryDirectory() as temp_dir:
+            local_file = Path(temp_dir) / "entry.json"
+            for obj in storage_adapter.list(prefix=TRAIL_PREFIX):
+                if obj.key < earliest:
+                    continue
+                storage_adapter.download(obj.key, local_file)
+                try:
+                    event = AuditEvent.from_json(local_file.read_text())
+                except (OSError, UnicodeDecodeError, ValueError) as e:
+                    logger.warning(f"Skipping malformed audit entry {obj.key}: {e}")
+                    continue
+                event.target = event.target or target
+                add(event)
+
+    return sorted(events.values(), key=lambda event: event.at)
+
+
+def render_trail(events: list[AuditEvent], output: str) -> str:
+    """Render entries of the audit trail as a table for people, or as JSON lines for other tools.
+
+    Args:
+        events: Entries to render, in order
+        output: One of TRAIL_OUTPUTS
+    """
+    if output == "json":
+        return "\n".join(event.to_json() for event in events)
+
+    rows = [[column.upper() for column in TRAIL_COLUMNS]]
+    for event in events:
+        rows.append(
+            [
+                event.at.astimezone(timezone.utc).strftime("%Y-%m-%d %H:%M:%S"),
+                event.operation,
+                event.outcome,
+                event.target or "-",
+                event.backup,
+                event.user,
+                event.destination or "-",
+                event.reason,
+            ]
+        )
+    widths = [max(len(row[column]) for row in rows) for column in range(len(TRAIL_COLUMNS))]
+    lines = ["  ".join(value.ljust(width) for value, width in zip(row, widths)).rstrip() for row in rows]
+    return "\n".join(lines + [f"({len(events)} entries)"])
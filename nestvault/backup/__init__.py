@@ -1,7 +1,32 @@
 """Backup adapters for different database types."""
 
-from nestvault.backup.base import BackupAdapter
+from nestvault.backup.base import BackupAdapter, RestoreOptions
 from nestvault.backup.postgres import PostgresBackupAdapter
 from nestvault.backup.mongodb import MongoDBBackupAdapter
+from nestvault.backup.mysql import MySQLBackupAdapter
+from nestvault.backup.redis import RedisBackupAdapter
+from nestvault.backup.sqlite import SQLiteBackupAdapter
+from nestvault.backup.clickhouse import ClickHouseBackupAdapter
+from nestvault.backup.mssql import MSSQLBackupAdapter
+from nestvault.backup.etcd import EtcdBackupAdapter
+from nestvault.backup.influxdb import InfluxDBBackupAdapter
+from nestvault.backup.cockroachdb import CockroachDBBackupAdapter
+from nestvault.backup.cassandra import CassandraBackupAdapter
+from nestvault.backup.elasticsearch import ElasticsearchBackupAdapter
 
-__all__ = ["BackupAdapter", "PostgresBackupAdapter", "MongoDBBackupAdapter"]
+__all__ = [
+    "BackupAdapter",
+    "RestoreOptions",
+    "PostgresBackupAdapter",
+    "MongoDBBackupAdapter",
+    "MySQLBackupAdapter",
+    "RedisBackupAdapter",
+    "SQLiteBackupAdapter",
+    "ClickHouseBackupAdapter",
+    "MSSQLBackupAdapter",
+    "EtcdBackupAdapter",
+    "InfluxDBBackupAdapter",
+    "CockroachDBBackupAdapter",
+    "CassandraBackupAdapter",
+    "ElasticsearchBackupAdapter",
+]
@@ -1,7 +1,129 @@
 """Abstract base class for backup adapters."""
 
+from __future__ import annotations
+
+import shutil
+import tarfile
 from abc import ABC, abstractmethod
+from contextlib import AbstractContextManager
+from dataclasses import dataclass, field
 from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.compression import compression_level
+from nestvault.config import CompressionConfig
+from nestvault.download import RetryPolicy
+from nestvault.encryption import decrypted_name
+from nestvault.exceptions import BackupError
+from nestvault.progress import Progress
+from nestvault.storage.base import StorageAdapter
+
+# File extensions of companion objects by kind; they are uploaded next to a
+# backup and only restored together with it. Manifests, records of the
+# runs skipped because the database was unchanged, and holds are appended
+# to the backup's full key instead of replacing its extension.
+COMPANION_EXTENSIONS = {
+    "globals": "globals.sql.gz",
+    "manifest": "manifest.json",
+    "unchanged": "unchanged.json",
+    "hold": "hold.json",
+}
+
+
+def is_companion(key: str) -> bool:
+    """Check whether a storage key is a companion object rather than a backup."""
+    key = decrypted_name(key)
+    return any(key.endswith(f".{extension}") for extension in COMPANION_EXTENSIONS.values())
+
+
+def find_binary(*candidates: str) -> str:
+    """Return the first candidate binary found in PATH.
+
+    Args:
+        candidates: Binary names in order of preference
+
+    Returns:
+        Name of the first binary available in PATH
+
+    Raises:
+        BackupError: If none of the candidates are installed
+    """
+    for candidate in candidates:
+        if shutil.which(candidate):
+            return candidate
+
+    raise BackupError(
+        f"None of the required client binaries were found in PATH: {', '.join(candidates)}"
+    )
+
+
+def extract_tar(archive: tarfile.TarFile, destination: Path) -> None:
+    """Extract a tar archive, rejecting members that escape the destination.
+
+    Args:
+        archive: Open tar archive
+        destination: Directory to extract into
+
+    Raises:
+        BackupError: If a member would be written outside the destination
+    """
+    root = destination.resolve()
+
+    for member in archive.getmembers():
+        if not (root / member.name).resolve().is_relative_to(root):
+            raise BackupError(f"Refusing to extract {member.name} outside of {destination}")
+
+    archive.extractall(destination)
+
+
+@dataclass
+class RestoreOptions:
+    """Options controlling how a backup is restored."""
+
+    force: bool = False
+    # Restore companion objects such as PostgreSQL globals before the backup itself
+    with_globals: bool = False
+    # Metadata recorded with the backup object at upload time
+    metadata: dict[str, str] = field(default_factory=dict)
+    # Companion files downloaded for this restore, keyed by kind (e.g. 'globals')
+    companions: dict[str, Path] = field(default_factory=dict)
+    # Data directory to extract a physical backup into instead of the configured one
+    data_dir: Path | None = None
+    # Recovery settings written into the extracted data directory, e.g. restore_command
+    recovery: dict[str, str] = field(default_factory=dict)
+    # Create the database before restoring into it, dropping an existing one first if drop_existing is set
+    create_database: bool = False
+    drop_existing: bool = False
+    # Drop the backup's objects before recreating them, for engines whose restore tool can
+    clean: bool = False
+    # Only restore these tables, given as 'schema.table' or 'table', for engines that can select them
+    tables: list[str] = field(default_factory=list)
+    # Read the backup's table of contents into contents instead of restoring it
+    list_contents: bool = False
+    contents: str | None = None
+    # Restore a backup whose recorded engine or format does not match, only warning about it
+    ignore_mismatch: bool = False
+    # How a failed download of the backup is retried, and whether one an earlier restore left unfinished is resumed
+    retry: RetryPolicy = field(default_factory=RetryPolicy)
+    resume: bool = False
+    # Counts the restore as it runs, for adapters that can tell how far it got
+    progress: Progress | None = None
+
+
+@dataclass
+class DestinationState:
+    """The database a restore would write into, as restore --dry-run reports it."""
+
+    exists: bool
+    # Tables the database holds; None when unknown
+    tables: int | None = None
+
+    def describe(self) -> str:
+        if not self.exists:
+            return "does not exist"
+        if self.tables is None:
+            return "exists"
+        return f"exists, {self.tables} tables" if self.tables else "exists, empty"
 
 
 class BackupAdapter(ABC):
@@ -23,11 +145,12 @@ class BackupAdapter(ABC):
         pass
 
     @abstractmethod
-    def restore(self, backup_file: Path) -> None:
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
         """Restore a database from a backup file.
 
         Args:
             backup_file: Path to the backup file (compressed)
+            options: Restore options (defaults to RestoreOptions())
 
         Raises:
             BackupError: If the restore operation fails
@@ -45,3 +168,238 @@ class BackupAdapter(ABC):
     def file_extension(self) -> str:
         """Return the file extension for backup files (e.g., 'sql.gz', 'archive.gz')."""
         pass
+
+    @property
+    @abstractmethod
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup (e.g., 'postgres')."""
+        pass
+
+    @property
+    def compression(self) -> CompressionConfig | None:
+        """Return how NestVault compresses backups, or None when the database tools do."""
+        return None
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether stream_backup() can produce this adapter's backups."""
+        return False
+
+    def stream_backup(self) -> AbstractContextManager[tuple[str, BinaryIO]]:
+        """Start a backup whose data is read from a stream instead of written to a file.
+
+        The backup runs only as fast as the stream is read. It has
+        succeeded once the stream is read to its end without an error;
+        leaving the context before that stops it.
+
+        Returns:
+            Context manager yielding the backup's file name and its data
+
+        Raises:
+            BackupError: If the backup cannot be streamed or fails; errors of a running
+                backup are raised from reading the stream
+        """
+        raise BackupError(f"The {self.engine} engine does not support streaming backups")
+
+    def supports_streaming_restore(self, metadata: dict[str, str]) -> bool:
+        """Return whether restore_stream() can restore the backup recorded with this metadata."""
+        return False
+
+    def restore_stream(self, name: str, stream: BinaryIO, options: RestoreOptions | None = None) -> None:
+        """Restore a database from a backup read from a stream instead of a downloaded file.
+
+        Args:
+            name: File name of the backup, e.g. 'db_20240115_120000.sql.gz'
+            stream: The backup's data, as uploaded
+            options: Restore options (defaults to RestoreOptions())
+
+        Raises:
+            BackupError: If the backup cannot be restored from a stream or the restore fails;
+                errors reading the stream are raised as is
+        """
+        raise BackupError(f"The {self.engine} engine does not support streaming restores")
+
+    def restore_commands(self, name: str, options: RestoreOptions, streamed: bool) -> list[str]:
+        """Return the commands restoring a backup would run, with secrets masked, for restore --dry-run.
+
+        Args:
+            name: File name of the backup, e.g. 'db_20240115_120000.sql.gz'
+            options: Restore options including the recorded backup metadata
+            streamed: Whether the backup would be restored from a stream
+
+        Returns:
+            The commands in the order they would run; empty when the adapter cannot tell
+
+        Raises:
+            BackupError: If the backup cannot be restored with these options
+        """
+        return []
+
+    def inspect_destination(self) -> DestinationState | None:
+        """Check the database a restore would write into, for restore --dry-run.
+
+        Returns:
+            Whether it exists and what it holds; None when the adapter cannot tell
+
+        Raises:
+            BackupError: If the destination cannot be reached
+        """
+        return None
+
+    def backup_companions(self, backup_file: Path) -> dict[str, Path]:
+        """Create companion files stored next to a backup.
+
+        Called after a successful backup. Each companion is uploaded as its
+        own object and linked from the backup's metadata under its kind.
+
+        Args:
+            backup_file: Backup file the companions belong to
+
+        Returns:
+            Companion files keyed by kind (empty by default)
+
+        Raises:
+            BackupError: If creating a companion fails
+        """
+        return {}
+
+    def expand(self) -> list[BackupAdapter]:
+        """Return the adapters to run for one backup cycle.
+
+        Engines that can discover several databases on one server return an
+        adapter per database; everything else backs up just itself.
+
+        Raises:
+            BackupError: If discovery fails
+        """
+        return [self]
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to a different database on the same server.
+
+        Raises:
+            BackupError: If the engine cannot select databases
+        """
+        raise BackupError(f"The {self.engine} engine does not support selecting a database")
+
+    def is_own_backup(self, backup_key: str) -> bool:
+        """Check whether a backup of this database was taken by this adapter.
+
+        Engines that back up every node separately share one database name
+        across nodes and use this to tell their own backups apart.
+
+        Args:
+            backup_key: Key of a backup of this database
+        """
+        return True
+
+    def use_storage(self, storage: StorageAdapter) -> None:
+        """Give the adapter access to the storage its backups are kept in.
+
+        Only engines whose server writes backups to object storage itself
+        need this; the default ignores it.
+
+        Args:
+            storage: Storage adapter the backups are uploaded to
+        """
+
+    def use_credentials(self, username: str, password: str) -> None:
+        """Connect to the database as another user from now on, e.g. with credentials leased for a run.
+
+        Adapters the adapter expands to afterwards connect as that user too.
+
+        Args:
+            username: User to connect as
+            password: Password of the user
+
+        Raises:
+            BackupError: If the engine cannot connect with other credentials
+        """
+        raise BackupError(f"The {self.engine} engine does not support leased credentials")
+
+    def use_tunnel(self, port: int | None) -> None:
+        """Connect to the database through a local port forwarded to its server from now on, e.g. by an SSH tunnel.
+
+        Adapters the adapter expands to afterwards connect the same way.
+
+        Args:
+            port: Local port of the tunnel, or None to connect directly again
+
+        Raises:
+            BackupError: If the engine cannot connect through a tunnel
+        """
+        if port is not None:
+            raise BackupError(f"The {self.engine} engine does not support SSH tunnels")
+
+    def check_tls(self) -> str | None:
+        """Handshake TLS with the database server as backups connect to it.
+
+        The default does nothing, for engines without TLS settings.
+
+        Returns:
+            Subject of the server's certificate, e.g. 'CN=db.internal', or None if connections are not encrypted
+
+        Raises:
+            BackupError: If the handshake fails or the server does not offer TLS where it is required
+        """
+        return None
+
+    def delete_backup_data(self, backup_key: str) -> None:
+        """Delete data a backup keeps outside its own storage object.
+
+        Called by retention before an expired backup object is deleted.
+
+        Args:
+            backup_key: Key of the expired backup object
+
+        Raises:
+            BackupError: If the data cannot be deleted
+        """
+
+    @property
+    def archives_wal(self) -> bool:
+        """Return whether the server continuously archives WAL next to these backups, see nestvault.wal."""
+        return False
+
+    @property
+    def deduplicates(self) -> bool:
+        """Return whether backups are stored as chunks shared between backups, see nestvault.dedup."""
+        return False
+
+    def server_version(self) -> str | None:
+        """Return the version of the database server, recorded in manifests; None when unknown."""
+        return None
+
+    def database_size(self) -> int | None:
+        """Return the size in bytes of what a backup covers, to estimate the backup's size; None when unknown."""
+        return None
+
+    def fingerprint(self) -> str | None:
+        """Return a digest that changes whenever the database does, to skip unchanged backups; None when unknown."""
+        return None
+
+    @property
+    def location(self) -> str:
+        """Return where the database lives, e.g. 'db.internal:5432/app', recorded in restore audit records."""
+        return self.database_name
+
+    @property
+    def dsn(self) -> str:
+        """Return a connection string of the database without its password, exposed to restore hooks."""
+        return self.location
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata stored alongside each backup object.
+
+        Restore uses the recorded engine to refuse restoring a backup
+        with an adapter for a different database engine, and the recorded
+        compression to decompress it.
+        """
+        metadata = {"engine": self.engine}
+        if self.compression is not None:
+            metadata["compression"] = self.compression.algorithm
+            level = compression_level(self.compression)
+            if level is not None:
+                metadata["compression_level"] = str(level)
+        return metadata
@@ -0,0 +1,243 @@
+"""Cassandra/ScyllaDB backup adapter using nodetool snapshots."""
+
+from __future__ import annotations
+
+import fnmatch
+import io
+import json
+import shutil
+import subprocess
+import tarfile
+import tempfile
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, extract_tar, find_binary
+from nestvault.config import CassandraConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.cassandra")
+
+# Keyspaces that are node-local or rebuilt by the cluster and never backed up
+SYSTEM_KEYSPACES = (
+    "system",
+    "system_auth",
+    "system_distributed",
+    "system_schema",
+    "system_traces",
+    "system_views",
+    "system_virtual_schema",
+)
+
+
+class CassandraBackupAdapter(BackupAdapter):
+    """Backup adapter for one Cassandra or ScyllaDB node.
+
+    Takes a `nodetool snapshot`, tars the snapshot's SSTables and clears the
+    snapshot again. Backups are per node: the node ID is part of every key,
+    and the snapshot tag is derived from the minute the backup starts in, so
+    the nodes of a cluster backed up by the same cron tick share one tag and
+    timestamp.
+    """
+
+    def __init__(self, config: CassandraConfig):
+        """Initialize the Cassandra backup adapter.
+
+        Args:
+            config: Cassandra node configuration
+        """
+        self.config = config
+        self.snapshot: dict[str, str] = {}
+
+    @property
+    def database_name(self) -> str:
+        """Return the cluster name shared by the backups of every node."""
+        return self.config.name
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files, including the node ID."""
+        return f"{self.config.node_id}.cassandra.tar"
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "cassandra"
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including node and snapshot tag."""
+        return {**super().backup_metadata, **self.snapshot}
+
+    def is_own_backup(self, backup_key: str) -> bool:
+        """Check whether a backup was taken on this node."""
+        return backup_key.endswith(f".{self.file_extension}")
+
+    def _nodetool(self, *args: str) -> None:
+        """Run nodetool against the configured JMX endpoint.
+
+        The JMX password is written to a temporary password file so it does
+        not appear in the process list.
+
+        Raises:
+            BackupError: If nodetool fails
+        """
+        cmd = [find_binary("nodetool"), "-h", self.config.jmx_host, "-p", str(self.config.jmx_port)]
+
+        with tempfile.NamedTemporaryFile("w", suffix=".password") as password_file:
+            if self.config.jmx_user:
+                password_file.write(f"{self.config.jmx_user} {self.config.jmx_password}\n")
+                password_file.flush()
+                cmd.extend(["-u", self.config.jmx_user, "-pwf", password_file.name])
+
+            cmd.extend(args)
+
+            try:
+                logger.debug(f"Executing nodetool {args[0]}")
+                subprocess.run(cmd, capture_output=True, check=True)
+            except subprocess.CalledProcessError as e:
+                error_msg = e.stderr.decode() if e.stderr else str(e)
+                logger.error(f"nodetool {args[0]} failed: {error_msg}")
+                raise BackupError(f"nodetool {args[0]} failed: {error_msg}")
+
+    def _select_keyspaces(self) -> list[str]:
+        """Return the keyspaces on disk that match the include and exclude lists."""
+        data_dir = Path(self.config.data_dir)
+
+        try:
+            on_disk = sorted(path.name for path in data_dir.iterdir() if path.is_dir())
+        except OSError as e:
+            raise BackupError(f"Failed to read data directory {data_dir}: {e}")
+
+        keyspaces = [
+            name
+            for name in on_disk
+            if name not in SYSTEM_KEYSPACES
+            and (not self.config.keyspaces or any(fnmatch.fnmatchcase(name, p) for p in self.config.keyspaces))
+            and not any(fnmatch.fnmatchcase(name, p) for p in self.config.exclude_keyspaces)
+        ]
+
+        if not keyspaces:
+            raise BackupError(f"No keyspaces to back up in {data_dir}")
+
+        return keyspaces
+
+    def backup(self, output_path: Path) -> Path:
+        """Snapshot the selected keyspaces and archive the snapshot SSTables.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file
+
+        Raises:
+            BackupError: If the snapshot or archive fails
+        """
+        now = datetime.now(timezone.utc)
+        timestamp = now.strftime("%Y%m%d_%H%M00")
+        tag = f"nestvault_{timestamp}"
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        keyspaces = self._select_keyspaces()
+        logger.info(f"Starting Cassandra snapshot '{tag}' on node {self.config.node_id}: {', '.join(keyspaces)}")
+
+        self._nodetool("snapshot", "-t", tag, "--", *keyspaces)
+
+        try:
+            tables = 0
+            with tarfile.open(backup_file, "w") as archive:
+                for keyspace in keyspaces:
+                    for table_dir in sorted((Path(self.config.data_dir) / keyspace).iterdir()):
+                        snapshot_dir = table_dir / "snapshots" / tag
+                        if not snapshot_dir.is_dir():
+                            continue
+
+                        # Table directories carry a table ID suffix that differs between clusters
+                        table = table_dir.name.rsplit("-", 1)[0]
+                        archive.add(snapshot_dir, arcname=f"{keyspace}/{table}")
+                        tables += 1
+
+                manifest = json.dumps({"node": self.config.node_id, "tag": tag, "keyspaces": keyspaces}).encode()
+                info = tarfile.TarInfo("manifest.json")
+                info.size = len(manifest)
+                info.mtime = int(now.timestamp())
+                archive.addfile(info, fileobj=io.BytesIO(manifest))
+
+        except OSError as e:
+            backup_file.unlink(missing_ok=True)
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+        finally:
+            try:
+                self._nodetool("clearsnapshot", "-t", tag, "--", *keyspaces)
+            except BackupError as e:
+                logger.warning(f"Snapshot '{tag}' was not cleared and still uses disk space: {e}")
+
+        self.snapshot = {
+            "node": self.config.node_id,
+            "snapshot_tag": tag,
+            "keyspaces": ",".join(keyspaces),
+        }
+
+        file_size = backup_file.stat().st_size
+        logger.info(f"Backup completed: {filename} ({file_size} bytes, {tables} tables)")
+
+        return backup_file
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Load a node's snapshot SSTables back into its tables.
+
+        The schema must already exist. SSTables are staged in each table's
+        `upload` directory and loaded with `nodetool import` (Cassandra) or
+        `nodetool refresh` (ScyllaDB).
+
+        Args:
+            backup_file: Path to the backup file (.cassandra.tar)
+            options: Restore options (unused by this engine)
+
+        Raises:
+            BackupError: If a table is missing or loading fails
+        """
+        data_dir = Path(self.config.data_dir)
+
+        logger.info(f"Starting Cassandra restore on node {self.config.node_id}")
+        logger.info(f"Restoring from: {backup_file}")
+
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                scratch_path = Path(scratch)
+                with tarfile.open(backup_file) as archive:
+                    extract_tar(archive, scratch_path)
+
+                for snapshot_dir in sorted(scratch_path.glob("*/*")):
+                    if not snapshot_dir.is_dir():
+                        continue
+
+                    keyspace, table = snapshot_dir.parent.name, snapshot_dir.name
+                    # A dropped and recreated table leaves its old directory behind
+                    matches = sorted((data_dir / keyspace).glob(f"{table}-*"), key=lambda path: path.stat().st_mtime)
+                    if not matches:
+                        raise BackupError(
+                            f"Table {keyspace}.{table} does not exist, create the schema before restoring"
+                        )
+
+                    upload_dir = matches[-1] / "upload"
+                    upload_dir.mkdir(exist_ok=True)
+                    for sstable in snapshot_dir.iterdir():
+                        if sstable.is_file():
+                            shutil.copy2(sstable, upload_dir / sstable.name)
+
+                    logger.info(f"Loading SSTables into {keyspace}.{table}")
+                    if self.config.flavor == "scylla":
+                        self._nodetool("refresh", "--", keyspace, table)
+                    else:
+                        self._nodetool("import", "--", keyspace, table, str(upload_dir))
+
+        except (OSError, tarfile.TarError) as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
+
+        logger.info(f"Restore completed successfully on node {self.config.node_id}")
@@ -0,0 +1,428 @@
+"""ClickHouse backup adapter using clickhouse-client."""
+
+from __future__ import annotations
+
+import fnmatch
+import io
+import json
+import shutil
+import subprocess
+import tarfile
+import tempfile
+from dataclasses import replace
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, extract_tar, find_binary
+from nestvault.config import ClickHouseConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.clickhouse")
+
+# Table-by-table Native export bundled with the schema of every table
+EXPORT_EXTENSION = "clickhouse.tar.gz"
+# Archive written by the server's own BACKUP ... TO Disk() statement
+SERVER_BACKUP_EXTENSION = "clickhouse.zip"
+
+# Database every server has, for queries run before the one restored into exists
+DEFAULT_DATABASE = "default"
+
+VIEW_ENGINES = ("View", "MaterializedView", "LiveView", "WindowView")
+
+# Engines that hold no data of their own, or whose SELECT would consume
+# messages from an external queue; only their schema is exported
+SCHEMA_ONLY_ENGINES = VIEW_ENGINES + (
+    "Dictionary",
+    "Distributed",
+    "Merge",
+    "Null",
+    "Buffer",
+    "Kafka",
+    "RabbitMQ",
+    "NATS",
+    "S3Queue",
+)
+
+
+def _quote(identifier: str) -> str:
+    """Quote a ClickHouse identifier with backticks."""
+    return "`" + identifier.replace("\\", "\\\\").replace("`", "\\`") + "`"
+
+
+def _literal(value: str) -> str:
+    """Quote a ClickHouse string literal with single quotes."""
+    return "'" + value.replace("\\", "\\\\").replace("'", "\\'") + "'"
+
+
+def _restore_order(table: dict) -> int:
+    """Sort key that creates tables before dictionaries and views.
+
+    Views are created last so inserting the restored data does not fire
+    materialized views a second time.
+    """
+    if table["engine"] in VIEW_ENGINES:
+        return 2
+    if table["engine"] in SCHEMA_ONLY_ENGINES:
+        return 1
+    return 0
+
+
+class ClickHouseBackupAdapter(BackupAdapter):
+    """Backup adapter for ClickHouse databases.
+
+    Uses `BACKUP DATABASE ... TO Disk()` when a backup disk is configured
+    and mounted into the container, otherwise exports every table with
+    `SELECT ... FORMAT Native`.
+    """
+
+    def __init__(self, config: ClickHouseConfig):
+        """Initialize the ClickHouse backup adapter.
+
+        Args:
+            config: ClickHouse connection configuration
+        """
+        self.config = config
+
+    @property
+    def database_name(self) -> str:
+        """Return the name of the database being backed up."""
+        return self.config.database
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        if self.config.backup_disk:
+            return SERVER_BACKUP_EXTENSION
+        return EXPORT_EXTENSION
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "clickhouse"
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including the method."""
+        method = "server" if self.config.backup_disk else "export"
+        return {**super().backup_metadata, "method": method}
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to another database on the same server."""
+        return ClickHouseBackupAdapter(replace(self.config, database=database))
+
+    def _client_command(self, query: str, *, database: str | None = None, **params: str) -> list[str]:
+        """Build a clickhouse-client invocation for a single query, in the configured database unless given another."""
+        cmd = [
+            find_binary("clickhouse-client"),
+            "--host", self.config.host,
+            "--port", str(self.config.port),
+            "--user", self.config.user,
+            "--database", database or self.config.database,
+        ]
+
+        if self.config.secure:
+            cmd.append("--secure")
+
+        for name, value in params.items():
+            cmd.append(f"--param_{name}={value}")
+
+        cmd.extend(["--query", query])
+        return cmd
+
+    def _env(self) -> dict[str, str]:
+        """Build the client environment; the password stays out of the process list."""
+        return {
+            "CLICKHOUSE_PASSWORD": self.config.password,
+        }
+
+    def _query(self, query: str, *, database: str | None = None, **params: str) -> str:
+        """Run a query and return its output.
+
+        Raises:
+            BackupError: If the query fails
+        """
+        try:
+            result = subprocess.run(
+                self._client_command(query, database=database, **params),
+                env=self._env(),
+                capture_output=True,
+                check=True,
+            )
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"clickhouse-client failed: {error_msg}")
+            raise BackupError(f"ClickHouse query failed: {error_msg}")
+
+        return result.stdout.decode()
+
+    def _qualified(self, table: str) -> str:
+        """Return the fully qualified, quoted name of a table."""
+        return f"{_quote(self.config.database)}.{_quote(table)}"
+
+    def list_tables(self) -> list[tuple[str, str]]:
+        """List the tables of the database that match the configured include list.
+
+        Returns:
+            (name, engine) pairs sorted by name
+
+        Raises:
+            BackupError: If the query fails
+        """
+        output = self._query(
+            "SELECT name, engine FROM system.tables "
+            "WHERE database = {db:String} AND NOT is_temporary AND NOT startsWith(name, '.inner') "
+            "ORDER BY name FORMAT TSVRaw",
+            db=self.config.database,
+        )
+
+        tables = []
+        for line in output.splitlines():
+            if not line:
+                continue
+            name, engine = line.split("\t", 1)
+            if self.config.tables and not any(fnmatch.fnmatchcase(name, p) for p in self.config.tables):
+                continue
+            tables.append((name, engine))
+
+        return tables
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup of the ClickHouse database.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        logger.info(f"Starting ClickHouse backup for database '{self.database_name}'")
+
+        if self.config.backup_disk:
+            self._backup_server(backup_file)
+        else:
+            self._backup_export(backup_file)
+
+        file_size = backup_file.stat().st_size
+        logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+        return backup_file
+
+    def _backup_server(self, backup_file: Path) -> None:
+        """Run BACKUP ... TO Disk() and collect the archive from the mounted disk."""
+        disk_file = Path(self.config.backup_disk_path) / backup_file.name
+        destination = f"Disk({_literal(self.config.backup_disk)}, {_literal(backup_file.name)})"
+
+        if self.config.tables:
+            tables = self.list_tables()
+            if not tables:
+                raise BackupError("CLICKHOUSE_TABLES did not match any table")
+            scope = ", ".join(f"TABLE {self._qualified(name)}" for name, _ in tables)
+        else:
+            scope = f"DATABASE {_quote(self.config.database)}"
+
+        logger.debug(f"Executing BACKUP {scope}")
+        self._query(f"BACKUP {scope} TO {destination}")
+
+        try:
+            shutil.move(disk_file, backup_file)
+        except OSError as e:
+            logger.error(f"Failed to collect backup from disk '{self.config.backup_disk}': {e}")
+            raise BackupError(
+                f"Backup was written to disk '{self.config.backup_disk}' but {disk_file} is not readable; "
+                "check that CLICKHOUSE_BACKUP_DISK_PATH is where that disk is mounted"
+            )
+
+    def _backup_export(self, backup_file: Path) -> None:
+        """Export every table's schema and data into a tarball."""
+        tables = self.list_tables()
+        if not tables:
+            raise BackupError(f"No tables to back up in database '{self.database_name}'")
+
+        manifest = {"database": self.config.database, "tables": []}
+
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch, \
+                    tarfile.open(backup_file, "w:gz") as archive:
+                for index, (name, engine) in enumerate(tables):
+                    entry = {
+                        "name": name,
+                        "engine": engine,
+                        "schema": f"schema/{index:04d}.sql",
+                        "data": None,
+                    }
+
+                    schema = self._query(f"SHOW CREATE TABLE {self._qualified(name)} FORMAT TSVRaw")
+                    self._add_bytes(archive, entry["schema"], schema.encode())
+
+                    if engine not in SCHEMA_ONLY_ENGINES:
+                        entry["data"] = f"data/{index:04d}.native"
+                        data_file = Path(scratch) / f"{index:04d}.native"
+
+                        logger.debug(f"Exporting table {name} ({engine})")
+                        with open(data_file, "wb") as f:
+                            subprocess.run(
+                                self._client_command(f"SELECT * FROM {self._qualified(name)} FORMAT Native"),
+                                env=self._env(),
+                                stdout=f,
+                                stderr=subprocess.PIPE,
+                                check=True,
+                            )
+
+                        archive.add(data_file, arcname=entry["data"])
+                        data_file.unlink()
+
+                    manifest["tables"].append(entry)
+
+                self._add_bytes(archive, "manifest.json", json.dumps(manifest, indent=2).encode())
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"clickhouse-client export failed: {error_msg}")
+            raise BackupError(f"ClickHouse backup failed: {error_msg}")
+        except (OSError, tarfile.TarError) as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+
+    @staticmethod
+    def _add_bytes(archive: tarfile.TarFile, name: str, content: bytes) -> None:
+        """Add an in-memory file to a tar archive."""
+        info = tarfile.TarInfo(name)
+        info.size = len(content)
+        archive.addfile(info, io.BytesIO(content))
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore a ClickHouse database from a backup file.
+
+        Args:
+            backup_file: Path to the backup file (.clickhouse.tar.gz or .clickhouse.zip)
+            options: Restore options; `force` allows restoring into tables that contain data
+
+        Raises:
+            BackupError: If target tables contain data without force, or the restore fails
+        """
+        options = options or RestoreOptions()
+        method = options.metadata.get("method")
+
+        if method is None:
+            method = "server" if backup_file.name.endswith(f".{SERVER_BACKUP_EXTENSION}") else "export"
+
+        logger.info(f"Starting ClickHouse restore for database '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        if method == "server":
+            self._restore_server(backup_file, options.force)
+        else:
+            self._restore_export(backup_file, options.force)
+
+        logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+    def _restore_server(self, backup_file: Path, force: bool) -> None:
+        """Place the archive on the backup disk and run RESTORE ... FROM Disk()."""
+        if not self.config.backup_disk:
+            raise BackupError(
+                "This backup was created with BACKUP ... TO Disk(); set CLICKHOUSE_BACKUP_DISK and "
+                "CLICKHOUSE_BACKUP_DISK_PATH to restore it"
+            )
+
+        disk_file = Path(self.config.backup_disk_path) / backup_file.name
+        source = f"Disk({_literal(self.config.backup_disk)}, {_literal(backup_file.name)})"
+        query = f"RESTORE DATABASE {_quote(self.config.database)} FROM {source}"
+        if force:
+            query += " SETTINGS allow_non_empty_tables = true"
+
+        try:
+            shutil.copyfile(backup_file, disk_file)
+        except OSError as e:
+            logger.error(f"Failed to copy backup to disk '{self.config.backup_disk}': {e}")
+            raise BackupError(f"Failed to copy backup to {disk_file}: {e}")
+
+        try:
+            # The database may not exist yet, so the client cannot connect to it
+            self._query(query, database=DEFAULT_DATABASE)
+        except BackupError as e:
+            if "allow_non_empty_tables" in str(e):
+                raise BackupError(
+                    f"Target tables in '{self.database_name}' already contain data, pass --force to restore anyway"
+                )
+            raise
+        finally:
+            disk_file.unlink(missing_ok=True)
+
+    def _restore_export(self, backup_file: Path, force: bool) -> None:
+        """Recreate tables from an export and replay their Native data."""
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                scratch_path = Path(scratch)
+                with tarfile.open(backup_file) as archive:
+                    extract_tar(archive, scratch_path)
+
+                manifest = json.loads((scratch_path / "manifest.json").read_text())
+
+                if manifest["database"] != self.config.database:
+                    raise BackupError(
+                        f"Backup of database '{manifest['database']}' cannot be restored into "
+                        f"'{self.config.database}', its table definitions name the original database"
+                    )
+
+                tables = sorted(manifest["tables"], key=_restore_order)
+                existing = {
+                    table["name"]
+                    for table in tables
+                    if self._query(
+                        f"EXISTS TABLE {self._qualified(table['name'])}", database=DEFAULT_DATABASE
+                    ).strip() == "1"
+                }
+
+                non_empty = [
+                    table["name"]
+                    for table in tables
+                    if table["data"] and table["name"] in existing
+                    and int(self._query(f"SELECT count() FROM {self._qualified(table['name'])}").strip()) > 0
+                ]
+
+                if non_empty and not force:
+                    raise BackupError(
+                        f"Refusing to restore into tables that already contain data: {', '.join(non_empty)}. "
+                        "Pass --force to replace their contents"
+                    )
+
+                self._query(
+                    f"CREATE DATABASE IF NOT EXISTS {_quote(self.config.database)}", database=DEFAULT_DATABASE
+                )
+
+                for table in tables:
+                    name = table["name"]
+
+                    if name not in existing:
+                        logger.debug(f"Creating {table['engine']} {name}")
+                        self._query((scratch_path / table["schema"]).read_text())
+                    elif name in non_empty:
+                        logger.warning(f"Truncating table {name} before restoring its data")
+                        self._query(f"TRUNCATE TABLE {self._qualified(name)}")
+
+                    if table["data"]:
+                        logger.debug(f"Restoring data into {name}")
+                        with open(scratch_path / table["data"], "rb") as f:
+                            subprocess.run(
+                                self._client_command(f"INSERT INTO {self._qualified(name)} FORMAT Native"),
+                                env=self._env(),
+                                stdin=f,
+                                capture_output=True,
+                                check=True,
+                            )
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"clickhouse-client restore failed: {error_msg}")
+            raise BackupError(f"ClickHouse restore failed: {error_msg}")
+        except (OSError, tarfile.TarError, KeyError, ValueError) as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
@@ -0,0 +1,287 @@
+"""CockroachDB backup adapter using native BACKUP and RESTORE statements."""
+
+from __future__ import annotations
+
+import json
+import subprocess
+import time
+from dataclasses import replace
+from datetime import datetime, timezone
+from pathlib import Path
+from urllib.parse import urlencode
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, find_binary
+from nestvault.config import CockroachDBConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("backup.cockroachdb")
+
+# Terminal job states other than success
+FAILED_JOB_STATES = ("failed", "canceled")
+
+
+def _quote_ident(name: str) -> str:
+    """Quote a SQL identifier."""
+    return '"' + name.replace('"', '""') + '"'
+
+
+def _quote_literal(value: str) -> str:
+    """Quote a SQL string literal."""
+    return "'" + value.replace("'", "''") + "'"
+
+
+class CockroachDBBackupAdapter(BackupAdapter):
+    """Backup adapter for CockroachDB using `BACKUP DATABASE ... INTO`.
+
+    The cluster writes the backup straight into the storage bucket; NestVault
+    starts the job, waits for it, and uploads a small JSON pointer file that
+    records the backup's path, job ID and end time. Listing, retention and
+    restore work on the pointer files like on any other backup.
+    """
+
+    def __init__(self, config: CockroachDBConfig, storage: StorageAdapter | None = None):
+        """Initialize the CockroachDB backup adapter.
+
+        Args:
+            config: CockroachDB connection configuration
+            storage: Storage the cluster writes backup collections to
+        """
+        self.config = config
+        self.storage = storage
+        self.job: dict[str, str] = {}
+
+    @property
+    def database_name(self) -> str:
+        """Return the name of the database being backed up."""
+        return self.config.database
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return "crdb.json"
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "cockroachdb"
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including the job and backup path."""
+        return {**super().backup_metadata, **self.job}
+
+    @property
+    def collection(self) -> str:
+        """Return the storage path of this database's backup collection."""
+        return f"{self.config.collection_prefix}/{self.config.database}"
+
+    def use_storage(self, storage: StorageAdapter) -> None:
+        """Set the storage the cluster writes backup collections to."""
+        self.storage = storage
+
+    def for_database(self, database: str) -> CockroachDBBackupAdapter:
+        """Return an adapter for another database on the same cluster."""
+        return CockroachDBBackupAdapter(replace(self.config, database=database), self.storage)
+
+    def _collection_uri(self, collection: str) -> str:
+        """Return the URI, with credentials, the cluster reads and writes a collection at."""
+        if self.storage is None:
+            raise BackupError("CockroachDB backups need a storage backend to write to")
+
+        try:
+            return self.storage.external_location(collection).uri
+        except StorageError as e:
+            raise BackupError(str(e))
+
+    def _connection_url(self) -> str:
+        """Build the connection URL; the password is passed via PGPASSWORD."""
+        params = {"sslmode": self.config.sslmode}
+        if self.config.sslrootcert:
+            params["sslrootcert"] = self.config.sslrootcert
+        if self.config.sslcert:
+            params["sslcert"] = self.config.sslcert
+            params["sslkey"] = self.config.sslkey
+
+        return f"postgresql://{self.config.user}@{self.config.host}:{self.config.port}/defaultdb?{urlencode(params)}"
+
+    def _sql(self, statement: str) -> list[list[str]]:
+        """Run a SQL statement and return its rows.
+
+        The statement is piped through stdin since it may contain storage
+        credentials, which must not appear in the process list.
+
+        Raises:
+            BackupError: If the statement fails
+        """
+        cmd = [
+            find_binary("psql"),
+            self._connection_url(),
+            "-X", "-A", "-t",
+            "-F", "\t",
+            "-v", "ON_ERROR_STOP=1",
+            "-f", "-",
+        ]
+
+        env = {"PGPASSWORD": self.config.password or ""}
+
+        try:
+            result = subprocess.run(cmd, input=statement.encode(), env=env, capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"CockroachDB statement failed: {error_msg}")
+            raise BackupError(f"CockroachDB statement failed: {error_msg}")
+
+        return [line.split("\t") for line in result.stdout.decode().splitlines() if line]
+
+    def _wait_for_job(self, job_id: str) -> str:
+        """Poll a job until it finishes.
+
+        Returns:
+            The job's finish time
+
+        Raises:
+            BackupError: If the job fails or is canceled
+        """
+        last_progress = None
+
+        while True:
+            rows = self._sql(f"SELECT status, fraction_completed, error, finished FROM [SHOW JOB {int(job_id)}]")
+            if not rows:
+                raise BackupError(f"Job {job_id} not found")
+
+            status, fraction, error, finished = rows[0]
+
+            if status == "succeeded":
+                return finished
+            if status in FAILED_JOB_STATES:
+                raise BackupError(f"Job {job_id} {status}: {error or 'no error reported'}")
+
+            progress = f"{float(fraction or 0) * 100:.0f}%"
+            if progress != last_progress:
+                logger.info(f"Job {job_id} {status}: {progress}")
+                last_progress = progress
+
+            time.sleep(self.config.poll_interval)
+
+    def backup(self, output_path: Path) -> Path:
+        """Run a CockroachDB backup into the storage bucket.
+
+        Args:
+            output_path: Directory to write the pointer file to
+
+        Returns:
+            Path to the pointer file describing the backup
+
+        Raises:
+            BackupError: If the backup job fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+        uri = self._collection_uri(self.collection)
+
+        logger.info(f"Starting CockroachDB backup for database '{self.database_name}' into {self.collection}")
+
+        rows = self._sql(
+            f"BACKUP DATABASE {_quote_ident(self.database_name)} INTO {_quote_literal(uri)} "
+            "AS OF SYSTEM TIME '-10s' WITH detached"
+        )
+        job_id = rows[0][0]
+        logger.info(f"Backup job {job_id} started")
+
+        end_time = self._wait_for_job(job_id)
+
+        rows = self._sql(f"SELECT path FROM [SHOW BACKUPS IN {_quote_literal(uri)}] ORDER BY path DESC LIMIT 1")
+        if not rows:
+            raise BackupError(f"Backup job {job_id} succeeded but no backup was found in {self.collection}")
+
+        self.job = {
+            "job_id": job_id,
+            "collection": self.collection,
+            "path": rows[0][0],
+            "end_time": end_time,
+        }
+
+        try:
+            backup_file.write_text(json.dumps({"database": self.database_name, **self.job}, indent=2))
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+
+        logger.info(f"Backup completed: {self.collection}{self.job['path']} (job {job_id})")
+
+        return backup_file
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore a CockroachDB backup with RESTORE DATABASE.
+
+        The database is restored under COCKROACH_RESTORE_DATABASE when set.
+        An existing target database is only dropped and replaced with force.
+
+        Args:
+            backup_file: Path to the pointer file (.crdb.json)
+            options: Restore options
+
+        Raises:
+            BackupError: If the restore operation fails
+        """
+        options = options or RestoreOptions()
+
+        try:
+            pointer = json.loads(backup_file.read_text())
+            source, collection, path = pointer["database"], pointer["collection"], pointer["path"]
+        except (OSError, ValueError, KeyError) as e:
+            raise BackupError(f"Invalid CockroachDB backup pointer {backup_file.name}: {e}")
+
+        target = self.config.restore_database or source
+        uri = self._collection_uri(collection)
+
+        logger.info(f"Starting CockroachDB restore of '{source}' into '{target}'")
+        logger.info(f"Restoring from: {collection}{path}")
+
+        rows = self._sql(f"SELECT count(*) FROM [SHOW DATABASES] WHERE database_name = {_quote_literal(target)}")
+        if rows[0][0] != "0":
+            if not options.force:
+                raise BackupError(f"Database '{target}' already exists, use --force to drop and replace it")
+            logger.warning(f"Dropping existing database '{target}'")
+            self._sql(f"DROP DATABASE {_quote_ident(target)} CASCADE")
+
+        statement = f"RESTORE DATABASE {_quote_ident(source)} FROM {_quote_literal(path)} IN {_quote_literal(uri)} WITH "
+        if target != source:
+            statement += f"new_db_name = {_quote_literal(target)}, "
+        statement += "detached"
+
+        job_id = self._sql(statement)[0][0]
+        logger.info(f"Restore job {job_id} started")
+
+        self._wait_for_job(job_id)
+
+        logger.info(f"Restore completed successfully for database '{target}'")
+
+    def delete_backup_data(self, backup_key: str) -> None:
+        """Delete the backup files the cluster wrote for an expired pointer.
+
+        Args:
+            backup_key: Key of the expired pointer file
+
+        Raises:
+            BackupError: If the backup files cannot be deleted
+        """
+        if self.storage is None:
+            raise BackupError("CockroachDB backups need a storage backend to write to")
+
+        try:
+            metadata = self.storage.get_metadata(backup_key)
+            collection, path = metadata.get("collection"), metadata.get("path")
+            if not collection or not path:
+                logger.warning(f"{backup_key} has no recorded backup path, only deleting the pointer")
+                return
+
+            keys = [obj.key for obj in self.storage.list(prefix=f"{collection}{path}/")]
+            self.storage.delete_many(keys)
+        except StorageError as e:
+            raise BackupError(f"Failed to delete the CockroachDB backup of {backup_key}: {e}")
+
+        logger.info(f"Deleted CockroachDB backup {collection}{path} ({len(keys)} files)")
@@ -0,0 +1,237 @@
+"""Backup adapter that stores another adapter's backups as chunks shared between backups."""
+
+from __future__ import annotations
+
+from dataclasses import replace
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.backup.base import BackupAdapter, DestinationState, RestoreOptions
+from nestvault.compression import decompressed_name, open_reader
+from nestvault.config import CompressionConfig, DedupConfig
+from nestvault.dedup import (
+    INDEX_SUFFIX,
+    ChunkIndex,
+    index_name,
+    indexed_name,
+    lock_backup,
+    reassemble,
+    store_chunks,
+)
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("backup.deduplicated")
+
+
+class DedupBackupAdapter(BackupAdapter):
+    """Wraps another backup adapter and stores its backups deduplicated.
+
+    Each backup is decompressed and split into content-defined chunks,
+    see nestvault.dedup. Chunks the storage already holds are not uploaded
+    again; the backup itself is an index of its chunks, whose key carries
+    the index suffix after the engine's extension. Restore reassembles
+    backups whose metadata records deduplication and passes older backups
+    through unchanged.
+    """
+
+    def __init__(self, adapter: BackupAdapter, config: DedupConfig):
+        """Initialize the deduplicating backup adapter.
+
+        Args:
+            adapter: Backup adapter to delegate to
+            config: Deduplication settings
+        """
+        self.adapter = adapter
+        self.config = config
+        self.storage: StorageAdapter | None = None
+        # Metadata of the last backup, e.g. how many chunks it uploaded
+        self.dedup_metadata: dict[str, str] = {}
+
+    @property
+    def _storage(self) -> StorageAdapter:
+        if self.storage is None:
+            raise BackupError("Deduplicated backups need the storage they are kept in")
+        return self.storage
+
+    @property
+    def _compression(self) -> CompressionConfig:
+        return self.adapter.compression or CompressionConfig(algorithm="none")
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup with the wrapped adapter and upload its new chunks.
+
+        Returns:
+            The backup's index, to upload in place of the backup
+
+        Raises:
+            BackupError: If the backup, or storing its chunks, fails
+        """
+        backup_file = self.adapter.backup(output_path)
+        index_file = backup_file.with_name(index_name(backup_file.name))
+
+        try:
+            lock = lock_backup(self._storage, index_file.name)
+        except StorageError as e:
+            backup_file.unlink(missing_ok=True)
+            raise BackupError(f"Failed to lock the chunk store: {e}")
+
+        try:
+            average_size = self.config.chunk_size_kb * 1024
+            with open_reader(backup_file, self._compression.algorithm) as stream:
+                index = store_chunks(self._storage, stream, self._compression, average_size, output_path)
+            index_file.write_text(index.to_json())
+        except (OSError, StorageError) as e:
+            self._storage.delete(lock)
+            raise BackupError(f"Failed to store chunks of {backup_file.name}: {e}")
+        finally:
+            backup_file.unlink(missing_ok=True)
+
+        logger.info(
+            f"Stored {backup_file.name} as {len(index.chunks)} chunks, "
+            f"{index.new_chunks} of them new ({index.size} bytes uncompressed)"
+        )
+        self.dedup_metadata = {
+            "dedup_chunks": str(len(index.chunks)),
+            "dedup_new_chunks": str(index.new_chunks),
+            "uncompressed_size": str(index.size),
+        }
+        return index_file
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Reassemble a deduplicated backup from its chunks, then restore with the wrapped adapter.
+
+        Raises:
+            BackupError: If reassembling or the restore fails
+        """
+        options = options or RestoreOptions()
+
+        if options.metadata.get("dedup") != "chunks":
+            logger.info("Backup is not deduplicated, restoring as is")
+            self.adapter.restore(backup_file, options)
+            return
+
+        try:
+            index = ChunkIndex.from_json(backup_file.read_text())
+        except (OSError, UnicodeDecodeError, ValueError) as e:
+            raise BackupError(f"Index {backup_file.name} is unreadable: {e}")
+
+        # Chunks hold uncompressed data, so the reassembled backup is restored uncompressed
+        plain = backup_file.with_name(decompressed_name(indexed_name(backup_file.name)))
+        try:
+            reassemble(self._storage, index, plain)
+        except StorageError as e:
+            raise BackupError(f"Failed to download chunks of {backup_file.name}: {e}")
+        logger.info(f"Reassembled {plain.name} from {len(index.chunks)} chunks")
+
+        options.metadata = {**options.metadata, "compression": "none"}
+        self.adapter.restore(plain, options)
+
+    def supports_streaming_restore(self, metadata: dict[str, str]) -> bool:
+        """Return whether the backup is not deduplicated and the wrapped adapter can restore it from a stream."""
+        return metadata.get("dedup") != "chunks" and self.adapter.supports_streaming_restore(metadata)
+
+    def restore_stream(self, name: str, stream: BinaryIO, options: RestoreOptions | None = None) -> None:
+        """Restore a backup that is not deduplicated from a stream with the wrapped adapter.
+
+        Raises:
+            BackupError: If the backup is deduplicated, as it is reassembled from its chunks, or the restore fails
+        """
+        options = options or RestoreOptions()
+        if options.metadata.get("dedup") == "chunks":
+            raise BackupError(f"{name} is deduplicated and is restored from its chunks, not a stream")
+        self.adapter.restore_stream(name, stream, options)
+
+    def restore_commands(self, name: str, options: RestoreOptions, streamed: bool) -> list[str]:
+        """Return the commands the wrapped adapter would run on the backup, reassembled if deduplicated.
+
+        Raises:
+            BackupError: If the backup cannot be restored with these options
+        """
+        if options.metadata.get("dedup") != "chunks":
+            return self.adapter.restore_commands(name, options, streamed)
+        plain_options = replace(options, metadata={**options.metadata, "compression": "none"})
+        return self.adapter.restore_commands(decompressed_name(indexed_name(name)), plain_options, streamed=False)
+
+    def inspect_destination(self) -> DestinationState | None:
+        return self.adapter.inspect_destination()
+
+    @property
+    def deduplicates(self) -> bool:
+        return True
+
+    @property
+    def database_name(self) -> str:
+        return self.adapter.database_name
+
+    @property
+    def archives_wal(self) -> bool:
+        return self.adapter.archives_wal
+
+    def server_version(self) -> str | None:
+        return self.adapter.server_version()
+
+    def database_size(self) -> int | None:
+        return self.adapter.database_size()
+
+    def fingerprint(self) -> str | None:
+        return self.adapter.fingerprint()
+
+    @property
+    def location(self) -> str:
+        return self.adapter.location
+
+    @property
+    def dsn(self) -> str:
+        return self.adapter.dsn
+
+    @property
+    def file_extension(self) -> str:
+        return f"{self.adapter.file_extension}{INDEX_SUFFIX}"
+
+    @property
+    def engine(self) -> str:
+        return self.adapter.engine
+
+    @property
+    def compression(self) -> CompressionConfig | None:
+        return self.adapter.compression
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return the wrapped adapter's metadata and the chunks of the last backup."""
+        return {**self.adapter.backup_metadata, "dedup": "chunks", **self.dedup_metadata}
+
+    def backup_companions(self, backup_file: Path) -> dict[str, Path]:
+        return self.adapter.backup_companions(backup_file.with_name(indexed_name(backup_file.name)))
+
+    def expand(self) -> list[BackupAdapter]:
+        return [self._wrap(adapter) for adapter in self.adapter.expand()]
+
+    def for_database(self, database: str) -> BackupAdapter:
+        return self._wrap(self.adapter.for_database(database))
+
+    def _wrap(self, adapter: BackupAdapter) -> DedupBackupAdapter:
+        wrapped = DedupBackupAdapter(adapter, self.config)
+        wrapped.storage = self.storage
+        return wrapped
+
+    def is_own_backup(self, backup_key: str) -> bool:
+        return self.adapter.is_own_backup(indexed_name(backup_key))
+
+    def use_storage(self, storage: StorageAdapter) -> None:
+        self.storage = storage
+        self.adapter.use_storage(storage)
+
+    def use_credentials(self, username: str, password: str) -> None:
+        self.adapter.use_credentials(username, password)
+
+    def use_tunnel(self, port: int | None) -> None:
+        self.adapter.use_tunnel(port)
+
+    def check_tls(self) -> str | None:
+        return self.adapter.check_tls()
+
+    def delete_backup_data(self, backup_key: str) -> None:
+        self.adapter.delete_backup_data(indexed_name(backup_key))
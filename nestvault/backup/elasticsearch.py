@@ -0,0 +1,319 @@
+"""Elasticsearch/OpenSearch backup adapter using the snapshot API."""
+
+from __future__ import annotations
+
+import base64
+import json
+import re
+import ssl
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions
+from nestvault.config import ElasticsearchConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("backup.elasticsearch")
+
+# Snapshot states after which a snapshot no longer changes
+FINISHED_STATES = ("SUCCESS", "PARTIAL", "FAILED", "INCOMPATIBLE")
+
+
+class ElasticsearchBackupAdapter(BackupAdapter):
+    """Backup adapter for Elasticsearch and OpenSearch snapshots.
+
+    The cluster writes snapshots into an S3 repository in the storage bucket;
+    NestVault registers the repository, starts the snapshot, waits for it,
+    and uploads a small JSON pointer file recording the snapshot name and
+    shard stats. Expired pointers delete their snapshot through the API.
+    """
+
+    def __init__(self, config: ElasticsearchConfig, storage: StorageAdapter | None = None):
+        """Initialize the Elasticsearch backup adapter.
+
+        Args:
+            config: Cluster connection configuration
+            storage: Storage the snapshot repository lives in
+        """
+        self.config = config
+        self.storage = storage
+        self.snapshot: dict[str, str] = {}
+
+    @property
+    def database_name(self) -> str:
+        """Return the name used to identify this cluster's backups."""
+        return self.config.name
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return "es-snapshot.json"
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "elasticsearch"
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including snapshot state and shard stats."""
+        return {**super().backup_metadata, **self.snapshot}
+
+    def use_storage(self, storage: StorageAdapter) -> None:
+        """Set the storage the snapshot repository lives in."""
+        self.storage = storage
+
+    def _request(self, method: str, path: str, payload=None, allow_missing: bool = False, timeout: float | None = 300):
+        """Send an authenticated API request and decode the JSON response.
+
+        Returns:
+            The decoded response, or None on HTTP 404 when allow_missing is set
+
+        Raises:
+            BackupError: If the cluster returns an error or cannot be reached
+        """
+        headers = {"Content-Type": "application/json"}
+        if self.config.api_key:
+            headers["Authorization"] = f"ApiKey {self.config.api_key}"
+        elif self.config.user:
+            credentials = base64.b64encode(f"{self.config.user}:{self.config.password}".encode()).decode()
+            headers["Authorization"] = f"Basic {credentials}"
+
+        request = urllib.request.Request(
+            f"{self.config.url}{path}",
+            data=json.dumps(payload).encode() if payload is not None else None,
+            method=method,
+            headers=headers,
+        )
+        context = ssl.create_default_context(cafile=self.config.ca_cert) if self.config.ca_cert else None
+
+        try:
+            with urllib.request.urlopen(request, timeout=timeout, context=context) as response:
+                return json.load(response)
+        except urllib.error.HTTPError as e:
+            if allow_missing and e.code == 404:
+                return None
+            detail = e.read().decode(errors="replace")
+            raise BackupError(f"Cluster API {method} {path} failed with HTTP {e.code}: {detail}")
+        except (urllib.error.URLError, OSError, ValueError) as e:
+            raise BackupError(f"Failed to reach cluster at {self.config.url}: {e}")
+
+    def _ensure_repository(self) -> None:
+        """Register the snapshot repository, or check an existing one points at our bucket.
+
+        Raises:
+            BackupError: If the repository points elsewhere or fails verification
+        """
+        if self.storage is None:
+            raise BackupError("Snapshots need a storage backend for the repository")
+
+        try:
+            location = self.storage.external_location(self.config.base_path)
+        except StorageError as e:
+            raise BackupError(str(e))
+
+        repository = urllib.parse.quote(self.config.repository)
+        existing = self._request("GET", f"/_snapshot/{repository}", allow_missing=True)
+
+        if existing is None:
+            logger.info(f"Registering snapshot repository '{self.config.repository}' at s3://{location.bucket}/{location.key}")
+            self._request("PUT", f"/_snapshot/{repository}", {
+                "type": "s3",
+                "settings": {
+                    "bucket": location.bucket,
+                    "base_path": location.key,
+                    "client": self.config.client,
+                },
+            })
+        else:
+            settings = existing[self.config.repository].get("settings", {})
+            if (settings.get("bucket"), settings.get("base_path", "")) != (location.bucket, location.key):
+                raise BackupError(
+                    f"Snapshot repository '{self.config.repository}' points at "
+                    f"s3://{settings.get('bucket')}/{settings.get('base_path', '')}, "
+                    f"expected s3://{location.bucket}/{location.key}"
+                )
+
+        result = self._request("POST", f"/_snapshot/{repository}/_verify")
+        logger.debug(f"Repository verified by {len(result.get('nodes', {}))} nodes")
+
+    def _snapshot_path(self, snapshot: str) -> str:
+        """Return the API path of a snapshot in the repository."""
+        return f"/_snapshot/{urllib.parse.quote(self.config.repository)}/{urllib.parse.quote(snapshot)}"
+
+    def backup(self, output_path: Path) -> Path:
+        """Take a cluster snapshot into the repository.
+
+        PARTIAL snapshots are kept but logged as warnings, since some shards
+        are missing from them.
+
+        Args:
+            output_path: Directory to write the pointer file to
+
+        Returns:
+            Path to the pointer file describing the snapshot
+
+        Raises:
+            BackupError: If the snapshot fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        snapshot = f"{self.database_name}_{timestamp}"
+        filename = f"{snapshot}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        self._ensure_repository()
+
+        logger.info(f"Starting snapshot '{snapshot}' in repository '{self.config.repository}'")
+
+        body = {
+            "include_global_state": self.config.include_global_state,
+            "metadata": {"taken_by": "nestvault"},
+        }
+        if self.config.indices:
+            body["indices"] = ",".join(self.config.indices)
+
+        self._request("PUT", f"{self._snapshot_path(snapshot)}?wait_for_completion=false", body)
+
+        while True:
+            info = self._request("GET", self._snapshot_path(snapshot))["snapshots"][0]
+            if info["state"] in FINISHED_STATES:
+                break
+            logger.debug(f"Snapshot '{snapshot}' {info['state']}")
+            time.sleep(self.config.poll_interval)
+
+        shards = info.get("shards", {})
+        self.snapshot = {
+            "repository": self.config.repository,
+            "snapshot": snapshot,
+            "state": info["state"],
+            "shards_total": str(shards.get("total", 0)),
+            "shards_successful": str(shards.get("successful", 0)),
+            "shards_failed": str(shards.get("failed", 0)),
+        }
+
+        if info["state"] in ("FAILED", "INCOMPATIBLE"):
+            reasons = "; ".join(failure.get("reason", "") for failure in info.get("failures", []))
+            raise BackupError(f"Snapshot '{snapshot}' {info['state']}: {reasons or info.get('reason', 'no reason reported')}")
+
+        if info["state"] == "PARTIAL":
+            logger.warning(
+                f"Snapshot '{snapshot}' is PARTIAL: {self.snapshot['shards_failed']} of "
+                f"{self.snapshot['shards_total']} shards failed"
+            )
+
+        try:
+            backup_file.write_text(json.dumps({**self.snapshot, "indices": info.get("indices", [])}, indent=2))
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+
+        logger.info(
+            f"Backup completed: snapshot '{snapshot}' {info['state']} "
+            f"({self.snapshot['shards_successful']}/{self.snapshot['shards_total']} shards)"
+        )
+
+        return backup_file
+
+    def _target_indices(self, indices: list[str]) -> list[str]:
+        """Return the names indices get after the configured rename."""
+        if not self.config.rename_pattern:
+            return indices
+
+        # The cluster uses Java replacement syntax ($1) rather than Python's (\1)
+        replacement = re.sub(r"\$(\d+)", r"\\g<\1>", self.config.rename_replacement)
+        return [re.sub(self.config.rename_pattern, replacement, index) for index in indices]
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore indices from a snapshot.
+
+        Existing indices with the same names are closed first with force, so
+        the restore can replace them; otherwise the restore is refused.
+
+        Args:
+            backup_file: Path to the pointer file (.es-snapshot.json)
+            options: Restore options
+
+        Raises:
+            BackupError: If the restore fails
+        """
+        options = options or RestoreOptions()
+
+        try:
+            pointer = json.loads(backup_file.read_text())
+            snapshot, indices = pointer["snapshot"], pointer["indices"]
+        except (OSError, ValueError, KeyError) as e:
+            raise BackupError(f"Invalid snapshot pointer {backup_file.name}: {e}")
+
+        if pointer.get("repository", self.config.repository) != self.config.repository:
+            raise BackupError(
+                f"Snapshot '{snapshot}' is in repository '{pointer['repository']}', "
+                f"not '{self.config.repository}'"
+            )
+
+        if self.config.restore_indices:
+            indices = [index for index in indices if index in self.config.restore_indices]
+            if not indices:
+                raise BackupError(f"Snapshot '{snapshot}' contains none of the requested indices")
+
+        logger.info(f"Starting restore of snapshot '{snapshot}' ({len(indices)} indices)")
+
+        existing = {row["index"] for row in self._request("GET", "/_cat/indices?h=index&format=json&expand_wildcards=all")}
+        conflicts = sorted(existing & set(self._target_indices(indices)))
+
+        if conflicts:
+            if not options.force:
+                raise BackupError(
+                    f"Indices already exist: {', '.join(conflicts)}. Use --force to replace them "
+                    "or set ELASTICSEARCH_RESTORE_RENAME_PATTERN"
+                )
+            logger.warning(f"Closing existing indices to restore over them: {', '.join(conflicts)}")
+            self._request("POST", f"/{','.join(urllib.parse.quote(index) for index in conflicts)}/_close")
+
+        body = {
+            "indices": ",".join(indices),
+            "include_global_state": self.config.include_global_state,
+        }
+        if self.config.rename_pattern:
+            body["rename_pattern"] = self.config.rename_pattern
+            body["rename_replacement"] = self.config.rename_replacement
+
+        result = self._request(
+            "POST",
+            f"{self._snapshot_path(snapshot)}/_restore?wait_for_completion=true",
+            body,
+            timeout=None,
+        )
+
+        shards = result.get("snapshot", {}).get("shards", {})
+        if shards.get("failed"):
+            raise BackupError(f"Restore of '{snapshot}' failed for {shards['failed']} of {shards.get('total')} shards")
+
+        logger.info(f"Restore completed successfully for snapshot '{snapshot}'")
+
+    def delete_backup_data(self, backup_key: str) -> None:
+        """Delete the snapshot behind an expired pointer file.
+
+        Args:
+            backup_key: Key of the expired pointer file
+
+        Raises:
+            BackupError: If the snapshot cannot be deleted
+        """
+        snapshot = backup_key.removesuffix(f".{self.file_extension}")
+        if self.storage is not None:
+            # Pointers uploaded under a key template are named differently from their snapshot
+            try:
+                snapshot = self.storage.get_metadata(backup_key).get("snapshot", snapshot)
+            except StorageError as e:
+                raise BackupError(f"Failed to read the pointer {backup_key}: {e}")
+
+        if self._request("DELETE", self._snapshot_path(snapshot), allow_missing=True) is None:
+            logger.warning(f"Snapshot '{snapshot}' no longer exists")
+        else:
+            logger.info(f"Deleted snapshot '{snapshot}'")
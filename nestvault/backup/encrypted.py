@@ -0,0 +1,256 @@
+"""Backup adapter that encrypts another adapter's backups."""
+
+from __future__ import annotations
+
+import time
+from collections.abc import Iterator
+from contextlib import contextmanager
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.backup.base import BackupAdapter, DestinationState, RestoreOptions
+from nestvault.config import CompressionConfig
+from nestvault.encryption import Cipher, decrypted_name, encrypted_name
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+from nestvault.stats import record
+from nestvault.storage.base import StorageAdapter
+from nestvault.streaming import IteratorReader
+from nestvault.tracing import span
+
+logger = get_logger("backup.encrypted")
+
+
+class EncryptedBackupAdapter(BackupAdapter):
+    """Wraps another backup adapter and encrypts its backups and companions.
+
+    Backups are encrypted right after they are created, so plaintext never
+    reaches any storage destination. Keys carry the cipher's suffix after
+    the engine's extension; restore decrypts backups whose metadata records
+    encryption and passes older plaintext backups through unchanged.
+    """
+
+    def __init__(self, adapter: BackupAdapter, cipher: Cipher):
+        """Initialize the encrypted backup adapter.
+
+        Args:
+            adapter: Backup adapter to delegate to
+            cipher: Cipher to encrypt backups with
+        """
+        self.adapter = adapter
+        self.cipher = cipher
+        # Metadata of the last encrypted backup, e.g. a wrapped data key
+        self.encryption_metadata: dict[str, str] = {}
+
+    def _encrypt(self, plaintext: Path) -> tuple[Path, dict[str, str]]:
+        """Encrypt a file next to itself and delete the plaintext.
+
+        Returns:
+            The encrypted file and the cipher's metadata for it
+        """
+        encrypted = plaintext.with_name(encrypted_name(plaintext.name, self.cipher.mode))
+        started = time.perf_counter()
+
+        try:
+            with span("encrypt", mode=self.cipher.mode) as traced:
+                metadata = self.cipher.encrypt(plaintext, encrypted)
+                bytes_in, bytes_out = plaintext.stat().st_size, encrypted.stat().st_size
+                record("encrypt", time.perf_counter() - started, bytes_in, bytes_out)
+                traced.set(bytes_in=bytes_in, bytes_out=bytes_out)
+        except BackupError:
+            encrypted.unlink(missing_ok=True)
+            raise
+        finally:
+            plaintext.unlink(missing_ok=True)
+
+        logger.info(f"Encrypted {plaintext.name} with {self.cipher.mode}")
+        return encrypted, metadata
+
+    def _decrypt(self, encrypted: Path, metadata: dict[str, str]) -> Path:
+        """Decrypt a file next to itself."""
+        plaintext = encrypted.with_name(decrypted_name(encrypted.name))
+        self.cipher.decrypt(encrypted, plaintext, metadata)
+        logger.info(f"Decrypted {encrypted.name}")
+        return plaintext
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup with the wrapped adapter and encrypt it.
+
+        Raises:
+            BackupError: If the backup or its encryption fails
+        """
+        encrypted, self.encryption_metadata = self._encrypt(self.adapter.backup(output_path))
+        return encrypted
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether both the wrapped adapter and the cipher can stream."""
+        return self.adapter.supports_streaming and self.cipher.supports_streaming
+
+    @contextmanager
+    def stream_backup(self) -> Iterator[tuple[str, BinaryIO]]:
+        """Stream the wrapped adapter's backup, encrypting it as it is read.
+
+        Raises:
+            BackupError: If the backup or its encryption cannot be streamed or fails
+        """
+        if not self.cipher.supports_streaming:
+            raise BackupError(f"{self.cipher.mode} encryption does not support streaming")
+
+        with self.adapter.stream_backup() as (name, plaintext):
+            chunks, self.encryption_metadata = self.cipher.encrypt_stream(plaintext)
+            stream = IteratorReader(chunks)
+            try:
+                yield encrypted_name(name, self.cipher.mode), stream
+            finally:
+                stream.close()
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Decrypt a backup and its companions, then restore with the wrapped adapter.
+
+        Raises:
+            BackupError: If decryption or the restore fails
+        """
+        options = options or RestoreOptions()
+        mode = options.metadata.get("encryption")
+
+        if mode is None:
+            logger.info("Backup is not encrypted, restoring as is")
+            self.adapter.restore(backup_file, options)
+            return
+
+        if mode != self.cipher.mode:
+            raise BackupError(f"Backup is encrypted with {mode}, but ENCRYPTION={self.cipher.mode} is configured")
+
+        plaintext = self._decrypt(backup_file, options.metadata)
+        options.companions = {
+            kind: self._decrypt(path, options.metadata) for kind, path in options.companions.items()
+        }
+
+        self.adapter.restore(plaintext, options)
+
+    def supports_streaming_restore(self, metadata: dict[str, str]) -> bool:
+        """Return whether the cipher can decrypt the backup as it is read and the wrapped adapter restore it."""
+        mode = metadata.get("encryption")
+        if mode is not None and (mode != self.cipher.mode or not self.cipher.supports_streaming):
+            return False
+        return self.adapter.supports_streaming_restore(metadata)
+
+    def restore_stream(self, name: str, stream: BinaryIO, options: RestoreOptions | None = None) -> None:
+        """Decrypt a backup as it is read, restoring it with the wrapped adapter.
+
+        Raises:
+            BackupError: If decryption or the restore fails
+            IntegrityError: If part of the backup fails authentication, which stops the restore
+        """
+        options = options or RestoreOptions()
+        mode = options.metadata.get("encryption")
+
+        if mode is None:
+            logger.info("Backup is not encrypted, restoring as is")
+            self.adapter.restore_stream(name, stream, options)
+            return
+
+        if mode != self.cipher.mode:
+            raise BackupError(f"Backup is encrypted with {mode}, but ENCRYPTION={self.cipher.mode} is configured")
+
+        plaintext = IteratorReader(self.cipher.decrypt_stream(stream, name, options.metadata))
+        try:
+            self.adapter.restore_stream(decrypted_name(name), plaintext, options)
+        finally:
+            plaintext.close()
+
+    def restore_commands(self, name: str, options: RestoreOptions, streamed: bool) -> list[str]:
+        """Return the commands the wrapped adapter would run on the decrypted backup.
+
+        Raises:
+            BackupError: If the backup is encrypted with another cipher or cannot be restored with these options
+        """
+        mode = options.metadata.get("encryption")
+        if mode is None:
+            return self.adapter.restore_commands(name, options, streamed)
+        if mode != self.cipher.mode:
+            raise BackupError(f"Backup is encrypted with {mode}, but ENCRYPTION={self.cipher.mode} is configured")
+        return self.adapter.restore_commands(decrypted_name(name), options, streamed)
+
+    def inspect_destination(self) -> DestinationState | None:
+        return self.adapter.inspect_destination()
+
+    @property
+    def database_name(self) -> str:
+        return self.adapter.database_name
+
+    @property
+    def archives_wal(self) -> bool:
+        return self.adapter.archives_wal
+
+    @property
+    def deduplicates(self) -> bool:
+        return self.adapter.deduplicates
+
+    def server_version(self) -> str | None:
+        return self.adapter.server_version()
+
+    def database_size(self) -> int | None:
+        return self.adapter.database_size()
+
+    def fingerprint(self) -> str | None:
+        return self.adapter.fingerprint()
+
+    @property
+    def location(self) -> str:
+        return self.adapter.location
+
+    @property
+    def dsn(self) -> str:
+        return self.adapter.dsn
+
+    @property
+    def file_extension(self) -> str:
+        return encrypted_name(self.adapter.file_extension, self.cipher.mode)
+
+    @property
+    def engine(self) -> str:
+        return self.adapter.engine
+
+    @property
+    def compression(self) -> CompressionConfig | None:
+        return self.adapter.compression
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return the wrapped adapter's metadata and the encryption of the last backup."""
+        return {**self.adapter.backup_metadata, "encryption": self.cipher.mode, **self.encryption_metadata}
+
+    def backup_companions(self, backup_file: Path) -> dict[str, Path]:
+        """Create the wrapped adapter's companions and encrypt them.
+
+        Raises:
+            BackupError: If creating or encrypting a companion fails
+        """
+        companions = self.adapter.backup_companions(backup_file.with_name(decrypted_name(backup_file.name)))
+        return {kind: self._encrypt(path)[0] for kind, path in companions.items()}
+
+    def expand(self) -> list[BackupAdapter]:
+        return [EncryptedBackupAdapter(adapter, self.cipher) for adapter in self.adapter.expand()]
+
+    def for_database(self, database: str) -> BackupAdapter:
+        return EncryptedBackupAdapter(self.adapter.for_database(database), self.cipher)
+
+    def is_own_backup(self, backup_key: str) -> bool:
+        return self.adapter.is_own_backup(decrypted_name(backup_key))
+
+    def use_storage(self, storage: StorageAdapter) -> None:
+        self.adapter.use_storage(storage)
+
+    def use_credentials(self, username: str, password: str) -> None:
+        self.adapter.use_credentials(username, password)
+
+    def use_tunnel(self, port: int | None) -> None:
+        self.adapter.use_tunnel(port)
+
+    def check_tls(self) -> str | None:
+        return self.adapter.check_tls()
+
+    def delete_backup_data(self, backup_key: str) -> None:
+        self.adapter.delete_backup_data(decrypted_name(backup_key))
@@ -0,0 +1,254 @@
+"""etcd backup adapter using etcdctl snapshots."""
+
+from __future__ import annotations
+
+import json
+import shutil
+import subprocess
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, find_binary
+from nestvault.compression import compressed_extension, decompressed_name, open_reader, open_writer
+from nestvault.config import CompressionConfig, EtcdConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.etcd")
+
+
+class EtcdBackupAdapter(BackupAdapter):
+    """Backup adapter for etcd using `etcdctl snapshot save`.
+
+    The revision and hash reported by `snapshot status` are recorded with
+    each backup and checked again before a restore.
+    """
+
+    def __init__(self, config: EtcdConfig):
+        """Initialize the etcd backup adapter.
+
+        Args:
+            config: etcd connection configuration
+        """
+        self.config = config
+        self.snapshot_status: dict[str, str] = {}
+
+    @property
+    def database_name(self) -> str:
+        """Return the name used to identify this cluster's backups."""
+        return self.config.name
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return compressed_extension("snapshot.db", self.config.compression)
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "etcd"
+
+    @property
+    def compression(self) -> CompressionConfig:
+        """Return how backups are compressed."""
+        return self.config.compression
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including revision and hash."""
+        return {**super().backup_metadata, **self.snapshot_status}
+
+    def _env(self) -> dict[str, str]:
+        """Build the etcdctl environment; credentials stay out of the process list."""
+        env = {
+            "ETCDCTL_API": "3",
+        }
+        if self.config.user:
+            env["ETCDCTL_USER"] = f"{self.config.user}:{self.config.password or ''}"
+        return env
+
+    def _tls_args(self) -> list[str]:
+        """Build the TLS arguments for etcdctl."""
+        args = []
+        if self.config.ca_cert:
+            args.extend(["--cacert", self.config.ca_cert])
+        if self.config.cert:
+            args.extend(["--cert", self.config.cert, "--key", self.config.key])
+        return args
+
+    def _status(self, snapshot_file: Path) -> dict[str, str]:
+        """Read revision, hash and key count from a snapshot file.
+
+        Raises:
+            BackupError: If the snapshot cannot be read
+        """
+        # etcdutl replaced `etcdctl snapshot status` in etcd 3.5
+        cmd = [find_binary("etcdutl", "etcdctl"), "snapshot", "status", str(snapshot_file), "--write-out", "json"]
+
+        try:
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+            status = json.loads(result.stdout)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"snapshot status failed: {error_msg}")
+            raise BackupError(f"Failed to read etcd snapshot status: {error_msg}")
+        except ValueError as e:
+            raise BackupError(f"Unexpected etcd snapshot status output: {e}")
+
+        return {
+            "revision": str(status["revision"]),
+            "hash": str(status["hash"]),
+            "total_keys": str(status["totalKey"]),
+        }
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a snapshot of the etcd cluster.
+
+        `snapshot save` talks to a single member, so endpoints are tried in
+        order until one succeeds.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file (compressed)
+
+        Raises:
+            BackupError: If no endpoint produced a snapshot
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+        snapshot_file = output_path / f"{self.database_name}_{timestamp}.db"
+
+        logger.info(f"Starting etcd snapshot for '{self.database_name}'")
+
+        etcdctl = find_binary("etcdctl")
+        errors = []
+
+        try:
+            for endpoint in self.config.endpoints:
+                cmd = [
+                    etcdctl,
+                    "--endpoints", endpoint,
+                    *self._tls_args(),
+                    "snapshot", "save", str(snapshot_file),
+                ]
+
+                try:
+                    logger.debug(f"Executing etcdctl snapshot save against {endpoint}")
+                    subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+                    break
+                except subprocess.CalledProcessError as e:
+                    error_msg = e.stderr.decode() if e.stderr else str(e)
+                    logger.warning(f"Snapshot from {endpoint} failed: {error_msg}")
+                    errors.append(f"{endpoint}: {error_msg.strip()}")
+            else:
+                raise BackupError(f"etcd snapshot failed on every endpoint: {'; '.join(errors)}")
+
+            self.snapshot_status = self._status(snapshot_file)
+            logger.info(
+                f"Snapshot at revision {self.snapshot_status['revision']} "
+                f"(hash {self.snapshot_status['hash']}, {self.snapshot_status['total_keys']} keys)"
+            )
+
+            logger.debug(f"Compressing snapshot to {backup_file}")
+            with open(snapshot_file, "rb") as src, open_writer(backup_file, self.config.compression) as dst:
+                shutil.copyfileobj(src, dst)
+
+            file_size = backup_file.stat().st_size
+            logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+            return backup_file
+
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+        finally:
+            snapshot_file.unlink(missing_ok=True)
+            # etcdctl leaves a .part file behind when a save is interrupted
+            Path(f"{snapshot_file}.part").unlink(missing_ok=True)
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore an etcd snapshot.
+
+        The snapshot's hash is checked against the one recorded at backup
+        time. With ETCD_RESTORE_DATA_DIR set, `etcdutl snapshot restore`
+        builds a new data directory; otherwise the snapshot file is written
+        to ETCD_RESTORE_PATH.
+
+        Args:
+            backup_file: Path to the backup file (.snapshot.db.gz or .snapshot.db.zst)
+            options: Restore options including the recorded backup metadata
+
+        Raises:
+            BackupError: If the snapshot does not match its recorded hash, or the restore fails
+        """
+        options = options or RestoreOptions()
+        target = Path(self.config.restore_path)
+        partial = backup_file.with_name(decompressed_name(backup_file.name))
+
+        logger.info(f"Starting etcd restore for '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        try:
+            with open_reader(backup_file, options.metadata.get("compression")) as src, open(partial, "wb") as dst:
+                shutil.copyfileobj(src, dst)
+        except OSError as e:
+            logger.error(f"Failed to decompress snapshot: {e}")
+            raise BackupError(f"Failed to decompress snapshot: {e}")
+
+        status = self._status(partial)
+        recorded_hash = options.metadata.get("hash")
+
+        if recorded_hash is None:
+            logger.warning("Backup has no recorded snapshot hash, skipping integrity check")
+        elif status["hash"] != recorded_hash:
+            raise BackupError(
+                f"Snapshot hash {status['hash']} does not match the hash recorded at backup time ({recorded_hash})"
+            )
+
+        logger.info(f"Snapshot verified at revision {status['revision']}")
+
+        if self.config.restore_data_dir:
+            self._restore_data_dir(partial)
+            return
+
+        try:
+            target.parent.mkdir(parents=True, exist_ok=True)
+            shutil.move(partial, target)
+        except OSError as e:
+            logger.error(f"Failed to write snapshot: {e}")
+            raise BackupError(f"Failed to write snapshot to {target}: {e}")
+
+        logger.info(f"Snapshot written to {target}")
+        logger.info("To restore it run: etcdutl snapshot restore <file> --data-dir <new data dir>")
+
+    def _restore_data_dir(self, snapshot_file: Path) -> None:
+        """Run `etcdutl snapshot restore` into an empty data directory."""
+        data_dir = Path(self.config.restore_data_dir)
+
+        if data_dir.exists():
+            if any(data_dir.iterdir()):
+                raise BackupError(f"Refusing to restore into non-empty data directory: {data_dir}")
+            # etcdutl creates the data directory itself and refuses an existing one
+            data_dir.rmdir()
+
+        cmd = [find_binary("etcdutl", "etcdctl"), "snapshot", "restore", str(snapshot_file), "--data-dir", str(data_dir)]
+
+        if self.config.restore_member_name:
+            cmd.extend(["--name", self.config.restore_member_name])
+        if self.config.initial_cluster:
+            cmd.extend(["--initial-cluster", self.config.initial_cluster])
+        if self.config.initial_advertise_peer_urls:
+            cmd.extend(["--initial-advertise-peer-urls", self.config.initial_advertise_peer_urls])
+
+        try:
+            logger.debug("Executing snapshot restore")
+            subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"snapshot restore failed: {error_msg}")
+            raise BackupError(f"etcd restore failed: {error_msg}")
+
+        logger.info(f"Restore completed, start etcd with --data-dir {data_dir}")
@@ -0,0 +1,362 @@
+"""InfluxDB 2.x backup adapter using the backup and restore HTTP API."""
+
+from __future__ import annotations
+
+import email.parser
+import json
+import shutil
+import tarfile
+import tempfile
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, extract_tar
+from nestvault.config import InfluxDBConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.influxdb")
+
+# Read shards in chunks so large shards are never held in memory
+CHUNK_SIZE = 1024 * 1024
+
+
+class InfluxDBBackupAdapter(BackupAdapter):
+    """Backup adapter for InfluxDB 2.x.
+
+    Fetches the metadata snapshot from `/api/v2/backup/metadata` and every
+    shard of the selected buckets from `/api/v2/backup/shards/{id}`, and
+    bundles them into one tarball. Shard downloads are retried before the
+    backup is marked failed.
+    """
+
+    def __init__(self, config: InfluxDBConfig):
+        """Initialize the InfluxDB backup adapter.
+
+        Args:
+            config: InfluxDB connection configuration
+        """
+        self.config = config
+        self.backed_up_buckets: list[str] = []
+
+    @property
+    def database_name(self) -> str:
+        """Return the name used to identify this instance's backups."""
+        return self.config.name
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return "influx.tar"
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "influxdb"
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including the buckets it holds."""
+        metadata = super().backup_metadata
+        if self.backed_up_buckets:
+            metadata["buckets"] = ",".join(self.backed_up_buckets)
+        return metadata
+
+    def _request(
+        self,
+        method: str,
+        path: str,
+        body: bytes | None = None,
+        headers: dict[str, str] | None = None,
+        allow_missing: bool = False,
+    ):
+        """Send an authenticated API request and return the open response.
+
+        Returns:
+            The open response, or None on HTTP 404 when allow_missing is set
+
+        Raises:
+            BackupError: If the server returns an error or cannot be reached
+        """
+        request = urllib.request.Request(
+            f"{self.config.url}{path}",
+            data=body,
+            method=method,
+            headers={"Authorization": f"Token {self.config.token}", **(headers or {})},
+        )
+
+        try:
+            return urllib.request.urlopen(request, timeout=300)
+        except urllib.error.HTTPError as e:
+            if allow_missing and e.code == 404:
+                return None
+            detail = e.read().decode(errors="replace")
+            raise BackupError(f"InfluxDB API {method} {path} failed with HTTP {e.code}: {detail}")
+        except (urllib.error.URLError, OSError) as e:
+            raise BackupError(f"Failed to reach InfluxDB at {self.config.url}: {e}")
+
+    def _request_json(self, method: str, path: str, payload=None):
+        """Send a JSON API request and decode the JSON response."""
+        body = json.dumps(payload).encode() if payload is not None else None
+        headers = {"Content-Type": "application/json"} if body is not None else {}
+
+        with self._request(method, path, body, headers) as response:
+            return json.load(response)
+
+    def _fetch_metadata(self) -> dict[str, bytes]:
+        """Download the metadata snapshot and split its multipart parts by name.
+
+        Returns:
+            Parts keyed by name: 'kv' (BoltDB), 'sql' (SQLite) and 'buckets' (JSON)
+        """
+        with self._request("GET", "/api/v2/backup/metadata") as response:
+            content_type = response.headers["Content-Type"]
+            body = response.read()
+
+        message = email.parser.BytesParser().parsebytes(
+            f"Content-Type: {content_type}\r\n\r\n".encode() + body
+        )
+
+        parts = {}
+        for part in message.walk():
+            name = part.get_param("name", header="content-disposition")
+            if name:
+                parts[name] = part.get_payload(decode=True)
+
+        missing = {"kv", "sql", "buckets"} - parts.keys()
+        if missing:
+            raise BackupError(f"InfluxDB metadata backup is missing parts: {', '.join(sorted(missing))}")
+
+        return parts
+
+    def _select_buckets(self, manifests: list[dict]) -> list[dict]:
+        """Filter bucket manifests by the configured organization and bucket names."""
+        selected = [
+            manifest
+            for manifest in manifests
+            if (not self.config.org or manifest["organizationName"] == self.config.org)
+            and (not self.config.buckets or manifest["bucketName"] in self.config.buckets)
+        ]
+
+        missing = set(self.config.buckets) - {manifest["bucketName"] for manifest in selected}
+        if missing:
+            raise BackupError(f"Buckets not found: {', '.join(sorted(missing))}")
+
+        return selected
+
+    def _download_shard(self, shard_id: int, destination: Path) -> bool:
+        """Download one shard, retrying transient failures.
+
+        Returns:
+            False if the shard no longer exists (deleted by retention), True otherwise
+
+        Raises:
+            BackupError: If the shard could not be downloaded after all retries
+        """
+        attempts = self.config.shard_retries + 1
+
+        for attempt in range(1, attempts + 1):
+            try:
+                response = self._request(
+                    "GET",
+                    f"/api/v2/backup/shards/{shard_id}",
+                    headers={"Accept-Encoding": "gzip"},
+                    allow_missing=True,
+                )
+                if response is None:
+                    logger.warning(f"Shard {shard_id} no longer exists, skipping")
+                    return False
+
+                with response, open(destination, "wb") as f:
+                    shutil.copyfileobj(response, f, CHUNK_SIZE)
+                return True
+
+            except (BackupError, OSError) as e:
+                if attempt == attempts:
+                    raise BackupError(f"Failed to download shard {shard_id} after {attempts} attempts: {e}")
+
+                delay = 2 ** (attempt - 1)
+                logger.warning(f"Shard {shard_id} download failed (attempt {attempt}/{attempts}), retrying in {delay}s: {e}")
+                time.sleep(delay)
+
+        return False
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup of the InfluxDB instance.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        logger.info(f"Starting InfluxDB backup for '{self.database_name}'")
+
+        parts = self._fetch_metadata()
+        buckets = self._select_buckets(json.loads(parts["buckets"]))
+        full = not self.config.org and not self.config.buckets
+
+        manifest = {"full": full, "buckets": buckets, "shards": []}
+
+        try:
+            with tempfile.TemporaryDirectory(dir=output_path) as scratch, \
+                    tarfile.open(backup_file, "w") as archive:
+                scratch_path = Path(scratch)
+
+                # The KV and SQL stores hold every org, user and token, so they
+                # are only included when the whole instance is backed up
+                if full:
+                    for name, arcname in (("kv", "kv.bolt"), ("sql", "sql.sqlite")):
+                        path = scratch_path / arcname
+                        path.write_bytes(parts[name])
+                        archive.add(path, arcname=arcname)
+                        path.unlink()
+
+                for bucket in buckets:
+                    logger.debug(f"Backing up bucket {bucket['organizationName']}/{bucket['bucketName']}")
+
+                    for policy in bucket.get("retentionPolicies") or []:
+                        for group in policy.get("shardGroups") or []:
+                            for shard in group.get("shards") or []:
+                                shard_file = scratch_path / f"{shard['id']}.tar.gz"
+                                if not self._download_shard(shard["id"], shard_file):
+                                    continue
+
+                                archive.add(shard_file, arcname=f"shards/{shard['id']}.tar.gz")
+                                shard_file.unlink()
+                                manifest["shards"].append(shard["id"])
+
+                manifest_file = scratch_path / "manifest.json"
+                manifest_file.write_text(json.dumps(manifest, indent=2))
+                archive.add(manifest_file, arcname="manifest.json")
+
+        except (OSError, tarfile.TarError) as e:
+            backup_file.unlink(missing_ok=True)
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+        except BackupError:
+            backup_file.unlink(missing_ok=True)
+            raise
+
+        self.backed_up_buckets = [bucket["bucketName"] for bucket in buckets]
+
+        file_size = backup_file.stat().st_size
+        logger.info(
+            f"Backup completed: {filename} ({file_size} bytes, "
+            f"{len(buckets)} buckets, {len(manifest['shards'])} shards)"
+        )
+
+        return backup_file
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore an InfluxDB backup through the restore API.
+
+        Buckets are recreated one by one, optionally under INFLUXDB_RESTORE_ORG
+        or as INFLUXDB_RESTORE_BUCKET. With INFLUXDB_RESTORE_FULL the whole
+        instance's metadata is replaced first, as `influx restore --full` does.
+
+        Args:
+            backup_file: Path to the backup file (.influx.tar)
+            options: Restore options (unused by this engine)
+
+        Raises:
+            BackupError: If the restore operation fails
+        """
+        logger.info(f"Starting InfluxDB restore for '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                scratch_path = Path(scratch)
+                with tarfile.open(backup_file) as archive:
+                    extract_tar(archive, scratch_path)
+
+                manifest = json.loads((scratch_path / "manifest.json").read_text())
+
+                if self.config.restore_full:
+                    self._restore_full(scratch_path, manifest)
+                else:
+                    self._restore_buckets(scratch_path, manifest)
+
+        except (OSError, tarfile.TarError, KeyError, ValueError) as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
+
+        logger.info(f"Restore completed successfully for '{self.database_name}'")
+
+    def _restore_full(self, scratch_path: Path, manifest: dict) -> None:
+        """Replace the instance's KV and SQL metadata, then restore every shard."""
+        if not manifest["full"]:
+            raise BackupError("INFLUXDB_RESTORE_FULL requires a backup of the whole instance")
+
+        logger.warning("Replacing all InfluxDB metadata (orgs, users, tokens, dashboards)")
+
+        for path, arcname in (("/api/v2/restore/kv", "kv.bolt"), ("/api/v2/restore/sql", "sql.sqlite")):
+            with self._request(
+                "POST",
+                path,
+                (scratch_path / arcname).read_bytes(),
+                {"Content-Type": "application/octet-stream"},
+            ):
+                pass
+
+        for shard_id in manifest["shards"]:
+            self._upload_shard(scratch_path, shard_id, shard_id)
+
+    def _restore_buckets(self, scratch_path: Path, manifest: dict) -> None:
+        """Recreate each bucket and upload its shards under the new shard IDs."""
+        buckets = manifest["buckets"]
+
+        if self.config.restore_bucket and len(buckets) != 1:
+            raise BackupError(
+                f"INFLUXDB_RESTORE_BUCKET needs a backup of a single bucket, this one has {len(buckets)}"
+            )
+
+        org_ids: dict[str, str] = {}
+        backed_up = set(manifest["shards"])
+
+        for bucket in buckets:
+            org_name = self.config.restore_org or bucket["organizationName"]
+            if org_name not in org_ids:
+                query = urllib.parse.urlencode({"org": org_name})
+                orgs = self._request_json("GET", f"/api/v2/orgs?{query}").get("orgs") or []
+                if not orgs:
+                    raise BackupError(f"Organization not found: {org_name}")
+                org_ids[org_name] = orgs[0]["id"]
+
+            bucket_name = self.config.restore_bucket or bucket["bucketName"]
+            logger.info(f"Restoring bucket {bucket['bucketName']} as {org_name}/{bucket_name}")
+
+            request = {**bucket, "organizationID": org_ids[org_name], "bucketName": bucket_name}
+            request.pop("organizationName", None)
+            request.pop("bucketID", None)
+
+            result = self._request_json("POST", "/api/v2/restore/bucketMetadata", request)
+
+            for mapping in result.get("shardMappings") or []:
+                if mapping["oldId"] in backed_up:
+                    self._upload_shard(scratch_path, mapping["oldId"], mapping["newId"])
+
+    def _upload_shard(self, scratch_path: Path, old_id: int, new_id: int) -> None:
+        """Upload a backed up shard into its (possibly renumbered) shard."""
+        logger.debug(f"Restoring shard {old_id} into {new_id}")
+
+        with open(scratch_path / "shards" / f"{old_id}.tar.gz", "rb") as f:
+            with self._request(
+                "POST",
+                f"/api/v2/restore/shards/{new_id}",
+                f.read(),
+                {"Content-Type": "application/octet-stream", "Content-Encoding": "gzip"},
+            ):
+                pass
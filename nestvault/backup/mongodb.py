@@ -1,10 +1,13 @@
 """MongoDB backup adapter using mongodump."""
 
+from __future__ import annotations
+
 import subprocess
+from dataclasses import replace
 from datetime import datetime, timezone
 from pathlib import Path
 
-from nestvault.backup.base import BackupAdapter
+from nestvault.backup.base import BackupAdapter, RestoreOptions
 from nestvault.config import MongoDBConfig
 from nestvault.exceptions import BackupError
 from nestvault.logging import get_logger
@@ -25,14 +28,37 @@ class MongoDBBackupAdapter(BackupAdapter):
 
     @property
     def database_name(self) -> str:
-        """Return the name of the database being backed up."""
-        return self.config.database
+        """Return the name of the database being backed up.
+
+        Falls back to 'mongodb' when all databases on the server are dumped.
+        """
+        return self.config.database or "mongodb"
 
     @property
     def file_extension(self) -> str:
         """Return the file extension for backup files."""
         return "archive.gz"
 
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "mongodb"
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to another database on the same server."""
+        return MongoDBBackupAdapter(replace(self.config, database=database))
+
+    def _scope_args(self) -> list[str]:
+        """Build the --db/--collection arguments limiting the dump scope."""
+        args = []
+
+        if self.config.database:
+            args.extend(["--db", self.config.database])
+        if self.config.collection:
+            args.extend(["--collection", self.config.collection])
+
+        return args
+
     def backup(self, output_path: Path) -> Path:
         """Create a backup of the MongoDB database.
 
@@ -54,22 +80,23 @@ class MongoDBBackupAdapter(BackupAdapter):
         cmd = [
             "mongodump",
             "--uri", self.config.uri,
-            "--db", self.config.database,
+            *self._scope_args(),
             "--archive",
             "--gzip",
         ]
 
+        if self.config.read_preference:
+            cmd.extend(["--readPreference", self.config.read_preference])
+
         try:
-            logger.debug("Executing mongodump command")
-            result = subprocess.run(
-                cmd,
-                capture_output=True,
-                check=True,
-            )
-
-            logger.debug(f"Writing backup to {backup_file}")
+            logger.debug(f"Streaming mongodump archive to {backup_file}")
             with open(backup_file, "wb") as f:
-                f.write(result.stdout)
+                subprocess.run(
+                    cmd,
+                    stdout=f,
+                    stderr=subprocess.PIPE,
+                    check=True,
+                )
 
             file_size = backup_file.stat().st_size
             logger.info(f"Backup completed: {filename} ({file_size} bytes)")
@@ -84,11 +111,12 @@ class MongoDBBackupAdapter(BackupAdapter):
             logger.error(f"Failed to write backup file: {e}")
             raise BackupError(f"Failed to write backup file: {e}")
 
-    def restore(self, backup_file: Path) -> None:
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
         """Restore a MongoDB database from a backup file.
 
         Args:
             backup_file: Path to the backup file (.archive.gz)
+            options: Restore options (unused by this engine)
 
         Raises:
             BackupError: If the restore operation fails
@@ -99,19 +127,23 @@ class MongoDBBackupAdapter(BackupAdapter):
         cmd = [
             "mongorestore",
             "--uri", self.config.uri,
-            "--db", self.config.database,
-            "--archive=" + str(backup_file),
+            "--archive",
             "--gzip",
             "--drop",  # Drop existing collections before restoring
         ]
 
+        if self.config.database:
+            cmd.extend(["--nsInclude", f"{self.config.database}.*"])
+
         try:
-            logger.debug("Executing mongorestore command")
-            result = subprocess.run(
-                cmd,
-                capture_output=True,
-                check=True,
-            )
+            logger.debug("Streaming archive into mongorestore")
+            with open(backup_file, "rb") as f:
+                subprocess.run(
+                    cmd,
+                    stdin=f,
+                    capture_output=True,
+                    check=True,
+                )
 
             logger.info(f"Restore completed successfully for database '{self.database_name}'")
 
@@ -119,3 +151,6 @@ class MongoDBBackupAdapter(BackupAdapter):
             error_msg = e.stderr.decode() if e.stderr else str(e)
             logger.error(f"mongorestore failed: {error_msg}")
             raise BackupError(f"MongoDB restore failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
@@ -0,0 +1,368 @@
+"""Microsoft SQL Server backup adapter using sqlcmd and sqlpackage."""
+
+from __future__ import annotations
+
+import os
+import shutil
+import subprocess
+import tempfile
+from collections.abc import Iterator
+from contextlib import contextmanager
+from dataclasses import replace
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, find_binary
+from nestvault.compression import compressed_extension, decompressed_name, open_reader, open_writer
+from nestvault.config import CompressionConfig, MSSQLConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.mssql")
+
+# File extension used for each backup method; native backups also get NestVault's compression suffix
+METHOD_EXTENSIONS = {
+    "native": "bak",
+    "bacpac": "bacpac",
+}
+
+
+def _quote_name(name: str) -> str:
+    """Quote a SQL Server identifier with brackets."""
+    return "[" + name.replace("]", "]]") + "]"
+
+
+def _literal(value: str) -> str:
+    """Quote a value as an NVARCHAR literal."""
+    return "N'" + value.replace("'", "''") + "'"
+
+
+def _server_path(directory: str, name: str) -> str:
+    """Join a path on the SQL Server host, which may be Windows or Linux."""
+    separator = "\\" if "\\" in directory else "/"
+    return directory.rstrip("\\/") + separator + name
+
+
+class MSSQLBackupAdapter(BackupAdapter):
+    """Backup adapter for Microsoft SQL Server.
+
+    The native method runs `BACKUP DATABASE ... TO DISK` on the server and
+    picks the .bak file up from a directory shared with the container. The
+    bacpac method exports with sqlpackage for hosted instances without
+    filesystem access.
+    """
+
+    def __init__(self, config: MSSQLConfig):
+        """Initialize the SQL Server backup adapter.
+
+        Args:
+            config: SQL Server connection configuration
+        """
+        self.config = config
+        self.recovery_model: str | None = None
+
+    @property
+    def database_name(self) -> str:
+        """Return the name of the database being backed up."""
+        return self.config.database
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        if self.config.method == "native":
+            return compressed_extension("bak", self.config.compression)
+        return METHOD_EXTENSIONS[self.config.method]
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "mssql"
+
+    @property
+    def compression(self) -> CompressionConfig | None:
+        """Return how backups are compressed; bacpac exports are zip files already."""
+        return self.config.compression if self.config.method == "native" else None
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata recorded with each backup, including the recovery model."""
+        metadata = {**super().backup_metadata, "method": self.config.method}
+        if self.recovery_model:
+            metadata["recovery_model"] = self.recovery_model
+        return metadata
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to another database on the same server."""
+        return MSSQLBackupAdapter(replace(self.config, database=database))
+
+    def _sqlcmd(self, query: str) -> str:
+        """Run a query against the master database and return its output.
+
+        Raises:
+            BackupError: If the query fails
+        """
+        cmd = [
+            find_binary("sqlcmd"),
+            "-S", f"tcp:{self.config.host},{self.config.port}",
+            "-U", self.config.user,
+            "-d", "master",
+            "-b",
+            "-h", "-1",
+            "-W",
+            "-s", "\t",
+        ]
+
+        if self.config.encrypt:
+            cmd.append("-N")
+        if self.config.trust_server_certificate:
+            cmd.append("-C")
+
+        cmd.extend(["-Q", f"SET NOCOUNT ON; {query}"])
+
+        env = {
+            "SQLCMDPASSWORD": self.config.password,
+        }
+
+        try:
+            result = subprocess.run(cmd, env=env, capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = (e.stderr or e.stdout or b"").decode() or str(e)
+            logger.error(f"sqlcmd failed: {error_msg}")
+            raise BackupError(f"SQL Server query failed: {error_msg}")
+
+        return result.stdout.decode()
+
+    @contextmanager
+    def _sqlpackage_connection(self, prefix: str) -> Iterator[str]:
+        """Write the sqlpackage connection properties of the Source or Target side to a response file.
+
+        Yields the '@<file>' argument that makes sqlpackage read them, so the
+        password stays out of the process list. Only this user can read the
+        file, and it is deleted when the block exits.
+        """
+        properties = [
+            f"/{prefix}ServerName:tcp:{self.config.host},{self.config.port}",
+            f"/{prefix}DatabaseName:{self.config.database}",
+            f"/{prefix}User:{self.config.user}",
+            f"/{prefix}Password:{self.config.password}",
+            f"/{prefix}EncryptConnection:{self.config.encrypt}",
+            f"/{prefix}TrustServerCertificate:{self.config.trust_server_certificate}",
+        ]
+        with tempfile.TemporaryDirectory(prefix="nestvault-sqlpackage-") as scratch:
+            path = os.path.join(scratch, "connection.rsp")
+            with os.fdopen(os.open(path, os.O_WRONLY | os.O_CREAT | os.O_EXCL, 0o600), "w") as f:
+                f.write("\n".join(properties) + "\n")
+            yield f"@{path}"
+
+    def _database_exists(self) -> bool:
+        """Check whether the database exists on the server."""
+        output = self._sqlcmd(f"SELECT DB_ID({_literal(self.config.database)})")
+        return output.strip() not in ("", "NULL")
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup of the SQL Server database.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        logger.info(f"Starting SQL Server backup for database '{self.database_name}' ({self.config.method})")
+
+        self.recovery_model = self._sqlcmd(
+            f"SELECT recovery_model_desc FROM sys.databases WHERE name = {_literal(self.config.database)}"
+        ).strip() or None
+
+        if self.recovery_model is None:
+            raise BackupError(f"Database '{self.database_name}' does not exist on the server")
+
+        logger.debug(f"Database recovery model: {self.recovery_model}")
+
+        if self.config.method == "bacpac":
+            self._backup_bacpac(backup_file)
+        else:
+            self._backup_native(backup_file, f"{self.database_name}_{timestamp}.bak")
+
+        file_size = backup_file.stat().st_size
+        logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+        return backup_file
+
+    def _backup_native(self, backup_file: Path, bak_name: str) -> None:
+        """Run BACKUP DATABASE on the server and compress the resulting .bak file."""
+        server_file = _server_path(self.config.backup_dir, bak_name)
+        local_file = Path(self.config.local_backup_dir) / bak_name
+
+        # COPY_ONLY keeps the backup out of the customer's differential and log chain
+        options = ["CHECKSUM", "INIT", "NAME = N'NestVault backup'"]
+        if self.config.copy_only:
+            options.insert(0, "COPY_ONLY")
+
+        try:
+            logger.debug(f"Executing BACKUP DATABASE to {server_file}")
+            self._sqlcmd(
+                f"BACKUP DATABASE {_quote_name(self.config.database)} "
+                f"TO DISK = {_literal(server_file)} WITH {', '.join(options)}"
+            )
+
+            logger.debug(f"Compressing {local_file} to {backup_file}")
+            with open(local_file, "rb") as src, open_writer(backup_file, self.config.compression) as dst:
+                shutil.copyfileobj(src, dst)
+
+        except OSError as e:
+            logger.error(f"Failed to read backup from {local_file}: {e}")
+            raise BackupError(
+                f"Failed to read {local_file}; check that MSSQL_LOCAL_BACKUP_DIR is where "
+                f"the server's MSSQL_BACKUP_DIR is mounted: {e}"
+            )
+        finally:
+            local_file.unlink(missing_ok=True)
+
+    def _backup_bacpac(self, backup_file: Path) -> None:
+        """Export the database to a .bacpac file with sqlpackage."""
+        try:
+            with self._sqlpackage_connection("Source") as connection:
+                cmd = [find_binary("sqlpackage"), "/Action:Export", connection, f"/TargetFile:{backup_file}"]
+                logger.debug("Executing sqlpackage export")
+                subprocess.run(cmd, capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = (e.stderr or e.stdout or b"").decode() or str(e)
+            logger.error(f"sqlpackage export failed: {error_msg}")
+            raise BackupError(f"SQL Server backup failed: {error_msg}")
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore a SQL Server database from a backup file.
+
+        Args:
+            backup_file: Path to the backup file (.bak.gz, .bak.zst or .bacpac)
+            options: Restore options; `force` replaces an existing database
+
+        Raises:
+            BackupError: If the database exists without force, or the restore fails
+        """
+        options = options or RestoreOptions()
+        method = options.metadata.get("method")
+
+        if method is None:
+            method = "bacpac" if backup_file.name.endswith(".bacpac") else "native"
+
+        logger.info(f"Starting SQL Server restore for database '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        exists = self._database_exists()
+        if exists and not options.force:
+            raise BackupError(
+                f"Database '{self.database_name}' already exists, pass --force to replace it"
+            )
+
+        if method == "bacpac":
+            self._restore_bacpac(backup_file, exists)
+        else:
+            self._restore_native(backup_file, replace_existing=exists, compression=options.metadata.get("compression"))
+
+    def _restore_native(self, backup_file: Path, replace_existing: bool, compression: str | None = None) -> None:
+        """Place the .bak file on the shared directory and run RESTORE ... WITH MOVE."""
+        if not self.config.backup_dir or not self.config.local_backup_dir:
+            raise BackupError("MSSQL_BACKUP_DIR is required to restore native backups")
+
+        bak_name = decompressed_name(backup_file.name)
+        server_file = _server_path(self.config.backup_dir, bak_name)
+        local_file = Path(self.config.local_backup_dir) / bak_name
+
+        try:
+            with open_reader(backup_file, compression) as src, open(local_file, "wb") as dst:
+                shutil.copyfileobj(src, dst)
+        except OSError as e:
+            logger.error(f"Failed to write {local_file}: {e}")
+            raise BackupError(f"Failed to write {local_file}: {e}")
+
+        try:
+            statement = self.restore_statement(server_file, replace_existing)
+        except BackupError:
+            local_file.unlink(missing_ok=True)
+            raise
+
+        try:
+            logger.debug(f"Executing: {statement}")
+            self._sqlcmd(statement)
+        finally:
+            local_file.unlink(missing_ok=True)
+
+        logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+    def restore_statement(self, server_file: str, replace_existing: bool = False) -> str:
+        """Generate a RESTORE DATABASE statement that moves every file.
+
+        Files are moved into MSSQL_RESTORE_DATA_DIR when set, otherwise they
+        keep the paths recorded in the backup.
+
+        Args:
+            server_file: Path of the .bak file on the server
+            replace_existing: Add REPLACE to overwrite an existing database
+
+        Returns:
+            The RESTORE DATABASE statement
+
+        Raises:
+            BackupError: If the file list cannot be read
+        """
+        output = self._sqlcmd(f"RESTORE FILELISTONLY FROM DISK = {_literal(server_file)}")
+
+        moves = []
+        data_files = 0
+        for line in output.splitlines():
+            columns = line.split("\t")
+            if len(columns) < 3:
+                continue
+
+            logical_name, physical_name, file_type = columns[0], columns[1], columns[2]
+
+            if self.config.restore_data_dir:
+                if file_type == "L":
+                    suffix = ".ldf"
+                else:
+                    suffix = ".mdf" if data_files == 0 else ".ndf"
+                    data_files += 1
+                target = _server_path(self.config.restore_data_dir, f"{self.database_name}_{logical_name}{suffix}")
+            else:
+                target = physical_name
+
+            moves.append(f"MOVE {_literal(logical_name)} TO {_literal(target)}")
+
+        if not moves:
+            raise BackupError(f"RESTORE FILELISTONLY returned no files for {server_file}")
+
+        options = [*moves, "RECOVERY", "STATS = 10"]
+        if replace_existing:
+            options.append("REPLACE")
+
+        return (
+            f"RESTORE DATABASE {_quote_name(self.config.database)} "
+            f"FROM DISK = {_literal(server_file)} WITH {', '.join(options)}"
+        )
+
+    def _restore_bacpac(self, backup_file: Path, drop_existing: bool) -> None:
+        """Import a .bacpac file, which requires the database not to exist."""
+        if drop_existing:
+            logger.warning(f"Dropping existing database '{self.database_name}' before import")
+            name = _quote_name(self.config.database)
+            self._sqlcmd(f"ALTER DATABASE {name} SET SINGLE_USER WITH ROLLBACK IMMEDIATE; DROP DATABASE {name}")
+
+        try:
+            with self._sqlpackage_connection("Target") as connection:
+                cmd = [find_binary("sqlpackage"), "/Action:Import", connection, f"/SourceFile:{backup_file}"]
+                logger.debug("Executing sqlpackage import")
+                subprocess.run(cmd, capture_output=True, check=True)
+            logger.info(f"Restore completed successfully for database '{self.database_name}'")
+        except subprocess.CalledProcessError as e:
+            error_msg = (e.stderr or e.stdout or b"").decode() or str(e)
+            logger.error(f"sqlpackage import failed: {error_msg}")
+            raise BackupError(f"SQL Server restore failed: {error_msg}")
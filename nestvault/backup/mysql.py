@@ -0,0 +1,162 @@
+"""MySQL/MariaDB backup adapter using mysqldump."""
+
+from __future__ import annotations
+
+import subprocess
+from dataclasses import replace
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, find_binary
+from nestvault.compression import compressed_extension, compressing_pipe, open_reader
+from nestvault.config import CompressionConfig, MySQLConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.mysql")
+
+
+class MySQLBackupAdapter(BackupAdapter):
+    """Backup adapter for MySQL and MariaDB databases using mysqldump."""
+
+    def __init__(self, config: MySQLConfig):
+        """Initialize the MySQL backup adapter.
+
+        Args:
+            config: MySQL connection configuration
+        """
+        self.config = config
+
+    @property
+    def database_name(self) -> str:
+        """Return the name of the database being backed up."""
+        return self.config.database
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return compressed_extension("sql", self.config.compression)
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "mysql"
+
+    @property
+    def compression(self) -> CompressionConfig:
+        """Return how backups are compressed."""
+        return self.config.compression
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to another database on the same server."""
+        return MySQLBackupAdapter(replace(self.config, database=database))
+
+    def _connection_args(self) -> list[str]:
+        """Build the connection arguments shared by mysqldump and mysql."""
+        return [
+            "--host", self.config.host,
+            "--port", str(self.config.port),
+            "--user", self.config.user,
+        ]
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a backup of the MySQL database.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file (compressed)
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+
+        logger.info(f"Starting MySQL backup for database '{self.database_name}'")
+
+        # MariaDB ships mariadb-dump and deprecates the mysqldump alias
+        dump_binary = find_binary("mariadb-dump", "mysqldump")
+
+        env = {
+            "MYSQL_PWD": self.config.password,
+        }
+
+        cmd = [dump_binary, *self._connection_args(), "--routines", "--triggers"]
+
+        if self.config.single_transaction:
+            cmd.append("--single-transaction")
+
+        cmd.append(self.config.database)
+
+        try:
+            logger.debug(f"Executing {dump_binary} command, compressing to {backup_file}")
+            with compressing_pipe(backup_file, self.config.compression) as pipe:
+                subprocess.run(
+                    cmd,
+                    env=env,
+                    stdout=pipe,
+                    stderr=subprocess.PIPE,
+                    check=True,
+                )
+
+            file_size = backup_file.stat().st_size
+            logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+            return backup_file
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"{dump_binary} failed: {error_msg}")
+            raise BackupError(f"MySQL backup failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore a MySQL database from a backup file.
+
+        Args:
+            backup_file: Path to the backup file (.sql.gz or .sql.zst)
+            options: Restore options including the recorded compression
+
+        Raises:
+            BackupError: If the restore operation fails
+        """
+        options = options or RestoreOptions()
+
+        logger.info(f"Starting MySQL restore for database '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        client_binary = find_binary("mariadb", "mysql")
+
+        env = {
+            "MYSQL_PWD": self.config.password,
+        }
+
+        cmd = [client_binary, *self._connection_args(), self.config.database]
+
+        try:
+            logger.debug("Decompressing and executing restore")
+            with open_reader(backup_file, options.metadata.get("compression")) as f:
+                sql_content = f.read()
+
+            subprocess.run(
+                cmd,
+                env=env,
+                input=sql_content,
+                capture_output=True,
+                check=True,
+            )
+
+            logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"{client_binary} restore failed: {error_msg}")
+            raise BackupError(f"MySQL restore failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
@@ -1,20 +1,203 @@
-"""PostgreSQL backup adapter using pg_dump."""
+"""PostgreSQL backup adapter using pg_dump and pg_basebackup."""
 
+from __future__ import annotations
+
+import fnmatch
 import gzip
+import hashlib
+import itertools
+import re
+import shlex
+import socket
+import ssl
+import struct
 import subprocess
+import tarfile
+import tempfile
+from collections.abc import Callable, Iterator
+from contextlib import contextmanager
+from dataclasses import replace
 from datetime import datetime, timezone
 from pathlib import Path
+from typing import BinaryIO
+from urllib.parse import quote, urlencode
+
+from cryptography import x509
 
-from nestvault.backup.base import BackupAdapter
-from nestvault.config import PostgresConfig
+from nestvault.backup.base import COMPANION_EXTENSIONS, BackupAdapter, DestinationState, RestoreOptions, extract_tar
+from nestvault.compression import (
+    compress_chunks,
+    compressed_extension,
+    compressing_pipe,
+    open_reader,
+    open_stream_reader,
+)
+from nestvault.config import PG_SSL_PARAMETERS, CompressionConfig, PostgresConfig
 from nestvault.exceptions import BackupError
 from nestvault.logging import get_logger
+from nestvault.progress import Progress, ProgressReader
+from nestvault.streaming import CHUNK_SIZE, IteratorReader, command_input, command_output, command_run
 
 logger = get_logger("backup.postgres")
 
+# File extension used for each pg_dump output format, before NestVault's compression suffix
+DUMP_FORMAT_EXTENSIONS = {
+    "plain": "sql",
+    "custom": "dump",
+    "directory": "dir.tar",
+}
+
+# pg_dump flag and object name infix of each dump scope other than full
+DUMP_SCOPE_FLAGS = {"schema-only": "--schema-only", "data-only": "--data-only"}
+DUMP_SCOPE_INFIXES = {"schema-only": "schema", "data-only": "data"}
+
+# Address of the local end of SSH tunnels, see nestvault.tunnel
+TUNNEL_ADDRESS = "127.0.0.1"
+
+# Code of the SSLRequest message, which asks a server to switch the connection to TLS before the startup message
+SSL_REQUEST_CODE = 80877103
+
+
+def dump_scope_of(backup_key: str) -> str:
+    """Return the dump scope of a backup from its key, e.g. 'db_20240115_120000.schema.sql.gz' -> 'schema-only'."""
+    match = re.match(r".+_\d{8}_\d{6}\.(schema|data)\.", Path(backup_key).name)
+    if match is None:
+        return "full"
+    return next(scope for scope, infix in DUMP_SCOPE_INFIXES.items() if infix == match.group(1))
+
+
+def schema_sha256(schema_dump: bytes) -> str:
+    """Hash a pg_dump --schema-only output, ignoring comments and lines that change between runs."""
+    digest = hashlib.sha256()
+    for line in schema_dump.splitlines():
+        # Comments carry server and pg_dump versions; \restrict keys are random per dump
+        if not line.strip() or line.startswith((b"--", b"\\restrict", b"\\unrestrict")):
+            continue
+        digest.update(line + b"\n")
+    return digest.hexdigest()
+
+
+def command_line(cmd: list[str], password: str = "") -> str:
+    """Quote a command for logs and manifests, with passwords in it or in connection URIs masked."""
+    line = shlex.join(cmd)
+    if password:
+        line = line.replace(password, "***")
+    return re.sub(r"(://[^:/@\s]+:)[^@\s]+@", r"\1***@", line)
+
+
+# pg_restore --verbose messages marking the data of a table restored, without and with parallel jobs
+_TABLE_DATA_DONE = re.compile(rb"processing data for table|finished item \d+ TABLE DATA")
+
+# Entries of a pg_restore --list table of contents holding the data of a table
+_TABLE_DATA_ENTRY = re.compile(rb"^\d+; \d+ \d+ TABLE DATA ", re.MULTILINE)
+
+# Start of the data of a table in a plain dump
+_COPY_MARKER = b"\nCOPY "
+
+# Bytes read from the start of a dump to check it against its recorded format: a tar header's worth
+_HEAD_SIZE = 512
+
+# Header of custom format dumps, and the magic of the tarballs directory dumps are packed into, at offset 257
+_CUSTOM_MAGIC = b"PGDMP"
+_TAR_MAGIC = b"ustar"
+
+# Comments mysqldump and mariadb-dump start their dumps with
+_MYSQL_DUMP_MARKERS = (b"-- MySQL dump", b"-- MariaDB dump")
+
+
+def format_mismatch(head: bytes, dump_format: str) -> str | None:
+    """Return how the start of a dump, decompressed for plain dumps, contradicts its recorded format; None if not."""
+    if any(marker in head for marker in _MYSQL_DUMP_MARKERS):
+        return "it is a MySQL dump"
+    if dump_format == "custom" and not head.startswith(_CUSTOM_MAGIC):
+        return f"it does not start with the PGDMP header of one (it starts with {head[:8]!r})"
+    if dump_format == "directory" and head[257:262] != _TAR_MAGIC:
+        return "it is not the tarball directory format dumps are uploaded as"
+    if dump_format == "plain" and head.startswith(_CUSTOM_MAGIC):
+        return "it is a custom format dump"
+    return None
+
+
+def count_tables(progress: Progress) -> Callable[[bytes], bool]:
+    """Return a stderr callback counting the tables pg_restore --verbose reports restored.
+
+    Its other progress messages are dropped, so errors and warnings alone
+    make up the error message of a failed restore.
+    """
+    def on_line(line: bytes) -> bool:
+        if _TABLE_DATA_DONE.search(line):
+            progress.advance()
+            return False
+        return not line.startswith(b"pg_restore: ") or b"error" in line or b"warning" in line
+
+    return on_line
+
+
+def quote_identifier(name: str) -> str:
+    """Quote a name for use as an SQL identifier, e.g. a database name."""
+    return '"' + name.replace('"', '""') + '"'
+
+
+def quote_literal(value: str) -> str:
+    """Quote a value for use as an SQL string literal."""
+    return "'" + value.replace("'", "''") + "'"
+
+
+def table_args(tables: list[str]) -> list[str]:
+    """Return the pg_restore -n and -t flags restoring only tables given as 'schema.table' or 'table'.
+
+    pg_restore restores every -t table found in any -n schema, so the
+    tables must all name the same schema, or all leave it out.
+
+    Raises:
+        ValueError: If the tables name different schemas, or a table is empty
+    """
+    schemas = {table.rpartition(".")[0] for table in tables}
+    if len(schemas) > 1:
+        raise ValueError(f"tables {', '.join(tables)} name different schemas; restore one schema at a time")
+    if any(not table.rpartition(".")[2] for table in tables):
+        raise ValueError(f"empty table name in {', '.join(tables)}")
+
+    schema = schemas.pop() if schemas else ""
+    args = ["-n", schema] if schema else []
+    for table in tables:
+        args += ["-t", table.rpartition(".")[2]]
+    return args
+
+
+def filter_databases(databases: list[str], patterns: list[str]) -> list[str]:
+    """Apply include/exclude glob patterns to a list of database names.
+
+    Patterns prefixed with '!' exclude matching databases. When at least one
+    include pattern is given, only databases matching an include are kept.
+
+    Args:
+        databases: Database names to filter
+        patterns: Glob patterns such as 'tenant_*' or '!tenant_staging'
+
+    Returns:
+        Filtered database names in their original order
+    """
+    includes = [p for p in patterns if not p.startswith("!")]
+    excludes = [p[1:] for p in patterns if p.startswith("!")]
+
+    selected = []
+    for name in databases:
+        if includes and not any(fnmatch.fnmatchcase(name, p) for p in includes):
+            continue
+        if any(fnmatch.fnmatchcase(name, p) for p in excludes):
+            continue
+        selected.append(name)
+
+    return selected
+
 
 class PostgresBackupAdapter(BackupAdapter):
-    """Backup adapter for PostgreSQL databases using pg_dump."""
+    """Backup adapter for PostgreSQL databases.
+
+    Logical backups use pg_dump. Physical backups use pg_basebackup and
+    capture the whole cluster including the WAL needed to make it consistent.
+    """
 
     def __init__(self, config: PostgresConfig):
         """Initialize the PostgreSQL backup adapter.
@@ -23,6 +206,12 @@ class PostgresBackupAdapter(BackupAdapter):
             config: PostgreSQL connection configuration
         """
         self.config = config
+        # First WAL segment of the last physical backup, read from its backup_label
+        self.wal_start: str | None = None
+        # Schema hash captured with the last data-only dump
+        self.schema_sha256: str | None = None
+        # pg_dump command line of the last logical backup, without its output file
+        self.dump_command: str | None = None
 
     @property
     def database_name(self) -> str:
@@ -32,7 +221,324 @@ class PostgresBackupAdapter(BackupAdapter):
     @property
     def file_extension(self) -> str:
         """Return the file extension for backup files."""
-        return "sql.gz"
+        if self.config.mode == "physical":
+            return "tar.gz"
+        if self.config.dump_format == "plain":
+            extension = compressed_extension("sql", self.config.compression)
+        else:
+            extension = DUMP_FORMAT_EXTENSIONS[self.config.dump_format]
+        if self.config.dump_scope in DUMP_SCOPE_INFIXES:
+            return f"{DUMP_SCOPE_INFIXES[self.config.dump_scope]}.{extension}"
+        return extension
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "postgres"
+
+    @property
+    def compression(self) -> CompressionConfig | None:
+        """Return how backups are compressed; only plain dumps are compressed by NestVault."""
+        if self.config.mode == "logical" and self.config.dump_format == "plain":
+            return self.config.compression
+        return None
+
+    @property
+    def backup_metadata(self) -> dict[str, str]:
+        """Return metadata stored alongside each backup object."""
+        metadata = {**super().backup_metadata, "mode": self.config.mode}
+        if self.config.mode == "logical":
+            metadata["format"] = self.config.dump_format
+            metadata["dump_scope"] = self.config.dump_scope
+        if self.schema_sha256 is not None:
+            metadata["schema_sha256"] = self.schema_sha256
+        # Recorded so anyone restoring can tell the backup is partial
+        if self.config.include_tables:
+            metadata["include_tables"] = ",".join(self.config.include_tables)
+        if self.config.exclude_tables:
+            metadata["exclude_tables"] = ",".join(self.config.exclude_tables)
+        if self.wal_start is not None:
+            metadata["wal_start"] = self.wal_start
+        if self.dump_command is not None:
+            metadata["dump_command"] = self.dump_command
+        return metadata
+
+    @property
+    def archives_wal(self) -> bool:
+        """Return whether PG_WAL_ARCHIVE is set, which requires physical backups."""
+        return self.config.wal_archive
+
+    def backup_companions(self, backup_file: Path) -> dict[str, Path]:
+        """Dump roles, grants and tablespaces with pg_dumpall when enabled.
+
+        Reading role definitions requires superuser; without it the
+        globals are skipped with a warning instead of failing the backup.
+
+        Args:
+            backup_file: Database dump the globals belong to
+
+        Returns:
+            {'globals': <path>} or an empty dict when skipped
+
+        Raises:
+            BackupError: If pg_dumpall fails for another reason
+        """
+        if not self.config.backup_globals:
+            return {}
+
+        stem = backup_file.name[: -len(f".{self.file_extension}")]
+        globals_file = backup_file.with_name(f"{stem}.{COMPANION_EXTENSIONS['globals']}")
+
+        env = self._env()
+
+        cmd = [
+            "pg_dumpall",
+            *self._connection_args(),
+            "-l", self.config.database,
+            "--no-password",
+            "--globals-only",
+        ]
+
+        try:
+            logger.debug("Executing pg_dumpall --globals-only")
+            result = subprocess.run(cmd, env=env, capture_output=True, check=True)
+
+            with gzip.open(globals_file, "wb") as f:
+                f.write(result.stdout)
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            if "permission denied" in error_msg.lower():
+                logger.warning(
+                    f"Skipping globals, role '{self.config.user}' cannot read role definitions "
+                    f"(superuser required): {error_msg.strip()}"
+                )
+                return {}
+            logger.error(f"pg_dumpall failed: {error_msg}")
+            raise BackupError(f"PostgreSQL globals backup failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to write globals file: {e}")
+            raise BackupError(f"Failed to write globals file: {e}")
+
+        logger.info(f"Globals dumped: {globals_file.name} ({globals_file.stat().st_size} bytes)")
+        return {"globals": globals_file}
+
+    def list_databases(self) -> list[str]:
+        """List the non-template databases on the server that accept connections.
+
+        Returns:
+            Database names sorted alphabetically
+
+        Raises:
+            BackupError: If the query fails
+        """
+        env = self._env()
+
+        cmd = [
+            "psql",
+            *self._connection_args(),
+            "-d", self.config.database,
+            "--no-password",
+            "-At",
+            "-c", "SELECT datname FROM pg_database WHERE NOT datistemplate AND datallowconn ORDER BY datname",
+        ]
+
+        try:
+            result = subprocess.run(cmd, env=env, capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"Failed to list databases: {error_msg}")
+            raise BackupError(f"Failed to list PostgreSQL databases: {error_msg}")
+
+        return [line for line in result.stdout.decode().splitlines() if line]
+
+    def server_version(self) -> str | None:
+        """Return the server's version, or None with a warning if it cannot be queried."""
+        cmd = [
+            "psql",
+            *self._connection_args(),
+            "-d", self.config.database,
+            "--no-password",
+            "-At",
+            "-c", "SHOW server_version",
+        ]
+
+        try:
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+        except (subprocess.CalledProcessError, OSError) as e:
+            logger.warning(f"Failed to query the server version: {e}")
+            return None
+
+        return result.stdout.decode().strip() or None
+
+    def database_size(self) -> int | None:
+        """Return the size of the database, or of the whole cluster for physical backups.
+
+        Returns None with a warning if it cannot be queried.
+        """
+        if self.config.mode == "physical":
+            query = "SELECT sum(pg_database_size(datname)) FROM pg_database"
+        else:
+            query = "SELECT pg_database_size(current_database())"
+
+        cmd = [
+            "psql",
+            *self._connection_args(),
+            "-d", self.config.database,
+            "--no-password",
+            "-At",
+            "-c", query,
+        ]
+
+        try:
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+            return int(result.stdout.decode().strip())
+        except (subprocess.CalledProcessError, OSError, ValueError) as e:
+            logger.warning(f"Failed to query the database size: {e}")
+            return None
+
+    def fingerprint(self) -> str | None:
+        """Return a digest of the database's row write counters and catalog, or None for physical backups.
+
+        The counters of pg_stat_user_tables grow with every row inserted,
+        updated or deleted, and the newest transaction that changed
+        pg_class or pg_proc moves with every schema change. Returns None
+        with a warning if they cannot be queried.
+        """
+        if self.config.mode == "physical":
+            return None
+
+        query = (
+            "SELECT relid::text || ' ' || n_tup_ins || ' ' || n_tup_upd || ' ' || n_tup_del FROM pg_stat_user_tables "
+            "UNION ALL SELECT 'catalog ' || (SELECT max(xmin::text::bigint) FROM pg_class) || ' ' "
+            "|| (SELECT max(xmin::text::bigint) FROM pg_proc) ORDER BY 1"
+        )
+        cmd = [
+            "psql",
+            *self._connection_args(),
+            "-d", self.config.database,
+            "--no-password",
+            "-At",
+            "-c", query,
+        ]
+
+        try:
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+        except (subprocess.CalledProcessError, OSError) as e:
+            logger.warning(f"Failed to query whether the database changed: {e}")
+            return None
+
+        return hashlib.sha256(result.stdout).hexdigest()
+
+    def expand(self) -> list[BackupAdapter]:
+        """Return one adapter per database when backing up the whole server."""
+        if not self.config.all_databases:
+            return [self]
+
+        databases = filter_databases(self.list_databases(), self.config.database_patterns)
+        logger.info(f"Discovered {len(databases)} databases to back up: {', '.join(databases)}")
+
+        return [self.for_database(name) for name in databases]
+
+    def for_database(self, database: str) -> BackupAdapter:
+        """Return an adapter bound to another database on the same server."""
+        return PostgresBackupAdapter(
+            replace(self.config, database=database, all_databases=False, database_patterns=[])
+        )
+
+    def use_credentials(self, username: str, password: str) -> None:
+        """Connect as another user, keeping the server, database and dump settings."""
+        self.config = replace(self.config, user=username, password=password)
+
+    def use_tunnel(self, port: int | None) -> None:
+        """Connect through a local port, keeping the server's name for TLS verification and .pgpass lookups."""
+        self.config = replace(self.config, tunnel_port=port)
+
+    def is_own_backup(self, backup_key: str) -> bool:
+        """Check whether a backup has this adapter's dump scope, so targets with different scopes can share a prefix."""
+        if self.config.mode == "physical":
+            return True
+        return dump_scope_of(backup_key) == self.config.dump_scope
+
+    @property
+    def location(self) -> str:
+        return f"{self.config.host}:{self.config.port}/{self.config.database}"
+
+    @property
+    def dsn(self) -> str:
+        user, database = quote(self.config.user, safe=""), quote(self.config.database, safe="")
+        query = urlencode(self._ssl_settings())
+        return f"postgresql://{user}@{self.config.host}:{self.config.port}/{database}" + (f"?{query}" if query else "")
+
+    def _ssl_settings(self) -> dict[str, str]:
+        """Return the configured TLS settings by connection parameter, e.g. {'sslmode': 'verify-full'}."""
+        return {name: getattr(self.config, name) for name in PG_SSL_PARAMETERS if getattr(self.config, name)}
+
+    def _env(self) -> dict[str, str]:
+        """Return the environment every PostgreSQL client tool runs with: the password and TLS settings."""
+        env = {"PGPASSWORD": self.config.password}
+        env.update({f"PG{name.upper()}": value for name, value in self._ssl_settings().items()})
+        if self.config.tunnel_port is not None:
+            # libpq connects to hostaddr instead of resolving host, which it still verifies the certificate against
+            env["PGHOSTADDR"] = TUNNEL_ADDRESS
+        return env
+
+    def check_tls(self) -> str | None:
+        """Handshake TLS with the server as libpq does with the configured sslmode.
+
+        Returns None where connections are not encrypted: over a Unix
+        socket, with sslmode disable or allow, which connects without TLS
+        first, and with prefer, libpq's default, when the server does not
+        offer TLS.
+        """
+        config = self.config
+        mode = config.sslmode or "prefer"
+        if mode in ("disable", "allow") or config.host.startswith("/"):
+            return None
+
+        address = f"{config.host}:{config.port}"
+        connect = (config.host, config.port) if config.tunnel_port is None else (TUNNEL_ADDRESS, config.tunnel_port)
+        try:
+            context = self._ssl_context(mode)
+            with socket.create_connection(connect, timeout=10) as sock:
+                # The SSLRequest message, which the server answers with a single S if it speaks TLS
+                sock.sendall(struct.pack("!ii", 8, SSL_REQUEST_CODE))
+                if sock.recv(1) != b"S":
+                    if mode == "prefer":
+                        return None
+                    raise BackupError(f"Server {address} does not offer TLS, which sslmode {mode} requires")
+                with context.wrap_socket(sock, server_hostname=config.host) as connection:
+                    certificate = connection.getpeercert(binary_form=True)
+        except OSError as e:
+            raise BackupError(f"TLS handshake with {address} failed: {e}")
+
+        return x509.load_der_x509_certificate(certificate).subject.rfc4514_string()
+
+    def _ssl_context(self, mode: str) -> ssl.SSLContext:
+        """Build a TLS context verifying the server's certificate as libpq does in a mode."""
+        config = self.config
+        context = ssl.SSLContext(ssl.PROTOCOL_TLS_CLIENT)
+        context.check_hostname = mode == "verify-full"
+        # As in libpq, require also verifies the certificate when given a root certificate
+        if mode in ("verify-ca", "verify-full") or (mode == "require" and config.sslrootcert):
+            rootcert = config.sslrootcert or str(Path.home() / ".postgresql" / "root.crt")
+            if rootcert == "system":
+                context.load_default_certs()
+            else:
+                context.load_verify_locations(rootcert)
+        else:
+            context.verify_mode = ssl.CERT_NONE
+        if config.sslcert:
+            context.load_cert_chain(config.sslcert, config.sslkey)
+        return context
+
+    def _connection_args(self) -> list[str]:
+        """Build the connection arguments shared by all PostgreSQL client tools."""
+        return [
+            "-h", self.config.host,
+            "-p", str(self.config.tunnel_port or self.config.port),
+            "-U", self.config.user,
+        ]
 
     def backup(self, output_path: Path) -> Path:
         """Create a backup of the PostgreSQL database.
@@ -46,42 +552,165 @@ class PostgresBackupAdapter(BackupAdapter):
         Raises:
             BackupError: If the backup operation fails
         """
-        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
-        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        filename = self._backup_filename()
         backup_file = output_path / filename
 
-        logger.info(f"Starting PostgreSQL backup for database '{self.database_name}'")
+        if self.config.mode == "physical":
+            self._backup_physical(backup_file)
+        else:
+            self._capture_schema()
+            self._backup_logical(backup_file)
+
+        file_size = backup_file.stat().st_size
+        logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+        return backup_file
+
+    def _backup_filename(self) -> str:
+        """Return the file name of a backup taken now."""
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        return f"{self.database_name}_{timestamp}.{self.file_extension}"
 
-        env = {
-            "PGPASSWORD": self.config.password,
-        }
+    def _dump_command(self, *format_args: str) -> list[str]:
+        """Build the pg_dump command for an output format, up to where its output goes.
 
+        The command is recorded with the backup, so it can be reproduced.
+        """
         cmd = [
             "pg_dump",
-            "-h", self.config.host,
-            "-p", str(self.config.port),
-            "-U", self.config.user,
+            *self._connection_args(),
+            "-d", self.config.database,
+            "--no-password",
+        ]
+
+        if self.config.dump_compress is not None:
+            cmd.extend(["-Z", str(self.config.dump_compress)])
+
+        if self.config.dump_scope in DUMP_SCOPE_FLAGS:
+            cmd.append(DUMP_SCOPE_FLAGS[self.config.dump_scope])
+
+        cmd += [*self._table_args(), *format_args, *self.config.extra_dump_args]
+        self.dump_command = command_line(cmd, self.config.password)
+        return cmd
+
+    def _table_args(self) -> list[str]:
+        """Build the pg_dump flags selecting the configured tables."""
+        args = []
+        for pattern in self.config.include_tables:
+            args.extend(["-t", pattern])
+        for pattern in self.config.exclude_tables:
+            args.extend(["-T", pattern])
+        return args
+
+    def _schema_sha256(self) -> str:
+        """Dump the schema of the database and return its hash.
+
+        Raises:
+            BackupError: If pg_dump fails
+        """
+        cmd = [
+            "pg_dump",
+            *self._connection_args(),
             "-d", self.config.database,
             "--no-password",
+            "--schema-only",
+            *self._table_args(),
         ]
 
         try:
-            logger.debug(f"Executing pg_dump command")
-            result = subprocess.run(
-                cmd,
-                env=env,
-                capture_output=True,
-                check=True,
-            )
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            raise BackupError(f"Failed to dump the schema of '{self.config.database}': {error_msg}")
 
-            logger.debug(f"Compressing backup to {backup_file}")
-            with gzip.open(backup_file, "wb") as f:
-                f.write(result.stdout)
+        return schema_sha256(result.stdout)
+
+    def _capture_schema(self) -> None:
+        """Record the schema hash a data-only dump is taken against, checked again on restore."""
+        self.schema_sha256 = self._schema_sha256() if self.config.dump_scope == "data-only" else None
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether backups can be streamed; pg_dump writes only plain and custom dumps to stdout."""
+        return self.config.mode == "logical" and self.config.dump_format in ("plain", "custom")
+
+    @contextmanager
+    def stream_backup(self) -> Iterator[tuple[str, BinaryIO]]:
+        """Stream a plain or custom format dump from pg_dump's stdout.
 
-            file_size = backup_file.stat().st_size
-            logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+        Plain dumps are compressed as they are read. The stream yields the
+        same bytes backup() would write to a file, so streamed backups
+        restore like any other.
 
-            return backup_file
+        Raises:
+            BackupError: If the format cannot be streamed, or pg_dump fails (raised from reading)
+        """
+        if not self.supports_streaming:
+            raise BackupError("Only logical PostgreSQL backups in plain or custom format can be streamed")
+
+        filename = self._backup_filename()
+        self._capture_schema()
+        logger.info(
+            f"Starting streamed PostgreSQL backup for database '{self.database_name}' "
+            f"(format={self.config.dump_format})"
+        )
+
+        cmd = self._dump_command("-Fc") if self.config.dump_format == "custom" else self._dump_command()
+
+        logger.debug(f"Executing pg_dump command, streaming its output: {self.dump_command}")
+        output = command_output(cmd, self._env(), "pg_dump")
+        chunks = compress_chunks(output, self.config.compression) if self.config.dump_format == "plain" else output
+        stream = IteratorReader(chunks)
+
+        try:
+            yield filename, stream
+        finally:
+            stream.close()
+            output.close()
+
+    def _backup_logical(self, backup_file: Path) -> None:
+        """Dump the database with pg_dump in the configured output format.
+
+        Plain dumps are compressed by NestVault while pg_dump writes them.
+        Custom and directory dumps are compressed by pg_dump itself;
+        directory dumps are packed into an uncompressed tarball so they
+        upload as a single object.
+        """
+        logger.info(
+            f"Starting PostgreSQL backup for database '{self.database_name}' "
+            f"(format={self.config.dump_format})"
+        )
+
+        env = self._env()
+
+        try:
+            if self.config.dump_format == "custom":
+                cmd = self._dump_command("-Fc")
+                logger.debug(f"Executing pg_dump command: {self.dump_command}")
+                subprocess.run([*cmd, "-f", str(backup_file)], env=env, capture_output=True, check=True)
+
+            elif self.config.dump_format == "directory":
+                with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                    dump_dir = Path(scratch) / "dump"
+                    cmd = self._dump_command("-Fd", "-j", str(self.config.dump_jobs))
+                    logger.debug(f"Executing pg_dump command: {self.dump_command}")
+                    subprocess.run([*cmd, "-f", str(dump_dir)], env=env, capture_output=True, check=True)
+
+                    logger.debug(f"Packing dump directory into {backup_file}")
+                    with tarfile.open(backup_file, "w") as archive:
+                        archive.add(dump_dir, arcname="dump")
+
+            else:
+                cmd = self._dump_command()
+                logger.debug(f"Executing pg_dump command, compressing to {backup_file}: {self.dump_command}")
+                with compressing_pipe(backup_file, self.config.compression) as pipe:
+                    subprocess.run(
+                        cmd,
+                        env=env,
+                        stdout=pipe,
+                        stderr=subprocess.PIPE,
+                        check=True,
+                    )
 
         except subprocess.CalledProcessError as e:
             error_msg = e.stderr.decode() if e.stderr else str(e)
@@ -91,34 +720,497 @@ class PostgresBackupAdapter(BackupAdapter):
             logger.error(f"Failed to write backup file: {e}")
             raise BackupError(f"Failed to write backup file: {e}")
 
-    def restore(self, backup_file: Path) -> None:
+    def _backup_physical(self, backup_file: Path) -> None:
+        """Take a base backup with pg_basebackup and bundle it into one tarball.
+
+        pg_basebackup cannot stream WAL while writing tar output to stdout, so
+        the tar files (base.tar, pg_wal.tar and one per tablespace) are written
+        to a scratch directory and packed into a single gzip compressed archive.
+        """
+        logger.info(f"Starting PostgreSQL physical backup of server {self.config.host}")
+
+        env = self._env()
+
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                cmd = [
+                    "pg_basebackup",
+                    *self._connection_args(),
+                    "-D", scratch,
+                    "--format=tar",
+                    "--wal-method=stream",
+                    f"--checkpoint={self.config.checkpoint}",
+                    "--no-password",
+                ]
+
+                if self.config.max_rate:
+                    cmd.append(f"--max-rate={self.config.max_rate}")
+
+                logger.debug("Executing pg_basebackup command")
+                subprocess.run(
+                    cmd,
+                    env=env,
+                    capture_output=True,
+                    check=True,
+                )
+
+                self.wal_start = self._read_wal_start(Path(scratch) / "base.tar")
+
+                logger.debug(f"Packing base backup into {backup_file}")
+                with tarfile.open(backup_file, "w:gz") as archive:
+                    for part in sorted(Path(scratch).iterdir()):
+                        archive.add(part, arcname=part.name)
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"pg_basebackup failed: {error_msg}")
+            raise BackupError(f"PostgreSQL physical backup failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+
+    @staticmethod
+    def _read_wal_start(base_tar: Path) -> str | None:
+        """Return the first WAL segment a base backup needs, read from its backup_label.
+
+        The label records it as e.g. 'START WAL LOCATION: 0/2000028 (file 000000010000000000000002)'.
+        """
+        try:
+            with tarfile.open(base_tar) as archive:
+                label = archive.extractfile("backup_label")
+                match = re.search(rb"^START WAL LOCATION: .* \(file ([0-9A-F]{24})\)$", label.read(), re.MULTILINE)
+        except (OSError, KeyError, AttributeError, tarfile.TarError) as e:
+            logger.warning(f"Could not read the WAL start of the base backup: {e}")
+            return None
+
+        if match is None:
+            logger.warning("backup_label of the base backup does not record its WAL start")
+            return None
+        return match.group(1).decode()
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
         """Restore a PostgreSQL database from a backup file.
 
+        The restore method follows the mode recorded with the backup rather
+        than the currently configured mode, falling back to the file
+        extension for backups uploaded without metadata.
+
         Args:
-            backup_file: Path to the backup file (.sql.gz)
+            backup_file: Path to the backup file (.sql.gz, .sql.zst, .dump, .dir.tar or .tar.gz)
+            options: Restore options including the recorded backup metadata
 
         Raises:
             BackupError: If the restore operation fails
         """
-        logger.info(f"Starting PostgreSQL restore for database '{self.database_name}'")
-        logger.info(f"Restoring from: {backup_file}")
+        options = options or RestoreOptions()
+        mode, dump_format = self._restore_kind(backup_file.name, options.metadata)
 
-        env = {
-            "PGPASSWORD": self.config.password,
-        }
+        if options.tables or options.list_contents:
+            self._check_selective(backup_file.name, mode, dump_format)
+        if options.clean:
+            self._check_clean(backup_file.name, mode, dump_format)
+        if mode == "logical":
+            head = self._read_head(backup_file, dump_format, options.metadata)
+            self._check_contents(backup_file.name, head, dump_format, options.ignore_mismatch)
+        if options.list_contents:
+            options.contents = self._list_archive(backup_file, dump_format)
+            return
 
-        cmd = [
+        self._prepare_restore(options)
+
+        if mode == "physical":
+            self._restore_physical(backup_file, options)
+        elif dump_format in ("custom", "directory"):
+            self._restore_archive(backup_file, dump_format, options.tables, options.progress, options.clean)
+        else:
+            self._restore_logical(backup_file, options.metadata, options.progress)
+
+    @staticmethod
+    def _restore_kind(name: str, metadata: dict[str, str]) -> tuple[str, str]:
+        """Return the mode and dump format of a backup, from its metadata or else its file name."""
+        mode = metadata.get("mode")
+        dump_format = metadata.get("format")
+
+        if mode is None:
+            mode = "physical" if name.endswith(".tar.gz") else "logical"
+
+        if dump_format is None:
+            dump_format = next(
+                (fmt for fmt, extension in DUMP_FORMAT_EXTENSIONS.items() if name.endswith(f".{extension}")),
+                "plain",
+            )
+        return mode, dump_format
+
+    def restore_commands(self, name: str, options: RestoreOptions, streamed: bool) -> list[str]:
+        """Return the commands restoring a backup would run, with the password masked.
+
+        Raises:
+            BackupError: If the backup cannot be restored with these options
+        """
+        mode, dump_format = self._restore_kind(name, options.metadata)
+        if options.tables or options.list_contents:
+            self._check_selective(name, mode, dump_format)
+        if options.clean:
+            self._check_clean(name, mode, dump_format)
+
+        password = self.config.password
+        maintenance = self._psql_args("postgres")
+        commands = []
+        if options.with_globals:
+            commands.append(f"{command_line(maintenance, password)} < {Path(options.metadata.get('globals', '')).name}")
+        if options.create_database:
+            identifier = quote_identifier(self.config.database)
+            if options.drop_existing:
+                commands.append(command_line([*maintenance, "-c", f"DROP DATABASE IF EXISTS {identifier}"], password))
+            create = command_line([*maintenance, "-c", f"CREATE DATABASE {identifier}"], password)
+            commands.append(create if options.drop_existing else f"{create}  (unless it exists)")
+
+        session = self._session_options()
+        prefix = f"PGOPTIONS={shlex.quote(session)} " if session else ""
+        if mode == "physical":
+            commands.append(f"extract {name} into {self.config.restore_data_dir or 'PG_RESTORE_DATA_DIR'}")
+        elif dump_format in ("custom", "directory"):
+            cmd = self._pg_restore_args(options.tables, jobs=not streamed, clean=options.clean)
+            if streamed:
+                commands.append(f"{prefix}{command_line(cmd, password)} < {name}")
+            else:
+                commands.append(prefix + command_line([*cmd, name], password))
+        else:
+            psql = command_line(self._psql_args(self.config.database), password)
+            commands.append(f"{prefix}{psql} < {name}, decompressed")
+        return commands
+
+    def inspect_destination(self) -> DestinationState | None:
+        """Check whether the database exists and count the tables it holds; None for physical restores.
+
+        Raises:
+            BackupError: If the server cannot be reached
+        """
+        if self.config.mode == "physical":
+            return None
+
+        literal = quote_literal(self.config.database)
+        if not self._maintenance_command(f"SELECT 1 FROM pg_database WHERE datname = {literal}"):
+            return DestinationState(exists=False)
+
+        tables = self.query(
+            "SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace "
+            "WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') "
+            "AND n.nspname NOT LIKE 'pg_toast%'"
+        )
+        return DestinationState(exists=True, tables=int(tables))
+
+    def supports_streaming_restore(self, metadata: dict[str, str]) -> bool:
+        """Return whether the backup is a plain or custom format dump that can be piped into psql or pg_restore.
+
+        pg_restore reads a dump from stdin only without parallel jobs, so
+        custom format dumps stream only with PG_RESTORE_JOBS=1, and
+        directory format dumps and physical backups never do. Backups
+        without recorded metadata are downloaded first too.
+        """
+        if metadata.get("mode") != "logical":
+            return False
+        return metadata.get("format") == "plain" or (
+            metadata.get("format") == "custom" and self.config.restore_jobs == 1
+        )
+
+    def restore_stream(self, name: str, stream: BinaryIO, options: RestoreOptions | None = None) -> None:
+        """Restore a dump as it is read, decompressing plain dumps into psql and piping custom ones into pg_restore.
+
+        Raises:
+            BackupError: If the dump cannot be restored from a stream or the restore fails
+        """
+        options = options or RestoreOptions()
+        if not self.supports_streaming_restore(options.metadata):
+            raise BackupError(f"{name} cannot be restored from a stream, it has to be downloaded first")
+
+        dump_format = options.metadata["format"]
+        if options.tables or options.list_contents:
+            self._check_selective(name, "logical", dump_format)
+        if options.clean:
+            self._check_clean(name, "logical", dump_format)
+        if options.list_contents:
+            raise BackupError(f"The table of contents of {name} is read from a download, not a stream")
+
+        # Plain dumps are checked by their decompressed start, so they are decompressed as they are read
+        data = stream
+        if dump_format == "plain":
+            data = open_stream_reader(stream, options.metadata.get("compression", "gzip"))
+        try:
+            head = data.read(_HEAD_SIZE)
+        except (OSError, EOFError) as e:
+            raise BackupError(f"Failed to read backup {name}: {e}")
+        self._check_contents(name, head, dump_format, options.ignore_mismatch)
+        dump = IteratorReader(itertools.chain([head], iter(lambda: data.read(CHUNK_SIZE), b"")))
+
+        self._prepare_restore(options)
+
+        logger.info(f"Starting PostgreSQL restore for database '{self.database_name}' from a stream of {name}")
+        self._log_restore_settings(dump_format, jobs=1)
+
+        env = self._restore_env()
+
+        progress = options.progress
+        on_stderr = None
+        if dump_format == "custom":
+            description = "pg_restore"
+            cmd = self._pg_restore_args(options.tables, jobs=False, verbose=progress is not None, clean=options.clean)
+            source = dump
+            if progress is not None:
+                # The table of contents cannot be read ahead from a stream, so only selected tables give a total
+                progress.unit, progress.total = "tables", len(options.tables) or None
+                on_stderr = count_tables(progress)
+        else:
+            description = "psql"
+            cmd = self._psql_args(self.config.database)
+            source = self._sql_reader(dump, options.metadata, progress)
+
+        logger.debug(f"Executing {description} command: {command_line(cmd, self.config.password)}")
+        try:
+            stderr = command_input(cmd, env, source, description, on_stderr)
+        except BackupError as e:
+            logger.error(str(e))
+            raise BackupError(f"PostgreSQL restore failed: {e}")
+        except (OSError, EOFError) as e:
+            logger.error(f"Failed to read backup stream: {e}")
+            raise BackupError(f"Failed to read backup {name}: {e}")
+        finally:
+            source.close()
+            data.close()
+
+        if stderr and dump_format == "plain":
+            logger.warning(f"psql reported errors while restoring: {stderr.decode(errors='replace').strip()}")
+        logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+    @staticmethod
+    def _read_head(backup_file: Path, dump_format: str, metadata: dict[str, str]) -> bytes:
+        """Read the start of a dump file, decompressing plain dumps.
+
+        Raises:
+            BackupError: If the file cannot be read
+        """
+        try:
+            if dump_format == "plain":
+                with open_reader(backup_file, metadata.get("compression")) as f:
+                    return f.read(_HEAD_SIZE)
+            with open(backup_file, "rb") as f:
+                return f.read(_HEAD_SIZE)
+        except (OSError, EOFError) as e:
+            raise BackupError(f"Failed to read backup file: {e}")
+
+    @staticmethod
+    def _check_contents(name: str, head: bytes, dump_format: str, ignore: bool = False) -> None:
+        """Check the start of a dump matches its recorded format, e.g. that a custom format dump starts with PGDMP.
+
+        Raises:
+            BackupError: If it does not, unless ignore is set, which only logs a warning
+        """
+        problem = format_mismatch(head, dump_format)
+        if problem is None:
+            return
+        message = f"{name} is recorded as a {dump_format} format PostgreSQL dump, but {problem}"
+        if ignore:
+            logger.warning(f"{message}; restoring it anyway (--ignore-engine-mismatch)")
+            return
+        raise BackupError(f"{message}; pass --ignore-engine-mismatch to restore it anyway")
+
+    @staticmethod
+    def _check_selective(name: str, mode: str, dump_format: str) -> None:
+        """Check a backup is an archive pg_restore can select tables from and list.
+
+        Raises:
+            BackupError: If it is a plain SQL dump or a physical backup
+        """
+        if mode == "physical":
+            raise BackupError(f"{name} is a physical backup, which can only be restored as a whole")
+        if dump_format not in ("custom", "directory"):
+            raise BackupError(
+                f"{name} is a plain SQL dump; selecting tables and listing contents requires a custom "
+                f"or directory format dump, taken with PG_DUMP_FORMAT=custom"
+            )
+
+    @staticmethod
+    def _check_clean(name: str, mode: str, dump_format: str) -> None:
+        """Check a backup is an archive pg_restore can drop the objects of before recreating them.
+
+        Raises:
+            BackupError: If it is a plain SQL dump or a physical backup
+        """
+        if mode == "physical" or dump_format not in ("custom", "directory"):
+            raise BackupError(
+                f"{name} is not a custom or directory format dump, which --clean requires; "
+                f"use --create-database --drop-existing to restore into a recreated database instead"
+            )
+
+    def _prepare_restore(self, options: RestoreOptions) -> None:
+        """Apply the globals restored with a backup, create the database, and check its schema for data-only backups."""
+        if "globals" in options.companions:
+            self._restore_globals(options.companions["globals"])
+
+        if options.create_database:
+            self._create_database(options.drop_existing)
+
+        if options.metadata.get("dump_scope") == "data-only":
+            self._check_schema(options.metadata)
+
+    def query(self, sql: str) -> str:
+        """Run one statement in the database and return its unaligned output, e.g. 't' for a true result.
+
+        Raises:
+            BackupError: If the statement fails
+        """
+        return self._psql_command(self.config.database, sql)
+
+    def drop_database(self) -> None:
+        """Drop the database, e.g. a scratch database a backup was test-restored into.
+
+        Raises:
+            BackupError: If the database cannot be dropped
+        """
+        self._maintenance_command(f"DROP DATABASE IF EXISTS {quote_identifier(self.config.database)}")
+        logger.info(f"Dropped database '{self.config.database}'")
+
+    def _maintenance_command(self, sql: str) -> str:
+        """Run one statement through the postgres maintenance database and return its unaligned output.
+
+        Raises:
+            BackupError: If the statement fails
+        """
+        return self._psql_command("postgres", sql)
+
+    def _psql_args(self, database: str) -> list[str]:
+        """Return the psql command connecting to a database of the server, without prompting for a password."""
+        return [
             "psql",
-            "-h", self.config.host,
-            "-p", str(self.config.port),
-            "-U", self.config.user,
+            *self._connection_args(),
+            "-d", database,
+            "--no-password",
+        ]
+
+    def _pg_restore_args(self, tables: list[str], jobs: bool, verbose: bool = False, clean: bool = False) -> list[str]:
+        """Return the pg_restore command restoring into the database, less the dump; jobs only apply to files."""
+        return [
+            "pg_restore",
+            *(["--verbose"] if verbose else []),
+            *self._connection_args(),
             "-d", self.config.database,
             "--no-password",
+            *(["-j", str(self.config.restore_jobs)] if jobs else []),
+            *(["--clean", "--if-exists"] if clean else []),
+            *(["--no-owner"] if self.config.restore_no_owner else []),
+            *(["--no-acl"] if self.config.restore_no_acl else []),
+            *table_args(tables),
+            *self.config.extra_restore_args,
+        ]
+
+    def _session_options(self) -> str | None:
+        """Return the PGOPTIONS setting the timeouts of restore sessions, None when the server's apply."""
+        settings = [
+            f"-c {setting}={value}"
+            for setting, value in (
+                ("statement_timeout", self.config.restore_statement_timeout),
+                ("lock_timeout", self.config.restore_lock_timeout),
+            )
+            if value
+        ]
+        return " ".join(settings) or None
+
+    def _restore_env(self) -> dict[str, str]:
+        """Return the environment psql and pg_restore restore a dump with."""
+        env = self._env()
+        options = self._session_options()
+        if options:
+            env["PGOPTIONS"] = options
+        return env
+
+    def _log_restore_settings(self, dump_format: str, jobs: int) -> None:
+        """Log the settings a dump is restored with, warning about those its format ignores."""
+        config = self.config
+        settings = [f"format={dump_format}"]
+        if dump_format in ("custom", "directory"):
+            settings += [
+                f"jobs={jobs}",
+                f"no-owner={'yes' if config.restore_no_owner else 'no'}",
+                f"no-acl={'yes' if config.restore_no_acl else 'no'}",
+            ]
+        elif config.restore_no_owner or config.restore_no_acl:
+            logger.warning(
+                "PG_RESTORE_NO_OWNER and PG_RESTORE_NO_ACL only apply to custom and directory format dumps, "
+                "a plain dump restores the ownership and grants it was taken with"
+            )
+        settings += [
+            f"statement_timeout={config.restore_statement_timeout or 'server default'}",
+            f"lock_timeout={config.restore_lock_timeout or 'server default'}",
         ]
+        logger.info(f"Restore settings: {', '.join(settings)}")
+
+    def _psql_command(self, database: str, sql: str) -> str:
+        cmd = [*self._psql_args(database), "-At", "-c", sql]
 
         try:
-            logger.debug("Decompressing and executing restore")
-            with gzip.open(backup_file, "rb") as f:
+            result = subprocess.run(cmd, env=self._env(), capture_output=True, check=True)
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            raise BackupError(f"Failed to run '{sql}': {error_msg}")
+
+        return result.stdout.decode().strip()
+
+    def _create_database(self, drop_existing: bool) -> None:
+        """Create the database to restore into, dropping it first when asked to.
+
+        An existing database is restored into as is, unless drop_existing
+        is set.
+
+        Raises:
+            BackupError: If the database cannot be dropped or created
+        """
+        database = self.config.database
+        identifier = quote_identifier(database)
+
+        if drop_existing:
+            logger.warning(f"Dropping database '{database}' before restoring into it")
+            self._maintenance_command(f"DROP DATABASE IF EXISTS {identifier}")
+
+        if self._maintenance_command(f"SELECT 1 FROM pg_database WHERE datname = {quote_literal(database)}"):
+            logger.info(f"Database '{database}' already exists, restoring into it")
+            return
+
+        self._maintenance_command(f"CREATE DATABASE {identifier}")
+        logger.info(f"Created database '{database}'")
+
+    def _check_schema(self, metadata: dict[str, str]) -> None:
+        """Warn when the schema a data-only backup is restored into differs from the one it was dumped from."""
+        recorded = metadata.get("schema_sha256")
+        if recorded is None:
+            logger.warning("Data-only backup has no recorded schema hash, make sure the schema matches")
+            return
+
+        try:
+            current = self._schema_sha256()
+        except BackupError as e:
+            logger.warning(f"Could not compare the schema before restoring data-only backup: {e}")
+            return
+
+        if current != recorded:
+            logger.warning(
+                f"Schema of '{self.config.database}' differs from the one the data-only backup was dumped from, "
+                "the restore may fail or load data into changed tables"
+            )
+
+    def _restore_globals(self, globals_file: Path) -> None:
+        """Apply a pg_dumpall globals file through the postgres maintenance database.
+
+        Roles that already exist on the server produce errors that psql
+        reports and skips, so the rest of the file is still applied.
+        """
+        logger.info(f"Restoring roles and tablespaces from: {globals_file}")
+
+        env = self._env()
+
+        cmd = self._psql_args("postgres")
+
+        try:
+            with gzip.open(globals_file, "rb") as f:
                 sql_content = f.read()
 
             result = subprocess.run(
@@ -129,12 +1221,198 @@ class PostgresBackupAdapter(BackupAdapter):
                 check=True,
             )
 
-            logger.info(f"Restore completed successfully for database '{self.database_name}'")
+            if result.stderr:
+                logger.warning(f"psql reported errors while applying globals: {result.stderr.decode().strip()}")
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"psql globals restore failed: {error_msg}")
+            raise BackupError(f"PostgreSQL globals restore failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to read globals file: {e}")
+            raise BackupError(f"Failed to read globals file: {e}")
+
+    @staticmethod
+    def _sql_reader(source: BinaryIO, metadata: dict[str, str], progress: Progress | None) -> BinaryIO:
+        """Return a decompressed plain dump to feed psql, counting its bytes and tables into progress if given."""
+        if progress is None:
+            return source
+        if "uncompressed_size" in metadata:
+            progress.total = int(metadata["uncompressed_size"])
+        return ProgressReader(source, progress, _COPY_MARKER)
+
+    def _restore_logical(self, backup_file: Path, metadata: dict[str, str], progress: Progress | None = None) -> None:
+        """Replay a compressed SQL dump through psql.
+
+        With progress, the dump is decompressed as psql reads it, counting
+        the bytes fed to psql and the tables among them.
+
+        Args:
+            backup_file: Compressed SQL dump
+            metadata: Recorded metadata; the compression is detected from the file when it records none
+            progress: Counts the restore as it runs
+        """
+        logger.info(f"Starting PostgreSQL restore for database '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+        self._log_restore_settings("plain", jobs=1)
+
+        env = self._restore_env()
+
+        cmd = self._psql_args(self.config.database)
+
+        try:
+            logger.debug("Decompressing and executing restore")
+            with open_reader(backup_file, metadata.get("compression")) as f:
+                if progress is None:
+                    subprocess.run(cmd, env=env, input=f.read(), capture_output=True, check=True)
+                else:
+                    stderr = command_input(cmd, env, self._sql_reader(f, metadata, progress), "psql")
+                    if stderr:
+                        errors = stderr.decode(errors="replace").strip()
+                        logger.warning(f"psql reported errors while restoring: {errors}")
 
         except subprocess.CalledProcessError as e:
             error_msg = e.stderr.decode() if e.stderr else str(e)
             logger.error(f"psql restore failed: {error_msg}")
             raise BackupError(f"PostgreSQL restore failed: {error_msg}")
-        except OSError as e:
+        except BackupError as e:
+            logger.error(f"psql restore failed: {e}")
+            raise BackupError(f"PostgreSQL restore failed: {e}")
+        except (OSError, EOFError) as e:
+            logger.error(f"Failed to read backup file: {e}")
+            raise BackupError(f"Failed to read backup file: {e}")
+
+        logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+    def _restore_archive(
+        self,
+        backup_file: Path,
+        dump_format: str,
+        tables: list[str] | None = None,
+        progress: Progress | None = None,
+        clean: bool = False,
+    ) -> None:
+        """Restore a custom or directory format dump with pg_restore, optionally only some of its tables.
+
+        With clean, the objects of the dump are dropped before they are recreated.
+        """
+        logger.info(f"Starting PostgreSQL restore for database '{self.database_name}' with pg_restore")
+        logger.info(f"Restoring from: {backup_file}")
+        self._log_restore_settings(dump_format, jobs=self.config.restore_jobs)
+        if tables:
+            logger.info(f"Restoring only tables: {', '.join(tables)}")
+
+        cmd = self._pg_restore_args(tables or [], jobs=True, verbose=progress is not None, clean=clean)
+        if progress is not None:
+            progress.unit, progress.total = "tables", len(tables) if tables else None
+        self._run_pg_restore(cmd, backup_file, dump_format, progress)
+        logger.info(f"Restore completed successfully for database '{self.database_name}'")
+
+    def _list_archive(self, backup_file: Path, dump_format: str) -> str:
+        """Return the table of contents of a custom or directory format dump, as pg_restore --list prints it."""
+        logger.info(f"Reading table of contents of {backup_file.name}")
+        return self._run_pg_restore(["pg_restore", "--list"], backup_file, dump_format).decode(errors="replace")
+
+    def _run_pg_restore(
+        self, cmd: list[str], backup_file: Path, dump_format: str, progress: Progress | None = None
+    ) -> bytes:
+        """Run pg_restore on a dump, extracting directory format dumps first, and return its output.
+
+        With progress, cmd must be verbose; the tables restored are counted
+        from its messages against those the dump's table of contents holds.
+
+        Raises:
+            BackupError: If the dump cannot be read or pg_restore fails
+        """
+        env = self._restore_env()
+
+        try:
+            with tempfile.TemporaryDirectory(dir=backup_file.parent) as scratch:
+                if dump_format == "directory":
+                    with tarfile.open(backup_file) as archive:
+                        extract_tar(archive, Path(scratch))
+                    cmd = [*cmd, str(Path(scratch) / "dump")]
+                else:
+                    cmd = [*cmd, str(backup_file)]
+
+                logger.debug(f"Executing pg_restore command: {command_line(cmd, self.config.password)}")
+                if progress is None:
+                    return subprocess.run(cmd, env=env, capture_output=True, check=True).stdout
+
+                if progress.total is None:
+                    toc = subprocess.run(["pg_restore", "--list", cmd[-1]], env=env, capture_output=True, check=True)
+                    progress.total = len(_TABLE_DATA_ENTRY.findall(toc.stdout))
+                command_run(cmd, env, "pg_restore", count_tables(progress))
+                return b""
+
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"pg_restore failed: {error_msg}")
+            raise BackupError(f"PostgreSQL restore failed: {error_msg}")
+        except BackupError as e:
+            logger.error(str(e))
+            raise BackupError(f"PostgreSQL restore failed: {e}")
+        except (OSError, tarfile.TarError) as e:
             logger.error(f"Failed to read backup file: {e}")
             raise BackupError(f"Failed to read backup file: {e}")
+
+    def _restore_physical(self, backup_file: Path, options: RestoreOptions) -> None:
+        """Extract a physical base backup into an empty data directory.
+
+        The server must be stopped while restoring; PostgreSQL replays the
+        bundled WAL on its next start. With recovery settings, they are
+        appended to postgresql.auto.conf next to a recovery.signal file so
+        the server recovers from archived WAL instead.
+        """
+        if options.data_dir is None and not self.config.restore_data_dir:
+            raise BackupError(
+                "Backup is a physical base backup and cannot be replayed with psql, "
+                "set PG_RESTORE_DATA_DIR to extract it into a data directory"
+            )
+
+        data_dir = options.data_dir or Path(self.config.restore_data_dir)
+
+        logger.info(f"Starting PostgreSQL physical restore into '{data_dir}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        if data_dir.exists() and any(data_dir.iterdir()):
+            raise BackupError(f"Refusing to restore into non-empty data directory: {data_dir}")
+
+        try:
+            data_dir.mkdir(parents=True, exist_ok=True, mode=0o700)
+
+            with tempfile.TemporaryDirectory(dir=data_dir.parent) as scratch:
+                scratch_path = Path(scratch)
+
+                with tarfile.open(backup_file, "r:gz") as bundle:
+                    extract_tar(bundle, scratch_path)
+
+                for part in sorted(scratch_path.glob("*.tar")):
+                    if part.name == "base.tar":
+                        destination = data_dir
+                    elif part.name == "pg_wal.tar":
+                        destination = data_dir / "pg_wal"
+                    else:
+                        destination = data_dir.parent / f"{data_dir.name}_tablespace_{part.stem}"
+                        logger.warning(
+                            f"Tablespace {part.stem} extracted to {destination}, "
+                            "update the pg_tblspc symlink if its original location differs"
+                        )
+
+                    destination.mkdir(parents=True, exist_ok=True, mode=0o700)
+                    with tarfile.open(part) as archive:
+                        extract_tar(archive, destination)
+
+            if options.recovery:
+                with open(data_dir / "postgresql.auto.conf", "a") as auto_conf:
+                    auto_conf.write("\n# Added by NestVault for point-in-time recovery\n")
+                    for name, value in options.recovery.items():
+                        quoted = value.replace("'", "''")
+                        auto_conf.write(f"{name} = '{quoted}'\n")
+                (data_dir / "recovery.signal").touch()
+
+        except (OSError, tarfile.TarError) as e:
+            logger.error(f"Failed to extract base backup: {e}")
+            raise BackupError(f"Failed to extract base backup: {e}")
+
+        logger.info(f"Base backup extracted to {data_dir}, start PostgreSQL to complete recovery")
@@ -0,0 +1,183 @@
+"""Redis backup adapter using redis-cli RDB snapshots."""
+
+from __future__ import annotations
+
+import shutil
+import subprocess
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions, find_binary
+from nestvault.compression import compressed_extension, open_reader, open_writer
+from nestvault.config import CompressionConfig, RedisConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.redis")
+
+# Every RDB file starts with the magic string followed by a 4 digit version
+RDB_MAGIC = b"REDIS"
+
+
+def _verify_rdb_header(path: Path) -> None:
+    """Check that a file starts with the RDB magic header.
+
+    Args:
+        path: Path to the (uncompressed) RDB file
+
+    Raises:
+        BackupError: If the file is not a valid RDB snapshot
+    """
+    with open(path, "rb") as f:
+        header = f.read(9)
+
+    if not header.startswith(RDB_MAGIC) or not header[5:].isdigit():
+        raise BackupError(f"{path.name} is not a valid Redis RDB snapshot (bad header)")
+
+
+class RedisBackupAdapter(BackupAdapter):
+    """Backup adapter for Redis using `redis-cli --rdb` snapshots."""
+
+    def __init__(self, config: RedisConfig):
+        """Initialize the Redis backup adapter.
+
+        Args:
+            config: Redis connection configuration
+        """
+        self.config = config
+
+    @property
+    def database_name(self) -> str:
+        """Return the name used to identify this Redis instance's backups."""
+        return self.config.name
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return compressed_extension("rdb", self.config.compression)
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "redis"
+
+    @property
+    def compression(self) -> CompressionConfig:
+        """Return how backups are compressed."""
+        return self.config.compression
+
+    def backup(self, output_path: Path) -> Path:
+        """Create an RDB snapshot of the Redis server.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file (compressed)
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+        rdb_file = output_path / f"{self.database_name}_{timestamp}.rdb"
+
+        logger.info(f"Starting Redis snapshot for '{self.database_name}'")
+
+        env = {}
+        if self.config.password:
+            # REDISCLI_AUTH keeps the password out of the process list
+            env["REDISCLI_AUTH"] = self.config.password
+
+        cmd = [
+            find_binary("redis-cli"),
+            "-h", self.config.host,
+            "-p", str(self.config.port),
+        ]
+
+        if self.config.user:
+            cmd.extend(["--user", self.config.user])
+        if self.config.tls:
+            cmd.append("--tls")
+        if self.config.ca_cert:
+            cmd.extend(["--cacert", self.config.ca_cert])
+
+        cmd.extend(["--rdb", str(rdb_file)])
+
+        try:
+            logger.debug("Executing redis-cli --rdb")
+            subprocess.run(
+                cmd,
+                env=env,
+                capture_output=True,
+                check=True,
+                timeout=self.config.timeout,
+            )
+
+            _verify_rdb_header(rdb_file)
+
+            logger.debug(f"Compressing snapshot to {backup_file}")
+            with open(rdb_file, "rb") as src, open_writer(backup_file, self.config.compression) as dst:
+                shutil.copyfileobj(src, dst)
+
+            file_size = backup_file.stat().st_size
+            logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+            return backup_file
+
+        except subprocess.TimeoutExpired:
+            logger.error(f"redis-cli did not finish within {self.config.timeout} seconds")
+            raise BackupError(f"Redis snapshot timed out after {self.config.timeout} seconds")
+        except subprocess.CalledProcessError as e:
+            error_msg = e.stderr.decode() if e.stderr else str(e)
+            logger.error(f"redis-cli failed: {error_msg}")
+            raise BackupError(f"Redis backup failed: {error_msg}")
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+        finally:
+            rdb_file.unlink(missing_ok=True)
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Write an RDB snapshot to the configured restore path.
+
+        Redis only loads RDB files at startup, so the snapshot is placed on
+        disk and the operator is told how to activate it.
+
+        Args:
+            backup_file: Path to the backup file (.rdb.gz or .rdb.zst)
+            options: Restore options including the recorded compression
+
+        Raises:
+            BackupError: If the restore operation fails
+        """
+        options = options or RestoreOptions()
+        target = Path(self.config.restore_path)
+        partial = target.with_name(target.name + ".partial")
+
+        logger.info(f"Starting Redis restore for '{self.database_name}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        try:
+            target.parent.mkdir(parents=True, exist_ok=True)
+
+            with open_reader(backup_file, options.metadata.get("compression")) as src, open(partial, "wb") as dst:
+                shutil.copyfileobj(src, dst)
+
+            _verify_rdb_header(partial)
+            partial.replace(target)
+
+        except OSError as e:
+            partial.unlink(missing_ok=True)
+            logger.error(f"Failed to write RDB file: {e}")
+            raise BackupError(f"Failed to write RDB file: {e}")
+        except BackupError:
+            partial.unlink(missing_ok=True)
+            raise
+
+        logger.info(f"RDB snapshot written to {target}")
+        logger.info(
+            "To load it: stop the Redis server, place this file at the path configured by "
+            "'dir' and 'dbfilename' (with appendonly disabled), then start Redis again"
+        )
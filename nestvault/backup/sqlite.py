@@ -0,0 +1,169 @@
+"""SQLite backup adapter using the online backup API."""
+
+from __future__ import annotations
+
+import shutil
+import sqlite3
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter, RestoreOptions
+from nestvault.compression import compressed_extension, open_reader, open_writer
+from nestvault.config import CompressionConfig, SQLiteConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("backup.sqlite")
+
+# Sidecar files SQLite keeps next to a database in WAL mode
+SIDECAR_SUFFIXES = ("-wal", "-shm")
+
+
+class SQLiteBackupAdapter(BackupAdapter):
+    """Backup adapter for SQLite database files.
+
+    Uses the SQLite online backup API instead of copying the file, so the
+    snapshot is consistent even while the application is writing and
+    includes transactions that are still only in the WAL file.
+    """
+
+    def __init__(self, config: SQLiteConfig):
+        """Initialize the SQLite backup adapter.
+
+        Args:
+            config: SQLite database file configuration
+        """
+        self.config = config
+        self.path = Path(config.path)
+
+    @property
+    def database_name(self) -> str:
+        """Return the name of the database being backed up."""
+        return self.path.stem
+
+    @property
+    def file_extension(self) -> str:
+        """Return the file extension for backup files."""
+        return compressed_extension("sqlite", self.config.compression)
+
+    @property
+    def engine(self) -> str:
+        """Return the engine identifier recorded with each backup."""
+        return "sqlite"
+
+    @property
+    def compression(self) -> CompressionConfig:
+        """Return how backups are compressed."""
+        return self.config.compression
+
+    def backup(self, output_path: Path) -> Path:
+        """Create a consistent copy of the SQLite database.
+
+        Args:
+            output_path: Directory to write the backup file to
+
+        Returns:
+            Path to the created backup file (compressed)
+
+        Raises:
+            BackupError: If the backup operation fails
+        """
+        timestamp = datetime.now(timezone.utc).strftime("%Y%m%d_%H%M%S")
+        filename = f"{self.database_name}_{timestamp}.{self.file_extension}"
+        backup_file = output_path / filename
+        snapshot_file = output_path / f"{self.database_name}_{timestamp}.sqlite"
+
+        logger.info(f"Starting SQLite backup for database '{self.path}'")
+
+        if not self.path.is_file():
+            raise BackupError(f"SQLite database file not found: {self.path}")
+
+        if Path(f"{self.path}-wal").exists():
+            logger.debug("Database is in WAL mode, committed WAL frames will be included")
+
+        source = None
+        snapshot = None
+
+        try:
+            source = sqlite3.connect(f"file:{self.path}?mode=ro", uri=True, timeout=30)
+            snapshot = sqlite3.connect(snapshot_file)
+            source.backup(snapshot)
+
+            # Make the snapshot self-contained so no -wal file is needed to read it
+            snapshot.execute("PRAGMA journal_mode=DELETE")
+            snapshot.close()
+            snapshot = None
+
+            logger.debug(f"Compressing snapshot to {backup_file}")
+            with open(snapshot_file, "rb") as src, open_writer(backup_file, self.config.compression) as dst:
+                shutil.copyfileobj(src, dst)
+
+            file_size = backup_file.stat().st_size
+            logger.info(f"Backup completed: {filename} ({file_size} bytes)")
+
+            return backup_file
+
+        except sqlite3.Error as e:
+            logger.error(f"SQLite backup failed: {e}")
+            raise BackupError(f"SQLite backup failed: {e}")
+        except OSError as e:
+            logger.error(f"Failed to write backup file: {e}")
+            raise BackupError(f"Failed to write backup file: {e}")
+        finally:
+            if snapshot is not None:
+                snapshot.close()
+            if source is not None:
+                source.close()
+            snapshot_file.unlink(missing_ok=True)
+
+    def restore(self, backup_file: Path, options: RestoreOptions | None = None) -> None:
+        """Restore the SQLite database file from a backup.
+
+        Args:
+            backup_file: Path to the backup file (.sqlite.gz or .sqlite.zst)
+            options: Restore options; `force` allows overwriting an existing file
+
+        Raises:
+            BackupError: If the destination exists without force, or the restore fails
+        """
+        options = options or RestoreOptions()
+        partial = self.path.with_name(self.path.name + ".partial")
+
+        logger.info(f"Starting SQLite restore to '{self.path}'")
+        logger.info(f"Restoring from: {backup_file}")
+
+        if self.path.exists() and not options.force:
+            raise BackupError(
+                f"Refusing to overwrite existing database file {self.path}, pass --force to replace it"
+            )
+
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+
+            with open_reader(backup_file, options.metadata.get("compression")) as src, open(partial, "wb") as dst:
+                shutil.copyfileobj(src, dst)
+
+            check = sqlite3.connect(partial)
+            try:
+                result = check.execute("PRAGMA integrity_check").fetchone()
+            finally:
+                check.close()
+
+            if result[0] != "ok":
+                raise BackupError(f"Restored SQLite database failed integrity check: {result[0]}")
+
+            # Stale WAL/SHM files from the old database would corrupt the restored one
+            for suffix in SIDECAR_SUFFIXES:
+                Path(f"{self.path}{suffix}").unlink(missing_ok=True)
+
+            partial.replace(self.path)
+
+        except (sqlite3.Error, OSError) as e:
+            partial.unlink(missing_ok=True)
+            logger.error(f"SQLite restore failed: {e}")
+            raise BackupError(f"SQLite restore failed: {e}")
+        except BackupError:
+            partial.unlink(missing_ok=True)
+            raise
+
+        logger.info(f"Restore completed successfully for database '{self.path}'")
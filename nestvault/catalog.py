@@ -0,0 +1,319 @@
+"""The catalog of stored backups of every target, and the queries `list` and GET /backups run over it."""
+
+from __future__ import annotations
+
+import csv
+import io
+import json
+import re
+import threading
+import time
+from collections.abc import Callable, Mapping, Sequence
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta, timezone
+from typing import TYPE_CHECKING
+
+from nestvault.config import parse_label
+from nestvault.exceptions import ConfigError
+from nestvault.hold import Hold, read_holds
+from nestvault.manifest import Manifest, describe_backups, format_labels
+from nestvault.naming import listing_prefix
+
+if TYPE_CHECKING:
+    from nestvault.scheduler import BackupTarget
+
+# 'complete' backups hold all of their database, 'partial' ones leave tables out,
+# and 'legacy' ones were stored without a manifest, so what they hold is unknown
+STATUSES = ("complete", "partial", "legacy")
+SORT_FIELDS = ("finished_at", "size", "duration", "target", "database")
+ORDERS = ("desc", "asc")
+OUTPUTS = ("table", "json", "csv")
+
+# Backups GET /backups returns by default, and at most
+DEFAULT_PAGE_SIZE = 100
+MAX_PAGE_SIZE = 1000
+
+COLUMNS = ("target", "database", "finished_at", "size", "status", "key", "labels", "hold")
+
+
+@dataclass
+class Entry:
+    """A stored backup of a target, with the hold on it if any."""
+
+    target: str
+    manifest: Manifest
+    hold: Hold | None = None
+
+    @property
+    def status(self) -> str:
+        if self.manifest.legacy:
+            return "legacy"
+        return "partial" if self.manifest.partial else "complete"
+
+    def to_dict(self) -> dict[str, object]:
+        """Describe the backup as /backups and `list --output json` return it."""
+        manifest = self.manifest
+        return {
+            "target": self.target,
+            "database": manifest.database,
+            "key": manifest.key,
+            "status": self.status,
+            "started_at": manifest.started_at.isoformat() if manifest.started_at else None,
+            "finished_at": manifest.finished_at.isoformat(),
+            "duration": manifest.duration,
+            "size": manifest.size,
+            "uncompressed_size": manifest.uncompressed_size,
+            "engine": manifest.engine,
+            "compression": manifest.compression,
+            "encryption": manifest.encryption,
+            "labels": dict(manifest.labels),
+            "held": self.hold is not None,
+        }
+
+
+def read_catalog(targets: Sequence[BackupTarget], database: str | None = None) -> list[Entry]:
+    """Read the backups of targets from their primary storage, newest first within each database.
+
+    Args:
+        targets: Targets to read the backups of
+        database: Only read the backups of this database when backing up all databases on a server
+
+    Raises:
+        StorageError: If listing fails
+    """
+    entries = []
+    for target in targets:
+        adapters = target.backup_adapter.expand()
+        if database:
+            adapters = [target.backup_adapter.for_database(database)]
+
+        for backup_adapter in adapters:
+            objects = target.storage_adapter.list(prefix=listing_prefix(target.key_template, backup_adapter))
+            holds = read_holds(target.storage_adapter, objects)
+            entries.extend(
+                Entry(target.name, manifest, holds.get(manifest.key))
+                for manifest, _ in describe_backups(target.storage_adapter, objects)
+                if backup_adapter.is_own_backup(manifest.key)
+                and (backup_adapter.database_name is None or manifest.database == backup_adapter.database_name)
+            )
+    return entries
+
+
+class Catalog:
+    """The backups of targets, read again from their storage once max_age seconds passed since the last read.
+
+    GET /backups is answered from here, so customers paging through
+    their history do not have every page list the buckets again.
+    """
+
+    def __init__(self, targets: Sequence[BackupTarget], max_age: float = 60.0):
+        self.targets = targets
+        self.max_age = max_age
+        self.lock = threading.Lock()
+        self.read_at: float | None = None
+        self.cached: list[Entry] = []
+
+    def entries(self) -> list[Entry]:
+        """Return every backup of the targets.
+
+        Raises:
+            StorageError: If listing fails
+        """
+        with self.lock:
+            if self.read_at is None or time.monotonic() - self.read_at > self.max_age:
+                self.cached = read_catalog(self.targets)
+                self.read_at = time.monotonic()
+            return self.cached
+
+    def query(self, params: Mapping[str, list[str]]) -> dict[str, object]:
+        """Return the page of backups the parameters of GET /backups ask for, see BackupQuery.from_params.
+
+        Raises:
+            ValueError: If a parameter is invalid
+            StorageError: If listing fails
+        """
+        return BackupQuery.from_params(params).page(self.entries()).to_dict()
+
+
+def parse_time(value: str, source: str, now: datetime | None = None) -> datetime:
+    """Parse an ISO 8601 date or time, in UTC unless it names its offset, or an age such as '30d' before now.
+
+    Ages count seconds, minutes, hours, days or weeks, e.g. '90s', '15m', '12h', '30d' or '2w'.
+
+    Raises:
+        ValueError: If the time is malformed
+    """
+    age = re.fullmatch(r"(\d+)([smhdw])", value.strip())
+    if age is not None:
+        unit = {"s": "seconds", "m": "minutes", "h": "hours", "d": "days", "w": "weeks"}[age.group(2)]
+        return (now or datetime.now(timezone.utc)) - timedelta(**{unit: int(age.group(1))})
+    try:
+        parsed = datetime.fromisoformat(value.strip().removesuffix("Z").removesuffix("z"))
+    except ValueError:
+        raise ValueError(
+            f"Invalid {source}: '{value}'. Use e.g. '2024-01-15', '2024-01-15T02:00:00+00:00' or '30d' for an age"
+        )
+    return parsed if parsed.tzinfo is not None else parsed.replace(tzinfo=timezone.utc)
+
+
+@dataclass
+class Page:
+    """The backups a query selected, and which of them one page holds."""
+
+    entries: list[Entry]
+    total: int
+    offset: int
+    limit: int | None
+
+    def to_dict(self) -> dict[str, object]:
+        return {
+            "total": self.total,
+            "offset": self.offset,
+            "limit": self.limit,
+            "backups": [entry.to_dict() for entry in self.entries],
+        }
+
+
+def _sort_value(entry: Entry, name: str) -> object:
+    if name == "target":
+        return entry.target
+    if name == "duration":
+        return entry.manifest.duration
+    return getattr(entry.manifest, name)
+
+
+@dataclass
+class BackupQuery:
+    """Which backups to select from the catalog, in which order, and which page of them."""
+
+    target: str | None = None
+    database: str | None = None
+    # Only backups finished at or after since, and before until
+    since: datetime | None = None
+    until: datetime | None = None
+    status: str | None = None
+    labels: dict[str, str] = field(default_factory=dict)
+    sort: str = "finished_at"
+    order: str = "desc"
+    # None for every backup from offset on
+    limit: int | None = None
+    offset: int = 0
+
+    def __post_init__(self):
+        if self.status is not None and self.status not in STATUSES:
+            raise ValueError(f"Invalid status: '{self.status}'. Use one of {', '.join(STATUSES)}")
+        if self.sort not in SORT_FIELDS:
+            raise ValueError(f"Invalid sort: '{self.sort}'. Use one of {', '.join(SORT_FIELDS)}")
+        if self.order not in ORDERS:
+            raise ValueError(f"Invalid order: '{self.order}'. Use one of {', '.join(ORDERS)}")
+        if self.limit is not None and self.limit < 1:
+            raise ValueError("Invalid limit: must be at least 1")
+        if self.offset < 0:
+            raise ValueError("Invalid offset: must not be negative")
+
+    def matches(self, entry: Entry) -> bool:
+        manifest = entry.manifest
+        return (
+            (self.target is None or entry.target == self.target)
+            and (self.database is None or manifest.database == self.database)
+            and (self.since is None or manifest.finished_at >= self.since)
+            and (self.until is None or manifest.finished_at < self.until)
+            and (self.status is None or entry.status == self.status)
+            and all(manifest.labels.get(name) == value for name, value in self.labels.items())
+        )
+
+    def select(self, entries: list[Entry]) -> list[Entry]:
+        """Return the backups matching the query in its order; those missing the sort field come last."""
+        selected = [entry for entry in entries if self.matches(entry)]
+        known = [entry for entry in selected if _sort_value(entry, self.sort) is not None]
+        unknown = [entry for entry in selected if _sort_value(entry, self.sort) is None]
+        known.sort(key=lambda entry: _sort_value(entry, self.sort), reverse=self.order == "desc")
+        return known + unknown
+
+    def page(self, entries: list[Entry]) -> Page:
+        selected = self.select(entries)
+        end = None if self.limit is None else self.offset + self.limit
+        return Page(selected[self.offset : end], len(selected), self.offset, self.limit)
+
+    @classmethod
+    def from_params(cls, params: Mapping[str, list[str]]) -> BackupQuery:
+        """Build a query from the parameters of GET /backups, as urllib.parse.parse_qs returns them.
+
+        The page holds DEFAULT_PAGE_SIZE backups unless limit asks for
+        another number, up to MAX_PAGE_SIZE.
+
+        Raises:
+            ValueError: If a parameter is invalid
+        """
+
+        def single(name: str) -> str | None:
+            values = params.get(name)
+            return values[-1] if values else None
+
+        def number(name: str, default: int) -> int:
+            value = single(name)
+            try:
+                return int(value) if value is not None else default
+            except ValueError:
+                raise ValueError(f"Invalid {name}: '{value}'. Use a whole number")
+
+        try:
+            labels = dict(parse_label(label, "label") for label in params.get("label", []))
+        except ConfigError as e:
+            raise ValueError(str(e))
+
+        since, until = single("since"), single("until")
+        limit = number("limit", DEFAULT_PAGE_SIZE)
+        if limit > MAX_PAGE_SIZE:
+            raise ValueError(f"Invalid limit: {limit}. Ask for at most {MAX_PAGE_SIZE} backups per page")
+        return cls(
+            target=single("target"),
+            database=single("database"),
+            since=parse_time(since, "since") if since is not None else None,
+            until=parse_time(until, "until") if until is not None else None,
+            status=single("status"),
+            labels=labels,
+            sort=single("sort") or "finished_at",
+            order=single("order") or "desc",
+            limit=limit,
+            offset=number("offset", 0),
+        )
+
+
+def _row(entry: Entry, describe_time: Callable[[datetime], str]) -> list[str]:
+    manifest = entry.manifest
+    return [
+        entry.target,
+        manifest.database,
+        describe_time(manifest.finished_at),
+        str(manifest.size),
+        entry.status,
+        manifest.key,
+        format_labels(manifest.labels),
+        entry.hold.describe() if entry.hold is not None else "",
+    ]
+
+
+def render(page: Page, output: str) -> str:
+    """Render a page of backups as a table for people, or as JSON or CSV for other tools.
+
+    Args:
+        page: Page of backups to render
+        output: One of OUTPUTS
+    """
+    if output == "json":
+        return json.dumps(page.to_dict(), indent=2)
+
+    if output == "csv":
+        buffer = io.StringIO()
+        writer = csv.writer(buffer, lineterminator="\n")
+        writer.writerow(COLUMNS)
+        writer.writerows(_row(entry, datetime.isoformat) for entry in page.entries)
+        return buffer.getvalue().rstrip("\n")
+
+    rows = [[column.upper().replace("_", " ") for column in COLUMNS]]
+    rows.extend(_row(entry, lambda at: at.strftime("%Y-%m-%d %H:%M:%S")) for entry in page.entries)
+    widths = [max(len(row[column]) for row in rows) for column in range(len(COLUMNS))]
+    lines = ["  ".join(value.ljust(width) for value, width in zip(row, widths)).rstrip() for row in rows]
+    shown = f"{page.offset + 1}-{page.offset + len(page.entries)}" if page.entries else "none"
+    return "\n".join(lines + [f"({shown} of {page.total} backups)"])
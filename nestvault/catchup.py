@@ -0,0 +1,62 @@
+"""Records of the scheduled runs that completed, so runs missed while NestVault was down are caught up."""
+
+from __future__ import annotations
+
+import json
+import tempfile
+from datetime import datetime
+from pathlib import Path
+
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("catchup")
+
+# Key prefix the records are kept under, next to the backups
+SCHEDULE_PREFIX = "schedules/"
+
+
+def run_record_key(run_name: str) -> str:
+    """Return the key of the record of a scheduled run, e.g. 'schedules/billing/hourly.json'."""
+    return f"{SCHEDULE_PREFIX}{run_name}.json"
+
+
+def record_run(storage_adapter: StorageAdapter, run_name: str, due: datetime, finished_at: datetime) -> None:
+    """Record that a scheduled run completed, replacing the record of its previous run.
+
+    A record that cannot be uploaded is only logged, as it only decides
+    whether a later start catches up on the run.
+
+    Args:
+        storage_adapter: Storage the run's backups go to
+        run_name: Name of the run, e.g. 'billing/hourly'
+        due: When the run fell due
+        finished_at: When it completed
+    """
+    key = run_record_key(run_name)
+    record = {"run": run_name, "due": due.isoformat(), "finished_at": finished_at.isoformat()}
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "run.json"
+        local_file.write_text(json.dumps(record, indent=2, sort_keys=True))
+        try:
+            storage_adapter.upload(local_file, key)
+        except StorageError as e:
+            logger.warning(f"Failed to record the run of '{run_name}' in {key}: {e}")
+
+
+def last_run(storage_adapter: StorageAdapter, run_name: str) -> datetime | None:
+    """Return when the last recorded run of a schedule fell due, None if none is recorded or it is unreadable."""
+    key = run_record_key(run_name)
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "run.json"
+        try:
+            if not any(obj.key == key for obj in storage_adapter.list(prefix=key)):
+                return None
+            storage_adapter.download(key, local_file)
+            return datetime.fromisoformat(json.loads(local_file.read_text())["due"])
+        except (StorageError, OSError, ValueError, KeyError, TypeError) as e:
+            logger.warning(f"Ignoring the record of the last run of '{run_name}' in {key}: {e}")
+            return None
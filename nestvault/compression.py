@@ -0,0 +1,337 @@
+"""Streaming compression of backup files."""
+
+from __future__ import annotations
+
+import contextvars
+import gzip
+import os
+import shutil
+import threading
+import time
+import zlib
+from collections.abc import Iterable, Iterator
+from contextlib import contextmanager
+from pathlib import Path
+from typing import BinaryIO
+
+import lz4.frame
+import zstandard
+
+from nestvault.config import COMPRESSION_LEVELS, CompressionConfig
+from nestvault.exceptions import BackupError
+from nestvault.stats import BackupStats, current, record
+from nestvault.tempdir import partial_path
+from nestvault.tracing import Span, start_span
+
+# File name suffix of each algorithm; uncompressed backups keep the bare extension
+EXTENSIONS = {"gzip": "gz", "zstd": "zst", "lz4": "lz4"}
+
+# Leading bytes of each format, used to detect backups uploaded without metadata
+MAGIC_BYTES = {"gzip": b"\x1f\x8b", "zstd": b"\x28\xb5\x2f\xfd", "lz4": b"\x04\x22\x4d\x18"}
+
+# Window of zstd long-distance matching, 128 MiB like `zstd --long`
+LONG_WINDOW_LOG = 27
+
+# Largest window accepted on decompression, so long-window backups restore too
+MAX_WINDOW_SIZE = 2**31
+
+CHUNK_SIZE = 1024 * 1024
+
+
+def compressed_extension(extension: str, compression: CompressionConfig) -> str:
+    """Append the algorithm's suffix to a file extension, e.g. 'sql' -> 'sql.zst'."""
+    if compression.algorithm == "none":
+        return extension
+    return f"{extension}.{EXTENSIONS[compression.algorithm]}"
+
+
+def compression_level(compression: CompressionConfig) -> int | None:
+    """Return the configured level, or the algorithm's default; None when uncompressed."""
+    if compression.algorithm == "none":
+        return None
+    if compression.level is not None:
+        return compression.level
+    return COMPRESSION_LEVELS[compression.algorithm][2]
+
+
+def decompressed_name(name: str) -> str:
+    """Strip the compression suffix from a file name, e.g. 'db.bak.zst' -> 'db.bak'."""
+    for extension in EXTENSIONS.values():
+        if name.endswith(f".{extension}"):
+            return name.removesuffix(f".{extension}")
+    return name
+
+
+def detect_algorithm(path: Path) -> str:
+    """Tell the compression algorithm of a file from its magic bytes.
+
+    Raises:
+        BackupError: If the file is not compressed with a supported algorithm
+    """
+    with open(path, "rb") as f:
+        head = f.read(4)
+
+    for algorithm, magic in MAGIC_BYTES.items():
+        if head.startswith(magic):
+            return algorithm
+
+    raise BackupError(f"{path.name} is not compressed with any of: {', '.join(EXTENSIONS)}")
+
+
+def _zstd_compressor(compression: CompressionConfig) -> zstandard.ZstdCompressor:
+    """Create a zstd compressor with the configured level and window."""
+    level = compression_level(compression)
+    if compression.long_window:
+        params = zstandard.ZstdCompressionParameters.from_level(
+            level, window_log=LONG_WINDOW_LOG, enable_ldm=True, write_checksum=True
+        )
+        return zstandard.ZstdCompressor(compression_params=params)
+    return zstandard.ZstdCompressor(level=level, write_checksum=True)
+
+
+class _PartialWriter:
+    """File written under its partial name, renamed to its final name once closed without an error.
+
+    Compressed files also record the time spent compressing and the bytes
+    in and out once closed, and are traced from opening to closing.
+    """
+
+    def __init__(self, writer: BinaryIO, path: Path, measured: bool, traced: Span | None = None):
+        self.writer = writer
+        self.path = path
+        self.measured = measured
+        self.traced = traced or Span()
+        self.bytes_in = 0
+        self.seconds = 0.0
+        self.closed = False
+
+    def write(self, data: bytes) -> int:
+        started = time.perf_counter()
+        written = self.writer.write(data)
+        self.seconds += time.perf_counter() - started
+        self.bytes_in += len(data)
+        return written
+
+    def close(self) -> None:
+        if self.closed:
+            return
+        started = time.perf_counter()
+        self.writer.close()
+        self.seconds += time.perf_counter() - started
+        self.closed = True
+        os.replace(partial_path(self.path), self.path)
+        if self.measured:
+            bytes_out = self.path.stat().st_size
+            record("compress", self.seconds, self.bytes_in, bytes_out)
+            self.traced.set(bytes_in=self.bytes_in, bytes_out=bytes_out)
+        self.traced.end()
+
+    def discard(self) -> None:
+        """Close and delete the file, which is incomplete."""
+        self.closed = True
+        try:
+            self.writer.close()
+        finally:
+            partial_path(self.path).unlink(missing_ok=True)
+            self.traced.end()
+
+    def __enter__(self) -> _PartialWriter:
+        return self
+
+    def __exit__(self, exc_type, *exc_info) -> None:
+        if exc_type is None:
+            self.close()
+        elif not self.closed:
+            self.traced.fail(exc_info[0])
+            self.discard()
+
+    def __getattr__(self, name: str):
+        return getattr(self.writer, name)
+
+
+def open_writer(path: Path, compression: CompressionConfig) -> BinaryIO:
+    """Open a file for compressed writing, compressing as data is written.
+
+    The file is written under a partial name until it is closed, so a
+    crashed run never leaves anything that looks complete. The time spent
+    compressing is recorded in the stats of the backup being made, see
+    nestvault.stats.
+
+    Args:
+        path: File to write
+        compression: Algorithm and its settings
+
+    Returns:
+        Binary file object; closing it finishes the compressed stream and
+        renames the file to path, leaving the block with an error deletes it
+    """
+    level = compression_level(compression)
+    partial = partial_path(path)
+
+    if compression.algorithm == "zstd":
+        writer = _zstd_compressor(compression).stream_writer(open(partial, "wb"))
+    elif compression.algorithm == "lz4":
+        writer = lz4.frame.open(partial, "wb", compression_level=level)
+    elif compression.algorithm == "none":
+        writer = open(partial, "wb")
+    else:
+        writer = gzip.open(partial, "wb", compresslevel=level)
+
+    measured = compression.algorithm != "none"
+    # Traced within backups only, as a child of their dump
+    traced = start_span("compress", algorithm=compression.algorithm) if measured and current() is not None else None
+    return _PartialWriter(writer, path, measured, traced)  # type: ignore[return-value]
+
+
+def compress_chunks(chunks: Iterable[bytes], compression: CompressionConfig) -> Iterator[bytes]:
+    """Compress a stream of chunks, yielding compressed data as it is produced.
+
+    The output is the same as open_writer() writes to a file, so streamed
+    backups restore like any other.
+
+    Args:
+        chunks: Uncompressed data in order
+        compression: Algorithm and its settings
+    """
+    if compression.algorithm == "none":
+        return iter(chunks)
+    # Consumers may read from another thread, so the stats and the parent span are looked up now
+    stats = current()
+    traced = start_span("compress", algorithm=compression.algorithm) if stats is not None else Span()
+    return _compress_chunks(chunks, compression, stats, traced)
+
+
+def _compress_chunks(
+    chunks: Iterable[bytes], compression: CompressionConfig, stats: BackupStats | None, traced: Span
+) -> Iterator[bytes]:
+    try:
+        yield from _compressed(chunks, compression, stats, traced)
+    except Exception as e:
+        traced.fail(e)
+        raise
+    finally:
+        traced.end()
+
+
+def _compressed(
+    chunks: Iterable[bytes], compression: CompressionConfig, stats: BackupStats | None, traced: Span
+) -> Iterator[bytes]:
+    level = compression_level(compression)
+    bytes_in = bytes_out = 0
+    seconds = 0.0
+
+    def measured(compress, data: bytes = b"") -> bytes:
+        nonlocal bytes_in, bytes_out, seconds
+        started = time.perf_counter()
+        output = compress(data) if data else compress()
+        seconds += time.perf_counter() - started
+        bytes_in += len(data)
+        bytes_out += len(output)
+        return output
+
+    if compression.algorithm == "zstd":
+        compressor = _zstd_compressor(compression).compressobj()
+    elif compression.algorithm == "lz4":
+        compressor = lz4.frame.LZ4FrameCompressor(compression_level=level)
+        yield measured(compressor.begin)
+    else:
+        # wbits 31 writes a gzip header and trailer around the deflate stream
+        compressor = zlib.compressobj(level, zlib.DEFLATED, 31)
+
+    for chunk in chunks:
+        if chunk and (data := measured(compressor.compress, chunk)):
+            yield data
+    yield measured(compressor.flush)
+
+    if stats is not None:
+        stats.add("compress", seconds, bytes_in, bytes_out)
+    traced.set(bytes_in=bytes_in, bytes_out=bytes_out)
+
+
+def open_reader(path: Path, algorithm: str | None = None) -> BinaryIO:
+    """Open a compressed file for reading, decompressing as data is read.
+
+    Args:
+        path: File to read
+        algorithm: Algorithm recorded with the backup ('none' for uncompressed); detected from
+            the file when None or unknown
+
+    Returns:
+        Binary file object yielding the decompressed data
+
+    Raises:
+        BackupError: If the algorithm cannot be detected
+    """
+    if algorithm == "none":
+        return open(path, "rb")
+
+    if algorithm not in EXTENSIONS:
+        algorithm = detect_algorithm(path)
+
+    if algorithm == "zstd":
+        return zstandard.ZstdDecompressor(max_window_size=MAX_WINDOW_SIZE).stream_reader(open(path, "rb"))
+
+    if algorithm == "lz4":
+        return lz4.frame.open(path, "rb")
+
+    return gzip.open(path, "rb")
+
+
+def open_stream_reader(stream: BinaryIO, algorithm: str) -> BinaryIO:
+    """Decompress a stream as it is read, e.g. a backup read from storage.
+
+    Args:
+        stream: Compressed data
+        algorithm: Algorithm recorded with the backup, 'none' for uncompressed
+
+    Returns:
+        Binary file object yielding the decompressed data; the caller still closes the stream
+
+    Raises:
+        BackupError: If the algorithm is unknown
+    """
+    if algorithm == "none":
+        return stream
+    if algorithm == "zstd":
+        return zstandard.ZstdDecompressor(max_window_size=MAX_WINDOW_SIZE).stream_reader(stream)
+    if algorithm == "lz4":
+        return lz4.frame.open(stream, "rb")
+    if algorithm == "gzip":
+        return gzip.GzipFile(fileobj=stream, mode="rb")
+
+    raise BackupError(f"Unknown compression algorithm: {algorithm}")
+
+
+@contextmanager
+def compressing_pipe(path: Path, compression: CompressionConfig) -> Iterator[int]:
+    """Yield the write end of a pipe whose data is compressed into a file.
+
+    Passed as a subprocess's stdout, the dump is compressed while it runs
+    instead of being held in memory. The file is complete once the context
+    exits.
+
+    Raises:
+        OSError: If compressing into the file fails
+    """
+    read_fd, write_fd = os.pipe()
+    errors: list[Exception] = []
+
+    def pump() -> None:
+        try:
+            with open(read_fd, "rb") as src, open_writer(path, compression) as dst:
+                shutil.copyfileobj(src, dst, CHUNK_SIZE)
+        except (OSError, RuntimeError, zstandard.ZstdError) as e:
+            errors.append(e)
+
+    # The pump records its compression stats in the caller's context
+    thread = threading.Thread(target=contextvars.copy_context().run, args=(pump,), daemon=True)
+    thread.start()
+
+    try:
+        yield write_fd
+    finally:
+        os.close(write_fd)
+        thread.join()
+
+    if errors:
+        raise OSError(f"Failed to compress {path.name}: {errors[0]}")
@@ -0,0 +1,294 @@
+"""Database credentials leased for every run, e.g. from the database secrets engine of HashiCorp Vault."""
+
+from __future__ import annotations
+
+import json
+import ssl
+import threading
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+from abc import ABC, abstractmethod
+from collections.abc import Iterator
+from contextlib import contextmanager
+from dataclasses import dataclass, replace
+from datetime import datetime, timedelta, timezone
+
+from nestvault.backup.base import BackupAdapter
+from nestvault.config import VaultConfig
+from nestvault.exceptions import CredentialError
+from nestvault.logging import get_logger, register_secrets
+
+logger = get_logger("credentials")
+
+# Longest wait between two attempts of a request to Vault
+MAX_BACKOFF = 30.0
+
+# Share of a lease's duration after which it is renewed, so a failed renewal leaves time for retries
+RENEW_AFTER = 2 / 3
+
+# Shortest wait between renewals, for leases of a few seconds
+MIN_RENEW_INTERVAL = 5.0
+
+
+@dataclass
+class Lease:
+    """Credentials valid for a limited time, as a provider handed them out."""
+
+    username: str
+    password: str
+    # ID the provider renews and revokes the lease by; empty for credentials that do not expire
+    lease_id: str = ""
+    # Seconds the credentials are valid for after the lease was obtained or last renewed, 0 for no limit
+    duration: float = 0
+    renewable: bool = False
+
+    @property
+    def expires(self) -> datetime | None:
+        """Return when the credentials expire unless renewed, None when they do not."""
+        if not self.duration:
+            return None
+        return datetime.now(timezone.utc) + timedelta(seconds=self.duration)
+
+
+class CredentialProvider(ABC):
+    """A service handing out database credentials for the length of a run."""
+
+    @property
+    @abstractmethod
+    def name(self) -> str:
+        """Return the provider's name for logs (e.g., 'vault')."""
+        pass
+
+    @abstractmethod
+    def acquire(self) -> Lease:
+        """Obtain credentials.
+
+        Raises:
+            CredentialError: If the provider cannot be reached or refuses to hand out credentials
+        """
+        pass
+
+    @abstractmethod
+    def renew(self, lease: Lease) -> Lease:
+        """Extend a lease, returning it with its new duration.
+
+        Raises:
+            CredentialError: If the lease cannot be renewed
+        """
+        pass
+
+    @abstractmethod
+    def revoke(self, lease: Lease) -> None:
+        """End a lease before it expires, so its credentials stop working.
+
+        Raises:
+            CredentialError: If the lease cannot be revoked
+        """
+        pass
+
+
+class VaultCredentialProvider(CredentialProvider):
+    """Leases database credentials from the database secrets engine of HashiCorp Vault.
+
+    Every acquire logs in with the configured auth method, unless a token
+    is configured, and reads the role's credentials path. The token logged
+    in with is renewed along with the lease, as Vault revokes the leases
+    of a token that expires, and is revoked with the lease.
+    """
+
+    name = "vault"
+
+    def __init__(self, config: VaultConfig, timeout: float = 10):
+        """Initialize the Vault credential provider.
+
+        Args:
+            config: Vault address, auth method and credentials path
+            timeout: Seconds a request to Vault may take
+        """
+        self.config = config
+        self.address = config.address.rstrip("/")
+        self.timeout = timeout
+        self.context = ssl.create_default_context(cafile=config.ca_cert_file) if config.ca_cert_file else None
+        # Token of the current login, None before the first login or with a configured token
+        self.token: str | None = None
+        self.token_renewable = False
+
+    def _request(self, method: str, path: str, body: dict | None = None, token: str | None = None) -> dict:
+        """Send a request to the Vault API, returning its JSON response.
+
+        A request that fails to connect or is answered with a 5xx status,
+        e.g. while Vault is sealed or electing a leader, is sent again up
+        to config.retries times, waiting 1s, 2s, 4s and so on in between.
+
+        Raises:
+            CredentialError: If the request fails or is answered with an error status
+        """
+        headers = {"User-Agent": "nestvault", "Content-Type": "application/json"}
+        if token is not None:
+            headers["X-Vault-Token"] = token
+        if self.config.namespace:
+            headers["X-Vault-Namespace"] = self.config.namespace
+        data = json.dumps(body).encode() if body is not None else None
+        request = urllib.request.Request(f"{self.address}/v1/{path}", data=data, headers=headers, method=method)
+
+        failed = 0
+        while True:
+            try:
+                with urllib.request.urlopen(request, timeout=self.timeout, context=self.context) as response:
+                    content = response.read()
+                    return json.loads(content) if content else {}
+            except urllib.error.HTTPError as e:
+                errors = _errors(e.read())
+                error = CredentialError(f"Vault answered {method} {path} with HTTP {e.code}{errors}")
+                if e.code < 500 or failed == self.config.retries:
+                    raise error
+            except (urllib.error.URLError, OSError, ValueError) as e:
+                error = CredentialError(f"Vault at {self.address} is not reachable: {e}")
+                if failed == self.config.retries:
+                    raise error
+            delay = min(2.0**failed, MAX_BACKOFF)
+            failed += 1
+            logger.info(f"{error}, trying again in {delay:.0f}s")
+            time.sleep(delay)
+
+    def _login(self) -> str:
+        """Return the token to read credentials with, logging in unless one is configured."""
+        config = self.config
+        if config.auth_method == "token":
+            return config.token
+
+        mount = config.auth_mount or config.auth_method
+        if config.auth_method == "approle":
+            body = {"role_id": config.role_id, "secret_id": config.secret_id}
+        else:
+            try:
+                with open(config.jwt_path) as f:
+                    jwt = f.read().strip()
+            except OSError as e:
+                raise CredentialError(f"Failed to read the Kubernetes service account token {config.jwt_path}: {e}")
+            body = {"role": config.kubernetes_role, "jwt": jwt}
+
+        auth = self._request("POST", f"auth/{mount}/login", body).get("auth") or {}
+        if not auth.get("client_token"):
+            raise CredentialError(f"Vault login with {config.auth_method} returned no token")
+        register_secrets([auth["client_token"]])
+        self.token = auth["client_token"]
+        self.token_renewable = bool(auth.get("renewable"))
+        return self.token
+
+    def acquire(self) -> Lease:
+        response = self._request("GET", self.config.credentials_path, token=self._login())
+        data = response.get("data") or {}
+        if not data.get("username") or not data.get("password"):
+            raise CredentialError(f"Vault returned no username and password at {self.config.credentials_path}")
+        register_secrets([data["password"]])
+        return Lease(
+            username=data["username"],
+            password=data["password"],
+            lease_id=response.get("lease_id", ""),
+            duration=response.get("lease_duration", 0),
+            renewable=bool(response.get("renewable")),
+        )
+
+    def renew(self, lease: Lease) -> Lease:
+        if self.token is not None and self.token_renewable:
+            self._request("POST", "auth/token/renew-self", {}, token=self.token)
+        token = self.token or self.config.token
+        response = self._request(
+            "PUT", "sys/leases/renew", {"lease_id": lease.lease_id, "increment": int(lease.duration)}, token=token
+        )
+        return replace(
+            lease, duration=response.get("lease_duration", 0), renewable=bool(response.get("renewable"))
+        )
+
+    def revoke(self, lease: Lease) -> None:
+        token = self.token or self.config.token
+        try:
+            if lease.lease_id:
+                self._request("PUT", "sys/leases/revoke", {"lease_id": lease.lease_id}, token=token)
+        finally:
+            if self.token is not None:
+                self._request("POST", "auth/token/revoke-self", {}, token=self.token)
+                self.token = None
+
+
+def _errors(body: bytes) -> str:
+    """Return the errors of a Vault error response, as ': <error>; <error>', or '' when it has none."""
+    try:
+        errors = json.loads(body).get("errors") or []
+    except (ValueError, AttributeError):
+        return ""
+    return f": {'; '.join(str(error) for error in errors)}" if errors else ""
+
+
+class LeaseKeeper:
+    """Renews a lease in the background while a run uses its credentials.
+
+    A lease is renewed once RENEW_AFTER of its duration has passed, so a
+    backup may outlive the lease's initial duration. Vault stops extending
+    a lease at its role's max TTL; when a renewal comes back shorter than
+    asked for, the time the credentials expire is logged as a warning.
+    """
+
+    def __init__(self, provider: CredentialProvider, lease: Lease):
+        self.provider = provider
+        self.lease = lease
+        self.stopped = threading.Event()
+        self.thread = threading.Thread(target=self._run, name="lease-keeper", daemon=True)
+
+    def start(self) -> None:
+        if self.lease.renewable and self.lease.duration:
+            self.thread.start()
+
+    def _run(self) -> None:
+        increment = self.lease.duration
+        while not self.stopped.wait(max(self.lease.duration * RENEW_AFTER, MIN_RENEW_INTERVAL)):
+            try:
+                renewed = self.provider.renew(self.lease)
+            except CredentialError as e:
+                logger.warning(f"Failed to renew the lease of the database credentials: {e}")
+                # Try again while there is time left, without drifting past the expiry
+                self.lease = replace(self.lease, duration=self.lease.duration * (1 - RENEW_AFTER))
+                continue
+            if renewed.duration < increment:
+                logger.warning(
+                    f"The lease of the database credentials reached its maximum duration, they expire at "
+                    f"{renewed.expires.isoformat(timespec='seconds')} even if the backup is still running"
+                )
+            self.lease = renewed
+            if not renewed.renewable or renewed.duration < increment:
+                return
+
+    def stop(self) -> None:
+        """Stop renewing the lease and revoke it."""
+        self.stopped.set()
+        if self.thread.is_alive():
+            self.thread.join()
+        try:
+            self.provider.revoke(self.lease)
+        except CredentialError as e:
+            logger.warning(f"Failed to revoke the lease of the database credentials, it expires on its own: {e}")
+
+
+@contextmanager
+def leased_credentials(provider: CredentialProvider, backup_adapter: BackupAdapter) -> Iterator[Lease]:
+    """Connect an adapter to its database with credentials leased for the length of the context.
+
+    The lease is renewed while the context runs and revoked once it ends.
+
+    Raises:
+        CredentialError: If the credentials cannot be obtained
+        BackupError: If the adapter's engine cannot take leased credentials
+    """
+    lease = provider.acquire()
+    keeper = LeaseKeeper(provider, lease)
+    try:
+        backup_adapter.use_credentials(lease.username, lease.password)
+        expires = f", valid until {lease.expires.isoformat(timespec='seconds')}" if lease.expires else ""
+        logger.info(f"Leased database credentials for '{lease.username}' from {provider.name}{expires}")
+        keeper.start()
+        yield lease
+    finally:
+        keeper.stop()
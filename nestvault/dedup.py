@@ -0,0 +1,369 @@
+"""Content-defined chunking of backups into a content-addressed chunk store shared between backups."""
+
+from __future__ import annotations
+
+import hashlib
+import json
+import tempfile
+import time
+import uuid
+import zlib
+from collections.abc import Iterator
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.compression import compressed_extension, open_reader, open_writer
+from nestvault.config import CompressionConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.verify import checksum_metadata
+
+logger = get_logger("dedup")
+
+# Key prefix chunks are stored under, next to the backups
+CHUNK_PREFIX = "chunks/"
+
+# Objects marking running backups and chunk cleanups, see collect_chunks
+LOCK_PREFIX = f"{CHUNK_PREFIX}locks/"
+GC_LOCK = f"{LOCK_PREFIX}gc"
+
+# Locks older than this were left behind by a run that died
+LOCK_MAX_AGE = timedelta(hours=24)
+
+# How long a backup waits for a running chunk cleanup, and how often it checks
+GC_WAIT_SECONDS = 600
+GC_POLL_SECONDS = 15
+
+# Suffix of the index a deduplicated backup is stored as, after the engine's extension
+INDEX_SUFFIX = ".dedup"
+
+# Bumped when the index layout changes, so older readers can tell
+INDEX_FORMAT = 1
+
+READ_SIZE = 1024 * 1024
+
+
+def index_name(name: str) -> str:
+    """Return the name of a backup's index, e.g. 'db.sql.gz' -> 'db.sql.gz.dedup'."""
+    return f"{name}{INDEX_SUFFIX}"
+
+
+def indexed_name(name: str) -> str:
+    """Return the name of the backup an index describes, e.g. 'db.sql.gz.dedup' -> 'db.sql.gz'."""
+    return name.removesuffix(INDEX_SUFFIX)
+
+
+def chunk_key(sha256: str, algorithm: str) -> str:
+    """Return the key a chunk is stored under, e.g. 'chunks/ab/ab12...ef.gz'."""
+    return f"{CHUNK_PREFIX}{sha256[:2]}/{compressed_extension(sha256, CompressionConfig(algorithm=algorithm))}"
+
+
+def _segments(stream: BinaryIO, limit: int) -> Iterator[bytes]:
+    """Split a stream after every newline, and every limit bytes of a longer line."""
+    buffer, start = b"", 0
+    while True:
+        end = buffer.find(b"\n", start, start + limit)
+        if end != -1:
+            yield buffer[start : end + 1]
+            start = end + 1
+        elif len(buffer) - start >= limit:
+            yield buffer[start : start + limit]
+            start += limit
+        else:
+            data = stream.read(READ_SIZE)
+            if not data:
+                if start < len(buffer):
+                    yield buffer[start:]
+                return
+            buffer, start = buffer[start:] + data, 0
+
+
+def split_chunks(stream: BinaryIO, average_size: int) -> Iterator[bytes]:
+    """Split a stream into chunks whose boundaries depend on the content around them.
+
+    Boundaries fall after lines whose checksum is below a threshold scaled
+    by their length, so on average every average_size bytes. Each depends
+    only on the line before it: inserting or changing a row of a dump moves
+    the chunk boundaries around it, and every other chunk is cut as before.
+    Chunks are at least a quarter and at most four times the average, the
+    latter also bounding chunks of data without newlines.
+
+    Args:
+        stream: Uncompressed data to split
+        average_size: Average chunk size in bytes
+    """
+    minimum, maximum = average_size // 4, average_size * 4
+    chunk = bytearray()
+
+    for segment in _segments(stream, maximum):
+        if len(chunk) + len(segment) > maximum:
+            yield bytes(chunk)
+            chunk = bytearray()
+        chunk += segment
+        if len(chunk) >= minimum and zlib.crc32(segment) < (len(segment) << 32) // average_size:
+            yield bytes(chunk)
+            chunk = bytearray()
+
+    if chunk:
+        yield bytes(chunk)
+
+
+@dataclass
+class ChunkIndex:
+    """The chunks a deduplicated backup is reassembled from, in order."""
+
+    # Size and checksum of the reassembled, uncompressed data
+    size: int
+    sha256: str
+    # Compression the chunks are stored with
+    compression: str
+    # (sha256, size) of each chunk's uncompressed data
+    chunks: list[tuple[str, int]] = field(default_factory=list)
+    # Chunks this backup uploaded, the rest were stored by earlier backups
+    new_chunks: int = 0
+
+    @property
+    def keys(self) -> set[str]:
+        """Return the keys of every chunk the backup needs."""
+        return {chunk_key(sha256, self.compression) for sha256, _ in self.chunks}
+
+    def to_json(self) -> str:
+        return json.dumps(
+            {
+                "format": INDEX_FORMAT,
+                "size": self.size,
+                "sha256": self.sha256,
+                "compression": self.compression,
+                "chunks": [list(chunk) for chunk in self.chunks],
+            }
+        )
+
+    @classmethod
+    def from_json(cls, text: str) -> ChunkIndex:
+        """Parse an index.
+
+        Raises:
+            ValueError: If the index is malformed
+        """
+        try:
+            data = json.loads(text)
+            return cls(
+                size=int(data["size"]),
+                sha256=data["sha256"],
+                compression=data["compression"],
+                chunks=[(sha256, int(size)) for sha256, size in data["chunks"]],
+            )
+        except (KeyError, TypeError) as e:
+            raise ValueError(f"index is incomplete: {e}")
+
+
+def read_index(storage_adapter: StorageAdapter, key: str) -> ChunkIndex:
+    """Download and parse a backup's index.
+
+    Raises:
+        StorageError: If the index cannot be downloaded or parsed
+    """
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "index.json"
+        storage_adapter.download(key, local_file)
+        try:
+            return ChunkIndex.from_json(local_file.read_text())
+        except (OSError, UnicodeDecodeError, ValueError) as e:
+            raise StorageError(f"Index {key} is unreadable: {e}")
+
+
+def _is_fresh(obj: StorageObject, now: datetime) -> bool:
+    last_modified = obj.last_modified
+    if last_modified.tzinfo is None:
+        last_modified = last_modified.replace(tzinfo=timezone.utc)
+    return now - last_modified < LOCK_MAX_AGE
+
+
+def _write_lock(storage_adapter: StorageAdapter, key: str, owner: str) -> None:
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "lock"
+        local_file.write_text(owner)
+        storage_adapter.upload(local_file, key, metadata={"lock": owner})
+
+
+def _running_gc(storage_adapter: StorageAdapter) -> bool:
+    now = datetime.now(timezone.utc)
+    return any(obj.key == GC_LOCK and _is_fresh(obj, now) for obj in storage_adapter.list(prefix=GC_LOCK))
+
+
+def lock_backup(storage_adapter: StorageAdapter, backup_name: str) -> str:
+    """Mark a backup as running, so chunk cleanup leaves the chunks it reuses alone.
+
+    The lock names the backup's index and stops counting once the index is
+    uploaded; collect_chunks deletes it then. A chunk cleanup already under
+    way is waited for, as it may be deleting chunks the backup would reuse.
+
+    Args:
+        storage_adapter: Storage adapter holding the chunks
+        backup_name: Name of the index the backup is uploaded as
+
+    Returns:
+        Key of the lock, to release it with if the backup fails
+
+    Raises:
+        BackupError: If a chunk cleanup is still running after GC_WAIT_SECONDS
+        StorageError: If the lock cannot be written
+    """
+    key = f"{LOCK_PREFIX}{backup_name}"
+    _write_lock(storage_adapter, key, backup_name)
+
+    deadline = time.monotonic() + GC_WAIT_SECONDS
+    while _running_gc(storage_adapter):
+        if time.monotonic() >= deadline:
+            storage_adapter.delete(key)
+            raise BackupError(f"Chunk cleanup has been running for over {GC_WAIT_SECONDS} seconds, not backing up")
+        logger.info("Waiting for a running chunk cleanup to finish")
+        time.sleep(GC_POLL_SECONDS)
+
+    return key
+
+
+def store_chunks(
+    storage_adapter: StorageAdapter,
+    stream: BinaryIO,
+    compression: CompressionConfig,
+    average_size: int,
+    temp_path: Path,
+) -> ChunkIndex:
+    """Split a stream into chunks and upload those the chunk store does not hold yet.
+
+    Args:
+        storage_adapter: Storage adapter holding the chunks
+        stream: Uncompressed backup data
+        compression: Compression to store new chunks with
+        average_size: Average chunk size in bytes
+        temp_path: Directory to compress chunks in
+
+    Returns:
+        Index of the chunks, in order
+
+    Raises:
+        StorageError: If listing or uploading chunks fails
+    """
+    stored = {obj.key for obj in storage_adapter.list(prefix=CHUNK_PREFIX)}
+    index = ChunkIndex(size=0, sha256="", compression=compression.algorithm)
+    digest = hashlib.sha256()
+
+    for data in split_chunks(stream, average_size):
+        sha256 = hashlib.sha256(data).hexdigest()
+        digest.update(data)
+        index.size += len(data)
+        index.chunks.append((sha256, len(data)))
+
+        key = chunk_key(sha256, compression.algorithm)
+        if key in stored:
+            continue
+
+        local_file = temp_path / Path(key).name
+        try:
+            with open_writer(local_file, compression) as destination:
+                destination.write(data)
+            metadata = {"chunk": sha256, "compression": compression.algorithm, **checksum_metadata(local_file)}
+            storage_adapter.upload(local_file, key, metadata=metadata)
+        finally:
+            local_file.unlink(missing_ok=True)
+        stored.add(key)
+        index.new_chunks += 1
+
+    index.sha256 = digest.hexdigest()
+    return index
+
+
+def reassemble(storage_adapter: StorageAdapter, index: ChunkIndex, destination: Path) -> None:
+    """Download a backup's chunks and write their uncompressed data to a file, in order.
+
+    Raises:
+        StorageError: If a chunk cannot be downloaded
+        BackupError: If a chunk or the reassembled data does not match its checksum
+    """
+    digest = hashlib.sha256()
+    local_file = destination.with_name(f".{destination.name}.chunk")
+
+    try:
+        with open(destination, "wb") as output:
+            for sha256, _ in index.chunks:
+                key = chunk_key(sha256, index.compression)
+                storage_adapter.download(key, local_file)
+                with open_reader(local_file, index.compression) as source:
+                    data = source.read()
+                if hashlib.sha256(data).hexdigest() != sha256:
+                    raise BackupError(f"Chunk {key} does not match its checksum")
+                digest.update(data)
+                output.write(data)
+    except OSError as e:
+        raise BackupError(f"Failed to reassemble {destination.name}: {e}")
+    finally:
+        local_file.unlink(missing_ok=True)
+
+    if digest.hexdigest() != index.sha256:
+        raise BackupError(f"Reassembled {destination.name} does not match its recorded checksum")
+
+
+def collect_chunks(storage_adapter: StorageAdapter) -> int:
+    """Delete chunks no retained backup's index refers to anymore.
+
+    Chunks are shared by every deduplicated backup in the storage, so every
+    index in it counts. A backup that is running has uploaded chunks its
+    index does not list yet, or counts on chunks an earlier backup stored;
+    while one is, nothing is deleted. Backups and cleanups each write a
+    lock before looking for the other's, so at least one of them sees the
+    other: the cleanup skips, or the backup waits for it to finish. Run
+    this after retention has deleted expired backups.
+
+    Args:
+        storage_adapter: Storage adapter holding the backups and chunks
+
+    Returns:
+        Number of chunks deleted
+
+    Raises:
+        StorageError: If listing, reading an index or deleting fails
+    """
+    _write_lock(storage_adapter, GC_LOCK, f"gc-{uuid.uuid4()}")
+
+    try:
+        now = datetime.now(timezone.utc)
+        objects = storage_adapter.list()
+        indexes = [
+            obj.key for obj in objects if obj.key.endswith(INDEX_SUFFIX) and not obj.key.startswith(CHUNK_PREFIX)
+        ]
+        index_names = {Path(key).name for key in indexes}
+
+        running, released = [], []
+        for obj in objects:
+            if not obj.key.startswith(LOCK_PREFIX) or obj.key == GC_LOCK:
+                continue
+            name = obj.key.removeprefix(LOCK_PREFIX)
+            if name in index_names or not _is_fresh(obj, now):
+                released.append(obj.key)
+            else:
+                running.append(name)
+
+        if running:
+            logger.warning(f"Not cleaning up chunks while backups are running: {', '.join(sorted(running))}")
+            return 0
+
+        referenced: set[str] = set()
+        for key in indexes:
+            referenced |= read_index(storage_adapter, key).keys
+
+        unreferenced = [
+            obj.key
+            for obj in objects
+            if obj.key.startswith(CHUNK_PREFIX) and not obj.key.startswith(LOCK_PREFIX) and obj.key not in referenced
+        ]
+        if unreferenced or released:
+            storage_adapter.delete_many(unreferenced + released)
+        if unreferenced:
+            logger.info(f"Deleted {len(unreferenced)} chunks no retained backup refers to")
+        return len(unreferenced)
+    finally:
+        storage_adapter.delete(GC_LOCK)
@@ -0,0 +1,172 @@
+"""Downloads of backups that retry from where they stopped, and resume what a failed run left behind."""
+
+from __future__ import annotations
+
+import hashlib
+import os
+import random
+import shutil
+import tempfile
+import time
+from dataclasses import dataclass
+from pathlib import Path
+
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.metrics import DOWNLOADED_BYTES
+from nestvault.progress import Progress, download_progress, reporting, watching
+from nestvault.storage.base import StorageAdapter
+from nestvault.tempdir import PARTIAL_SUFFIX, TEMP_PREFIX
+
+logger = get_logger("download")
+
+# Bytes fetched per ranged read; a failed read is retried from its first byte
+RANGE_SIZE = 8 * 1024 * 1024
+
+
+@dataclass
+class RetryPolicy:
+    """How often a failed download is retried, and how long to back off in between."""
+
+    retries: int = 0
+    # Longest wait between two attempts, in seconds
+    max_delay: float = 60.0
+
+    def delay(self, failure: int) -> float:
+        """Return the seconds to wait after the given consecutive failure: doubling, capped, with jitter."""
+        ceiling = min(float(2 ** (failure - 1)), self.max_delay)
+        return random.uniform(ceiling / 2, ceiling)
+
+
+def kept_download_path(remote_key: str, metadata: dict[str, str]) -> Path:
+    """Return where an unfinished download of a backup is kept in the temp directory, for a later resume.
+
+    The name is derived from the key and the recorded checksum, so a
+    different object uploaded under the same key is never resumed into.
+    """
+    digest = hashlib.sha256(f"{remote_key}\0{metadata.get('sha256', '')}".encode()).hexdigest()[:16]
+    return Path(tempfile.gettempdir()) / f"{TEMP_PREFIX}download-{digest}{PARTIAL_SUFFIX}"
+
+
+def _download_ranges(
+    storage_adapter: StorageAdapter, remote_key: str, partial: Path, size: int, progress: Progress, policy: RetryPolicy
+) -> None:
+    """Append the rest of an object to a partial file with ranged reads, retrying a failed read where it stopped.
+
+    Retries count consecutive failures, so a download that keeps making
+    progress over a flaky link carries on.
+
+    Raises:
+        StorageError: If a read failed more often in a row than the policy retries
+    """
+    fd = os.open(partial, os.O_WRONLY | os.O_CREAT | os.O_APPEND, 0o600)
+    with os.fdopen(fd, "ab") as f:
+        offset = partial.stat().st_size
+        progress.update(offset)
+        failures = 0
+
+        while offset < size:
+            try:
+                data = storage_adapter.read_range(remote_key, offset, min(RANGE_SIZE, size - offset))
+            except StorageError as e:
+                failures += 1
+                if failures > policy.retries:
+                    raise
+                delay = policy.delay(failures)
+                logger.warning(
+                    f"Download failed at byte {offset} of {size} (retry {failures}/{policy.retries}), "
+                    f"resuming in {delay:.1f}s: {e}"
+                )
+                time.sleep(delay)
+                continue
+
+            # An object shorter than recorded fails the checksum comparison afterwards
+            if not data:
+                return
+            f.write(data)
+            f.flush()
+            offset += len(data)
+            progress.update(offset)
+            failures = 0
+
+
+def _download_whole(
+    storage_adapter: StorageAdapter, remote_key: str, local_path: Path, metadata: dict[str, str], policy: RetryPolicy
+) -> None:
+    """Download an object in one go, starting over on every retry.
+
+    Raises:
+        StorageError: If the download failed on every attempt
+    """
+    attempts = policy.retries + 1
+    for attempt in range(1, attempts + 1):
+        try:
+            with reporting(download_progress(metadata)) as progress, watching(local_path.parent, progress):
+                storage_adapter.download(remote_key, local_path)
+            DOWNLOADED_BYTES.inc(local_path.stat().st_size)
+            return
+        except StorageError as e:
+            if attempt == attempts:
+                raise
+            delay = policy.delay(attempt)
+            logger.warning(f"Download failed (attempt {attempt}/{attempts}), retrying in {delay:.1f}s: {e}")
+            time.sleep(delay)
+
+
+def download_backup(
+    storage_adapter: StorageAdapter,
+    remote_key: str,
+    local_path: Path,
+    metadata: dict[str, str],
+    policy: RetryPolicy | None = None,
+    resume: bool = False,
+) -> None:
+    """Download a backup to a file, retrying failed downloads and reporting their progress.
+
+    On backends with ranged reads, and for backups of recorded size, the
+    object is fetched piece by piece into a partial file in the temp
+    directory, and a failed read is retried from the last byte written.
+    When the retries run out, the partial file stays there, and a later
+    download with resume continues it instead of starting over. Other
+    backends download the whole object again on every attempt.
+
+    The download is not checked here; compare it with its checksum afterwards.
+
+    Args:
+        storage_adapter: Storage adapter to download from
+        remote_key: Key of the backup
+        local_path: Path to write the backup to
+        metadata: Metadata stored with the backup, giving its size
+        policy: How failed downloads are retried; by default they are not
+        resume: Continue a partial download a previous run left behind
+
+    Raises:
+        StorageError: If the download failed on every attempt
+    """
+    policy = policy or RetryPolicy()
+    if not storage_adapter.supports_range_reads or "size" not in metadata:
+        _download_whole(storage_adapter, remote_key, local_path, metadata, policy)
+        return
+
+    size = int(metadata["size"])
+    partial = kept_download_path(remote_key, metadata)
+    if partial.exists():
+        kept = partial.stat().st_size
+        if not resume or kept > size:
+            logger.info(f"Discarding {kept} bytes of {remote_key} an earlier download left in {partial}")
+            partial.unlink()
+        else:
+            logger.info(f"Resuming the download of {remote_key} at byte {kept} of {size}")
+
+    with reporting(download_progress(metadata)) as progress:
+        try:
+            _download_ranges(storage_adapter, remote_key, partial, size, progress, policy)
+        except StorageError:
+            if partial.exists():
+                logger.error(
+                    f"Kept the {partial.stat().st_size} bytes of {remote_key} downloaded so far in {partial}, "
+                    f"pass --resume to continue from there"
+                )
+            raise
+    DOWNLOADED_BYTES.inc(size)
+    shutil.move(partial, local_path)
@@ -0,0 +1,638 @@
+"""Client-side encryption of backup files."""
+
+from __future__ import annotations
+
+import base64
+import hashlib
+import hmac
+import json
+import os
+import struct
+from abc import ABC, abstractmethod
+from collections.abc import Iterator
+from pathlib import Path
+from typing import BinaryIO
+
+import pgpy
+import pyrage
+from cryptography.exceptions import InvalidTag
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+from pgpy.constants import SymmetricKeyAlgorithm
+
+from nestvault.config import EncryptionConfig
+from nestvault.exceptions import BackupError, IntegrityError
+from nestvault.kms import KeyProvider, create_key_provider
+
+# File name suffix of each encryption mode, appended after the compression suffix
+SUFFIXES = {"age": "age", "gpg": "gpg", "aes-gcm": "enc", "kms": "enc"}
+
+# Leading bytes of aes-gcm and kms files, followed by the length of their JSON header
+AES_GCM_MAGIC = b"NVAESGCM"
+
+# scrypt cost of new backups (128 MiB of memory), and the most a header may ask for on restore
+SCRYPT_PARAMS = {"n": 2**17, "r": 8, "p": 1}
+SCRYPT_MAX_N = 2**20
+
+# Plaintext bytes per authenticated chunk, and the GCM tag each chunk carries
+AES_GCM_CHUNK_SIZE = 1024 * 1024
+AES_GCM_TAG_SIZE = 16
+
+
+def encrypted_name(name: str, mode: str) -> str:
+    """Append the mode's suffix to a file name, e.g. 'db.sql.gz' -> 'db.sql.gz.age'."""
+    return f"{name}.{SUFFIXES[mode]}"
+
+
+def decrypted_name(name: str) -> str:
+    """Strip the encryption suffix from a file name, e.g. 'db.sql.gz.age' -> 'db.sql.gz'."""
+    for suffix in SUFFIXES.values():
+        if name.endswith(f".{suffix}"):
+            return name.removesuffix(f".{suffix}")
+    return name
+
+
+class Cipher(ABC):
+    """Encrypts backup files before upload and decrypts them on restore."""
+
+    @property
+    @abstractmethod
+    def mode(self) -> str:
+        """Return the encryption mode recorded with each backup (e.g., 'age')."""
+        pass
+
+    @abstractmethod
+    def encrypt(self, source: Path, destination: Path) -> dict[str, str]:
+        """Encrypt a file.
+
+        Args:
+            source: Plaintext file
+            destination: File to write the ciphertext to
+
+        Returns:
+            Metadata needed to decrypt the file, recorded with the backup
+
+        Raises:
+            BackupError: If the cipher is not set up to encrypt or encryption fails; a backup is never
+                uploaded in plaintext when encryption was asked for
+        """
+        pass
+
+    @abstractmethod
+    def decrypt(self, source: Path, destination: Path, metadata: dict[str, str]) -> None:
+        """Decrypt a file.
+
+        Args:
+            source: Encrypted file
+            destination: File to write the plaintext to
+            metadata: Metadata recorded with the backup
+
+        Raises:
+            BackupError: If the cipher is not set up to decrypt or decryption fails
+        """
+        pass
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether encrypt_stream() and decrypt_stream() can work on a backup while it is transferred."""
+        return False
+
+    def encrypt_stream(self, source: BinaryIO) -> tuple[Iterator[bytes], dict[str, str]]:
+        """Encrypt a stream as it is read, without a plaintext file.
+
+        Args:
+            source: Plaintext stream
+
+        Returns:
+            The ciphertext in chunks, and the metadata needed to decrypt it
+
+        Raises:
+            BackupError: If the cipher cannot encrypt streams or is not set up to encrypt
+        """
+        raise BackupError(f"{self.mode} encryption does not support streaming")
+
+    def decrypt_stream(self, source: BinaryIO, name: str, metadata: dict[str, str]) -> Iterator[bytes]:
+        """Decrypt a stream as it is read, without an encrypted file.
+
+        The key is unlocked before this returns, so a wrong key fails before
+        anything is read past the header.
+
+        Args:
+            source: Encrypted stream
+            name: Name of the backup, used in errors
+            metadata: Metadata recorded with the backup
+
+        Returns:
+            The plaintext in chunks, each authenticated before it is yielded
+
+        Raises:
+            BackupError: If the cipher cannot decrypt streams or is not set up to decrypt
+            IntegrityError: If the header is malformed; chunks failing authentication raise it as they are read
+        """
+        raise BackupError(f"{self.mode} encryption does not support streaming")
+
+
+class AgeCipher(Cipher):
+    """Encryption to age X25519 and ssh-ed25519 recipients.
+
+    Recipients are only needed to back up and the identity only to
+    restore, so a backup host never has to hold the private key.
+    """
+
+    def __init__(self, config: EncryptionConfig):
+        """Initialize the age cipher.
+
+        Args:
+            config: Encryption configuration
+
+        Raises:
+            BackupError: If a recipient is not a valid public key
+        """
+        self.config = config
+
+        try:
+            self.recipients = [
+                pyrage.ssh.Recipient.from_str(recipient)
+                if recipient.startswith("ssh-")
+                else pyrage.x25519.Recipient.from_str(recipient)
+                for recipient in config.age_recipients
+            ]
+        except pyrage.RecipientError as e:
+            raise BackupError(f"Invalid age recipient: {e}")
+
+    @property
+    def mode(self) -> str:
+        return "age"
+
+    def _identities(self) -> list:
+        """Load the identities from AGE_IDENTITY or AGE_IDENTITY_FILE.
+
+        Raises:
+            BackupError: If no identity is configured or it cannot be parsed
+        """
+        if self.config.age_identity_file:
+            try:
+                text = Path(self.config.age_identity_file).read_text()
+            except OSError as e:
+                raise BackupError(f"Failed to read AGE_IDENTITY_FILE {self.config.age_identity_file}: {e}")
+        elif self.config.age_identity:
+            text = self.config.age_identity
+        else:
+            raise BackupError("AGE_IDENTITY or AGE_IDENTITY_FILE is required to restore age-encrypted backups")
+
+        try:
+            if "PRIVATE KEY-----" in text:
+                return [pyrage.ssh.Identity.from_buffer(text.encode())]
+
+            # age identity files hold one key per line, with comments
+            return [
+                pyrage.x25519.Identity.from_str(line.strip())
+                for line in text.splitlines()
+                if line.strip() and not line.startswith("#")
+            ]
+        except pyrage.IdentityError as e:
+            raise BackupError(f"Invalid age identity: {e}")
+
+    def encrypt(self, source: Path, destination: Path) -> dict[str, str]:
+        if not self.recipients:
+            raise BackupError(
+                "ENCRYPTION=age is set but no recipients are configured, set AGE_RECIPIENTS or AGE_RECIPIENTS_FILE"
+            )
+
+        try:
+            pyrage.encrypt_file(str(source), str(destination), self.recipients)
+        except (pyrage.EncryptError, OSError) as e:
+            raise BackupError(f"Failed to encrypt {source.name} with age: {e}")
+
+        return {}
+
+    def decrypt(self, source: Path, destination: Path, metadata: dict[str, str]) -> None:
+        identities = self._identities()
+
+        try:
+            pyrage.decrypt_file(str(source), str(destination), identities)
+        except (pyrage.DecryptError, OSError) as e:
+            raise BackupError(f"Failed to decrypt {source.name} with age: {e}")
+
+
+def fingerprint(key: pgpy.PGPKey) -> str:
+    """Return an OpenPGP key's fingerprint as 40 hex digits without spaces."""
+    return str(key.fingerprint).replace(" ", "")
+
+
+class GPGCipher(Cipher):
+    """OpenPGP encryption to one or more public keys, without a gpg binary.
+
+    The fingerprints of the keys are recorded with each backup, showing
+    which backups become unreadable when a key is retired. PGPy builds
+    messages in memory, so a backup is held in memory while it is
+    encrypted or decrypted.
+    """
+
+    def __init__(self, config: EncryptionConfig):
+        """Initialize the OpenPGP cipher.
+
+        Args:
+            config: Encryption configuration
+
+        Raises:
+            BackupError: If a public key cannot be parsed
+        """
+        self.config = config
+
+        try:
+            self.keys = [pgpy.PGPKey.from_blob(armored)[0] for armored in config.gpg_public_keys]
+        except (ValueError, pgpy.errors.PGPError) as e:
+            raise BackupError(f"Invalid GPG public key: {e}")
+
+        for key in self.keys:
+            if not key.is_public:
+                raise BackupError(f"GPG public keys include the private key {fingerprint(key)}, configure its public key")
+
+    @property
+    def mode(self) -> str:
+        return "gpg"
+
+    def _private_key(self) -> pgpy.PGPKey:
+        """Load the private key from GPG_PRIVATE_KEY_FILE.
+
+        Raises:
+            BackupError: If no private key is configured or it cannot be parsed
+        """
+        if not self.config.gpg_private_key_file:
+            raise BackupError("GPG_PRIVATE_KEY_FILE is required to restore gpg-encrypted backups")
+
+        try:
+            key, _ = pgpy.PGPKey.from_file(self.config.gpg_private_key_file)
+        except (ValueError, pgpy.errors.PGPError, OSError) as e:
+            raise BackupError(f"Failed to load GPG_PRIVATE_KEY_FILE {self.config.gpg_private_key_file}: {e}")
+
+        if key.is_protected and self.config.gpg_passphrase is None:
+            raise BackupError("The GPG private key is passphrase-protected, set GPG_PASSPHRASE or GPG_PASSPHRASE_FILE")
+
+        return key
+
+    def encrypt(self, source: Path, destination: Path) -> dict[str, str]:
+        if not self.keys:
+            raise BackupError(
+                "ENCRYPTION=gpg is set but no public keys are configured, set GPG_PUBLIC_KEYS or GPG_PUBLIC_KEY_FILES"
+            )
+
+        try:
+            message = pgpy.PGPMessage.new(str(source), file=True)
+
+            # One session key encrypted to every public key, so any of them can decrypt
+            cipher = SymmetricKeyAlgorithm.AES256
+            session_key = cipher.gen_key()
+            for key in self.keys:
+                message = key.encrypt(message, cipher=cipher, sessionkey=session_key)
+
+            destination.write_bytes(bytes(message))
+        except (ValueError, pgpy.errors.PGPError, OSError) as e:
+            raise BackupError(f"Failed to encrypt {source.name} with OpenPGP: {e}")
+
+        return {"gpg_fingerprints": ",".join(fingerprint(key) for key in self.keys)}
+
+    def decrypt(self, source: Path, destination: Path, metadata: dict[str, str]) -> None:
+        key = self._private_key()
+
+        recipients = [fp for fp in metadata.get("gpg_fingerprints", "").split(",") if fp]
+        if recipients and fingerprint(key) not in recipients:
+            raise BackupError(
+                f"Backup was encrypted to {', '.join(recipients)}, but the GPG private key is {fingerprint(key)}"
+            )
+
+        try:
+            message = pgpy.PGPMessage.from_file(str(source))
+            if key.is_protected:
+                with key.unlock(self.config.gpg_passphrase):
+                    plaintext = key.decrypt(message).message
+            else:
+                plaintext = key.decrypt(message).message
+
+            destination.write_bytes(plaintext.encode() if isinstance(plaintext, str) else bytes(plaintext))
+        except (ValueError, pgpy.errors.PGPError, OSError) as e:
+            raise BackupError(f"Failed to decrypt {source.name} with OpenPGP: {e}")
+
+
+def _encrypt_chunks(src: BinaryIO, key: bytes, params: dict) -> Iterator[bytes]:
+    """Yield a header and the AES-256-GCM encrypted chunks of a stream.
+
+    Each chunk's nonce carries its index and its associated data the
+    header and whether it is the last chunk, so reordered, dropped or
+    truncated chunks fail authentication just like modified bytes.
+
+    Args:
+        src: Plaintext stream; reads must only return short at its end
+        key: 256-bit key
+        params: Header parameters, with the nonce prefix and chunk size
+    """
+    body = json.dumps(params).encode()
+    header = AES_GCM_MAGIC + struct.pack(">H", len(body)) + body
+    aead = AESGCM(key)
+    prefix = bytes.fromhex(params["nonce"])
+
+    yield header
+
+    # Read one chunk ahead to know which chunk is the last
+    index, chunk = 0, src.read(params["chunk_size"])
+    while True:
+        following = src.read(params["chunk_size"])
+        final = not following
+        yield aead.encrypt(prefix + struct.pack(">I", index), chunk, header + bytes([final]))
+        if final:
+            break
+        index, chunk = index + 1, following
+
+
+def _write_chunks(source: Path, destination: Path, key: bytes, params: dict) -> None:
+    """Write a header and the AES-256-GCM encrypted chunks of a file."""
+    with open(source, "rb") as src, open(destination, "wb") as dst:
+        for data in _encrypt_chunks(src, key, params):
+            dst.write(data)
+
+
+def _read_header(f: BinaryIO, name: str) -> tuple[bytes, dict]:
+    """Read the header of an AES-256-GCM encrypted file.
+
+    Returns:
+        The raw header, authenticated with every chunk, and its parameters
+
+    Raises:
+        IntegrityError: If the header is missing or malformed
+    """
+    magic = f.read(len(AES_GCM_MAGIC) + 2)
+    if len(magic) < len(AES_GCM_MAGIC) + 2 or not magic.startswith(AES_GCM_MAGIC):
+        raise IntegrityError(f"Integrity check failed for {name}: it has no aes-gcm header")
+
+    (length,) = struct.unpack(">H", magic[len(AES_GCM_MAGIC):])
+    body = f.read(length)
+
+    try:
+        params = json.loads(body)
+        valid = 0 < params["chunk_size"] <= 64 * AES_GCM_CHUNK_SIZE and len(bytes.fromhex(params["nonce"])) == 8
+    except (ValueError, KeyError, TypeError):
+        valid = False
+
+    if not valid:
+        raise IntegrityError(f"Integrity check failed for {name}: its aes-gcm header is malformed")
+
+    return magic + body, params
+
+
+def _decrypt_chunks(src: BinaryIO, name: str, key: bytes, header: bytes, params: dict) -> Iterator[bytes]:
+    """Decrypt the chunks following a header, authenticating each before it is yielded.
+
+    Raises:
+        IntegrityError: If a chunk fails authentication
+    """
+    aead = AESGCM(key)
+    prefix = bytes.fromhex(params["nonce"])
+    size = params["chunk_size"] + AES_GCM_TAG_SIZE
+
+    index, chunk = 0, src.read(size)
+    while True:
+        following = src.read(size)
+        final = not following
+        try:
+            yield aead.decrypt(prefix + struct.pack(">I", index), chunk, header + bytes([final]))
+        except InvalidTag:
+            raise IntegrityError(
+                f"Integrity check failed for {name} at chunk {index}: "
+                f"the backup is corrupted, truncated or was tampered with"
+            )
+        if final:
+            break
+        index, chunk = index + 1, following
+
+
+def _read_chunks(src: BinaryIO, destination: Path, key: bytes, header: bytes, params: dict) -> None:
+    """Decrypt the chunks following a header into a file, authenticating each before it is written.
+
+    Raises:
+        IntegrityError: If a chunk fails authentication
+    """
+    with open(destination, "wb") as dst:
+        for data in _decrypt_chunks(src, destination.name, key, header, params):
+            dst.write(data)
+
+
+class AESGCMCipher(Cipher):
+    """AES-256-GCM encryption with a key derived from a passphrase.
+
+    Files start with a small header holding the scrypt parameters, salt
+    and nonce prefix, followed by the data in authenticated chunks, so
+    neither side holds more than one chunk in memory.
+    """
+
+    def __init__(self, config: EncryptionConfig):
+        """Initialize the AES-256-GCM cipher.
+
+        Args:
+            config: Encryption configuration
+        """
+        self.config = config
+
+    @property
+    def mode(self) -> str:
+        return "aes-gcm"
+
+    def _derive_key(self, params: dict) -> bytes:
+        """Derive the 256-bit key from the passphrase with a header's scrypt parameters."""
+        if not self.config.passphrase:
+            raise BackupError("NESTVAULT_ENCRYPTION_PASSPHRASE is required for ENCRYPTION=aes-gcm")
+
+        return hashlib.scrypt(
+            self.config.passphrase.encode(),
+            salt=bytes.fromhex(params["salt"]),
+            n=params["n"],
+            r=params["r"],
+            p=params["p"],
+            maxmem=256 * params["n"] * params["r"],
+            dklen=32,
+        )
+
+    @staticmethod
+    def _key_check(key: bytes) -> str:
+        """Return a value derived from the key that tells a wrong passphrase from tampering."""
+        return hmac.new(key, b"nestvault key check", hashlib.sha256).hexdigest()[:32]
+
+    def _new_key(self) -> tuple[bytes, dict]:
+        """Derive the key of a new backup with a fresh salt, returning it and the header parameters."""
+        params = {
+            "version": 1,
+            "kdf": "scrypt",
+            **SCRYPT_PARAMS,
+            "salt": os.urandom(16).hex(),
+            "nonce": os.urandom(8).hex(),
+            "chunk_size": AES_GCM_CHUNK_SIZE,
+        }
+        key = self._derive_key(params)
+        params["check"] = self._key_check(key)
+        return key, params
+
+    @property
+    def supports_streaming(self) -> bool:
+        return True
+
+    def encrypt_stream(self, source: BinaryIO) -> tuple[Iterator[bytes], dict[str, str]]:
+        key, params = self._new_key()
+        return _encrypt_chunks(source, key, params), {}
+
+    def encrypt(self, source: Path, destination: Path) -> dict[str, str]:
+        key, params = self._new_key()
+
+        try:
+            _write_chunks(source, destination, key, params)
+        except OSError as e:
+            raise BackupError(f"Failed to encrypt {source.name} with AES-256-GCM: {e}")
+
+        return {}
+
+    def decrypt(self, source: Path, destination: Path, metadata: dict[str, str]) -> None:
+        """Decrypt a file, authenticating every chunk before it is written.
+
+        Raises:
+            IntegrityError: If any part of the file fails authentication
+            BackupError: If the passphrase is wrong or reading fails
+        """
+        try:
+            with open(source, "rb") as src:
+                key, header, params = self._unlock(src, source.name)
+                _read_chunks(src, destination, key, header, params)
+        except OSError as e:
+            raise BackupError(f"Failed to decrypt {source.name} with AES-256-GCM: {e}")
+
+    def decrypt_stream(self, source: BinaryIO, name: str, metadata: dict[str, str]) -> Iterator[bytes]:
+        try:
+            key, header, params = self._unlock(source, name)
+        except OSError as e:
+            raise BackupError(f"Failed to decrypt {name} with AES-256-GCM: {e}")
+        return _decrypt_chunks(source, name, key, header, params)
+
+    def _unlock(self, src: BinaryIO, name: str) -> tuple[bytes, bytes, dict]:
+        """Read the header of an encrypted file and derive its key, returning the key, header and parameters."""
+        header, params = _read_header(src, name)
+
+        try:
+            valid = (
+                params["kdf"] == "scrypt"
+                and 2 <= params["n"] <= SCRYPT_MAX_N
+                and params["n"] & (params["n"] - 1) == 0
+                and 1 <= params["r"] <= 32
+                and 1 <= params["p"] <= 16
+            )
+        except (KeyError, TypeError):
+            valid = False
+        if not valid:
+            raise IntegrityError(f"Integrity check failed for {name}: invalid scrypt parameters")
+
+        key = self._derive_key(params)
+        if not hmac.compare_digest(params.get("check", ""), self._key_check(key)):
+            raise BackupError(f"Wrong NESTVAULT_ENCRYPTION_PASSPHRASE for {name}")
+        return key, header, params
+
+
+class KMSCipher(Cipher):
+    """Envelope encryption with a data key per backup, wrapped by a KMS key.
+
+    The data encryption is the chunked AES-256-GCM of AESGCMCipher. The
+    wrapped data key is kept in the object's header and metadata, so
+    revoking access to the KMS key makes every backup unreadable without
+    re-encrypting anything.
+    """
+
+    def __init__(self, provider: KeyProvider):
+        """Initialize the KMS cipher.
+
+        Args:
+            provider: KMS that generates and unwraps data keys
+        """
+        self.provider = provider
+
+    @property
+    def mode(self) -> str:
+        return "kms"
+
+    def _new_data_key(self) -> tuple[bytes, dict, dict[str, str]]:
+        """Generate the data key of a new backup, returning it, the header parameters and the metadata."""
+        key, wrapped_key = self.provider.generate_data_key()
+        wrapped = base64.b64encode(wrapped_key).decode()
+        params = {
+            "version": 1,
+            "kdf": "kms",
+            "provider": self.provider.name,
+            "wrapped_key": wrapped,
+            "nonce": os.urandom(8).hex(),
+            "chunk_size": AES_GCM_CHUNK_SIZE,
+        }
+        metadata = {"kms_provider": self.provider.name, "kms_key_id": self.provider.key_id, "kms_wrapped_key": wrapped}
+        return key, params, metadata
+
+    @property
+    def supports_streaming(self) -> bool:
+        return True
+
+    def encrypt_stream(self, source: BinaryIO) -> tuple[Iterator[bytes], dict[str, str]]:
+        key, params, metadata = self._new_data_key()
+        return _encrypt_chunks(source, key, params), metadata
+
+    def encrypt(self, source: Path, destination: Path) -> dict[str, str]:
+        key, params, metadata = self._new_data_key()
+
+        try:
+            _write_chunks(source, destination, key, params)
+        except OSError as e:
+            raise BackupError(f"Failed to encrypt {source.name} with a KMS data key: {e}")
+
+        return metadata
+
+    def decrypt(self, source: Path, destination: Path, metadata: dict[str, str]) -> None:
+        """Unwrap the backup's data key with the KMS and decrypt the file.
+
+        Raises:
+            IntegrityError: If any part of the file fails authentication
+            BackupError: If the KMS refuses to unwrap the key or reading fails
+        """
+        try:
+            with open(source, "rb") as src:
+                key, header, params = self._unlock(src, source.name)
+                _read_chunks(src, destination, key, header, params)
+        except OSError as e:
+            raise BackupError(f"Failed to decrypt {source.name} with a KMS data key: {e}")
+
+    def decrypt_stream(self, source: BinaryIO, name: str, metadata: dict[str, str]) -> Iterator[bytes]:
+        try:
+            key, header, params = self._unlock(source, name)
+        except OSError as e:
+            raise BackupError(f"Failed to decrypt {name} with a KMS data key: {e}")
+        return _decrypt_chunks(source, name, key, header, params)
+
+    def _unlock(self, src: BinaryIO, name: str) -> tuple[bytes, bytes, dict]:
+        """Read the header of an encrypted file and unwrap its data key, returning the key, header and parameters."""
+        header, params = _read_header(src, name)
+
+        if params.get("kdf") != "kms" or not isinstance(params.get("wrapped_key"), str):
+            raise IntegrityError(f"Integrity check failed for {name}: it has no wrapped data key")
+        if params.get("provider") != self.provider.name:
+            raise BackupError(
+                f"{name} was encrypted with {params.get('provider')} KMS, "
+                f"but KMS_PROVIDER={self.provider.name} is configured"
+            )
+
+        key = self.provider.decrypt_data_key(base64.b64decode(params["wrapped_key"]))
+        return key, header, params
+
+
+def create_cipher(config: EncryptionConfig) -> Cipher:
+    """Create the cipher for the configured encryption mode.
+
+    Raises:
+        BackupError: If the cipher's keys are invalid
+    """
+    if config.mode == "gpg":
+        return GPGCipher(config)
+    if config.mode == "aes-gcm":
+        return AESGCMCipher(config)
+    if config.mode == "kms":
+        return KMSCipher(create_key_provider(config))
+    return AgeCipher(config)
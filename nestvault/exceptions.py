@@ -19,6 +19,18 @@ class BackupError(NestVaultError):
     pass
 
 
+class IntegrityError(BackupError):
+    """Raised when an encrypted backup fails authentication, i.e. it was corrupted or tampered with."""
+
+    pass
+
+
+class HookError(NestVaultError):
+    """Raised when a pre-backup hook command fails, aborting the backup."""
+
+    pass
+
+
 class StorageError(NestVaultError):
     """Raised when a storage operation fails."""
 
@@ -29,3 +41,27 @@ class RetentionError(NestVaultError):
     """Raised when retention cleanup fails."""
 
     pass
+
+
+class NotifyError(NestVaultError):
+    """Raised when a notification cannot be delivered."""
+
+    pass
+
+
+class AuditError(NestVaultError):
+    """Raised when an entry of the audit trail cannot be written in strict mode, refusing the operation."""
+
+    pass
+
+
+class CredentialError(NestVaultError):
+    """Raised when database credentials cannot be obtained, renewed or revoked, e.g. because Vault is unreachable."""
+
+    pass
+
+
+class TunnelError(NestVaultError):
+    """Raised when the SSH tunnel to a database cannot be opened, e.g. because the jump host is down."""
+
+    pass
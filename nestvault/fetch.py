@@ -0,0 +1,124 @@
+"""Downloading backups to a local file or stdout without restoring them."""
+
+from __future__ import annotations
+
+import os
+import shutil
+import sys
+import tempfile
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.compression import decompressed_name, open_reader
+from nestvault.dedup import ChunkIndex, indexed_name, reassemble
+from nestvault.download import RetryPolicy, download_backup
+from nestvault.encryption import Cipher, decrypted_name
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+from nestvault.tempdir import partial_path
+from nestvault.verify import CHUNK_SIZE, check_download
+
+logger = get_logger("fetch")
+
+
+def _write(source: BinaryIO, output: Path | None) -> None:
+    """Copy a backup to a file only its owner can read, or to stdout when output is None.
+
+    A file is written under its partial name and renamed once complete, so
+    a failed fetch never leaves a truncated backup behind at the output path.
+    """
+    if output is None:
+        shutil.copyfileobj(source, sys.stdout.buffer, CHUNK_SIZE)
+        sys.stdout.buffer.flush()
+        return
+
+    partial = partial_path(output)
+    try:
+        fd = os.open(partial, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+        # A partial file left by an earlier fetch keeps its mode through O_TRUNC
+        os.fchmod(fd, 0o600)
+        with os.fdopen(fd, "wb") as f:
+            shutil.copyfileobj(source, f, CHUNK_SIZE)
+        os.replace(partial, output)
+    except OSError:
+        partial.unlink(missing_ok=True)
+        raise
+
+
+def fetch_backup(
+    storage_adapter: StorageAdapter,
+    backup_key: str,
+    output: str,
+    cipher: Cipher | None = None,
+    decompress: bool = False,
+    force: bool = False,
+    retry: RetryPolicy | None = None,
+    resume: bool = False,
+) -> None:
+    """Download a backup, check it against its checksum, and write it out as a file.
+
+    Deduplicated backups are reassembled from their chunks, as their index
+    alone holds no data. Otherwise the backup is written as stored, unless
+    a cipher is given to decrypt it or decompress is set.
+
+    Args:
+        storage_adapter: Storage adapter to download from
+        backup_key: Key of the backup
+        output: Path to write the backup to, '-' for stdout
+        cipher: Cipher to decrypt an encrypted backup with; None to keep it encrypted
+        decompress: Decompress the backup after decrypting it
+        force: Overwrite an existing file at the output path
+        retry: How a failed download is retried
+        resume: Continue a download an earlier fetch or restore left unfinished
+
+    Raises:
+        BackupError: If the output exists without force, or the backup cannot be reassembled,
+            decrypted, decompressed or written
+        StorageError: If the download fails
+        IntegrityError: If the backup does not match its recorded checksum
+    """
+    path = None if output == "-" else Path(output)
+    if path is not None and path.exists() and not force:
+        raise BackupError(f"{path} already exists, pass --force to overwrite it")
+
+    metadata = storage_adapter.get_metadata(backup_key)
+    encryption = metadata.get("encryption")
+    if encryption is not None and cipher is not None and encryption != cipher.mode:
+        raise BackupError(f"Backup is encrypted with {encryption}, but ENCRYPTION={cipher.mode} is configured")
+    if encryption is not None and cipher is None and decompress:
+        raise BackupError(f"{backup_key} is encrypted with {encryption}, pass --decrypt to decompress it")
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        temp_path = Path(temp_dir)
+        local_file = temp_path / Path(backup_key).name
+        compression = metadata.get("compression")
+
+        logger.info(f"Downloading {backup_key}...")
+        download_backup(storage_adapter, backup_key, local_file, metadata, retry, resume)
+        check_download(local_file, metadata, backup_key)
+
+        if metadata.get("dedup") == "chunks":
+            try:
+                index = ChunkIndex.from_json(local_file.read_text())
+            except (OSError, UnicodeDecodeError, ValueError) as e:
+                raise BackupError(f"Index {local_file.name} is unreadable: {e}")
+            # Chunks hold uncompressed data, so the reassembled backup is uncompressed
+            plain = local_file.with_name(decompressed_name(indexed_name(local_file.name)))
+            reassemble(storage_adapter, index, plain)
+            logger.info(f"Reassembled {plain.name} from {len(index.chunks)} chunks")
+            local_file, compression = plain, "none"
+
+        if encryption is not None and cipher is not None:
+            plaintext = local_file.with_name(decrypted_name(local_file.name))
+            cipher.decrypt(local_file, plaintext, metadata)
+            logger.info(f"Decrypted {local_file.name}")
+            local_file = plaintext
+
+        try:
+            with open_reader(local_file, compression) if decompress else open(local_file, "rb") as source:
+                _write(source, path)
+        except (OSError, EOFError) as e:
+            raise BackupError(f"Failed to write {backup_key} to {output}: {e}")
+
+    logger.info(f"Wrote {backup_key} to {'stdout' if path is None else path}")
@@ -0,0 +1,181 @@
+"""Holds on backups, which retention never deletes until they are released."""
+
+from __future__ import annotations
+
+import json
+import tempfile
+from dataclasses import dataclass
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.audit import operator
+from nestvault.backup.base import COMPANION_EXTENSIONS, is_companion
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.manifest import hold_key, read_manifest
+from nestvault.storage.base import StorageAdapter, StorageObject
+
+logger = get_logger("hold")
+
+HOLD_SUFFIX = f".{COMPANION_EXTENSIONS['hold']}"
+
+
+@dataclass
+class Hold:
+    """A hold on a backup: who placed it, when and why."""
+
+    backup: str
+    held_at: datetime
+    held_by: str
+    reason: str = ""
+    # Whether the backup's objects also carry an Object Lock legal hold
+    legal_hold: bool = False
+
+    def describe(self) -> str:
+        """Return e.g. 'held by root@nestvault since 2024-01-15 12:00:00: pre-migration'."""
+        text = f"held by {self.held_by} since {self.held_at.strftime('%Y-%m-%d %H:%M:%S')}"
+        return f"{text}: {self.reason}" if self.reason else text
+
+    def to_json(self) -> str:
+        return json.dumps(
+            {
+                "backup": self.backup,
+                "held_at": self.held_at.isoformat(),
+                "held_by": self.held_by,
+                "reason": self.reason,
+                "legal_hold": self.legal_hold,
+            },
+            indent=2,
+            sort_keys=True,
+        )
+
+    @classmethod
+    def from_json(cls, text: str) -> Hold:
+        """Parse a hold record.
+
+        Raises:
+            ValueError: If the record is malformed
+        """
+        data = json.loads(text)
+        try:
+            return cls(
+                backup=data["backup"],
+                held_at=datetime.fromisoformat(data["held_at"]),
+                held_by=data.get("held_by", ""),
+                reason=data.get("reason", ""),
+                legal_hold=bool(data.get("legal_hold", False)),
+            )
+        except (KeyError, TypeError, AttributeError) as e:
+            raise ValueError(f"hold record is incomplete: {e}")
+
+
+def _read_hold(storage_adapter: StorageAdapter, backup_key: str) -> Hold:
+    """Download and parse the hold on a backup.
+
+    Raises:
+        StorageError: If the record cannot be downloaded or parsed
+    """
+    key = hold_key(backup_key)
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "hold.json"
+        storage_adapter.download(key, local_file)
+        try:
+            return Hold.from_json(local_file.read_text())
+        except (OSError, UnicodeDecodeError, ValueError) as e:
+            raise StorageError(f"Hold record {key} is unreadable: {e}")
+
+
+def read_holds(storage_adapter: StorageAdapter, objects: list[StorageObject]) -> dict[str, Hold]:
+    """Return the holds on the backups in a listing, by backup key.
+
+    A hold record that cannot be read still holds its backup, so a
+    damaged record never lets retention delete it.
+    """
+    holds = {}
+    for obj in objects:
+        if not obj.key.endswith(HOLD_SUFFIX):
+            continue
+        backup_key = obj.key[: -len(HOLD_SUFFIX)]
+        try:
+            holds[backup_key] = _read_hold(storage_adapter, backup_key)
+        except StorageError as e:
+            logger.warning(f"Keeping {backup_key} held, its hold record is unreadable: {e}")
+            holds[backup_key] = Hold(backup_key, obj.last_modified, "unknown", "unreadable hold record")
+    return holds
+
+
+def _backup_parts(storage_adapter: StorageAdapter, backup_key: str) -> list[str]:
+    """Return the keys of a backup's object and companions.
+
+    Raises:
+        StorageError: If the backup does not exist or cannot be listed
+    """
+    keys = [obj.key for obj in storage_adapter.list(prefix=backup_key)]
+    if backup_key not in keys:
+        raise StorageError(f"Backup not found: {backup_key}")
+
+    parts = [key for key in keys if key == backup_key or (is_companion(key) and key != hold_key(backup_key))]
+    try:
+        manifest = read_manifest(storage_adapter, backup_key)
+        parts.extend(manifest.metadata[kind] for kind in COMPANION_EXTENSIONS if kind in manifest.metadata)
+    except StorageError:
+        pass
+    return list(dict.fromkeys(parts))
+
+
+def place_hold(storage_adapter: StorageAdapter, backup_key: str, reason: str = "", legal_hold: bool = False) -> Hold:
+    """Hold a backup, replacing an earlier hold on it.
+
+    With legal_hold, the backup's objects also get an Object Lock legal
+    hold, so the storage refuses to delete them whoever asks.
+
+    Args:
+        storage_adapter: Storage the backup is on
+        backup_key: Key of the backup
+        reason: Why the backup is held, shown in listings
+        legal_hold: Also place a legal hold on the backup's objects
+
+    Raises:
+        StorageError: If the backup does not exist or the hold cannot be stored
+    """
+    parts = _backup_parts(storage_adapter, backup_key)
+    if legal_hold:
+        for key in parts:
+            storage_adapter.set_legal_hold(key, True)
+
+    hold = Hold(backup_key, datetime.now(timezone.utc), operator(), reason, legal_hold)
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "hold.json"
+        local_file.write_text(hold.to_json())
+        storage_adapter.upload(local_file, hold_key(backup_key), metadata={"companion": "hold"})
+
+    logger.info(f"Held {backup_key}{f' ({reason})' if reason else ''}{' with a legal hold' if legal_hold else ''}")
+    return hold
+
+
+def release_hold(storage_adapter: StorageAdapter, backup_key: str) -> Hold | None:
+    """Release the hold on a backup, and the legal hold placed with it, so retention applies to it again.
+
+    Returns:
+        The released hold, None if the backup was not held
+
+    Raises:
+        StorageError: If the hold cannot be removed
+    """
+    key = hold_key(backup_key)
+    listed = next((obj for obj in storage_adapter.list(prefix=key) if obj.key == key), None)
+    if listed is None:
+        return None
+
+    try:
+        hold = _read_hold(storage_adapter, backup_key)
+    except StorageError as e:
+        logger.warning(f"Releasing {backup_key} despite its unreadable hold record, lift any legal hold by hand: {e}")
+        hold = Hold(backup_key, listed.last_modified, "unknown", "unreadable hold record")
+    if hold.legal_hold:
+        for part in _backup_parts(storage_adapter, backup_key):
+            storage_adapter.set_legal_hold(part, False)
+    storage_adapter.delete(key)
+
+    logger.info(f"Released {backup_key}, {hold.describe()}")
+    return hold
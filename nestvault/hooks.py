@@ -0,0 +1,133 @@
+"""Shell commands run before and after backup jobs and restores."""
+
+from __future__ import annotations
+
+import os
+import signal
+import subprocess
+from dataclasses import dataclass
+from pathlib import Path
+
+from nestvault.exceptions import HookError
+from nestvault.logging import get_logger
+
+logger = get_logger("hooks")
+
+
+@dataclass
+class HookContext:
+    """What a backup job exposes to its hook commands."""
+
+    target: str
+    database: str
+    backup_key: str = ""
+    size: int | None = None
+    # 'running' for pre-backup hooks, then 'success', 'failure' or 'aborted'
+    status: str = "running"
+    # The backup's labels as 'name=value' pairs separated by commas
+    labels: str = ""
+    # What the hooks run around: 'backup', 'restore', or 'restore_verification' for a test restore of a backup
+    event: str = "backup"
+    # Connection string of the database a restore writes into, without its password
+    destination: str = ""
+    # Why the job failed, empty while it has not
+    error: str = ""
+
+    @property
+    def environment(self) -> dict[str, str]:
+        """Return the variables hook commands are run with, on top of NestVault's own environment."""
+        return {
+            "NESTVAULT_TARGET": self.target,
+            "NESTVAULT_DATABASE": self.database,
+            "NESTVAULT_BACKUP_KEY": self.backup_key,
+            "NESTVAULT_BACKUP_SIZE": "" if self.size is None else str(self.size),
+            "NESTVAULT_STATUS": self.status,
+            "NESTVAULT_LABELS": self.labels,
+            "NESTVAULT_EVENT": self.event,
+            "NESTVAULT_DESTINATION": self.destination,
+            "NESTVAULT_ERROR": self.error,
+        }
+
+
+def file_size(path: Path) -> int | None:
+    """Return the size of a backup file for hooks, or None when it cannot be read."""
+    try:
+        return path.stat().st_size
+    except (OSError, TypeError):
+        return None
+
+
+def _run_hook(stage: str, command: str, context: HookContext, timeout: int) -> str | None:
+    """Run one hook command, logging its output.
+
+    Returns:
+        None on success, otherwise why the command failed
+    """
+    logger.info(f"Running {stage} hook: {command}")
+
+    try:
+        process = subprocess.Popen(
+            command,
+            shell=True,
+            env={**os.environ, **context.environment},
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            start_new_session=True,
+        )
+    except OSError as e:
+        return f"'{command}' could not be started: {e}"
+
+    try:
+        stdout, stderr = process.communicate(timeout=timeout)
+    except subprocess.TimeoutExpired:
+        # Killing only the shell would leave what the command started running
+        os.killpg(process.pid, signal.SIGKILL)
+        process.communicate()
+        return f"'{command}' timed out after {timeout} seconds"
+
+    for stream in (stdout, stderr):
+        for line in stream.decode(errors="replace").splitlines():
+            logger.info(f"[{stage}] {line}")
+
+    if process.returncode != 0:
+        return f"'{command}' exited with status {process.returncode}"
+    return None
+
+
+def run_pre_backup_hooks(commands: list[str], context: HookContext, timeout: int) -> None:
+    """Run the pre-backup hooks in order, stopping at the first that fails.
+
+    Raises:
+        HookError: If a command exits non-zero, times out or cannot be started
+    """
+    for command in commands:
+        error = _run_hook("pre_backup", command, context, timeout)
+        if error is not None:
+            raise HookError(f"Pre-backup hook {error}")
+
+
+def run_pre_restore_hooks(commands: list[str], context: HookContext, timeout: int) -> None:
+    """Run the pre-restore hooks in order, stopping at the first that fails.
+
+    Raises:
+        HookError: If a command exits non-zero, times out or cannot be started
+    """
+    for command in commands:
+        error = _run_hook("pre_restore", command, context, timeout)
+        if error is not None:
+            raise HookError(f"Pre-restore hook {error}")
+
+
+def run_post_hooks(stage: str, commands: list[str], context: HookContext, timeout: int) -> list[str]:
+    """Run post-backup, post-restore or failure hooks; every command runs even if an earlier one failed.
+
+    Returns:
+        Why each failed command failed, empty when all succeeded
+    """
+    failures = []
+    for command in commands:
+        error = _run_hook(stage, command, context, timeout)
+        if error is not None:
+            logger.warning(f"{stage} hook {error}")
+            failures.append(error)
+    return failures
@@ -0,0 +1,112 @@
+"""Key management services that wrap per-backup data keys."""
+
+from __future__ import annotations
+
+from abc import ABC, abstractmethod
+
+import boto3
+from botocore.exceptions import BotoCoreError, ClientError
+
+from nestvault.config import EncryptionConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("kms")
+
+# Bound to every data key, so KMS refuses to unwrap keys generated for other uses
+ENCRYPTION_CONTEXT = {"application": "nestvault"}
+
+
+class KeyProvider(ABC):
+    """A KMS that generates data keys wrapped by a master key and unwraps them."""
+
+    @property
+    @abstractmethod
+    def name(self) -> str:
+        """Return the provider recorded with each backup (e.g., 'aws')."""
+        pass
+
+    @property
+    @abstractmethod
+    def key_id(self) -> str | None:
+        """Return the configured master key, or None when only unwrapping."""
+        pass
+
+    @abstractmethod
+    def generate_data_key(self) -> tuple[bytes, bytes]:
+        """Generate a 256-bit data key.
+
+        Returns:
+            The plaintext data key, and the same key wrapped by the master key
+
+        Raises:
+            BackupError: If no master key is configured or the KMS call fails
+        """
+        pass
+
+    @abstractmethod
+    def decrypt_data_key(self, wrapped_key: bytes) -> bytes:
+        """Unwrap a data key.
+
+        Args:
+            wrapped_key: Data key as returned wrapped by generate_data_key
+
+        Returns:
+            The plaintext data key
+
+        Raises:
+            BackupError: If the KMS refuses to unwrap the key
+        """
+        pass
+
+
+class AWSKMSKeyProvider(KeyProvider):
+    """AWS KMS, using the ambient AWS credentials.
+
+    Unwrapping does not need the key ID: KMS finds the key in the wrapped
+    blob, so backups stay restorable after KMS_KEY_ID moves to a new key.
+    """
+
+    def __init__(self, config: EncryptionConfig):
+        """Initialize the AWS KMS key provider.
+
+        Args:
+            config: Encryption configuration
+        """
+        self.config = config
+        self.client = boto3.client("kms", region_name=config.kms_region)
+
+    @property
+    def name(self) -> str:
+        return "aws"
+
+    @property
+    def key_id(self) -> str | None:
+        return self.config.kms_key_id
+
+    def generate_data_key(self) -> tuple[bytes, bytes]:
+        if not self.key_id:
+            raise BackupError("ENCRYPTION=kms is set but KMS_KEY_ID is not, set the KMS key backups are encrypted with")
+
+        try:
+            response = self.client.generate_data_key(
+                KeyId=self.key_id, KeySpec="AES_256", EncryptionContext=ENCRYPTION_CONTEXT
+            )
+        except (BotoCoreError, ClientError) as e:
+            raise BackupError(f"AWS KMS GenerateDataKey with {self.key_id} failed: {e}")
+
+        logger.debug(f"Generated a data key with {response.get('KeyId', self.key_id)}")
+        return response["Plaintext"], response["CiphertextBlob"]
+
+    def decrypt_data_key(self, wrapped_key: bytes) -> bytes:
+        try:
+            response = self.client.decrypt(CiphertextBlob=wrapped_key, EncryptionContext=ENCRYPTION_CONTEXT)
+        except (BotoCoreError, ClientError) as e:
+            raise BackupError(f"AWS KMS Decrypt of the backup's data key failed: {e}")
+
+        return response["Plaintext"]
+
+
+def create_key_provider(config: EncryptionConfig) -> KeyProvider:
+    """Create the key provider for the configured KMS."""
+    return AWSKMSKeyProvider(config)
@@ -0,0 +1,225 @@
+"""Locks keeping two runs of a target from backing it up at the same time, in this process and across replicas."""
+
+from __future__ import annotations
+
+import json
+import os
+import socket
+import tempfile
+import threading
+import uuid
+from collections.abc import Iterator
+from contextlib import contextmanager
+from contextvars import ContextVar
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+from nestvault.window import terminate_children
+
+logger = get_logger("lock")
+
+# Key prefix the lock objects are kept under, next to the backups
+LOCK_PREFIX = "locks/"
+
+# Targets a run of this process is backing up
+_running: set[str] = set()
+_running_lock = threading.Lock()
+
+# Key of the lock object the run under way in this context holds, with the event set once it was lost
+_held: ContextVar[tuple[str, threading.Event] | None] = ContextVar("held_lock", default=None)
+
+
+def lock_key(name: str) -> str:
+    """Return the key of the lock object of a target, e.g. 'locks/billing.json'."""
+    return f"{LOCK_PREFIX}{name}.json"
+
+
+def _write_record(local_file: Path, owner: str, ttl: timedelta) -> None:
+    now = datetime.now(timezone.utc)
+    record = {"owner": owner, "acquired_at": now.isoformat(), "expires_at": (now + ttl).isoformat()}
+    local_file.write_text(json.dumps(record, indent=2, sort_keys=True))
+
+
+def _read_record(storage_adapter: StorageAdapter, key: str) -> tuple[dict, str] | None:
+    """Return the lock object stored under a key with its version, None if there is none.
+
+    Raises:
+        StorageError: If the lock object cannot be read
+    """
+    found = storage_adapter.read_versioned(key)
+    if found is None:
+        return None
+    content, version = found
+    try:
+        record = json.loads(content)
+        datetime.fromisoformat(record["expires_at"])
+        return record, version
+    except (ValueError, KeyError, TypeError) as e:
+        raise StorageError(f"Unreadable lock object {key}: {e}")
+
+
+def _acquire(storage_adapter: StorageAdapter, key: str, owner: str, ttl: timedelta, local_file: Path) -> bool:
+    """Create the lock object of a target, taking over one whose TTL ran out; False if another run holds it.
+
+    A takeover replaces the expired lock object only if it is unchanged
+    since it was read, so of two replicas taking it over at once, one fails.
+
+    Raises:
+        StorageError: If the lock object cannot be read or written
+    """
+    _write_record(local_file, owner, ttl)
+    if storage_adapter.create_exclusive(local_file, key):
+        return True
+
+    found = _read_record(storage_adapter, key)
+    if found is None:
+        # Released between the create and the read
+        return storage_adapter.create_exclusive(local_file, key)
+
+    record, version = found
+    expires_at = datetime.fromisoformat(record["expires_at"])
+    if expires_at > datetime.now(timezone.utc):
+        logger.debug(f"Lock {key} is held by {record.get('owner')} until {expires_at.isoformat()}")
+        return False
+    # The run holding it crashed, or lost its storage for longer than its TTL
+    logger.warning(f"Taking over lock {key} of {record.get('owner')}, which expired at {expires_at.isoformat()}")
+    if storage_adapter.replace_if_unchanged(local_file, key, version):
+        return True
+    logger.debug(f"Lock {key} was taken over by another run first")
+    return False
+
+
+def _renew(
+    storage_adapter: StorageAdapter,
+    key: str,
+    owner: str,
+    ttl: timedelta,
+    stop: threading.Event,
+    lost: threading.Event,
+    thread_id: int,
+) -> None:
+    """Push the expiry of a held lock object out by its TTL, every third of it, until stopped or the lock is lost.
+
+    A renewal replaces the lock object only if it still names this run as
+    its owner and is unchanged since it was read. Otherwise another run
+    took the lock over, e.g. after renewals failed for longer than the TTL:
+    the processes the run started in its thread are terminated, which
+    fails the dump under way, and check_lock stops it before its next step.
+    """
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "lock.json"
+        while not stop.wait(ttl.total_seconds() / 3):
+            try:
+                found = _read_record(storage_adapter, key)
+                if found is not None and found[0].get("owner") == owner:
+                    _write_record(local_file, owner, ttl)
+                    if storage_adapter.replace_if_unchanged(local_file, key, found[1]):
+                        continue
+            except StorageError as e:
+                logger.warning(f"Failed to renew lock {key}, it expires unless a later renewal succeeds: {e}")
+                continue
+
+            lost.set()
+            terminated = terminate_children(thread_id)
+            logger.error(
+                f"Lock {key} was taken over by another run, cancelling this one"
+                f"{f' and terminating {terminated} processes it started' if terminated else ''}"
+            )
+            return
+
+
+def _release(storage_adapter: StorageAdapter, key: str, owner: str) -> None:
+    """Delete a lock object, unless another run took it over in the meantime."""
+    try:
+        found = _read_record(storage_adapter, key)
+        if found is not None and found[0].get("owner") == owner:
+            storage_adapter.delete(key)
+        elif found is not None:
+            logger.warning(f"Lock {key} was taken over by {found[0].get('owner')}, leaving it in place")
+    except StorageError as e:
+        logger.warning(f"Failed to release lock {key}, it expires with its TTL: {e}")
+
+
+@contextmanager
+def _distributed_lock(storage_adapter: StorageAdapter, name: str, ttl: timedelta) -> Iterator[bool]:
+    key = lock_key(name)
+    owner = f"{socket.gethostname()}:{os.getpid()}:{uuid.uuid4().hex[:8]}"
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        acquired = _acquire(storage_adapter, key, owner, ttl, Path(temp_dir) / "lock.json")
+    if not acquired:
+        yield False
+        return
+
+    stop, lost = threading.Event(), threading.Event()
+    renewer = threading.Thread(
+        target=_renew,
+        args=(storage_adapter, key, owner, ttl, stop, lost, threading.get_native_id()),
+        name=f"lock-{name}",
+        daemon=True,
+    )
+    renewer.start()
+    token = _held.set((key, lost))
+    try:
+        yield True
+    finally:
+        _held.reset(token)
+        stop.set()
+        renewer.join()
+        _release(storage_adapter, key, owner)
+
+
+@contextmanager
+def target_lock(
+    name: str, storage_adapter: StorageAdapter | None = None, ttl: timedelta | None = None
+) -> Iterator[bool]:
+    """Hold the lock of a target for the block, yielding whether it was acquired.
+
+    A run of the target already under way in this process holds the lock.
+    With a storage adapter and a TTL, so does one of any replica: the lock
+    is then an object in the storage, created only if it does not exist
+    yet, and renewed while the block runs. A replica that crashed leaves
+    its lock behind, which is taken over once its TTL ran out. A run
+    whose lock was taken over meanwhile is cancelled, see _renew.
+
+    Args:
+        name: Name of the target
+        storage_adapter: Storage to keep the lock object in; None for a lock in this process only
+        ttl: How long a lock object is valid without renewal
+
+    Raises:
+        StorageError: If the lock object cannot be read or written
+    """
+    with _running_lock:
+        if name in _running:
+            acquired = False
+        else:
+            _running.add(name)
+            acquired = True
+    if not acquired:
+        yield False
+        return
+
+    try:
+        if storage_adapter is None or ttl is None:
+            yield True
+        else:
+            with _distributed_lock(storage_adapter, name, ttl) as held:
+                yield held
+    finally:
+        with _running_lock:
+            _running.discard(name)
+
+
+def check_lock(step: str) -> None:
+    """Stop the backup under way before a step once another run took its target's lock over.
+
+    Raises:
+        BackupError: If the lock the backup holds was taken over
+    """
+    held = _held.get()
+    if held is not None and held[1].is_set():
+        raise BackupError(f"Lost lock {held[0]} to another run, cancelled before the {step}")
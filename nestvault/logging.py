@@ -1,21 +1,119 @@
 """Structured logging setup for NestVault using loguru."""
 
+import json
+import re
 import sys
+import threading
+import traceback
+from collections import deque
+from collections.abc import Callable, Iterable, Iterator
+from contextlib import AbstractContextManager, contextmanager
+from datetime import timezone
+from typing import Any, TextIO
 
 from loguru import logger
 
+# Formats lines can be logged in: for people, or one JSON object per line for log pipelines
+LOG_FORMATS = ("text", "json")
 
-def setup_logging(level: str = "INFO") -> None:
+# Context fields JSON lines carry when they are set, in this order
+CONTEXT_FIELDS = ("target", "database", "run_id", "phase", "duration")
+
+REDACTED = "***"
+
+# Secrets recognizable by their shape: passwords in URLs, key=value credentials and authorization headers
+_SECRET_PATTERNS = (
+    (re.compile(r"(\b[A-Za-z][\w+.-]*://[^/\s:@]*:)[^@\s]+@"), rf"\1{REDACTED}@"),
+    (
+        re.compile(
+            r"(?i)(?<!/)\b(password|passwd|pwd|passphrase|secret|token|api[_-]?key|access[_-]?key|account[_-]?key|sig)"
+            r"(\s*[=:]\s*)(?!\*\*\*)[^\s&;,'\"]+"
+        ),
+        rf"\1\2{REDACTED}",
+    ),
+    (re.compile(r"(?i)\b(bearer|basic|geniekey)\s+[\w.~+/=-]{8,}"), rf"\1 {REDACTED}"),
+)
+
+# Configured secrets, longest first so one containing another is redacted whole
+_secrets: list[str] = []
+_secrets_lock = threading.Lock()
+
+# Shortest configured secret redacted, so short values such as 'db' do not blank out ordinary words
+MIN_SECRET_CHARS = 4
+
+
+def register_secrets(values: Iterable[str | None]) -> None:
+    """Redact values, e.g. the passwords and keys NestVault is configured with, wherever they are logged."""
+    with _secrets_lock:
+        known = set(_secrets)
+        known.update(value for value in values if value and len(value) >= MIN_SECRET_CHARS)
+        _secrets[:] = sorted(known, key=len, reverse=True)
+
+
+def redact(text: str) -> str:
+    """Return text with the configured secrets and anything shaped like a credential replaced by ***."""
+    for secret in _secrets:
+        text = text.replace(secret, REDACTED)
+    for pattern, replacement in _SECRET_PATTERNS:
+        text = pattern.sub(replacement, text)
+    return text
+
+
+def _redact_record(record) -> None:
+    record["message"] = redact(record["message"])
+
+
+# Every line is redacted before any sink sees it, whatever logged it
+logger.configure(patcher=_redact_record)
+
+
+def _format(record) -> str:
+    """Format a line, tagged with the target it was logged for, if any."""
+    target = "[{extra[target]}] " if record["extra"].get("target") else ""
+    return "[{time:YYYY-MM-DDTHH:mm:ss.SSS}Z] [{level}] [{extra[component]}] " + target + "{message}\n{exception}"
+
+
+def format_json(record) -> str:
+    """Return a record as one JSON line, with its context fields and any exception, redacted."""
+    document: dict[str, Any] = {
+        "time": record["time"].astimezone(timezone.utc).isoformat(timespec="milliseconds").replace("+00:00", "Z"),
+        "level": record["level"].name,
+        "component": record["extra"].get("component", record["name"]),
+        "message": record["message"],
+    }
+    for name in CONTEXT_FIELDS:
+        if record["extra"].get(name) is not None:
+            document[name] = record["extra"][name]
+    if record["exception"] is not None:
+        kind, value, tb = record["exception"]
+        document["exception"] = redact("".join(traceback.format_exception(kind, value, tb)).rstrip())
+    return json.dumps(document, default=str)
+
+
+def _json_sink(stream: TextIO) -> Callable[[Any], None]:
+    def sink(message) -> None:
+        stream.write(format_json(message.record) + "\n")
+        stream.flush()
+
+    return sink
+
+
+def setup_logging(level: str = "INFO", stream: TextIO | None = None, log_format: str = "text") -> None:
     """Configure loguru for NestVault.
 
     Args:
         level: Log level (DEBUG, INFO, WARNING, ERROR, CRITICAL)
+        stream: Where to log, stdout by default; stderr when stdout carries data, e.g. a fetched backup
+        log_format: 'text' for people, or 'json' for one JSON object per line
     """
     logger.remove()
 
+    if log_format == "json":
+        logger.add(_json_sink(stream or sys.stdout), level=level.upper(), format="{message}", colorize=False)
+        return
     logger.add(
-        sys.stdout,
-        format="[{time:YYYY-MM-DDTHH:mm:ss.SSS}Z] [{level}] [{extra[component]}] {message}",
+        stream or sys.stdout,
+        format=_format,
         level=level.upper(),
         colorize=True,
     )
@@ -31,3 +129,39 @@ def get_logger(component: str):
         Logger bound with component context
     """
     return logger.bind(component=component)
+
+
+def target_context(target: str) -> AbstractContextManager:
+    """Tag every line logged within the block, in this thread, with a target's name.
+
+    Args:
+        target: Name of the target being backed up
+    """
+    return logger.contextualize(target=target)
+
+
+def log_context(**fields: Any) -> AbstractContextManager:
+    """Add context fields, e.g. database or run_id, to every line logged within the block, in this thread."""
+    return logger.contextualize(**fields)
+
+
+@contextmanager
+def capturing(max_lines: int = 500) -> Iterator[deque[str]]:
+    """Collect the last lines logged within the block, in this thread, as they are logged.
+
+    Args:
+        max_lines: Lines kept; earlier ones are dropped
+    """
+    lines: deque[str] = deque(maxlen=max_lines)
+    thread = threading.get_ident()
+    sink = logger.add(
+        lambda message: lines.append(message.rstrip("\n")),
+        format=_format,
+        level="INFO",
+        colorize=False,
+        filter=lambda record: record["thread"].id == thread,
+    )
+    try:
+        yield lines
+    finally:
+        logger.remove(sink)
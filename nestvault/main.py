@@ -1,20 +1,147 @@
 """Main entry point for NestVault."""
 
+from __future__ import annotations
+
+import json
+import shutil
+import signal
 import sys
+import threading
+import time
+import uuid
+from collections import Counter
+from collections.abc import Iterator
+from contextlib import AbstractContextManager, ExitStack, contextmanager, nullcontext, suppress
+from dataclasses import asdict, replace
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+from zoneinfo import ZoneInfo
 
-from nestvault.backup.base import BackupAdapter
+from nestvault.audit import (
+    OPERATIONS,
+    TRAIL_OUTPUTS,
+    AuditTrail,
+    RestoreRecord,
+    read_trail,
+    record_outcome,
+    record_start,
+    render_trail,
+    strip_credentials,
+    use_audit_trail,
+    write_restore_record,
+)
+from nestvault.backup.base import BackupAdapter, RestoreOptions
+from nestvault.backup.cassandra import CassandraBackupAdapter
+from nestvault.backup.clickhouse import ClickHouseBackupAdapter
+from nestvault.backup.deduplicated import DedupBackupAdapter
+from nestvault.backup.cockroachdb import CockroachDBBackupAdapter
+from nestvault.backup.elasticsearch import ElasticsearchBackupAdapter
+from nestvault.backup.encrypted import EncryptedBackupAdapter
+from nestvault.backup.etcd import EtcdBackupAdapter
+from nestvault.backup.influxdb import InfluxDBBackupAdapter
 from nestvault.backup.mongodb import MongoDBBackupAdapter
-from nestvault.backup.postgres import PostgresBackupAdapter
+from nestvault.backup.mssql import MSSQLBackupAdapter
+from nestvault.backup.mysql import MySQLBackupAdapter
+from nestvault.backup.postgres import PostgresBackupAdapter, table_args
+from nestvault.backup.redis import RedisBackupAdapter
+from nestvault.backup.sqlite import SQLiteBackupAdapter
+from nestvault.catalog import OUTPUTS, BackupQuery, Catalog, parse_time, read_catalog, render
 from nestvault.cli import parse_args
-from nestvault.config import Config, load_config
-from nestvault.exceptions import ConfigError, NestVaultError
-from nestvault.logging import get_logger, setup_logging
-from nestvault.restore import list_available_backups, restore_backup, restore_latest_backup
-from nestvault.scheduler import run_scheduler
+from nestvault.config import (
+    Config,
+    PostgresConfig,
+    TargetConfig,
+    apply_dsn,
+    load_config,
+    parse_label,
+    secret_values,
+)
+from nestvault.credentials import VaultCredentialProvider, leased_credentials
+from nestvault.dedup import collect_chunks
+from nestvault.download import RetryPolicy
+from nestvault.encryption import create_cipher
+from nestvault.fetch import fetch_backup
+from nestvault.exceptions import (
+    BackupError,
+    ConfigError,
+    CredentialError,
+    HookError,
+    IntegrityError,
+    NestVaultError,
+    RetentionError,
+    StorageError,
+    TunnelError,
+)
+from nestvault.hold import Hold, place_hold, release_hold
+from nestvault.hooks import HookContext, run_post_hooks, run_pre_restore_hooks
+from nestvault.logging import get_logger, register_secrets, setup_logging, target_context
+from nestvault.manifest import Manifest, format_labels, list_backups, read_manifest
+from nestvault.metrics import serve as serve_metrics
+from nestvault.naming import ADHOC_TIER, DEFAULT_KEY_TEMPLATE, KeyTemplate, listing_prefix
+from nestvault.notify import (
+    DiscordNotifier,
+    EmailNotifier,
+    EscalationState,
+    Notifier,
+    NtfyNotifier,
+    OpsgenieNotifier,
+    PagerDutyNotifier,
+    SlackNotifier,
+    TeamsNotifier,
+    RunResult,
+    TelegramNotifier,
+    WebhookNotifier,
+    notify,
+    track_streaks,
+)
+from nestvault.ping import Pinger
+from nestvault.restore import RestorePlan, list_available_backups, plan_restore, restore_backup, restore_to_time
+from nestvault.retention import (
+    Decision,
+    GfsPolicy,
+    PruneReport,
+    RetentionLimits,
+    find_orphans,
+    limit_backups,
+    prune_backups,
+)
+from nestvault.sandbox import run_checks, scratch_name, scratch_server
+from nestvault.scheduler import (
+    BackupTarget,
+    Fallback,
+    Replica,
+    Schedule,
+    ScheduledTask,
+    Tier,
+    for_tier,
+    pause,
+    paused,
+    reconcile_failover,
+    resume,
+    reschedule,
+    resume_uploads,
+    run_once,
+    run_scheduler,
+    upcoming,
+)
+from nestvault.storage.azblob import AzureBlobStorageAdapter
 from nestvault.storage.backblaze import BackblazeStorageAdapter
 from nestvault.storage.base import StorageAdapter
+from nestvault.storage.gcs import GCSStorageAdapter
+from nestvault.storage.local import LocalStorageAdapter
+from nestvault.storage.prefixed import PrefixedStorageAdapter
 from nestvault.storage.r2 import R2StorageAdapter
 from nestvault.storage.s3 import S3StorageAdapter
+from nestvault.storage.sftp import SFTPStorageAdapter
+from nestvault.storage.webdav import WebDAVStorageAdapter
+from nestvault.summary import EXIT_FAILURE, EXIT_SUCCESS, EXIT_USAGE, RunSummary, exit_code, write_summary
+from nestvault.tempdir import sweep_orphans, use_temp_dir
+from nestvault.throttle import shared_throttle
+from nestvault.tracing import setup_tracing
+from nestvault.tunnel import SshTunnel, tunneled
+from nestvault.verify import log_result, verify_backup
+from nestvault.wal import fetch_wal, prune_wal, push_wal
+from nestvault.window import BackupWindow
 
 
 def create_backup_adapter(config: Config) -> BackupAdapter:
@@ -34,33 +161,1455 @@ def create_backup_adapter(config: Config) -> BackupAdapter:
         if not config.mongodb:
             raise ConfigError("MongoDB configuration missing")
         return MongoDBBackupAdapter(config.mongodb)
+    elif config.database_type == "mysql":
+        if not config.mysql:
+            raise ConfigError("MySQL configuration missing")
+        return MySQLBackupAdapter(config.mysql)
+    elif config.database_type == "redis":
+        if not config.redis:
+            raise ConfigError("Redis configuration missing")
+        return RedisBackupAdapter(config.redis)
+    elif config.database_type == "sqlite":
+        if not config.sqlite:
+            raise ConfigError("SQLite configuration missing")
+        return SQLiteBackupAdapter(config.sqlite)
+    elif config.database_type == "clickhouse":
+        if not config.clickhouse:
+            raise ConfigError("ClickHouse configuration missing")
+        return ClickHouseBackupAdapter(config.clickhouse)
+    elif config.database_type == "mssql":
+        if not config.mssql:
+            raise ConfigError("SQL Server configuration missing")
+        return MSSQLBackupAdapter(config.mssql)
+    elif config.database_type == "etcd":
+        if not config.etcd:
+            raise ConfigError("etcd configuration missing")
+        return EtcdBackupAdapter(config.etcd)
+    elif config.database_type == "influxdb":
+        if not config.influxdb:
+            raise ConfigError("InfluxDB configuration missing")
+        return InfluxDBBackupAdapter(config.influxdb)
+    elif config.database_type == "cockroachdb":
+        if not config.cockroachdb:
+            raise ConfigError("CockroachDB configuration missing")
+        return CockroachDBBackupAdapter(config.cockroachdb)
+    elif config.database_type == "cassandra":
+        if not config.cassandra:
+            raise ConfigError("Cassandra configuration missing")
+        return CassandraBackupAdapter(config.cassandra)
+    elif config.database_type == "elasticsearch":
+        if not config.elasticsearch:
+            raise ConfigError("Elasticsearch configuration missing")
+        return ElasticsearchBackupAdapter(config.elasticsearch)
     else:
         raise ConfigError(f"Unknown database type: {config.database_type}")
 
 
-def create_storage_adapter(config: Config) -> StorageAdapter:
+def create_storage_adapter(
+    config: Config,
+    storage_type: str | None = None,
+    access_tier: str | None = None,
+    storage_class: str | None = None,
+) -> StorageAdapter:
     """Create the appropriate storage adapter based on configuration.
 
     Args:
         config: Application configuration
+        storage_type: Storage backend to create (defaults to STORAGE_TYPE)
+        access_tier: Azure Blob access tier (defaults to AZURE_STORAGE_ACCESS_TIER)
+        storage_class: S3/R2 storage class (defaults to S3_STORAGE_CLASS)
 
     Returns:
-        Configured storage adapter
+        Configured storage adapter, sharing the bandwidth limits with every other adapter
     """
-    if config.storage_type == "s3":
+    adapter = _storage_adapter(config, storage_type or config.storage_type, access_tier, storage_class)
+    adapter.limit_bandwidth(
+        shared_throttle("upload", config.bandwidth.upload_limit, config.bandwidth.limit_windows),
+        shared_throttle("download", config.bandwidth.download_limit, config.bandwidth.limit_windows),
+    )
+    return adapter
+
+
+def _storage_adapter(
+    config: Config,
+    storage_type: str,
+    access_tier: str | None,
+    storage_class: str | None,
+) -> StorageAdapter:
+    """Create the storage adapter of a backend."""
+    if storage_type == "s3":
         if not config.s3:
             raise ConfigError("S3 configuration missing")
-        return S3StorageAdapter(config.s3)
-    elif config.storage_type == "r2":
+        return S3StorageAdapter(replace(config.s3, storage_class=storage_class or config.s3.storage_class))
+    elif storage_type == "r2":
         if not config.s3:
             raise ConfigError("R2 configuration missing")
-        return R2StorageAdapter(config.s3)
-    elif config.storage_type == "backblaze":
+        return R2StorageAdapter(replace(config.s3, storage_class=storage_class or config.s3.storage_class))
+    elif storage_type == "backblaze":
         if not config.backblaze:
             raise ConfigError("Backblaze configuration missing")
         return BackblazeStorageAdapter(config.backblaze)
+    elif storage_type == "gcs":
+        if not config.gcs:
+            raise ConfigError("GCS configuration missing")
+        return GCSStorageAdapter(config.gcs)
+    elif storage_type == "azblob":
+        if not config.azblob:
+            raise ConfigError("Azure Blob configuration missing")
+        return AzureBlobStorageAdapter(replace(config.azblob, access_tier=access_tier or config.azblob.access_tier))
+    elif storage_type == "sftp":
+        if not config.sftp:
+            raise ConfigError("SFTP configuration missing")
+        return SFTPStorageAdapter(config.sftp)
+    elif storage_type == "local":
+        if not config.local:
+            raise ConfigError("Local storage configuration missing")
+        return LocalStorageAdapter(config.local)
+    elif storage_type == "webdav":
+        if not config.webdav:
+            raise ConfigError("WebDAV configuration missing")
+        return WebDAVStorageAdapter(config.webdav)
+    else:
+        raise ConfigError(f"Unknown storage type: {storage_type}")
+
+
+def create_notifiers(config: Config) -> list[Notifier]:
+    """Create the notifiers reporting backup results."""
+    notifiers: list[Notifier] = []
+    if config.slack is not None:
+        slack = config.slack
+        notifiers.append(SlackNotifier(slack.webhook_url, slack.bot_token, slack.channel, slack.notify_on))
+    if config.discord is not None:
+        notifiers.append(DiscordNotifier(config.discord.webhook_url, config.discord.notify_on))
+    if config.telegram is not None:
+        telegram = config.telegram
+        notifiers.append(TelegramNotifier(telegram.bot_token, telegram.chat_id, telegram.notify_on))
+    if config.teams is not None:
+        teams = config.teams
+        notifiers.append(TeamsNotifier(teams.webhook_url, teams.status_url, teams.notify_on, retries=teams.retries))
+    if config.ntfy is not None:
+        ntfy = config.ntfy
+        notifiers.append(
+            NtfyNotifier(
+                ntfy.server_url,
+                ntfy.topic,
+                ntfy.token,
+                ntfy.username,
+                ntfy.password,
+                ntfy.click_url,
+                ntfy.notify_on,
+            )
+        )
+    if config.webhook is not None:
+        webhook = config.webhook
+        notifiers.append(
+            WebhookNotifier(
+                webhook.url,
+                webhook.method,
+                webhook.headers,
+                webhook.body_template,
+                webhook.secret,
+                webhook.retries,
+                webhook.notify_on,
+            )
+        )
+    if config.smtp is not None:
+        smtp = config.smtp
+        notifiers.append(
+            EmailNotifier(
+                smtp.host,
+                smtp.port,
+                smtp.sender,
+                smtp.to,
+                smtp.cc,
+                smtp.tls,
+                smtp.username,
+                smtp.password,
+                smtp.notify_on,
+                smtp.timeout_seconds,
+            )
+        )
+    if config.escalation is not None:
+        escalation = config.escalation
+        # One file counts the failures of both, so they keep out of each other's way
+        state = EscalationState(Path(escalation.state_file))
+        if escalation.pagerduty_routing_key is not None:
+            notifiers.append(PagerDutyNotifier(escalation.pagerduty_routing_key, state, escalation.after_failures))
+        if escalation.opsgenie_api_key is not None:
+            notifiers.append(
+                OpsgenieNotifier(
+                    escalation.opsgenie_api_key, state, escalation.after_failures, escalation.opsgenie_api_url
+                )
+            )
+    return notifiers
+
+
+def create_backup_target(
+    config: Config, target: TargetConfig, labels: dict[str, str] | None = None
+) -> BackupTarget:
+    """Create the adapters for one configured backup target.
+
+    Args:
+        config: Application configuration
+        target: Target settings
+        labels: Labels of a manual backup, added to the target's own
+
+    Returns:
+        Backup target ready to be scheduled
+
+    Raises:
+        ConfigError: If the target has an SSH tunnel but its engine cannot be tunneled
+    """
+    if config.postgres is not None:
+        overrides = {}
+        if target.include_tables is not None or target.exclude_tables is not None:
+            overrides.update(include_tables=target.include_tables or [], exclude_tables=target.exclude_tables or [])
+        if target.dump_scope is not None:
+            overrides["dump_scope"] = target.dump_scope
+        if target.extra_dump_args is not None:
+            overrides["extra_dump_args"] = target.extra_dump_args
+        if target.extra_restore_args is not None:
+            overrides["extra_restore_args"] = target.extra_restore_args
+        config = replace(config, postgres=replace(config.postgres, **overrides))
+    if target.compression is not None:
+        engine = getattr(config, config.database_type)
+        config = replace(config, **{config.database_type: replace(engine, compression=target.compression)})
+
+    backup_adapter = create_backup_adapter(config)
+    if target.database:
+        backup_adapter = backup_adapter.for_database(target.database)
+    if target.encryption:
+        backup_adapter = EncryptedBackupAdapter(backup_adapter, create_cipher(target.encryption))
+    if config.dedup.enabled:
+        backup_adapter = DedupBackupAdapter(backup_adapter, config.dedup)
+
+    storage_adapter = create_storage_adapter(
+        config, target.storage_type, target.access_tier, target.storage_class
+    )
+    if target.storage_prefix:
+        storage_adapter = PrefixedStorageAdapter(storage_adapter, target.storage_prefix)
+    backup_adapter.use_storage(storage_adapter)
+
+    def secondary_storage(storage_type: str) -> StorageAdapter:
+        adapter = create_storage_adapter(config, storage_type)
+        if target.storage_prefix:
+            adapter = PrefixedStorageAdapter(adapter, target.storage_prefix)
+        return adapter
+
+    replicas = [
+        Replica(replica.storage_type, secondary_storage(replica.storage_type), replica.retention_days)
+        for replica in target.replicas
+    ]
+    failover = [Fallback(storage_type, secondary_storage(storage_type)) for storage_type in target.failover]
+
+    labels = {**target.labels, **(labels or {})}
+    tiers = [Tier(tier.name, tier.schedule, tier.retention_days) for tier in target.tiers]
+    if target.adhoc_retention_days is not None:
+        tiers.append(Tier(ADHOC_TIER, None, target.adhoc_retention_days))
+
+    tz = ZoneInfo(target.schedule_timezone)
+    max_runtime = None
+    if target.backup_max_runtime_seconds is not None:
+        max_runtime = timedelta(seconds=target.backup_max_runtime_seconds)
+    # GFS periods are counted in the target's schedule timezone
+    gfs = GfsPolicy(**asdict(config.gfs), tz=tz) if config.gfs is not None else None
+    limits = None
+    if target.max_total_size is not None or target.max_age_days is not None:
+        limits = RetentionLimits(target.max_total_size, target.max_age_days)
+
+    # The default template keeps the names adapters give their files
+    key_template = None
+    if target.key_template != DEFAULT_KEY_TEMPLATE:
+        key_template = KeyTemplate(target.key_template, target.name, labels)
+
+    tunnel = None
+    if target.ssh_tunnel is not None:
+        if config.postgres is None:
+            raise ConfigError(f"Target '{target.name}' has an SSH tunnel, which only DATABASE_TYPE=postgres supports")
+        tunnel = SshTunnel(target.ssh_tunnel, config.postgres.host, config.postgres.port)
+
+    return BackupTarget(
+        name=target.name,
+        schedule=target.backup_schedule,
+        retention_days=target.retention_days,
+        backup_adapter=backup_adapter,
+        storage_adapter=storage_adapter,
+        replicas=replicas,
+        tz=tz,
+        jitter=timedelta(seconds=target.schedule_jitter_seconds),
+        window=BackupWindow(tuple(target.backup_window), tz) if target.backup_window else None,
+        max_runtime=max_runtime,
+        skip_unchanged=timedelta(days=target.min_full_interval_days) if target.skip_unchanged else None,
+        lock_ttl=timedelta(seconds=config.lock_ttl_seconds) if config.distributed_lock else None,
+        ping=Pinger(target.ping_url, config.ping_timeout_seconds, config.ping_retries) if target.ping_url else None,
+        notifiers=create_notifiers(config),
+        credentials=VaultCredentialProvider(config.vault) if config.vault is not None else None,
+        tunnel=tunnel,
+        failover=failover,
+        upload_retries=config.upload_retries,
+        stream=not config.backup_temp_file,
+        upload_max_age=timedelta(hours=config.multipart_upload_max_age_hours),
+        hooks=config.hooks if config.hooks.configured else None,
+        preflight=config.preflight if config.preflight.enabled else None,
+        key_template=key_template,
+        labels=labels,
+        concurrency_key=target.concurrency_key,
+        tiers=tiers,
+        gfs=gfs,
+        limits=limits,
+    )
+
+
+def leased(target: BackupTarget, backup_adapter: BackupAdapter) -> AbstractContextManager:
+    """Return a context connecting an adapter with credentials leased for the target, if it leases any."""
+    if target.credentials is None:
+        return nullcontext()
+    return leased_credentials(target.credentials, backup_adapter)
+
+
+@contextmanager
+def connected(target: BackupTarget, backup_adapter: BackupAdapter) -> Iterator[None]:
+    """Connect an adapter to the target's database through its SSH tunnel and with leased credentials, if it has them.
+
+    Raises:
+        TunnelError: If the tunnel cannot be opened
+        CredentialError: If the credentials cannot be obtained
+    """
+    with ExitStack() as stack:
+        if target.tunnel is not None:
+            stack.enter_context(tunneled(target.tunnel, backup_adapter))
+        stack.enter_context(leased(target, backup_adapter))
+        yield
+
+
+# Settings a running daemon only reads on start, by variable, which a reload leaves as they were
+RESTART_SETTINGS = {
+    "LOG_LEVEL": "log_level",
+    "LOG_FORMAT": "log_format",
+    "METRICS_ADDRESS": "metrics_address",
+    "HEALTHZ_OVERDUE_SECONDS": "healthz_overdue_seconds",
+    "TEMP_DIR": "temp_dir",
+    "NOTIFY_STATE_FILE": "notify_state_file",
+    "CATCH_UP": "catch_up",
+    "CATCH_UP_GRACE_SECONDS": "catch_up_grace_seconds",
+    "AUDIT_*": "audit",
+}
+
+
+def daemon_schedule(config: Config, targets: list[BackupTarget], logger) -> Schedule:
+    """Return what the daemon schedules for a configuration: its targets, and restore verification if scheduled."""
+    tasks = []
+    if config.restore_verify.schedule:
+        tasks.append(
+            ScheduledTask(
+                "restore verification",
+                config.restore_verify.schedule,
+                lambda: verify_restores(config, None, None, "latest", logger),
+                ZoneInfo(config.schedule_timezone),
+            )
+        )
+    return Schedule(targets, tasks, config.max_concurrent_backups)
+
+
+def reload_config(current: Config, logger) -> tuple[Config, Schedule]:
+    """Load the configuration of a running daemon again, validated in full before anything uses it.
+
+    The secret files of *_FILE variables are read again and the adapters
+    of every target created anew, e.g. with a rotated storage key. With
+    CHECK_STORAGE_ON_STARTUP, the storage of every target must pass the
+    check first. Settings in RESTART_SETTINGS keep their values until a
+    restart, which is logged when they changed.
+
+    Args:
+        current: Configuration the daemon runs with
+        logger: Logger instance
+
+    Returns:
+        The new configuration, and what the daemon schedules for it
+
+    Raises:
+        NestVaultError: If the configuration is invalid, or its storage fails the check
+    """
+    config = load_config()
+    targets = [create_backup_target(config, target) for target in config.targets]
+    if config.check_storage_on_startup and not check_storage(targets, logger):
+        raise StorageError("The storage check of the reloaded configuration failed")
+    register_secrets(secret_values(config))
+
+    changed = [
+        name for name, setting in RESTART_SETTINGS.items() if getattr(config, setting) != getattr(current, setting)
+    ]
+    if changed:
+        logger.warning(f"Changes to {', '.join(changed)} take effect on the next restart, not on a reload")
+    config = replace(config, **{setting: getattr(current, setting) for setting in RESTART_SETTINGS.values()})
+
+    logger.info(f"Configuration reloaded, targets: {', '.join(target.name for target in config.targets)}")
+    return config, daemon_schedule(config, targets, logger)
+
+
+def config_reload_result(status: str, error: str = "") -> RunResult:
+    """Return the result notifications report a configuration reload with, a failure as long as reloads fail."""
+    return RunResult("configuration", "-", status, error=error, subject="Configuration reload")
+
+
+def manual_runs(targets: list[BackupTarget], tier: str | None) -> list[BackupTarget]:
+    """Return what a manual backup of the targets runs: targets with tiers in the given one, by default ad hoc.
+
+    Args:
+        targets: Backup targets to back up
+        tier: Tier from --tier, None for the ad hoc tier
+
+    Raises:
+        ConfigError: If a target has no tier of that name
+    """
+    runs = []
+    for target in targets:
+        if not target.tiers:
+            if tier is not None:
+                raise ConfigError(f"--tier needs TIERS, and target '{target.name}' has none")
+            runs.append(target)
+            continue
+        try:
+            runs.append(for_tier(target, tier or ADHOC_TIER))
+        except KeyError:
+            names = ", ".join(candidate.name for candidate in target.tiers)
+            raise ConfigError(f"Target '{target.name}' has no tier '{tier}', use one of: {names}")
+    return runs
+
+
+def select_target(config: Config, name: str | None) -> TargetConfig:
+    """Pick the target a restore operates on.
+
+    Args:
+        config: Application configuration
+        name: Target name from --target, optional with a single target
+
+    Returns:
+        Selected target settings
+    """
+    if name is None:
+        if len(config.targets) > 1:
+            names = ", ".join(target.name for target in config.targets)
+            raise ConfigError(f"Multiple targets configured, pass --target (one of: {names})")
+        return config.targets[0]
+
+    for target in config.targets:
+        if target.name == name:
+            return target
+
+    raise ConfigError(f"Unknown target: {name}")
+
+
+def check_storage(targets: list[BackupTarget], logger) -> bool:
+    """Round-trip a small test object through every storage destination of every target.
+
+    Where the storage's credentials can come from more than one place, the
+    source they were found in is logged first.
+
+    Args:
+        targets: Backup targets to check
+        logger: Logger instance
+
+    Returns:
+        True if every target's storage passed
+    """
+    passed = True
+
+    for target in targets:
+        destinations = [(target.name, target.storage_adapter)]
+        destinations += [(f"{target.name}/{replica.name}", replica.storage_adapter) for replica in target.replicas]
+        destinations += [(f"{target.name}/{fallback.name}", fallback.storage_adapter) for fallback in target.failover]
+
+        for name, storage_adapter in destinations:
+            # A dot name keeps a test object left behind by a failed delete out of backup listings
+            key = f".nestvault-check-{uuid.uuid4().hex}"
+            try:
+                source = storage_adapter.credential_source()
+                if source is not None:
+                    logger.info(f"Storage of target '{name}' authenticates with credentials from the {source}")
+                storage_adapter.check_connectivity(key)
+                logger.info(f"Storage check passed for target '{name}'")
+            except StorageError as e:
+                logger.error(f"Storage check failed for target '{name}': {e}")
+                passed = False
+
+    return passed
+
+
+def check_database_tls(targets: list[BackupTarget], logger) -> bool:
+    """Handshake TLS with the database server of every target, as its backups connect.
+
+    Logs the subject of each server's certificate, so a doctor run shows
+    which certificate the configured root certificate was checked against.
+    A target with an SSH tunnel has it opened first, and the handshake
+    goes through it.
+
+    Args:
+        targets: Backup targets to check
+        logger: Logger instance
+
+    Returns:
+        True if every tunnel opened and every handshake passed, or was not attempted as connections are not encrypted
+    """
+    passed = True
+
+    for target in targets:
+        tunnel = tunneled(target.tunnel, target.backup_adapter) if target.tunnel is not None else nullcontext()
+        try:
+            with tunnel:
+                if target.tunnel is not None:
+                    logger.info(f"SSH tunnel check passed for target '{target.name}' through {target.tunnel.jump_host}")
+                subject = target.backup_adapter.check_tls()
+        except TunnelError as e:
+            logger.error(f"SSH tunnel check failed for target '{target.name}': {e}")
+            passed = False
+            continue
+        except BackupError as e:
+            logger.error(f"TLS check failed for target '{target.name}': {e}")
+            passed = False
+            continue
+        if subject is not None:
+            logger.info(f"TLS check passed for target '{target.name}', server certificate: {subject}")
+
+    return passed
+
+
+def run_reconcile(targets: list[BackupTarget], logger) -> int:
+    """Copy failed-over backups of every target back to its primary storage.
+
+    Args:
+        targets: Backup targets to reconcile
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    failed = False
+
+    for target in targets:
+        for backup_adapter in target.backup_adapter.expand():
+            for fallback in target.failover:
+                try:
+                    copied = reconcile_failover(
+                        backup_adapter.database_name,
+                        target.storage_adapter,
+                        fallback,
+                        listing_prefix(target.key_template, backup_adapter),
+                    )
+                    logger.info(
+                        f"Target '{target.name}': reconciled {copied} objects of "
+                        f"'{backup_adapter.database_name}' from {fallback.name}"
+                    )
+                except StorageError as e:
+                    logger.error(f"Target '{target.name}': reconciling {fallback.name} failed: {e}")
+                    failed = True
+
+    return 1 if failed else 0
+
+
+def run_resume(targets: list[BackupTarget], logger) -> int:
+    """Finish the uploads an interrupted run left behind on every target's storage.
+
+    Args:
+        targets: Backup targets to resume
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    failed = False
+
+    for target in targets:
+        try:
+            resumed = resume_uploads(target.storage_adapter, target.upload_max_age)
+            logger.info(f"Target '{target.name}': resumed {resumed} interrupted uploads")
+        except StorageError as e:
+            logger.error(f"Target '{target.name}': resuming interrupted uploads failed: {e}")
+            failed = True
+
+    return 1 if failed else 0
+
+
+def describe_decision(decision: Decision, database_name: str | None = None) -> dict[str, str | int | None]:
+    """Return what retention decided for an object, as printed by prune --json."""
+    return {
+        "key": decision.key,
+        "database": database_name,
+        "size": decision.size,
+        "decision": "delete" if decision.delete else "keep",
+        "reason": decision.reason,
+        "held": decision.held,
+    }
+
+
+def print_json(data: dict) -> None:
+    """Print a document to stdout, stamped with when it was made."""
+    print(json.dumps({"generated_at": datetime.now(timezone.utc).isoformat(), **data}, indent=2))
+
+
+def run_prune(targets: list[BackupTarget], logger, dry_run: bool = False, as_json: bool = False) -> int:
+    """Apply retention and abort stale multipart uploads on every target's storage.
+
+    Logs the bytes retention reclaimed from each target's primary storage and
+    the bytes its backups still take up there.
+
+    Args:
+        targets: Backup targets to prune
+        logger: Logger instance
+        dry_run: Only log which backups retention would keep and delete, and why
+        as_json: Print every object retention considered, with its decision and reason, as JSON
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    failed = False
+    results = []
+
+    for target in targets:
+        objects = []
+        retention_failed = False
+        # Each tier of a target with tiers is pruned against its own retention
+        retention = [(tier.name, tier.retention_days) for tier in target.tiers] or [(None, target.retention_days)]
+        deleted_verb = "would delete" if dry_run else "deleted"
+        reclaimed = remaining = 0
+        for backup_adapter in target.backup_adapter.expand():
+            prefix = listing_prefix(target.key_template, backup_adapter)
+            try:
+                reports = []
+                for tier, retention_days in retention:
+                    report = prune_backups(
+                        target.storage_adapter,
+                        retention_days,
+                        prefix=prefix,
+                        database_name=backup_adapter.database_name,
+                        owns=backup_adapter.is_own_backup,
+                        on_expire=backup_adapter.delete_backup_data,
+                        tier=tier,
+                        policy=target.gfs,
+                        dry_run=dry_run,
+                    )
+                    reports.append(report)
+                    logger.info(
+                        f"Target '{target.name}': {deleted_verb} {report.deleted} old "
+                        f"{f'{tier} ' if tier else ''}backups of '{backup_adapter.database_name}'"
+                    )
+
+                # Without limits, each tier's report covers its own backups; the limits cover all that retention left
+                if target.limits is None:
+                    remaining += sum(report.remaining_bytes for report in reports)
+                else:
+                    limited = limit_backups(
+                        target.storage_adapter,
+                        target.limits,
+                        prefix=prefix,
+                        database_name=backup_adapter.database_name,
+                        owns=backup_adapter.is_own_backup,
+                        on_expire=backup_adapter.delete_backup_data,
+                        dry_run=dry_run,
+                        pruned={decision.key for report in reports for decision in report.decisions if decision.delete},
+                    )
+                    reports.append(limited)
+                    remaining += limited.remaining_bytes
+                    logger.info(
+                        f"Target '{target.name}': {deleted_verb} {limited.deleted} backups of "
+                        f"'{backup_adapter.database_name}' past the retention limits"
+                    )
+                reclaimed += sum(report.reclaimed_bytes for report in reports)
+                held = PruneReport.combined(reports).held
+                if held:
+                    logger.info(
+                        f"Target '{target.name}': kept {len(held)} held backups of "
+                        f"'{backup_adapter.database_name}': {', '.join(held)}"
+                    )
+                objects.extend(
+                    describe_decision(decision, backup_adapter.database_name)
+                    for decision in PruneReport.combined(reports).decisions
+                )
+            except RetentionError as e:
+                logger.error(f"Target '{target.name}': retention cleanup failed: {e}")
+                failed = retention_failed = True
+                continue
+
+            if dry_run:
+                continue
+
+            if backup_adapter.archives_wal:
+                try:
+                    deleted = prune_wal(target.storage_adapter, backup_adapter.database_name, prefix)
+                    logger.info(f"Target '{target.name}': deleted {deleted} WAL files no base backup needs")
+                except StorageError as e:
+                    logger.error(f"Target '{target.name}': WAL cleanup failed: {e}")
+                    failed = True
+
+        logger.info(
+            f"Target '{target.name}': {'would reclaim' if dry_run else 'reclaimed'} {reclaimed} bytes, "
+            f"{remaining} bytes of backups remain"
+        )
+        results.append(
+            {
+                "target": target.name,
+                "failed": retention_failed,
+                "reclaimed_bytes": reclaimed,
+                "remaining_bytes": remaining,
+                "objects": objects,
+            }
+        )
+
+        if dry_run:
+            logger.info(f"Target '{target.name}': dry run, leaving WAL, chunks and multipart uploads as they are")
+            continue
+
+        if target.backup_adapter.deduplicates:
+            try:
+                deleted = collect_chunks(target.storage_adapter)
+                logger.info(f"Target '{target.name}': deleted {deleted} chunks no retained backup refers to")
+            except StorageError as e:
+                logger.error(f"Target '{target.name}': chunk cleanup failed: {e}")
+                failed = True
+
+        try:
+            aborted = target.storage_adapter.abort_stale_uploads("", target.upload_max_age)
+            for key in aborted:
+                logger.info(f"Target '{target.name}': aborted stale multipart upload of {key}")
+            logger.info(f"Target '{target.name}': aborted {len(aborted)} stale multipart uploads")
+        except StorageError as e:
+            logger.error(f"Target '{target.name}': aborting stale multipart uploads failed: {e}")
+            failed = True
+
+    if as_json:
+        print_json({"dry_run": dry_run, "targets": results})
+    return 1 if failed else 0
+
+
+def run_orphans(targets: list[BackupTarget], configured: list[BackupTarget], logger, as_json: bool = False) -> int:
+    """List the objects on each target's storage that belong to no backup of a configured database.
+
+    Objects of targets since removed from the configuration, or left by
+    failed runs, show up here; nothing is deleted.
+
+    Args:
+        targets: Backup targets whose storage to list
+        configured: Every configured target, whose backups do not count as orphans on a storage they share
+        logger: Logger instance
+        as_json: Print the orphans, with why each is one, as JSON
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    owners = [
+        (listing_prefix(target.key_template, adapter), adapter.database_name, adapter.is_own_backup)
+        for target in configured
+        for adapter in target.backup_adapter.expand()
+    ]
+    failed = False
+    results = []
+
+    for target in targets:
+        try:
+            orphans = find_orphans(target.storage_adapter, owners)
+        except RetentionError as e:
+            logger.error(f"Target '{target.name}': listing orphaned objects failed: {e}")
+            failed = True
+            results.append({"target": target.name, "failed": True, "objects": []})
+            continue
+        size = sum(orphan.size for orphan in orphans)
+        logger.info(f"Target '{target.name}': {len(orphans)} orphaned objects take up {size} bytes")
+        results.append(
+            {"target": target.name, "failed": False, "objects": [describe_decision(orphan) for orphan in orphans]}
+        )
+
+    if as_json:
+        print_json({"orphans": True, "targets": results})
+    return 1 if failed else 0
+
+
+def run_verify(args, config: Config, logger) -> int:
+    """Verify stored backups against their recorded checksums.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 if no backup is corrupt, 1 otherwise)
+    """
+    target_configs = [select_target(config, args.target)] if args.target or args.backup else config.targets
+    results = []
+    failed = False
+
+    for target_config in target_configs:
+        target = create_backup_target(config, target_config)
+
+        if args.backup:
+            keys = [args.backup]
+        else:
+            adapters = target.backup_adapter.expand()
+            if args.database:
+                adapters = [target.backup_adapter.for_database(args.database)]
+            keys = [
+                key
+                for backup_adapter in adapters
+                for key in list_available_backups(
+                    target.storage_adapter,
+                    backup_adapter.database_name,
+                    listing_prefix(target.key_template, backup_adapter),
+                )
+                if backup_adapter.is_own_backup(key)
+            ]
+
+        for key in keys:
+            try:
+                result = verify_backup(target.storage_adapter, key, quick=args.quick)
+            except StorageError as e:
+                logger.error(f"Target '{target.name}': failed to verify {key}: {e}")
+                failed = True
+                continue
+            log_result(result)
+            results.append(result)
+
+    counts = Counter(result.status for result in results)
+    logger.info(
+        f"Checked {len(results)} backups: {counts['verified']} verified, "
+        f"{counts['unverifiable']} unverifiable, {counts['corrupt']} corrupt"
+    )
+
+    return 1 if failed or counts["corrupt"] else 0
+
+
+def verify_restore(
+    config: Config,
+    target: BackupTarget,
+    target_config: TargetConfig,
+    source: BackupAdapter,
+    backup_name: str,
+    logger,
+) -> bool:
+    """Restore a backup into a scratch database, run the validation queries against it, and tear it down again.
+
+    The outcome is recorded under restores/ like any restore. A failure
+    runs the post-failure hooks with NESTVAULT_EVENT=restore_verification.
+
+    Args:
+        config: Application configuration
+        target: Target the backup is restored from
+        target_config: Settings of that target
+        source: Adapter of the database the backup was taken from
+        backup_name: Key of the backup, or 'latest'
+        logger: Logger instance
+
+    Returns:
+        True if the backup was restored and every query returned true
+    """
+    verify = config.restore_verify
+    prefix = listing_prefix(target.key_template, source)
+    backup = find_backup(target.storage_adapter, source, backup_name, prefix, logger)
+    if backup is None:
+        _notify_verification_failure(target, HookContext(target=target.name, database=source.database_name))
+        return False
+
+    logger.info(f"Verifying that {backup.key} restores")
+    database = scratch_name()
+    started_at = datetime.now(timezone.utc)
+    destination = None
+    checks = []
+    timings = {}
+    succeeded = False
+
+    clock = time.monotonic()
+    try:
+        with scratch_server(verify) as dsn:
+            timings["provision"] = round(time.monotonic() - clock, 1)
+            destination = restore_destination(config, target_config, source, dsn, database)
+            scratch = PostgresBackupAdapter(destination_postgres(config, source, dsn, database))
+            # A fresh container has none of the backup's roles, whereas a shared server keeps its own
+            options = RestoreOptions(
+                create_database=True, with_globals=bool(verify.docker_image and "globals" in backup.metadata)
+            )
+            try:
+                clock = time.monotonic()
+                restored = restore_backup(target.storage_adapter, destination, backup.key, options)
+                timings["restore"] = round(time.monotonic() - clock, 1)
+                if restored:
+                    clock = time.monotonic()
+                    checks = run_checks(scratch, verify.queries)
+                    timings["checks"] = round(time.monotonic() - clock, 1)
+                    succeeded = all(check.passed for check in checks)
+            finally:
+                # A container is removed with its databases
+                if not verify.docker_image:
+                    try:
+                        scratch.drop_database()
+                    except BackupError as e:
+                        logger.warning(f"Failed to drop scratch database {database}, drop it by hand: {e}")
+    except BackupError as e:
+        logger.error(f"Restore verification of {backup.key} failed: {e}")
+
+    record = RestoreRecord.of(backup, destination or source, started_at, datetime.now(timezone.utc), succeeded)
+    if destination is None:
+        record.destination["location"] = f"docker:{verify.docker_image}"
+    record.kind = "verification"
+    record.checks = {check.query: check.passed for check in checks}
+    record.timings = timings
+    write_restore_record(target.storage_adapter, record)
+
+    if succeeded:
+        logger.info(f"Restore verification of {backup.key} passed: {len(checks)} checks")
+    else:
+        logger.error(f"Restore verification of {backup.key} failed")
+        context = HookContext(
+            target=target.name,
+            database=source.database_name,
+            backup_key=backup.key,
+            size=backup.size,
+            labels=format_labels(backup.labels),
+        )
+        _notify_verification_failure(target, context)
+    return succeeded
+
+
+def _notify_verification_failure(target: BackupTarget, context: HookContext) -> None:
+    """Run a target's post-failure hooks for a failed restore verification."""
+    if target.hooks is None:
+        return
+    context.status = "failure"
+    context.event = "restore_verification"
+    run_post_hooks("post_failure", target.hooks.post_failure, context, target.hooks.timeout_seconds)
+
+
+def verify_restores(
+    config: Config, target_name: str | None, database: str | None, backup_name: str, logger
+) -> bool:
+    """Verify that the latest backup of every database of every target restores, or only of the given ones.
+
+    Returns:
+        True if every verification passed
+    """
+    target_configs = [select_target(config, target_name)] if target_name or backup_name != "latest" else config.targets
+    results = []
+
+    for target_config in target_configs:
+        target = create_backup_target(config, target_config)
+        with target_context(target.name):
+            try:
+                if database:
+                    sources = [target.backup_adapter.for_database(database)]
+                elif backup_name != "latest":
+                    sources = [target.backup_adapter]
+                else:
+                    sources = target.backup_adapter.expand()
+            except BackupError as e:
+                logger.error(f"Failed to discover databases: {e}")
+                results.append(False)
+                continue
+
+            for source in sources:
+                results.append(verify_restore(config, target, target_config, source, backup_name, logger))
+
+    logger.info(f"Restore verification: {sum(results)}/{len(results)} passed")
+    return all(results)
+
+
+def run_verify_restore(args, config: Config, logger) -> int:
+    """Restore backups into scratch databases and check them.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 if every verification passed, 1 otherwise)
+    """
+    if not config.restore_verify.configured:
+        raise ConfigError("verify-restore requires RESTORE_VERIFY_DSN or RESTORE_VERIFY_DOCKER_IMAGE")
+    return 0 if verify_restores(config, args.target, args.database, args.backup or "latest", logger) else 1
+
+
+def run_wal_push(args, config: Config, logger) -> int:
+    """Archive one WAL file to a target's storage; PostgreSQL retries the file until this exits 0.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    if config.postgres is None or not config.postgres.wal_archive:
+        raise ConfigError("wal-push requires DATABASE_TYPE=postgres with PG_WAL_ARCHIVE=true")
+
+    target = select_target(config, args.target)
+    cipher = create_cipher(target.encryption) if target.encryption else None
+
+    try:
+        push_wal(wal_storage(config, args.target), Path(args.path), target.compression, cipher)
+    except StorageError as e:
+        logger.error(f"Failed to archive {args.path}: {e}")
+        return 1
+
+    return 0
+
+
+def run_wal_fetch(args, config: Config, logger) -> int:
+    """Fetch one archived WAL file for recovery; a non-zero exit tells PostgreSQL it is not archived.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    destination = Path(args.destination)
+
+    if args.source_dir:
+        downloaded = Path(args.source_dir) / args.name
+        if downloaded.is_file():
+            shutil.copyfile(downloaded, destination)
+            logger.info(f"WAL file {args.name} copied from {args.source_dir}")
+            return 0
+
+    target = select_target(config, args.target)
+    cipher = create_cipher(target.encryption) if target.encryption else None
+
+    try:
+        fetch_wal(wal_storage(config, args.target), args.name, destination, cipher)
+    except (StorageError, BackupError) as e:
+        logger.info(f"WAL file {args.name} not fetched: {e}")
+        return 1
+
+    return 0
+
+
+def wal_storage(config: Config, target_name: str | None) -> StorageAdapter:
+    """Create the primary storage of the target WAL is archived to, without the rest of the target."""
+    target = select_target(config, target_name)
+    storage_adapter = create_storage_adapter(config, target.storage_type, target.access_tier, target.storage_class)
+    if target.storage_prefix:
+        storage_adapter = PrefixedStorageAdapter(storage_adapter, target.storage_prefix)
+    return storage_adapter
+
+
+def describe_backup(manifest: Manifest, hold: Hold | None = None) -> str:
+    """Summarize a backup on one line for listings, with the hold on it if any."""
+    details = [manifest.finished_at.strftime("%Y-%m-%d %H:%M:%S"), f"{manifest.size} bytes"]
+    if manifest.legacy:
+        details.append("no manifest")
     else:
-        raise ConfigError(f"Unknown storage type: {config.storage_type}")
+        details.append(manifest.engine or "unknown engine")
+        if manifest.server_version:
+            details.append(f"server {manifest.server_version}")
+        if manifest.compression:
+            details.append(manifest.compression)
+        if manifest.encryption:
+            details.append(f"encrypted with {manifest.encryption}")
+        if manifest.dump_scope and manifest.dump_scope != "full":
+            details.append(manifest.dump_scope)
+        if manifest.partial:
+            details.append("partial")
+        if manifest.labels:
+            details.append(" ".join(f"{name}={value}" for name, value in sorted(manifest.labels.items())))
+    if hold is not None:
+        details.append(hold.describe())
+    return f"{manifest.key} ({', '.join(details)})"
+
+
+def _ratio(manifest: Manifest) -> float | None:
+    """Return how many times smaller than its data a backup is, when known."""
+    if manifest.uncompressed_size and manifest.size:
+        return manifest.uncompressed_size / manifest.size
+    return None
+
+
+def describe_stats(manifest: Manifest) -> str:
+    """Summarize a backup's duration, compression ratio and phases on one line."""
+    details = [manifest.finished_at.strftime("%Y-%m-%d %H:%M:%S"), f"{manifest.size} bytes"]
+    if manifest.duration is not None:
+        details.append(f"took {manifest.duration:.1f}s")
+    if (ratio := _ratio(manifest)) is not None:
+        details.append(f"ratio {ratio:.2f}")
+    phases = manifest.stats.summary()
+    return f"{manifest.key} ({', '.join(details)})" + (f": {phases}" if phases else "")
+
+
+def describe_trend(manifests: list[Manifest]) -> str:
+    """Compare the newest of some backups with the average of the others."""
+    latest, previous = manifests[0], manifests[1:]
+    durations = [manifest.duration for manifest in previous if manifest.duration is not None]
+    ratios = [ratio for manifest in previous if (ratio := _ratio(manifest)) is not None]
+    if latest.duration is None or not durations:
+        return "Not enough backups with recorded stats to show a trend"
+
+    average = sum(durations) / len(durations)
+    change = (latest.duration - average) / average * 100 if average else 0.0
+    trend = (
+        f"Latest took {latest.duration:.1f}s, {abs(change):.0f}% {'slower' if change >= 0 else 'faster'} "
+        f"than the average of the previous {len(durations)} ({average:.1f}s)"
+    )
+    if (ratio := _ratio(latest)) is not None and ratios:
+        trend += f"; ratio {ratio:.2f} against {sum(ratios) / len(ratios):.2f}"
+    return trend
+
+
+def run_list(args, config: Config, logger) -> int:
+    """List stored backups from the catalog, filtered, sorted and paged as asked.
+
+    With --stats, the newest --last backups of each database matching
+    the filters are listed instead, with their phases and how the
+    newest compares to the others.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    if args.output not in OUTPUTS:
+        raise ConfigError(f"Invalid --output: '{args.output}'. Use one of {', '.join(OUTPUTS)}")
+    try:
+        query = BackupQuery(
+            since=parse_time(args.since, "--since") if args.since else None,
+            until=parse_time(args.until, "--until") if args.until else None,
+            status=args.status,
+            labels=dict(parse_label(label, "--label") for label in args.labels),
+            sort=args.sort,
+            order=args.order,
+            limit=args.limit,
+            offset=args.offset,
+        )
+    except ValueError as e:
+        raise ConfigError(str(e))
+
+    target_configs = [select_target(config, args.target)] if args.target else config.targets
+    targets = [create_backup_target(config, target_config) for target_config in target_configs]
+    entries = read_catalog(targets, args.database)
+
+    if args.stats:
+        by_database: dict[tuple[str, str], list[Manifest]] = {}
+        for entry in replace(query, sort="finished_at", order="desc", limit=None, offset=0).select(entries):
+            by_database.setdefault((entry.target, entry.manifest.database), []).append(entry.manifest)
+        for (name, database), backups in by_database.items():
+            backups = backups[: args.last]
+            logger.info(f"Target '{name}': {len(backups)} backups of {database}")
+            for backup in backups:
+                print(f"  - {describe_stats(backup)}")
+            print(f"  {describe_trend(backups)}")
+        if not by_database:
+            logger.info("No backups found")
+        return 0
+
+    page = query.page(entries)
+    if not page.total and args.output == "table":
+        logger.info("No backups found")
+        return 0
+    print(render(page, args.output))
+    return 0
+
+
+def run_audit(args, config: Config, logger) -> int:
+    """Print the audit trail from AUDIT_LOG_FILE and, with AUDIT_STORAGE, every target's storage, filtered as asked.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    if not config.audit.enabled:
+        raise ConfigError("audit reads the trail AUDIT_LOG_FILE or AUDIT_STORAGE keeps, and neither is set")
+    if args.output not in TRAIL_OUTPUTS:
+        raise ConfigError(f"Invalid --output: '{args.output}'. Use one of {', '.join(TRAIL_OUTPUTS)}")
+    if args.operation is not None and args.operation not in OPERATIONS:
+        raise ConfigError(f"Invalid --operation: '{args.operation}'. Use one of {', '.join(OPERATIONS)}")
+    try:
+        since = parse_time(args.since, "--since") if args.since else None
+        until = parse_time(args.until, "--until") if args.until else None
+    except ValueError as e:
+        raise ConfigError(str(e))
+
+    storages = []
+    if config.audit.storage:
+        target_configs = [select_target(config, args.target)] if args.target else config.targets
+        storages = [
+            (target_config.name, create_backup_target(config, target_config).storage_adapter)
+            for target_config in target_configs
+        ]
+    path = Path(config.audit.log_file) if config.audit.log_file else None
+    try:
+        events = read_trail(path, storages, since, until)
+    except StorageError as e:
+        logger.error(f"Failed to read the audit trail: {e}")
+        return 1
+
+    events = [
+        event
+        for event in events
+        if args.operation in (None, event.operation)
+        and args.target in (None, event.target)
+        and args.backup in (None, event.backup)
+        and args.by in (None, event.user)
+    ]
+    if not events and args.output == "table":
+        logger.info("No audit entries found")
+        return 0
+    print(render_trail(events, args.output))
+    return 0
+
+
+def run_hold(args, config: Config, logger) -> int:
+    """Hold a backup, or release it with release, on the target's storage and every replica holding a copy.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    target = create_backup_target(config, select_target(config, args.target))
+    locations = [("primary", target.storage_adapter)]
+    locations.extend((replica.name, replica.storage_adapter) for replica in target.replicas)
+    legal_hold = getattr(args, "legal_hold", False)
+    found = False
+    failed = False
+
+    for name, storage_adapter in locations:
+        started = None
+        try:
+            if not any(obj.key == args.backup for obj in storage_adapter.list(prefix=args.backup)):
+                continue
+            found = True
+            reason = getattr(args, "reason", "")
+            started = record_start(storage_adapter, args.command, args.backup, target=target.name, reason=reason)
+            if args.command == "release":
+                if release_hold(storage_adapter, args.backup) is None:
+                    logger.info(f"Target '{target.name}': {args.backup} is not held on {name} storage")
+                    record_outcome(storage_adapter, started, True, f"not held on {name} storage")
+                    continue
+            else:
+                if legal_hold and not storage_adapter.supports_legal_hold:
+                    logger.warning(
+                        f"Target '{target.name}': {name} storage has no legal holds, only holding the backup"
+                    )
+                place_hold(
+                    storage_adapter, args.backup, args.reason, legal_hold and storage_adapter.supports_legal_hold
+                )
+        except StorageError as e:
+            logger.error(f"Target '{target.name}': failed to {args.command} {args.backup} on {name} storage: {e}")
+            if started is not None:
+                record_outcome(storage_adapter, started, False, str(e))
+            failed = True
+            continue
+        record_outcome(storage_adapter, started, True)
+
+    if not found and not failed:
+        logger.error(f"Backup not found: {args.backup}")
+        return 1
+    return 1 if failed else 0
+
+
+def find_backup(
+    storage_adapter: StorageAdapter, backup_adapter: BackupAdapter, name: str, prefix: str, logger
+) -> Manifest | None:
+    """Look up the backup to restore, logging why when there is none.
+
+    Args:
+        storage_adapter: Storage adapter holding the backups
+        backup_adapter: Database backup adapter to restore with
+        name: Key of the backup, or 'latest' for the newest of the adapter's database
+        prefix: Key prefix the database's backups are listed under
+        logger: Logger instance
+
+    Returns:
+        The backup's manifest, derived from its listing without one; None if it does not exist
+    """
+    if name == "latest":
+        backups = [
+            backup
+            for backup in list_backups(storage_adapter, backup_adapter.database_name, prefix)
+            if backup_adapter.is_own_backup(backup.key)
+        ]
+        if not backups:
+            logger.error(f"No backups found for database: {backup_adapter.database_name}")
+            return None
+        logger.info(f"Found {len(backups)} backups, using the latest: {backups[0].key}")
+        return backups[0]
+
+    try:
+        return read_manifest(storage_adapter, name)
+    except StorageError:
+        pass
+
+    listed = next((obj for obj in storage_adapter.list(prefix=name) if obj.key == name), None)
+    if listed is None:
+        logger.error(f"Backup not found: {name}")
+        return None
+    return Manifest.from_object(listed, backup_adapter.database_name)
+
+
+def restore_destination(
+    config: Config,
+    target_config: TargetConfig,
+    source: BackupAdapter,
+    dsn: str | None,
+    database: str | None,
+) -> BackupAdapter:
+    """Create the adapter to restore with when --to-dsn or --to-database points away from the backup's source.
+
+    The destination is the source database on the configured server,
+    with the server and database of --to-dsn and then --to-database
+    applied over it.
+
+    Args:
+        config: Application configuration
+        target_config: Target the backup is restored from
+        source: Adapter of the database the backup was taken from
+        dsn: PostgreSQL connection URL from --to-dsn
+        database: Database name from --to-database
+    """
+    postgres = destination_postgres(config, source, dsn, database)
+
+    # The target's own database selects backups, it must not override the destination
+    destination_config = replace(target_config, database=None)
+    return create_backup_target(replace(config, postgres=postgres), destination_config).backup_adapter
+
+
+def destination_postgres(
+    config: Config, source: BackupAdapter, dsn: str | None, database: str | None
+) -> PostgresConfig:
+    """Return the PostgreSQL configuration of a restore destination, see restore_destination."""
+    postgres = replace(config.postgres, database=source.database_name, all_databases=False, database_patterns=[])
+    if dsn:
+        postgres = apply_dsn(postgres, dsn)
+    if database:
+        postgres = replace(postgres, database=database)
+    return postgres
+
+
+def describe_restore(manifest: Manifest, backup_adapter: BackupAdapter, tables: list[str] | None = None) -> str:
+    """Summarize what a restore is about to apply, and to which database."""
+    source = manifest.database or "unknown database"
+    if manifest.engine:
+        source += f" ({manifest.engine}" + (f" {manifest.server_version})" if manifest.server_version else ")")
+    lines = [
+        f"Backup:   {manifest.key}",
+        f"Taken:    {manifest.finished_at.strftime('%Y-%m-%d %H:%M:%S %Z').strip()}",
+        f"Size:     {manifest.size} bytes",
+        f"Source:   {source}",
+        f"Into:     {backup_adapter.location}",
+    ]
+    if tables:
+        lines.append(f"Tables:   {', '.join(tables)}")
+    if manifest.legacy:
+        lines.append("The backup has no manifest, so where it was taken from is a guess from its name")
+    return "\n".join(lines)
+
+
+def print_restore_plan(plan: RestorePlan, logger) -> int:
+    """Print what a restore would do, and log why it would fail.
+
+    Returns:
+        Exit code (0 if the restore is possible, 1 otherwise)
+    """
+    size = f"{plan.download_size} bytes" if plan.download_size is not None else "unknown size"
+    how = "downloaded to TEMP_DIR first" if plan.downloaded else "streamed into the database"
+    print(f"Download: {size}, {how}")
+    if plan.destination is not None:
+        print(f"Database: {plan.destination.describe()}")
+    if plan.commands:
+        print("Commands:")
+        for command in plan.commands:
+            print(f"  {command}")
+
+    for problem in plan.problems:
+        logger.error(problem)
+    if not plan.possible:
+        logger.error("The restore is not possible as planned")
+        return 1
+    logger.info("Dry run, nothing was restored")
+    return 0
+
+
+def download_retry_policy(config: Config) -> RetryPolicy:
+    """Return how failed downloads of backups are retried, as DOWNLOAD_RETRIES configures it."""
+    return RetryPolicy(config.download_retries, config.download_retry_max_delay)
+
+
+def confirm(question: str, assume_yes: bool) -> bool:
+    """Ask on the terminal whether to go ahead, unless --yes was passed.
+
+    Raises:
+        ConfigError: If there is no terminal to ask on
+    """
+    if assume_yes:
+        return True
+    if not sys.stdin.isatty():
+        raise ConfigError("restore overwrites data and asks for confirmation, pass --yes to run it without a terminal")
+    return input(f"{question} [y/N] ").strip().lower() in ("y", "yes")
+
+
+def run_fetch(args, config: Config, logger) -> int:
+    """Download a backup to a file or stdout without restoring it.
+
+    Args:
+        args: Parsed command line arguments
+        config: Application configuration
+        logger: Logger instance
+
+    Returns:
+        Exit code (0 for success, 1 for failure)
+    """
+    if args.output == "-" and sys.stdout.isatty():
+        raise ConfigError("fetch --output - writes the backup to stdout, redirect it into a file or a pipe")
+
+    target_config = select_target(config, args.target)
+    if args.decrypt and target_config.encryption is None:
+        raise ConfigError("fetch --decrypt requires ENCRYPTION and the decryption key")
+    target = create_backup_target(config, target_config)
+    backup_adapter = target.backup_adapter
+    if args.database:
+        backup_adapter = backup_adapter.for_database(args.database)
+
+    prefix = listing_prefix(target.key_template, backup_adapter)
+    backup = find_backup(target.storage_adapter, backup_adapter, args.backup, prefix, logger)
+    if backup is None:
+        return 1
+
+    cipher = create_cipher(target_config.encryption) if args.decrypt else None
+    destination = "stdout" if args.output == "-" else str(Path(args.output).absolute())
+    started = record_start(
+        target.storage_adapter,
+        "fetch",
+        backup.key,
+        target=target.name,
+        database=backup.database,
+        destination=destination,
+    )
+    try:
+        fetch_backup(
+            target.storage_adapter,
+            backup.key,
+            args.output,
+            cipher,
+            args.decompress,
+            args.force,
+            download_retry_policy(config),
+            args.resume,
+        )
+    except (BackupError, StorageError, IntegrityError) as e:
+        logger.error(f"Failed to fetch {backup.key}: {e}")
+        record_outcome(target.storage_adapter, started, False, str(e))
+        return 1
+    record_outcome(target.storage_adapter, started, True)
+    return 0
 
 
 def run_restore(args, config: Config, logger) -> int:
@@ -74,13 +1623,50 @@ def run_restore(args, config: Config, logger) -> int:
     Returns:
         Exit code (0 for success, 1 for failure)
     """
-    backup_adapter = create_backup_adapter(config)
-    storage_adapter = create_storage_adapter(config)
+    redirected = args.dsn or args.to_database
+    if (redirected or args.create_database) and (config.postgres is None or config.postgres.mode != "logical"):
+        raise ConfigError("restore --to-dsn, --to-database and --create-database require logical PostgreSQL backups")
+    if args.drop_existing and not args.create_database:
+        raise ConfigError("restore --drop-existing requires --create-database")
+    if (redirected or args.create_database) and args.target_time:
+        raise ConfigError("restore --target-time recovers into a data directory, not into another database")
+    listing_contents = args.list and args.backup
+    if (args.tables or listing_contents) and config.postgres is None:
+        raise ConfigError("restore --table, and --list with --backup, require PostgreSQL backups")
+    if args.clean and (config.postgres is None or config.postgres.mode != "logical"):
+        raise ConfigError("restore --clean requires logical PostgreSQL backups")
+    if args.tables and args.target_time:
+        raise ConfigError("restore --target-time recovers the whole cluster, it cannot restore single tables")
+    if args.dry_run and (args.target_time or args.list):
+        raise ConfigError("restore --dry-run plans the restore of one backup, not --target-time or --list")
+    try:
+        table_args(args.tables)
+    except ValueError as e:
+        raise ConfigError(f"Invalid restore --table: {e}")
+
+    target_config = select_target(config, args.target)
+    target = create_backup_target(config, target_config)
+    backup_adapter = target.backup_adapter
+    storage_adapter = target.storage_adapter
+
+    if args.database:
+        backup_adapter = backup_adapter.for_database(args.database)
+    prefix = listing_prefix(target.key_template, backup_adapter)
+
+    if listing_contents:
+        backup = find_backup(storage_adapter, backup_adapter, args.backup, prefix, logger)
+        if backup is None:
+            return 1
+        options = RestoreOptions(list_contents=True)
+        if not restore_backup(storage_adapter, backup_adapter, backup.key, options):
+            return 1
+        print(options.contents, end="")
+        return 0
 
     # List backups only
     if args.list:
         logger.info("Listing available backups...")
-        backups = list_available_backups(storage_adapter, backup_adapter.database_name)
+        backups = list_backups(storage_adapter, backup_adapter.database_name, prefix)
 
         if not backups:
             logger.info(f"No backups found for database: {backup_adapter.database_name}")
@@ -88,17 +1674,130 @@ def run_restore(args, config: Config, logger) -> int:
 
         logger.info(f"Found {len(backups)} backups:")
         for backup in backups:
-            print(f"  - {backup}")
+            print(f"  - {describe_backup(backup)}")
         return 0
 
-    # Restore specific backup
-    if args.backup:
-        logger.info(f"Restoring specific backup: {args.backup}")
-        success = restore_backup(storage_adapter, backup_adapter, args.backup)
-    else:
-        # Restore latest backup
-        logger.info("Restoring latest backup...")
-        success = restore_latest_backup(storage_adapter, backup_adapter)
+    if args.target_time:
+        if config.postgres is None or not config.postgres.wal_archive:
+            raise ConfigError("restore --target-time requires DATABASE_TYPE=postgres with PG_WAL_ARCHIVE=true")
+        try:
+            target_time = datetime.fromisoformat(args.target_time)
+        except ValueError:
+            raise ConfigError(f"Invalid --target-time: {args.target_time}. Use e.g. '2024-06-01 14:32:00'")
+
+        if args.output_dir:
+            data_dir = Path(args.output_dir) / "data"
+            wal_dir = Path(args.output_dir) / "wal"
+        elif config.postgres.restore_data_dir:
+            data_dir = Path(config.postgres.restore_data_dir)
+            wal_dir = data_dir.parent / f"{data_dir.name}_wal"
+        else:
+            raise ConfigError("restore --target-time needs --output-dir or PG_RESTORE_DATA_DIR")
+
+        if not confirm(f"Recover into {data_dir} to {target_time.isoformat(sep=' ')}?", args.yes):
+            logger.info("Restore cancelled")
+            return 1
+
+        cipher = create_cipher(target_config.encryption) if target_config.encryption else None
+        target_name = target.name if len(config.targets) > 1 else None
+        # The base backup is only chosen during recovery, so the entry names the time recovered to
+        started = record_start(
+            storage_adapter,
+            "restore",
+            f"{backup_adapter.database_name} at {target_time.isoformat()}",
+            target=target.name,
+            database=backup_adapter.database_name,
+            destination=str(data_dir.absolute()),
+        )
+        success = restore_to_time(
+            storage_adapter, backup_adapter, target_time, data_dir, wal_dir, cipher, target_name, prefix
+        )
+        record_outcome(storage_adapter, started, success)
+        return 0 if success else 1
+
+    backup = find_backup(storage_adapter, backup_adapter, args.backup or "latest", prefix, logger)
+    if backup is None:
+        return 1
+
+    destination = backup_adapter
+    if redirected:
+        destination = restore_destination(config, target_config, backup_adapter, args.dsn, args.to_database)
+
+    options = RestoreOptions(
+        force=args.force,
+        with_globals=args.with_globals,
+        create_database=args.create_database,
+        drop_existing=args.drop_existing,
+        clean=args.clean,
+        tables=args.tables,
+        ignore_mismatch=args.ignore_engine_mismatch,
+        retry=download_retry_policy(config),
+        resume=args.resume,
+    )
+    print(describe_restore(backup, destination, args.tables))
+    # A --dsn brings its own server and credentials; the tunnel and leased ones reach the configured server only
+    connection = nullcontext() if args.dsn else connected(target, destination)
+    if args.dry_run:
+        with connection:
+            plan = plan_restore(storage_adapter, destination, backup, options)
+        return print_restore_plan(plan, logger)
+
+    what = f"{', '.join(args.tables)} from {backup.key}" if args.tables else backup.key
+    question = f"Restore {what} into {destination.location}?"
+    if args.drop_existing:
+        question = f"Drop {destination.location} and restore {what} into it?"
+    if not confirm(question, args.yes):
+        logger.info("Restore cancelled")
+        return 1
+
+    hooks = config.hooks
+    context = HookContext(
+        target=target.name,
+        database=backup.database,
+        backup_key=backup.key,
+        size=backup.size,
+        labels=format_labels(backup.labels),
+        event="restore",
+        destination=destination.dsn,
+    )
+    try:
+        run_pre_restore_hooks(hooks.pre_restore, context, hooks.timeout_seconds)
+    except HookError as e:
+        logger.error(f"Restore aborted: {e}")
+        context.status = "aborted"
+        run_post_hooks("post_restore_failure", hooks.post_restore_failure, context, hooks.timeout_seconds)
+        return 1
+
+    started = record_start(
+        storage_adapter,
+        "restore",
+        backup.key,
+        target=target.name,
+        database=backup.database,
+        destination=strip_credentials(destination.dsn),
+    )
+    started_at = datetime.now(timezone.utc)
+    try:
+        with connection:
+            success = restore_backup(storage_adapter, destination, backup.key, options)
+    except TunnelError as e:
+        logger.error(f"SSH tunnel failed: {e}")
+        success = False
+    except CredentialError as e:
+        logger.error(f"Credential acquisition failed: {e}")
+        success = False
+    record = RestoreRecord.of(backup, destination, started_at, datetime.now(timezone.utc), success, args.tables)
+    write_restore_record(storage_adapter, record)
+    record_outcome(storage_adapter, started, success)
+
+    context.status = "success" if success else "failure"
+    stage, commands = ("post_restore", hooks.post_restore)
+    if not success:
+        stage, commands = ("post_restore_failure", hooks.post_restore_failure)
+    # Like after backups, a failing post hook is reported but does not change the result of the restore
+    failures = run_post_hooks(stage, commands, context, hooks.timeout_seconds)
+    if failures:
+        logger.warning(f"Restore finished, but {len(failures)} {stage} hooks failed")
 
     return 0 if success else 1
 
@@ -106,53 +1805,245 @@ def run_restore(args, config: Config, logger) -> int:
 def main() -> int:
     """Main entry point for NestVault.
 
+    With --summary-json, a summary of the run is written however it ends.
+
     Returns:
-        Exit code (0 for success, 1 for failure)
+        Exit code: 0 for success, 1 for failure, 2 for an invalid configuration
+        or command line, 3 when only some targets of a backup were backed up
     """
     args = parse_args()
+    summary = RunSummary(args.command or "backup")
+    code = run_command(args, summary)
+    if getattr(args, "summary_json", None) is not None:
+        write_summary(args.summary_json, summary.to_dict(code))
+    return code
+
+
+def run_command(args, summary: RunSummary) -> int:
+    """Run the command of the parsed arguments, recording the targets it backed up and why it failed in summary.
+
+    Args:
+        args: Parsed command line arguments
+        summary: Summary of the run
+
+    Returns:
+        Exit code, see main
+    """
+    # A backup fetched to stdout, or JSON printed there, must not be mixed with log lines
+    data_on_stdout = (
+        (args.command == "fetch" and args.output == "-")
+        or getattr(args, "json", False)
+        or getattr(args, "summary_json", None) == "-"
+    )
+    log_stream = sys.stderr if data_on_stdout else None
 
     try:
         config = load_config()
-        setup_logging(config.log_level)
+        register_secrets(secret_values(config))
+        setup_logging(config.log_level, log_stream, config.log_format)
+        setup_tracing()
+        track_streaks(Path(config.notify_state_file))
+        use_audit_trail(
+            AuditTrail(
+                Path(config.audit.log_file) if config.audit.log_file else None,
+                config.audit.storage,
+                config.audit.strict,
+                getattr(args, "user", None) or config.audit.user,
+            )
+        )
 
         logger = get_logger("main")
         logger.info("NestVault starting")
         logger.info(f"Database type: {config.database_type}")
         logger.info(f"Storage type: {config.storage_type}")
+        if len(config.targets) > 1:
+            logger.info(f"Targets: {', '.join(target.name for target in config.targets)}")
+
+        temp_dir = use_temp_dir(config.temp_dir)
+
+        if args.command == "wal-push":
+            return run_wal_push(args, config, logger)
+
+        if args.command == "wal-fetch":
+            return run_wal_fetch(args, config, logger)
 
         # Handle restore command
         if args.command == "restore":
             return run_restore(args, config, logger)
 
+        if args.command == "verify":
+            return run_verify(args, config, logger)
+
+        if args.command == "fetch":
+            return run_fetch(args, config, logger)
+
+        if args.command == "verify-restore":
+            return run_verify_restore(args, config, logger)
+
+        if args.command == "list":
+            return run_list(args, config, logger)
+
+        if args.command == "audit":
+            return run_audit(args, config, logger)
+
+        if args.command in ("hold", "release"):
+            return run_hold(args, config, logger)
+
+        labels = dict(parse_label(label, "--label") for label in getattr(args, "labels", []))
+        if labels and not args.once:
+            raise ConfigError("--label is only supported with backup --once")
+        tier = getattr(args, "tier", None)
+        if tier is not None and not args.once:
+            raise ConfigError("--tier is only supported with backup --once")
+        ignore_window = getattr(args, "ignore_window", False)
+        wait_for_window = getattr(args, "wait_for_window", False)
+        if (ignore_window or wait_for_window) and not args.once:
+            raise ConfigError("--ignore-window and --wait-for-window are only supported with backup --once")
+        if ignore_window and wait_for_window:
+            raise ConfigError("--ignore-window and --wait-for-window cannot be combined")
+        if getattr(args, "summary_json", None) is not None and not args.once:
+            raise ConfigError("--summary-json is only supported with backup --once")
+
+        if getattr(args, "skip_preflight", False) and config.preflight.enabled:
+            logger.warning("Skipping the temp directory preflight check (--skip-preflight)")
+            config.preflight.enabled = False
+
+        if args.command in (None, "backup", "prune"):
+            keep = [config.s3.upload_state_dir] if config.s3 is not None else []
+            removed = sweep_orphans(temp_dir, config.temp_max_age_hours, keep)
+            if removed:
+                logger.info(f"Removed {len(removed)} orphaned temp files and directories from {temp_dir}")
+
+        targets = [create_backup_target(config, target, labels) for target in config.targets]
+
+        if args.command == "doctor":
+            passed = check_storage(targets, logger)
+            passed = check_database_tls(targets, logger) and passed
+            return 0 if passed else 1
+
+        if args.command == "reconcile":
+            return run_reconcile(targets, logger)
+
+        if args.command == "prune":
+            selected = targets
+            if args.target is not None:
+                name = select_target(config, args.target).name
+                selected = [target for target in targets if target.name == name]
+            if args.orphans:
+                return run_orphans(selected, targets, logger, args.json)
+            return run_prune(selected, logger, args.dry_run, args.json)
+
+        if args.command == "backup" and args.resume:
+            return run_resume(targets, logger)
+
+        if config.check_storage_on_startup and not check_storage(targets, logger):
+            summary.error = "Storage check on startup failed"
+            return EXIT_FAILURE
+
+        if args.command == "backup" and args.once:
+            runs = manual_runs(targets, tier)
+            if ignore_window:
+                logger.warning("Backing up regardless of backup windows (--ignore-window)")
+            if args.summary_json is not None:
+                runs = [replace(run, notifiers=[*run.notifiers, summary.collector]) for run in runs]
+            summary.targets = run_once(runs, config.max_concurrent_backups, ignore_window, wait_for_window)
+            return exit_code(summary.targets)
+
         # Default: run backup scheduler
-        backup_adapter = create_backup_adapter(config)
-        storage_adapter = create_storage_adapter(config)
+        schedule = daemon_schedule(config, targets, logger)
+        catalog = Catalog(targets)
+        reload_lock = threading.Lock()
+
+        # Loads the configuration again and schedules it, keeping the current one when the new one is rejected
+        def reload() -> None:
+            nonlocal config, catalog
+            with reload_lock:
+                try:
+                    reloaded, rescheduled = reload_config(config, logger)
+                except Exception as e:
+                    error = f"Reloading the configuration failed, keeping the current one: {e}"
+                    logger.error(error)
+                    notify(create_notifiers(config), config_reload_result("failure", error))
+                    raise
+                config, catalog = reloaded, Catalog(rescheduled.targets)
+                reschedule(rescheduled)
+                notify(create_notifiers(config), config_reload_result("success"))
 
-        run_scheduler(config, backup_adapter, storage_adapter)
+        # SIGHUP reloads the configuration, e.g. after a secret file was rotated; any failure is logged by reload
+        def reload_on_signal(signum: int, frame: object) -> None:
+            def run() -> None:
+                with suppress(Exception):
+                    reload()
+
+            logger.info("Received SIGHUP, reloading the configuration")
+            threading.Thread(target=run, name="reload", daemon=True).start()
+
+        signal.signal(signal.SIGHUP, reload_on_signal)
+
+        # docker stop sends SIGTERM; finish the backups under way instead of dying mid-upload
+        stop = threading.Event()
+
+        def shut_down(signum: int, frame: object) -> None:
+            logger.info(f"Received {signal.Signals(signum).name}, stopping once the backups under way finish")
+            stop.set()
+
+        signal.signal(signal.SIGTERM, shut_down)
+
+        # SIGUSR2 pauses scheduling, e.g. for maintenance with docker kill --signal USR2, and resumes it again
+        def toggle_pause(signum: int, frame: object) -> None:
+            if paused() is None:
+                pause()
+            else:
+                resume()
+
+        signal.signal(signal.SIGUSR2, toggle_pause)
+
+        if config.metrics_address is not None:
+            try:
+                serve_metrics(
+                    *config.metrics_address,
+                    upcoming,
+                    timedelta(seconds=config.healthz_overdue_seconds),
+                    lambda query: catalog.query(query),
+                    reload,
+                )
+            except OSError as e:
+                raise ConfigError(f"Cannot serve metrics on METRICS_ADDRESS: {e}")
+        catch_up = timedelta(seconds=config.catch_up_grace_seconds) if config.catch_up else None
+        run_scheduler(
+            schedule.targets,
+            max_concurrent=schedule.max_concurrent,
+            tasks=schedule.tasks,
+            stop=stop,
+            catch_up=catch_up,
+        )
 
         return 0
 
     except ConfigError as e:
-        setup_logging("ERROR")
+        setup_logging("ERROR", log_stream)
         logger = get_logger("main")
         logger.error(f"Configuration error: {e}")
-        return 1
+        summary.error = f"Configuration error: {e}"
+        return EXIT_USAGE
 
     except NestVaultError as e:
         logger = get_logger("main")
         logger.error(f"NestVault error: {e}")
-        return 1
+        summary.error = str(e)
+        return EXIT_FAILURE
 
     except KeyboardInterrupt:
         logger = get_logger("main")
         logger.info("Shutting down")
-        return 0
+        return EXIT_SUCCESS
 
     except Exception as e:
-        setup_logging("ERROR")
+        setup_logging("ERROR", log_stream)
         logger = get_logger("main")
         logger.error(f"Unexpected error: {e}")
-        return 1
+        summary.error = f"Unexpected error: {e}"
+        return EXIT_FAILURE
 
 
 if __name__ == "__main__":
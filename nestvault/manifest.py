@@ -0,0 +1,395 @@
+"""Per-backup manifests describing what each backup object contains."""
+
+from __future__ import annotations
+
+import json
+import re
+import tempfile
+from dataclasses import asdict, dataclass, field
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault import __version__
+from nestvault.backup.base import COMPANION_EXTENSIONS, BackupAdapter, is_companion
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.naming import ADHOC_TIER, RESERVED_PREFIXES, TIER_LABEL
+from nestvault.stats import BackupStats
+from nestvault.storage.base import StorageAdapter, StorageObject
+
+logger = get_logger("manifest")
+
+# Bumped when fields change meaning, so older readers can tell
+MANIFEST_FORMAT = 1
+
+
+def format_labels(labels: dict[str, str]) -> str:
+    """Return labels as the 'name=value' pairs separated by commas backups record them as."""
+    return ",".join(f"{name}={value}" for name, value in sorted(labels.items()))
+
+
+def parse_labels(text: str) -> dict[str, str]:
+    """Parse labels recorded by format_labels, skipping malformed pairs."""
+    pairs = (item.partition("=") for item in text.split(","))
+    return {name: value for name, separator, value in pairs if separator and name}
+
+
+def manifest_key(backup_key: str) -> str:
+    """Return the key of a backup's manifest, e.g. 'db_20240115_120000.sql.gz.manifest.json'."""
+    return f"{backup_key}.{COMPANION_EXTENSIONS['manifest']}"
+
+
+def unchanged_key(backup_key: str) -> str:
+    """Return the key of the record of skipped runs, e.g. 'db_20240115_120000.sql.gz.unchanged.json'."""
+    return f"{backup_key}.{COMPANION_EXTENSIONS['unchanged']}"
+
+
+def hold_key(backup_key: str) -> str:
+    """Return the key of the hold on a backup, e.g. 'db_20240115_120000.sql.gz.hold.json'."""
+    return f"{backup_key}.{COMPANION_EXTENSIONS['hold']}"
+
+
+@dataclass
+class Manifest:
+    """What a backup contains and how it was made.
+
+    Backups uploaded before manifests existed get one derived from their
+    key and listing, marked legacy, with everything else unknown.
+    """
+
+    key: str
+    database: str
+    finished_at: datetime
+    size: int
+    engine: str | None = None
+    started_at: datetime | None = None
+    server_version: str | None = None
+    # Size before NestVault compressed it, when known
+    uncompressed_size: int | None = None
+    # Size the preflight check expected, and the database size it was based on
+    estimated_size: int | None = None
+    database_size: int | None = None
+    compression: str | None = None
+    compression_level: str | None = None
+    encryption: str | None = None
+    sha256: str | None = None
+    nestvault_version: str | None = None
+    labels: dict[str, str] = field(default_factory=dict)
+    # What a logical dump contains: full, schema-only or data-only
+    dump_scope: str | None = None
+    # Table patterns the dump was limited to or left out, for engines that can select tables
+    include_tables: list[str] = field(default_factory=list)
+    exclude_tables: list[str] = field(default_factory=list)
+    # pg_dump command line the backup was taken with, less its output file and password
+    dump_command: str | None = None
+    # Wall time and bytes of each phase of the backup, see nestvault.stats
+    phases: dict[str, dict[str, float | int | None]] = field(default_factory=dict)
+    # Metadata stored with the backup object
+    metadata: dict[str, str] = field(default_factory=dict)
+    legacy: bool = False
+
+    @property
+    def partial(self) -> bool:
+        """Return whether the backup leaves tables of its database out."""
+        return bool(self.include_tables or self.exclude_tables)
+
+    @property
+    def stats(self) -> BackupStats:
+        """Return the recorded phases of the backup, empty when unknown."""
+        return BackupStats.from_dict(self.phases)
+
+    @property
+    def duration(self) -> float | None:
+        """Return the seconds from the start of the backup to the end of its upload, when known."""
+        if self.started_at is None:
+            return None
+        return (self.finished_at - self.started_at).total_seconds()
+
+    def to_json(self) -> str:
+        data = {"format": MANIFEST_FORMAT, **asdict(self)}
+        data["started_at"] = self.started_at.isoformat() if self.started_at else None
+        data["finished_at"] = self.finished_at.isoformat()
+        del data["legacy"]
+        return json.dumps(data, indent=2, sort_keys=True)
+
+    @classmethod
+    def from_json(cls, text: str) -> Manifest:
+        """Parse a manifest, ignoring fields added by newer versions.
+
+        Raises:
+            ValueError: If the manifest is malformed
+        """
+        data = json.loads(text)
+        if not isinstance(data, dict):
+            raise ValueError("manifest is not a JSON object")
+
+        known = {name: data[name] for name in cls.__dataclass_fields__ if name in data and name != "legacy"}
+        try:
+            known["finished_at"] = datetime.fromisoformat(known["finished_at"])
+            if known.get("started_at"):
+                known["started_at"] = datetime.fromisoformat(known["started_at"])
+            return cls(**known)
+        except (KeyError, TypeError) as e:
+            raise ValueError(f"manifest is incomplete: {e}")
+
+    @classmethod
+    def from_object(cls, obj: StorageObject, database: str) -> Manifest:
+        """Describe a backup without a manifest from its key and listing."""
+        finished_at = obj.last_modified
+        if finished_at.tzinfo is None:
+            finished_at = finished_at.replace(tzinfo=timezone.utc)
+        return cls(key=obj.key, database=database, finished_at=finished_at, size=obj.size, legacy=True)
+
+
+def build_manifest(
+    backup_adapter: BackupAdapter,
+    key: str,
+    metadata: dict[str, str],
+    started_at: datetime,
+    finished_at: datetime,
+    stats: BackupStats | None = None,
+) -> Manifest:
+    """Describe a backup that was just uploaded.
+
+    Args:
+        backup_adapter: Database backup adapter that produced the backup
+        key: Key of the uploaded backup
+        metadata: Metadata stored with the backup, including its size and checksum
+        started_at: When the backup started
+        finished_at: When its upload completed
+        stats: Phases recorded while the backup was made
+    """
+    phases = stats.to_dict() if stats is not None else {}
+    uncompressed_size = metadata.get("uncompressed_size") or phases.get("compress", {}).get("bytes_in")
+
+    return Manifest(
+        key=key,
+        database=backup_adapter.database_name,
+        finished_at=finished_at,
+        size=int(metadata["size"]),
+        engine=backup_adapter.engine,
+        started_at=started_at,
+        server_version=backup_adapter.server_version(),
+        compression=metadata.get("compression"),
+        compression_level=metadata.get("compression_level"),
+        encryption=metadata.get("encryption"),
+        sha256=metadata.get("sha256"),
+        uncompressed_size=int(uncompressed_size) if uncompressed_size is not None else None,
+        estimated_size=int(metadata["estimated_size"]) if "estimated_size" in metadata else None,
+        database_size=int(metadata["database_size"]) if "database_size" in metadata else None,
+        nestvault_version=__version__,
+        labels=parse_labels(metadata.get("labels", "")),
+        dump_scope=metadata.get("dump_scope"),
+        include_tables=[pattern for pattern in metadata.get("include_tables", "").split(",") if pattern],
+        exclude_tables=[pattern for pattern in metadata.get("exclude_tables", "").split(",") if pattern],
+        dump_command=metadata.get("dump_command"),
+        phases=phases,
+        metadata=metadata,
+    )
+
+
+def write_manifest(storage_adapter: StorageAdapter, manifest: Manifest, temp_path: Path) -> None:
+    """Upload a backup's manifest next to it.
+
+    Args:
+        storage_adapter: Storage adapter the backup was uploaded to
+        manifest: Manifest to upload
+        temp_path: Directory to write the manifest file to
+
+    Raises:
+        StorageError: If the upload fails
+    """
+    key = manifest_key(manifest.key)
+    local_file = temp_path / Path(key).name
+    local_file.write_text(manifest.to_json())
+
+    try:
+        storage_adapter.upload(local_file, key, metadata={"engine": manifest.engine or "", "companion": "manifest"})
+    finally:
+        local_file.unlink(missing_ok=True)
+
+    logger.info(f"Manifest uploaded: {key}")
+
+
+def write_unchanged_record(
+    storage_adapter: StorageAdapter, manifest: Manifest, skipped_at: datetime, temp_path: Path
+) -> None:
+    """Record next to a backup that a run found its database unchanged since, and skipped the backup.
+
+    The record is replaced by every skipped run, so it tells when the
+    database was last found unchanged, and is deleted with the backup.
+
+    Args:
+        storage_adapter: Storage adapter the backup is on
+        manifest: Manifest of the backup the database is unchanged since
+        skipped_at: When the run was skipped
+        temp_path: Directory to write the record file to
+
+    Raises:
+        StorageError: If the upload fails
+    """
+    key = unchanged_key(manifest.key)
+    local_file = temp_path / Path(key).name
+    record = {
+        "backup": manifest.key,
+        "database": manifest.database,
+        "fingerprint": manifest.metadata.get("fingerprint"),
+        "tier": manifest.labels.get(TIER_LABEL, ADHOC_TIER),
+        "skipped_at": skipped_at.isoformat(),
+    }
+    local_file.write_text(json.dumps(record, indent=2, sort_keys=True))
+
+    try:
+        storage_adapter.upload(local_file, key, metadata={"engine": manifest.engine or "", "companion": "unchanged"})
+    finally:
+        local_file.unlink(missing_ok=True)
+
+    logger.info(f"Unchanged record uploaded: {key}")
+
+
+def read_manifest(storage_adapter: StorageAdapter, backup_key: str) -> Manifest:
+    """Download and parse a backup's manifest.
+
+    Raises:
+        StorageError: If the manifest cannot be downloaded or parsed
+    """
+    key = manifest_key(backup_key)
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / "manifest.json"
+        storage_adapter.download(key, local_file)
+        try:
+            return Manifest.from_json(local_file.read_text())
+        except (OSError, UnicodeDecodeError, ValueError) as e:
+            raise StorageError(f"Manifest {key} is unreadable: {e}")
+
+
+def _database_of(key: str) -> str:
+    """Guess the database of a backup without a manifest from its `<database>_<date>_<time>.` key."""
+    match = re.match(r"(.+)_\d{8}_\d{6}\.", Path(key).name)
+    return match.group(1) if match else ""
+
+
+def _read_listed_manifest(storage_adapter: StorageAdapter, key: str, keys: set[str]) -> Manifest | None:
+    """Read the manifest of a listed backup, or return None if it has none or it cannot be read."""
+    if manifest_key(key) not in keys:
+        return None
+    try:
+        return read_manifest(storage_adapter, key)
+    except StorageError as e:
+        logger.warning(f"Ignoring manifest of {key}: {e}")
+        return None
+
+
+def list_backups(
+    storage_adapter: StorageAdapter,
+    database_name: str | None = None,
+    prefix: str | None = None,
+) -> list[Manifest]:
+    """List backups with their manifests, newest first.
+
+    A backup belongs to the database its manifest records, whatever its
+    key. Backups without a manifest, or whose manifest cannot be read, are
+    described from their `<database>_<date>_<time>.` key and listing instead.
+
+    Args:
+        storage_adapter: Storage adapter to list
+        database_name: Only list backups of exactly this database
+        prefix: Key prefix to list, by default the database name
+
+    Raises:
+        StorageError: If listing fails
+    """
+    objects = storage_adapter.list(prefix=(database_name or "") if prefix is None else prefix)
+    return [
+        manifest
+        for manifest, _ in describe_backups(storage_adapter, objects)
+        if database_name is None or manifest.database == database_name
+    ]
+
+
+def _stem(key: str) -> str | None:
+    """Return the `<database>_<date>_<time>` a default key starts with, shared by a backup and its companions."""
+    match = re.match(r"(.+_\d{8}_\d{6})\.", key)
+    return match.group(1) if match else None
+
+
+def describe_backups(
+    storage_adapter: StorageAdapter, objects: list[StorageObject]
+) -> list[tuple[Manifest, list[StorageObject]]]:
+    """Describe the backups in a listing, newest first, each with the listed objects it consists of.
+
+    A backup consists of its own object, its manifest and the companions
+    the manifest names. A backup without a manifest, or whose manifest
+    cannot be read, is described from its key and listing instead, with
+    the companions sharing its `<database>_<date>_<time>` key.
+
+    Args:
+        storage_adapter: Storage adapter the objects were listed from
+        objects: Listed objects
+    """
+    by_key = {obj.key: obj for obj in objects}
+    keys = set(by_key)
+    backups = []
+
+    for obj in objects:
+        # WAL and deduplicated chunks are kept under reserved prefixes next to the backups
+        if is_companion(obj.key) or obj.key.startswith(RESERVED_PREFIXES):
+            continue
+
+        manifest = _read_listed_manifest(storage_adapter, obj.key, keys)
+        if manifest is None:
+            manifest = Manifest.from_object(obj, _database_of(obj.key))
+            stem = _stem(obj.key)
+            parts = [obj] + [
+                other for other in objects if stem and is_companion(other.key) and _stem(other.key) == stem
+            ]
+        else:
+            companions = [manifest.metadata[kind] for kind in COMPANION_EXTENSIONS if kind in manifest.metadata]
+            own = (obj.key, manifest_key(obj.key), unchanged_key(obj.key), hold_key(obj.key), *companions)
+            parts = [by_key[key] for key in own if key in by_key]
+
+        backups.append((manifest, parts))
+
+    backups.sort(key=lambda backup: backup[0].finished_at, reverse=True)
+    return backups
+
+
+def backup_objects(
+    storage_adapter: StorageAdapter,
+    objects: list[StorageObject],
+    database_name: str,
+    tier: str | None = None,
+) -> list[StorageObject]:
+    """Select the backups of a database from a listing, with their companions and manifests.
+
+    Objects a manifest names belong to the manifest's database; the rest
+    are matched by their `<database>_<date>_<time>.` key.
+
+    Args:
+        storage_adapter: Storage adapter the objects were listed from
+        objects: Listed objects
+        database_name: Database whose objects to select
+        tier: Only select backups of this tier, counting those that record none as ad hoc
+    """
+    keys = {obj.key for obj in objects}
+    databases: dict[str, str] = {}
+    tiers: dict[str, str] = {}
+
+    for obj in objects:
+        if is_companion(obj.key) or obj.key.startswith(RESERVED_PREFIXES):
+            continue
+        manifest = _read_listed_manifest(storage_adapter, obj.key, keys)
+        if manifest is None:
+            continue
+        companions = [manifest.metadata[kind] for kind in COMPANION_EXTENSIONS if kind in manifest.metadata]
+        for key in (obj.key, manifest_key(obj.key), unchanged_key(obj.key), hold_key(obj.key), *companions):
+            databases[key] = manifest.database
+            tiers[key] = manifest.labels.get(TIER_LABEL, ADHOC_TIER)
+
+    return [
+        obj
+        for obj in objects
+        if databases.get(obj.key, _database_of(obj.key)) == database_name
+        and (tier is None or tiers.get(obj.key, ADHOC_TIER) == tier)
+    ]
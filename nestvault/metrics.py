@@ -0,0 +1,352 @@
+"""Prometheus metrics of the backups, and the HTTP server serving /metrics, /status, /healthz and /backups."""
+
+from __future__ import annotations
+
+import json
+import math
+import threading
+from collections.abc import Callable, Mapping, Sequence
+from datetime import timedelta
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, unquote
+
+from nestvault import status
+from nestvault.exceptions import NestVaultError, StorageError
+from nestvault.logging import get_logger
+from nestvault.stats import BackupStats
+
+logger = get_logger("metrics")
+
+CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+# Bucket bounds of the duration histograms, in seconds: from a small dump to a multi-hour one
+DURATION_BUCKETS = (1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 28800)
+
+LabelValues = tuple[str, ...]
+
+
+def _escape(value: str) -> str:
+    return value.replace("\\", "\\\\").replace("\n", "\\n").replace('"', '\\"')
+
+
+def _format_value(value: float) -> str:
+    if math.isinf(value):
+        return "+Inf" if value > 0 else "-Inf"
+    return repr(float(value)) if value != int(value) else str(int(value))
+
+
+class Metric:
+    """A metric family with labels, in the Prometheus text exposition format."""
+
+    kind = "untyped"
+
+    def __init__(self, name: str, documentation: str, labels: Sequence[str] = ()):
+        self.name = name
+        self.documentation = documentation
+        self.labels = tuple(labels)
+        self._lock = threading.Lock()
+
+    def _label_values(self, labels: dict[str, str]) -> LabelValues:
+        if set(labels) != set(self.labels):
+            raise ValueError(f"{self.name} takes labels {', '.join(self.labels) or 'none'}, got: {', '.join(labels)}")
+        return tuple(str(labels[name]) for name in self.labels)
+
+    def _series(self, values: LabelValues, extra: dict[str, str] | None = None) -> str:
+        pairs = list(zip(self.labels, values)) + list((extra or {}).items())
+        if not pairs:
+            return ""
+        return "{" + ",".join(f'{name}="{_escape(value)}"' for name, value in pairs) + "}"
+
+    def samples(self) -> list[str]:
+        raise NotImplementedError
+
+    def render(self) -> str:
+        lines = [f"# HELP {self.name} {self.documentation}", f"# TYPE {self.name} {self.kind}"]
+        return "\n".join(lines + self.samples()) + "\n"
+
+
+class Counter(Metric):
+    """A value that only goes up, e.g. the backups taken."""
+
+    kind = "counter"
+
+    def __init__(self, name: str, documentation: str, labels: Sequence[str] = ()):
+        super().__init__(name, documentation, labels)
+        self._values: dict[LabelValues, float] = {}
+
+    def inc(self, amount: float = 1, **labels: str) -> None:
+        if amount < 0:
+            raise ValueError(f"{self.name} can only increase, got: {amount}")
+        values = self._label_values(labels)
+        with self._lock:
+            self._values[values] = self._values.get(values, 0) + amount
+
+    def value(self, **labels: str) -> float:
+        with self._lock:
+            return self._values.get(self._label_values(labels), 0)
+
+    def samples(self) -> list[str]:
+        with self._lock:
+            values = sorted(self._values.items())
+        return [f"{self.name}{self._series(labels)} {_format_value(value)}" for labels, value in values]
+
+
+class Gauge(Metric):
+    """A value that is set, e.g. the size of the last backup."""
+
+    kind = "gauge"
+
+    def __init__(self, name: str, documentation: str, labels: Sequence[str] = ()):
+        super().__init__(name, documentation, labels)
+        self._values: dict[LabelValues, float] = {}
+
+    def set(self, value: float, **labels: str) -> None:
+        values = self._label_values(labels)
+        with self._lock:
+            self._values[values] = value
+
+    def value(self, **labels: str) -> float | None:
+        with self._lock:
+            return self._values.get(self._label_values(labels))
+
+    def samples(self) -> list[str]:
+        with self._lock:
+            values = sorted(self._values.items())
+        return [f"{self.name}{self._series(labels)} {_format_value(value)}" for labels, value in values]
+
+
+class Histogram(Metric):
+    """Observations counted into cumulative buckets, e.g. backup durations."""
+
+    kind = "histogram"
+
+    def __init__(self, name: str, documentation: str, labels: Sequence[str] = (), buckets: Sequence[float] = ()):
+        super().__init__(name, documentation, labels)
+        self.buckets = tuple(sorted(buckets)) + (math.inf,)
+        # Per series: the count in each bucket, not cumulative, and the sum of the observations
+        self._values: dict[LabelValues, tuple[list[int], float]] = {}
+
+    def observe(self, value: float, **labels: str) -> None:
+        values = self._label_values(labels)
+        with self._lock:
+            counts, total = self._values.get(values, ([0] * len(self.buckets), 0.0))
+            counts[next(i for i, bound in enumerate(self.buckets) if value <= bound)] += 1
+            self._values[values] = (counts, total + value)
+
+    def count(self, **labels: str) -> int:
+        with self._lock:
+            counts, _ = self._values.get(self._label_values(labels), ([0], 0.0))
+            return sum(counts)
+
+    def samples(self) -> list[str]:
+        with self._lock:
+            values = sorted((labels, (list(counts), total)) for labels, (counts, total) in self._values.items())
+        lines = []
+        for labels, (counts, total) in values:
+            cumulative = 0
+            for bound, count in zip(self.buckets, counts):
+                cumulative += count
+                bucket = self._series(labels, {"le": _format_value(bound)})
+                lines.append(f"{self.name}_bucket{bucket} {cumulative}")
+            lines.append(f"{self.name}_sum{self._series(labels)} {_format_value(total)}")
+            lines.append(f"{self.name}_count{self._series(labels)} {cumulative}")
+        return lines
+
+
+BACKUPS = Counter("nestvault_backups_total", "Backup jobs run, by target and status.", ("target", "status"))
+LAST_SUCCESS = Gauge(
+    "nestvault_last_success_timestamp_seconds", "Unix time the last successful backup of a target finished.", ("target",)
+)
+LAST_SIZE = Gauge(
+    "nestvault_last_backup_size_bytes", "Size of the last successful backup of a target, as stored.", ("target",)
+)
+LAST_RAW_SIZE = Gauge(
+    "nestvault_last_backup_raw_size_bytes",
+    "Size of the data of the last successful backup of a target, before compression.",
+    ("target",),
+)
+BACKUP_DURATION = Histogram(
+    "nestvault_backup_duration_seconds", "Duration of backup jobs, by target.", ("target",), DURATION_BUCKETS
+)
+UPLOAD_DURATION = Histogram(
+    "nestvault_upload_duration_seconds", "Duration of backup uploads, by target.", ("target",), DURATION_BUCKETS
+)
+UPLOADED_BYTES = Counter("nestvault_uploaded_bytes_total", "Bytes of backups uploaded, by target.", ("target",))
+DOWNLOADED_BYTES = Counter("nestvault_downloaded_bytes_total", "Bytes of backups downloaded.")
+PRUNED = Counter("nestvault_pruned_objects_total", "Objects deleted by retention.")
+TUNNEL_FAILURES = Counter(
+    "nestvault_ssh_tunnel_failures_total",
+    "Runs that failed to open the SSH tunnel to their database, by target.",
+    ("target",),
+)
+
+REGISTRY: tuple[Metric, ...] = (
+    BACKUPS,
+    LAST_SUCCESS,
+    LAST_SIZE,
+    LAST_RAW_SIZE,
+    BACKUP_DURATION,
+    UPLOAD_DURATION,
+    UPLOADED_BYTES,
+    DOWNLOADED_BYTES,
+    PRUNED,
+    TUNNEL_FAILURES,
+)
+
+
+def render() -> str:
+    """Return every metric in the Prometheus text exposition format."""
+    return "".join(metric.render() for metric in REGISTRY)
+
+
+def record_backup(
+    target: str,
+    succeeded: bool,
+    duration: float,
+    finished_at: float,
+    size: int | None,
+    stats: BackupStats,
+) -> None:
+    """Record a finished backup job of a target.
+
+    Args:
+        target: Name of the target
+        succeeded: Whether the backup reached storage
+        duration: Seconds the job took
+        finished_at: Unix time the job finished
+        size: Size of the backup as stored, when known
+        stats: The phases measured during the job
+    """
+    BACKUPS.inc(target=target, status="success" if succeeded else "failure")
+    BACKUP_DURATION.observe(duration, target=target)
+
+    upload = stats.phases.get("upload")
+    if upload is not None:
+        UPLOAD_DURATION.observe(upload.seconds, target=target)
+        if upload.bytes_out is not None:
+            UPLOADED_BYTES.inc(upload.bytes_out, target=target)
+
+    if not succeeded:
+        return
+    LAST_SUCCESS.set(finished_at, target=target)
+    if size is not None:
+        LAST_SIZE.set(size, target=target)
+    compress = stats.phases.get("compress")
+    if compress is not None and compress.bytes_in is not None:
+        LAST_RAW_SIZE.set(compress.bytes_in, target=target)
+
+
+def record_tunnel_failure(target: str) -> None:
+    """Record a run of a target that failed because its SSH tunnel could not be opened."""
+    TUNNEL_FAILURES.inc(target=target)
+
+
+class _Server(ThreadingHTTPServer):
+    # Schedules of the runs, for the next run of every target, and how late a run may start before /healthz fails
+    upcoming: Callable[[], status.Upcoming]
+    overdue: timedelta
+    # Returns the page of stored backups the parameters of /backups ask for; None serves no /backups
+    backups: Callable[[Mapping[str, list[str]]], dict[str, object]] | None
+    # Reloads the configuration on POST /reload, raising if it is rejected; None serves no /reload
+    reload: Callable[[], None] | None
+
+
+class _Handler(BaseHTTPRequestHandler):
+    server: _Server
+
+    def do_GET(self) -> None:
+        path, _, query = self.path.partition("?")
+        if path == "/metrics":
+            self._send(200, render().encode(), CONTENT_TYPE)
+        elif path == "/status":
+            self._send_json(200, status.snapshot(self.server.upcoming()))
+        elif path.startswith("/status/"):
+            targets = status.snapshot(self.server.upcoming())
+            name = unquote(path.removeprefix("/status/"))
+            if name not in targets:
+                self.send_error(404, f"No target named {name}")
+                return
+            self._send_json(200, targets[name])
+        elif path == "/healthz":
+            problems = status.problems(self.server.upcoming(), self.server.overdue)
+            if problems:
+                self._send_json(503, {"status": "unhealthy", "problems": problems})
+            else:
+                self._send_json(200, {"status": "ok"})
+        elif path == "/backups" and self.server.backups is not None:
+            self._send_backups(query)
+        else:
+            self.send_error(404)
+
+    def do_POST(self) -> None:
+        if self.path == "/reload" and self.server.reload is not None:
+            try:
+                self.server.reload()
+            except NestVaultError as e:
+                self._send_json(422, {"status": "rejected", "error": str(e)})
+                return
+            except Exception as e:
+                self._send_json(500, {"status": "failed", "error": str(e)})
+                return
+            self._send_json(200, {"status": "reloaded"})
+        else:
+            self.send_error(404)
+
+    def _send_backups(self, query: str) -> None:
+        try:
+            page = self.server.backups(parse_qs(query))
+        except ValueError as e:
+            self.send_error(400, str(e))
+            return
+        except StorageError as e:
+            logger.warning(f"Failed to list backups for /backups: {e}")
+            self.send_error(503, "Failed to list the backups")
+            return
+        self._send_json(200, page)
+
+    def _send_json(self, code: int, document: object) -> None:
+        self._send(code, (json.dumps(document, indent=2) + "\n").encode(), "application/json")
+
+    def _send(self, code: int, body: bytes, content_type: str) -> None:
+        self.send_response(code)
+        self.send_header("Content-Type", content_type)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, format: str, *args: object) -> None:
+        logger.debug(f"{self.address_string()} {format % args}")
+
+
+def serve(
+    host: str,
+    port: int,
+    upcoming: Callable[[], status.Upcoming] = dict,
+    overdue: timedelta = timedelta(hours=1),
+    backups: Callable[[Mapping[str, list[str]]], dict[str, object]] | None = None,
+    reload: Callable[[], None] | None = None,
+) -> ThreadingHTTPServer:
+    """Serve /metrics, /status, /healthz, /backups and /reload from a daemon thread, returning the server.
+
+    Args:
+        host: Host to listen on, '' for every interface
+        port: Port to listen on, 0 for any free one
+        upcoming: Returns the schedules of the runs, e.g. scheduler.upcoming
+        overdue: How late a run may start before /healthz reports it
+        backups: Returns a page of stored backups for the parameters of /backups, e.g. Catalog.query
+        reload: Reloads the configuration on POST /reload, raising NestVaultError when it is rejected
+
+    Raises:
+        OSError: If the address cannot be listened on
+    """
+    server = _Server((host, port), _Handler)
+    server.upcoming = upcoming
+    server.overdue = overdue
+    server.backups = backups
+    server.reload = reload
+    server.daemon_threads = True
+    thread = threading.Thread(target=server.serve_forever, name="metrics", daemon=True)
+    thread.start()
+    address = f"http://{host or '0.0.0.0'}:{server.server_address[1]}"
+    logger.info(f"Serving metrics on {address}/metrics, and the status of the targets on {address}/status")
+    return server
@@ -0,0 +1,183 @@
+"""Storage keys of backups, rendered from a key template."""
+
+from __future__ import annotations
+
+import re
+import socket
+from dataclasses import dataclass, field
+from typing import TYPE_CHECKING
+
+if TYPE_CHECKING:
+    from nestvault.backup.base import BackupAdapter
+
+# The key every backup had before templates existed: '<database>_<YYYYmmdd>_<HHMMSS>'
+DEFAULT_KEY_TEMPLATE = "{{.Database}}_{{.Timestamp}}"
+
+# Variables a template can use, besides .Labels.<name>
+KEY_VARIABLES = (
+    "Database", "Engine", "Target", "Hostname", "Scope", "Tier",
+    "Timestamp", "Year", "Month", "Day", "Hour", "Minute", "Second",
+)
+
+# Variables that differ between backups of the same database, so listing cannot narrow on them;
+# the hostname changes whenever a container is recreated
+VARYING_VARIABLES = ("Hostname", "Tier", "Timestamp", "Year", "Month", "Day", "Hour", "Minute", "Second")
+
+# Label the backups of a target with tiers record their tier in
+TIER_LABEL = "tier"
+# Tier of manual backups of a target with tiers, and of its backups that record no tier
+ADHOC_TIER = "adhoc"
+# Label a backup catching up on a scheduled run missed while NestVault was down records that run's due time in
+CATCH_UP_LABEL = "catch_up"
+
+# Key prefixes NestVault keeps other objects under: archived WAL, deduplicated chunks, restore records,
+# the audit trail, records of scheduled runs and locks
+RESERVED_PREFIXES = ("wal/", "chunks/", "restores/", "audit/", "schedules/", "locks/")
+
+# Names adapters give their backup files: '<database>_<YYYYmmdd>_<HHMMSS>.<extension>'
+_FILE_NAME = re.compile(r"(?P<database>.+)_(?P<date>\d{8})_(?P<time>\d{6})\.(?P<extension>.+)")
+
+_ACTION = re.compile(r"\{\{-?\s*(.*?)\s*-?\}\}")
+_FIELD = re.compile(r"\.([A-Za-z]\w*)(?:\.([A-Za-z0-9_-]+))?")
+
+
+def _parse(template: str) -> list[tuple[str, str]]:
+    """Split a template into ('text', text) and ('field', name) parts; label fields are named 'Labels.<name>'.
+
+    Only the subset of Go template syntax keys need is supported: text and
+    {{.Field}} actions, with optional whitespace and trim markers inside
+    the braces.
+
+    Raises:
+        ValueError: If the template is malformed or uses an unknown variable
+    """
+    parts = []
+    position = 0
+
+    for action in _ACTION.finditer(template):
+        text = template[position : action.start()]
+        if "{{" in text or "}}" in text:
+            raise ValueError(f"unbalanced braces in {text!r}")
+        if text:
+            parts.append(("text", text))
+
+        match = _FIELD.fullmatch(action.group(1))
+        if match is None:
+            raise ValueError(f"{action.group(0)} is not a variable; use e.g. {{{{.Database}}}}")
+        name, label = match.groups()
+        if name == "Labels" and label:
+            parts.append(("field", f"Labels.{label}"))
+        elif name in KEY_VARIABLES and not label:
+            parts.append(("field", name))
+        else:
+            raise ValueError(
+                f"unknown variable {action.group(0)}; use one of {', '.join(KEY_VARIABLES)} or .Labels.<name>"
+            )
+        position = action.end()
+
+    text = template[position:]
+    if "{{" in text or "}}" in text:
+        raise ValueError(f"unbalanced braces in {text!r}")
+    if text:
+        parts.append(("text", text))
+    return parts
+
+
+@dataclass
+class KeyTemplate:
+    """Renders the storage keys of one target's backups.
+
+    A backup's key is the rendered template followed by the extension of
+    its file, and its companions and manifest take the same key with their
+    own extension. The default template keeps the names adapters give their
+    files, so those keys are unchanged.
+    """
+
+    template: str = DEFAULT_KEY_TEMPLATE
+    target: str = "default"
+    labels: dict[str, str] = field(default_factory=dict)
+    hostname: str = field(default_factory=socket.gethostname)
+    # Tier the backups are taken in, for targets with tiers
+    tier: str = ADHOC_TIER
+
+    def __post_init__(self):
+        self.parts = _parse(self.template)
+
+    def validate(self) -> None:
+        """Render a sample key and check it is usable.
+
+        Raises:
+            ValueError: If the template cannot render a key for every backup
+        """
+        fields = {name for kind, name in self.parts if kind == "field"}
+        if "Timestamp" not in fields:
+            raise ValueError("it must contain {{.Timestamp}}, or backups would overwrite each other")
+        for name in sorted(fields):
+            if name.startswith("Labels.") and name.removeprefix("Labels.") not in self.labels:
+                raise ValueError(f"label '{name.removeprefix('Labels.')}' is not defined")
+
+        sample = self._render(self.variables("db", "postgres", "full", "20240115", "120000"))
+        segments = sample.split("/")
+        if any(segment in ("", ".", "..") for segment in segments):
+            raise ValueError(f"it renders keys such as '{sample}', with an empty, '.' or '..' path segment")
+        if sample.startswith(RESERVED_PREFIXES):
+            raise ValueError(f"it renders keys under {sample.split('/')[0]}/, which NestVault keeps other objects in")
+        if any(char.isspace() or not char.isprintable() for char in sample):
+            raise ValueError(f"it renders keys such as '{sample}', with whitespace or control characters")
+
+    def variables(self, database: str, engine: str, scope: str, date: str, time: str) -> dict[str, str]:
+        """Return the variables of the backup of a database taken at a date and time."""
+        return {
+            "Database": database,
+            "Engine": engine,
+            "Target": self.target,
+            "Hostname": self.hostname,
+            "Scope": scope,
+            "Tier": self.tier,
+            "Timestamp": f"{date}_{time}",
+            "Year": date[:4],
+            "Month": date[4:6],
+            "Day": date[6:],
+            "Hour": time[:2],
+            "Minute": time[2:4],
+            "Second": time[4:],
+            **{f"Labels.{name}": value for name, value in self.labels.items()},
+        }
+
+    def _render(self, variables: dict[str, str]) -> str:
+        return "".join(value if kind == "text" else str(variables[value]) for kind, value in self.parts)
+
+    def key(self, backup_adapter: BackupAdapter, name: str) -> str:
+        """Return the key to upload a backup file, companion or manifest named by its adapter under.
+
+        Args:
+            backup_adapter: Database backup adapter that produced the file
+            name: File name, e.g. 'db_20240115_120000.sql.gz'
+
+        Returns:
+            The key, e.g. 'prod/db/2024/01/15/120000.sql.gz'; the name itself
+            when it does not carry a timestamp
+        """
+        match = _FILE_NAME.fullmatch(name)
+        if match is None:
+            return name
+
+        scope = backup_adapter.backup_metadata.get("dump_scope", "full")
+        variables = self.variables(match["database"], backup_adapter.engine, scope, match["date"], match["time"])
+        return f"{self._render(variables)}.{match['extension']}"
+
+    def prefix(self, backup_adapter: BackupAdapter) -> str:
+        """Return the key prefix shared by every backup of an adapter's database, for listing them."""
+        scope = backup_adapter.backup_metadata.get("dump_scope", "full")
+        variables = self.variables(backup_adapter.database_name, backup_adapter.engine, scope, "", "")
+        prefix = []
+        for kind, value in self.parts:
+            if kind == "field" and value in VARYING_VARIABLES:
+                break
+            prefix.append(value if kind == "text" else str(variables[value]))
+        return "".join(prefix)
+
+
+def listing_prefix(key_template: KeyTemplate | None, backup_adapter: BackupAdapter) -> str:
+    """Return the key prefix to list an adapter's backups under; without a template, its database name."""
+    return key_template.prefix(backup_adapter) if key_template is not None else backup_adapter.database_name
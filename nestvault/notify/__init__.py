@@ -0,0 +1,32 @@
+"""Notifiers reporting backup results to chat, push notifications, email and incident tools."""
+
+from nestvault.notify.base import LOG_TAIL_LINES, Notifier, RunResult, notify, track_streaks
+from nestvault.notify.discord import DiscordNotifier
+from nestvault.notify.escalation import EscalationNotifier, EscalationState
+from nestvault.notify.ntfy import NtfyNotifier
+from nestvault.notify.opsgenie import OpsgenieNotifier
+from nestvault.notify.pagerduty import PagerDutyNotifier
+from nestvault.notify.slack import SlackNotifier
+from nestvault.notify.smtp import EmailNotifier
+from nestvault.notify.teams import TeamsNotifier
+from nestvault.notify.telegram import TelegramNotifier
+from nestvault.notify.webhook import WebhookNotifier
+
+__all__ = [
+    "DiscordNotifier",
+    "EmailNotifier",
+    "EscalationNotifier",
+    "EscalationState",
+    "LOG_TAIL_LINES",
+    "Notifier",
+    "NtfyNotifier",
+    "OpsgenieNotifier",
+    "PagerDutyNotifier",
+    "RunResult",
+    "SlackNotifier",
+    "TeamsNotifier",
+    "TelegramNotifier",
+    "WebhookNotifier",
+    "notify",
+    "track_streaks",
+]
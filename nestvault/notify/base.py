@@ -0,0 +1,318 @@
+"""Abstract base class for notifiers, and the results they report."""
+
+from __future__ import annotations
+
+import json
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+from abc import ABC, abstractmethod
+from collections.abc import Sequence
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.config import NOTIFY_POLICIES
+from nestvault.exceptions import NotifyError
+from nestvault.logging import get_logger
+from nestvault.notify.streak import StreakState
+from nestvault.tracing import span
+
+logger = get_logger("notify")
+
+# Characters of a run's error shown in notifications
+ERROR_EXCERPT_CHARS = 500
+
+# Lines of a run's log kept for notifiers, the last ones it logged
+LOG_TAIL_LINES = 100
+
+# Colors notifications are coded with, by status
+STATUS_COLORS = {"success": 0x2EB67D, "failure": 0xE01E5A, "aborted": 0xECB22E}
+
+# Times a rate-limited request is sent again, and the longest wait asked for that is honored, in seconds
+RATE_LIMIT_RETRIES = 3
+MAX_RETRY_AFTER = 60.0
+
+# Longest wait between retries of a request that failed with a server error, in seconds
+MAX_BACKOFF = 30.0
+
+MIB = 1024 * 1024
+
+
+@dataclass
+class RunResult:
+    """The result of backing up one database of a target, as notifiers report it."""
+
+    target: str
+    database: str
+    # 'success', 'failure', or 'aborted' when a pre-backup hook failed
+    status: str
+    duration: float | None = None
+    size: int | None = None
+    # Size of the data before compression, and the seconds each phase of the backup took
+    raw_size: int | None = None
+    phase_durations: dict[str, float] = field(default_factory=dict)
+    backup_key: str = ""
+    error: str = ""
+    labels: dict[str, str] = field(default_factory=dict)
+    # The last lines the run logged
+    log: list[str] = field(default_factory=list)
+    finished_at: datetime = field(default_factory=lambda: datetime.now(timezone.utc))
+    # Whether the run succeeded after the previous run of the database failed
+    recovered: bool = False
+    # Failures in a row a failed run continues, or a recovery ended, and when the database last succeeded before
+    consecutive_failures: int = 0
+    last_success: datetime | None = None
+    # What the result is of when not a backup, e.g. 'Configuration reload'
+    subject: str = ""
+
+    @property
+    def succeeded(self) -> bool:
+        return self.status == "success"
+
+    @property
+    def headline(self) -> str:
+        """Return e.g. 'Backup of billing failed'."""
+        outcome = {"success": "recovered" if self.recovered else "succeeded", "failure": "failed"}
+        return f"{self.subject or f'Backup of {self.target}'} {outcome.get(self.status, self.status)}"
+
+    @property
+    def streak(self) -> str:
+        """Describe the failures in a row, e.g. '3rd consecutive failure, last success 2024-06-02 02:11'.
+
+        Empty for a success following a success.
+        """
+        failures = self.consecutive_failures
+        if self.recovered and failures:
+            return f"recovered after {failures} consecutive failures" if failures > 1 else "recovered after 1 failure"
+        if self.succeeded or not failures:
+            return ""
+        last = f"last success {self.last_success:%Y-%m-%d %H:%M}" if self.last_success else "no success recorded"
+        return f"{_ordinal(failures)} consecutive failure, {last}" if failures > 1 else f"first failure, {last}"
+
+    @property
+    def color(self) -> int:
+        return STATUS_COLORS.get(self.status, STATUS_COLORS["failure"])
+
+    def fields(self) -> list[tuple[str, str]]:
+        """Return the details notifications show, as (name, value) pairs."""
+        fields = [
+            ("Target", self.target),
+            ("Database", self.database),
+            ("Status", "recovered" if self.recovered else self.status),
+            ("Duration", format_duration(self.duration)),
+            ("Size", format_size(self.size)),
+        ]
+        if self.streak:
+            fields.append(("Streak", self.streak))
+        if self.backup_key:
+            fields.append(("Backup", self.backup_key))
+        return fields
+
+    def template_data(self) -> dict:
+        """Return the fields templates render the result from, named as in RESULT_VARIABLES."""
+        return {
+            "Target": self.target,
+            "Database": self.database,
+            "Status": self.status,
+            "Succeeded": self.succeeded,
+            "Recovered": self.recovered,
+            "Headline": self.headline,
+            "Error": self.error,
+            "Size": self.size,
+            "RawSize": self.raw_size,
+            "Duration": self.duration,
+            "Phases": dict(self.phase_durations),
+            "BackupKey": self.backup_key,
+            "Labels": dict(self.labels),
+            "FinishedAt": self.finished_at.isoformat(),
+            "ConsecutiveFailures": self.consecutive_failures,
+            "LastSuccess": self.last_success.isoformat() if self.last_success else None,
+            "Streak": self.streak,
+        }
+
+    def error_excerpt(self) -> str:
+        """Return the start of the run's error, cut to ERROR_EXCERPT_CHARS."""
+        error = self.error.strip()
+        if len(error) <= ERROR_EXCERPT_CHARS:
+            return error
+        return error[: ERROR_EXCERPT_CHARS - 1].rstrip() + "…"
+
+
+def _ordinal(number: int) -> str:
+    """Return e.g. '2nd', '3rd', '11th' or '21st'."""
+    suffix = "th" if 10 <= number % 100 <= 20 else {1: "st", 2: "nd", 3: "rd"}.get(number % 10, "th")
+    return f"{number}{suffix}"
+
+
+def format_size(size: int | None) -> str:
+    """Return a size for people, e.g. '310.2 MiB', or '-' when unknown."""
+    if size is None:
+        return "-"
+    if size < MIB:
+        return f"{size / 1024:.1f} KiB"
+    if size < 1024 * MIB:
+        return f"{size / MIB:.1f} MiB"
+    return f"{size / (1024 * MIB):.2f} GiB"
+
+
+def format_duration(seconds: float | None) -> str:
+    """Return a duration for people, e.g. '4m 12s', or '-' when unknown."""
+    if seconds is None:
+        return "-"
+    if seconds < 60:
+        return f"{seconds:.1f}s"
+    minutes, seconds = divmod(round(seconds), 60)
+    if minutes < 60:
+        return f"{minutes}m {seconds}s"
+    hours, minutes = divmod(minutes, 60)
+    return f"{hours}h {minutes}m"
+
+
+def _retry_after(error: urllib.error.HTTPError, body: bytes) -> float | None:
+    """Return the seconds a rate-limited request asks to wait.
+
+    The wait is read from Retry-After, or from the retry_after of a JSON
+    body, at its top as Discord puts it or in parameters as Telegram does.
+    """
+    header = error.headers.get("Retry-After") if error.headers is not None else None
+    try:
+        if header is not None:
+            return float(header)
+        document = json.loads(body)
+        return float(document.get("retry_after", document.get("parameters", {}).get("retry_after")))
+    except (ValueError, AttributeError, TypeError):
+        return None
+
+
+def request(
+    url: str,
+    data: bytes | None,
+    method: str = "POST",
+    headers: dict[str, str] | None = None,
+    timeout: float = 10,
+    retries: int = 0,
+) -> bytes:
+    """Send an HTTP request, returning the response body.
+
+    A request answered with 429 Too Many Requests is sent again once the
+    wait the response asks for is over, up to RATE_LIMIT_RETRIES times.
+    One that fails to connect or is answered with a 5xx status is sent
+    again up to retries times, waiting 1s, 2s, 4s and so on in between.
+
+    Raises:
+        NotifyError: If the request fails or is answered with an error status
+    """
+    prepared = urllib.request.Request(
+        url, data=data, headers={"User-Agent": "nestvault", **(headers or {})}, method=method
+    )
+    host = urllib.parse.urlsplit(url).netloc
+    rate_limited = failed = 0
+    while True:
+        try:
+            with urllib.request.urlopen(prepared, timeout=timeout) as response:
+                return response.read()
+        except urllib.error.HTTPError as e:
+            body = e.read()
+            error = NotifyError(f"HTTP {e.code}: {body.decode(errors='replace')[:200]}")
+            if e.code == 429:
+                delay = _retry_after(e, body)
+                if delay is None or delay > MAX_RETRY_AFTER or rate_limited == RATE_LIMIT_RETRIES:
+                    raise error
+                rate_limited += 1
+                logger.info(f"Rate limited by {host}, sending again in {delay:.1f}s")
+                time.sleep(delay)
+                continue
+            if e.code < 500 or failed == retries:
+                raise error
+        except (urllib.error.URLError, OSError) as e:
+            error = NotifyError(str(e))
+            if failed == retries:
+                raise error
+        delay = min(2.0**failed, MAX_BACKOFF)
+        failed += 1
+        logger.info(f"Request to {host} failed ({error}), sending again in {delay:.0f}s")
+        time.sleep(delay)
+
+
+def post_json(
+    url: str, payload: dict, headers: dict[str, str] | None = None, timeout: float = 10, retries: int = 0
+) -> bytes:
+    """POST a JSON document, returning the response body; transient failures are retried as with request.
+
+    Raises:
+        NotifyError: If the request fails or is answered with an error status
+    """
+    headers = {"Content-Type": "application/json", **(headers or {})}
+    return request(url, json.dumps(payload).encode(), headers=headers, timeout=timeout, retries=retries)
+
+
+class Notifier(ABC):
+    """Abstract base class for notifiers.
+
+    A notifier reports results its policy selects: every run, failed
+    runs, or failed runs and the first success after a failure.
+    """
+
+    # Name of the notifier in logs, e.g. 'slack'
+    name = "notifier"
+
+    def __init__(self, policy: str = "failures-and-recovery"):
+        if policy not in NOTIFY_POLICIES:
+            raise ValueError(f"Unknown notification policy: {policy}")
+        self.policy = policy
+
+    def wants(self, result: RunResult) -> bool:
+        """Return whether the policy reports a result.
+
+        A recovery is reported whatever the policy, so a failure that was
+        reported is never left looking unresolved.
+        """
+        return self.policy == "always" or not result.succeeded or result.recovered
+
+    @abstractmethod
+    def send(self, result: RunResult) -> None:
+        """Report a result.
+
+        Raises:
+            NotifyError: If the result could not be delivered
+        """
+        pass
+
+
+# Failure streaks of every target and database, to tell recoveries and how long a database has been failing
+_streaks = StreakState()
+
+
+def track_streaks(path: Path) -> None:
+    """Keep the failure streaks in a file, so they carry on where they were when NestVault restarts."""
+    global _streaks
+    _streaks = StreakState(path)
+
+
+def notify(notifiers: Sequence[Notifier], result: RunResult) -> None:
+    """Report a result to every notifier whose policy selects it.
+
+    The result is given the failure streak of its database first: a run
+    succeeding after failed ones is marked as recovered, and a failed
+    one counted with those before it. A notification that cannot be
+    delivered is logged, never raised, as the backup itself is done, and
+    recorded on the span of its notifier.
+    """
+    previous = _streaks.record(f"{result.target}/{result.database}", result.succeeded, result.finished_at)
+    result.recovered = result.succeeded and previous.failures > 0
+    result.consecutive_failures = previous.failures if result.succeeded else previous.failures + 1
+    result.last_success = previous.last_success
+
+    wanted = [notifier for notifier in notifiers if notifier.wants(result)]
+    if not wanted:
+        return
+    with span("notify", status=result.status, backup_key=result.backup_key):
+        for notifier in wanted:
+            with span(f"notify {notifier.name}", notifier=notifier.name) as traced:
+                try:
+                    notifier.send(result)
+                except NotifyError as e:
+                    traced.fail(e)
+                    logger.warning(f"Failed to send the {notifier.name} notification for '{result.target}': {e}")
@@ -0,0 +1,44 @@
+"""Discord notifier, posting embeds to a channel webhook."""
+
+from __future__ import annotations
+
+from nestvault.notify.base import Notifier, RunResult, post_json
+
+# Longest value of an embed field Discord accepts
+MAX_FIELD_CHARS = 1024
+
+
+class DiscordNotifier(Notifier):
+    """Posts backup results to a Discord webhook, as color-coded embeds.
+
+    Discord rate-limits webhooks with 429 responses naming how long to
+    wait; the message is sent again once that wait is over.
+    """
+
+    name = "discord"
+
+    def __init__(self, webhook_url: str, policy: str = "failures-and-recovery", timeout: float = 10):
+        super().__init__(policy)
+        self.webhook_url = webhook_url
+        self.timeout = timeout
+
+    def payload(self, result: RunResult) -> dict:
+        """Build the message reporting a result."""
+        embed = {
+            "title": result.headline,
+            "color": result.color,
+            "fields": [
+                {"name": name, "value": value[:MAX_FIELD_CHARS], "inline": name != "Backup"}
+                for name, value in result.fields()
+            ],
+            "timestamp": result.finished_at.isoformat(),
+        }
+        if not result.succeeded and result.error:
+            excerpt = result.error_excerpt().replace("```", "'''")
+            embed["description"] = f"```{excerpt}```"
+
+        # Mentions in an error excerpt must not ping anyone
+        return {"username": "NestVault", "embeds": [embed], "allowed_mentions": {"parse": []}}
+
+    def send(self, result: RunResult) -> None:
+        post_json(self.webhook_url, self.payload(result), timeout=self.timeout)
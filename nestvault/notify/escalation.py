@@ -0,0 +1,141 @@
+"""Escalation to incident tools after consecutive failures, with the counts kept across restarts."""
+
+from __future__ import annotations
+
+import json
+import os
+import threading
+from abc import abstractmethod
+from dataclasses import dataclass
+from pathlib import Path
+
+from nestvault.logging import get_logger
+from nestvault.notify.base import Notifier, RunResult
+
+logger = get_logger("notify.escalation")
+
+
+@dataclass
+class Escalation:
+    """The consecutive failures of one database of a target, and whether an incident is open for them."""
+
+    failures: int = 0
+    open: bool = False
+
+
+class EscalationState:
+    """Escalations of every notifier, target and database, in one JSON file replaced atomically.
+
+    The file is read once and written on every change, so a process that
+    crashes and restarts carries on counting where it stopped.
+    """
+
+    def __init__(self, path: Path):
+        self.path = path
+        self.lock = threading.Lock()
+        self.escalations: dict[str, Escalation] = {}
+        try:
+            data = json.loads(path.read_text())
+            self.escalations = {key: Escalation(**value) for key, value in data.items()}
+        except FileNotFoundError:
+            pass
+        except (OSError, ValueError, TypeError, AttributeError) as e:
+            logger.warning(f"Ignoring unreadable escalation state {path}: {e}")
+
+    def get(self, key: str) -> Escalation:
+        with self.lock:
+            escalation = self.escalations.get(key, Escalation())
+            return Escalation(escalation.failures, escalation.open)
+
+    def set(self, key: str, escalation: Escalation) -> None:
+        """Record an escalation; one that cannot be written is logged, and counted in memory only."""
+        partial = self.path.with_suffix(".tmp")
+        with self.lock:
+            if escalation.failures or escalation.open:
+                self.escalations[key] = Escalation(escalation.failures, escalation.open)
+            else:
+                self.escalations.pop(key, None)
+            data = {key: vars(escalation) for key, escalation in sorted(self.escalations.items())}
+            try:
+                self.path.parent.mkdir(parents=True, exist_ok=True)
+                partial.write_text(json.dumps(data, indent=2))
+                os.replace(partial, self.path)
+            except OSError as e:
+                logger.warning(f"Failed to record escalations in {self.path}: {e}")
+
+
+class EscalationNotifier(Notifier):
+    """Opens an incident once a database failed after_failures times in a row, resolving it on the next success.
+
+    Every result counts, whatever the policy of other notifiers. The
+    incident has a dedup key stable across runs and restarts, so the
+    incident tool groups repeated triggers and the resolve closes it.
+    """
+
+    def __init__(self, state: EscalationState, after_failures: int = 2):
+        super().__init__("always")
+        if after_failures < 1:
+            raise ValueError("Escalation needs at least 1 failure")
+        self.state = state
+        self.after_failures = after_failures
+
+    @staticmethod
+    def dedup_key(result: RunResult) -> str:
+        return f"nestvault/{result.target}/{result.database}"
+
+    @abstractmethod
+    def trigger(self, result: RunResult, failures: int) -> None:
+        """Open the incident of a failing database, or add to it.
+
+        Raises:
+            NotifyError: If the incident could not be opened
+        """
+        pass
+
+    @abstractmethod
+    def resolve(self, result: RunResult) -> None:
+        """Resolve the incident of a database that succeeded again.
+
+        Raises:
+            NotifyError: If the incident could not be resolved
+        """
+        pass
+
+    def send(self, result: RunResult) -> None:
+        key = f"{self.name}:{self.dedup_key(result)}"
+        escalation = self.state.get(key)
+
+        if result.succeeded:
+            # The count starts over even if the resolve fails; it is sent again on the next success
+            escalation.failures = 0
+            self.state.set(key, escalation)
+            if escalation.open:
+                self.resolve(result)
+                escalation.open = False
+                self.state.set(key, escalation)
+                logger.info(f"Resolved the {self.name} incident of '{result.target}'")
+            return
+
+        escalation.failures += 1
+        self.state.set(key, escalation)
+        if escalation.failures < self.after_failures:
+            logger.info(
+                f"Backup of '{result.target}' failed {escalation.failures} times in a row, "
+                f"escalating to {self.name} at {self.after_failures}"
+            )
+            return
+        if escalation.open:
+            return
+        self.trigger(result, escalation.failures)
+        escalation.open = True
+        self.state.set(key, escalation)
+        logger.warning(f"Opened a {self.name} incident for '{result.target}' after {escalation.failures} failures")
+
+
+def incident_details(result: RunResult, failures: int) -> dict[str, str | int]:
+    """Return the details incidents carry about a failing database."""
+    details: dict[str, str | int] = {name.lower(): value for name, value in result.fields()}
+    details["consecutive_failures"] = failures
+    if result.error:
+        details["error"] = result.error_excerpt()
+    return details
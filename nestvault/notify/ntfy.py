@@ -0,0 +1,73 @@
+"""ntfy notifier, publishing to a topic of ntfy.sh or a self-hosted server."""
+
+from __future__ import annotations
+
+import base64
+from urllib.parse import quote
+
+from nestvault.notify.base import Notifier, RunResult, post_json
+
+# Priorities of the messages by status: 'high' vibrates and pops up on phones, 'default' only notifies
+PRIORITIES = {"success": 3, "failure": 4, "aborted": 3}
+
+# Tags of the messages by status, which ntfy shows as emoji before the title
+TAGS = {"success": ["white_check_mark"], "failure": ["rotating_light"], "aborted": ["warning"]}
+
+
+class NtfyNotifier(Notifier):
+    """Publishes backup results to an ntfy topic, as JSON to the server's root URL.
+
+    Failures are sent with high priority and successes with the default
+    one. With a click URL, tapping a message opens the status of its
+    target on the server at METRICS_ADDRESS, e.g. behind a reverse proxy.
+    """
+
+    name = "ntfy"
+
+    def __init__(
+        self,
+        server_url: str,
+        topic: str,
+        token: str | None = None,
+        username: str | None = None,
+        password: str | None = None,
+        click_url: str | None = None,
+        policy: str = "failures-and-recovery",
+        timeout: float = 10,
+    ):
+        super().__init__(policy)
+        self.server_url = server_url.rstrip("/")
+        self.topic = topic
+        self.token = token
+        self.username = username
+        self.password = password
+        self.click_url = click_url.rstrip("/") if click_url else None
+        self.timeout = timeout
+
+    def payload(self, result: RunResult) -> dict:
+        """Build the message reporting a result."""
+        lines = [f"{name}: {value}" for name, value in result.fields()]
+        if not result.succeeded and result.error:
+            lines += ["", result.error_excerpt()]
+        payload = {
+            "topic": self.topic,
+            "title": result.headline,
+            "message": "\n".join(lines),
+            "priority": PRIORITIES.get(result.status, PRIORITIES["failure"]),
+            "tags": TAGS.get(result.status, TAGS["failure"]),
+        }
+        if self.click_url is not None:
+            payload["click"] = f"{self.click_url}/status/{quote(result.target, safe='')}"
+        return payload
+
+    def headers(self) -> dict[str, str]:
+        """Return the Authorization header of the access token or the user's credentials, if any."""
+        if self.token is not None:
+            return {"Authorization": f"Bearer {self.token}"}
+        if self.username is not None:
+            credentials = base64.b64encode(f"{self.username}:{self.password or ''}".encode()).decode()
+            return {"Authorization": f"Basic {credentials}"}
+        return {}
+
+    def send(self, result: RunResult) -> None:
+        post_json(self.server_url, self.payload(result), self.headers(), timeout=self.timeout)
@@ -0,0 +1,57 @@
+"""Opsgenie escalation, through the Alert API."""
+
+from __future__ import annotations
+
+import urllib.parse
+
+from nestvault.notify.base import RunResult, post_json
+from nestvault.notify.escalation import EscalationNotifier, EscalationState, incident_details
+
+DEFAULT_API_URL = "https://api.opsgenie.com"
+
+
+class OpsgenieNotifier(EscalationNotifier):
+    """Creates an Opsgenie alert for a database failing repeatedly, and closes it once it succeeds.
+
+    The alert's alias is the dedup key, so Opsgenie folds repeated
+    creates into one alert and the close finds it.
+    """
+
+    name = "opsgenie"
+
+    def __init__(
+        self,
+        api_key: str,
+        state: EscalationState,
+        after_failures: int = 2,
+        api_url: str = DEFAULT_API_URL,
+        timeout: float = 10,
+    ):
+        super().__init__(state, after_failures)
+        self.api_key = api_key
+        self.api_url = api_url.rstrip("/")
+        self.timeout = timeout
+
+    def alert(self, result: RunResult, failures: int) -> dict:
+        """Build the alert about a result's database."""
+        return {
+            "message": f"{result.headline} {failures} times in a row"[:130],
+            "alias": self.dedup_key(result),
+            "description": result.error.strip()[:15000],
+            "details": {name: str(value) for name, value in incident_details(result, failures).items()},
+            "entity": result.target,
+            "source": "nestvault",
+            "tags": ["nestvault", "backup"],
+            "priority": "P1" if result.status == "failure" else "P2",
+        }
+
+    def trigger(self, result: RunResult, failures: int) -> None:
+        post_json(f"{self.api_url}/v2/alerts", self.alert(result, failures), self._headers(), self.timeout)
+
+    def resolve(self, result: RunResult) -> None:
+        alias = urllib.parse.quote(self.dedup_key(result), safe="")
+        url = f"{self.api_url}/v2/alerts/{alias}/close?identifierType=alias"
+        post_json(url, {"source": "nestvault", "note": result.headline}, self._headers(), self.timeout)
+
+    def _headers(self) -> dict[str, str]:
+        return {"Authorization": f"GenieKey {self.api_key}"}
@@ -0,0 +1,43 @@
+"""PagerDuty escalation, through the Events API v2."""
+
+from __future__ import annotations
+
+import socket
+
+from nestvault.notify.base import RunResult, post_json
+from nestvault.notify.escalation import EscalationNotifier, EscalationState, incident_details
+
+EVENTS_URL = "https://events.pagerduty.com/v2/enqueue"
+
+
+class PagerDutyNotifier(EscalationNotifier):
+    """Triggers a PagerDuty incident for a database failing repeatedly, and resolves it once it succeeds."""
+
+    name = "pagerduty"
+
+    def __init__(self, routing_key: str, state: EscalationState, after_failures: int = 2, timeout: float = 10):
+        super().__init__(state, after_failures)
+        self.routing_key = routing_key
+        self.timeout = timeout
+
+    def event(self, result: RunResult, action: str, failures: int = 0) -> dict:
+        """Build the event triggering or resolving the incident of a result's database."""
+        event = {"routing_key": self.routing_key, "event_action": action, "dedup_key": self.dedup_key(result)}
+        if action == "trigger":
+            event["payload"] = {
+                "summary": f"{result.headline} {failures} times in a row",
+                "source": socket.gethostname(),
+                "severity": "critical" if result.status == "failure" else "error",
+                "timestamp": result.finished_at.isoformat(),
+                "component": result.database,
+                "group": result.target,
+                "class": "backup",
+                "custom_details": incident_details(result, failures),
+            }
+        return event
+
+    def trigger(self, result: RunResult, failures: int) -> None:
+        post_json(EVENTS_URL, self.event(result, "trigger", failures), timeout=self.timeout)
+
+    def resolve(self, result: RunResult) -> None:
+        post_json(EVENTS_URL, self.event(result, "resolve"), timeout=self.timeout)
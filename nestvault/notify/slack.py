@@ -0,0 +1,87 @@
+"""Slack notifier, posting through an incoming webhook or as a bot with chat.postMessage."""
+
+from __future__ import annotations
+
+import json
+
+from nestvault.exceptions import NotifyError
+from nestvault.logging import get_logger
+from nestvault.notify.base import Notifier, RunResult, post_json
+
+logger = get_logger("notify.slack")
+
+POST_MESSAGE_URL = "https://slack.com/api/chat.postMessage"
+
+
+def _escape(text: str) -> str:
+    """Escape the characters Slack's mrkdwn treats as control characters."""
+    return text.replace("&", "&amp;").replace("<", "&lt;").replace(">", "&gt;")
+
+
+def _field(name: str, value: str) -> dict[str, str]:
+    return {"type": "mrkdwn", "text": f"*{name}*\n{_escape(value)}"}
+
+
+class SlackNotifier(Notifier):
+    """Posts backup results to Slack, as color-coded attachments of Block Kit blocks.
+
+    With a webhook URL, messages go to the webhook's channel. With a bot
+    token instead, they are posted to channel with chat.postMessage.
+    """
+
+    name = "slack"
+
+    def __init__(
+        self,
+        webhook_url: str | None = None,
+        bot_token: str | None = None,
+        channel: str | None = None,
+        policy: str = "failures-and-recovery",
+        timeout: float = 10,
+    ):
+        super().__init__(policy)
+        if webhook_url is None and (bot_token is None or channel is None):
+            raise ValueError("Slack needs a webhook URL, or a bot token and a channel")
+        self.webhook_url = webhook_url
+        self.bot_token = bot_token
+        self.channel = channel
+        self.timeout = timeout
+
+    def payload(self, result: RunResult) -> dict:
+        """Build the message reporting a result."""
+        fields = [_field(name, value) for name, value in result.fields()]
+        blocks: list[dict] = [
+            {"type": "section", "text": {"type": "mrkdwn", "text": f"*{_escape(result.headline)}*"}},
+            {"type": "section", "fields": fields},
+        ]
+        if not result.succeeded and result.error:
+            excerpt = result.error_excerpt().replace("```", "'''")
+            blocks.append({"type": "section", "text": {"type": "mrkdwn", "text": f"```{_escape(excerpt)}```"}})
+
+        message = {
+            "text": result.headline,
+            "attachments": [{"color": f"#{result.color:06x}", "blocks": blocks}],
+        }
+        if self.webhook_url is None:
+            message["channel"] = self.channel
+        return message
+
+    def send(self, result: RunResult) -> None:
+        if self.webhook_url is not None:
+            post_json(self.webhook_url, self.payload(result), timeout=self.timeout)
+            return
+
+        body = post_json(
+            POST_MESSAGE_URL,
+            self.payload(result),
+            headers={"Authorization": f"Bearer {self.bot_token}"},
+            timeout=self.timeout,
+        )
+        # The Web API answers errors with HTTP 200 and ok false
+        try:
+            response = json.loads(body)
+        except ValueError:
+            raise NotifyError(f"unexpected response from chat.postMessage: {body[:200]!r}")
+        if not response.get("ok"):
+            raise NotifyError(f"chat.postMessage failed: {response.get('error', 'unknown error')}")
+        logger.debug(f"Posted the result of '{result.target}' to {self.channel}")
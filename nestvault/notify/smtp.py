@@ -0,0 +1,114 @@
+"""Email notifier, sending run summaries over SMTP."""
+
+from __future__ import annotations
+
+import html
+import smtplib
+import ssl
+from email.message import EmailMessage
+from email.utils import formatdate, make_msgid
+
+from nestvault.config import SMTP_TLS_PORTS
+from nestvault.exceptions import NotifyError
+from nestvault.logging import get_logger
+from nestvault.notify.base import Notifier, RunResult
+
+logger = get_logger("notify.smtp")
+
+
+class EmailNotifier(Notifier):
+    """Emails backup results, as a plaintext and an HTML summary of the run.
+
+    The connection is secured with STARTTLS, with TLS from the start
+    ('implicit'), or not at all ('none'). A failed run's email has the
+    last lines the run logged attached.
+    """
+
+    name = "email"
+
+    def __init__(
+        self,
+        host: str,
+        port: int,
+        sender: str,
+        to: list[str],
+        cc: list[str] | None = None,
+        tls: str = "starttls",
+        username: str | None = None,
+        password: str | None = None,
+        policy: str = "failures-and-recovery",
+        timeout: float = 30,
+    ):
+        super().__init__(policy)
+        if tls not in SMTP_TLS_PORTS:
+            raise ValueError(f"Unknown SMTP TLS mode: {tls}")
+        if not to:
+            raise ValueError("An email needs at least one recipient")
+        self.host = host
+        self.port = port
+        self.sender = sender
+        self.to = to
+        self.cc = cc or []
+        self.tls = tls
+        self.username = username
+        self.password = password
+        self.timeout = timeout
+
+    def message(self, result: RunResult) -> EmailMessage:
+        """Build the email reporting a result."""
+        message = EmailMessage()
+        message["Subject"] = f"[NestVault] {result.headline}"
+        message["From"] = self.sender
+        message["To"] = ", ".join(self.to)
+        if self.cc:
+            message["Cc"] = ", ".join(self.cc)
+        message["Date"] = formatdate(result.finished_at.timestamp(), localtime=False)
+        message["Message-ID"] = make_msgid(domain="nestvault")
+
+        fields = result.fields()
+        text = [result.headline, ""] + [f"{name}: {value}" for name, value in fields]
+        if not result.succeeded and result.error:
+            text += ["", "Error:", result.error.strip()]
+        message.set_content("\n".join(text) + "\n")
+
+        rows = "".join(
+            f'<tr><th align="left">{html.escape(name)}</th><td>{html.escape(value)}</td></tr>'
+            for name, value in fields
+        )
+        body = [
+            f'<h2 style="color: #{result.color:06x}">{html.escape(result.headline)}</h2>',
+            f'<table cellpadding="4">{rows}</table>',
+        ]
+        if not result.succeeded and result.error:
+            body.append(f"<h3>Error</h3><pre>{html.escape(result.error.strip())}</pre>")
+        message.add_alternative(f"<html><body>{''.join(body)}</body></html>\n", subtype="html")
+
+        if not result.succeeded and result.log:
+            message.add_attachment(
+                "\n".join(result.log) + "\n", filename=f"nestvault-{result.target}-{result.database}.log"
+            )
+        return message
+
+    def _connect(self) -> smtplib.SMTP:
+        context = ssl.create_default_context()
+        if self.tls == "implicit":
+            return smtplib.SMTP_SSL(self.host, self.port, timeout=self.timeout, context=context)
+        smtp = smtplib.SMTP(self.host, self.port, timeout=self.timeout)
+        if self.tls == "starttls":
+            try:
+                smtp.starttls(context=context)
+            except BaseException:
+                smtp.close()
+                raise
+        return smtp
+
+    def send(self, result: RunResult) -> None:
+        message = self.message(result)
+        try:
+            with self._connect() as smtp:
+                if self.username is not None:
+                    smtp.login(self.username, self.password or "")
+                smtp.send_message(message, self.sender, self.to + self.cc)
+        except (smtplib.SMTPException, OSError) as e:
+            raise NotifyError(f"SMTP {self.host}:{self.port}: {e}")
+        logger.debug(f"Emailed the result of '{result.target}' to {', '.join(self.to + self.cc)}")
@@ -0,0 +1,82 @@
+"""Failure streaks of the databases of every target, kept across restarts, for the context notifications give."""
+
+from __future__ import annotations
+
+import json
+import os
+import threading
+from dataclasses import dataclass
+from datetime import datetime
+from pathlib import Path
+
+from nestvault.logging import get_logger
+
+logger = get_logger("notify.streak")
+
+
+@dataclass
+class Streak:
+    """The failures in a row of one database of a target, and when it last succeeded."""
+
+    failures: int = 0
+    last_success: datetime | None = None
+
+
+class StreakState:
+    """Streaks of every target and database, in one JSON file replaced atomically, or in memory without one.
+
+    The file is read once and written on every result, so a process that
+    restarts tells a recovery, and how long a database has been failing,
+    from the results of the one before.
+    """
+
+    def __init__(self, path: Path | None = None):
+        self.path = path
+        self.lock = threading.Lock()
+        self.streaks: dict[str, Streak] = {}
+        if path is None:
+            return
+        try:
+            data = json.loads(path.read_text())
+            self.streaks = {
+                key: Streak(
+                    value["failures"],
+                    datetime.fromisoformat(value["last_success"]) if value.get("last_success") else None,
+                )
+                for key, value in data.items()
+            }
+        except FileNotFoundError:
+            pass
+        except (OSError, ValueError, TypeError, KeyError, AttributeError) as e:
+            logger.warning(f"Ignoring unreadable failure streaks {path}: {e}")
+
+    def record(self, key: str, succeeded: bool, at: datetime) -> Streak:
+        """Count a result towards a streak, returning the streak as it was before.
+
+        A streak that cannot be written is logged, and counted in memory only.
+        """
+        with self.lock:
+            previous = self.streaks.get(key, Streak())
+            if succeeded:
+                self.streaks[key] = Streak(0, at)
+            else:
+                self.streaks[key] = Streak(previous.failures + 1, previous.last_success)
+            if self.path is not None:
+                self._write()
+            return previous
+
+    def _write(self) -> None:
+        data = {
+            key: {
+                "failures": streak.failures,
+                "last_success": streak.last_success.isoformat() if streak.last_success else None,
+            }
+            for key, streak in sorted(self.streaks.items())
+        }
+        partial = self.path.with_suffix(".tmp")
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            partial.write_text(json.dumps(data, indent=2))
+            os.replace(partial, self.path)
+        except OSError as e:
+            logger.warning(f"Failed to record failure streaks in {self.path}: {e}")
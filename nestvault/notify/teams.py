@@ -0,0 +1,90 @@
+"""Microsoft Teams notifier, posting Adaptive Cards to an incoming webhook."""
+
+from __future__ import annotations
+
+from urllib.parse import quote
+
+from nestvault.notify.base import Notifier, RunResult, post_json
+
+# Styles of the card's heading by status, which Teams shows as a green, red or yellow accent
+STYLES = {"success": "good", "failure": "attention", "aborted": "warning"}
+
+
+class TeamsNotifier(Notifier):
+    """Posts backup results to a Teams incoming webhook, as Adaptive Cards.
+
+    The details of the run are laid out as facts under a heading colored
+    by status. A failed run's error is cut to its start; with a status URL,
+    the card links to the status of the target, which has the whole error
+    of every database its last run failed to back up.
+
+    A request failing to connect or answered with a 5xx status is sent
+    again up to retries times, backing off between attempts.
+    """
+
+    name = "teams"
+
+    def __init__(
+        self,
+        webhook_url: str,
+        status_url: str | None = None,
+        policy: str = "failures-and-recovery",
+        timeout: float = 10,
+        retries: int = 3,
+    ):
+        super().__init__(policy)
+        self.webhook_url = webhook_url
+        self.status_url = status_url.rstrip("/") if status_url else None
+        self.timeout = timeout
+        self.retries = retries
+
+    def card(self, result: RunResult) -> dict:
+        """Build the Adaptive Card reporting a result."""
+        style = STYLES.get(result.status, STYLES["failure"])
+        body: list[dict] = [
+            {
+                "type": "Container",
+                "style": style,
+                "bleed": True,
+                "items": [
+                    {"type": "TextBlock", "text": result.headline, "size": "Large", "weight": "Bolder", "wrap": True}
+                ],
+            },
+            {"type": "FactSet", "facts": [{"title": name, "value": value} for name, value in result.fields()]},
+        ]
+        status_url = f"{self.status_url}/status/{quote(result.target, safe='')}" if self.status_url else None
+
+        if not result.succeeded and result.error:
+            excerpt = result.error_excerpt()
+            body.append({"type": "TextBlock", "text": excerpt, "fontType": "Monospace", "wrap": True})
+            if excerpt != result.error.strip():
+                where = "the status of the target" if status_url else "the log"
+                note = f"The error is cut short, see {where} for all of it."
+                body.append({"type": "TextBlock", "text": note, "isSubtle": True, "wrap": True})
+
+        card = {
+            "$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+            "type": "AdaptiveCard",
+            "version": "1.4",
+            "msteams": {"width": "Full"},
+            "body": body,
+        }
+        if status_url is not None:
+            card["actions"] = [{"type": "Action.OpenUrl", "title": "View status", "url": status_url}]
+        return card
+
+    def payload(self, result: RunResult) -> dict:
+        """Build the message reporting a result, with its card as the only attachment."""
+        return {
+            "type": "message",
+            "attachments": [
+                {
+                    "contentType": "application/vnd.microsoft.card.adaptive",
+                    "contentUrl": None,
+                    "content": self.card(result),
+                }
+            ],
+        }
+
+    def send(self, result: RunResult) -> None:
+        post_json(self.webhook_url, self.payload(result), timeout=self.timeout, retries=self.retries)
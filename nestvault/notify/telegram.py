@@ -0,0 +1,99 @@
+"""Telegram notifier, posting through a bot's sendMessage API."""
+
+from __future__ import annotations
+
+import json
+import re
+
+from nestvault.exceptions import NotifyError
+from nestvault.logging import get_logger
+from nestvault.notify.base import Notifier, RunResult, post_json
+
+logger = get_logger("notify.telegram")
+
+API_URL = "https://api.telegram.org"
+
+# Longest message Telegram accepts, after entities are parsed
+MAX_MESSAGE_CHARS = 4096
+
+_CODE_FENCE = ("```\n", "\n```")
+
+
+def _escape(text: str) -> str:
+    """Escape the characters MarkdownV2 reserves outside of code."""
+    return re.sub(r"([_*\[\]()~`>#+\-=|{}.!\\])", r"\\\1", text)
+
+
+def _escape_code(text: str) -> str:
+    """Escape the characters MarkdownV2 reserves inside code blocks."""
+    return text.replace("\\", "\\\\").replace("`", "\\`")
+
+
+def _split(text: str, limit: int) -> list[str]:
+    """Split escaped text into pieces of at most limit characters, at line breaks where there are any.
+
+    A piece never ends between a backslash and the character it escapes.
+    """
+    pieces = []
+    while len(text) > limit:
+        cut = text.rfind("\n", 0, limit + 1)
+        if cut <= 0:
+            cut = limit
+            backslashes = len(text[:cut]) - len(text[:cut].rstrip("\\"))
+            if backslashes % 2:
+                cut -= 1
+        pieces.append(text[:cut])
+        text = text[cut:].removeprefix("\n")
+    pieces.append(text)
+    return pieces
+
+
+class TelegramNotifier(Notifier):
+    """Posts backup results to a Telegram chat as a bot, in MarkdownV2.
+
+    A failed run's error is sent in full: when the message would be longer
+    than Telegram allows, the error follows the summary in as many
+    messages as it takes.
+    """
+
+    name = "telegram"
+
+    def __init__(self, bot_token: str, chat_id: str, policy: str = "failures-and-recovery", timeout: float = 10):
+        super().__init__(policy)
+        self.bot_token = bot_token
+        self.chat_id = chat_id
+        self.timeout = timeout
+
+    def messages(self, result: RunResult) -> list[str]:
+        """Build the messages reporting a result, each within MAX_MESSAGE_CHARS."""
+        icon = {"success": "✅", "failure": "❌"}.get(result.status, "⚠️")
+        lines = [f"{icon} *{_escape(result.headline)}*", ""]
+        lines += [f"*{_escape(name)}:* {_escape(value)}" for name, value in result.fields()]
+        summary = "\n".join(lines)
+        if result.succeeded or not result.error:
+            return [summary]
+
+        opening, closing = _CODE_FENCE
+        error = _escape_code(result.error.strip())
+        message = f"{summary}\n\n{opening}{error}{closing}"
+        if len(message) <= MAX_MESSAGE_CHARS:
+            return [message]
+        pieces = _split(error, MAX_MESSAGE_CHARS - len(opening) - len(closing))
+        return [summary] + [f"{opening}{piece}{closing}" for piece in pieces]
+
+    def send(self, result: RunResult) -> None:
+        url = f"{API_URL}/bot{self.bot_token}/sendMessage"
+        for text in self.messages(result):
+            body = post_json(
+                url,
+                {"chat_id": self.chat_id, "text": text, "parse_mode": "MarkdownV2", "disable_web_page_preview": True},
+                timeout=self.timeout,
+            )
+            # The Bot API answers errors with ok false, with HTTP 200 or an error status
+            try:
+                response = json.loads(body)
+            except ValueError:
+                raise NotifyError(f"unexpected response from sendMessage: {body[:200]!r}")
+            if not response.get("ok"):
+                raise NotifyError(f"sendMessage failed: {response.get('description', 'unknown error')}")
+        logger.debug(f"Posted the result of '{result.target}' to Telegram chat {self.chat_id}")
@@ -0,0 +1,70 @@
+"""Generic webhook notifier, sending a payload rendered from a template."""
+
+from __future__ import annotations
+
+import hashlib
+import hmac
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import Notifier, RunResult, request
+from nestvault.template import RESULT_VARIABLES, Template
+
+# Body sent when no template is configured: every field of the result, as a JSON object
+DEFAULT_BODY_TEMPLATE = "{{json .}}"
+
+# Header carrying the HMAC-SHA256 of the body, as 'sha256=<hex digest>'
+SIGNATURE_HEADER = "X-NestVault-Signature"
+
+
+def sign(body: bytes, secret: str) -> str:
+    """Return the signature of a body, as receivers recompute it with the shared secret."""
+    return "sha256=" + hmac.new(secret.encode(), body, hashlib.sha256).hexdigest()
+
+
+class WebhookNotifier(Notifier):
+    """Sends backup results to any HTTP endpoint, in a body rendered from a Go-style template.
+
+    With a secret, the body is signed in the X-NestVault-Signature header.
+    A request failing to connect or answered with a 5xx status is sent
+    again up to retries times, backing off between attempts.
+    """
+
+    name = "webhook"
+
+    def __init__(
+        self,
+        url: str,
+        method: str = "POST",
+        headers: dict[str, str] | None = None,
+        body_template: str | None = None,
+        secret: str | None = None,
+        retries: int = 3,
+        policy: str = "failures-and-recovery",
+        timeout: float = 10,
+    ):
+        super().__init__(policy)
+        self.url = url
+        self.method = method
+        self.headers = {"Content-Type": "application/json", **(headers or {})}
+        self.template = Template(body_template or DEFAULT_BODY_TEMPLATE, RESULT_VARIABLES)
+        self.secret = secret
+        self.retries = retries
+        self.timeout = timeout
+
+    def body(self, result: RunResult) -> bytes:
+        """Render the body reporting a result.
+
+        Raises:
+            NotifyError: If the template cannot be rendered for the result
+        """
+        try:
+            return self.template.render(result.template_data()).encode()
+        except ValueError as e:
+            raise NotifyError(f"failed to render the webhook body: {e}")
+
+    def send(self, result: RunResult) -> None:
+        body = self.body(result)
+        headers = dict(self.headers)
+        if self.secret is not None:
+            headers[SIGNATURE_HEADER] = sign(body, self.secret)
+        request(self.url, body, self.method, headers, timeout=self.timeout, retries=self.retries)
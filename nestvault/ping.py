@@ -0,0 +1,76 @@
+"""Dead man's switch pings to a monitoring service, e.g. Healthchecks.io, around every backup run."""
+
+from __future__ import annotations
+
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+import uuid
+from collections.abc import Iterable
+from dataclasses import dataclass
+
+from nestvault.logging import get_logger
+
+logger = get_logger("ping")
+
+# The log tail sent with a finished run is cut to its last bytes, within Healthchecks.io's default body limit
+MAX_BODY_BYTES = 100_000
+
+
+def _log_body(lines: Iterable[str]) -> bytes:
+    body = "\n".join(lines).encode("utf-8", errors="replace")
+    return body[-MAX_BODY_BYTES:]
+
+
+@dataclass
+class Pinger:
+    """Pings a check URL when a run starts, succeeds and fails, following the Healthchecks.io conventions.
+
+    A run is pinged at '<url>/start', '<url>' once it succeeded and
+    '<url>/fail' once it failed, each with the run's ID as 'rid', so the
+    service can time the run. A ping that fails is retried, then logged;
+    it never fails or holds up the run for longer than its retries take.
+    """
+
+    url: str
+    timeout_seconds: float = 10
+    retries: int = 2
+
+    def _endpoint(self, event: str, run_id: str) -> str:
+        parts = urllib.parse.urlsplit(self.url)
+        path = f"{parts.path.rstrip('/')}/{event}" if event else parts.path
+        query = "&".join(filter(None, [parts.query, f"rid={run_id}"]))
+        return urllib.parse.urlunsplit((parts.scheme, parts.netloc, path, query, parts.fragment))
+
+    def _send(self, url: str, body: bytes | None) -> bool:
+        attempts = self.retries + 1
+        for attempt in range(1, attempts + 1):
+            request = urllib.request.Request(url, data=body, method="POST" if body is not None else "GET")
+            request.add_header("User-Agent", "nestvault")
+            try:
+                with urllib.request.urlopen(request, timeout=self.timeout_seconds):
+                    return True
+            except (urllib.error.URLError, OSError) as e:
+                if attempt == attempts:
+                    logger.warning(f"Failed to ping {urllib.parse.urlsplit(url).netloc} after {attempts} attempts: {e}")
+                    return False
+                logger.debug(f"Ping failed (attempt {attempt}/{attempts}), retrying: {e}")
+                time.sleep(attempt)
+        return False
+
+    def start(self) -> str:
+        """Ping the start of a run, returning its ID to finish it with."""
+        run_id = str(uuid.uuid4())
+        self._send(self._endpoint("start", run_id), None)
+        return run_id
+
+    def finish(self, run_id: str, succeeded: bool, log: Iterable[str] = ()) -> None:
+        """Ping the end of a run, with the tail of its log as the body.
+
+        Args:
+            run_id: ID start returned for the run
+            succeeded: Whether the run succeeded
+            log: Lines the run logged
+        """
+        self._send(self._endpoint("" if succeeded else "fail", run_id), _log_body(log))
@@ -0,0 +1,131 @@
+"""Checks run before a backup is written to the temp directory."""
+
+from __future__ import annotations
+
+import math
+import shutil
+from dataclasses import dataclass
+from pathlib import Path
+
+from nestvault.backup.base import BackupAdapter
+from nestvault.config import PreflightConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.logging import get_logger
+from nestvault.manifest import Manifest, list_backups
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("preflight")
+
+
+@dataclass
+class SizeEstimate:
+    """How large the next backup is expected to be, and what that is based on."""
+
+    size: int
+    basis: str
+    # Size of the database when the estimate was made, None when the engine cannot tell
+    database_size: int | None = None
+
+    @property
+    def metadata(self) -> dict[str, str]:
+        """Return the estimate as backup metadata, so later estimates can compare it with the actual size."""
+        metadata = {"estimated_size": str(self.size)}
+        if self.database_size is not None:
+            metadata["database_size"] = str(self.database_size)
+        return metadata
+
+
+def _previous_backup(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    prefix: str | None,
+) -> Manifest | None:
+    """Return the newest backup the adapter made, or None if there is none or it cannot be listed."""
+    try:
+        manifests = list_backups(storage_adapter, backup_adapter.database_name, prefix)
+    except StorageError as e:
+        logger.warning(f"Failed to list previous backups for the size estimate: {e}")
+        return None
+    return next((manifest for manifest in manifests if backup_adapter.is_own_backup(manifest.key)), None)
+
+
+def estimate_backup_size(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    size_ratio: float,
+    prefix: str | None = None,
+) -> SizeEstimate | None:
+    """Estimate the size of the next backup.
+
+    The database's size is scaled by the ratio the previous backup actually
+    had to its database, or by size_ratio until a backup recorded one, so
+    the estimate follows the data as it grows. Engines that cannot report
+    their size fall back to the size of the previous backup.
+
+    Args:
+        backup_adapter: Database backup adapter about to back up
+        storage_adapter: Primary storage holding previous backups
+        size_ratio: Expected ratio of backup to database size without history
+        prefix: Key prefix previous backups are listed under, by default the database name
+
+    Returns:
+        The estimate, or None when there is neither a database size nor a previous backup
+    """
+    database_size = backup_adapter.database_size()
+    previous = _previous_backup(backup_adapter, storage_adapter, prefix)
+
+    if database_size is not None:
+        if previous is not None and previous.database_size:
+            ratio = previous.size / previous.database_size
+            basis = f"the database size of {database_size} bytes and the ratio {ratio:.2f} of the previous backup"
+        else:
+            ratio = size_ratio
+            basis = f"the database size of {database_size} bytes and PREFLIGHT_SIZE_RATIO={size_ratio}"
+        return SizeEstimate(size=math.ceil(database_size * ratio), basis=basis, database_size=database_size)
+
+    if previous is not None:
+        return SizeEstimate(size=previous.size, basis=f"the size of the previous backup {previous.key}")
+    return None
+
+
+def check_temp_space(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    temp_path: Path,
+    config: PreflightConfig,
+    prefix: str | None = None,
+) -> SizeEstimate:
+    """Refuse to start a backup the temp directory has no room for.
+
+    Args:
+        backup_adapter: Database backup adapter about to back up
+        storage_adapter: Primary storage holding previous backups
+        temp_path: Directory the backup is written to
+        config: Size ratio and safety margin to apply
+        prefix: Key prefix previous backups are listed under, by default the database name
+
+    Returns:
+        The estimate the check was based on
+
+    Raises:
+        BackupError: If the size cannot be estimated, or less space than the estimate plus margin is free
+    """
+    estimate = estimate_backup_size(backup_adapter, storage_adapter, config.size_ratio, prefix)
+    if estimate is None:
+        raise BackupError(
+            f"Cannot estimate the size of the backup of '{backup_adapter.database_name}': "
+            "the database size is unknown and there is no previous backup. "
+            "Run 'nestvault backup --skip-preflight' for the first backup"
+        )
+
+    required = math.ceil(estimate.size * (100 + config.margin_percent) / 100)
+    free = shutil.disk_usage(temp_path).free
+    if free < required:
+        raise BackupError(
+            f"Not enough space in {temp_path.parent} for the backup of '{backup_adapter.database_name}': "
+            f"it is estimated at {estimate.size} bytes from {estimate.basis}, {required} bytes are needed "
+            f"with the {config.margin_percent}% margin, {free} bytes are free"
+        )
+
+    logger.info(f"Preflight passed: backup estimated at {estimate.size} bytes, {free} bytes free in {temp_path.parent}")
+    return estimate
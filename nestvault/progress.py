@@ -0,0 +1,269 @@
+"""Progress of long restores, logged periodically and drawn as a live line on terminals."""
+
+from __future__ import annotations
+
+import io
+import sys
+import threading
+import time
+from collections.abc import Iterator
+from contextlib import contextmanager
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.logging import get_logger
+
+logger = get_logger("progress")
+
+MIB = 1024 * 1024
+GIB = 1024 * MIB
+
+# Seconds between progress log lines, and between redraws of the progress line on a terminal
+PROGRESS_INTERVAL = 30.0
+REFRESH_INTERVAL = 0.5
+
+BAR_WIDTH = 20
+
+
+def _duration(seconds: float) -> str:
+    """Format seconds as e.g. '1h02m', '3m05s' or '42s'."""
+    seconds = int(seconds)
+    if seconds >= 3600:
+        return f"{seconds // 3600}h{seconds % 3600 // 60:02d}m"
+    if seconds >= 60:
+        return f"{seconds // 60}m{seconds % 60:02d}s"
+    return f"{seconds}s"
+
+
+def _size(count: float) -> str:
+    return f"{count / GIB:.1f} GiB" if count >= GIB else f"{count / MIB:.1f} MiB"
+
+
+class Progress:
+    """Counts the work done in one phase of a restore, e.g. bytes downloaded or tables restored.
+
+    Advanced from any thread; the total may be set once it is known, or
+    stay None when it cannot be.
+    """
+
+    def __init__(self, phase: str, total: int | None = None, unit: str = "bytes"):
+        """Initialize the counter.
+
+        Args:
+            phase: What is being done, e.g. 'download' or 'restore'
+            total: Units the phase will have done when complete, None when unknown
+            unit: 'bytes', or what else is counted, e.g. 'tables'
+        """
+        self.phase = phase
+        self.total = total
+        self.unit = unit
+        self.done = 0
+        # Tables loaded while counting bytes, e.g. the COPY statements of a plain dump
+        self.tables = 0
+        self.started = time.monotonic()
+        self.lock = threading.Lock()
+
+    def advance(self, count: int = 1) -> None:
+        with self.lock:
+            self.done += count
+
+    def update(self, done: int) -> None:
+        with self.lock:
+            self.done = done
+
+    @property
+    def elapsed(self) -> float:
+        return time.monotonic() - self.started
+
+    @property
+    def fraction(self) -> float | None:
+        """Return the share of the phase done, None when the total is unknown."""
+        if not self.total:
+            return None
+        return min(self.done / self.total, 1.0)
+
+    @property
+    def rate(self) -> float:
+        """Return the units done per second."""
+        return self.done / max(self.elapsed, 0.001)
+
+    @property
+    def eta(self) -> float | None:
+        """Return the seconds left at the rate so far, None when it cannot be told."""
+        if not self.total or not self.done:
+            return None
+        return max(self.total - self.done, 0) / self.rate
+
+    def _amount(self, count: float) -> str:
+        return _size(count) if self.unit == "bytes" else f"{int(count)} {self.unit}"
+
+    def describe(self, finished: bool = False) -> str:
+        """Return e.g. '1.2 GiB of 60.0 GiB (2%), 45.3 MiB/s, 22m10s left'; without the time left once finished."""
+        details = [self._amount(self.done)]
+        if self.fraction is not None:
+            details[0] += f" of {self._amount(self.total)} ({self.fraction:.0%})"
+        if self.unit == "bytes":
+            details.append(f"{self.rate / MIB:.1f} MiB/s")
+        if self.tables:
+            details.append(f"{self.tables} tables loaded")
+        eta = self.eta
+        if not finished:
+            details.append(f"{_duration(eta)} left" if eta is not None else f"{_duration(self.elapsed)} elapsed")
+        return ", ".join(details)
+
+    def bar(self) -> str:
+        """Return the phase as drawn on a terminal, e.g. 'Download [####----------------] 2.0 GiB of ...'."""
+        fraction = self.fraction
+        if fraction is None:
+            return f"{self.phase.capitalize()} {self.describe()}"
+        filled = int(fraction * BAR_WIDTH)
+        return f"{self.phase.capitalize()} [{'#' * filled}{'-' * (BAR_WIDTH - filled)}] {self.describe()}"
+
+    def snapshot(self) -> dict[str, str | int | float | None]:
+        """Return the numbers of the phase, for monitoring."""
+        return {
+            "phase": self.phase,
+            "unit": self.unit,
+            "done": self.done,
+            "total": self.total,
+            "tables": self.tables,
+            "elapsed_seconds": round(self.elapsed, 1),
+            "eta_seconds": round(self.eta, 1) if self.eta is not None else None,
+        }
+
+
+def download_progress(metadata: dict[str, str]) -> Progress:
+    """Return the progress counter of downloading a backup, of the size its metadata records."""
+    return Progress("download", int(metadata["size"]) if "size" in metadata else None)
+
+
+# Phases running in this process, in the order they started
+_active: list[Progress] = []
+_lock = threading.Lock()
+_reporter: threading.Thread | None = None
+
+
+def active() -> list[dict[str, str | int | float | None]]:
+    """Return the numbers of every phase running in this process, e.g. for a status endpoint or metrics."""
+    with _lock:
+        return [progress.snapshot() for progress in _active]
+
+
+def _clear_line() -> None:
+    sys.stdout.write("\r\033[K")
+    sys.stdout.flush()
+
+
+def _report() -> None:
+    """Log the running phases every PROGRESS_INTERVAL seconds and redraw them on a terminal, until none is left."""
+    global _reporter
+    terminal = sys.stdout.isatty()
+    logged = time.monotonic()
+
+    while True:
+        time.sleep(REFRESH_INTERVAL)
+        with _lock:
+            phases = list(_active)
+            if not phases:
+                _reporter = None
+                return
+
+        if terminal:
+            _clear_line()
+        if time.monotonic() - logged >= PROGRESS_INTERVAL:
+            logged = time.monotonic()
+            for progress in phases:
+                logger.info(f"{progress.phase.capitalize()}: {progress.describe()}")
+        if terminal:
+            sys.stdout.write(" | ".join(progress.bar() for progress in phases))
+            sys.stdout.flush()
+
+
+@contextmanager
+def reporting(progress: Progress) -> Iterator[Progress]:
+    """Report a phase while the block runs, and log where it ended."""
+    global _reporter
+    with _lock:
+        _active.append(progress)
+        if _reporter is None:
+            _reporter = threading.Thread(target=_report, daemon=True)
+            _reporter.start()
+
+    try:
+        yield progress
+    finally:
+        with _lock:
+            _active.remove(progress)
+        if sys.stdout.isatty():
+            _clear_line()
+        took = _duration(progress.elapsed)
+        logger.bind(duration=round(progress.elapsed, 3)).info(
+            f"{progress.phase.capitalize()} took {took}: {progress.describe(finished=True)}"
+        )
+
+
+@contextmanager
+def watching(directory: Path, progress: Progress) -> Iterator[Progress]:
+    """Count the bytes written into a directory while the block runs, e.g. by a download into it.
+
+    The directory is polled rather than the file, as some backends download
+    to a temporary name and rename it once complete.
+    """
+    stopped = threading.Event()
+
+    def poll() -> None:
+        try:
+            progress.update(sum(path.stat().st_size for path in directory.iterdir() if path.is_file()))
+        except OSError:
+            pass
+
+    def run() -> None:
+        while not stopped.wait(REFRESH_INTERVAL):
+            poll()
+
+    thread = threading.Thread(target=run, daemon=True)
+    thread.start()
+    try:
+        yield progress
+    finally:
+        stopped.set()
+        thread.join()
+        poll()
+
+
+class ProgressReader(io.RawIOBase):
+    """File-like wrapper advancing a progress counter by the bytes read from another stream.
+
+    With a marker, every occurrence of it in the data also counts as a
+    table loaded, e.g. b'\\nCOPY ' for the data of a table in a plain dump.
+    """
+
+    def __init__(self, stream: BinaryIO, progress: Progress, marker: bytes | None = None):
+        self.stream = stream
+        self.progress = progress
+        self.marker = marker
+        # End of the previous read, so a marker split between two reads is still counted
+        self.tail = b""
+
+    def readable(self) -> bool:
+        return True
+
+    def read(self, size: int = -1) -> bytes:
+        data = self.stream.read(size)
+        self.progress.advance(len(data))
+        if self.marker and data:
+            window = self.tail + data
+            self.progress.tables += window.count(self.marker)
+            self.tail = window[len(window) - len(self.marker) + 1:]
+        return data
+
+    def readinto(self, buffer) -> int:
+        data = self.read(len(buffer))
+        buffer[: len(data)] = data
+        return len(data)
+
+    def close(self) -> None:
+        """Close the reader and the stream it reads from."""
+        if not self.closed:
+            self.stream.close()
+        super().close()
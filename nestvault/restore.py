@@ -3,12 +3,21 @@
 from __future__ import annotations
 
 import tempfile
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
 from pathlib import Path
 
-from nestvault.backup.base import BackupAdapter
-from nestvault.exceptions import BackupError, StorageError
+from nestvault.backup.base import BackupAdapter, DestinationState, RestoreOptions
+from nestvault.backup.encrypted import EncryptedBackupAdapter
+from nestvault.download import download_backup
+from nestvault.encryption import Cipher
+from nestvault.exceptions import BackupError, IntegrityError, StorageError
 from nestvault.logging import get_logger
+from nestvault.manifest import Manifest, list_backups
+from nestvault.progress import Progress, ProgressReader, download_progress, reporting
 from nestvault.storage.base import StorageAdapter
+from nestvault.verify import ChecksumReader, check_download, check_stream
+from nestvault.wal import HISTORY_PATTERN, WAL_PREFIX, archived_segments, fetch_wal, wal_file_of
 
 logger = get_logger("restore")
 
@@ -16,29 +25,75 @@ logger = get_logger("restore")
 def list_available_backups(
     storage_adapter: StorageAdapter,
     database_name: str | None = None,
+    prefix: str | None = None,
 ) -> list[str]:
     """List available backups in storage.
 
     Args:
         storage_adapter: Storage adapter
-        database_name: Optional filter by database name prefix
+        database_name: Optional filter by database name
+        prefix: Key prefix to list, by default the database name
 
     Returns:
         List of backup keys sorted by date (newest first)
     """
-    prefix = database_name or ""
-    objects = storage_adapter.list(prefix=prefix)
+    return [manifest.key for manifest in list_backups(storage_adapter, database_name or None, prefix)]
 
-    # Sort by last_modified descending (newest first)
-    objects.sort(key=lambda x: x.last_modified, reverse=True)
 
-    return [obj.key for obj in objects]
+def _incompatibility(
+    backup_adapter: BackupAdapter, backup_key: str, metadata: dict[str, str], ignore_engine: bool = False
+) -> str | None:
+    """Return why a backup cannot be restored with an adapter, judging by its metadata, or None if it can.
+
+    With ignore_engine, a backup of another engine is only warned about.
+    """
+    engine = metadata.get("engine")
+    if engine is None:
+        logger.warning("Backup has no recorded engine (created by an older NestVault), skipping engine check")
+    elif engine != backup_adapter.engine:
+        mismatch = (
+            f"Backup {backup_key} was created by the '{engine}' engine "
+            f"and cannot be restored with the '{backup_adapter.engine}' engine"
+        )
+        if not ignore_engine:
+            return f"{mismatch}; pass --ignore-engine-mismatch to restore it anyway"
+        logger.warning(f"{mismatch}, restoring it anyway (--ignore-engine-mismatch)")
+
+    if "encryption" in metadata and not isinstance(backup_adapter, EncryptedBackupAdapter):
+        return (
+            f"Backup {backup_key} is encrypted with {metadata['encryption']}, "
+            f"set ENCRYPTION and the decryption key to restore it"
+        )
+    return None
+
+
+def _destination_problem(
+    destination: DestinationState | None, database_name: str, options: RestoreOptions
+) -> str | None:
+    """Return why a restore into the destination database is refused, or None if it is not.
+
+    A database holding tables is only restored into with force, or with
+    clean or drop_existing, which remove its objects on purpose.
+    """
+    if destination is None:
+        return None
+    if not destination.exists:
+        if options.create_database:
+            return None
+        return f"Destination database {database_name} does not exist, pass --create-database to create it"
+    if destination.tables and not (options.force or options.clean or options.drop_existing):
+        return (
+            f"Destination database {database_name} is not empty, it holds {destination.tables} tables; "
+            f"pass --force to restore into it anyway, or --clean to drop and recreate the backup's objects"
+        )
+    return None
 
 
 def restore_backup(
     storage_adapter: StorageAdapter,
     backup_adapter: BackupAdapter,
     backup_key: str,
+    options: RestoreOptions | None = None,
 ) -> bool:
     """Restore a specific backup.
 
@@ -46,25 +101,77 @@ def restore_backup(
         storage_adapter: Storage adapter to download from
         backup_adapter: Database backup adapter to restore with
         backup_key: Key of the backup to restore
+        options: Restore options passed to the backup adapter
 
     Returns:
         True if restore succeeded, False otherwise
     """
     logger.info(f"Starting restore of backup: {backup_key}")
 
+    options = options or RestoreOptions()
+
     try:
+        metadata = storage_adapter.get_metadata(backup_key)
+        problem = _incompatibility(backup_adapter, backup_key, metadata, options.ignore_mismatch)
+        if problem is not None:
+            logger.error(problem)
+            return False
+
+        options.metadata = metadata
+
+        # Listing a table of contents leaves the database alone
+        if not options.list_contents:
+            destination = backup_adapter.inspect_destination()
+            problem = _destination_problem(destination, backup_adapter.database_name, options)
+            if problem is not None:
+                logger.error(problem)
+                return False
+
+        if "compression" in metadata:
+            level = metadata.get("compression_level")
+            logger.info(f"Backup compression: {metadata['compression']}" + (f" (level {level})" if level else ""))
+
         with tempfile.TemporaryDirectory() as temp_dir:
             temp_path = Path(temp_dir)
-            local_file = temp_path / backup_key
+            # Keys rendered from a key template can contain slashes
+            local_file = temp_path / Path(backup_key).name
+            # A table of contents is read from a download, so the backup is checked before anything is listed
+            streamed = not options.list_contents and backup_adapter.supports_streaming_restore(metadata)
+
+            # Download backup from storage, unless it is streamed into the database as it is read
+            if not streamed or not storage_adapter.supports_streaming_download:
+                logger.info(f"Downloading backup from storage...")
+                download_backup(storage_adapter, backup_key, local_file, metadata, options.retry, options.resume)
+                logger.info(f"Downloaded: {local_file.name} ({local_file.stat().st_size} bytes)")
+                check_download(local_file, metadata, backup_key)
+
+            if options.with_globals:
+                globals_key = metadata.get("globals")
+                if not globals_key:
+                    logger.error(f"Backup {backup_key} has no globals companion, it was created without PG_BACKUP_GLOBALS")
+                    return False
 
-            # Download backup from storage
-            logger.info(f"Downloading backup from storage...")
-            storage_adapter.download(backup_key, local_file)
-            logger.info(f"Downloaded: {local_file.name} ({local_file.stat().st_size} bytes)")
+                options.companions["globals"] = temp_path / Path(globals_key).name
+                storage_adapter.download(globals_key, options.companions["globals"])
+                logger.info(f"Downloaded globals: {globals_key}")
+                check_download(options.companions["globals"], storage_adapter.get_metadata(globals_key), globals_key)
 
             # Restore to database
+            if options.list_contents:
+                logger.info("Reading the table of contents...")
+                backup_adapter.restore(local_file, options)
+                return True
+
             logger.info(f"Restoring to database...")
-            backup_adapter.restore(local_file)
+            options.progress = Progress("restore")
+            if not streamed:
+                with reporting(options.progress):
+                    backup_adapter.restore(local_file, options)
+            elif local_file.exists():
+                with open(local_file, "rb") as stream, reporting(options.progress):
+                    backup_adapter.restore_stream(local_file.name, stream, options)
+            elif not _restore_streamed(storage_adapter, backup_adapter, backup_key, options):
+                return False
 
         logger.info("Restore completed successfully")
         return True
@@ -72,6 +179,9 @@ def restore_backup(
     except StorageError as e:
         logger.error(f"Failed to download backup: {e}")
         return False
+    except IntegrityError as e:
+        logger.error(f"Backup failed its integrity check, nothing was restored: {e}")
+        return False
     except BackupError as e:
         logger.error(f"Failed to restore backup: {e}")
         return False
@@ -80,15 +190,128 @@ def restore_backup(
         return False
 
 
+@dataclass
+class RestorePlan:
+    """What restoring a backup would do, as restore --dry-run reports it."""
+
+    backup_key: str
+    # Whether the backup would be restored from a stream, and whether a local copy is downloaded first
+    streamed: bool = False
+    downloaded: bool = True
+    # Bytes that would be downloaded, when known
+    download_size: int | None = None
+    # Commands the restore would run, with secrets masked
+    commands: list[str] = field(default_factory=list)
+    destination: DestinationState | None = None
+    # Why the restore would fail; a plan without problems is possible
+    problems: list[str] = field(default_factory=list)
+
+    @property
+    def possible(self) -> bool:
+        return not self.problems
+
+
+def plan_restore(
+    storage_adapter: StorageAdapter,
+    backup_adapter: BackupAdapter,
+    manifest: Manifest,
+    options: RestoreOptions | None = None,
+) -> RestorePlan:
+    """Work out what restoring a backup would do, without downloading or changing anything.
+
+    Args:
+        storage_adapter: Storage adapter the backup would be downloaded from
+        backup_adapter: Database backup adapter it would be restored with
+        manifest: Manifest of the backup
+        options: Restore options the restore would use
+
+    Returns:
+        The plan, listing the problems that would make the restore fail
+    """
+    options = options or RestoreOptions()
+    plan = RestorePlan(backup_key=manifest.key)
+
+    try:
+        metadata = storage_adapter.get_metadata(manifest.key)
+    except StorageError as e:
+        plan.problems.append(f"Cannot read the metadata of backup {manifest.key}: {e}")
+        return plan
+
+    problem = _incompatibility(backup_adapter, manifest.key, metadata, options.ignore_mismatch)
+    if problem is not None:
+        plan.problems.append(problem)
+    options.metadata = metadata
+
+    plan.streamed = not options.list_contents and backup_adapter.supports_streaming_restore(metadata)
+    plan.downloaded = not plan.streamed or not storage_adapter.supports_streaming_download
+    # A deduplicated backup downloads its chunks, at most the size of the data they hold
+    plan.download_size = manifest.uncompressed_size if metadata.get("dedup") == "chunks" else manifest.size
+
+    if options.with_globals and not metadata.get("globals"):
+        plan.problems.append(
+            f"Backup {manifest.key} has no globals companion, it was created without PG_BACKUP_GLOBALS"
+        )
+
+    try:
+        plan.commands = backup_adapter.restore_commands(Path(manifest.key).name, options, plan.streamed)
+    except BackupError as e:
+        plan.problems.append(str(e))
+
+    try:
+        plan.destination = backup_adapter.inspect_destination()
+    except BackupError as e:
+        plan.problems.append(f"Destination {backup_adapter.location} is unreachable: {e}")
+
+    problem = _destination_problem(plan.destination, backup_adapter.database_name, options)
+    if problem is not None:
+        plan.problems.append(problem)
+    return plan
+
+
+def _restore_streamed(
+    storage_adapter: StorageAdapter,
+    backup_adapter: BackupAdapter,
+    backup_key: str,
+    options: RestoreOptions,
+) -> bool:
+    """Restore a backup as it is read from storage, without a local copy.
+
+    The checksum can only be compared once the whole backup has been
+    read, so a mismatch is reported after the database was restored
+    from it. Encrypted backups are authenticated chunk by chunk, so
+    their restore stops at the first corrupted chunk instead.
+
+    Returns:
+        True if the restore succeeded and the backup matched its checksum
+    """
+    logger.info("Streaming backup from storage into the database...")
+    download = download_progress(options.metadata)
+    with ChecksumReader(ProgressReader(storage_adapter.open_download(backup_key), download)) as stream:
+        try:
+            with reporting(download), reporting(options.progress):
+                backup_adapter.restore_stream(Path(backup_key).name, stream, options)
+            check_stream(stream, options.metadata, backup_key)
+        except IntegrityError as e:
+            logger.error(f"Backup failed its integrity check, the database may hold part of it or corrupted data: {e}")
+            return False
+
+    logger.info(f"Streamed {stream.size} bytes from storage")
+    return True
+
+
 def restore_latest_backup(
     storage_adapter: StorageAdapter,
     backup_adapter: BackupAdapter,
+    options: RestoreOptions | None = None,
+    prefix: str | None = None,
 ) -> bool:
     """Restore the most recent backup for the configured database.
 
     Args:
         storage_adapter: Storage adapter to download from
         backup_adapter: Database backup adapter to restore with
+        options: Restore options passed to the backup adapter
+        prefix: Key prefix the backups are listed under, by default the database name
 
     Returns:
         True if restore succeeded, False otherwise
@@ -96,7 +319,10 @@ def restore_latest_backup(
     database_name = backup_adapter.database_name
     logger.info(f"Finding latest backup for database: {database_name}")
 
-    backups = list_available_backups(storage_adapter, database_name)
+    backups = [
+        key for key in list_available_backups(storage_adapter, database_name, prefix)
+        if backup_adapter.is_own_backup(key)
+    ]
 
     if not backups:
         logger.error(f"No backups found for database: {database_name}")
@@ -105,4 +331,132 @@ def restore_latest_backup(
     latest = backups[0]
     logger.info(f"Found {len(backups)} backups, restoring latest: {latest}")
 
-    return restore_backup(storage_adapter, backup_adapter, latest)
+    return restore_backup(storage_adapter, backup_adapter, latest, options)
+
+
+def _as_utc(moment: datetime) -> datetime:
+    return moment.replace(tzinfo=timezone.utc) if moment.tzinfo is None else moment
+
+
+def plan_point_in_time(
+    storage_adapter: StorageAdapter,
+    backup_adapter: BackupAdapter,
+    target_time: datetime,
+    prefix: str | None = None,
+) -> tuple[Manifest, list[str]]:
+    """Pick the base backup and the archived WAL needed to recover to a point in time.
+
+    The recoverable window runs from the end of the oldest base backup
+    that records its WAL start to the newest archived segment.
+
+    Args:
+        storage_adapter: Storage adapter holding the base backups and WAL
+        backup_adapter: PostgreSQL backup adapter of the base backups
+        target_time: Time to recover to; naive times are UTC
+        prefix: Key prefix the base backups are listed under, by default the database name
+
+    Returns:
+        The newest base backup finished before the target, and the WAL files to download
+
+    Raises:
+        BackupError: If the target is outside the recoverable window
+    """
+    target_time = _as_utc(target_time)
+    base_backups = [
+        manifest
+        for manifest in list_backups(storage_adapter, backup_adapter.database_name, prefix)
+        if "wal_start" in manifest.metadata and backup_adapter.is_own_backup(manifest.key)
+    ]
+    segments = archived_segments(storage_adapter)
+    if not base_backups or not segments:
+        raise BackupError("No base backup with archived WAL found, point-in-time restore needs PG_WAL_ARCHIVE")
+
+    earliest = min(_as_utc(manifest.finished_at) for manifest in base_backups)
+    latest = max(_as_utc(obj.last_modified) for obj in segments)
+    if not earliest <= target_time <= latest:
+        raise BackupError(
+            f"Target time {target_time.isoformat()} is outside the recoverable window "
+            f"{earliest.isoformat()} to {latest.isoformat()}"
+        )
+
+    base = max(
+        (manifest for manifest in base_backups if _as_utc(manifest.finished_at) <= target_time),
+        key=lambda manifest: manifest.finished_at,
+    )
+    start = base.metadata["wal_start"][8:]
+
+    # Every segment from the base backup's start up to the first one archived after the target
+    wal_files = []
+    for obj in segments:
+        name = wal_file_of(obj.key)
+        if name[8:24] < start:
+            continue
+        wal_files.append(name)
+        if _as_utc(obj.last_modified) > target_time:
+            break
+
+    history = [
+        wal_file_of(obj.key)
+        for obj in storage_adapter.list(prefix=WAL_PREFIX)
+        if HISTORY_PATTERN.fullmatch(wal_file_of(obj.key))
+    ]
+    return base, history + wal_files
+
+
+def restore_to_time(
+    storage_adapter: StorageAdapter,
+    backup_adapter: BackupAdapter,
+    target_time: datetime,
+    data_dir: Path,
+    wal_dir: Path,
+    cipher: Cipher | None = None,
+    target_name: str | None = None,
+    prefix: str | None = None,
+) -> bool:
+    """Restore a physical base backup and the WAL to recover it to a point in time.
+
+    The base backup is extracted into the data directory and the WAL it
+    needs is downloaded into its own directory. The data directory is set
+    up to recover up to the target time with `nestvault wal-fetch` as its
+    restore_command, reading the downloaded WAL first; starting PostgreSQL
+    on it performs the recovery.
+
+    Args:
+        storage_adapter: Storage adapter holding the base backups and WAL
+        backup_adapter: PostgreSQL backup adapter to restore with
+        target_time: Time to recover to; naive times are UTC
+        data_dir: Empty data directory to extract the base backup into
+        wal_dir: Directory to download the WAL into
+        cipher: Cipher to decrypt encrypted WAL with
+        target_name: Backup target restore_command fetches from when TARGETS lists several
+        prefix: Key prefix the base backups are listed under, by default the database name
+
+    Returns:
+        True if the restore succeeded, False otherwise
+    """
+    target_time = _as_utc(target_time)
+
+    try:
+        base, wal_files = plan_point_in_time(storage_adapter, backup_adapter, target_time, prefix)
+        logger.info(f"Recovering to {target_time.isoformat()} from {base.key} and {len(wal_files)} WAL files")
+
+        wal_dir.mkdir(parents=True, exist_ok=True, mode=0o700)
+        for name in wal_files:
+            fetch_wal(storage_adapter, name, wal_dir / name, cipher)
+    except (BackupError, StorageError, IntegrityError, OSError) as e:
+        logger.error(f"Point-in-time restore failed, nothing was restored: {e}")
+        return False
+
+    restore_command = f"nestvault wal-fetch %f %p --source-dir {wal_dir.resolve()}"
+    if target_name:
+        restore_command += f" --target {target_name}"
+
+    options = RestoreOptions(
+        data_dir=data_dir,
+        recovery={
+            "restore_command": restore_command,
+            "recovery_target_time": target_time.isoformat(sep=" "),
+            "recovery_target_action": "promote",
+        },
+    )
+    return restore_backup(storage_adapter, backup_adapter, base.key, options)
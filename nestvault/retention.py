@@ -2,14 +2,162 @@
 
 from __future__ import annotations
 
-from datetime import datetime, timedelta, timezone
+import re
+from collections.abc import Callable, Collection
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta, timezone, tzinfo
 
+from nestvault.audit import record_outcome, record_start
 from nestvault.exceptions import RetentionError
+from nestvault.hold import read_holds
 from nestvault.logging import get_logger
+from nestvault.manifest import Manifest, backup_objects, describe_backups
+from nestvault.metrics import PRUNED
+from nestvault.naming import RESERVED_PREFIXES
 from nestvault.storage.base import StorageAdapter, StorageObject
 
 logger = get_logger("retention")
 
+MIB = 1024**2
+GIB = 1024**3
+
+# How each kind of GFS period names the period a time falls in
+GFS_PERIODS: dict[str, Callable[[datetime], str]] = {
+    "hourly": lambda time: time.strftime("%Y-%m-%d %H:00"),
+    "daily": lambda time: time.strftime("%Y-%m-%d"),
+    "weekly": lambda time: "{}-W{:02d}".format(*time.isocalendar()[:2]),
+    "monthly": lambda time: time.strftime("%Y-%m"),
+    "yearly": lambda time: time.strftime("%Y"),
+}
+
+
+@dataclass
+class GfsPolicy:
+    """Grandfather-father-son retention: how many of the latest hours, days, weeks, months and years keep a backup.
+
+    Like restic's --keep-* options, the newest backup of each of the latest
+    periods that have a backup is kept, so one backup can be kept for
+    several reasons, e.g. as the newest of its day and of its month.
+    """
+
+    keep_hourly: int = 0
+    keep_daily: int = 0
+    keep_weekly: int = 0
+    keep_monthly: int = 0
+    keep_yearly: int = 0
+    # Timezone periods are counted in, so a day ends at local midnight
+    tz: tzinfo = timezone.utc
+
+    def counts(self) -> dict[str, int]:
+        """Return the periods kept of each kind, by GFS_PERIODS name."""
+        return {
+            "hourly": self.keep_hourly,
+            "daily": self.keep_daily,
+            "weekly": self.keep_weekly,
+            "monthly": self.keep_monthly,
+            "yearly": self.keep_yearly,
+        }
+
+    def describe(self) -> str:
+        """Return e.g. '24 hourly, 7 daily, 12 monthly'."""
+        return ", ".join(f"{count} {kind}" for kind, count in self.counts().items() if count)
+
+
+@dataclass
+class RetentionLimits:
+    """Caps on the backups of a database on one storage, applied after the retention rules."""
+
+    # Bytes the backups may take up in total, None for no cap
+    max_total_size: int | None = None
+    # Days after which a backup is deleted whatever the retention rules keep, None for no cap
+    max_age_days: int | None = None
+
+    def describe(self) -> str:
+        """Return e.g. 'max_total_size=500.0 GiB, max_age_days=180'."""
+        limits = []
+        if self.max_total_size is not None:
+            limits.append(f"max_total_size={_size(self.max_total_size)}")
+        if self.max_age_days is not None:
+            limits.append(f"max_age_days={self.max_age_days}")
+        return ", ".join(limits)
+
+
+@dataclass
+class Decision:
+    """What retention does with one stored object, and why."""
+
+    key: str
+    size: int
+    delete: bool
+    reason: str
+    # Key of the held backup the object belongs to, which keeps it whatever was decided
+    held: str | None = None
+
+
+@dataclass
+class PruneReport:
+    """The decisions of a retention run, over every object it considered."""
+
+    decisions: list[Decision] = field(default_factory=list)
+
+    @classmethod
+    def combined(cls, reports: list[PruneReport]) -> PruneReport:
+        """Combine the reports of successive runs over the same objects, one decision per object.
+
+        A later decision to delete an object wins; otherwise the first
+        reason given for keeping it stands.
+        """
+        decisions: dict[str, Decision] = {}
+        for report in reports:
+            for decision in report.decisions:
+                if decision.key not in decisions or decision.delete:
+                    decisions[decision.key] = decision
+        return cls(list(decisions.values()))
+
+    @property
+    def deleted(self) -> int:
+        """Return the objects deleted, or that would be on a dry run."""
+        return sum(1 for decision in self.decisions if decision.delete)
+
+    @property
+    def held(self) -> list[str]:
+        """Return the keys of the held backups kept."""
+        return sorted({decision.held for decision in self.decisions if decision.held})
+
+    @property
+    def reclaimed_bytes(self) -> int:
+        return sum(decision.size for decision in self.decisions if decision.delete)
+
+    @property
+    def remaining_bytes(self) -> int:
+        return sum(decision.size for decision in self.decisions if not decision.delete)
+
+
+def _size(count: int) -> str:
+    """Format bytes as e.g. '500.0 GiB', '12.5 MiB' or '300 bytes'."""
+    if count >= GIB:
+        return f"{count / GIB:.1f} GiB"
+    if count >= MIB:
+        return f"{count / MIB:.1f} MiB"
+    return f"{count} bytes"
+
+
+def is_backup_of(key: str, database_name: str) -> bool:
+    """Check whether a storage key belongs to the given database.
+
+    Backup keys are named `<database>_<YYYYmmdd>_<HHMMSS>.<ext>`, so a plain
+    prefix match would also pick up databases that share a name prefix
+    (e.g. `tenant` and `tenant_staging`).
+
+    Args:
+        key: Storage object key
+        database_name: Database name the backup should belong to
+
+    Returns:
+        True if the key is a backup of exactly this database
+    """
+    return re.match(rf"{re.escape(database_name)}_\d{{8}}_\d{{6}}\.", key) is not None
+
 
 def get_expired_backups(
     objects: list[StorageObject],
@@ -43,44 +191,359 @@ def get_expired_backups(
     return expired
 
 
+def plan_gfs(manifests: list[Manifest], policy: GfsPolicy) -> dict[str, list[str]]:
+    """Return the backups a GFS policy keeps, each with why, e.g. {'db_...': ['daily 2024-01-15', 'monthly 2024-01']}.
+
+    The newest successful backup is kept even when the policy keeps none: a
+    backup is successful when it has a manifest, which is only written once
+    its upload completed.
+
+    Args:
+        manifests: Backups to plan, in any order
+        policy: Periods to keep backups of
+
+    Returns:
+        Reasons to keep each kept backup by key; backups missing from it are deleted
+    """
+    newest_first = sorted(manifests, key=lambda manifest: manifest.finished_at, reverse=True)
+    kept: dict[str, list[str]] = {}
+
+    for kind, count in policy.counts().items():
+        periods: list[str] = []
+        for manifest in newest_first:
+            if len(periods) >= count:
+                break
+            finished_at = manifest.finished_at
+            if finished_at.tzinfo is None:
+                finished_at = finished_at.replace(tzinfo=timezone.utc)
+            period = GFS_PERIODS[kind](finished_at.astimezone(policy.tz))
+            if periods and periods[-1] == period:
+                continue
+            periods.append(period)
+            kept.setdefault(manifest.key, []).append(f"{kind} {period}")
+
+    successful = [manifest for manifest in newest_first if not manifest.legacy]
+    if successful and not any(manifest.key in kept for manifest in successful):
+        kept[successful[0].key] = ["only successful backup left"]
+
+    return kept
+
+
+def _decide_by_age(objects: list[StorageObject], retention_days: int) -> list[Decision]:
+    """Decide to delete every object older than the retention period."""
+    expired = {obj.key for obj in get_expired_backups(objects, retention_days)}
+    decisions = []
+    for obj in objects:
+        reason = f"{'older' if obj.key in expired else 'newer'} than {retention_days} days"
+        decisions.append(Decision(obj.key, obj.size, obj.key in expired, reason))
+    return decisions
+
+
+def _decide_by_gfs(storage: StorageAdapter, objects: list[StorageObject], policy: GfsPolicy) -> list[Decision]:
+    """Plan a GFS policy over the backups in a listing, deciding for each of their objects and logging why."""
+    backups = describe_backups(storage, objects)
+    kept = plan_gfs([manifest for manifest, _ in backups], policy)
+    decisions = []
+
+    for manifest, parts in backups:
+        if manifest.key in kept:
+            reason = ", ".join(kept[manifest.key])
+            logger.info(f"Keeping {manifest.key}: {reason}")
+        else:
+            reason = "not the newest backup of any kept period"
+            logger.info(f"Deciding to delete {manifest.key}: {reason}")
+        decisions.extend(Decision(part.key, part.size, manifest.key not in kept, reason) for part in parts)
+
+    # Objects of no backup, such as orphaned companions, are left alone
+    decided = {decision.key for decision in decisions}
+    decisions.extend(
+        Decision(obj.key, obj.size, False, "part of no backup") for obj in objects if obj.key not in decided
+    )
+    return decisions
+
+
+def _keep_held(storage: StorageAdapter, objects: list[StorageObject], decisions: list[Decision]) -> None:
+    """Keep every object of a held backup, whatever retention decided for it."""
+    holds = read_holds(storage, objects)
+    if not holds:
+        return
+
+    held_parts = {
+        part.key: manifest.key
+        for manifest, parts in describe_backups(storage, objects)
+        if manifest.key in holds
+        for part in parts
+    }
+    for decision in decisions:
+        backup = held_parts.get(decision.key)
+        if backup is None:
+            continue
+        decision.held = backup
+        if decision.delete:
+            decision.delete = False
+            decision.reason = f"{holds[backup].describe()}, though {decision.reason}"
+
+    for backup in sorted(set(held_parts.values())):
+        logger.info(f"Keeping {backup}: {holds[backup].describe()}")
+
+
+def _select_objects(
+    storage: StorageAdapter,
+    prefix: str,
+    database_name: str | None,
+    owns: Callable[[str], bool] | None,
+    tier: str | None,
+) -> list[StorageObject]:
+    """List the objects a retention run considers."""
+    objects = storage.list(prefix=prefix)
+    if database_name is not None:
+        objects = backup_objects(storage, objects, database_name, tier)
+    if owns is not None:
+        objects = [obj for obj in objects if owns(obj.key)]
+    logger.debug(f"Found {len(objects)} total objects")
+    return objects
+
+
+def _delete_decided(
+    storage: StorageAdapter,
+    decisions: list[Decision],
+    on_expire: Callable[[str], None] | None,
+    dry_run: bool,
+    database_name: str | None = None,
+) -> PruneReport:
+    """Delete the objects decided to be deleted, keeping those whose on_expire callback fails.
+
+    Every deletion is recorded in the audit trail before it is made, and
+    again with its outcome.
+    """
+    report = PruneReport(decisions)
+    expired = [decision for decision in decisions if decision.delete]
+
+    if not expired:
+        logger.info("No expired backups to delete")
+        return report
+
+    if dry_run:
+        for decision in expired:
+            logger.info(f"Would delete {decision.key}: {decision.reason}")
+        logger.info(f"Retention dry run completed: would delete {len(expired)} objects")
+        return report
+
+    logger.info(f"Found {len(expired)} expired backups to delete")
+    started = [
+        record_start(storage, "prune", decision.key, database=database_name, reason=decision.reason)
+        for decision in expired
+    ]
+
+    for decision in expired:
+        if on_expire is not None:
+            try:
+                on_expire(decision.key)
+            except Exception as e:
+                logger.error(f"Failed to delete data of {decision.key}, keeping it: {e}")
+                decision.delete = False
+                decision.reason = f"deleting its data failed: {e}"
+
+    try:
+        storage.delete_many([decision.key for decision in expired if decision.delete])
+    except Exception as e:
+        for event in started:
+            record_outcome(storage, event, False, str(e))
+        raise
+    for decision, event in zip(expired, started):
+        record_outcome(storage, event, decision.delete, decision.reason)
+    PRUNED.inc(report.deleted)
+
+    logger.info(f"Retention cleanup completed: deleted {report.deleted} backups")
+    return report
+
+
+def prune_backups(
+    storage: StorageAdapter,
+    retention_days: int | None,
+    prefix: str = "",
+    database_name: str | None = None,
+    owns: Callable[[str], bool] | None = None,
+    on_expire: Callable[[str], None] | None = None,
+    tier: str | None = None,
+    policy: GfsPolicy | None = None,
+    dry_run: bool = False,
+) -> PruneReport:
+    """Delete backups older than the retention period, or that a GFS policy does not keep.
+
+    Under a GFS policy, a backup is deleted together with its manifest and
+    companions; objects of no backup, such as orphaned companions, are left.
+    Every object of a held backup is kept until its hold is released.
+
+    Args:
+        storage: Storage adapter to use
+        retention_days: Number of days to retain backups, unused with a policy
+        prefix: Optional prefix to filter backups
+        database_name: Only consider backups of exactly this database, as
+            their manifests record it, so any key template can be pruned
+        owns: Only consider keys this returns True for, e.g. an adapter's is_own_backup
+        on_expire: Called with each expired key before it is deleted; a
+            backup whose callback fails is kept and retried next time
+        tier: With database_name, only consider backups of this tier of a target with tiers
+        policy: GFS policy deciding which backups to keep instead of their age
+        dry_run: Only log what would be deleted
+
+    Returns:
+        What was decided for every object considered
+
+    Raises:
+        RetentionError: If cleanup fails
+    """
+    rule = f"policy={policy.describe()}" if policy is not None else f"retention_days={retention_days}"
+    logger.info(
+        f"Starting retention cleanup ({rule}{f', tier={tier}' if tier else ''}){' as a dry run' if dry_run else ''}"
+    )
+
+    try:
+        objects = _select_objects(storage, prefix, database_name, owns, tier)
+        if policy is not None:
+            decisions = _decide_by_gfs(storage, objects, policy)
+        else:
+            decisions = _decide_by_age(objects, retention_days)  # type: ignore[arg-type]
+        _keep_held(storage, objects, decisions)
+        return _delete_decided(storage, decisions, on_expire, dry_run, database_name)
+
+    except Exception as e:
+        logger.error(f"Retention cleanup failed: {e}")
+        raise RetentionError(f"Failed to cleanup old backups: {e}")
+
+
 def cleanup_old_backups(
     storage: StorageAdapter,
-    retention_days: int,
+    retention_days: int | None,
     prefix: str = "",
+    database_name: str | None = None,
+    owns: Callable[[str], bool] | None = None,
+    on_expire: Callable[[str], None] | None = None,
+    tier: str | None = None,
+    policy: GfsPolicy | None = None,
+    dry_run: bool = False,
 ) -> int:
-    """Delete backups older than the retention period.
+    """Apply retention like prune_backups, returning the number of objects deleted, or that would be with dry_run.
+
+    Raises:
+        RetentionError: If cleanup fails
+    """
+    return prune_backups(
+        storage, retention_days, prefix, database_name, owns, on_expire, tier, policy, dry_run
+    ).deleted
+
+
+def limit_backups(
+    storage: StorageAdapter,
+    limits: RetentionLimits,
+    prefix: str = "",
+    database_name: str | None = None,
+    owns: Callable[[str], bool] | None = None,
+    on_expire: Callable[[str], None] | None = None,
+    dry_run: bool = False,
+    pruned: Collection[str] = (),
+) -> PruneReport:
+    """Delete the backups of a database past the maximum age, then the oldest until they fit the maximum size.
+
+    Runs after retention, over every tier, so a backup stays only when the
+    retention rules and the limits both keep it. The newest successful
+    backup is kept even when it is past a limit.
 
     Args:
         storage: Storage adapter to use
-        retention_days: Number of days to retain backups
+        limits: Maximum age and total size of the backups
         prefix: Optional prefix to filter backups
+        database_name: Only consider backups of exactly this database
+        owns: Only consider keys this returns True for, e.g. an adapter's is_own_backup
+        on_expire: Called with each expired key before it is deleted, as with prune_backups
+        dry_run: Only log what would be deleted
+        pruned: Keys retention already deleted, or would have on a dry run, which are not counted
 
     Returns:
-        Number of backups deleted
+        What was decided for every object considered
 
     Raises:
         RetentionError: If cleanup fails
     """
-    logger.info(f"Starting retention cleanup (retention_days={retention_days})")
+    logger.info(f"Starting retention limits ({limits.describe()}){' as a dry run' if dry_run else ''}")
 
     try:
-        objects = storage.list(prefix=prefix)
-        logger.debug(f"Found {len(objects)} total objects")
+        objects = [obj for obj in _select_objects(storage, prefix, database_name, owns, None) if obj.key not in pruned]
+        backups = describe_backups(storage, objects)
+        newest_successful = next((manifest.key for manifest, _ in backups if not manifest.legacy), None)
+        cutoff = None
+        if limits.max_age_days is not None:
+            cutoff = datetime.now(timezone.utc) - timedelta(days=limits.max_age_days)
+
+        decisions = []
+        total = 0
+        full = False
+        for manifest, parts in backups:
+            size = sum(part.size for part in parts)
+            finished_at = manifest.finished_at
+            if finished_at.tzinfo is None:
+                finished_at = finished_at.replace(tzinfo=timezone.utc)
+
+            reason = "within the limits"
+            if cutoff is not None and finished_at < cutoff:
+                reason = f"older than {limits.max_age_days} days"
+            elif limits.max_total_size is not None and (full or total + size > limits.max_total_size):
+                # Every older backup goes too, so the oldest are deleted first
+                full = True
+                reason = f"newer backups fill the {_size(limits.max_total_size)} size limit"
+            delete = reason != "within the limits"
 
-        expired = get_expired_backups(objects, retention_days)
+            if delete and manifest.key == newest_successful:
+                logger.warning(f"Keeping {manifest.key}, {reason}: it is the only successful backup left")
+                delete, reason = False, f"only successful backup left, though {reason}"
+            elif delete:
+                logger.info(f"Deciding to delete {manifest.key}: {reason}")
+            if not delete:
+                total += size
+            decisions.extend(Decision(part.key, part.size, delete, reason) for part in parts)
+
+        _keep_held(storage, objects, decisions)
+        report = _delete_decided(storage, decisions, on_expire, dry_run, database_name)
+        logger.info(f"Retention limits leave {_size(report.remaining_bytes)} ({report.remaining_bytes} bytes)")
+        return report
+
+    except Exception as e:
+        logger.error(f"Retention limits failed: {e}")
+        raise RetentionError(f"Failed to apply retention limits: {e}")
 
-        if not expired:
-            logger.info("No expired backups to delete")
-            return 0
 
-        logger.info(f"Found {len(expired)} expired backups to delete")
+def find_orphans(storage: StorageAdapter, owners: list[tuple[str, str, Callable[[str], bool]]]) -> list[Decision]:
+    """List the objects on a storage that belong to no backup of a configured database, deleting none.
 
-        keys_to_delete = [obj.key for obj in expired]
-        storage.delete_many(keys_to_delete)
+    Objects under the reserved prefixes, e.g. WAL, chunks, restore records
+    and the audit trail, are not considered.
 
-        logger.info(f"Retention cleanup completed: deleted {len(expired)} backups")
-        return len(expired)
+    Args:
+        storage: Storage adapter to list
+        owners: Key prefix, database name and is_own_backup of every configured
+            database, whichever target it belongs to, so that targets sharing
+            the storage do not count each other's backups as orphans
 
+    Raises:
+        RetentionError: If listing fails
+    """
+    try:
+        objects = [obj for obj in storage.list() if not obj.key.startswith(RESERVED_PREFIXES)]
+        claimed = set()
+        for prefix, database_name, owns in owners:
+            listed = [obj for obj in objects if obj.key.startswith(prefix)]
+            claimed.update(obj.key for obj in backup_objects(storage, listed, database_name) if owns(obj.key))
     except Exception as e:
-        logger.error(f"Retention cleanup failed: {e}")
-        raise RetentionError(f"Failed to cleanup old backups: {e}")
+        logger.error(f"Listing orphaned objects failed: {e}")
+        raise RetentionError(f"Failed to list orphaned objects: {e}")
+
+    orphans = [
+        Decision(obj.key, obj.size, False, "part of no backup of a configured database")
+        for obj in objects
+        if obj.key not in claimed
+    ]
+    for orphan in orphans:
+        logger.info(f"Orphaned object {orphan.key} ({_size(orphan.size)}): {orphan.reason}")
+    logger.info(f"Found {len(orphans)} orphaned objects, {_size(sum(orphan.size for orphan in orphans))}")
+    return orphans
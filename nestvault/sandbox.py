@@ -0,0 +1,133 @@
+"""Scratch PostgreSQL databases that backups are test-restored into, and the checks run against them."""
+
+from __future__ import annotations
+
+import secrets
+import subprocess
+import time
+import uuid
+from collections.abc import Iterator
+from contextlib import contextmanager
+from dataclasses import dataclass
+from urllib.parse import quote
+
+from nestvault.backup.postgres import PostgresBackupAdapter
+from nestvault.config import RestoreVerifyConfig
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("sandbox")
+
+# Prefix of the scratch databases and containers backups are restored into
+SCRATCH_PREFIX = "nestvault_verify_"
+
+
+@dataclass
+class CheckResult:
+    """Outcome of one validation query run against a restored backup."""
+
+    query: str
+    passed: bool
+    # What the query returned, or why it failed
+    output: str
+
+
+def scratch_name() -> str:
+    """Return a fresh name for a scratch database or container, e.g. 'nestvault_verify_1a2b3c4d'."""
+    return f"{SCRATCH_PREFIX}{uuid.uuid4().hex[:8]}"
+
+
+def _docker(*args: str) -> str:
+    """Run a docker command and return its output.
+
+    Raises:
+        BackupError: If docker cannot be run or the command fails
+    """
+    try:
+        result = subprocess.run(["docker", *args], capture_output=True, check=True)
+    except FileNotFoundError:
+        raise BackupError("docker is not installed; mount the Docker socket and install the Docker CLI")
+    except subprocess.CalledProcessError as e:
+        error_msg = e.stderr.decode(errors="replace").strip() if e.stderr else str(e)
+        raise BackupError(f"docker {args[0]} failed: {error_msg}")
+    return result.stdout.decode().strip()
+
+
+def _wait_ready(dsn: str, timeout: int) -> None:
+    """Wait until the PostgreSQL server of a connection URL accepts queries.
+
+    Raises:
+        BackupError: If it does not within timeout seconds
+    """
+    deadline = time.monotonic() + timeout
+    while True:
+        result = subprocess.run(["psql", dsn, "-At", "-c", "SELECT 1"], capture_output=True)
+        if result.returncode == 0:
+            return
+        if time.monotonic() > deadline:
+            error_msg = result.stderr.decode(errors="replace").strip()
+            raise BackupError(f"Scratch server did not accept connections within {timeout} seconds: {error_msg}")
+        time.sleep(1)
+
+
+@contextmanager
+def docker_server(config: RestoreVerifyConfig) -> Iterator[str]:
+    """Start a PostgreSQL container, yield a connection URL to it, and remove it afterwards.
+
+    On a Docker network, the container is reached by its name, so
+    NestVault has to run in the same network; otherwise by its address
+    on the default bridge.
+
+    Raises:
+        BackupError: If the container cannot be started or does not become ready
+    """
+    name = scratch_name().replace("_", "-")
+    password = secrets.token_urlsafe(16)
+    network = ["--network", config.docker_network] if config.docker_network else []
+
+    logger.info(f"Starting scratch container {name} from {config.docker_image}")
+    _docker("run", "-d", "--rm", "--name", name, "-e", f"POSTGRES_PASSWORD={password}", *network, config.docker_image)
+    try:
+        if config.docker_network:
+            host = name
+        else:
+            host = _docker("inspect", "-f", "{{.NetworkSettings.IPAddress}}", name)
+        # The scratch server has no TLS, whatever the target's own server requires
+        dsn = f"postgresql://postgres:{quote(password, safe='')}@{host}:5432/postgres?sslmode=disable"
+        _wait_ready(dsn, config.timeout_seconds)
+        yield dsn
+    finally:
+        try:
+            _docker("rm", "-f", name)
+            logger.info(f"Removed scratch container {name}")
+        except BackupError as e:
+            logger.warning(f"Failed to remove scratch container {name}, remove it by hand: {e}")
+
+
+@contextmanager
+def scratch_server(config: RestoreVerifyConfig) -> Iterator[str]:
+    """Yield a connection URL to the server scratch databases are created on, starting a container if configured."""
+    if config.docker_image:
+        with docker_server(config) as dsn:
+            yield dsn
+    else:
+        yield config.dsn
+
+
+def run_checks(adapter: PostgresBackupAdapter, queries: list[str]) -> list[CheckResult]:
+    """Run the validation queries against a restored database; each passes if it returns true."""
+    results = []
+    for query in queries:
+        try:
+            output = adapter.query(query)
+        except BackupError as e:
+            logger.error(f"Check failed: {e}")
+            results.append(CheckResult(query, False, str(e)))
+            continue
+
+        if output == "t":
+            logger.info(f"Check passed: {query}")
+        else:
+            logger.error(f"Check failed: {query} returned {output!r}, expected true")
+        results.append(CheckResult(query, output == "t", output))
+    return results
@@ -2,121 +2,1703 @@
 
 from __future__ import annotations
 
+import random
+import shutil
 import tempfile
+import threading
 import time
-from datetime import datetime, timezone
+import uuid
+from collections.abc import Callable, Sequence
+from concurrent.futures import ThreadPoolExecutor
+from contextlib import ExitStack
+from dataclasses import dataclass, field, replace
+from datetime import datetime, timedelta, timezone, tzinfo
 from pathlib import Path
 
 from croniter import croniter
 
 from nestvault.backup.base import BackupAdapter
-from nestvault.config import Config
-from nestvault.exceptions import BackupError, StorageError
-from nestvault.logging import get_logger
-from nestvault.retention import cleanup_old_backups
+from nestvault.catchup import last_run, record_run
+from nestvault.config import HooksConfig, PreflightConfig
+from nestvault.dedup import collect_chunks
+from nestvault.credentials import CredentialProvider, leased_credentials
+from nestvault.exceptions import BackupError, CredentialError, HookError, RetentionError, StorageError, TunnelError
+from nestvault.hooks import HookContext, file_size, run_post_hooks, run_pre_backup_hooks
+from nestvault.lock import check_lock, target_lock
+from nestvault.preflight import check_temp_space
+from nestvault.logging import capturing, get_logger, log_context, target_context
+from nestvault.manifest import (
+    Manifest,
+    backup_objects,
+    build_manifest,
+    format_labels,
+    list_backups,
+    write_manifest,
+    write_unchanged_record,
+)
+from nestvault.metrics import record_backup, record_tunnel_failure
+from nestvault.naming import ADHOC_TIER, CATCH_UP_LABEL, TIER_LABEL, KeyTemplate, listing_prefix
+from nestvault.notify import LOG_TAIL_LINES, Notifier, RunResult, notify
+from nestvault.ping import Pinger
+from nestvault.retention import GfsPolicy, RetentionLimits, cleanup_old_backups, limit_backups
+from nestvault.stats import BackupStats, collecting, current, measure
+from nestvault.status import add_backup, add_error, enter_phase, register, tracking
 from nestvault.storage.base import StorageAdapter
+from nestvault.tempdir import TEMP_PREFIX
+from nestvault.tracing import span
+from nestvault.tunnel import SshTunnel, tunneled
+from nestvault.verify import checksum_metadata
+from nestvault.wal import prune_wal
+from nestvault.window import BackupWindow, check_runtime, supervising
 
 logger = get_logger("scheduler")
 
+# Temp dirs of backup jobs; one outlives its job only when the process dies mid-upload
+TEMP_DIR_PREFIX = TEMP_PREFIX
 
-def get_next_run_time(cron_expression: str, base_time: datetime | None = None) -> datetime:
+
+@dataclass
+class Replica:
+    """A secondary storage destination every backup is copied to."""
+
+    name: str
+    storage_adapter: StorageAdapter
+    # None when the target's GFS policy prunes the replica too
+    retention_days: int | None
+
+
+@dataclass
+class Fallback:
+    """A storage destination backups are uploaded to while the primary storage fails."""
+
+    name: str
+    storage_adapter: StorageAdapter
+
+
+@dataclass
+class Tier:
+    """A schedule of a target whose backups are kept for their own retention, e.g. hourlies for 2 days."""
+
+    name: str
+    # None for the ad hoc tier of manual backups, which runs on demand only
+    schedule: str | None
+    retention_days: int
+
+
+@dataclass
+class BackupTarget:
+    """A scheduled backup: what to back up, where to, and how often."""
+
+    name: str
+    schedule: str
+    # None when gfs decides which backups are kept
+    retention_days: int | None
+    backup_adapter: BackupAdapter
+    storage_adapter: StorageAdapter
+    replicas: list[Replica] = field(default_factory=list)
+    # Timezone the schedule is evaluated in
+    tz: tzinfo = timezone.utc
+    failover: list[Fallback] = field(default_factory=list)
+    upload_retries: int = 0
+    # Stream backups straight to storage where possible instead of writing a temp file
+    stream: bool = False
+    # Interrupted uploads older than this are aborted instead of resumed
+    upload_max_age: timedelta = timedelta(hours=24)
+    hooks: HooksConfig | None = None
+    # Check the temp directory can hold a backup before writing it; None skips the check
+    preflight: PreflightConfig | None = None
+    # Storage keys of the target's backups; None keeps the names adapters give their files
+    key_template: KeyTemplate | None = None
+    # Labels recorded with every backup of the target
+    labels: dict[str, str] = field(default_factory=dict)
+    # Targets sharing a key are never backed up at the same time; empty for no constraint
+    concurrency_key: str = ""
+    # Schedules run instead of the target's own, each counting against its own retention
+    tiers: list[Tier] = field(default_factory=list)
+    # Tier the copy of a target with tiers backs up in, see for_tier
+    tier: str | None = None
+    # Keeps backups by hour, day, week, month and year instead of for retention_days
+    gfs: GfsPolicy | None = None
+    # Caps on the backups of each database, applied after retention on every storage
+    limits: RetentionLimits | None = None
+    # Longest random delay of each scheduled run, so instances sharing a schedule do not all start at once
+    jitter: timedelta = timedelta(0)
+    # Hours of the day backups may start in; None for any time
+    window: BackupWindow | None = None
+    # Runs taking longer are cancelled; None for no limit
+    max_runtime: timedelta | None = None
+    # Backups of a database unchanged since one younger than this are skipped; None always backs up
+    skip_unchanged: timedelta | None = None
+    # How long the lock object keeping replicas from backing the target up at once is valid unrenewed;
+    # None locks the target in this process only
+    lock_ttl: timedelta | None = None
+    # Pings a monitoring service when a run starts, succeeds and fails; None pings nothing
+    ping: Pinger | None = None
+    # Report the result of every backup job, as their policies select
+    notifiers: list[Notifier] = field(default_factory=list)
+    # Leases the credentials every run connects to the database with; None uses the configured ones
+    credentials: CredentialProvider | None = None
+    # Tunnel every run connects to the database through; None connects directly
+    tunnel: SshTunnel | None = None
+
+    @property
+    def run_name(self) -> str:
+        """Return the name of the target, with its tier for the copy backing up in one, e.g. 'billing/hourly'."""
+        return f"{self.name}/{self.tier}" if self.tier else self.name
+
+
+def for_tier(target: BackupTarget, name: str) -> BackupTarget:
+    """Return the copy of a target with tiers that backs up in one of them, labelled and pruned as that tier.
+
+    Raises:
+        KeyError: If the target has no tier of that name
+    """
+    tier = next((tier for tier in target.tiers if tier.name == name), None)
+    if tier is None:
+        raise KeyError(name)
+
+    key_template = replace(target.key_template, tier=name) if target.key_template is not None else None
+    return replace(
+        target,
+        schedule=tier.schedule or target.schedule,
+        retention_days=tier.retention_days,
+        labels={**target.labels, TIER_LABEL: name},
+        key_template=key_template,
+        tier=name,
+    )
+
+
+def scheduled_runs(targets: list[BackupTarget]) -> list[BackupTarget]:
+    """Return what the scheduler runs: every target without tiers, and a copy per scheduled tier of the others."""
+    runs = []
+    for target in targets:
+        if target.tiers:
+            runs.extend(for_tier(target, tier.name) for tier in target.tiers if tier.schedule)
+        else:
+            runs.append(target)
+    return runs
+
+
+@dataclass
+class ScheduledTask:
+    """Work other than backups that runs on its own schedule, e.g. restore verification."""
+
+    name: str
+    schedule: str
+    run: Callable[[], bool]
+    tz: tzinfo = timezone.utc
+
+
+@dataclass
+class Schedule:
+    """Everything the scheduler runs, replaced as a whole when the configuration is reloaded."""
+
+    targets: list[BackupTarget]
+    tasks: Sequence[ScheduledTask] = ()
+    max_concurrent: int = 1
+
+
+# Next run of every target and task the scheduler runs, by name
+_upcoming: dict[str, dict[str, str]] = {}
+_upcoming_lock = threading.Lock()
+
+# Schedule handed over with reschedule, taken by the scheduler once the runs under way finish
+_rescheduled: Schedule | None = None
+_rescheduled_lock = threading.Lock()
+
+# How often a sleeping scheduler checks for a schedule handed over with reschedule
+RESCHEDULE_POLL_SECONDS = 1.0
+
+
+def upcoming() -> dict[str, dict[str, str]]:
+    """Return the schedule, timezone and next run of every target and task, e.g. for a status endpoint.
+
+    A run's next_run is when it starts, after the jitter delaying it; due is when its schedule falls due.
+    """
+    with _upcoming_lock:
+        return {name: dict(run) for name, run in _upcoming.items()}
+
+
+@dataclass
+class Pause:
+    """Scheduling paused at runtime, e.g. for maintenance, with the runs skipped meanwhile."""
+
+    since: datetime
+    # Scheduling resumes on its own at this time; None until resumed
+    until: datetime | None = None
+    # Name of each run or task that fell due while paused, with when it fell due
+    skipped: list[tuple[str, datetime]] = field(default_factory=list)
+
+    def snapshot(self) -> dict[str, str | list[dict[str, str]] | None]:
+        """Return the pause, for monitoring."""
+        return {
+            "since": self.since.isoformat(),
+            "until": self.until.isoformat() if self.until else None,
+            "skipped": [{"name": name, "due": due.isoformat()} for name, due in self.skipped],
+        }
+
+
+_pause: Pause | None = None
+_pause_lock = threading.Lock()
+
+
+def pause(duration: timedelta | None = None) -> Pause:
+    """Stop the scheduler from starting runs until resumed, or until the duration is over.
+
+    Runs under way finish; runs falling due while paused are skipped and
+    recorded. Pausing again while paused only changes when it resumes.
+    """
+    global _pause
+    now = datetime.now(timezone.utc)
+    until = now + duration if duration is not None else None
+    with _pause_lock:
+        if _pause is None:
+            _pause = Pause(since=now)
+        _pause.until = until
+        current_pause = _pause
+
+    logger.warning(f"Scheduling paused{f' until {until.isoformat()}' if until else ', until resumed'}")
+    return current_pause
+
+
+def resume() -> Pause | None:
+    """Let the scheduler start runs again, returning the pause that ended, or None if it was not paused."""
+    global _pause
+    with _pause_lock:
+        ended, _pause = _pause, None
+
+    if ended is not None:
+        skipped = ", ".join(f"{name} due at {due.isoformat()}" for name, due in ended.skipped)
+        logger.info(
+            f"Scheduling resumed after {(datetime.now(timezone.utc) - ended.since).total_seconds():.0f}s"
+            f"{f', skipped while paused: {skipped}' if skipped else ''}"
+        )
+    return ended
+
+
+def paused() -> Pause | None:
+    """Return the pause in effect, e.g. for a status endpoint, resuming first if its duration is over."""
+    with _pause_lock:
+        current_pause = _pause
+    if current_pause is not None and current_pause.until is not None:
+        if datetime.now(timezone.utc) >= current_pause.until:
+            resume()
+            return None
+    return current_pause
+
+
+def reschedule(schedule: Schedule) -> None:
+    """Hand the scheduler what to run from now on, e.g. the targets of a reloaded configuration.
+
+    The runs under way finish as they were configured; the new schedule
+    replaces the old one once they have, or right away while the
+    scheduler sleeps. Handing over another schedule first replaces this one.
+    """
+    global _rescheduled
+    with _rescheduled_lock:
+        _rescheduled = schedule
+
+
+def _take_rescheduled() -> Schedule | None:
+    """Return the schedule handed over with reschedule since the last call, if any."""
+    global _rescheduled
+    with _rescheduled_lock:
+        schedule, _rescheduled = _rescheduled, None
+    return schedule
+
+
+def _wait(stop: threading.Event, seconds: float) -> bool:
+    """Sleep until stop is set, a schedule is handed over or the time is up, returning whether stop is set."""
+    deadline = time.monotonic() + seconds
+    while _rescheduled is None:
+        remaining = deadline - time.monotonic()
+        if remaining <= 0 or stop.wait(min(remaining, RESCHEDULE_POLL_SECONDS)):
+            break
+    return stop.is_set()
+
+
+def _skip_while_paused(name: str, due: datetime) -> bool:
+    """Record a run falling due while paused, returning whether it is skipped."""
+    current_pause = paused()
+    if current_pause is None:
+        return False
+    with _pause_lock:
+        current_pause.skipped.append((name, due))
+    logger.warning(f"Skipped {name} due at {due.isoformat()}, scheduling is paused")
+    return True
+
+
+def get_next_run_time(cron_expression: str, base_time: datetime | None = None, tz: tzinfo = timezone.utc) -> datetime:
     """Calculate the next run time based on a cron expression.
 
+    The expression is matched against the wall-clock time in tz, and each
+    wall-clock time runs at most once: a time the clocks pass twice when
+    they go back runs on the first pass only, and a time they skip when
+    they go forward runs as much later as they jumped, e.g. 02:30 at 03:30.
+
     Args:
-        cron_expression: Cron expression string
+        cron_expression: Cron expression string, or a shorthand such as '@daily'
         base_time: Base time for calculation (defaults to UTC now)
+        tz: Timezone the expression is evaluated in
 
     Returns:
-        Next scheduled run time as datetime
+        Next scheduled run time as a UTC datetime
     """
     if base_time is None:
         base_time = datetime.now(timezone.utc)
+    after = base_time.astimezone(timezone.utc)
+
+    # Aware times in one zone compare by wall clock, so the passes of a repeated hour are compared in UTC
+    cron = croniter(cron_expression, after.astimezone(tz).replace(tzinfo=None, fold=0))
+    while True:
+        next_run = cron.get_next(datetime).replace(tzinfo=tz).astimezone(timezone.utc)
+        if next_run > after:
+            return next_run
+
+
+def _key(key_template: KeyTemplate | None, backup_adapter: BackupAdapter, name: str) -> str:
+    """Return the storage key of a file an adapter named."""
+    return key_template.key(backup_adapter, name) if key_template is not None else name
+
+
+def upload_backup(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    backup_file: Path,
+    extra_metadata: dict[str, str] | None = None,
+    started_at: datetime | None = None,
+    key_template: KeyTemplate | None = None,
+) -> None:
+    """Upload a backup, its companions and its manifest to one storage destination.
 
-    cron = croniter(cron_expression, base_time)
-    return cron.get_next(datetime)
+    The size and SHA-256 of every uploaded file are recorded in its
+    metadata, so verify and restore can detect corrupt or truncated objects.
+
+    Args:
+        backup_adapter: Database backup adapter that produced the backup
+        storage_adapter: Storage adapter to upload to
+        backup_file: Path to the backup file
+        extra_metadata: Metadata recorded with the backup in addition to the adapter's
+        started_at: When the backup started, recorded in its manifest
+        key_template: Template of the backup's key; None uploads it under its file name
+
+    Raises:
+        StorageError: If an upload fails
+    """
+    metadata = dict(backup_adapter.backup_metadata)
+    metadata.update(extra_metadata or {})
+    metadata.update(checksum_metadata(backup_file))
+
+    # Upload companions first so the backup never links to a missing object
+    metadata.update(_upload_companions(backup_adapter, storage_adapter, backup_file, key_template))
+
+    key = _key(key_template, backup_adapter, backup_file.name)
+    with measure("upload") as phase:
+        storage_adapter.upload(
+            backup_file,
+            key,
+            metadata=metadata,
+        )
+        phase.bytes_out = int(metadata["size"])
+
+    _write_manifest(backup_adapter, storage_adapter, key, metadata, started_at, backup_file.parent)
+
+
+def _write_manifest(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    key: str,
+    metadata: dict[str, str],
+    started_at: datetime | None,
+    temp_path: Path,
+) -> None:
+    """Upload the manifest of an uploaded backup; a failure is logged, as the backup itself is complete."""
+    finished_at = datetime.now(timezone.utc)
+    manifest = build_manifest(backup_adapter, key, metadata, started_at or finished_at, finished_at, current())
+
+    with span("manifest write", backup_key=key) as traced:
+        try:
+            write_manifest(storage_adapter, manifest, temp_path)
+        except StorageError as e:
+            traced.fail(e)
+            logger.warning(f"Failed to upload the manifest of {key}, it is listed from its key instead: {e}")
+
+
+def _upload_companions(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    backup_file: Path,
+    key_template: KeyTemplate | None = None,
+) -> dict[str, str]:
+    """Create and upload a backup's companions, returning their keys by kind."""
+    keys = {}
+
+    for kind, companion_file in backup_adapter.backup_companions(backup_file).items():
+        key = _key(key_template, backup_adapter, companion_file.name)
+        storage_adapter.upload(
+            companion_file,
+            key,
+            metadata={"engine": backup_adapter.engine, "companion": kind, **checksum_metadata(companion_file)},
+        )
+        keys[kind] = key
+        logger.info(f"Companion uploaded: {key}")
+
+    return keys
+
+
+def stream_backup(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    temp_path: Path,
+    started_at: datetime | None = None,
+    key_template: KeyTemplate | None = None,
+    extra_metadata: dict[str, str] | None = None,
+) -> tuple[str, int]:
+    """Stream a backup straight into storage, without writing it to disk.
+
+    Companions are small and still created in the temporary directory,
+    before the backup itself is uploaded. The previous backup's size is
+    passed on as the expected size, so a backend that could not hold it
+    refuses before the dump starts.
+
+    Args:
+        backup_adapter: Database backup adapter that supports streaming
+        storage_adapter: Storage adapter that supports streaming
+        temp_path: Directory for the companions and the manifest
+        started_at: When the backup started, recorded in its manifest
+        key_template: Template of the backup's key; None uploads it under its file name
+        extra_metadata: Metadata recorded with the backup in addition to the adapter's
+
+    Returns:
+        Key and size of the uploaded backup
+
+    Raises:
+        BackupError: If the backup fails; the partial upload is discarded
+        StorageError: If an upload fails
+    """
+    previous = list_backups(
+        storage_adapter, backup_adapter.database_name, listing_prefix(key_template, backup_adapter)
+    )
+    expected_size = previous[0].size if previous else None
+
+    with backup_adapter.stream_backup() as (name, stream):
+        key = _key(key_template, backup_adapter, name)
+        logger.info(f"Streaming backup {key} to storage")
+        companions = _upload_companions(backup_adapter, storage_adapter, temp_path / name, key_template)
+        # Read once the stream is open, as ciphers set their metadata then
+        metadata = {**backup_adapter.backup_metadata, **(extra_metadata or {}), **companions}
+        with measure("upload") as phase:
+            uploaded = storage_adapter.upload_stream(stream, key, metadata=metadata, expected_size=expected_size)
+            phase.bytes_out = uploaded.size
+
+    logger.info(f"Backup streamed: {key} ({uploaded.size} bytes, sha256 {uploaded.sha256})")
+    recorded = {**metadata, "size": str(uploaded.size), "sha256": uploaded.sha256}
+    _write_manifest(backup_adapter, storage_adapter, key, recorded, started_at, temp_path)
+    return key, uploaded.size
+
+
+def _can_stream(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    replicas: Sequence[Replica],
+    failover: Sequence[Fallback],
+) -> bool:
+    """Tell whether a backup can be streamed, logging why not when it cannot."""
+    if replicas or failover:
+        logger.info("Writing the backup to a temp file, replicas and fallbacks need a local copy")
+        return False
+    if not backup_adapter.supports_streaming:
+        logger.info(
+            f"Writing the backup to a temp file, {backup_adapter.engine} backups cannot be streamed "
+            "with the configured format or encryption"
+        )
+        return False
+    if not storage_adapter.supports_streaming:
+        logger.info("Writing the backup to a temp file, the storage backend needs seekable input")
+        return False
+    return True
+
+
+def _remove_leftover(local_path: Path) -> None:
+    """Delete the temp file of an interrupted upload, with the temp dir of the run it belonged to."""
+    local_path.unlink(missing_ok=True)
+    parent = local_path.parent
+    if parent.name.startswith(TEMP_DIR_PREFIX) and parent.parent == Path(tempfile.gettempdir()):
+        shutil.rmtree(parent, ignore_errors=True)
+
+
+def resume_uploads(storage_adapter: StorageAdapter, max_age: timedelta, prefix: str = "") -> int:
+    """Finish or discard the uploads a previous run left unfinished.
+
+    An upload of a temp file that still exists continues from its last
+    completed part. A streamed upload cannot be resumed, as its data is
+    gone with the process that produced it; it is aborted and the next
+    backup starts over. Uploads whose file is gone or that started longer
+    ago than max_age are aborted as well.
+
+    Args:
+        storage_adapter: Storage adapter the uploads went to
+        max_age: Age beyond which an interrupted upload is aborted
+        prefix: Only consider uploads under this key prefix
+
+    Returns:
+        Number of uploads resumed
+
+    Raises:
+        StorageError: If resuming or aborting an upload fails
+    """
+    resumed = 0
+
+    for upload in storage_adapter.interrupted_uploads(prefix):
+        age = datetime.now(timezone.utc) - upload.started
+
+        if upload.local_path is None:
+            logger.warning(
+                f"Streamed upload of {upload.key} was interrupted and cannot be resumed, "
+                "aborting it; the backup starts over with the next run"
+            )
+            storage_adapter.abort_upload(upload)
+            continue
+
+        if not upload.local_path.exists():
+            logger.warning(f"Aborting interrupted upload of {upload.key}, {upload.local_path} no longer exists")
+            storage_adapter.abort_upload(upload)
+        elif age > max_age:
+            logger.warning(f"Aborting interrupted upload of {upload.key}, it started {age} ago")
+            storage_adapter.abort_upload(upload)
+        else:
+            logger.info(f"Resuming interrupted upload of {upload.key} from {upload.local_path}")
+            storage_adapter.upload(upload.local_path, upload.key, upload.metadata)
+            logger.info(f"Backup uploaded: {upload.key}")
+            resumed += 1
+
+        _remove_leftover(upload.local_path)
+
+    return resumed
+
+
+def _upload_with_retries(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    backup_file: Path,
+    retries: int,
+    started_at: datetime | None = None,
+    extra_metadata: dict[str, str] | None = None,
+    key_template: KeyTemplate | None = None,
+) -> None:
+    """Upload a backup to the primary storage, retrying failed uploads.
+
+    A failed multipart upload keeps its completed parts, so every retry
+    continues where the previous attempt stopped.
+
+    Raises:
+        StorageError: If the upload failed on every attempt
+    """
+    attempts = retries + 1
+
+    for attempt in range(1, attempts + 1):
+        try:
+            upload_backup(backup_adapter, storage_adapter, backup_file, extra_metadata, started_at, key_template)
+            return
+        except StorageError as e:
+            if attempt == attempts:
+                raise
+
+            delay = 2 ** (attempt - 1)
+            logger.warning(f"Upload failed (attempt {attempt}/{attempts}), retrying in {delay}s: {e}")
+            time.sleep(delay)
+
+
+def _fail_over(
+    backup_adapter: BackupAdapter,
+    failover: Sequence[Fallback],
+    backup_file: Path,
+    started_at: datetime | None = None,
+    extra_metadata: dict[str, str] | None = None,
+    key_template: KeyTemplate | None = None,
+) -> Fallback:
+    """Upload a backup to the first fallback that accepts it.
+
+    Raises:
+        StorageError: If every fallback failed as well
+    """
+    for fallback in failover:
+        try:
+            metadata = {**(extra_metadata or {}), "failover": "true"}
+            upload_backup(backup_adapter, fallback.storage_adapter, backup_file, metadata, started_at, key_template)
+            return fallback
+        except StorageError as e:
+            logger.error(f"Upload to fallback {fallback.name} failed: {e}")
+
+    raise StorageError("Upload failed on the primary storage and every fallback")
+
+
+def reconcile_failover(
+    database_name: str,
+    storage_adapter: StorageAdapter,
+    fallback: Fallback,
+    prefix: str | None = None,
+) -> int:
+    """Move backups that failed over to a fallback back to the primary storage.
+
+    Backups already on the primary storage are left alone. Copied backups
+    are deleted from the fallback once all of them reached the primary.
+
+    Args:
+        database_name: Database whose backups are reconciled
+        storage_adapter: Primary storage adapter
+        fallback: Fallback destination to reconcile
+        prefix: Key prefix the backups are listed under, by default the database name
+
+    Returns:
+        Number of objects copied to the primary storage
+
+    Raises:
+        StorageError: If listing, copying or deleting fails
+    """
+    prefix = database_name if prefix is None else prefix
+    on_primary = {obj.key for obj in storage_adapter.list(prefix=prefix)}
+    objects = backup_objects(fallback.storage_adapter, fallback.storage_adapter.list(prefix=prefix), database_name)
+    pending = [obj.key for obj in objects if obj.key not in on_primary]
+    if not pending:
+        return 0
+
+    logger.info(f"Copying {len(pending)} objects from fallback {fallback.name} to the primary storage")
+
+    entries = [(key, fallback.storage_adapter.get_metadata(key)) for key in pending]
+    # Companions first, so a copied backup never links to a missing object
+    entries.sort(key=lambda entry: "companion" not in entry[1])
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_path = Path(temp_dir) / "object"
+        for key, metadata in entries:
+            fallback.storage_adapter.download(key, local_path)
+            storage_adapter.upload(local_path, key, metadata=metadata)
+            local_path.unlink()
+            logger.info(f"Reconciled {key} from {fallback.name}")
+
+    fallback.storage_adapter.delete_many(pending)
+    return len(pending)
+
+
+def _reconcile(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    failover: Sequence[Fallback],
+    prefix: str,
+) -> None:
+    """Reconcile every fallback, logging failures instead of failing the job."""
+    for fallback in failover:
+        try:
+            reconcile_failover(backup_adapter.database_name, storage_adapter, fallback, prefix)
+        except StorageError as e:
+            logger.error(f"Reconciling fallback {fallback.name} failed: {e}")
+
+
+def _replicate(
+    backup_adapter: BackupAdapter,
+    replicas: Sequence[Replica],
+    backup_file: Path,
+    started_at: datetime | None = None,
+    extra_metadata: dict[str, str] | None = None,
+    key_template: KeyTemplate | None = None,
+) -> list[str]:
+    """Copy a backup to every replica, returning the names of those that failed."""
+    failed = []
+
+    for replica in replicas:
+        try:
+            upload_backup(
+                backup_adapter, replica.storage_adapter, backup_file, extra_metadata, started_at, key_template
+            )
+            logger.info(f"Backup replicated to {replica.name}")
+        except StorageError as e:
+            logger.error(f"Replication to {replica.name} failed: {e}")
+            failed.append(replica.name)
+
+    return failed
+
+
+def _prune_secondary(
+    backup_adapter: BackupAdapter,
+    destinations: Sequence[tuple[str, StorageAdapter, int | None]],
+    prefix: str,
+    tier: str | None,
+    gfs: GfsPolicy | None,
+    limits: RetentionLimits | None,
+) -> None:
+    """Apply retention and its limits to replicas and fallbacks, independently of the primary."""
+    for name, storage_adapter, retention_days in destinations:
+        try:
+            deleted_count = cleanup_old_backups(
+                storage_adapter,
+                retention_days,
+                prefix=prefix,
+                database_name=backup_adapter.database_name,
+                owns=backup_adapter.is_own_backup,
+                tier=tier,
+                policy=gfs if retention_days is None else None,
+            )
+            if deleted_count > 0:
+                logger.info(f"Cleaned up {deleted_count} old backups on {name}")
+            if limits is not None:
+                report = limit_backups(
+                    storage_adapter,
+                    limits,
+                    prefix=prefix,
+                    database_name=backup_adapter.database_name,
+                    owns=backup_adapter.is_own_backup,
+                )
+                if report.deleted > 0:
+                    logger.info(f"Cleaned up {report.deleted} backups past the retention limits on {name}")
+        except RetentionError as e:
+            logger.error(f"Retention cleanup on {name} failed: {e}")
+
+
+def _prune_wal(backup_adapter: BackupAdapter, storage_adapter: StorageAdapter, prefix: str) -> None:
+    """Delete archived WAL older than every retained base backup; a failure keeps it for next time."""
+    try:
+        prune_wal(storage_adapter, backup_adapter.database_name, prefix)
+    except StorageError as e:
+        logger.error(f"WAL cleanup failed: {e}")
+
+
+def _collect_chunks(storage_adapter: StorageAdapter) -> None:
+    """Delete chunks no retained backup refers to; a failure keeps them for next time."""
+    try:
+        collect_chunks(storage_adapter)
+    except StorageError as e:
+        logger.error(f"Chunk cleanup failed: {e}")
+
+
+def _unchanged_since(
+    storage_adapter: StorageAdapter,
+    backup_adapter: BackupAdapter,
+    prefix: str,
+    tier: str | None,
+    max_age: timedelta,
+    fingerprint: str,
+) -> Manifest | None:
+    """Return the latest backup of the database in its tier if it has the same fingerprint and is younger than max_age.
+
+    A failed listing returns None, so the database is backed up.
+    """
+    try:
+        backups = list_backups(storage_adapter, backup_adapter.database_name, prefix)
+    except StorageError as e:
+        logger.warning(f"Cannot list earlier backups to tell whether the database changed, backing it up: {e}")
+        return None
+
+    latest = next(
+        (manifest for manifest in backups if manifest.labels.get(TIER_LABEL, ADHOC_TIER) == (tier or ADHOC_TIER)), None
+    )
+    if latest is None or latest.metadata.get("fingerprint") != fingerprint:
+        return None
+    age = datetime.now(timezone.utc) - latest.finished_at
+    if age >= max_age:
+        logger.info(f"The database is unchanged since {latest.key}, backing it up as that is {age.days} days old")
+        return None
+    return latest
 
 
 def run_backup_job(
     backup_adapter: BackupAdapter,
     storage_adapter: StorageAdapter,
-    retention_days: int,
+    retention_days: int | None,
+    replicas: Sequence[Replica] = (),
+    failover: Sequence[Fallback] = (),
+    upload_retries: int = 0,
+    stream: bool = False,
+    hooks: HooksConfig | None = None,
+    target_name: str = "default",
+    preflight: PreflightConfig | None = None,
+    key_template: KeyTemplate | None = None,
+    labels: dict[str, str] | None = None,
+    tier: str | None = None,
+    gfs: GfsPolicy | None = None,
+    limits: RetentionLimits | None = None,
+    skip_unchanged: timedelta | None = None,
+    notifiers: Sequence[Notifier] = (),
 ) -> bool:
     """Execute a single backup job.
 
+    The backup is uploaded to the primary storage first and then copied to
+    every replica. A job whose primary upload succeeded but a replica
+    failed is reported as degraded and still counts as a success.
+
+    When the primary upload still fails after its retries, the backup goes
+    to the first fallback that accepts it instead. Failed-over backups are
+    copied back to the primary storage after the next successful upload.
+
+    With streaming, a backup whose engine and storage support it is piped
+    straight into storage without a temp file. A streamed upload cannot be
+    retried, so a failure fails the job.
+
     Args:
         backup_adapter: Database backup adapter
-        storage_adapter: Storage adapter
-        retention_days: Number of days to retain backups
+        storage_adapter: Primary storage adapter
+        retention_days: Number of days to retain backups on the primary storage, None with gfs
+        replicas: Secondary destinations with their own retention
+        failover: Destinations to try in order when the primary upload fails
+        upload_retries: Times a failed primary upload is retried
+        stream: Stream the backup to storage when possible
+        hooks: Commands run before the job, and after it succeeded or failed
+        target_name: Name of the target, exposed to hooks
+        preflight: Check the temp directory can hold the backup first, unless it is streamed
+        key_template: Template of the storage keys of the target's backups
+        labels: Labels recorded with the backup, exposed to hooks
+        tier: Tier of a target with tiers the backup is taken in; retention only prunes that tier
+        gfs: GFS policy pruning the primary storage, fallbacks and replicas without retention days instead
+        limits: Caps on the database's backups on every storage, applied after retention
+        skip_unchanged: Skip the backup while the database is unchanged since one younger than this; None never skips
+        notifiers: Notifiers reporting the result of the job
 
     Returns:
-        True if backup succeeded, False otherwise
+        True if the backup reached the primary storage or a fallback, False otherwise
     """
+    context = HookContext(
+        target=target_name, database=backup_adapter.database_name, labels=format_labels(labels or {})
+    )
+
+    # Notifiers may report the lines the job logged
+    with (
+        log_context(database=backup_adapter.database_name),
+        capturing(LOG_TAIL_LINES) as log,
+        span("backup job", target=target_name, database=backup_adapter.database_name) as traced,
+    ):
+        if hooks is not None:
+            try:
+                run_pre_backup_hooks(hooks.pre_backup, context, hooks.timeout_seconds)
+            except HookError as e:
+                logger.error(f"Backup aborted: {e}")
+                context.status, context.error = "aborted", str(e)
+                run_post_hooks("post_failure", hooks.post_failure, context, hooks.timeout_seconds)
+                record_backup(target_name, False, 0.0, time.time(), None, BackupStats())
+                add_error(context.database, context.error)
+                traced.fail(e)
+                notify(notifiers, _run_result(context, None, labels, BackupStats(), log))
+                return False
+
+        started = time.monotonic()
+        with collecting() as stats:
+            succeeded = _run_backup_job(
+                backup_adapter,
+                storage_adapter,
+                retention_days,
+                replicas,
+                failover,
+                upload_retries,
+                stream,
+                preflight,
+                key_template,
+                labels or {},
+                context,
+                tier,
+                gfs,
+                limits,
+                skip_unchanged,
+            )
+        duration = time.monotonic() - started
+        if succeeded and stats.phases:
+            logger.bind(duration=round(duration, 3)).info(f"Backup job took {duration:.1f}s: {stats.summary()}")
+        record_backup(target_name, succeeded, duration, time.time(), context.size, stats)
+        if succeeded:
+            add_backup(context.size)
+
+        context.status = "success" if succeeded else "failure"
+        traced.set(status=context.status, backup_key=context.backup_key, size=context.size)
+        if not succeeded:
+            traced.fail(context.error or "backup failed")
+            add_error(context.database, context.error or "backup failed")
+        if hooks is not None:
+            stage, commands = ("post_backup", hooks.post_backup) if succeeded else ("post_failure", hooks.post_failure)
+            # A failing post hook is reported but never fails a backup that already completed
+            failures = run_post_hooks(stage, commands, context, hooks.timeout_seconds)
+            if failures:
+                logger.warning(f"Backup job finished, but {len(failures)} {stage} hooks failed")
+
+        notify(notifiers, _run_result(context, duration, labels, stats, log))
+        return succeeded
+
+
+def _run_result(
+    context: HookContext,
+    duration: float | None,
+    labels: dict[str, str] | None,
+    stats: BackupStats,
+    log: Sequence[str] = (),
+) -> RunResult:
+    """Return the result of a backup job for notifiers."""
+    compress = stats.phases.get("compress")
+    return RunResult(
+        target=context.target,
+        database=context.database,
+        status=context.status,
+        duration=duration,
+        size=context.size,
+        raw_size=compress.bytes_in if compress is not None else None,
+        phase_durations={name: phase["seconds"] for name, phase in stats.to_dict().items()},
+        backup_key=context.backup_key,
+        error=context.error,
+        labels=labels or {},
+        log=list(log),
+    )
+
+
+def _run_backup_job(
+    backup_adapter: BackupAdapter,
+    storage_adapter: StorageAdapter,
+    retention_days: int | None,
+    replicas: Sequence[Replica],
+    failover: Sequence[Fallback],
+    upload_retries: int,
+    stream: bool,
+    preflight: PreflightConfig | None,
+    key_template: KeyTemplate | None,
+    labels: dict[str, str],
+    context: HookContext,
+    tier: str | None,
+    gfs: GfsPolicy | None,
+    limits: RetentionLimits | None,
+    skip_unchanged: timedelta | None,
+) -> bool:
+    """Back up, upload, replicate and prune, recording the backup's key and size for hooks."""
     logger.info("Starting backup job")
+    started_at = datetime.now(timezone.utc)
+    prefix = listing_prefix(key_template, backup_adapter)
+    metadata = {"labels": format_labels(labels)} if labels else {}
 
     try:
-        with tempfile.TemporaryDirectory() as temp_dir:
+        with tempfile.TemporaryDirectory(prefix=TEMP_DIR_PREFIX) as temp_dir:
             temp_path = Path(temp_dir)
 
-            backup_file = backup_adapter.backup(temp_path)
-            logger.info(f"Backup created: {backup_file.name}")
+            unchanged = None
+            if skip_unchanged is not None:
+                fingerprint = backup_adapter.fingerprint()
+                if fingerprint is None:
+                    logger.warning("Cannot tell whether the database changed, backing it up")
+                else:
+                    metadata["fingerprint"] = fingerprint
+                    unchanged = _unchanged_since(
+                        storage_adapter, backup_adapter, prefix, tier, skip_unchanged, fingerprint
+                    )
 
-            remote_key = backup_file.name
-            storage_adapter.upload(backup_file, remote_key)
-            logger.info(f"Backup uploaded: {remote_key}")
+            used_fallback = None
+            failed_replicas = []
 
-        deleted_count = cleanup_old_backups(
-            storage_adapter,
-            retention_days,
-            prefix=backup_adapter.database_name,
-        )
+            if unchanged is not None:
+                logger.info(f"Backup skipped: the database is unchanged since {unchanged.key}")
+                context.backup_key, context.size = unchanged.key, unchanged.size
+                backup_name = unchanged.key
+                write_unchanged_record(storage_adapter, unchanged, started_at, temp_path)
+            else:
+                try:
+                    storage_adapter.check_free_space(backup_adapter.database_name)
+                except StorageError as e:
+                    if not failover:
+                        raise
+                    logger.warning(f"Primary storage preflight failed, the backup will fail over: {e}")
+
+                if stream and _can_stream(backup_adapter, storage_adapter, replicas, failover):
+                    backup_name, context.size = stream_backup(
+                        backup_adapter, storage_adapter, temp_path, started_at, key_template, metadata
+                    )
+                    context.backup_key = backup_name
+                else:
+                    if preflight is not None:
+                        estimate = check_temp_space(backup_adapter, storage_adapter, temp_path, preflight, prefix)
+                        metadata.update(estimate.metadata)
+
+                    with measure("dump"):
+                        backup_file = backup_adapter.backup(temp_path)
+                    logger.info(f"Backup created: {backup_file.name}")
+                    check_runtime("upload")
+                    check_lock("upload")
+                    backup_name = _key(key_template, backup_adapter, backup_file.name)
+                    context.backup_key, context.size = backup_name, file_size(backup_file)
+
+                    try:
+                        _upload_with_retries(
+                            backup_adapter,
+                            storage_adapter,
+                            backup_file,
+                            upload_retries,
+                            started_at,
+                            metadata,
+                            key_template,
+                        )
+                        logger.info(f"Backup uploaded: {backup_name}")
+                    except StorageError as e:
+                        if not failover:
+                            raise
+                        logger.error(f"Upload to the primary storage failed, failing over: {e}")
+                        used_fallback = _fail_over(
+                            backup_adapter, failover, backup_file, started_at, metadata, key_template
+                        )
+
+                    failed_replicas = _replicate(
+                        backup_adapter, replicas, backup_file, started_at, metadata, key_template
+                    )
+
+        if used_fallback is None:
+            _reconcile(backup_adapter, storage_adapter, failover, prefix)
+
+        enter_phase("prune")
+        with span("prune", backup_key=context.backup_key) as pruned:
+            if used_fallback is None:
+                deleted_count = cleanup_old_backups(
+                    storage_adapter,
+                    retention_days,
+                    prefix=prefix,
+                    database_name=backup_adapter.database_name,
+                    owns=backup_adapter.is_own_backup,
+                    on_expire=backup_adapter.delete_backup_data,
+                    tier=tier,
+                    policy=gfs,
+                )
+
+                pruned.set(deleted=deleted_count)
+                if deleted_count > 0:
+                    logger.info(f"Cleaned up {deleted_count} old backups")
 
-        if deleted_count > 0:
-            logger.info(f"Cleaned up {deleted_count} old backups")
+                if limits is not None:
+                    report = limit_backups(
+                        storage_adapter,
+                        limits,
+                        prefix=prefix,
+                        database_name=backup_adapter.database_name,
+                        owns=backup_adapter.is_own_backup,
+                        on_expire=backup_adapter.delete_backup_data,
+                    )
+                    if report.deleted > 0:
+                        logger.info(f"Cleaned up {report.deleted} backups past the retention limits")
 
-        logger.info("Backup job completed successfully")
+                if backup_adapter.archives_wal:
+                    _prune_wal(backup_adapter, storage_adapter, prefix)
+                if backup_adapter.deduplicates:
+                    _collect_chunks(storage_adapter)
+
+            _prune_secondary(
+                backup_adapter,
+                [(replica.name, replica.storage_adapter, replica.retention_days) for replica in replicas]
+                + [(fallback.name, fallback.storage_adapter, retention_days) for fallback in failover],
+                prefix,
+                tier,
+                gfs,
+                limits,
+            )
+
+        if used_fallback is not None:
+            logger.warning(f"Backup succeeded via fallback destination {used_fallback.name}: {backup_name}")
+        elif failed_replicas:
+            logger.warning(f"Backup job completed degraded: replication to {', '.join(failed_replicas)} failed")
+        else:
+            logger.info("Backup job completed successfully")
         return True
 
     except BackupError as e:
         logger.error(f"Backup failed: {e}")
+        context.error = str(e)
         return False
     except StorageError as e:
         logger.error(f"Storage operation failed: {e}")
+        context.error = str(e)
         return False
     except Exception as e:
         logger.error(f"Unexpected error during backup: {e}")
+        context.error = f"Unexpected error: {e}"
         return False
 
 
-def run_scheduler(
-    config: Config,
+def run_backup_cycle(
     backup_adapter: BackupAdapter,
     storage_adapter: StorageAdapter,
+    retention_days: int | None,
+    replicas: Sequence[Replica] = (),
+    failover: Sequence[Fallback] = (),
+    upload_retries: int = 0,
+    stream: bool = False,
+    hooks: HooksConfig | None = None,
+    target_name: str = "default",
+    preflight: PreflightConfig | None = None,
+    key_template: KeyTemplate | None = None,
+    labels: dict[str, str] | None = None,
+    tier: str | None = None,
+    gfs: GfsPolicy | None = None,
+    limits: RetentionLimits | None = None,
+    skip_unchanged: timedelta | None = None,
+    notifiers: Sequence[Notifier] = (),
+) -> bool:
+    """Back up every database the adapter expands to.
+
+    A failure on one database does not stop the others; a summary with the
+    result for each database is logged at the end.
+
+    Args:
+        backup_adapter: Database backup adapter
+        storage_adapter: Primary storage adapter
+        retention_days: Number of days to retain backups on the primary storage, None with gfs
+        replicas: Secondary destinations with their own retention
+        failover: Destinations to try in order when the primary upload fails
+        upload_retries: Times a failed primary upload is retried
+        stream: Stream backups to storage when possible
+        hooks: Commands run around the job of every database
+        target_name: Name of the target, exposed to hooks
+        preflight: Check the temp directory can hold each backup first, unless it is streamed
+        key_template: Template of the storage keys of the target's backups
+        labels: Labels recorded with every backup
+        tier: Tier of a target with tiers the backups are taken in; retention only prunes that tier
+        gfs: GFS policy pruning the primary storage, fallbacks and replicas without retention days instead
+        limits: Caps on the database's backups on every storage, applied after retention
+        skip_unchanged: Skip the backup while the database is unchanged since one younger than this; None never skips
+        notifiers: Notifiers reporting the result of the job of every database
+
+    Returns:
+        True if every database was backed up, False otherwise
+    """
+    try:
+        adapters = backup_adapter.expand()
+    except BackupError as e:
+        logger.error(f"Failed to discover databases: {e}")
+        failure = RunResult(
+            target_name, backup_adapter.database_name, "failure", error=f"Failed to discover databases: {e}"
+        )
+        add_error(failure.database, failure.error)
+        notify(notifiers, failure)
+        return False
+
+    if len(adapters) == 1:
+        return run_backup_job(
+            adapters[0],
+            storage_adapter,
+            retention_days,
+            replicas,
+            failover,
+            upload_retries,
+            stream,
+            hooks,
+            target_name,
+            preflight,
+            key_template,
+            labels,
+            tier,
+            gfs,
+            limits,
+            skip_unchanged,
+            notifiers,
+        )
+
+    results = {}
+    for adapter in adapters:
+        logger.info(f"Backing up database '{adapter.database_name}'")
+        results[adapter.database_name] = run_backup_job(
+            adapter,
+            storage_adapter,
+            retention_days,
+            replicas,
+            failover,
+            upload_retries,
+            stream,
+            hooks,
+            target_name,
+            preflight,
+            key_template,
+            labels,
+            tier,
+            gfs,
+            limits,
+            skip_unchanged,
+            notifiers,
+        )
+
+    failed = [name for name, ok in results.items() if not ok]
+    logger.info(f"Backup summary: {len(results) - len(failed)}/{len(results)} databases succeeded")
+    for name, ok in results.items():
+        logger.info(f"  {name}: {'success' if ok else 'failed'}")
+
+    if failed:
+        logger.error(f"Backups failed for: {', '.join(failed)}")
+
+    return not failed
+
+
+def _retention(retention_days: int | None, gfs: GfsPolicy | None) -> str:
+    """Describe how long backups are kept, e.g. 'retention 7 days' or 'keeping 24 hourly, 7 daily'."""
+    if retention_days is None and gfs is not None:
+        return f"keeping {gfs.describe()}"
+    return f"retention {retention_days} days"
+
+
+def _run_target(target: BackupTarget, ignore_window: bool = False, wait_for_window: bool = False) -> bool:
+    """Run one backup cycle for a target, with every line it logs tagged with its name and a run ID.
+
+    Outside the target's backup window, the run is refused, or waits for
+    the window to open with wait_for_window, unless ignore_window is set.
+    A run of the target already under way, in this process or with a
+    lock_ttl in another replica, skips the run. A run that goes ahead is
+    pinged when it starts and ends, with the lines it logged. The run is
+    traced, with a span for each of its jobs.
+    """
+    run_id = uuid.uuid4().hex[:12]
+    with (
+        target_context(target.name),
+        log_context(run_id=run_id),
+        span("backup run", target=target.run_name, run_id=run_id),
+    ):
+        window = None if ignore_window else target.window
+        if window is not None and not window.contains(now := datetime.now(timezone.utc)):
+            if not wait_for_window:
+                logger.warning(
+                    f"Target '{target.run_name}': backup refused, {_local(now, window.tz)} is outside "
+                    f"its backup window {window.describe()}"
+                )
+                return False
+            opens = window.opens_after(now)
+            logger.info(f"Target '{target.run_name}': waiting for its window to open at {_local(opens, window.tz)}")
+            time.sleep((opens - now).total_seconds())
+
+        with ExitStack() as stack:
+            storage_lock = target.storage_adapter if target.lock_ttl is not None else None
+            try:
+                acquired = stack.enter_context(target_lock(target.name, storage_lock, target.lock_ttl))
+            except StorageError as e:
+                logger.error(f"Target '{target.run_name}': backup failed, cannot take its lock: {e}")
+                return False
+            if not acquired:
+                logger.info(f"Target '{target.run_name}': skipped, already running elsewhere")
+                return True
+            if target.ping is None:
+                with supervising(target.run_name, window, target.max_runtime):
+                    return _run_target_cycle(target)
+
+            ping_id = target.ping.start()
+            succeeded = False
+            with capturing() as log:
+                try:
+                    with supervising(target.run_name, window, target.max_runtime):
+                        succeeded = _run_target_cycle(target)
+                finally:
+                    target.ping.finish(ping_id, succeeded, log)
+            return succeeded
+
+
+def _run_target_cycle(target: BackupTarget) -> bool:
+    """Run one backup cycle for a target, after resuming uploads a previous run left unfinished.
+
+    The cycle is reported in the target's status while it runs, and recorded there as its last run.
+    With an SSH tunnel, the cycle connects to the database through it,
+    and with a credential provider, with credentials leased for it; it
+    fails without backing anything up when either cannot be set up.
+    """
+
+    def failed(error: str) -> bool:
+        failure = RunResult(target.name, target.backup_adapter.database_name, "failure", error=error)
+        logger.error(failure.error)
+        add_error(failure.database, failure.error)
+        notify(target.notifiers, failure)
+        return False
+
+    with tracking(target.name) as run, ExitStack() as stack:
+        logger.info(f"Running backup target '{target.run_name}'")
+
+        if target.tunnel is not None:
+            try:
+                stack.enter_context(tunneled(target.tunnel, target.backup_adapter))
+            except (TunnelError, BackupError) as e:
+                record_tunnel_failure(target.name)
+                return failed(f"SSH tunnel failed: {e}")
+
+        if target.credentials is not None:
+            try:
+                stack.enter_context(leased_credentials(target.credentials, target.backup_adapter))
+            except (CredentialError, BackupError) as e:
+                return failed(f"Credential acquisition failed: {e}")
+
+        try:
+            # Only this target's uploads, as targets running alongside may share the bucket
+            prefix = listing_prefix(target.key_template, target.backup_adapter)
+            resumed = resume_uploads(target.storage_adapter, target.upload_max_age, prefix)
+            if resumed:
+                logger.info(f"Target '{target.name}': resumed {resumed} interrupted uploads")
+        except StorageError as e:
+            logger.error(f"Target '{target.name}': resuming interrupted uploads failed: {e}")
+
+        run.succeeded = run_backup_cycle(
+            target.backup_adapter,
+            target.storage_adapter,
+            target.retention_days,
+            replicas=target.replicas,
+            failover=target.failover,
+            upload_retries=target.upload_retries,
+            stream=target.stream,
+            hooks=target.hooks,
+            target_name=target.name,
+            preflight=target.preflight,
+            key_template=target.key_template,
+            labels=target.labels,
+            tier=target.tier,
+            gfs=target.gfs,
+            limits=target.limits,
+            skip_unchanged=target.skip_unchanged,
+            notifiers=target.notifiers,
+        )
+        return run.succeeded
+
+
+def _run_targets(
+    targets: list[BackupTarget],
+    max_concurrent: int = 1,
+    on_finished: Callable[[BackupTarget], None] | None = None,
+    ignore_window: bool = False,
+    wait_for_window: bool = False,
+) -> dict[str, bool]:
+    """Back up targets, up to max_concurrent of them at a time.
+
+    Targets sharing a concurrency key run one after another, in the order
+    given, so at most one of them loads their server at a time. With
+    several targets, a summary of their results is logged at the end.
+
+    Args:
+        targets: Backup targets to back up
+        max_concurrent: Targets backed up at the same time
+        on_finished: Called with each target as soon as its backup finished
+        ignore_window: Back up targets outside their backup windows too
+        wait_for_window: Wait for a target's backup window to open instead of refusing to back it up
+
+    Returns:
+        Whether each target was backed up, by name
+    """
+
+    def run(target: BackupTarget) -> bool:
+        succeeded = _run_target(target, ignore_window, wait_for_window)
+        if on_finished is not None:
+            on_finished(target)
+        return succeeded
+
+    if max_concurrent <= 1 or len(targets) <= 1:
+        results = {target.name: run(target) for target in targets}
+    else:
+        chains: dict[tuple[str, str], list[BackupTarget]] = {}
+        for target in targets:
+            key = ("key", target.concurrency_key) if target.concurrency_key else ("target", target.name)
+            chains.setdefault(key, []).append(target)
+
+        def run_chain(chain: list[BackupTarget]) -> dict[str, bool]:
+            return {target.name: run(target) for target in chain}
+
+        finished: dict[str, bool] = {}
+        with ThreadPoolExecutor(max_workers=min(max_concurrent, len(chains)), thread_name_prefix="backup") as pool:
+            for chain_results in pool.map(run_chain, chains.values()):
+                finished.update(chain_results)
+        results = {target.name: finished[target.name] for target in targets}
+
+    if len(results) > 1:
+        failed = [name for name, ok in results.items() if not ok]
+        logger.info(f"Run summary: {len(results) - len(failed)}/{len(results)} targets succeeded")
+        if failed:
+            logger.error(f"Targets failed: {', '.join(failed)}")
+
+    return results
+
+
+def run_once(
+    targets: list[BackupTarget], max_concurrent: int = 1, ignore_window: bool = False, wait_for_window: bool = False
+) -> dict[str, bool]:
+    """Back up every target once, e.g. for a manual backup outside the schedule.
+
+    Args:
+        targets: Backup targets to back up
+        max_concurrent: Targets backed up at the same time
+        ignore_window: Back up targets outside their backup windows too, e.g. in an emergency
+        wait_for_window: Wait for a target's backup window to open instead of refusing to back it up
+
+    Returns:
+        Whether each target was backed up, by name
+    """
+    return _run_targets(targets, max_concurrent, ignore_window=ignore_window, wait_for_window=wait_for_window)
+
+
+def _run_task(task: ScheduledTask) -> None:
+    """Run a scheduled task, logging instead of raising when it fails."""
+    logger.info(f"Running scheduled {task.name}")
+    try:
+        if not task.run():
+            logger.error(f"Scheduled {task.name} failed")
+    except Exception as e:
+        logger.error(f"Unexpected error during scheduled {task.name}: {e}")
+
+
+def _local(moment: datetime, tz: tzinfo) -> str:
+    """Format a time in a timezone, e.g. '2024-01-15T03:00:00+01:00 (Europe/Berlin)'."""
+    return f"{moment.astimezone(tz).isoformat()} ({tz})"
+
+
+def delayed_start(run: BackupTarget, occurrence: datetime) -> datetime:
+    """Return when a scheduled run starts: at its occurrence, delayed by a random part of the target's jitter.
+
+    The delay is chosen afresh for every run. A jitter that could delay
+    the run past the schedule's following occurrence is capped at half the
+    time until then, with a warning.
+
+    Args:
+        run: Target, or tier of one, the scheduler runs
+        occurrence: When the schedule falls due
+    """
+    if not run.jitter:
+        return occurrence
+
+    jitter = run.jitter
+    gap = get_next_run_time(run.schedule, occurrence, run.tz) - occurrence
+    if jitter >= gap:
+        jitter = gap / 2
+        logger.warning(
+            f"Target '{run.run_name}': a jitter of {run.jitter.total_seconds():.0f}s could delay the run due at "
+            f"{_local(occurrence, run.tz)} past the next one, capping it at {jitter.total_seconds():.0f}s"
+        )
+
+    start = occurrence + timedelta(seconds=random.uniform(0, jitter.total_seconds()))
+    logger.info(
+        f"Target '{run.run_name}': run due at {_local(occurrence, run.tz)} starts at {_local(start, run.tz)}, "
+        f"{(start - occurrence).total_seconds():.0f}s later by jitter"
+    )
+    return start
+
+
+def _missed_occurrence(run: BackupTarget, last_due: datetime, now: datetime) -> datetime | None:
+    """Return the latest time a run's schedule fell due after last_due and by now, None if it did not."""
+    missed = None
+    occurrence = get_next_run_time(run.schedule, last_due, run.tz)
+    while occurrence <= now:
+        missed = occurrence
+        occurrence = get_next_run_time(run.schedule, occurrence, run.tz)
+    return missed
+
+
+def _catch_up_runs(runs: list[BackupTarget], grace: timedelta) -> dict[str, tuple[BackupTarget, datetime]]:
+    """Return the runs whose schedule fell due since their last recorded run, by name, with when it last did.
+
+    A run later than the grace period is labelled as catching up on the
+    run it missed; a later one runs as it would have. Runs without a
+    record, e.g. on the first start, have missed nothing.
+    """
+    now = datetime.now(timezone.utc)
+    missed_runs = {}
+    for run in runs:
+        last_due = last_run(run.storage_adapter, run.run_name)
+        missed = _missed_occurrence(run, last_due, now) if last_due is not None else None
+        if missed is None:
+            continue
+        late = (now - missed).total_seconds()
+        if late > grace.total_seconds():
+            logger.warning(
+                f"Target '{run.run_name}': missed the run due at {_local(missed, run.tz)}, catching up on it now"
+            )
+            run = replace(run, labels={**run.labels, CATCH_UP_LABEL: missed.isoformat()})
+        else:
+            logger.info(f"Target '{run.run_name}': running the run due at {_local(missed, run.tz)}, {late:.0f}s late")
+        missed_runs[run.run_name] = (run, missed)
+    return missed_runs
+
+
+def _one_run_per_target(due: list[BackupTarget]) -> tuple[list[BackupTarget], list[BackupTarget]]:
+    """Split tiers of one target falling due together into the one kept longest, which runs, and the rest."""
+    kept: dict[str, BackupTarget] = {}
+    for run in due:
+        if run.name not in kept or run.retention_days > kept[run.name].retention_days:
+            kept[run.name] = run
+    runs = [run for run in due if kept[run.name] is run]
+    return runs, [run for run in due if kept[run.name] is not run]
+
+
+def run_scheduler(
+    targets: list[BackupTarget],
     run_immediately: bool = True,
+    max_concurrent: int = 1,
+    tasks: Sequence[ScheduledTask] = (),
+    stop: threading.Event | None = None,
+    catch_up: timedelta | None = None,
 ) -> None:
     """Run the backup scheduler loop.
 
+    Each target follows its own schedule, in its own timezone, or a target
+    with tiers each of its tiers' schedules; when several tiers of a target
+    fall due together, only the one kept longest is backed up. A target
+    with jitter starts each scheduled run a random while after it falls
+    due, the same for all its tiers falling due together. A run outside
+    its target's backup window, including the one on start, is refused.
+    Targets that fall due at the same time are backed up up to
+    max_concurrent at a time, and one after another by default. Tasks
+    follow their own schedules too, run after the backups due at the same
+    time, and are not run on start. While paused, see pause, runs and
+    tasks falling due are skipped and recorded instead.
+
+    With catch_up, every completed scheduled run is recorded in its
+    target's storage, and on start a run whose schedule fell due since its
+    last record, e.g. while NestVault was down, runs instead of the
+    target's initial backup, labelled as a catch-up once later than the
+    grace period.
+
+    A schedule handed over with reschedule, e.g. after the configuration
+    was reloaded, replaces the targets, tasks and max_concurrent once the
+    runs under way finish. Its runs are scheduled from then on, without
+    an initial backup or catching up.
+
     Args:
-        config: Application configuration
-        backup_adapter: Database backup adapter
-        storage_adapter: Storage adapter
-        run_immediately: If True, run a backup immediately on start
+        targets: Backup targets to schedule
+        run_immediately: If True, back up every target immediately on start, in the ad hoc tier if it has tiers
+        max_concurrent: Targets backed up at the same time
+        tasks: Other work to run on a schedule
+        stop: Once set, the loop returns after the runs under way; None runs until interrupted
+        catch_up: Grace period after which a run missed before the start is caught up on; None never catches up
     """
-    logger.info(f"Starting scheduler with schedule: {config.backup_schedule}")
-    logger.info(f"Retention policy: {config.retention_days} days")
+    runs: list[BackupTarget] = []
+    # When each run falls due, and when it starts once delayed by its target's jitter
+    next_runs: dict[str, datetime] = {}
+    starts: dict[str, datetime] = {}
+    next_tasks: dict[str, datetime] = {}
+
+    def publish(name: str, schedule: str, tz: tzinfo, next_run: datetime, due: datetime | None = None) -> None:
+        with _upcoming_lock:
+            _upcoming[name] = {
+                "schedule": schedule,
+                "timezone": str(tz),
+                "next_run": next_run.isoformat(),
+                "due": (due or next_run).isoformat(),
+            }
+
+    def delay(run: BackupTarget) -> None:
+        # Tiers of a target falling due together start together, so only the one kept longest runs
+        occurrence = next_runs[run.run_name]
+        siblings = [
+            other.run_name
+            for other in runs
+            if other.name == run.name and other is not run and other.run_name in starts
+            and next_runs[other.run_name] == occurrence
+        ]
+        starts[run.run_name] = starts[siblings[0]] if siblings else delayed_start(run, occurrence)
+        publish(run.run_name, run.schedule, run.tz, starts[run.run_name], occurrence)
+
+    def configure(targets: list[BackupTarget], tasks: Sequence[ScheduledTask], max_concurrent: int) -> None:
+        previous = {*next_runs, *next_tasks}
+        runs[:] = scheduled_runs(targets)
+        register([target.name for target in targets])
+        next_runs.clear()
+        next_runs.update({run.run_name: get_next_run_time(run.schedule, tz=run.tz) for run in runs})
+        starts.clear()
+        next_tasks.clear()
+        next_tasks.update({task.name: get_next_run_time(task.schedule, tz=task.tz) for task in tasks})
+        # Targets and tasks a reload removed are no longer upcoming
+        with _upcoming_lock:
+            for name in previous - {*next_runs, *next_tasks}:
+                _upcoming.pop(name, None)
+
+        for target in targets:
+            for replica in target.replicas:
+                retention = _retention(replica.retention_days, target.gfs)
+                logger.info(f"Target '{target.name}': replicated to {replica.name}, {retention}")
+            if target.failover:
+                logger.info(f"Target '{target.name}': fails over to {', '.join(f.name for f in target.failover)}")
+
+        for run in runs:
+            jitter = f", jitter up to {run.jitter.total_seconds():.0f}s" if run.jitter else ""
+            window = f", backup window {run.window.describe()}" if run.window else ""
+            logger.info(
+                f"Target '{run.run_name}': schedule {run.schedule}{jitter}{window}, "
+                f"{_retention(run.retention_days, run.gfs)}, next run at {_local(next_runs[run.run_name], run.tz)}"
+            )
+            delay(run)
 
+        for task in tasks:
+            logger.info(
+                f"Scheduled {task.name}: schedule {task.schedule}, "
+                f"next run at {_local(next_tasks[task.name], task.tz)}"
+            )
+            publish(task.name, task.schedule, task.tz, next_tasks[task.name])
+
+        if max_concurrent > 1:
+            logger.info(f"Backing up up to {max_concurrent} targets at a time")
+
+    configure(targets, tasks, max_concurrent)
+
+    def schedule_next(run: BackupTarget, after: datetime | None = None) -> None:
+        # A target's next run is counted from when its own backup finished
+        next_runs[run.run_name] = get_next_run_time(run.schedule, after, run.tz)
+        delay(run)
+
+    def schedule_tiers(target: BackupTarget) -> None:
+        for run in runs:
+            if run.name == target.name:
+                schedule_next(run)
+
+    def record(ran: list[BackupTarget], results: dict[str, bool], occurrences: dict[str, datetime]) -> None:
+        if catch_up is None:
+            return
+        finished_at = datetime.now(timezone.utc)
+        for run in ran:
+            if results[run.name]:
+                record_run(run.storage_adapter, run.run_name, occurrences[run.run_name], finished_at)
+
+    missed = _catch_up_runs(runs, catch_up) if catch_up is not None else {}
+    catch_ups, covered = _one_run_per_target([run for run, _ in missed.values()])
+    for run in covered:
+        logger.info(f"Target '{run.run_name}': not caught up on, a tier kept longer catches up instead")
+    initial = list(catch_ups)
     if run_immediately:
         logger.info("Running initial backup")
-        run_backup_job(backup_adapter, storage_adapter, config.retention_days)
+        caught_up = {run.name for run in catch_ups}
+        initial += [
+            for_tier(target, ADHOC_TIER) if target.tiers else target
+            for target in targets
+            if target.name not in caught_up
+        ]
+    if initial:
+        results = _run_targets(initial, max_concurrent, schedule_tiers)
+        record(catch_ups, results, {name: occurrence for name, (_, occurrence) in missed.items()})
 
-    while True:
-        next_run = get_next_run_time(config.backup_schedule)
-        logger.info(f"Next backup scheduled for: {next_run.isoformat()}")
+    while stop is None or not stop.is_set():
+        rescheduled = _take_rescheduled()
+        if rescheduled is not None:
+            logger.info("Scheduling the targets and tasks of the reloaded configuration")
+            targets, tasks, max_concurrent = rescheduled.targets, rescheduled.tasks, rescheduled.max_concurrent
+            configure(targets, tasks, max_concurrent)
+
+        next_run = min([*starts.values(), *next_tasks.values()])
+        due, coinciding = _one_run_per_target([run for run in runs if starts[run.run_name] == next_run])
+        due_tasks = [task for task in tasks if next_tasks[task.name] == next_run]
+        current_pause = paused()
+        note = ""
+        if current_pause is not None and (current_pause.until is None or current_pause.until > next_run):
+            until = current_pause.until.isoformat() if current_pause.until else "resumed"
+            note = f", skipped as scheduling is paused until {until}"
+        logger.info(
+            f"Next run scheduled for: {next_run.isoformat()} "
+            f"({', '.join([*(run.run_name for run in due), *(task.name for task in due_tasks)])}){note}"
+        )
 
         now = datetime.now(timezone.utc)
         wait_seconds = (next_run - now).total_seconds()
 
         if wait_seconds > 0:
             logger.debug(f"Sleeping for {wait_seconds:.0f} seconds")
-            time.sleep(wait_seconds)
+            if stop is None:
+                time.sleep(wait_seconds)
+            elif _wait(stop, wait_seconds):
+                break
+            if _rescheduled is not None:
+                continue
+
+        for run in coinciding:
+            logger.info(f"Target '{run.run_name}': skipped, a tier kept longer is backed up at the same time")
+            schedule_next(run, next_runs[run.run_name])
+        for run in [run for run in due if _skip_while_paused(run.run_name, next_runs[run.run_name])]:
+            due.remove(run)
+            schedule_next(run, next_runs[run.run_name])
+        occurrences = {run.run_name: next_runs[run.run_name] for run in due}
+        record(due, _run_targets(due, max_concurrent, schedule_next), occurrences)
+        for task in due_tasks:
+            if not _skip_while_paused(task.name, next_tasks[task.name]):
+                _run_task(task)
+            next_tasks[task.name] = get_next_run_time(task.schedule, tz=task.tz)
+            publish(task.name, task.schedule, task.tz, next_tasks[task.name])
 
-        run_backup_job(backup_adapter, storage_adapter, config.retention_days)
+    logger.info("Scheduler stopped")
@@ -0,0 +1,145 @@
+"""Timings and sizes of the phases of a backup."""
+
+from __future__ import annotations
+
+import time
+from collections.abc import Iterator
+from contextlib import contextmanager
+from contextvars import ContextVar
+from dataclasses import asdict, dataclass, field
+
+from nestvault.logging import log_context
+from nestvault.status import enter_phase
+from nestvault.tracing import span
+
+MIB = 1024 * 1024
+
+# Phases in the order a backup goes through them
+PHASES = ("dump", "compress", "encrypt", "upload")
+
+
+@dataclass
+class Phase:
+    """Wall time spent in one phase of a backup, and the bytes it read and wrote when known."""
+
+    seconds: float = 0.0
+    bytes_in: int | None = None
+    bytes_out: int | None = None
+
+    @property
+    def ratio(self) -> float | None:
+        """Return bytes in per byte out, e.g. the compression ratio."""
+        if not self.bytes_in or not self.bytes_out:
+            return None
+        return self.bytes_in / self.bytes_out
+
+    @property
+    def throughput(self) -> float | None:
+        """Return the bytes written per second."""
+        if self.bytes_out is None or self.seconds <= 0:
+            return None
+        return self.bytes_out / self.seconds
+
+    def describe(self, name: str) -> str:
+        details = []
+        if self.bytes_in is not None and self.bytes_out is not None:
+            details.append(f"{self.bytes_in / MIB:.1f} MiB -> {self.bytes_out / MIB:.1f} MiB")
+        elif self.bytes_out is not None:
+            details.append(f"{self.bytes_out / MIB:.1f} MiB")
+        if name == "compress" and self.ratio is not None:
+            details.append(f"ratio {self.ratio:.2f}")
+        if name != "compress" and self.throughput is not None:
+            details.append(f"{self.throughput / MIB:.1f} MiB/s")
+        return f"{name} {self.seconds:.1f}s" + (f" ({', '.join(details)})" if details else "")
+
+
+@dataclass
+class BackupStats:
+    """The phases of one backup, recorded as it runs.
+
+    Dump covers creating the whole backup file, compressing and encrypting
+    included, as engines compress while they dump; compress and encrypt
+    record the time spent in each within it. Streamed backups dump,
+    compress and upload at once, so they have no dump phase.
+    """
+
+    phases: dict[str, Phase] = field(default_factory=dict)
+
+    def add(self, name: str, seconds: float, bytes_in: int | None = None, bytes_out: int | None = None) -> None:
+        """Add time and bytes to a phase, e.g. of one more compressed file."""
+        phase = self.phases.setdefault(name, Phase())
+        phase.seconds += seconds
+        if bytes_in is not None:
+            phase.bytes_in = (phase.bytes_in or 0) + bytes_in
+        if bytes_out is not None:
+            phase.bytes_out = (phase.bytes_out or 0) + bytes_out
+
+    def to_dict(self) -> dict[str, dict[str, float | int | None]]:
+        """Return the phases in order, as recorded in manifests."""
+        return {name: asdict(self.phases[name]) for name in PHASES if name in self.phases}
+
+    @classmethod
+    def from_dict(cls, data: dict[str, dict[str, float | int | None]]) -> BackupStats:
+        """Read phases recorded in a manifest, skipping malformed ones."""
+        phases = {}
+        for name, values in data.items():
+            try:
+                phases[name] = Phase(**values)
+            except TypeError:
+                continue
+        return cls(phases)
+
+    def summary(self) -> str:
+        """Describe the phases on one line, e.g. 'dump 12.3s (310.2 MiB, 25.2 MiB/s), upload 3.1s (...)'."""
+        return ", ".join(self.phases[name].describe(name) for name in PHASES if name in self.phases)
+
+
+_current: ContextVar[BackupStats | None] = ContextVar("backup_stats", default=None)
+
+
+@contextmanager
+def collecting() -> Iterator[BackupStats]:
+    """Record the phases measured within the block into new stats."""
+    stats = BackupStats()
+    token = _current.set(stats)
+    try:
+        yield stats
+    finally:
+        _current.reset(token)
+
+
+def current() -> BackupStats | None:
+    """Return the stats being collected, or None outside a backup."""
+    return _current.get()
+
+
+def record(name: str, seconds: float, bytes_in: int | None = None, bytes_out: int | None = None) -> None:
+    """Add time and bytes to a phase of the backup being collected, if any."""
+    stats = _current.get()
+    if stats is not None:
+        stats.add(name, seconds, bytes_in, bytes_out)
+
+
+@contextmanager
+def measure(name: str) -> Iterator[Phase]:
+    """Time a block as a phase of the backup being collected.
+
+    The phase replaces an earlier measurement of the same name, so a
+    retried upload records its last attempt. Set bytes on the yielded
+    phase to record them. Lines logged within the block carry the phase,
+    the block is traced as a span with the bytes, and the run's status
+    shows the phase.
+    """
+    phase = Phase()
+    enter_phase(name)
+    started = time.perf_counter()
+    with span(name) as traced:
+        try:
+            with log_context(phase=name):
+                yield phase
+        finally:
+            phase.seconds = time.perf_counter() - started
+            traced.set(bytes_in=phase.bytes_in, bytes_out=phase.bytes_out)
+            stats = _current.get()
+            if stats is not None:
+                stats.phases[name] = phase
@@ -0,0 +1,166 @@
+"""Last and running backup runs of every target, for the /status and /healthz endpoints."""
+
+from __future__ import annotations
+
+import threading
+import time
+from collections.abc import Iterator, Mapping
+from contextlib import contextmanager
+from contextvars import ContextVar
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta, timezone
+
+# Schedules of every run and task by name, as scheduler.upcoming() returns them
+Upcoming = Mapping[str, Mapping[str, str]]
+
+
+@dataclass
+class TargetStatus:
+    """The last finished run of a target, and the run under way if there is one."""
+
+    last_run: datetime | None = None
+    # 'success' or 'failure'; None until a run finished
+    status: str | None = None
+    duration: float | None = None
+    # Bytes of the backups the last run stored, over all its databases
+    size: int | None = None
+    running_since: datetime | None = None
+    # Phase of the run under way, e.g. 'dump' or 'upload', and the share of it done when known
+    phase: str | None = None
+    progress: float | None = None
+    # Full errors of the databases the last run failed to back up, by database
+    errors: dict[str, str] = field(default_factory=dict)
+
+
+@dataclass
+class Run:
+    """A run of a target under way; set succeeded before it ends."""
+
+    status: TargetStatus
+    size: int | None = None
+    succeeded: bool = False
+    errors: dict[str, str] = field(default_factory=dict)
+
+
+_targets: dict[str, TargetStatus] = {}
+_lock = threading.Lock()
+_current: ContextVar[Run | None] = ContextVar("status_run", default=None)
+
+
+def register(names: list[str]) -> None:
+    """List targets in the status before they first run, e.g. every target the scheduler runs."""
+    with _lock:
+        for name in names:
+            _targets.setdefault(name, TargetStatus())
+
+
+@contextmanager
+def tracking(name: str) -> Iterator[Run]:
+    """Report a target as running until the block ends, then record the run as its last one.
+
+    A block left with an exception is recorded as a failed run.
+    """
+    with _lock:
+        status = _targets.setdefault(name, TargetStatus())
+        status.running_since = datetime.now(timezone.utc)
+        status.phase = status.progress = None
+    run = Run(status)
+    started = time.monotonic()
+    token = _current.set(run)
+    try:
+        yield run
+    finally:
+        _current.reset(token)
+        with _lock:
+            status.last_run = datetime.now(timezone.utc)
+            status.status = "success" if run.succeeded else "failure"
+            status.duration = time.monotonic() - started
+            status.size = run.size
+            status.errors = run.errors
+            status.running_since = status.phase = status.progress = None
+
+
+def current_run() -> Run | None:
+    """Return the run under way, or None outside of one; threads working for it are handed it from here."""
+    return _current.get()
+
+
+def enter_phase(phase: str) -> None:
+    """Report the run under way as having moved on to a phase, whose progress is unknown so far."""
+    run = _current.get()
+    if run is not None:
+        with _lock:
+            run.status.phase, run.status.progress = phase, None
+
+
+def report_progress(run: Run | None, fraction: float) -> None:
+    """Report the share of the current phase of a run that is done, from any thread."""
+    if run is not None:
+        with _lock:
+            run.status.progress = min(max(fraction, 0.0), 1.0)
+
+
+def add_backup(size: int | None) -> None:
+    """Count a backup stored by the run under way towards its size."""
+    run = _current.get()
+    if run is not None and size is not None:
+        with _lock:
+            run.size = (run.size or 0) + size
+
+
+def add_error(database: str, error: str) -> None:
+    """Record why the run under way failed to back up a database, in full, for notifications to point at."""
+    run = _current.get()
+    if run is not None:
+        with _lock:
+            run.errors[database] = error
+
+
+def _runs_of(name: str, upcoming: Upcoming) -> list[Mapping[str, str]]:
+    """Return the schedules of a target: its own, or one per tier, e.g. 'billing/hourly'."""
+    return [run for run_name, run in upcoming.items() if run_name == name or run_name.startswith(f"{name}/")]
+
+
+def _next(runs: list[Mapping[str, str]], field: str) -> datetime | None:
+    times = [datetime.fromisoformat(run[field]) for run in runs if run.get(field)]
+    return min(times) if times else None
+
+
+def _describe(name: str, status: TargetStatus, upcoming: Upcoming) -> dict[str, object]:
+    next_run = _next(_runs_of(name, upcoming), "next_run")
+    return {
+        "last_run": status.last_run.isoformat() if status.last_run else None,
+        "status": status.status,
+        "duration": round(status.duration, 3) if status.duration is not None else None,
+        "size": status.size,
+        "next_run": next_run.isoformat() if next_run else None,
+        "in_progress": status.running_since is not None,
+        "running_since": status.running_since.isoformat() if status.running_since else None,
+        "phase": status.phase,
+        "progress": round(status.progress * 100, 1) if status.progress is not None else None,
+        "errors": dict(status.errors),
+    }
+
+
+def snapshot(upcoming: Upcoming) -> dict[str, dict[str, object]]:
+    """Return the status of every target by name, as served on /status; progress is a percentage."""
+    with _lock:
+        return {name: _describe(name, status, upcoming) for name, status in sorted(_targets.items())}
+
+
+def problems(upcoming: Upcoming, overdue: timedelta, now: datetime | None = None) -> list[str]:
+    """Return why the backups are unhealthy, as /healthz reports it: none when they are healthy.
+
+    A target is unhealthy while its last run failed, or once a run of it
+    fell due more than overdue ago without starting.
+    """
+    now = now or datetime.now(timezone.utc)
+    found = []
+    with _lock:
+        for name, status in sorted(_targets.items()):
+            if status.status == "failure":
+                found.append(f"{name}: last run failed at {status.last_run.isoformat()}")
+            due = _next(_runs_of(name, upcoming), "due")
+            if status.running_since is None and due is not None and now - due > overdue:
+                found.append(f"{name}: overdue, its run was due at {due.isoformat()}")
+    return found
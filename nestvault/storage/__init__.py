@@ -4,10 +4,22 @@ from nestvault.storage.base import StorageAdapter
 from nestvault.storage.s3 import S3StorageAdapter
 from nestvault.storage.backblaze import BackblazeStorageAdapter
 from nestvault.storage.r2 import R2StorageAdapter
+from nestvault.storage.gcs import GCSStorageAdapter
+from nestvault.storage.azblob import AzureBlobStorageAdapter
+from nestvault.storage.sftp import SFTPStorageAdapter
+from nestvault.storage.local import LocalStorageAdapter
+from nestvault.storage.webdav import WebDAVStorageAdapter
+from nestvault.storage.prefixed import PrefixedStorageAdapter
 
 __all__ = [
     "StorageAdapter",
     "S3StorageAdapter",
     "BackblazeStorageAdapter",
     "R2StorageAdapter",
+    "GCSStorageAdapter",
+    "AzureBlobStorageAdapter",
+    "SFTPStorageAdapter",
+    "LocalStorageAdapter",
+    "WebDAVStorageAdapter",
+    "PrefixedStorageAdapter",
 ]
@@ -0,0 +1,299 @@
+"""Azure Blob Storage adapter using azure-storage-blob."""
+
+from __future__ import annotations
+
+import base64
+from pathlib import Path
+
+from azure.core import MatchConditions
+from azure.core.exceptions import (
+    AzureError,
+    HttpResponseError,
+    ResourceExistsError,
+    ResourceModifiedError,
+    ResourceNotFoundError,
+)
+from azure.identity import DefaultAzureCredential
+from azure.storage.blob import BlobBlock, BlobServiceClient
+
+from nestvault.config import AzureBlobConfig
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.throttle import pace, throttled_writer
+
+logger = get_logger("storage.azblob")
+
+# Most sub-requests a single blob batch request may contain
+BATCH_SIZE = 256
+
+
+class AzureBlobStorageAdapter(StorageAdapter):
+    """Storage adapter for Azure Blob Storage.
+
+    Backups are block blobs. Files larger than one block are uploaded as
+    staged blocks and committed as a block list, so no single request has
+    to carry the whole dump. Blobs in the Archive tier show up in listings
+    and can be pruned, but must be rehydrated before they can be restored.
+    """
+
+    def __init__(self, config: AzureBlobConfig):
+        """Initialize the Azure Blob Storage adapter.
+
+        Args:
+            config: Azure Blob configuration
+
+        Raises:
+            StorageError: If the client cannot be created
+        """
+        self.config = config
+
+        try:
+            if config.connection_string:
+                service = BlobServiceClient.from_connection_string(config.connection_string)
+            elif config.account_key:
+                service = BlobServiceClient(
+                    config.account_url,
+                    credential={"account_name": config.account_name, "account_key": config.account_key},
+                )
+            elif config.sas_token:
+                service = BlobServiceClient(config.account_url, credential=config.sas_token.lstrip("?"))
+            else:
+                credential = DefaultAzureCredential(managed_identity_client_id=config.client_id)
+                service = BlobServiceClient(config.account_url, credential=credential)
+
+            self.container = service.get_container_client(config.container)
+            logger.debug(f"Initialized Azure Blob client for container '{config.container}'")
+        except (AzureError, ValueError) as e:
+            logger.error(f"Failed to initialize Azure Blob client: {e}")
+            raise StorageError(f"Failed to initialize Azure Blob Storage: {e}")
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Upload a file as a block blob in the configured access tier.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Blob name in the container
+            metadata: Optional metadata stored with the blob
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        logger.info(f"Uploading {local_path.name} to azblob://{self.config.container}/{remote_key}")
+
+        block_size = self.config.block_size_mb * 1024 * 1024
+        blob = self.container.get_blob_client(remote_key)
+
+        try:
+            with open(local_path, "rb") as f:
+                if local_path.stat().st_size <= block_size:
+                    pace(self.upload_throttle, local_path.stat().st_size)
+                    blob.upload_blob(
+                        f, overwrite=True, metadata=metadata, standard_blob_tier=self.config.access_tier
+                    )
+                else:
+                    blocks = []
+                    while chunk := f.read(block_size):
+                        # Block IDs must all have the same length within a blob
+                        block_id = base64.b64encode(f"{len(blocks):08d}".encode()).decode()
+                        pace(self.upload_throttle, len(chunk))
+                        blob.stage_block(block_id, chunk)
+                        blocks.append(BlobBlock(block_id=block_id))
+
+                    logger.debug(f"Committing {len(blocks)} blocks for {remote_key}")
+                    blob.commit_block_list(blocks, metadata=metadata, standard_blob_tier=self.config.access_tier)
+
+            logger.info(f"Upload completed: {remote_key}")
+        except (AzureError, OSError) as e:
+            logger.error(f"Azure Blob upload failed: {e}")
+            raise StorageError(f"Failed to upload to Azure Blob Storage: {e}")
+
+    @property
+    def supports_exclusive_create(self) -> bool:
+        return True
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a small file as a block blob unless a blob of that name exists.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.container.get_blob_client(remote_key).upload_blob(local_path.read_bytes(), overwrite=False)
+            return True
+        except ResourceExistsError:
+            return False
+        except (AzureError, OSError) as e:
+            logger.error(f"Azure Blob upload failed: {e}")
+            raise StorageError(f"Failed to upload to Azure Blob Storage: {e}")
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a small blob along with its ETag.
+
+        Raises:
+            StorageError: If the blob cannot be read
+        """
+        try:
+            downloader = self.container.get_blob_client(remote_key).download_blob()
+            return downloader.readall(), downloader.properties.etag
+        except ResourceNotFoundError:
+            return None
+        except AzureError as e:
+            logger.error(f"Azure Blob read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from Azure Blob Storage: {e}")
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Overwrite a small blob on the condition that its ETag is unchanged.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.container.get_blob_client(remote_key).upload_blob(
+                local_path.read_bytes(), overwrite=True, etag=version, match_condition=MatchConditions.IfNotModified
+            )
+            return True
+        except (ResourceModifiedError, ResourceNotFoundError):
+            return False
+        except (AzureError, OSError) as e:
+            logger.error(f"Azure Blob upload failed: {e}")
+            raise StorageError(f"Failed to upload to Azure Blob Storage: {e}")
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List blobs in the container.
+
+        Args:
+            prefix: Filter blobs by name prefix
+
+        Returns:
+            List of StorageObject instances, with archived blobs flagged
+
+        Raises:
+            StorageError: If listing fails
+        """
+        logger.debug(f"Listing objects with prefix '{prefix}'")
+
+        try:
+            objects = [
+                StorageObject(
+                    key=blob.name,
+                    size=blob.size,
+                    last_modified=blob.last_modified,
+                    archived=blob.blob_tier == "Archive",
+                )
+                for blob in self.container.list_blobs(name_starts_with=prefix)
+            ]
+
+            logger.debug(f"Found {len(objects)} objects")
+            return objects
+
+        except AzureError as e:
+            logger.error(f"Azure Blob list failed: {e}")
+            raise StorageError(f"Failed to list Azure blobs: {e}")
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the metadata stored with a blob; this works for archived blobs too.
+
+        Args:
+            remote_key: Blob name
+
+        Returns:
+            Metadata dictionary
+
+        Raises:
+            StorageError: If the blob cannot be read
+        """
+        try:
+            properties = self.container.get_blob_client(remote_key).get_blob_properties()
+            return dict(properties.metadata or {})
+        except AzureError as e:
+            logger.error(f"Azure Blob properties lookup failed: {e}")
+            raise StorageError(f"Failed to read Azure blob metadata: {e}")
+
+    def delete(self, remote_key: str) -> None:
+        """Delete a blob and its snapshots.
+
+        Args:
+            remote_key: Blob name to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        logger.info(f"Deleting azblob://{self.config.container}/{remote_key}")
+
+        try:
+            self.container.delete_blob(remote_key, delete_snapshots="include")
+            logger.debug(f"Deleted: {remote_key}")
+        except ResourceNotFoundError:
+            logger.debug(f"Already deleted: {remote_key}")
+        except AzureError as e:
+            logger.error(f"Azure Blob delete failed: {e}")
+            raise StorageError(f"Failed to delete Azure blob: {e}")
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple blobs with batch requests.
+
+        Blobs that no longer exist are skipped.
+
+        Args:
+            remote_keys: List of blob names to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        if not remote_keys:
+            return
+
+        logger.info(f"Deleting {len(remote_keys)} objects from Azure Blob Storage")
+
+        try:
+            for i in range(0, len(remote_keys), BATCH_SIZE):
+                batch = remote_keys[i : i + BATCH_SIZE]
+                responses = self.container.delete_blobs(
+                    *batch, delete_snapshots="include", raise_on_any_failure=False
+                )
+                failed = [response for response in responses if response.status_code not in (202, 404)]
+                if failed:
+                    raise StorageError(
+                        f"Failed to delete {len(failed)} Azure blobs: HTTP {failed[0].status_code} {failed[0].reason}"
+                    )
+
+            logger.info(f"Deleted {len(remote_keys)} objects")
+
+        except AzureError as e:
+            logger.error(f"Azure Blob bulk delete failed: {e}")
+            raise StorageError(f"Failed to delete Azure blobs: {e}")
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Download a blob.
+
+        Args:
+            remote_key: Blob name in the container
+            local_path: Local path to save the downloaded file
+
+        Raises:
+            StorageError: If the download fails or the blob is archived
+        """
+        logger.info(f"Downloading azblob://{self.config.container}/{remote_key} to {local_path}")
+
+        try:
+            with open(local_path, "wb") as f:
+                self.container.get_blob_client(remote_key).download_blob().readinto(
+                    throttled_writer(f, self.download_throttle)
+                )
+            logger.info(f"Download completed: {local_path}")
+        except HttpResponseError as e:
+            if e.error_code == "BlobArchived":
+                raise StorageError(
+                    f"{remote_key} is in the Archive tier, rehydrate it to Hot or Cool before restoring"
+                )
+            logger.error(f"Azure Blob download failed: {e}")
+            raise StorageError(f"Failed to download from Azure Blob Storage: {e}")
+        except (AzureError, OSError) as e:
+            logger.error(f"Azure Blob download failed: {e}")
+            raise StorageError(f"Failed to download from Azure Blob Storage: {e}")
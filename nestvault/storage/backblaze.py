@@ -2,21 +2,44 @@
 
 from __future__ import annotations
 
+import hashlib
 from pathlib import Path
 
-from b2sdk.v2 import B2Api, InMemoryAccountInfo
+from b2sdk.v2 import AbstractProgressListener, B2Api, InMemoryAccountInfo
 from b2sdk.v2.exception import B2Error
 
 from nestvault.config import BackblazeConfig
 from nestvault.exceptions import StorageError
 from nestvault.logging import get_logger
-from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.storage.base import ExternalLocation, StorageAdapter, StorageObject
+from nestvault.throttle import Throttle, throttled_writer
 
 logger = get_logger("storage.backblaze")
 
 
+class ThrottledProgressListener(AbstractProgressListener):
+    """Paces an upload by the bytes b2sdk reports as completed, which it does as it reads them."""
+
+    def __init__(self, throttle: Throttle):
+        super().__init__()
+        self.throttle = throttle
+        self.completed = 0
+
+    def set_total_bytes(self, total_byte_count: int) -> None:
+        pass
+
+    def bytes_completed(self, byte_count: int) -> None:
+        self.throttle(byte_count - self.completed)
+        self.completed = max(self.completed, byte_count)
+
+
 class BackblazeStorageAdapter(StorageAdapter):
-    """Storage adapter for Backblaze B2."""
+    """Storage adapter for Backblaze B2 using the native B2 API.
+
+    Large backups are uploaded as B2 large files with a SHA1 per part.
+    b2sdk fetches a fresh upload URL and retries when a pod answers 503.
+    Downloads that break off are resumed with range requests.
+    """
 
     def __init__(self, config: BackblazeConfig):
         """Initialize the Backblaze B2 storage adapter.
@@ -36,12 +59,18 @@ class BackblazeStorageAdapter(StorageAdapter):
             logger.error(f"Failed to initialize B2 client: {e}")
             raise StorageError(f"Failed to initialize Backblaze B2: {e}")
 
-    def upload(self, local_path: Path, remote_key: str) -> None:
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
         """Upload a file to Backblaze B2.
 
         Args:
             local_path: Path to the local file
             remote_key: Key/path in the B2 bucket
+            metadata: Optional file info stored with the object
 
         Raises:
             StorageError: If the upload fails
@@ -52,6 +81,9 @@ class BackblazeStorageAdapter(StorageAdapter):
             self.bucket.upload_local_file(
                 local_file=str(local_path),
                 file_name=remote_key,
+                file_infos=metadata,
+                min_part_size=self.config.part_size_mb * 1000 * 1000,
+                progress_listener=ThrottledProgressListener(self.upload_throttle) if self.upload_throttle else None,
             )
             logger.info(f"Upload completed: {remote_key}")
         except B2Error as e:
@@ -91,6 +123,25 @@ class BackblazeStorageAdapter(StorageAdapter):
             logger.error(f"B2 list failed: {e}")
             raise StorageError(f"Failed to list B2 objects: {e}")
 
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the file info stored with a B2 object.
+
+        Args:
+            remote_key: Key/path of the object
+
+        Returns:
+            Metadata dictionary
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        try:
+            file_version = self.bucket.get_file_info_by_name(remote_key)
+            return dict(file_version.file_info or {})
+        except B2Error as e:
+            logger.error(f"B2 file info lookup failed: {e}")
+            raise StorageError(f"Failed to read B2 object metadata: {e}")
+
     def delete(self, remote_key: str) -> None:
         """Delete an object from Backblaze B2.
 
@@ -138,7 +189,11 @@ class BackblazeStorageAdapter(StorageAdapter):
         logger.info(f"Deleted {len(remote_keys)} objects")
 
     def download(self, remote_key: str, local_path: Path) -> None:
-        """Download a file from Backblaze B2.
+        """Download a file from Backblaze B2, resuming interrupted transfers.
+
+        When a transfer breaks off, the rest of the file is fetched with a
+        range request, and the SHA1 of the finished file is checked against
+        the one B2 recorded at upload.
 
         Args:
             remote_key: Key/path of the object in the B2 bucket
@@ -150,9 +205,75 @@ class BackblazeStorageAdapter(StorageAdapter):
         logger.info(f"Downloading b2://{self.config.bucket}/{remote_key} to {local_path}")
 
         try:
-            downloaded_file = self.bucket.download_file_by_name(remote_key)
-            downloaded_file.save_to(str(local_path))
+            file_version = self.bucket.get_file_info_by_name(remote_key)
+            resumed = False
+
+            with open(local_path, "wb") as f:
+                for attempt in range(self.config.download_retries + 1):
+                    offset = f.tell()
+                    try:
+                        if offset:
+                            downloaded = self.bucket.download_file_by_name(
+                                remote_key, range_=(offset, file_version.size - 1)
+                            )
+                        else:
+                            downloaded = self.bucket.download_file_by_name(remote_key)
+                        # Write sequentially so the file position is where a resume starts
+                        downloaded.save(throttled_writer(f, self.download_throttle), allow_seeking=False)
+                        break
+                    except (B2Error, ConnectionError) as e:
+                        if attempt == self.config.download_retries:
+                            raise
+                        resumed = True
+                        logger.warning(
+                            f"Download of {remote_key} interrupted at {f.tell()} of {file_version.size} bytes, "
+                            f"resuming (retry {attempt + 1}/{self.config.download_retries}): {e}"
+                        )
+
+            if resumed:
+                self._verify_sha1(file_version, local_path)
+
             logger.info(f"Download completed: {local_path}")
-        except B2Error as e:
+        except (B2Error, ConnectionError, OSError) as e:
             logger.error(f"B2 download failed: {e}")
             raise StorageError(f"Failed to download from Backblaze B2: {e}")
+
+    def _verify_sha1(self, file_version, local_path: Path) -> None:
+        """Check a resumed download against the SHA1 recorded for the file.
+
+        Raises:
+            StorageError: If the checksums differ
+        """
+        # Large files have no content SHA1 unless the uploader recorded one in the file info
+        expected = file_version.content_sha1
+        if not expected or expected == "none":
+            expected = (file_version.file_info or {}).get("large_file_sha1")
+        if not expected:
+            logger.warning(f"{file_version.file_name} has no recorded SHA1, resumed download not verified")
+            return
+
+        sha1 = hashlib.sha1()
+        with open(local_path, "rb") as f:
+            for chunk in iter(lambda: f.read(1024 * 1024), b""):
+                sha1.update(chunk)
+
+        if sha1.hexdigest() != expected.removeprefix("unverified:"):
+            raise StorageError(f"Resumed download of {file_version.file_name} does not match its SHA1")
+
+    def external_location(self, remote_key: str) -> ExternalLocation:
+        """Return the location of a key on B2's S3-compatible API.
+
+        Args:
+            remote_key: Key/path in the B2 bucket
+
+        Returns:
+            Location including this adapter's credentials and S3 endpoint
+        """
+        return ExternalLocation(
+            bucket=self.config.bucket,
+            key=remote_key,
+            region=self.config.region,
+            access_key=self.config.key_id,
+            secret_key=self.config.application_key,
+            endpoint=f"https://s3.{self.config.region}.backblazeb2.com",
+        )
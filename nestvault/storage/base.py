@@ -2,10 +2,33 @@
 
 from __future__ import annotations
 
+import tempfile
+import threading
+import time
 from abc import ABC, abstractmethod
-from dataclasses import dataclass
-from datetime import datetime
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta
 from pathlib import Path
+from typing import BinaryIO
+from urllib.parse import quote, urlencode
+
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.status import current_run, report_progress
+from nestvault.throttle import Throttle, pace
+
+logger = get_logger("storage")
+
+# File-based backends have no object metadata and keep it in a sidecar file instead
+METADATA_SUFFIX = ".meta.json"
+
+# File-based backends hide uploads in progress under a dot name with this suffix
+PARTIAL_SUFFIX = ".partial"
+
+# Seconds between progress messages of a running upload
+PROGRESS_INTERVAL = 30.0
+
+MIB = 1024 * 1024
 
 
 @dataclass
@@ -15,18 +38,129 @@ class StorageObject:
     key: str
     size: int
     last_modified: datetime
+    # Offline in an archive tier and unreadable until rehydrated
+    archived: bool = False
+
+
+@dataclass
+class StreamedUpload:
+    """Size and checksum of an object uploaded from a stream, known only once it was read."""
+
+    size: int
+    sha256: str
+
+
+@dataclass
+class InterruptedUpload:
+    """A multipart upload left unfinished by a run that died."""
+
+    key: str
+    # Backup file being uploaded, or None for a streamed upload, which cannot be resumed
+    local_path: Path | None
+    started: datetime
+    metadata: dict[str, str] = field(default_factory=dict)
+
+
+class TransferProgress:
+    """Counts the bytes of an upload whose parts are sent by several workers.
+
+    Called with the size of every part or chunk as it completes, from any
+    thread, and logs the running total and rate at most every
+    PROGRESS_INTERVAL seconds.
+    """
+
+    def __init__(self, name: str, total: int | None = None, throttle: Throttle | None = None):
+        """Initialize the progress counter.
+
+        Args:
+            name: Key of the object being uploaded
+            total: Size of the object, None while streaming
+            throttle: Upload limit to pace every chunk by, for transfers that report chunks before sending them
+        """
+        self.name = name
+        self.total = total
+        self.throttle = throttle
+        self.transferred = 0
+        self.started = self.logged = time.monotonic()
+        self.lock = threading.Lock()
+        # Parts complete in worker threads, so the run whose status shows the progress is looked up now
+        self.run = current_run()
+
+    def __call__(self, count: int) -> None:
+        pace(self.throttle, count)
+        with self.lock:
+            self.transferred += count
+            if self.total:
+                report_progress(self.run, self.transferred / self.total)
+            now = time.monotonic()
+            if now - self.logged < PROGRESS_INTERVAL:
+                return
+            self.logged = now
+            transferred = self.transferred
+
+        rate = transferred / MIB / max(now - self.started, 0.001)
+        total = f" of {self.total / MIB:.0f} MiB" if self.total else ""
+        logger.info(f"Uploading {self.name}: {transferred / MIB:.0f} MiB{total} ({rate:.1f} MiB/s)")
+
+
+@dataclass
+class ExternalLocation:
+    """An S3-compatible location a database server can write backups to itself."""
+
+    bucket: str
+    key: str
+    region: str
+    access_key: str
+    secret_key: str
+    endpoint: str | None = None
+    session_token: str | None = None
+
+    @property
+    def uri(self) -> str:
+        """Return the location as an s3:// URI with credentials; it must not be logged."""
+        params = {
+            "AWS_ACCESS_KEY_ID": self.access_key,
+            "AWS_SECRET_ACCESS_KEY": self.secret_key,
+            "AWS_REGION": self.region,
+        }
+        if self.session_token:
+            params["AWS_SESSION_TOKEN"] = self.session_token
+        if self.endpoint:
+            params["AWS_ENDPOINT"] = self.endpoint
+
+        return f"s3://{self.bucket}/{quote(self.key)}?{urlencode(params)}"
 
 
 class StorageAdapter(ABC):
     """Abstract base class for storage adapters."""
 
+    # Limits the adapter paces its uploads and downloads by, see limit_bandwidth
+    upload_throttle: Throttle | None = None
+    download_throttle: Throttle | None = None
+
+    def limit_bandwidth(self, upload: Throttle | None, download: Throttle | None) -> None:
+        """Pace transfers by throttles, which may be shared with other adapters to limit them collectively.
+
+        Args:
+            upload: Throttle of uploads, None for unlimited uploads
+            download: Throttle of downloads, None for unlimited downloads
+        """
+        self.upload_throttle = upload
+        self.download_throttle = download
+
     @abstractmethod
-    def upload(self, local_path: Path, remote_key: str) -> None:
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
         """Upload a file to storage.
 
         Args:
             local_path: Path to the local file
             remote_key: Key/path in the storage bucket
+            metadata: Optional key/value metadata stored with the object
 
         Raises:
             StorageError: If the upload fails
@@ -48,6 +182,21 @@ class StorageAdapter(ABC):
         """
         pass
 
+    @abstractmethod
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the metadata stored with an object.
+
+        Args:
+            remote_key: Key/path of the object
+
+        Returns:
+            Metadata dictionary (empty for objects uploaded without metadata)
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        pass
+
     @abstractmethod
     def delete(self, remote_key: str) -> None:
         """Delete an object from storage.
@@ -84,3 +233,255 @@ class StorageAdapter(ABC):
             StorageError: If download fails
         """
         pass
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether upload_stream() can upload data of unknown size without a local file."""
+        return False
+
+    def upload_stream(
+        self,
+        stream: BinaryIO,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+        expected_size: int | None = None,
+    ) -> StreamedUpload:
+        """Upload data read from a stream until its end.
+
+        The stream is read one part at a time, so memory use is bounded by
+        the parts in flight however large the object grows. If reading or
+        uploading fails, the incomplete upload is discarded and the error
+        raised as is.
+
+        Args:
+            stream: Data to upload
+            remote_key: Key/path in the storage bucket
+            metadata: Optional key/value metadata stored with the object, to which the
+                size and SHA-256 are added
+            expected_size: Estimated size of the object, e.g. the previous backup's, checked
+                against the backend's limits before anything is read
+
+        Returns:
+            Size and SHA-256 of the uploaded object
+
+        Raises:
+            StorageError: If the upload fails or this backend cannot upload streams
+        """
+        raise StorageError(f"{type(self).__name__} does not support streaming uploads")
+
+    @property
+    def supports_streaming_download(self) -> bool:
+        """Return whether open_download() can read an object without downloading it to a file first."""
+        return False
+
+    def open_download(self, remote_key: str) -> BinaryIO:
+        """Open an object for reading as it is downloaded.
+
+        Data is fetched only as fast as it is read, so nothing but the
+        buffered part is held locally. The caller closes the stream.
+
+        Args:
+            remote_key: Key/path of the object to read
+
+        Returns:
+            Binary file object yielding the object's data
+
+        Raises:
+            StorageError: If the object cannot be opened or this backend cannot stream downloads; errors
+                of a running download are raised from reading the stream
+        """
+        raise StorageError(f"{type(self).__name__} does not support streaming downloads")
+
+    @property
+    def supports_range_reads(self) -> bool:
+        """Return whether read_range() can read part of an object without downloading it."""
+        return False
+
+    def read_range(self, remote_key: str, start: int, length: int) -> bytes:
+        """Read a byte range of an object.
+
+        Args:
+            remote_key: Key/path of the object
+            start: Offset of the first byte
+            length: Number of bytes to read
+
+        Returns:
+            The bytes read, fewer than length only if the object ends first
+
+        Raises:
+            StorageError: If the range cannot be read
+        """
+        raise StorageError(f"{type(self).__name__} does not support ranged reads")
+
+    @property
+    def supports_exclusive_create(self) -> bool:
+        """Return whether create_exclusive() can create an object only if its key is free."""
+        return False
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a small file unless an object already exists under its key, in one atomic step.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Key/path to store the file under
+
+        Returns:
+            True if the file was stored, False if the key was taken
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        raise StorageError(f"{type(self).__name__} does not support exclusive creates")
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a small object along with its version, for replace_if_unchanged().
+
+        Storage that supports exclusive creates supports this too.
+
+        Args:
+            remote_key: Key/path of the object
+
+        Returns:
+            The object's content and an opaque version, e.g. its ETag; None if there is no object under the key
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        raise StorageError(f"{type(self).__name__} does not support conditional writes")
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Overwrite a small object only if it is still at the version read_versioned() returned, in one atomic step.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Key/path of the object
+            version: Version of the object the file replaces
+
+        Returns:
+            True if the file was stored, False if the object changed or was deleted since
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        raise StorageError(f"{type(self).__name__} does not support conditional writes")
+
+    @property
+    def supports_legal_hold(self) -> bool:
+        """Return whether set_legal_hold() can keep an object from being deleted."""
+        return False
+
+    def credential_source(self) -> str | None:
+        """Describe where the storage's credentials come from, for storage that finds them in more than one place.
+
+        Returns:
+            The source, or None for storage with a single way of authenticating
+
+        Raises:
+            StorageError: If no credentials can be found
+        """
+        return None
+
+    def set_legal_hold(self, remote_key: str, on: bool) -> None:
+        """Place or lift a legal hold on an object, which the storage refuses to delete while it is on.
+
+        Args:
+            remote_key: Key/path of the object
+            on: Place the hold if True, lift it if False
+
+        Raises:
+            StorageError: If the hold cannot be changed
+        """
+        raise StorageError(f"{type(self).__name__} does not support legal holds")
+
+    def interrupted_uploads(self, prefix: str) -> list[InterruptedUpload]:
+        """List uploads under a prefix that a previous run started but never finished.
+
+        Calling upload() again with the same file and key continues such an
+        upload from its last completed part. Backends whose uploads cannot
+        be resumed have none.
+
+        Args:
+            prefix: Key prefix of the uploads to consider
+
+        Raises:
+            StorageError: If the recorded uploads cannot be read
+        """
+        return []
+
+    def abort_upload(self, upload: InterruptedUpload) -> None:
+        """Discard an interrupted upload and the parts it already stored.
+
+        Raises:
+            StorageError: If aborting fails
+        """
+
+    def abort_stale_uploads(self, prefix: str, older_than: timedelta) -> list[str]:
+        """Abort incomplete multipart uploads started longer ago than a given age.
+
+        Their parts are billed like stored objects but are never listed as
+        backups, so only this cleans them up.
+
+        Args:
+            prefix: Key prefix of the uploads to consider
+            older_than: Minimum age of an upload to abort
+
+        Returns:
+            Keys of the aborted uploads
+
+        Raises:
+            StorageError: If listing or aborting fails
+        """
+        return []
+
+    def external_location(self, remote_key: str) -> ExternalLocation:
+        """Return the bucket, key and credentials for a database server to write to.
+
+        Used by engines whose server backs up directly to object storage
+        instead of handing a file to NestVault.
+
+        Args:
+            remote_key: Key/path the location should point at
+
+        Raises:
+            StorageError: If this backend cannot be written to directly
+        """
+        raise StorageError(f"{type(self).__name__} does not support direct writes from the database server")
+
+    def check_free_space(self, prefix: str) -> None:
+        """Refuse a new backup under a prefix if storage has no room for it.
+
+        The most recent object under the prefix serves as the size estimate.
+        Backends without a fixed size limit accept any backup.
+
+        Args:
+            prefix: Key prefix of the uploads to consider
+
+        Raises:
+            StorageError: If storage has less free space than the estimate
+        """
+        pass
+
+    def check_connectivity(self, key: str) -> None:
+        """Upload, download and delete a small test object.
+
+        Args:
+            key: Key/path of the test object
+
+        Raises:
+            StorageError: If any step of the round trip fails or the object comes back changed
+        """
+        content = b"nestvault connectivity check\n"
+
+        with tempfile.TemporaryDirectory(prefix="nestvault-check-") as temp_dir:
+            sent = Path(temp_dir) / "sent"
+            received = Path(temp_dir) / "received"
+            sent.write_bytes(content)
+
+            self.upload(sent, key)
+            try:
+                self.download(key, received)
+            finally:
+                self.delete(key)
+
+            if received.read_bytes() != content:
+                raise StorageError(f"Test object {key} came back with different content")
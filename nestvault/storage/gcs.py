@@ -0,0 +1,259 @@
+"""Google Cloud Storage adapter using google-cloud-storage."""
+
+from __future__ import annotations
+
+import json
+from pathlib import Path
+
+from google.api_core.exceptions import GoogleAPIError, NotFound, PreconditionFailed
+from google.auth.exceptions import GoogleAuthError
+from google.cloud import storage
+from google.oauth2 import service_account
+
+from nestvault.config import GCSConfig
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.throttle import throttled_reader, throttled_writer
+
+logger = get_logger("storage.gcs")
+
+
+class GCSStorageAdapter(StorageAdapter):
+    """Storage adapter for Google Cloud Storage.
+
+    Authenticates with a service account key when one is configured and
+    with Application Default Credentials otherwise. Uploads are resumable
+    and sent in chunks of the configured size.
+    """
+
+    def __init__(self, config: GCSConfig):
+        """Initialize the Google Cloud Storage adapter.
+
+        Args:
+            config: GCS configuration
+
+        Raises:
+            StorageError: If the credentials cannot be loaded
+        """
+        self.config = config
+
+        try:
+            credentials = None
+            if config.credentials_file:
+                credentials = service_account.Credentials.from_service_account_file(config.credentials_file)
+            elif config.credentials_json:
+                credentials = service_account.Credentials.from_service_account_info(
+                    json.loads(config.credentials_json)
+                )
+
+            project = config.project or (credentials.project_id if credentials else None)
+            self.client = storage.Client(project=project, credentials=credentials)
+            self.bucket = self.client.bucket(config.bucket)
+            logger.debug(f"Initialized GCS client for bucket '{config.bucket}'")
+        except (GoogleAuthError, OSError, ValueError) as e:
+            logger.error(f"Failed to initialize GCS client: {e}")
+            raise StorageError(f"Failed to initialize Google Cloud Storage: {e}")
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Upload a file to GCS with a resumable upload.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Object name in the GCS bucket
+            metadata: Optional custom metadata stored with the object
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        logger.info(f"Uploading {local_path.name} to gs://{self.config.bucket}/{remote_key}")
+
+        try:
+            blob = self.bucket.blob(remote_key, chunk_size=self.config.chunk_size_mb * 1024 * 1024)
+            if metadata:
+                blob.metadata = metadata
+            if self.upload_throttle is None:
+                blob.upload_from_filename(str(local_path))
+            else:
+                # Resumable uploads read the file a chunk at a time, each paced by the limit
+                with open(local_path, "rb") as f:
+                    blob.upload_from_file(throttled_reader(f, self.upload_throttle), size=local_path.stat().st_size)
+            logger.info(f"Upload completed: {remote_key}")
+        except (GoogleAPIError, OSError) as e:
+            logger.error(f"GCS upload failed: {e}")
+            raise StorageError(f"Failed to upload to GCS: {e}")
+
+    @property
+    def supports_exclusive_create(self) -> bool:
+        return True
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a small file on the condition that no generation of the object exists yet.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.bucket.blob(remote_key).upload_from_filename(str(local_path), if_generation_match=0)
+            return True
+        except PreconditionFailed:
+            return False
+        except (GoogleAPIError, OSError) as e:
+            logger.error(f"GCS conditional upload failed: {e}")
+            raise StorageError(f"Failed to upload to GCS: {e}")
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a small object along with its generation.
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        try:
+            while True:
+                blob = self.bucket.get_blob(remote_key)
+                if blob is None:
+                    return None
+                try:
+                    return blob.download_as_bytes(if_generation_match=blob.generation), str(blob.generation)
+                except (NotFound, PreconditionFailed):
+                    # Replaced or deleted between looking the object up and downloading it
+                    continue
+        except GoogleAPIError as e:
+            logger.error(f"GCS read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from GCS: {e}")
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Overwrite a small object on the condition that it is still at a generation.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.bucket.blob(remote_key).upload_from_filename(str(local_path), if_generation_match=int(version))
+            return True
+        except PreconditionFailed:
+            return False
+        except (GoogleAPIError, OSError) as e:
+            logger.error(f"GCS conditional upload failed: {e}")
+            raise StorageError(f"Failed to upload to GCS: {e}")
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List objects in the GCS bucket.
+
+        Args:
+            prefix: Filter objects by name prefix
+
+        Returns:
+            List of StorageObject instances
+
+        Raises:
+            StorageError: If listing fails
+        """
+        logger.debug(f"Listing objects with prefix '{prefix}'")
+
+        try:
+            objects = [
+                StorageObject(key=blob.name, size=blob.size, last_modified=blob.updated)
+                for blob in self.client.list_blobs(self.bucket, prefix=prefix)
+            ]
+
+            logger.debug(f"Found {len(objects)} objects")
+            return objects
+
+        except GoogleAPIError as e:
+            logger.error(f"GCS list failed: {e}")
+            raise StorageError(f"Failed to list GCS objects: {e}")
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the custom metadata stored with a GCS object.
+
+        Args:
+            remote_key: Object name
+
+        Returns:
+            Metadata dictionary
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        try:
+            blob = self.bucket.get_blob(remote_key)
+        except GoogleAPIError as e:
+            logger.error(f"GCS object lookup failed: {e}")
+            raise StorageError(f"Failed to read GCS object metadata: {e}")
+
+        if blob is None:
+            raise StorageError(f"GCS object not found: {remote_key}")
+
+        return dict(blob.metadata or {})
+
+    def delete(self, remote_key: str) -> None:
+        """Delete an object from GCS.
+
+        Args:
+            remote_key: Object name to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        logger.info(f"Deleting gs://{self.config.bucket}/{remote_key}")
+
+        try:
+            self.bucket.delete_blob(remote_key)
+            logger.debug(f"Deleted: {remote_key}")
+        except NotFound:
+            logger.debug(f"Already deleted: {remote_key}")
+        except GoogleAPIError as e:
+            logger.error(f"GCS delete failed: {e}")
+            raise StorageError(f"Failed to delete GCS object: {e}")
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple objects from GCS.
+
+        Objects that no longer exist are skipped.
+
+        Args:
+            remote_keys: List of object names to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        if not remote_keys:
+            return
+
+        logger.info(f"Deleting {len(remote_keys)} objects from GCS")
+
+        try:
+            self.bucket.delete_blobs(remote_keys, on_error=lambda blob: None)
+            logger.info(f"Deleted {len(remote_keys)} objects")
+        except GoogleAPIError as e:
+            logger.error(f"GCS bulk delete failed: {e}")
+            raise StorageError(f"Failed to delete GCS objects: {e}")
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Download a file from GCS.
+
+        Args:
+            remote_key: Object name in the GCS bucket
+            local_path: Local path to save the downloaded file
+
+        Raises:
+            StorageError: If the download fails
+        """
+        logger.info(f"Downloading gs://{self.config.bucket}/{remote_key} to {local_path}")
+
+        try:
+            if self.download_throttle is None:
+                self.bucket.blob(remote_key).download_to_filename(str(local_path))
+            else:
+                with open(local_path, "wb") as f:
+                    self.bucket.blob(remote_key).download_to_file(throttled_writer(f, self.download_throttle))
+            logger.info(f"Download completed: {local_path}")
+        except (GoogleAPIError, OSError) as e:
+            logger.error(f"GCS download failed: {e}")
+            raise StorageError(f"Failed to download from GCS: {e}")
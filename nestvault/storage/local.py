@@ -0,0 +1,389 @@
+"""Local filesystem storage adapter, e.g. for a mounted NAS."""
+
+from __future__ import annotations
+
+import fcntl
+import json
+import os
+import shutil
+import uuid
+from datetime import datetime, timezone
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.config import LocalConfig
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import METADATA_SUFFIX, PARTIAL_SUFFIX, StorageAdapter, StorageObject
+from nestvault.throttle import throttled_reader
+
+logger = get_logger("storage.local")
+
+
+class LocalStorageAdapter(StorageAdapter):
+    """Storage adapter for a directory on the local filesystem.
+
+    Keys map to paths below the root directory. Backups are copied to a
+    hidden temporary file and renamed into place, so an interrupted copy
+    never looks like a backup. Metadata is kept in a sidecar file next to
+    each backup.
+    """
+
+    def __init__(self, config: LocalConfig):
+        """Initialize the local filesystem storage adapter.
+
+        Args:
+            config: Local storage configuration
+        """
+        self.config = config
+        self.root = Path(config.root)
+        logger.debug(f"Initialized local storage at {self.root}")
+
+    def _path(self, remote_key: str) -> Path:
+        """Return the path of a key, refusing keys that escape the root."""
+        path = (self.root / remote_key).resolve()
+        if not path.is_relative_to(self.root.resolve()):
+            raise StorageError(f"Key {remote_key} is outside the storage root")
+        return path
+
+    def _fsync_dir(self, directory: Path) -> None:
+        """Flush a directory entry, so a rename survives a crash."""
+        fd = os.open(directory, os.O_RDONLY)
+        try:
+            os.fsync(fd)
+        finally:
+            os.close(fd)
+
+    def _write_atomic(self, source: Path, path: Path) -> None:
+        """Copy a file under a temporary name and rename it into place."""
+        partial = path.with_name(f".{path.name}{PARTIAL_SUFFIX}")
+
+        try:
+            with open(source, "rb") as src, open(partial, "wb") as dst:
+                shutil.copyfileobj(throttled_reader(src, self.upload_throttle), dst, 1024 * 1024)
+                if self.config.fsync:
+                    dst.flush()
+                    os.fsync(dst.fileno())
+            os.replace(partial, path)
+        except OSError:
+            partial.unlink(missing_ok=True)
+            raise
+
+        if self.config.fsync:
+            self._fsync_dir(path.parent)
+
+    def _free_space(self) -> int:
+        """Return the free space on the filesystem holding the root."""
+        try:
+            return shutil.disk_usage(self.root).free
+        except OSError as e:
+            raise StorageError(f"Failed to read free space of {self.root}: {e}")
+
+    def check_free_space(self, prefix: str) -> None:
+        """Refuse a new backup if there is less free space than the last backup took.
+
+        Args:
+            prefix: Key prefix of the database about to be backed up
+
+        Raises:
+            StorageError: If the filesystem has too little free space
+        """
+        previous = self.list(prefix=prefix)
+        if not previous:
+            return
+
+        estimate = max(previous, key=lambda obj: obj.last_modified).size
+        free = self._free_space()
+        if estimate > free:
+            raise StorageError(
+                f"Not enough space in {self.root}: the last backup under '{prefix}' was {estimate} bytes, "
+                f"{free} bytes free"
+            )
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Copy a file into the storage directory.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Key/path below the root
+            metadata: Optional metadata stored in a sidecar file
+
+        Raises:
+            StorageError: If there is not enough free space or the copy fails
+        """
+        path = self._path(remote_key)
+        logger.info(f"Copying {local_path.name} to {path}")
+
+        size = local_path.stat().st_size
+        free = self._free_space()
+        if size > free:
+            raise StorageError(f"Not enough space in {self.root}: backup needs {size} bytes, {free} bytes free")
+
+        try:
+            path.parent.mkdir(parents=True, exist_ok=True)
+
+            if metadata:
+                metadata_file = local_path.with_name(local_path.name + METADATA_SUFFIX)
+                metadata_file.write_text(json.dumps(metadata))
+                try:
+                    self._write_atomic(metadata_file, path.with_name(path.name + METADATA_SUFFIX))
+                finally:
+                    metadata_file.unlink(missing_ok=True)
+
+            self._write_atomic(local_path, path)
+            logger.info(f"Upload completed: {remote_key}")
+        except OSError as e:
+            logger.error(f"Local copy failed: {e}")
+            raise StorageError(f"Failed to write to {self.root}: {e}")
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List backups below the root.
+
+        Metadata sidecars and copies still in progress are left out.
+
+        Args:
+            prefix: Filter files by key prefix
+
+        Returns:
+            List of StorageObject instances, with the modification time as last_modified
+
+        Raises:
+            StorageError: If listing fails
+        """
+        logger.debug(f"Listing objects with prefix '{prefix}'")
+
+        # Only walk the directory the prefix points into
+        directory = self.root / os.path.dirname(prefix)
+        objects = []
+
+        try:
+            for dirpath, _, filenames in os.walk(directory):
+                for filename in filenames:
+                    path = Path(dirpath) / filename
+                    key = path.relative_to(self.root).as_posix()
+                    if not key.startswith(prefix) or filename.startswith(".") or filename.endswith(METADATA_SUFFIX):
+                        continue
+
+                    info = path.stat()
+                    objects.append(
+                        StorageObject(
+                            key=key,
+                            size=info.st_size,
+                            last_modified=datetime.fromtimestamp(info.st_mtime, tz=timezone.utc),
+                        )
+                    )
+        except OSError as e:
+            logger.error(f"Local list failed: {e}")
+            raise StorageError(f"Failed to list {self.root}: {e}")
+
+        logger.debug(f"Found {len(objects)} objects")
+        return objects
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Read the metadata sidecar of a backup.
+
+        Args:
+            remote_key: Key/path of the backup
+
+        Returns:
+            Metadata dictionary, empty when the backup has no sidecar
+
+        Raises:
+            StorageError: If the sidecar cannot be read
+        """
+        path = self._path(remote_key)
+
+        try:
+            return json.loads(path.with_name(path.name + METADATA_SUFFIX).read_text())
+        except FileNotFoundError:
+            return {}
+        except (OSError, ValueError) as e:
+            logger.error(f"Local metadata read failed: {e}")
+            raise StorageError(f"Failed to read metadata of {remote_key}: {e}")
+
+    def delete(self, remote_key: str) -> None:
+        """Delete a backup and its sidecar, and remove directories left empty.
+
+        Args:
+            remote_key: Key/path of the backup to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        path = self._path(remote_key)
+        logger.info(f"Deleting {path}")
+
+        try:
+            path.unlink(missing_ok=True)
+            path.with_name(path.name + METADATA_SUFFIX).unlink(missing_ok=True)
+
+            # Date directories from key templates are only cleaned up once empty
+            parent = path.parent
+            while parent != self.root.resolve() and not any(parent.iterdir()):
+                parent.rmdir()
+                parent = parent.parent
+
+            logger.debug(f"Deleted: {remote_key}")
+        except OSError as e:
+            logger.error(f"Local delete failed: {e}")
+            raise StorageError(f"Failed to delete {remote_key}: {e}")
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple backups.
+
+        Args:
+            remote_keys: List of keys to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        if not remote_keys:
+            return
+
+        logger.info(f"Deleting {len(remote_keys)} objects from {self.root}")
+
+        for key in remote_keys:
+            self.delete(key)
+
+        logger.info(f"Deleted {len(remote_keys)} objects")
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Copy a backup out of the storage directory.
+
+        Args:
+            remote_key: Key/path of the backup
+            local_path: Local path to save the copy to
+
+        Raises:
+            StorageError: If the copy fails
+        """
+        path = self._path(remote_key)
+        logger.info(f"Copying {path} to {local_path}")
+
+        try:
+            with open(path, "rb") as src, open(local_path, "wb") as dst:
+                shutil.copyfileobj(throttled_reader(src, self.download_throttle), dst, 1024 * 1024)
+            logger.info(f"Download completed: {local_path}")
+        except OSError as e:
+            logger.error(f"Local copy failed: {e}")
+            raise StorageError(f"Failed to copy {remote_key}: {e}")
+
+    @property
+    def supports_streaming_download(self) -> bool:
+        return True
+
+    def open_download(self, remote_key: str) -> BinaryIO:
+        """Open a backup in the storage directory for reading.
+
+        Raises:
+            StorageError: If the backup cannot be opened
+        """
+        try:
+            return throttled_reader(open(self._path(remote_key), "rb"), self.download_throttle)
+        except OSError as e:
+            logger.error(f"Local read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key}: {e}")
+
+    @property
+    def supports_range_reads(self) -> bool:
+        return True
+
+    @property
+    def supports_exclusive_create(self) -> bool:
+        return True
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Copy a file into the storage directory unless the key is taken, linking it into place.
+
+        Raises:
+            StorageError: If the copy fails
+        """
+        path = self._path(remote_key)
+        partial = path.with_name(f".{path.name}.{uuid.uuid4().hex[:8]}{PARTIAL_SUFFIX}")
+
+        try:
+            path.parent.mkdir(parents=True, exist_ok=True)
+            shutil.copyfile(local_path, partial)
+            try:
+                os.link(partial, path)
+            except FileExistsError:
+                return False
+            finally:
+                partial.unlink(missing_ok=True)
+        except OSError as e:
+            logger.error(f"Local copy failed: {e}")
+            raise StorageError(f"Failed to write to {self.root}: {e}")
+
+        if self.config.fsync:
+            self._fsync_dir(path.parent)
+        return True
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a small file along with its inode and modification time, which every replace changes.
+
+        Raises:
+            StorageError: If the file cannot be read
+        """
+        try:
+            with open(self._path(remote_key), "rb") as f:
+                info = os.fstat(f.fileno())
+                return f.read(), f"{info.st_ino}-{info.st_mtime_ns}"
+        except FileNotFoundError:
+            return None
+        except OSError as e:
+            logger.error(f"Local read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key}: {e}")
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Rename a copy of a file over one in the storage directory if that is still at a version.
+
+        The check and the rename happen under an exclusive flock of a
+        hidden file next to it, which holds across replicas sharing the
+        directory as long as the file system supports locks, as NFSv4 does.
+
+        Raises:
+            StorageError: If the copy fails
+        """
+        path = self._path(remote_key)
+        partial = path.with_name(f".{path.name}.{uuid.uuid4().hex[:8]}{PARTIAL_SUFFIX}")
+
+        try:
+            shutil.copyfile(local_path, partial)
+            try:
+                with open(path.with_name(f".{path.name}.lock"), "a") as guard:
+                    fcntl.flock(guard, fcntl.LOCK_EX)
+                    try:
+                        info = path.stat()
+                    except FileNotFoundError:
+                        return False
+                    if f"{info.st_ino}-{info.st_mtime_ns}" != version:
+                        return False
+                    os.replace(partial, path)
+            finally:
+                partial.unlink(missing_ok=True)
+        except OSError as e:
+            logger.error(f"Local copy failed: {e}")
+            raise StorageError(f"Failed to write to {self.root}: {e}")
+
+        if self.config.fsync:
+            self._fsync_dir(path.parent)
+        return True
+
+    def read_range(self, remote_key: str, start: int, length: int) -> bytes:
+        """Read a byte range of a backup.
+
+        Raises:
+            StorageError: If the backup cannot be read
+        """
+        try:
+            with open(self._path(remote_key), "rb") as f:
+                f.seek(start)
+                return f.read(length)
+        except OSError as e:
+            logger.error(f"Local read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key}: {e}")
@@ -0,0 +1,163 @@
+"""Storage adapter that keeps all keys under a fixed prefix."""
+
+from __future__ import annotations
+
+from dataclasses import replace
+from datetime import timedelta
+from pathlib import Path
+from typing import BinaryIO
+
+from nestvault.storage.base import (
+    ExternalLocation,
+    InterruptedUpload,
+    StorageAdapter,
+    StorageObject,
+    StreamedUpload,
+)
+from nestvault.throttle import Throttle
+
+
+class PrefixedStorageAdapter(StorageAdapter):
+    """Wraps another storage adapter and places every key under a prefix.
+
+    Keys passed in and returned are relative to the prefix, so callers see
+    the same `<database>_<timestamp>.<ext>` names as without a prefix.
+    """
+
+    def __init__(self, storage: StorageAdapter, prefix: str):
+        """Initialize the prefixed storage adapter.
+
+        Args:
+            storage: Storage adapter to delegate to
+            prefix: Key prefix ending in a single '/', e.g. 'billing/', as the configuration normalizes it
+        """
+        self.storage = storage
+        self.prefix = prefix
+
+    def limit_bandwidth(self, upload: Throttle | None, download: Throttle | None) -> None:
+        """Limit the transfers of the wrapped storage."""
+        self.storage.limit_bandwidth(upload, download)
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Upload a file under the prefix."""
+        self.storage.upload(local_path, self.prefix + remote_key, metadata=metadata)
+
+    @property
+    def supports_streaming(self) -> bool:
+        """Return whether the wrapped storage can upload streams."""
+        return self.storage.supports_streaming
+
+    def upload_stream(
+        self,
+        stream: BinaryIO,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+        expected_size: int | None = None,
+    ) -> StreamedUpload:
+        """Upload a stream under the prefix."""
+        return self.storage.upload_stream(
+            stream, self.prefix + remote_key, metadata=metadata, expected_size=expected_size
+        )
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List objects under the prefix, with the prefix stripped from keys."""
+        return [
+            StorageObject(
+                key=obj.key[len(self.prefix):],
+                size=obj.size,
+                last_modified=obj.last_modified,
+                archived=obj.archived,
+            )
+            for obj in self.storage.list(prefix=self.prefix + prefix)
+        ]
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the metadata of an object under the prefix."""
+        return self.storage.get_metadata(self.prefix + remote_key)
+
+    def delete(self, remote_key: str) -> None:
+        """Delete an object under the prefix."""
+        self.storage.delete(self.prefix + remote_key)
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple objects under the prefix."""
+        self.storage.delete_many([self.prefix + key for key in remote_keys])
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Download an object under the prefix."""
+        self.storage.download(self.prefix + remote_key, local_path)
+
+    @property
+    def supports_streaming_download(self) -> bool:
+        return self.storage.supports_streaming_download
+
+    def open_download(self, remote_key: str) -> BinaryIO:
+        """Open an object under the prefix for reading as it is downloaded."""
+        return self.storage.open_download(self.prefix + remote_key)
+
+    @property
+    def supports_range_reads(self) -> bool:
+        return self.storage.supports_range_reads
+
+    def read_range(self, remote_key: str, start: int, length: int) -> bytes:
+        """Read a byte range of a key under the prefix."""
+        return self.storage.read_range(self.prefix + remote_key, start, length)
+
+    @property
+    def supports_exclusive_create(self) -> bool:
+        return self.storage.supports_exclusive_create
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a file to a key under the prefix unless it is taken."""
+        return self.storage.create_exclusive(local_path, self.prefix + remote_key)
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a key under the prefix along with its version."""
+        return self.storage.read_versioned(self.prefix + remote_key)
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Overwrite a key under the prefix if it is still at a version."""
+        return self.storage.replace_if_unchanged(local_path, self.prefix + remote_key, version)
+
+    @property
+    def supports_legal_hold(self) -> bool:
+        return self.storage.supports_legal_hold
+
+    def set_legal_hold(self, remote_key: str, on: bool) -> None:
+        """Place or lift a legal hold on a key under the prefix."""
+        self.storage.set_legal_hold(self.prefix + remote_key, on)
+
+    def credential_source(self) -> str | None:
+        return self.storage.credential_source()
+
+    def interrupted_uploads(self, prefix: str) -> list[InterruptedUpload]:
+        """List interrupted uploads under the prefix, with the prefix stripped from keys."""
+        return [
+            replace(upload, key=upload.key[len(self.prefix):])
+            for upload in self.storage.interrupted_uploads(self.prefix + prefix)
+        ]
+
+    def abort_upload(self, upload: InterruptedUpload) -> None:
+        """Abort an interrupted upload under the prefix."""
+        self.storage.abort_upload(replace(upload, key=self.prefix + upload.key))
+
+    def abort_stale_uploads(self, prefix: str, older_than: timedelta) -> list[str]:
+        """Abort stale uploads under the prefix, with the prefix stripped from the keys."""
+        return [key[len(self.prefix):] for key in self.storage.abort_stale_uploads(self.prefix + prefix, older_than)]
+
+    def external_location(self, remote_key: str) -> ExternalLocation:
+        """Return the direct-write location of a key under the prefix."""
+        return self.storage.external_location(self.prefix + remote_key)
+
+    def check_free_space(self, prefix: str) -> None:
+        """Check the free space of the wrapped storage for a prefix under ours."""
+        self.storage.check_free_space(self.prefix + prefix)
+
+    def check_connectivity(self, key: str) -> None:
+        """Run the connectivity check of the wrapped storage under the prefix."""
+        self.storage.check_connectivity(self.prefix + key)
@@ -28,3 +28,8 @@ class R2StorageAdapter(S3StorageAdapter):
 
         logger.debug(f"Initializing R2 adapter with endpoint: {config.endpoint}")
         super().__init__(config)
+
+    @property
+    def supports_legal_hold(self) -> bool:
+        # R2 locks buckets by rule, not objects one at a time
+        return False
@@ -2,21 +2,137 @@
 
 from __future__ import annotations
 
+import hashlib
+import posixpath
+import threading
+from collections.abc import Callable, Iterator
+from concurrent.futures import Future, ThreadPoolExecutor
+from dataclasses import dataclass
+from datetime import datetime, timedelta, timezone
 from pathlib import Path
+from typing import BinaryIO
 
 import boto3
+from boto3.s3.transfer import TransferConfig
+from botocore.config import Config
 from botocore.exceptions import BotoCoreError, ClientError
 
 from nestvault.config import S3Config
 from nestvault.exceptions import StorageError
 from nestvault.logging import get_logger
-from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.storage.base import (
+    MIB,
+    ExternalLocation,
+    InterruptedUpload,
+    StorageAdapter,
+    StorageObject,
+    StreamedUpload,
+    TransferProgress,
+)
+from nestvault.storage.upload_state import UploadState, UploadStateStore
+from nestvault.throttle import pace, throttled_reader
+from nestvault.tracing import Span, start_span
 
 logger = get_logger("storage.s3")
 
+# Content types of compressed backups, by key suffix
+CONTENT_TYPES = {".gz": "application/gzip", ".zst": "application/zstd", ".lz4": "application/x-lz4"}
+
+# Typical time until an archived object can be downloaded, per storage class and restore tier
+THAW_TIMES = {
+    "GLACIER": {"Expedited": "1-5 minutes", "Standard": "3-5 hours", "Bulk": "5-12 hours"},
+    "DEEP_ARCHIVE": {"Standard": "up to 12 hours", "Bulk": "up to 48 hours"},
+}
+
+# Most parts a multipart upload may have, on S3 and R2 alike
+MAX_PARTS = 10000
+
+# Sources of the default AWS credential chain, by the method botocore reports for them
+CREDENTIAL_SOURCES = {
+    "env": "AWS_* environment variables",
+    "shared-credentials-file": "shared credentials file",
+    "config-file": "shared config file",
+    "custom-process": "credential process of the shared config",
+    "sso": "IAM Identity Center (SSO) of the shared config",
+    "assume-role": "role assumed by the shared config",
+    "assume-role-with-web-identity": "web identity token file (AWS_WEB_IDENTITY_TOKEN_FILE)",
+    "container-role": "container role",
+    "iam-role": "instance role (IMDS)",
+}
+
+
+def _end_when_uploaded(traced: Span, futures: list[Future]) -> None:
+    """End the span of a batch of parts once each of them was uploaded, failed or cancelled."""
+    remaining = len(futures)
+    lock = threading.Lock()
+
+    def finished(future: Future) -> None:
+        nonlocal remaining
+        if not future.cancelled() and future.exception() is not None:
+            traced.fail(future.exception())
+        with lock:
+            remaining -= 1
+            last = remaining == 0
+        if last:
+            traced.end()
+
+    for future in futures:
+        future.add_done_callback(finished)
+
+
+@dataclass
+class TLSOptions:
+    """TLS settings in the form boto3 takes them."""
+
+    # Client `verify` argument: a CA bundle path, False to skip verification, or None for the defaults
+    verify: str | bool | None = None
+    # botocore Config `client_cert`: a combined PEM file or a (certificate, key) pair
+    client_cert: str | tuple[str, str] | None = None
+
+
+def build_tls_options(config: S3Config) -> TLSOptions:
+    """Translate the configured TLS settings into boto3 client options.
+
+    Args:
+        config: S3 configuration
+
+    Returns:
+        TLS options for the boto3 client and its botocore Config
+    """
+    options = TLSOptions()
+
+    if config.insecure_skip_verify:
+        logger.warning(
+            "TLS certificate verification is DISABLED for the S3 endpoint (S3_INSECURE_SKIP_VERIFY). "
+            "Backups and credentials can be intercepted; use S3_CA_CERT_FILE instead"
+        )
+        options.verify = False
+    elif config.ca_cert_file:
+        options.verify = config.ca_cert_file
+
+    if config.client_cert_file and config.client_key_file:
+        options.client_cert = (config.client_cert_file, config.client_key_file)
+    elif config.client_cert_file:
+        options.client_cert = config.client_cert_file
+
+    return options
+
 
 class S3StorageAdapter(StorageAdapter):
-    """Storage adapter for Amazon S3 and S3-compatible services."""
+    """Storage adapter for Amazon S3 and S3-compatible services.
+
+    Without an endpoint the client talks to the regional AWS endpoint.
+    Uploads go through boto3's managed transfer, which switches to
+    multipart uploads for large files on S3 and R2 alike. Streamed
+    uploads are multipart uploads fed from a bounded pool of workers.
+    Both use the configured part size and upload concurrency.
+
+    Without an access key in the configuration, the client takes its
+    credentials from the default AWS credential chain. Temporary ones,
+    such as those of a role or a web identity token, are refreshed before
+    they expire, also between the parts of a long multipart upload, as
+    every request is signed with the credentials current at the time.
+    """
 
     def __init__(self, config: S3Config):
         """Initialize the S3 storage adapter.
@@ -27,24 +143,112 @@ class S3StorageAdapter(StorageAdapter):
         self.config = config
         self.bucket = config.bucket
 
-        client_kwargs = {
-            "aws_access_key_id": config.access_key,
-            "aws_secret_access_key": config.secret_key,
-            "region_name": config.region,
-        }
+        client_kwargs = {"region_name": config.region}
+
+        # A session of its own resolves the credential chain once, so the source it found can be reported
+        self.session = None
+        if config.access_key:
+            client_kwargs["aws_access_key_id"] = config.access_key
+            client_kwargs["aws_secret_access_key"] = config.secret_key
+            if config.session_token:
+                client_kwargs["aws_session_token"] = config.session_token
+        else:
+            self.session = boto3.Session()
 
         if config.endpoint:
             client_kwargs["endpoint_url"] = config.endpoint
 
-        self.client = boto3.client("s3", **client_kwargs)
+        tls = build_tls_options(config)
+        if tls.verify is not None:
+            client_kwargs["verify"] = tls.verify
+
+        config_kwargs = {}
+        if tls.client_cert is not None:
+            config_kwargs["client_cert"] = tls.client_cert
+        if not config.checksum_trailers:
+            # Only send checksums for operations that require them, as before botocore 1.36
+            config_kwargs["request_checksum_calculation"] = "when_required"
+            config_kwargs["response_checksum_validation"] = "when_required"
+
+        # Keep a connection per upload worker instead of botocore's default pool of 10
+        config_kwargs["max_pool_connections"] = max(10, config.upload_concurrency)
+
+        create_client = self.session.client if self.session is not None else boto3.client
+        self.client = create_client(
+            "s3",
+            config=Config(s3={"addressing_style": config.addressing_style}, **config_kwargs),
+            **client_kwargs,
+        )
+        self.part_size = config.part_size_mb * MIB
+        self.upload_state = UploadStateStore(Path(config.upload_state_dir))
         logger.debug(f"Initialized S3 client for bucket '{self.bucket}'")
 
-    def upload(self, local_path: Path, remote_key: str) -> None:
+    def _chain_credentials(self):
+        """Return the credentials the default chain resolved, refreshed when about to expire.
+
+        Raises:
+            StorageError: If no source of the chain has credentials
+        """
+        try:
+            credentials = self.session.get_credentials()
+        except BotoCoreError as e:
+            raise StorageError(f"Failed to load S3 credentials: {e}")
+        if credentials is None:
+            raise StorageError(
+                "No S3 credentials found: set S3_ACCESS_KEY and S3_SECRET_KEY, the AWS_* variables, "
+                "or run with a role (AWS_WEB_IDENTITY_TOKEN_FILE, container or instance role)"
+            )
+        return credentials
+
+    def credential_source(self) -> str:
+        """Describe where the S3 credentials come from.
+
+        Raises:
+            StorageError: If no source of the default chain has credentials
+        """
+        if self.session is None:
+            return "S3_ACCESS_KEY and S3_SECRET_KEY"
+        method = self._chain_credentials().method
+        return CREDENTIAL_SOURCES.get(method, method)
+
+    def _bucket_args(self) -> dict[str, str]:
+        """Return the bucket arguments shared by every request."""
+        args = {"Bucket": self.bucket}
+        if self.config.expected_bucket_owner:
+            args["ExpectedBucketOwner"] = self.config.expected_bucket_owner
+        return args
+
+    def _extra_args(self, metadata: dict[str, str] | None = None, remote_key: str = "") -> dict[str, str] | None:
+        """Return the ExtraArgs for managed transfers, or None when there are none."""
+        extra_args = {}
+        if metadata:
+            extra_args["Metadata"] = metadata
+        content_type = CONTENT_TYPES.get(posixpath.splitext(remote_key)[1])
+        if content_type:
+            extra_args["ContentType"] = content_type
+        if self.config.storage_class:
+            extra_args["StorageClass"] = self.config.storage_class
+        if self.config.expected_bucket_owner:
+            extra_args["ExpectedBucketOwner"] = self.config.expected_bucket_owner
+        return extra_args or None
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
         """Upload a file to S3.
 
+        Files larger than one part are sent as a multipart upload whose
+        progress is recorded in S3_UPLOAD_STATE_DIR. When the upload fails
+        or the process dies, uploading the same unchanged file to the same
+        key again continues after the last completed part.
+
         Args:
             local_path: Path to the local file
             remote_key: Key/path in the S3 bucket
+            metadata: Optional user metadata stored with the object
 
         Raises:
             StorageError: If the upload fails
@@ -52,12 +256,392 @@ class S3StorageAdapter(StorageAdapter):
         logger.info(f"Uploading {local_path.name} to s3://{self.bucket}/{remote_key}")
 
         try:
-            self.client.upload_file(str(local_path), self.bucket, remote_key)
+            size = local_path.stat().st_size
+            if size > self.part_size:
+                with self.upload_state.sending(self.bucket, remote_key):
+                    self._upload_parts_of_file(local_path, remote_key, metadata, size)
+            else:
+                self.client.upload_file(
+                    str(local_path),
+                    self.bucket,
+                    remote_key,
+                    ExtraArgs=self._extra_args(metadata, remote_key),
+                    Config=TransferConfig(
+                        multipart_threshold=self.part_size,
+                        multipart_chunksize=self.part_size,
+                        max_concurrency=self.config.upload_concurrency,
+                    ),
+                    Callback=TransferProgress(remote_key, size, self.upload_throttle),
+                )
             logger.info(f"Upload completed: {remote_key}")
-        except (BotoCoreError, ClientError) as e:
+        except (BotoCoreError, ClientError, OSError) as e:
             logger.error(f"S3 upload failed: {e}")
             raise StorageError(f"Failed to upload to S3: {e}")
 
+    def _upload_parts_of_file(self, local_path: Path, remote_key: str, metadata: dict[str, str] | None, size: int) -> None:
+        """Upload a file as a resumable multipart upload, continuing a recorded one of the same file."""
+        part_size = max(self.part_size, -(-size // MAX_PARTS))
+        if part_size > self.part_size:
+            logger.info(
+                f"{local_path.name} needs more than {MAX_PARTS} parts of S3_PART_SIZE_MB={self.config.part_size_mb}, "
+                f"uploading it in parts of {part_size / MIB:.0f} MiB"
+            )
+        count = -(-size // part_size)
+
+        state = self.upload_state.load(self.bucket, remote_key)
+        if state is not None and not state.matches(local_path, part_size):
+            logger.info(f"Discarding the recorded upload of {remote_key}, the file to upload is a different one")
+            self._abort_recorded(state)
+            state = None
+
+        if state is not None:
+            parts = self._uploaded_parts(remote_key, state.upload_id)
+            if parts is None:
+                logger.info(f"Recorded upload of {remote_key} no longer exists on S3, starting over")
+                self.upload_state.delete(self.bucket, remote_key)
+                state = None
+            else:
+                state.parts = parts
+                logger.info(f"Resuming upload of {remote_key}: {len(parts)} of {count} parts already uploaded")
+
+        if state is None:
+            stat = local_path.stat()
+            state = UploadState(
+                bucket=self.bucket,
+                key=remote_key,
+                upload_id=self._create_multipart_upload(remote_key, metadata),
+                started=datetime.now(timezone.utc).isoformat(),
+                metadata=dict(metadata or {}),
+                local_path=str(local_path),
+                size=stat.st_size,
+                mtime=stat.st_mtime,
+                part_size=part_size,
+            )
+            self.upload_state.save(state)
+
+        progress = TransferProgress(remote_key, size)
+        done = dict(state.parts)
+        progress(sum(min(part_size, size - (number - 1) * part_size) for number in done))
+
+        def parts():
+            with open(local_path, "rb") as f:
+                for number in range(1, count + 1):
+                    if number not in done:
+                        f.seek((number - 1) * part_size)
+                        yield number, f.read(part_size)
+
+        try:
+            etags = self._send_parts(
+                remote_key,
+                state.upload_id,
+                parts(),
+                progress,
+                on_uploaded=lambda number, etag: self.upload_state.record_part(state, number, etag),
+            )
+        except (BotoCoreError, ClientError, OSError):
+            logger.warning(
+                f"Upload of {remote_key} stopped with {len(state.parts)} of {count} parts uploaded; "
+                "uploading the file again resumes it"
+            )
+            raise
+
+        self._complete(remote_key, state.upload_id, {**done, **etags})
+        self.upload_state.delete(self.bucket, remote_key)
+
+    @property
+    def supports_streaming(self) -> bool:
+        return True
+
+    def _create_multipart_upload(self, remote_key: str, metadata: dict[str, str] | None) -> str:
+        """Start a multipart upload, returning its ID."""
+        response = self.client.create_multipart_upload(
+            Bucket=self.bucket, Key=remote_key, **(self._extra_args(metadata, remote_key) or {})
+        )
+        return response["UploadId"]
+
+    def _uploaded_parts(self, remote_key: str, upload_id: str) -> dict[int, str] | None:
+        """Return the ETags of a multipart upload's parts by number, or None if the upload is gone."""
+        parts = {}
+        try:
+            paginator = self.client.get_paginator("list_parts")
+            for page in paginator.paginate(**self._bucket_args(), Key=remote_key, UploadId=upload_id):
+                for part in page.get("Parts", []):
+                    parts[part["PartNumber"]] = part["ETag"]
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") == "NoSuchUpload":
+                return None
+            raise
+        return parts
+
+    def _send_parts(
+        self,
+        remote_key: str,
+        upload_id: str,
+        parts: Iterator[tuple[int, bytes]],
+        progress: TransferProgress,
+        on_uploaded: Callable[[int, str], None] | None = None,
+    ) -> dict[int, str]:
+        """Upload parts with a bounded pool of workers, returning their ETags by number.
+
+        A slot is taken before the next part is read and freed once that part
+        is uploaded, so at most S3_UPLOAD_CONCURRENCY parts are in memory.
+        Reading stops at the first failed part, whose error is raised once
+        the running parts have finished. Every S3_UPLOAD_CONCURRENCY parts
+        sent in a row are traced as one batch.
+        """
+        futures: dict[int, Future] = {}
+        batch: list[Future] = []
+        batch_bytes = 0
+        traced = Span()
+        slots = threading.Semaphore(self.config.upload_concurrency)
+        pool = ThreadPoolExecutor(max_workers=self.config.upload_concurrency, thread_name_prefix="s3-upload")
+
+        def send(number: int, part: bytes) -> str:
+            try:
+                # Every worker draws from the same throttle, so their combined rate stays within the limit
+                pace(self.upload_throttle, len(part))
+                response = self.client.upload_part(
+                    **self._bucket_args(), Key=remote_key, UploadId=upload_id, PartNumber=number, Body=part
+                )
+                if on_uploaded is not None:
+                    on_uploaded(number, response["ETag"])
+                progress(len(part))
+                return response["ETag"]
+            finally:
+                slots.release()
+
+        try:
+            while True:
+                slots.acquire()
+                failed = next((future for future in futures.values() if future.done() and future.exception()), None)
+                if failed is not None:
+                    failed.result()
+
+                item = next(parts, None)
+                if item is None:
+                    slots.release()
+                    break
+                number, part = item
+                if not batch:
+                    traced = start_span("upload parts", backup_key=remote_key, first_part=number)
+                    batch_bytes = 0
+                batch_bytes += len(part)
+                traced.set(parts=len(batch) + 1, last_part=number, bytes_out=batch_bytes)
+                futures[number] = pool.submit(send, number, part)
+                batch.append(futures[number])
+                if len(batch) == self.config.upload_concurrency:
+                    _end_when_uploaded(traced, batch)
+                    batch = []
+
+            return {number: future.result() for number, future in futures.items()}
+        except BaseException:
+            # Let running parts finish first, or they could outlive an abort
+            pool.shutdown(wait=True, cancel_futures=True)
+            raise
+        finally:
+            if batch:
+                _end_when_uploaded(traced, batch)
+            pool.shutdown(wait=True)
+
+    def _complete(self, remote_key: str, upload_id: str, etags: dict[int, str]) -> None:
+        """Complete a multipart upload from the ETags of all its parts."""
+        self.client.complete_multipart_upload(
+            **self._bucket_args(),
+            Key=remote_key,
+            UploadId=upload_id,
+            MultipartUpload={"Parts": [{"PartNumber": number, "ETag": etags[number]} for number in sorted(etags)]},
+        )
+
+    def _abort_recorded(self, state: UploadState) -> None:
+        """Abort a recorded multipart upload and forget it; an upload that is already gone is fine."""
+        try:
+            self.client.abort_multipart_upload(**self._bucket_args(), Key=state.key, UploadId=state.upload_id)
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") != "NoSuchUpload":
+                raise
+        self.upload_state.delete(self.bucket, state.key)
+
+    def upload_stream(
+        self,
+        stream: BinaryIO,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+        expected_size: int | None = None,
+    ) -> StreamedUpload:
+        """Upload a stream to S3 as a multipart upload.
+
+        Parts are read from the stream in order and uploaded by up to
+        S3_UPLOAD_CONCURRENCY workers. The next part is only read once a
+        worker is free, so at most that many parts are held in memory and a
+        slow upload slows down the producer of the stream instead. Size and
+        checksum are only known at the end; they are added to the metadata
+        with an in-place copy once the upload completed. On any failure the
+        multipart upload is aborted, so no orphaned parts are left to be
+        billed. A streamed upload cannot be resumed, but is recorded while it
+        runs, so the next run can discard it if the process dies.
+
+        Args:
+            stream: Data to upload
+            remote_key: Key/path in the S3 bucket
+            metadata: Optional user metadata stored with the object
+            expected_size: Estimated size of the object, which must fit in 10,000 parts
+
+        Returns:
+            Size and SHA-256 of the uploaded object
+
+        Raises:
+            StorageError: If the object would not fit in 10,000 parts or the upload fails
+        """
+        limit = self.part_size * MAX_PARTS
+        if expected_size is not None and expected_size > limit:
+            raise StorageError(
+                f"{remote_key} is expected to be about {expected_size / MIB:.0f} MiB, but a streamed upload holds at "
+                f"most {MAX_PARTS} parts of S3_PART_SIZE_MB={self.config.part_size_mb} ({limit / MIB:.0f} MiB), "
+                "raise S3_PART_SIZE_MB"
+            )
+
+        logger.info(
+            f"Streaming upload to s3://{self.bucket}/{remote_key} in parts of {self.config.part_size_mb} MiB "
+            f"with {self.config.upload_concurrency} workers"
+        )
+
+        try:
+            upload_id = self._create_multipart_upload(remote_key, metadata)
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 upload failed: {e}")
+            raise StorageError(f"Failed to start multipart upload to S3: {e}")
+
+        state = UploadState(
+            bucket=self.bucket,
+            key=remote_key,
+            upload_id=upload_id,
+            started=datetime.now(timezone.utc).isoformat(),
+            metadata=dict(metadata or {}),
+        )
+        digest = hashlib.sha256()
+        size = 0
+        progress = TransferProgress(remote_key)
+
+        def parts():
+            nonlocal size
+            number = 0
+            while True:
+                part = stream.read(self.part_size)
+                # An empty stream still needs one (empty) part
+                if not part and number:
+                    return
+                if number == MAX_PARTS:
+                    raise StorageError(
+                        f"{remote_key} outgrew {MAX_PARTS} parts of S3_PART_SIZE_MB={self.config.part_size_mb}, "
+                        "raise S3_PART_SIZE_MB"
+                    )
+                number += 1
+                digest.update(part)
+                size += len(part)
+                yield number, part
+                if not part:
+                    return
+
+        with self.upload_state.sending(self.bucket, remote_key):
+            try:
+                self.upload_state.save(state)
+                etags = self._send_parts(remote_key, upload_id, parts(), progress)
+                self._complete(remote_key, upload_id, etags)
+            except Exception as e:
+                logger.error(f"S3 streaming upload failed after {progress.transferred} bytes, aborting it: {e}")
+                try:
+                    self._abort_recorded(state)
+                except (BotoCoreError, ClientError) as abort_error:
+                    logger.warning(f"Failed to abort multipart upload {upload_id} of {remote_key}: {abort_error}")
+                if isinstance(e, (BotoCoreError, ClientError)):
+                    raise StorageError(f"Failed to upload to S3: {e}")
+                raise
+
+            self.upload_state.delete(self.bucket, remote_key)
+
+        uploaded = StreamedUpload(size=size, sha256=digest.hexdigest())
+        recorded = {**(metadata or {}), "size": str(uploaded.size), "sha256": uploaded.sha256}
+
+        try:
+            self.client.copy(
+                {"Bucket": self.bucket, "Key": remote_key},
+                self.bucket,
+                remote_key,
+                ExtraArgs={**self._extra_args(recorded, remote_key), "MetadataDirective": "REPLACE"},
+            )
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 metadata update failed: {e}")
+            raise StorageError(f"Failed to record the size and checksum of {remote_key}: {e}")
+
+        logger.info(f"Upload completed: {remote_key} ({size} bytes in {len(etags)} parts)")
+        return uploaded
+
+    def interrupted_uploads(self, prefix: str) -> list[InterruptedUpload]:
+        """List the uploads under a prefix recorded in S3_UPLOAD_STATE_DIR that never finished."""
+        return [
+            InterruptedUpload(
+                key=state.key,
+                local_path=Path(state.local_path) if state.local_path else None,
+                started=datetime.fromisoformat(state.started),
+                metadata=state.metadata,
+            )
+            for state in self.upload_state.pending(self.bucket, prefix)
+        ]
+
+    def abort_upload(self, upload: InterruptedUpload) -> None:
+        """Abort a recorded multipart upload and forget it.
+
+        Raises:
+            StorageError: If aborting fails
+        """
+        state = self.upload_state.load(self.bucket, upload.key)
+        if state is None:
+            return
+
+        logger.info(f"Aborting interrupted multipart upload of {upload.key}")
+        try:
+            self._abort_recorded(state)
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 abort multipart upload failed: {e}")
+            raise StorageError(f"Failed to abort the multipart upload of {upload.key}: {e}")
+
+    def abort_stale_uploads(self, prefix: str, older_than: timedelta) -> list[str]:
+        """Abort incomplete multipart uploads under a prefix started longer ago than a given age.
+
+        Args:
+            prefix: Key prefix of the uploads to consider
+            older_than: Minimum age of an upload to abort
+
+        Returns:
+            Keys of the aborted uploads
+
+        Raises:
+            StorageError: If listing or aborting fails
+        """
+        cutoff = datetime.now(timezone.utc) - older_than
+        aborted = []
+
+        try:
+            paginator = self.client.get_paginator("list_multipart_uploads")
+            for page in paginator.paginate(**self._bucket_args(), Prefix=prefix):
+                for upload in page.get("Uploads", []):
+                    if upload["Initiated"] >= cutoff:
+                        continue
+
+                    logger.info(f"Aborting multipart upload of {upload['Key']} started {upload['Initiated'].isoformat()}")
+                    self.client.abort_multipart_upload(
+                        **self._bucket_args(), Key=upload["Key"], UploadId=upload["UploadId"]
+                    )
+                    state = self.upload_state.load(self.bucket, upload["Key"])
+                    if state is not None and state.upload_id == upload["UploadId"]:
+                        self.upload_state.delete(self.bucket, upload["Key"])
+                    aborted.append(upload["Key"])
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 multipart upload cleanup failed: {e}")
+            raise StorageError(f"Failed to abort stale multipart uploads: {e}")
+
+        return aborted
+
     def list(self, prefix: str = "") -> list[StorageObject]:
         """List objects in the S3 bucket.
 
@@ -65,7 +649,7 @@ class S3StorageAdapter(StorageAdapter):
             prefix: Filter objects by key prefix
 
         Returns:
-            List of StorageObject instances
+            List of StorageObject instances, with GLACIER and DEEP_ARCHIVE objects flagged
 
         Raises:
             StorageError: If listing fails
@@ -76,13 +660,14 @@ class S3StorageAdapter(StorageAdapter):
             objects = []
             paginator = self.client.get_paginator("list_objects_v2")
 
-            for page in paginator.paginate(Bucket=self.bucket, Prefix=prefix):
+            for page in paginator.paginate(**self._bucket_args(), Prefix=prefix):
                 for obj in page.get("Contents", []):
                     objects.append(
                         StorageObject(
                             key=obj["Key"],
                             size=obj["Size"],
                             last_modified=obj["LastModified"],
+                            archived=obj.get("StorageClass") in THAW_TIMES,
                         )
                     )
 
@@ -93,6 +678,107 @@ class S3StorageAdapter(StorageAdapter):
             logger.error(f"S3 list failed: {e}")
             raise StorageError(f"Failed to list S3 objects: {e}")
 
+    @property
+    def supports_exclusive_create(self) -> bool:
+        return True
+
+    def create_exclusive(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a small file with a conditional put that fails if the key is taken.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.client.put_object(
+                **self._bucket_args(), Key=remote_key, Body=local_path.read_bytes(), IfNoneMatch="*"
+            )
+            return True
+        except ClientError as e:
+            # A conditional write racing another to the same key may be told to retry, as the other won
+            if e.response.get("Error", {}).get("Code") in ("PreconditionFailed", "ConditionalRequestConflict"):
+                return False
+            logger.error(f"S3 conditional put failed: {e}")
+            raise StorageError(f"Failed to upload to S3: {e}")
+        except (BotoCoreError, OSError) as e:
+            logger.error(f"S3 conditional put failed: {e}")
+            raise StorageError(f"Failed to upload to S3: {e}")
+
+    def read_versioned(self, remote_key: str) -> tuple[bytes, str] | None:
+        """Read a small object along with its ETag.
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        try:
+            response = self.client.get_object(**self._bucket_args(), Key=remote_key)
+            return response["Body"].read(), response["ETag"]
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") in ("NoSuchKey", "404"):
+                return None
+            logger.error(f"S3 read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from S3: {e}")
+        except BotoCoreError as e:
+            logger.error(f"S3 read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from S3: {e}")
+
+    def replace_if_unchanged(self, local_path: Path, remote_key: str, version: str) -> bool:
+        """Overwrite a small object with a put conditional on its ETag.
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        try:
+            self.client.put_object(**self._bucket_args(), Key=remote_key, Body=local_path.read_bytes(), IfMatch=version)
+            return True
+        except ClientError as e:
+            # A put conditional on an ETag is refused with 404 once the object is gone
+            if e.response.get("Error", {}).get("Code") in (
+                "PreconditionFailed", "ConditionalRequestConflict", "NoSuchKey"
+            ):
+                return False
+            logger.error(f"S3 conditional put failed: {e}")
+            raise StorageError(f"Failed to upload to S3: {e}")
+        except (BotoCoreError, OSError) as e:
+            logger.error(f"S3 conditional put failed: {e}")
+            raise StorageError(f"Failed to upload to S3: {e}")
+
+    @property
+    def supports_legal_hold(self) -> bool:
+        return True
+
+    def set_legal_hold(self, remote_key: str, on: bool) -> None:
+        """Place or lift an Object Lock legal hold; the bucket must have Object Lock enabled.
+
+        Raises:
+            StorageError: If the hold cannot be changed
+        """
+        try:
+            self.client.put_object_legal_hold(
+                **self._bucket_args(), Key=remote_key, LegalHold={"Status": "ON" if on else "OFF"}
+            )
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 legal hold failed: {e}")
+            raise StorageError(f"Failed to {'place' if on else 'lift'} the legal hold on {remote_key}: {e}")
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Fetch the user metadata stored with an S3 object.
+
+        Args:
+            remote_key: Key/path of the object
+
+        Returns:
+            Metadata dictionary
+
+        Raises:
+            StorageError: If the object cannot be read
+        """
+        try:
+            response = self.client.head_object(**self._bucket_args(), Key=remote_key)
+            return response.get("Metadata", {})
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 head object failed: {e}")
+            raise StorageError(f"Failed to read S3 object metadata: {e}")
+
     def delete(self, remote_key: str) -> None:
         """Delete an object from S3.
 
@@ -105,7 +791,7 @@ class S3StorageAdapter(StorageAdapter):
         logger.info(f"Deleting s3://{self.bucket}/{remote_key}")
 
         try:
-            self.client.delete_object(Bucket=self.bucket, Key=remote_key)
+            self.client.delete_object(**self._bucket_args(), Key=remote_key)
             logger.debug(f"Deleted: {remote_key}")
         except (BotoCoreError, ClientError) as e:
             logger.error(f"S3 delete failed: {e}")
@@ -131,7 +817,7 @@ class S3StorageAdapter(StorageAdapter):
             for i in range(0, len(delete_objects), 1000):
                 batch = delete_objects[i : i + 1000]
                 self.client.delete_objects(
-                    Bucket=self.bucket, Delete={"Objects": batch}
+                    **self._bucket_args(), Delete={"Objects": batch}
                 )
 
             logger.info(f"Deleted {len(remote_keys)} objects")
@@ -140,6 +826,59 @@ class S3StorageAdapter(StorageAdapter):
             logger.error(f"S3 bulk delete failed: {e}")
             raise StorageError(f"Failed to delete S3 objects: {e}")
 
+    def _archived_error(self, remote_key: str) -> StorageError:
+        """Explain how to get at an archived object, requesting its restore if configured.
+
+        Args:
+            remote_key: Key/path of the archived object
+
+        Returns:
+            Error to raise from the download
+        """
+        try:
+            head = self.client.head_object(**self._bucket_args(), Key=remote_key)
+        except (BotoCoreError, ClientError) as e:
+            return StorageError(f"{remote_key} is archived and its storage class cannot be read: {e}")
+
+        storage_class = head.get("StorageClass", "GLACIER")
+        tiers = THAW_TIMES.get(storage_class, {})
+
+        # Restore is 'ongoing-request="true"' while a restore is in progress
+        if 'ongoing-request="true"' in head.get("Restore", ""):
+            return StorageError(
+                f"{remote_key} is in {storage_class} and a restore is already in progress, run the restore again once "
+                "it completes"
+            )
+
+        tier = self.config.restore_tier
+        if tier is None:
+            options = ", ".join(f"{name}: {time}" for name, time in tiers.items())
+            return StorageError(
+                f"{remote_key} is in {storage_class} and must be restored before it can be downloaded. Set "
+                f"S3_RESTORE_TIER to request the restore automatically ({options}), or restore it with the AWS CLI"
+            )
+
+        if tier not in tiers:
+            # Deep Archive has no expedited retrievals
+            logger.warning(f"{storage_class} does not support {tier} restores, using Standard")
+            tier = "Standard"
+
+        try:
+            self.client.restore_object(
+                **self._bucket_args(),
+                Key=remote_key,
+                RestoreRequest={"Days": self.config.restore_days, "GlacierJobParameters": {"Tier": tier}},
+            )
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 restore request failed: {e}")
+            return StorageError(f"{remote_key} is in {storage_class} and requesting its restore failed: {e}")
+
+        logger.info(f"Requested {tier} restore of {remote_key} for {self.config.restore_days} days")
+        return StorageError(
+            f"{remote_key} is in {storage_class}; a {tier} restore was requested and typically takes "
+            f"{tiers[tier]}. Run the restore again once it completes"
+        )
+
     def download(self, remote_key: str, local_path: Path) -> None:
         """Download a file from S3.
 
@@ -148,13 +887,121 @@ class S3StorageAdapter(StorageAdapter):
             local_path: Local path to save the downloaded file
 
         Raises:
-            StorageError: If the download fails
+            StorageError: If the download fails or the object is archived
         """
         logger.info(f"Downloading s3://{self.bucket}/{remote_key} to {local_path}")
 
         try:
-            self.client.download_file(self.bucket, remote_key, str(local_path))
+            extra_args = None
+            if self.config.expected_bucket_owner:
+                extra_args = {"ExpectedBucketOwner": self.config.expected_bucket_owner}
+            self.client.download_file(
+                self.bucket, remote_key, str(local_path), ExtraArgs=extra_args, Callback=self.download_throttle
+            )
             logger.info(f"Download completed: {local_path}")
-        except (BotoCoreError, ClientError) as e:
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") == "InvalidObjectState":
+                raise self._archived_error(remote_key)
+            logger.error(f"S3 download failed: {e}")
+            raise StorageError(f"Failed to download from S3: {e}")
+        except BotoCoreError as e:
+            logger.error(f"S3 download failed: {e}")
+            raise StorageError(f"Failed to download from S3: {e}")
+
+    @property
+    def supports_streaming_download(self) -> bool:
+        return True
+
+    def open_download(self, remote_key: str) -> BinaryIO:
+        """Open an S3 object for reading with a GET whose body is read as it arrives.
+
+        Raises:
+            StorageError: If the GET fails or the object is archived
+        """
+        logger.info(f"Streaming s3://{self.bucket}/{remote_key}")
+
+        try:
+            response = self.client.get_object(**self._bucket_args(), Key=remote_key)
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") == "InvalidObjectState":
+                raise self._archived_error(remote_key)
             logger.error(f"S3 download failed: {e}")
             raise StorageError(f"Failed to download from S3: {e}")
+        except BotoCoreError as e:
+            logger.error(f"S3 download failed: {e}")
+            raise StorageError(f"Failed to download from S3: {e}")
+
+        return throttled_reader(response["Body"], self.download_throttle)
+
+    @property
+    def supports_range_reads(self) -> bool:
+        return True
+
+    def read_range(self, remote_key: str, start: int, length: int) -> bytes:
+        """Read a byte range of an S3 object with a ranged GET.
+
+        Raises:
+            StorageError: If the read fails or the object is archived
+        """
+        try:
+            pace(self.download_throttle, length)
+            response = self.client.get_object(
+                **self._bucket_args(), Key=remote_key, Range=f"bytes={start}-{start + length - 1}"
+            )
+            return response["Body"].read()
+        except ClientError as e:
+            if e.response.get("Error", {}).get("Code") == "InvalidObjectState":
+                raise self._archived_error(remote_key)
+            logger.error(f"S3 ranged read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from S3: {e}")
+        except BotoCoreError as e:
+            logger.error(f"S3 ranged read failed: {e}")
+            raise StorageError(f"Failed to read {remote_key} from S3: {e}")
+
+    def check_connectivity(self, key: str) -> None:
+        """Check that the bucket exists, then round-trip a test object.
+
+        Args:
+            key: Key/path of the test object
+
+        Raises:
+            StorageError: If the bucket cannot be reached or the round trip fails
+        """
+        try:
+            # Sent with the configured addressing style, so path-style endpoints are checked as used
+            self.client.head_bucket(**self._bucket_args())
+        except (BotoCoreError, ClientError) as e:
+            logger.error(f"S3 head bucket failed: {e}")
+            raise StorageError(f"Bucket '{self.bucket}' is not reachable: {e}")
+
+        super().check_connectivity(key)
+
+    def external_location(self, remote_key: str) -> ExternalLocation:
+        """Return the bucket, key and credentials for a database server to write to.
+
+        Args:
+            remote_key: Key/path in the S3 bucket
+
+        Credentials of the default chain are passed as they are now; when
+        temporary, the server must be done writing before they expire.
+
+        Returns:
+            Location including this adapter's credentials and endpoint
+
+        Raises:
+            StorageError: If no source of the default chain has credentials
+        """
+        if self.session is None:
+            access_key, secret_key, token = self.config.access_key, self.config.secret_key, self.config.session_token
+        else:
+            frozen = self._chain_credentials().get_frozen_credentials()
+            access_key, secret_key, token = frozen.access_key, frozen.secret_key, frozen.token
+        return ExternalLocation(
+            bucket=self.bucket,
+            key=remote_key,
+            region=self.config.region,
+            access_key=access_key,
+            secret_key=secret_key,
+            endpoint=self.config.endpoint,
+            session_token=token,
+        )
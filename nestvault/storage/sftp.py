@@ -0,0 +1,340 @@
+"""SFTP storage adapter using paramiko."""
+
+from __future__ import annotations
+
+import base64
+import hashlib
+import json
+import os
+import posixpath
+import stat
+from collections.abc import Iterator
+from contextlib import contextmanager
+from datetime import datetime, timezone
+from pathlib import Path
+
+import paramiko
+
+from nestvault.config import SFTPConfig
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import METADATA_SUFFIX, PARTIAL_SUFFIX, StorageAdapter, StorageObject
+from nestvault.throttle import cumulative
+
+logger = get_logger("storage.sftp")
+
+
+def fingerprint(key: paramiko.PKey) -> str:
+    """Return a host key's fingerprint in the SHA256:... form ssh-keygen prints."""
+    digest = hashlib.sha256(key.asbytes()).digest()
+    return "SHA256:" + base64.b64encode(digest).decode().rstrip("=")
+
+
+class PinnedHostKeyPolicy(paramiko.MissingHostKeyPolicy):
+    """Accept only the host key matching a pinned fingerprint."""
+
+    def __init__(self, expected: str):
+        self.expected = expected
+
+    def missing_host_key(self, client, hostname, key):
+        actual = fingerprint(key)
+        if actual != self.expected:
+            raise paramiko.SSHException(
+                f"Host key for {hostname} is {actual}, expected pinned {self.expected}"
+            )
+
+
+class SFTPStorageAdapter(StorageAdapter):
+    """Storage adapter for SFTP servers.
+
+    A connection is opened per operation, so a long-running scheduler does
+    not depend on an idle session surviving between backups. Uploads are
+    written to a hidden temporary name and renamed into place once
+    complete, so an interrupted transfer never looks like a backup.
+    """
+
+    def __init__(self, config: SFTPConfig):
+        """Initialize the SFTP storage adapter.
+
+        Args:
+            config: SFTP configuration
+
+        Raises:
+            StorageError: If the private key cannot be loaded
+        """
+        self.config = config
+        self.pkey = None
+
+        if config.private_key:
+            try:
+                self.pkey = paramiko.PKey.from_path(
+                    os.path.expanduser(config.private_key), passphrase=config.private_key_passphrase
+                )
+            except (paramiko.SSHException, OSError) as e:
+                raise StorageError(f"Failed to load SFTP private key {config.private_key}: {e}")
+
+        logger.debug(f"Initialized SFTP adapter for {config.user}@{config.host}:{config.root}")
+
+    @contextmanager
+    def _connect(self) -> Iterator[paramiko.SFTPClient]:
+        """Open an SFTP session, verifying the server's host key.
+
+        Raises:
+            StorageError: If the connection or host key verification fails
+        """
+        client = paramiko.SSHClient()
+
+        try:
+            if self.config.host_key_fingerprint:
+                client.set_missing_host_key_policy(PinnedHostKeyPolicy(self.config.host_key_fingerprint))
+            else:
+                client.load_host_keys(os.path.expanduser(self.config.known_hosts))
+                client.set_missing_host_key_policy(paramiko.RejectPolicy())
+
+            client.connect(
+                self.config.host,
+                port=self.config.port,
+                username=self.config.user,
+                password=self.config.password,
+                pkey=self.pkey,
+                allow_agent=False,
+                look_for_keys=False,
+            )
+            sftp = client.open_sftp()
+        except (paramiko.SSHException, OSError) as e:
+            client.close()
+            logger.error(f"SFTP connection to {self.config.host} failed: {e}")
+            raise StorageError(f"Failed to connect to SFTP server {self.config.host}: {e}")
+
+        try:
+            yield sftp
+        finally:
+            sftp.close()
+            client.close()
+
+    def _path(self, remote_key: str) -> str:
+        """Return the server path of a key."""
+        return posixpath.join(self.config.root, remote_key)
+
+    @staticmethod
+    def _makedirs(sftp: paramiko.SFTPClient, directory: str) -> None:
+        """Create a directory and its missing parents."""
+        if directory in ("", ".", "/"):
+            return
+        try:
+            sftp.stat(directory)
+        except FileNotFoundError:
+            SFTPStorageAdapter._makedirs(sftp, posixpath.dirname(directory))
+            sftp.mkdir(directory)
+
+    @staticmethod
+    def _replace(sftp: paramiko.SFTPClient, source: str, target: str) -> None:
+        """Rename a file over an existing one."""
+        try:
+            sftp.posix_rename(source, target)
+        except OSError:
+            # Servers without the posix-rename extension refuse to rename over existing files
+            try:
+                sftp.remove(target)
+            except FileNotFoundError:
+                pass
+            sftp.rename(source, target)
+
+    def _put_atomic(self, sftp: paramiko.SFTPClient, local_path: Path, path: str) -> None:
+        """Upload a file under a temporary name and rename it into place."""
+        directory, name = posixpath.split(path)
+        partial = posixpath.join(directory, f".{name}{PARTIAL_SUFFIX}")
+
+        try:
+            sftp.put(str(local_path), partial, callback=cumulative(self.upload_throttle), confirm=True)
+            self._replace(sftp, partial, path)
+        except (paramiko.SSHException, OSError):
+            try:
+                sftp.remove(partial)
+            except OSError:
+                pass
+            raise
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Upload a file to the SFTP server.
+
+        The metadata sidecar is written before the backup is renamed into
+        place, so every visible backup has its metadata.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Key/path below the SFTP root
+            metadata: Optional metadata stored in a sidecar file
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        path = self._path(remote_key)
+        logger.info(f"Uploading {local_path.name} to sftp://{self.config.host}/{path}")
+
+        with self._connect() as sftp:
+            try:
+                self._makedirs(sftp, posixpath.dirname(path))
+
+                if metadata:
+                    metadata_file = local_path.with_name(local_path.name + METADATA_SUFFIX)
+                    metadata_file.write_text(json.dumps(metadata))
+                    try:
+                        self._put_atomic(sftp, metadata_file, path + METADATA_SUFFIX)
+                    finally:
+                        metadata_file.unlink(missing_ok=True)
+
+                self._put_atomic(sftp, local_path, path)
+                logger.info(f"Upload completed: {remote_key}")
+            except (paramiko.SSHException, OSError) as e:
+                logger.error(f"SFTP upload failed: {e}")
+                raise StorageError(f"Failed to upload to SFTP: {e}")
+
+    def _walk(self, sftp: paramiko.SFTPClient, directory: str) -> Iterator[tuple[str, paramiko.SFTPAttributes]]:
+        """Yield the key and attributes of every file below a directory."""
+        try:
+            entries = sftp.listdir_attr(self._path(directory))
+        except FileNotFoundError:
+            return
+
+        for entry in entries:
+            key = posixpath.join(directory, entry.filename) if directory else entry.filename
+            if stat.S_ISDIR(entry.st_mode):
+                yield from self._walk(sftp, key)
+            elif stat.S_ISREG(entry.st_mode):
+                yield key, entry
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List backups below the SFTP root.
+
+        Metadata sidecars and uploads still in progress are left out.
+
+        Args:
+            prefix: Filter files by key prefix
+
+        Returns:
+            List of StorageObject instances, with the modification time as last_modified
+
+        Raises:
+            StorageError: If listing fails
+        """
+        logger.debug(f"Listing objects with prefix '{prefix}'")
+
+        with self._connect() as sftp:
+            try:
+                objects = [
+                    StorageObject(
+                        key=key,
+                        size=attrs.st_size,
+                        last_modified=datetime.fromtimestamp(attrs.st_mtime, tz=timezone.utc),
+                    )
+                    for key, attrs in self._walk(sftp, posixpath.dirname(prefix))
+                    if key.startswith(prefix)
+                    and not posixpath.basename(key).startswith(".")
+                    and not key.endswith(METADATA_SUFFIX)
+                ]
+            except (paramiko.SSHException, OSError) as e:
+                logger.error(f"SFTP list failed: {e}")
+                raise StorageError(f"Failed to list SFTP files: {e}")
+
+        logger.debug(f"Found {len(objects)} objects")
+        return objects
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Read the metadata sidecar of a backup.
+
+        Args:
+            remote_key: Key/path of the backup
+
+        Returns:
+            Metadata dictionary, empty when the backup has no sidecar
+
+        Raises:
+            StorageError: If the sidecar cannot be read
+        """
+        with self._connect() as sftp:
+            try:
+                with sftp.open(self._path(remote_key) + METADATA_SUFFIX) as f:
+                    return json.loads(f.read())
+            except FileNotFoundError:
+                return {}
+            except (paramiko.SSHException, OSError, ValueError) as e:
+                logger.error(f"SFTP metadata read failed: {e}")
+                raise StorageError(f"Failed to read SFTP metadata: {e}")
+
+    def _remove(self, sftp: paramiko.SFTPClient, remote_key: str) -> None:
+        """Remove a backup and its metadata sidecar, ignoring files already gone."""
+        for path in (self._path(remote_key), self._path(remote_key) + METADATA_SUFFIX):
+            try:
+                sftp.remove(path)
+            except FileNotFoundError:
+                pass
+
+    def delete(self, remote_key: str) -> None:
+        """Delete a backup from the SFTP server.
+
+        Args:
+            remote_key: Key/path of the backup to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        logger.info(f"Deleting sftp://{self.config.host}/{self._path(remote_key)}")
+
+        with self._connect() as sftp:
+            try:
+                self._remove(sftp, remote_key)
+                logger.debug(f"Deleted: {remote_key}")
+            except (paramiko.SSHException, OSError) as e:
+                logger.error(f"SFTP delete failed: {e}")
+                raise StorageError(f"Failed to delete SFTP file: {e}")
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple backups over one connection.
+
+        Args:
+            remote_keys: List of keys to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        if not remote_keys:
+            return
+
+        logger.info(f"Deleting {len(remote_keys)} objects from SFTP")
+
+        with self._connect() as sftp:
+            try:
+                for key in remote_keys:
+                    self._remove(sftp, key)
+            except (paramiko.SSHException, OSError) as e:
+                logger.error(f"SFTP bulk delete failed: {e}")
+                raise StorageError(f"Failed to delete SFTP files: {e}")
+
+        logger.info(f"Deleted {len(remote_keys)} objects")
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Download a backup from the SFTP server.
+
+        Args:
+            remote_key: Key/path of the backup
+            local_path: Local path to save the downloaded file
+
+        Raises:
+            StorageError: If the download fails
+        """
+        path = self._path(remote_key)
+        logger.info(f"Downloading sftp://{self.config.host}/{path} to {local_path}")
+
+        with self._connect() as sftp:
+            try:
+                sftp.get(path, str(local_path), callback=cumulative(self.download_throttle))
+                logger.info(f"Download completed: {local_path}")
+            except (paramiko.SSHException, OSError) as e:
+                logger.error(f"SFTP download failed: {e}")
+                raise StorageError(f"Failed to download from SFTP: {e}")
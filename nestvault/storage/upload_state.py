@@ -0,0 +1,147 @@
+"""Local record of multipart uploads in progress, so interrupted uploads can continue."""
+
+from __future__ import annotations
+
+import hashlib
+import json
+import os
+import threading
+from collections.abc import Iterator
+from contextlib import contextmanager
+from dataclasses import asdict, dataclass, field
+from pathlib import Path
+
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+
+logger = get_logger("storage.upload_state")
+
+# State files of the uploads this process is sending, across the stores of all targets
+_sending: set[Path] = set()
+_sending_lock = threading.Lock()
+
+
+@dataclass
+class UploadState:
+    """Progress of one multipart upload."""
+
+    bucket: str
+    key: str
+    upload_id: str
+    # ISO 8601 time the upload was started
+    started: str
+    metadata: dict[str, str] = field(default_factory=dict)
+    # Source file with its size and modification time, or None for a streamed upload
+    local_path: str | None = None
+    size: int = 0
+    mtime: float = 0.0
+    part_size: int = 0
+    # ETag of every uploaded part, keyed by part number
+    parts: dict[int, str] = field(default_factory=dict)
+
+    def matches(self, local_path: Path, part_size: int) -> bool:
+        """Check whether this upload was of the same, unchanged file in the same parts."""
+        try:
+            stat = local_path.stat()
+        except OSError:
+            return False
+        return (
+            self.local_path == str(local_path)
+            and self.size == stat.st_size
+            and self.mtime == stat.st_mtime
+            and self.part_size == part_size
+        )
+
+
+class UploadStateStore:
+    """Keeps one JSON file per upload in progress, replaced atomically as parts complete.
+
+    Files are deleted once their upload completes or is aborted, so any
+    file left over belongs to a run that died or gave up mid-upload.
+    Uploads another run of this process is still sending are not
+    pending, as targets backed up concurrently can share a bucket.
+    """
+
+    def __init__(self, directory: Path):
+        """Initialize the store.
+
+        Args:
+            directory: Directory for the state files, created when first written to
+        """
+        self.directory = directory
+        self.lock = threading.RLock()
+
+    def _path(self, bucket: str, key: str) -> Path:
+        digest = hashlib.sha256(f"{bucket}/{key}".encode()).hexdigest()[:32]
+        return self.directory / f"{digest}.json"
+
+    def save(self, state: UploadState) -> None:
+        """Write the state of an upload, replacing its previous state.
+
+        Raises:
+            StorageError: If the state file cannot be written
+        """
+        path = self._path(state.bucket, state.key)
+        partial = path.with_suffix(".tmp")
+
+        with self.lock:
+            try:
+                self.directory.mkdir(mode=0o700, parents=True, exist_ok=True)
+                partial.write_text(json.dumps(asdict(state)))
+                os.replace(partial, path)
+            except OSError as e:
+                raise StorageError(f"Failed to record the progress of uploading {state.key}: {e}")
+
+    def record_part(self, state: UploadState, number: int, etag: str) -> None:
+        """Add an uploaded part to an upload's state and write it; safe to call from several workers.
+
+        Raises:
+            StorageError: If the state file cannot be written
+        """
+        with self.lock:
+            state.parts[number] = etag
+            self.save(state)
+
+    def load(self, bucket: str, key: str) -> UploadState | None:
+        """Read the state of an upload, or None when there is none."""
+        return self._read(self._path(bucket, key))
+
+    def _read(self, path: Path) -> UploadState | None:
+        try:
+            data = json.loads(path.read_text())
+            data["parts"] = {int(number): etag for number, etag in data.get("parts", {}).items()}
+            return UploadState(**data)
+        except FileNotFoundError:
+            return None
+        except (OSError, ValueError, TypeError) as e:
+            logger.warning(f"Ignoring unreadable upload state {path.name}: {e}")
+            return None
+
+    def delete(self, bucket: str, key: str) -> None:
+        """Forget an upload that completed or was aborted."""
+        with self.lock:
+            self._path(bucket, key).unlink(missing_ok=True)
+
+    @contextmanager
+    def sending(self, bucket: str, key: str) -> Iterator[None]:
+        """Mark an upload as being sent by this process until the block is left."""
+        path = self._path(bucket, key)
+        with _sending_lock:
+            _sending.add(path)
+        try:
+            yield
+        finally:
+            with _sending_lock:
+                _sending.discard(path)
+
+    def pending(self, bucket: str, prefix: str = "") -> list[UploadState]:
+        """Return the unfinished uploads to a bucket under a key prefix that nothing is sending."""
+        if not self.directory.is_dir():
+            return []
+
+        with _sending_lock:
+            paths = [path for path in sorted(self.directory.glob("*.json")) if path not in _sending]
+        states = [self._read(path) for path in paths]
+        return [
+            state for state in states if state is not None and state.bucket == bucket and state.key.startswith(prefix)
+        ]
@@ -0,0 +1,373 @@
+"""WebDAV storage adapter, with Nextcloud chunked uploads."""
+
+from __future__ import annotations
+
+import base64
+import json
+import posixpath
+import re
+import shutil
+import ssl
+import urllib.error
+import urllib.parse
+import urllib.request
+import uuid
+import xml.etree.ElementTree as ElementTree
+from email.utils import parsedate_to_datetime
+from pathlib import Path
+
+from nestvault.config import WebDAVConfig
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.storage.base import METADATA_SUFFIX, PARTIAL_SUFFIX, StorageAdapter, StorageObject
+from nestvault.throttle import pace, throttled_reader
+
+logger = get_logger("storage.webdav")
+
+# Nextcloud serves a user's files below /remote.php/dav/files/<user>
+NEXTCLOUD_FILES_URL = re.compile(r"^(?P<dav>.+/remote\.php/dav)/files/(?P<user>[^/]+)")
+
+PROPFIND_BODY = (
+    b'<?xml version="1.0" encoding="utf-8"?>'
+    b'<d:propfind xmlns:d="DAV:"><d:prop>'
+    b"<d:resourcetype/><d:getcontentlength/><d:getlastmodified/>"
+    b"</d:prop></d:propfind>"
+)
+
+DAV = "{DAV:}"
+
+
+class WebDAVStorageAdapter(StorageAdapter):
+    """Storage adapter for WebDAV servers such as Nextcloud.
+
+    On Nextcloud, backups larger than one chunk are uploaded with the
+    chunking extension and assembled on the server. Elsewhere they are
+    sent with a single PUT to a hidden temporary name and moved into
+    place, so an interrupted upload never looks like a backup. Metadata
+    is kept in a sidecar file next to each backup.
+    """
+
+    def __init__(self, config: WebDAVConfig):
+        """Initialize the WebDAV storage adapter.
+
+        Args:
+            config: WebDAV configuration
+        """
+        self.config = config
+        self.context = ssl.create_default_context(cafile=config.ca_cert) if config.ca_cert else None
+        self.base_path = urllib.parse.unquote(urllib.parse.urlsplit(config.url).path).rstrip("/")
+
+        match = NEXTCLOUD_FILES_URL.match(config.url)
+        self.uploads_url = f"{match['dav']}/uploads/{match['user']}" if match else None
+
+        logger.debug(f"Initialized WebDAV adapter for {config.url}")
+
+    def _url(self, remote_key: str) -> str:
+        """Return the URL of a key."""
+        return f"{self.config.url}/{urllib.parse.quote(remote_key)}"
+
+    def _request(
+        self,
+        method: str,
+        url: str,
+        body=None,
+        headers: dict[str, str] | None = None,
+        allowed: tuple[int, ...] = (),
+    ):
+        """Send an authenticated request and return the open response.
+
+        Returns:
+            The open response, or None when the server answers with an allowed error status
+
+        Raises:
+            StorageError: If the server returns an error or cannot be reached
+        """
+        headers = dict(headers or {})
+        if self.config.token:
+            headers["Authorization"] = f"Bearer {self.config.token}"
+        elif self.config.user:
+            credentials = base64.b64encode(f"{self.config.user}:{self.config.password}".encode()).decode()
+            headers["Authorization"] = f"Basic {credentials}"
+
+        request = urllib.request.Request(url, data=body, method=method, headers=headers)
+
+        try:
+            return urllib.request.urlopen(request, timeout=300, context=self.context)
+        except urllib.error.HTTPError as e:
+            if e.code in allowed:
+                return None
+            raise StorageError(f"WebDAV {method} {url} failed with HTTP {e.code}: {e.reason}")
+        except (urllib.error.URLError, OSError) as e:
+            raise StorageError(f"Failed to reach WebDAV server at {self.config.url}: {e}")
+
+    def _call(self, method: str, url: str, body=None, headers: dict[str, str] | None = None, allowed=()) -> None:
+        """Send a request whose response body is not needed."""
+        response = self._request(method, url, body, headers, allowed)
+        if response is not None:
+            response.close()
+
+    def _makedirs(self, directory: str) -> None:
+        """Create a collection and its missing parents with MKCOL."""
+        path = ""
+        for part in directory.split("/"):
+            if not part:
+                continue
+            path = f"{path}/{part}" if path else part
+            # 405 means the collection already exists
+            self._call("MKCOL", self._url(path), allowed=(405,))
+
+    def _put_atomic(self, local_path: Path, remote_key: str) -> None:
+        """Upload a file under a temporary name and move it into place."""
+        directory, name = posixpath.split(remote_key)
+        partial = posixpath.join(directory, f".{name}{PARTIAL_SUFFIX}")
+
+        try:
+            with open(local_path, "rb") as f:
+                self._call(
+                    "PUT",
+                    self._url(partial),
+                    body=throttled_reader(f, self.upload_throttle),
+                    headers={"Content-Length": str(local_path.stat().st_size)},
+                )
+            self._call("MOVE", self._url(partial), headers={"Destination": self._url(remote_key), "Overwrite": "T"})
+        except (StorageError, OSError):
+            try:
+                self._call("DELETE", self._url(partial), allowed=(404,))
+            except StorageError:
+                pass
+            raise
+
+    def _put_chunked(self, local_path: Path, remote_key: str) -> bool:
+        """Upload a file with Nextcloud's chunking extension.
+
+        Returns:
+            False if the server does not support chunked uploads
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        upload_url = f"{self.uploads_url}/nestvault-{uuid.uuid4()}"
+        size = local_path.stat().st_size
+        headers = {"Destination": self._url(remote_key), "OC-Total-Length": str(size)}
+
+        response = self._request("MKCOL", upload_url, headers=headers, allowed=(404, 405, 501))
+        if response is None:
+            logger.debug("Server does not support Nextcloud chunked uploads, falling back to PUT")
+            return False
+        response.close()
+
+        chunk_size = self.config.chunk_size_mb * 1024 * 1024
+
+        try:
+            with open(local_path, "rb") as f:
+                number = 1
+                while chunk := f.read(chunk_size):
+                    pace(self.upload_throttle, len(chunk))
+                    self._call("PUT", f"{upload_url}/{number:05d}", body=chunk, headers=headers)
+                    number += 1
+
+            # Nextcloud assembles the chunks and moves the result to the destination
+            self._call("MOVE", f"{upload_url}/.file", headers=headers)
+        except (StorageError, OSError):
+            try:
+                self._call("DELETE", upload_url, allowed=(404,))
+            except StorageError:
+                pass
+            raise
+
+        return True
+
+    def upload(
+        self,
+        local_path: Path,
+        remote_key: str,
+        metadata: dict[str, str] | None = None,
+    ) -> None:
+        """Upload a file to the WebDAV server.
+
+        Args:
+            local_path: Path to the local file
+            remote_key: Key/path below the WebDAV URL
+            metadata: Optional metadata stored in a sidecar file
+
+        Raises:
+            StorageError: If the upload fails
+        """
+        logger.info(f"Uploading {local_path.name} to {self._url(remote_key)}")
+
+        try:
+            self._makedirs(posixpath.dirname(remote_key))
+
+            if metadata:
+                metadata_file = local_path.with_name(local_path.name + METADATA_SUFFIX)
+                metadata_file.write_text(json.dumps(metadata))
+                try:
+                    self._put_atomic(metadata_file, remote_key + METADATA_SUFFIX)
+                finally:
+                    metadata_file.unlink(missing_ok=True)
+
+            chunked = (
+                self.uploads_url is not None
+                and local_path.stat().st_size > self.config.chunk_size_mb * 1024 * 1024
+                and self._put_chunked(local_path, remote_key)
+            )
+            if not chunked:
+                self._put_atomic(local_path, remote_key)
+
+            logger.info(f"Upload completed: {remote_key}")
+        except (StorageError, OSError) as e:
+            logger.error(f"WebDAV upload failed: {e}")
+            raise StorageError(f"Failed to upload to WebDAV: {e}")
+
+    def _propfind(self, directory: str) -> list[StorageObject]:
+        """List the files below a collection, descending into sub-collections."""
+        # Depth: infinity is disabled on most servers, so walk one level at a time
+        response = self._request(
+            "PROPFIND",
+            self._url(directory) if directory else self.config.url,
+            body=PROPFIND_BODY,
+            headers={"Depth": "1", "Content-Type": "application/xml"},
+            allowed=(404,),
+        )
+        if response is None:
+            return []
+
+        with response:
+            try:
+                tree = ElementTree.parse(response)
+            except ElementTree.ParseError as e:
+                raise StorageError(f"Invalid PROPFIND response from WebDAV server: {e}")
+
+        objects = []
+        for entry in tree.getroot().iter(f"{DAV}response"):
+            path = urllib.parse.unquote(urllib.parse.urlsplit(entry.findtext(f"{DAV}href", "")).path)
+            key = path[len(self.base_path):].strip("/")
+            if key == directory:
+                continue
+
+            if entry.find(f".//{DAV}resourcetype/{DAV}collection") is not None:
+                objects.extend(self._propfind(key))
+            else:
+                modified = entry.findtext(f".//{DAV}getlastmodified")
+                objects.append(
+                    StorageObject(
+                        key=key,
+                        size=int(entry.findtext(f".//{DAV}getcontentlength") or 0),
+                        last_modified=parsedate_to_datetime(modified),
+                    )
+                )
+
+        return objects
+
+    def list(self, prefix: str = "") -> list[StorageObject]:
+        """List backups below the WebDAV URL.
+
+        Metadata sidecars and uploads still in progress are left out.
+
+        Args:
+            prefix: Filter files by key prefix
+
+        Returns:
+            List of StorageObject instances
+
+        Raises:
+            StorageError: If listing fails
+        """
+        logger.debug(f"Listing objects with prefix '{prefix}'")
+
+        try:
+            objects = [
+                obj
+                for obj in self._propfind(posixpath.dirname(prefix))
+                if obj.key.startswith(prefix)
+                and not posixpath.basename(obj.key).startswith(".")
+                and not obj.key.endswith(METADATA_SUFFIX)
+            ]
+        except (TypeError, ValueError) as e:
+            raise StorageError(f"Invalid PROPFIND response from WebDAV server: {e}")
+        except StorageError as e:
+            logger.error(f"WebDAV list failed: {e}")
+            raise
+
+        logger.debug(f"Found {len(objects)} objects")
+        return objects
+
+    def get_metadata(self, remote_key: str) -> dict[str, str]:
+        """Read the metadata sidecar of a backup.
+
+        Args:
+            remote_key: Key/path of the backup
+
+        Returns:
+            Metadata dictionary, empty when the backup has no sidecar
+
+        Raises:
+            StorageError: If the sidecar cannot be read
+        """
+        response = self._request("GET", self._url(remote_key + METADATA_SUFFIX), allowed=(404,))
+        if response is None:
+            return {}
+
+        with response:
+            try:
+                return json.load(response)
+            except ValueError as e:
+                raise StorageError(f"Failed to read metadata of {remote_key}: {e}")
+
+    def delete(self, remote_key: str) -> None:
+        """Delete a backup and its sidecar from the WebDAV server.
+
+        Args:
+            remote_key: Key/path of the backup to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        logger.info(f"Deleting {self._url(remote_key)}")
+
+        try:
+            self._call("DELETE", self._url(remote_key), allowed=(404,))
+            self._call("DELETE", self._url(remote_key + METADATA_SUFFIX), allowed=(404,))
+            logger.debug(f"Deleted: {remote_key}")
+        except StorageError as e:
+            logger.error(f"WebDAV delete failed: {e}")
+            raise
+
+    def delete_many(self, remote_keys: list[str]) -> None:
+        """Delete multiple backups.
+
+        Args:
+            remote_keys: List of keys to delete
+
+        Raises:
+            StorageError: If deletion fails
+        """
+        if not remote_keys:
+            return
+
+        logger.info(f"Deleting {len(remote_keys)} objects from WebDAV")
+
+        for key in remote_keys:
+            self.delete(key)
+
+        logger.info(f"Deleted {len(remote_keys)} objects")
+
+    def download(self, remote_key: str, local_path: Path) -> None:
+        """Download a backup from the WebDAV server.
+
+        Args:
+            remote_key: Key/path of the backup
+            local_path: Local path to save the downloaded file
+
+        Raises:
+            StorageError: If the download fails
+        """
+        logger.info(f"Downloading {self._url(remote_key)} to {local_path}")
+
+        try:
+            with self._request("GET", self._url(remote_key)) as response, open(local_path, "wb") as f:
+                shutil.copyfileobj(throttled_reader(response, self.download_throttle), f, 1024 * 1024)
+            logger.info(f"Download completed: {local_path}")
+        except (StorageError, OSError) as e:
+            logger.error(f"WebDAV download failed: {e}")
+            raise StorageError(f"Failed to download from WebDAV: {e}")
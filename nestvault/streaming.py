@@ -0,0 +1,221 @@
+"""Backups streamed from a dump tool to storage without a temporary file."""
+
+from __future__ import annotations
+
+import io
+import subprocess
+import threading
+from collections.abc import Callable, Iterable, Iterator
+from typing import BinaryIO
+
+from nestvault.exceptions import BackupError
+
+CHUNK_SIZE = 1024 * 1024
+
+
+def command_output(cmd: list[str], env: dict[str, str], description: str) -> Iterator[bytes]:
+    """Run a command and yield its stdout as it is written.
+
+    The command only runs as fast as the output is consumed: while the
+    consumer is busy, the pipe fills up and the command blocks on its next
+    write instead of being buffered in memory. Closing the generator early
+    kills the command.
+
+    Args:
+        cmd: Command and arguments
+        env: Environment of the command
+        description: Name of the command used in errors, e.g. 'pg_dump'
+
+    Raises:
+        BackupError: If the command cannot be started or exits with an error, after its last output
+    """
+    try:
+        process = subprocess.Popen(cmd, env=env, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+    except OSError as e:
+        raise BackupError(f"Failed to run {description}: {e}")
+
+    # Drained on a thread, so a chatty command cannot block on a full stderr pipe
+    stderr: list[bytes] = []
+    thread = threading.Thread(target=lambda: stderr.append(process.stderr.read()), daemon=True)
+    thread.start()
+
+    finished = False
+    try:
+        while chunk := process.stdout.read(CHUNK_SIZE):
+            yield chunk
+        finished = True
+    finally:
+        if not finished:
+            process.kill()
+        process.stdout.close()
+        returncode = process.wait()
+        thread.join()
+
+    if returncode != 0:
+        error_msg = b"".join(stderr).decode(errors="replace").strip() or f"exit status {returncode}"
+        raise BackupError(f"{description} failed: {error_msg}")
+
+
+def _drain(pipe: BinaryIO, into: list[bytes], on_line: Callable[[bytes], bool] | None) -> None:
+    """Read a pipe until it closes, keeping what on_line, when given, returns True for line by line."""
+    if on_line is None:
+        into.append(pipe.read())
+        return
+    for line in pipe:
+        if on_line(line):
+            into.append(line)
+
+
+def command_input(
+    cmd: list[str],
+    env: dict[str, str],
+    source: BinaryIO,
+    description: str,
+    on_stderr: Callable[[bytes], bool] | None = None,
+) -> bytes:
+    """Run a command with a stream as its stdin, e.g. to restore a backup read from storage.
+
+    The stream is read only as fast as the command consumes it. If
+    reading the stream fails, the command is killed and the error raised
+    as is, so nothing more is applied.
+
+    Args:
+        cmd: Command and arguments
+        env: Environment of the command
+        source: Data to write to the command's stdin
+        description: Name of the command used in errors, e.g. 'psql'
+        on_stderr: Called with every line the command writes to stderr as it is written, e.g. to count
+            progress messages; lines it returns False for are left out of what is returned and raised
+
+    Returns:
+        What the command wrote to stderr, e.g. errors psql reported and skipped
+
+    Raises:
+        BackupError: If the command cannot be started or exits with an error
+    """
+    try:
+        process = subprocess.Popen(
+            cmd, env=env, stdin=subprocess.PIPE, stdout=subprocess.DEVNULL, stderr=subprocess.PIPE
+        )
+    except OSError as e:
+        raise BackupError(f"Failed to run {description}: {e}")
+
+    # Drained on a thread, so a chatty command cannot block on a full stderr pipe while it is fed
+    stderr: list[bytes] = []
+    thread = threading.Thread(target=_drain, args=(process.stderr, stderr, on_stderr), daemon=True)
+    thread.start()
+
+    finished = False
+    try:
+        while chunk := source.read(CHUNK_SIZE):
+            process.stdin.write(chunk)
+        finished = True
+    except BrokenPipeError:
+        # The command exited early; its exit status and stderr tell why
+        finished = True
+    finally:
+        if not finished:
+            process.kill()
+        try:
+            process.stdin.close()
+        except BrokenPipeError:
+            pass
+        returncode = process.wait()
+        thread.join()
+
+    output = b"".join(stderr)
+    if returncode != 0:
+        error_msg = output.decode(errors="replace").strip() or f"exit status {returncode}"
+        raise BackupError(f"{description} failed: {error_msg}")
+    return output
+
+
+def command_run(
+    cmd: list[str],
+    env: dict[str, str],
+    description: str,
+    on_stderr: Callable[[bytes], bool],
+) -> bytes:
+    """Run a command to completion, passing what it writes to stderr to a callback line by line.
+
+    Args:
+        cmd: Command and arguments
+        env: Environment of the command
+        description: Name of the command used in errors, e.g. 'pg_restore'
+        on_stderr: Called with every stderr line as it is written; lines it returns False for
+            are left out of what is returned and raised
+
+    Returns:
+        The stderr lines kept
+
+    Raises:
+        BackupError: If the command cannot be started or exits with an error
+    """
+    try:
+        process = subprocess.Popen(
+            cmd, env=env, stdin=subprocess.DEVNULL, stdout=subprocess.DEVNULL, stderr=subprocess.PIPE
+        )
+    except OSError as e:
+        raise BackupError(f"Failed to run {description}: {e}")
+
+    stderr: list[bytes] = []
+    try:
+        _drain(process.stderr, stderr, on_stderr)
+    finally:
+        process.stderr.close()
+        returncode = process.wait()
+
+    output = b"".join(stderr)
+    if returncode != 0:
+        error_msg = output.decode(errors="replace").strip() or f"exit status {returncode}"
+        raise BackupError(f"{description} failed: {error_msg}")
+    return output
+
+
+class IteratorReader(io.RawIOBase):
+    """Read-only file object over an iterator of byte chunks.
+
+    Chunks are pulled from the iterator only as they are read, so reading
+    drives the whole pipeline behind it. Reads return as many bytes as
+    asked for until the iterator is exhausted, so callers can cut the data
+    into fixed-size parts.
+    """
+
+    def __init__(self, chunks: Iterable[bytes]):
+        """Initialize the reader.
+
+        Args:
+            chunks: Byte chunks in order; exceptions raised by the iterator surface from read()
+        """
+        self.chunks = iter(chunks)
+        self.buffer = bytearray()
+        self.exhausted = False
+
+    def readable(self) -> bool:
+        return True
+
+    def read(self, size: int = -1) -> bytes:
+        while not self.exhausted and (size < 0 or len(self.buffer) < size):
+            try:
+                self.buffer += next(self.chunks)
+            except StopIteration:
+                self.exhausted = True
+
+        if size < 0:
+            size = len(self.buffer)
+        data = bytes(self.buffer[:size])
+        del self.buffer[:size]
+        return data
+
+    def readinto(self, buffer) -> int:
+        data = self.read(len(buffer))
+        buffer[: len(data)] = data
+        return len(data)
+
+    def close(self) -> None:
+        """Close the reader and the iterator, stopping a command still producing output."""
+        if not self.closed:
+            close = getattr(self.chunks, "close", None)
+            if close is not None:
+                close()
+        super().close()
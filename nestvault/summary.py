@@ -0,0 +1,128 @@
+"""Exit codes of NestVault, and the summary of a run that --summary-json writes for batch schedulers."""
+
+from __future__ import annotations
+
+import json
+import os
+import sys
+import threading
+from collections.abc import Mapping
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from pathlib import Path
+
+from nestvault.logging import get_logger
+from nestvault.notify.base import Notifier, RunResult
+
+logger = get_logger("summary")
+
+EXIT_SUCCESS = 0
+# A backup, or another operation, failed
+EXIT_FAILURE = 1
+# The configuration or command line is invalid, so nothing ran
+EXIT_USAGE = 2
+# Some targets of a run with several were backed up, others failed
+EXIT_PARTIAL = 3
+
+STATUSES = {EXIT_SUCCESS: "success", EXIT_FAILURE: "failure", EXIT_USAGE: "usage_error", EXIT_PARTIAL: "partial"}
+
+
+def exit_code(results: Mapping[str, bool]) -> int:
+    """Return the exit code of a backup of targets from whether each was backed up, by name."""
+    if all(results.values()):
+        return EXIT_SUCCESS
+    if len(results) > 1 and any(results.values()):
+        return EXIT_PARTIAL
+    return EXIT_FAILURE
+
+
+class SummaryCollector(Notifier):
+    """Collects the result of every backup job of a run, whatever its status, for the summary."""
+
+    name = "summary"
+
+    def __init__(self):
+        super().__init__("always")
+        self.lock = threading.Lock()
+        self.results: list[RunResult] = []
+
+    def send(self, result: RunResult) -> None:
+        with self.lock:
+            self.results.append(result)
+
+
+def _backup(result: RunResult) -> dict[str, object]:
+    return {
+        "database": result.database,
+        "status": result.status,
+        "backup_key": result.backup_key or None,
+        "size": result.size,
+        "duration": round(result.duration, 3) if result.duration is not None else None,
+        "error": result.error or None,
+        "finished_at": result.finished_at.isoformat(),
+    }
+
+
+@dataclass
+class RunSummary:
+    """What a run of NestVault did: the result of every target it backed up, or why it failed."""
+
+    command: str
+    started_at: datetime = field(default_factory=lambda: datetime.now(timezone.utc))
+    # Whether each target was backed up, by name; empty when the run backed up none
+    targets: dict[str, bool] = field(default_factory=dict)
+    collector: SummaryCollector = field(default_factory=SummaryCollector)
+    # Why the run failed, when it failed outside of a backup job, e.g. for an invalid configuration
+    error: str = ""
+
+    def _target(self, name: str, succeeded: bool) -> dict[str, object]:
+        results = [result for result in self.collector.results if result.target == name]
+        durations = [result.duration for result in results if result.duration is not None]
+        errors = [f"{result.database}: {result.error}" for result in results if result.error]
+        if not succeeded and not errors:
+            errors.append("not backed up, e.g. outside its backup window; see the log")
+        return {
+            "name": name,
+            # 'skipped' when another replica was backing the target up already
+            "status": ("success" if results else "skipped") if succeeded else "failure",
+            "size": sum(result.size or 0 for result in results if result.succeeded) if results else None,
+            "duration": round(sum(durations), 3) if durations else None,
+            "error": "; ".join(errors) or None,
+            "backups": [_backup(result) for result in results],
+        }
+
+    def to_dict(self, code: int) -> dict[str, object]:
+        """Return the summary document of the run ending with an exit code."""
+        finished_at = datetime.now(timezone.utc)
+        return {
+            "command": self.command,
+            "status": STATUSES.get(code, "failure"),
+            "exit_code": code,
+            "started_at": self.started_at.isoformat(),
+            "finished_at": finished_at.isoformat(),
+            "duration": round((finished_at - self.started_at).total_seconds(), 3),
+            "error": self.error or None,
+            "targets": [self._target(name, succeeded) for name, succeeded in self.targets.items()],
+        }
+
+
+def write_summary(path: str, document: dict[str, object]) -> None:
+    """Write a summary document to a file, replacing it atomically, or to stdout for '-'.
+
+    A summary that cannot be written is logged and never changes the
+    exit code, which tells the outcome of the run on its own.
+    """
+    text = json.dumps(document, indent=2) + "\n"
+    if path == "-":
+        sys.stdout.write(text)
+        sys.stdout.flush()
+        return
+
+    target = Path(path)
+    partial = target.with_name(f".{target.name}.partial")
+    try:
+        partial.write_text(text)
+        os.replace(partial, target)
+    except OSError as e:
+        logger.error(f"Failed to write the run summary to {path}: {e}")
+        partial.unlink(missing_ok=True)
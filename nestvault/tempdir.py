@@ -0,0 +1,84 @@
+"""The directory intermediate files are written to, and cleanup of what crashed runs left in it."""
+
+from __future__ import annotations
+
+import shutil
+import tempfile
+import time
+from collections.abc import Iterable
+from pathlib import Path
+
+from nestvault.exceptions import ConfigError
+from nestvault.logging import get_logger
+
+logger = get_logger("tempdir")
+
+# Prefix of every file and directory NestVault creates in the temp directory
+TEMP_PREFIX = "nestvault-"
+
+# Suffix of files still being written; they are renamed to their final name once complete
+PARTIAL_SUFFIX = ".partial"
+
+
+def partial_path(path: Path) -> Path:
+    """Return the name a file is written under until it is complete, e.g. 'db.sql.gz.partial'."""
+    return path.with_name(f"{path.name}{PARTIAL_SUFFIX}")
+
+
+def use_temp_dir(path: str) -> Path:
+    """Create the temp directory if needed and write every intermediate file of this process there.
+
+    A directory NestVault creates is only accessible to its own user, as
+    dumps hold the database's data.
+
+    Raises:
+        ConfigError: If the directory cannot be created
+    """
+    temp_dir = Path(path)
+    try:
+        if not temp_dir.is_dir():
+            temp_dir.mkdir(mode=0o700, parents=True)
+            logger.info(f"Created temp directory {temp_dir}")
+    except OSError as e:
+        raise ConfigError(f"Cannot create TEMP_DIR {temp_dir}: {e}")
+
+    # Every tempfile call made from now on, by NestVault or its libraries, writes here
+    tempfile.tempdir = str(temp_dir)
+    return temp_dir
+
+
+def sweep_orphans(temp_dir: Path, max_age_hours: int, keep: Iterable[str] = ()) -> list[Path]:
+    """Delete the files and directories crashed runs left in the temp directory.
+
+    Only entries named with NestVault's prefix and not modified for
+    max_age_hours are removed, so those of a running process, and interrupted
+    uploads young enough to resume, stay.
+
+    Args:
+        temp_dir: The temp directory
+        max_age_hours: Age beyond which an entry is considered orphaned
+        keep: Paths never to remove, e.g. the S3 upload state directory
+
+    Returns:
+        The removed paths
+    """
+    kept = {Path(path).resolve() for path in keep}
+    cutoff = time.time() - max_age_hours * 3600
+    removed = []
+
+    for entry in sorted(temp_dir.glob(f"{TEMP_PREFIX}*")):
+        try:
+            if entry.resolve() in kept or entry.lstat().st_mtime > cutoff:
+                continue
+            if entry.is_dir() and not entry.is_symlink():
+                shutil.rmtree(entry)
+            else:
+                entry.unlink()
+        except OSError as e:
+            logger.warning(f"Cannot remove orphaned {entry}: {e}")
+            continue
+
+        logger.info(f"Removed orphaned {entry}, left behind by a crashed run")
+        removed.append(entry)
+
+    return removed
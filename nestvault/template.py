@@ -0,0 +1,223 @@
+"""A subset of Go's text/template, for payloads rendered from a backup's result."""
+
+from __future__ import annotations
+
+import json
+import re
+from collections.abc import Callable, Collection
+from typing import Any
+
+# An action and its trim markers: '{{- ' trims the whitespace before it, ' -}}' the whitespace after it
+_ACTION = re.compile(r"\{\{(-\s)?\s*(.*?)\s*(\s-)?\}\}", re.DOTALL)
+_TOKEN = re.compile(r'"(?:[^"\\]|\\.)*"|[^\s|]+|\|')
+_NUMBER = re.compile(r"-?\d+(\.\d+)?")
+_PATH = re.compile(r"(\.[A-Za-z_][\w-]*)+|\.")
+
+# Fields of a backup's result templates can refer to; {{.}} is all of them
+RESULT_VARIABLES = (
+    "Target", "Database", "Status", "Succeeded", "Recovered", "Headline", "Error",
+    "Size", "RawSize", "Duration", "Phases", "BackupKey", "Labels", "FinishedAt",
+    "ConsecutiveFailures", "LastSuccess", "Streak",
+)
+
+
+def _truthy(value: Any) -> bool:
+    """Return whether Go templates treat a value as true: anything but false, 0, nil and empty values."""
+    return bool(value)
+
+
+def _eq(value: Any, *others: Any) -> bool:
+    return any(value == other for other in others)
+
+
+def _and(*values: Any) -> Any:
+    for value in values:
+        if not _truthy(value):
+            return value
+    return values[-1]
+
+
+def _or(*values: Any) -> Any:
+    for value in values:
+        if _truthy(value):
+            return value
+    return values[-1]
+
+
+FUNCTIONS: dict[str, Callable[..., Any]] = {
+    "and": _and,
+    "or": _or,
+    "not": lambda value: not _truthy(value),
+    "eq": _eq,
+    "ne": lambda value, other: value != other,
+    "len": len,
+    "json": lambda value: json.dumps(value, sort_keys=True),
+}
+
+
+def format_value(value: Any) -> str:
+    """Return how an action prints a value: nil as nothing, booleans and whole floats like Go, maps as JSON."""
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, float) and value.is_integer():
+        return str(int(value))
+    if isinstance(value, (dict, list)):
+        return json.dumps(value, sort_keys=True)
+    return str(value)
+
+
+class Template:
+    """A parsed template.
+
+    Supported are text, {{.Field}} and {{.Map.key}} actions, pipelines
+    such as {{.Error | json}}, {{if}}/{{else}}/{{end}}, comments, trim
+    markers, and the functions and, or, not, eq, ne, len and json. A nil
+    value prints nothing; pipe it to json to print null.
+
+    Args:
+        source: The template text
+        variables: Top-level fields the template may refer to; None allows any
+
+    Raises:
+        ValueError: If the template is malformed or refers to an unknown field
+    """
+
+    def __init__(self, source: str, variables: Collection[str] | None = None):
+        self.source = source
+        self.variables = variables
+        self.nodes = self._parse(source)
+
+    def _parse(self, source: str) -> list:
+        root: list = []
+        # Node lists being filled, innermost last, with the if node each belongs to
+        stack: list[tuple[list, list | None]] = [(root, None)]
+        position = 0
+        trim_next = False
+
+        for action in _ACTION.finditer(source):
+            text = source[position : action.start()]
+            if trim_next:
+                text = text.lstrip()
+            if action.group(1):
+                text = text.rstrip()
+            if "{{" in text or "}}" in text:
+                raise ValueError(f"unbalanced braces in {text!r}")
+            if text:
+                stack[-1][0].append(("text", text))
+            position, trim_next = action.end(), bool(action.group(3))
+
+            body = action.group(2)
+            if body.startswith("/*"):
+                if not body.endswith("*/"):
+                    raise ValueError(f"unterminated comment {action.group(0)}")
+                continue
+            keyword, _, rest = body.partition(" ")
+            if keyword == "if":
+                node = ["if", self._pipeline(rest), [], []]
+                stack[-1][0].append(node)
+                stack.append((node[2], node))
+            elif body == "else":
+                nodes, node = stack[-1]
+                if node is None or nodes is not node[2]:
+                    raise ValueError("{{else}} outside of an {{if}}")
+                stack[-1] = (node[3], node)
+            elif body == "end":
+                if len(stack) == 1:
+                    raise ValueError("{{end}} without an {{if}}")
+                stack.pop()
+            else:
+                stack[-1][0].append(("action", self._pipeline(body)))
+
+        text = source[position:]
+        if trim_next:
+            text = text.lstrip()
+        if "{{" in text or "}}" in text:
+            raise ValueError(f"unbalanced braces in {text!r}")
+        if text:
+            root.append(("text", text))
+        if len(stack) > 1:
+            raise ValueError("{{if}} without an {{end}}")
+        return root
+
+    def _pipeline(self, source: str) -> list[list[str]]:
+        """Split a pipeline into its commands, each a list of tokens."""
+        if not source:
+            raise ValueError("empty action")
+        commands: list[list[str]] = [[]]
+        for token in _TOKEN.findall(source):
+            if token == "|":
+                commands.append([])
+            else:
+                commands[-1].append(token)
+        for index, command in enumerate(commands):
+            if not command:
+                raise ValueError(f"empty command in pipeline: {source}")
+            if command[0] not in FUNCTIONS and (len(command) > 1 or index > 0):
+                raise ValueError(f"unknown function {command[0]!r} in: {source}")
+            for token in command[1:] if command[0] in FUNCTIONS else command:
+                self._check_argument(token)
+        return commands
+
+    def _check_argument(self, token: str) -> None:
+        if token.startswith('"'):
+            json.loads(token)
+        elif _PATH.fullmatch(token):
+            name = token[1:].split(".")[0]
+            if self.variables is not None and name and name not in self.variables:
+                raise ValueError(f"unknown variable {token}; use one of {', '.join(self.variables)}")
+        elif not (_NUMBER.fullmatch(token) or token in ("true", "false", "nil")):
+            raise ValueError(f"{token} is not a variable, string, number or function")
+
+    def _argument(self, token: str, data: dict) -> Any:
+        if token.startswith('"'):
+            return json.loads(token)
+        if token in ("true", "false"):
+            return token == "true"
+        if token == "nil":
+            return None
+        if _NUMBER.fullmatch(token):
+            return float(token) if "." in token else int(token)
+        value: Any = data
+        for name in token[1:].split(".") if token != "." else ():
+            if not isinstance(value, dict):
+                raise ValueError(f"{token}: cannot look up {name} in {format_value(value)!r}")
+            # As in Go, a missing key of a map is nil
+            value = value.get(name)
+        return value
+
+    def _evaluate(self, commands: list[list[str]], data: dict) -> Any:
+        value: Any = None
+        for index, command in enumerate(commands):
+            if command[0] not in FUNCTIONS:
+                value = self._argument(command[0], data)
+                continue
+            arguments = [self._argument(token, data) for token in command[1:]]
+            if index > 0:
+                arguments.append(value)
+            try:
+                value = FUNCTIONS[command[0]](*arguments)
+            except TypeError as e:
+                raise ValueError(f"{command[0]}: {e}")
+        return value
+
+    def _render(self, nodes: list, data: dict, out: list[str]) -> None:
+        for node in nodes:
+            if node[0] == "text":
+                out.append(node[1])
+            elif node[0] == "action":
+                out.append(format_value(self._evaluate(node[1], data)))
+            else:
+                _, condition, then, otherwise = node
+                self._render(then if _truthy(self._evaluate(condition, data)) else otherwise, data, out)
+
+    def render(self, data: dict) -> str:
+        """Render the template with data, a dict of fields.
+
+        Raises:
+            ValueError: If a field cannot be looked up or a function fails
+        """
+        out: list[str] = []
+        self._render(self.nodes, data, out)
+        return "".join(out)
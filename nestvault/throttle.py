@@ -0,0 +1,227 @@
+"""Bandwidth limits for transfers to and from storage."""
+
+from __future__ import annotations
+
+import io
+import threading
+import time
+from collections.abc import Callable
+from dataclasses import dataclass
+from datetime import datetime, timezone
+from typing import BinaryIO
+
+from nestvault.logging import get_logger
+
+logger = get_logger("throttle")
+
+MIB = 1024 * 1024
+
+# Seconds between measurements of the rate a limited transfer achieves
+RATE_INTERVAL = 30
+
+@dataclass(frozen=True)
+class BandwidthLimit:
+    """A transfer rate in bytes per second, applied at all times or only within some hours of the day (UTC)."""
+
+    rate: int
+    # (start, end) minutes of the day the limit applies in; empty for all day
+    windows: tuple[tuple[int, int], ...] = ()
+
+    def applies_at(self, moment: datetime) -> bool:
+        """Return whether the limit applies at a moment."""
+        if not self.windows:
+            return True
+        moment = moment.astimezone(timezone.utc)
+        # A window whose end is before its start runs past midnight
+        minute = moment.hour * 60 + moment.minute
+        return any(
+            start <= minute < end if start < end else minute >= start or minute < end
+            for start, end in self.windows
+        )
+
+
+class TokenBucket:
+    """Thread-safe token bucket refilled at a fixed rate of bytes per second.
+
+    A transfer larger than the bucket takes what is there and goes into
+    debt, and every caller waits until the debt before it is paid off. As
+    all workers draw from the same bucket, their combined rate stays at the
+    limit however many of them there are.
+    """
+
+    def __init__(
+        self,
+        rate: int,
+        clock: Callable[[], float] = time.monotonic,
+        sleep: Callable[[float], None] = time.sleep,
+    ):
+        """Initialize the bucket, full.
+
+        Args:
+            rate: Bytes per second, and the size of the bucket
+            clock: Monotonic clock in seconds
+            sleep: Function waiting a number of seconds
+        """
+        self.rate = rate
+        self.tokens = float(rate)
+        self.clock = clock
+        self.sleep = sleep
+        self.updated = clock()
+        self.lock = threading.Lock()
+
+    def consume(self, count: int) -> None:
+        """Take tokens for count bytes, waiting until the rate allows them."""
+        with self.lock:
+            now = self.clock()
+            self.tokens = min(float(self.rate), self.tokens + (now - self.updated) * self.rate)
+            self.updated = now
+            self.tokens -= count
+            wait = -self.tokens / self.rate if self.tokens < 0 else 0.0
+
+        if wait > 0:
+            self.sleep(wait)
+
+
+class Throttle:
+    """Limits the rate of one transfer direction and measures the rate it achieves.
+
+    Called with the size of every chunk before it is sent or written, from
+    any thread. While the limit applies, the rate achieved is logged and
+    kept in throughput at most every RATE_INTERVAL seconds.
+    """
+
+    def __init__(self, direction: str, limit: BandwidthLimit):
+        """Initialize the throttle.
+
+        Args:
+            direction: 'upload' or 'download', for the log
+            limit: Limit to apply
+        """
+        self.direction = direction
+        self.limit = limit
+        self.bucket = TokenBucket(limit.rate)
+        # Bytes per second of the last measured interval, 0 before one was measured
+        self.throughput = 0.0
+        self.measured = 0
+        self.measuring_since = time.monotonic()
+        self.lock = threading.Lock()
+
+    def __call__(self, count: int) -> None:
+        """Account for count bytes about to be transferred, waiting while the limit applies."""
+        if count <= 0 or not self.limit.applies_at(datetime.now(timezone.utc)):
+            return
+        self.bucket.consume(count)
+        self._measure(count)
+
+    def _measure(self, count: int) -> None:
+        with self.lock:
+            now = time.monotonic()
+            elapsed = now - self.measuring_since
+            if elapsed > 2 * RATE_INTERVAL:
+                # Nothing was transferred for a while; start measuring afresh
+                self.measured, self.measuring_since = count, now
+                return
+            self.measured += count
+            if elapsed < RATE_INTERVAL:
+                return
+            self.throughput = self.measured / elapsed
+            self.measured, self.measuring_since = 0, now
+
+        logger.info(
+            f"{self.direction.capitalize()} limited to {self.limit.rate / MIB:.1f} MiB/s, "
+            f"transferring at {self.throughput / MIB:.1f} MiB/s"
+        )
+
+
+def pace(throttle: Throttle | None, count: int) -> None:
+    """Wait as a throttle requires before transferring count bytes; return at once without one."""
+    if throttle is not None:
+        throttle(count)
+
+
+def cumulative(throttle: Throttle | None) -> Callable[[int, int], None] | None:
+    """Adapt a throttle to callbacks passed the bytes transferred so far and the total, like paramiko's."""
+    if throttle is None:
+        return None
+    state = {"done": 0}
+
+    def callback(transferred: int, total: int) -> None:
+        throttle(transferred - state["done"])
+        state["done"] = transferred
+
+    return callback
+
+
+class ThrottledReader(io.RawIOBase):
+    """File-like wrapper pacing reads from another stream."""
+
+    def __init__(self, stream: BinaryIO, throttle: Throttle | None):
+        self.stream = stream
+        self.throttle = throttle
+
+    def readable(self) -> bool:
+        return True
+
+    def read(self, size: int = -1) -> bytes:
+        data = self.stream.read(size)
+        if self.throttle is not None:
+            self.throttle(len(data))
+        return data
+
+    def readinto(self, buffer) -> int:
+        data = self.read(len(buffer))
+        buffer[: len(data)] = data
+        return len(data)
+
+    def close(self) -> None:
+        """Close the reader and the stream it reads from."""
+        if not self.closed:
+            self.stream.close()
+        super().close()
+
+
+class ThrottledWriter(io.RawIOBase):
+    """File-like wrapper pacing writes to another stream."""
+
+    def __init__(self, stream: BinaryIO, throttle: Throttle | None):
+        self.stream = stream
+        self.throttle = throttle
+
+    def writable(self) -> bool:
+        return True
+
+    def write(self, data) -> int:
+        if self.throttle is not None:
+            self.throttle(len(data))
+        return self.stream.write(data)
+
+
+def throttled_reader(stream: BinaryIO, throttle: Throttle | None) -> BinaryIO:
+    """Return a stream whose reads are paced by a throttle, or the stream itself without one."""
+    return stream if throttle is None else ThrottledReader(stream, throttle)
+
+
+def throttled_writer(stream: BinaryIO, throttle: Throttle | None) -> BinaryIO:
+    """Return a stream whose writes are paced by a throttle, or the stream itself without one."""
+    return stream if throttle is None else ThrottledWriter(stream, throttle)
+
+
+_shared: dict[tuple[str, BandwidthLimit], Throttle] = {}
+_shared_lock = threading.Lock()
+
+
+def shared_throttle(direction: str, rate: int | None, windows: list[tuple[int, int]]) -> Throttle | None:
+    """Return the process-wide throttle of a direction, shared by every target, destination and worker.
+
+    Args:
+        direction: 'upload' or 'download'
+        rate: Bytes per second, or None for unlimited transfers
+        windows: (start, end) minutes of the day the limit applies in; empty for all day
+    """
+    if rate is None:
+        return None
+    limit = BandwidthLimit(rate, tuple(windows))
+    with _shared_lock:
+        if (direction, limit) not in _shared:
+            _shared[(direction, limit)] = Throttle(direction, limit)
+        return _shared[(direction, limit)]
@@ -0,0 +1,130 @@
+"""Traces of backup runs, exported over OTLP when the standard OTEL_* environment variables configure it."""
+
+from __future__ import annotations
+
+import os
+from collections.abc import Iterator, Mapping
+from contextlib import contextmanager
+
+from nestvault.logging import get_logger
+
+logger = get_logger("tracing")
+
+# Exporter protocols the OTLP environment variables select
+OTLP_PROTOCOLS = ("http/protobuf", "grpc")
+
+_tracer = None
+
+
+def enabled(environ: Mapping[str, str] = os.environ) -> bool:
+    """Tell whether the environment configures an OTLP endpoint to export traces to.
+
+    Tracing is off unless OTEL_EXPORTER_OTLP_ENDPOINT or
+    OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, and stays off with
+    OTEL_SDK_DISABLED=true or OTEL_TRACES_EXPORTER=none.
+    """
+    if environ.get("OTEL_SDK_DISABLED", "").strip().lower() == "true":
+        return False
+    if environ.get("OTEL_TRACES_EXPORTER", "otlp").strip().lower() == "none":
+        return False
+    return bool(environ.get("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") or environ.get("OTEL_EXPORTER_OTLP_ENDPOINT"))
+
+
+def _protocol(environ: Mapping[str, str]) -> str:
+    protocol = environ.get("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL") or environ.get("OTEL_EXPORTER_OTLP_PROTOCOL")
+    return (protocol or OTLP_PROTOCOLS[0]).strip()
+
+
+def setup_tracing(environ: Mapping[str, str] = os.environ) -> bool:
+    """Start exporting spans over OTLP when the environment configures it, returning whether it does.
+
+    The exporter reads its endpoint, headers, timeout and certificates
+    from the OTEL_EXPORTER_OTLP_* variables itself, and the service
+    name from OTEL_SERVICE_NAME, 'nestvault' by default. Spans are
+    exported in batches in the background, and flushed on exit.
+    """
+    global _tracer
+    if not enabled(environ):
+        return False
+
+    protocol = _protocol(environ)
+    if protocol not in OTLP_PROTOCOLS:
+        logger.warning(f"Tracing disabled: unknown OTLP protocol '{protocol}', use one of {', '.join(OTLP_PROTOCOLS)}")
+        return False
+
+    try:
+        from opentelemetry.sdk.resources import Resource
+        from opentelemetry.sdk.trace import TracerProvider
+        from opentelemetry.sdk.trace.export import BatchSpanProcessor
+
+        if protocol == "grpc":
+            from opentelemetry.exporter.otlp.proto.grpc.trace_exporter import OTLPSpanExporter
+        else:
+            from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+    except ImportError as e:
+        logger.warning(f"Tracing disabled: the OpenTelemetry SDK or its OTLP {protocol} exporter is missing: {e}")
+        return False
+
+    resource = Resource.create({"service.name": environ.get("OTEL_SERVICE_NAME", "nestvault")})
+    provider = TracerProvider(resource=resource)
+    provider.add_span_processor(BatchSpanProcessor(OTLPSpanExporter()))
+    _tracer = provider.get_tracer("nestvault")
+    logger.info(f"Exporting traces over OTLP ({protocol})")
+    return True
+
+
+def _attributes(attributes: dict[str, object]) -> dict[str, object]:
+    """Name attributes in the nestvault namespace, leaving out unset ones."""
+    return {f"nestvault.{name}": value for name, value in attributes.items() if value is not None}
+
+
+class Span:
+    """A span of a trace, or a stand-in doing nothing while tracing is off."""
+
+    def __init__(self, span=None):
+        self._span = span
+
+    def set(self, **attributes: object) -> None:
+        """Set attributes, e.g. byte counts once they are known; None values are left out."""
+        if self._span is not None:
+            self._span.set_attributes(_attributes(attributes))
+
+    def fail(self, error: BaseException | str) -> None:
+        """Mark the span as failed, recording the exception when there is one."""
+        if self._span is None:
+            return
+        from opentelemetry.trace import Status, StatusCode
+
+        if isinstance(error, BaseException):
+            self._span.record_exception(error)
+        self._span.set_status(Status(StatusCode.ERROR, str(error)))
+
+    def end(self) -> None:
+        """End a span started with start_span()."""
+        if self._span is not None:
+            self._span.end()
+
+
+@contextmanager
+def span(name: str, **attributes: object) -> Iterator[Span]:
+    """Trace a block as a child of the current span, or as a new trace outside of any.
+
+    An exception leaving the block is recorded on the span, which is
+    marked as failed; set other errors with Span.fail().
+    """
+    if _tracer is None:
+        yield Span()
+        return
+    with _tracer.start_as_current_span(name, attributes=_attributes(attributes)) as current:
+        yield Span(current)
+
+
+def start_span(name: str, **attributes: object) -> Span:
+    """Start a child of the current span that is ended with Span.end(), possibly from another thread.
+
+    The span does not become the current one, so it suits work that
+    outlives the block starting it, like parts uploaded by a pool.
+    """
+    if _tracer is None:
+        return Span()
+    return Span(_tracer.start_span(name, attributes=_attributes(attributes)))
@@ -0,0 +1,229 @@
+"""SSH tunnels through a jump host to database servers that are only reachable from it."""
+
+from __future__ import annotations
+
+import base64
+import hashlib
+import os
+import socket
+import subprocess
+import tempfile
+import time
+from collections.abc import Iterator
+from contextlib import contextmanager
+
+from nestvault.backup.base import BackupAdapter
+from nestvault.config import SshTunnelConfig
+from nestvault.exceptions import TunnelError
+from nestvault.logging import get_logger
+
+logger = get_logger("tunnel")
+
+# Keepalives the jump host may leave unanswered in a row before ssh closes the tunnel
+KEEPALIVE_COUNT_MAX = 3
+
+# Seconds between checks whether the forwarded port accepts connections yet
+READY_POLL_INTERVAL = 0.2
+
+# Seconds ssh is given to exit once asked to before it is killed
+STOP_TIMEOUT = 5
+
+
+def fingerprint(key: str) -> str:
+    """Return the SHA256 fingerprint of a base64 encoded public key, as ssh-keygen -l prints it.
+
+    Raises:
+        ValueError: If the key is not valid base64
+    """
+    digest = hashlib.sha256(base64.b64decode(key, validate=True)).digest()
+    return "SHA256:" + base64.b64encode(digest).decode().rstrip("=")
+
+
+def _free_port() -> int:
+    """Return a local port nothing listens on, for ssh to forward."""
+    with socket.socket() as sock:
+        sock.bind(("127.0.0.1", 0))
+        return sock.getsockname()[1]
+
+
+class SshTunnel:
+    """Forwards a local port through an SSH jump host to a database server while it is open.
+
+    ssh runs in batch mode, so it fails instead of prompting, and exits
+    when the forward cannot be set up. The jump host's key must be listed
+    in the configured known_hosts file or have the pinned fingerprint;
+    a host key seen for the first time is never accepted.
+    """
+
+    def __init__(self, config: SshTunnelConfig, remote_host: str, remote_port: int):
+        """Initialize the SSH tunnel.
+
+        Args:
+            config: Jump host, login and host key pinning
+            remote_host: Database server the tunnel forwards to, as the jump host resolves it
+            remote_port: Port of the database server
+        """
+        self.config = config
+        self.remote_host = remote_host
+        self.remote_port = remote_port
+
+    @property
+    def jump_host(self) -> str:
+        return f"{self.config.user}@{self.config.host}:{self.config.port}"
+
+    def command(self, local_port: int, known_hosts_file: str) -> list[str]:
+        """Build the ssh command line forwarding a local port to the database server."""
+        config = self.config
+        remote_host = f"[{self.remote_host}]" if ":" in self.remote_host else self.remote_host
+        cmd = [
+            "ssh", "-N",
+            "-o", "BatchMode=yes",
+            "-o", "ExitOnForwardFailure=yes",
+            "-o", "StrictHostKeyChecking=yes",
+            "-o", f"UserKnownHostsFile={known_hosts_file}",
+            "-o", "GlobalKnownHostsFile=/dev/null",
+            "-o", f"ConnectTimeout={config.connect_timeout_seconds}",
+            "-o", f"ServerAliveInterval={config.keepalive_seconds}",
+            "-o", f"ServerAliveCountMax={KEEPALIVE_COUNT_MAX}",
+            "-o", "LogLevel=ERROR",
+            "-p", str(config.port),
+            "-l", config.user,
+            "-L", f"127.0.0.1:{local_port}:{remote_host}:{self.remote_port}",
+        ]
+        if config.key_file is not None:
+            cmd += ["-i", config.key_file, "-o", "IdentitiesOnly=yes"]
+        return [*cmd, config.host]
+
+    def _pinned_known_hosts(self, directory: str) -> str:
+        """Write the jump host's keys that have the pinned fingerprint to a known_hosts file, returning its path.
+
+        Raises:
+            TunnelError: If the jump host cannot be reached or has no key with the fingerprint
+        """
+        config = self.config
+        timeout = config.connect_timeout_seconds
+        cmd = ["ssh-keyscan", "-p", str(config.port), "-T", str(timeout), config.host]
+        try:
+            result = subprocess.run(cmd, capture_output=True, timeout=timeout + STOP_TIMEOUT)
+        except (OSError, subprocess.TimeoutExpired) as e:
+            raise TunnelError(f"Failed to scan the host keys of jump host {config.host}: {e}")
+
+        keys = [line.split() for line in result.stdout.decode(errors="replace").splitlines()]
+        keys = [key for key in keys if len(key) == 3 and not key[0].startswith("#")]
+        if not keys:
+            stderr = result.stderr.decode(errors="replace").strip()
+            reason = f": {stderr}" if stderr else ""
+            raise TunnelError(f"Jump host {config.host}:{config.port} is not reachable{reason}")
+        pinned = []
+        for key in keys:
+            try:
+                if fingerprint(key[2]) == config.host_key_fingerprint:
+                    pinned.append(" ".join(key))
+            except ValueError:
+                continue
+        if not pinned:
+            raise TunnelError(
+                f"Jump host {config.host} has no host key with the fingerprint {config.host_key_fingerprint}, "
+                "refusing to connect"
+            )
+
+        path = os.path.join(directory, "known_hosts")
+        with open(path, "w") as f:
+            f.write("\n".join(pinned) + "\n")
+        return path
+
+    def _wait_ready(self, process: subprocess.Popen, local_port: int) -> None:
+        """Wait until ssh has logged in and listens on the forwarded port.
+
+        The probe connections go through to the database server, which
+        may log them as connections without a startup packet.
+
+        Raises:
+            TunnelError: If ssh exits or the port does not open in time
+        """
+        # ssh's own connect timeout plus time to log in and set up the forward
+        deadline = time.monotonic() + 2 * self.config.connect_timeout_seconds
+        while True:
+            if process.poll() is not None:
+                raise TunnelError(f"SSH tunnel through {self.jump_host} failed: {_stderr(process)}")
+            try:
+                with socket.create_connection(("127.0.0.1", local_port), timeout=1):
+                    return
+            except OSError:
+                pass
+            if time.monotonic() > deadline:
+                raise TunnelError(f"SSH tunnel through {self.jump_host} did not open in time")
+            time.sleep(READY_POLL_INTERVAL)
+
+    @contextmanager
+    def open(self) -> Iterator[int]:
+        """Open the tunnel for the length of the context, yielding the local port it forwards.
+
+        Raises:
+            TunnelError: If ssh cannot reach the jump host, log in or set up the forward
+        """
+        with tempfile.TemporaryDirectory(prefix="nestvault-ssh-") as scratch:
+            known_hosts_file = self.config.known_hosts_file or self._pinned_known_hosts(scratch)
+            local_port = _free_port()
+            try:
+                process = subprocess.Popen(
+                    self.command(local_port, known_hosts_file),
+                    stdin=subprocess.DEVNULL,
+                    stdout=subprocess.DEVNULL,
+                    stderr=subprocess.PIPE,
+                )
+            except OSError as e:
+                raise TunnelError(f"Failed to start ssh: {e}")
+
+            try:
+                self._wait_ready(process, local_port)
+            except TunnelError:
+                _stop(process)
+                raise
+            logger.info(
+                f"Opened SSH tunnel through {self.jump_host} to {self.remote_host}:{self.remote_port} "
+                f"on local port {local_port}"
+            )
+
+            try:
+                yield local_port
+            finally:
+                # A tunnel lost mid-run, e.g. to unanswered keepalives, makes the run fail like a database that is down
+                if process.poll() is not None:
+                    logger.error(f"SSH tunnel through {self.jump_host} closed during the run: {_stderr(process)}")
+                _stop(process)
+
+
+def _stderr(process: subprocess.Popen) -> str:
+    """Return the last line ssh wrote to stderr before it exited, or its exit code if it wrote none."""
+    lines = process.stderr.read().decode(errors="replace").strip().splitlines() if process.stderr else []
+    return lines[-1] if lines else f"ssh exited with code {process.returncode}"
+
+
+def _stop(process: subprocess.Popen) -> None:
+    """Close a tunnel, killing ssh if it does not exit when asked to."""
+    if process.poll() is None:
+        process.terminate()
+        try:
+            process.wait(STOP_TIMEOUT)
+        except subprocess.TimeoutExpired:
+            process.kill()
+            process.wait()
+    if process.stderr is not None:
+        process.stderr.close()
+
+
+@contextmanager
+def tunneled(tunnel: SshTunnel, backup_adapter: BackupAdapter) -> Iterator[int]:
+    """Connect an adapter to its database through an SSH tunnel open for the length of the context.
+
+    Raises:
+        TunnelError: If the tunnel cannot be opened
+        BackupError: If the adapter's engine cannot connect through a tunnel
+    """
+    with tunnel.open() as port:
+        backup_adapter.use_tunnel(port)
+        try:
+            yield port
+        finally:
+            backup_adapter.use_tunnel(None)
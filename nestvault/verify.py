@@ -0,0 +1,206 @@
+"""SHA-256 checksums of backups and their verification against storage."""
+
+from __future__ import annotations
+
+import hashlib
+import io
+import tempfile
+from collections.abc import Callable
+from dataclasses import dataclass
+from pathlib import Path
+from typing import BinaryIO, Literal
+
+from nestvault.exceptions import IntegrityError
+from nestvault.logging import get_logger
+from nestvault.storage.base import StorageAdapter
+
+logger = get_logger("verify")
+
+CHUNK_SIZE = 1024 * 1024
+# Ranges read by a quick verification, spread evenly over the object
+SAMPLE_COUNT = 8
+SAMPLE_SIZE = 64 * 1024
+
+VerifyStatus = Literal["verified", "corrupt", "unverifiable"]
+
+
+@dataclass
+class VerifyResult:
+    """Outcome of verifying one backup."""
+
+    key: str
+    status: VerifyStatus
+    detail: str = ""
+
+
+def file_sha256(path: Path) -> str:
+    """Return the hex SHA-256 of a file."""
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        while chunk := f.read(CHUNK_SIZE):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+def checksum_metadata(path: Path) -> dict[str, str]:
+    """Return the size and SHA-256 of a file as they are recorded with its object."""
+    return {"size": str(path.stat().st_size), "sha256": file_sha256(path)}
+
+
+class ChecksumReader(io.RawIOBase):
+    """File-like wrapper computing the size and SHA-256 of what is read from another stream."""
+
+    def __init__(self, stream: BinaryIO):
+        self.stream = stream
+        self.digest = hashlib.sha256()
+        self.size = 0
+
+    def readable(self) -> bool:
+        return True
+
+    def read(self, size: int = -1) -> bytes:
+        data = self.stream.read(size)
+        self.digest.update(data)
+        self.size += len(data)
+        return data
+
+    def readinto(self, buffer) -> int:
+        data = self.read(len(buffer))
+        buffer[: len(data)] = data
+        return len(data)
+
+    def drain(self) -> None:
+        """Read what the consumer left unread, e.g. padding after the end of a dump, so the whole stream is hashed."""
+        while self.read(CHUNK_SIZE):
+            pass
+
+    def close(self) -> None:
+        """Close the reader and the stream it reads from."""
+        if not self.closed:
+            self.stream.close()
+        super().close()
+
+
+def check_download(local_file: Path, metadata: dict[str, str], key: str) -> bool:
+    """Compare a downloaded backup with the checksum recorded at upload.
+
+    Args:
+        local_file: Downloaded copy of the backup
+        metadata: Metadata stored with the backup
+        key: Key of the backup, for messages
+
+    Returns:
+        True if the checksum matched, False if the backup has none to compare with
+
+    Raises:
+        IntegrityError: If the size or checksum does not match
+    """
+    return _check(key, metadata, local_file.stat().st_size, lambda: file_sha256(local_file))
+
+
+def check_stream(reader: ChecksumReader, metadata: dict[str, str], key: str) -> bool:
+    """Compare a backup read from storage as a stream with the checksum recorded at upload.
+
+    Unread data is read first, so the whole object is compared.
+
+    Returns:
+        True if the checksum matched, False if the backup has none to compare with
+
+    Raises:
+        IntegrityError: If the size or checksum does not match
+    """
+    reader.drain()
+    return _check(key, metadata, reader.size, reader.digest.hexdigest)
+
+
+def _check(key: str, metadata: dict[str, str], size: int, sha256: Callable[[], str]) -> bool:
+    """Compare a backup's size, then its SHA-256, with those recorded at upload."""
+    expected = metadata.get("sha256")
+    if expected is None:
+        logger.warning(f"{key} has no recorded checksum (uploaded by an older NestVault), it cannot be verified")
+        return False
+
+    if "size" in metadata and size != int(metadata["size"]):
+        raise IntegrityError(f"{key} is {size} bytes, but {metadata['size']} bytes were uploaded")
+
+    actual = sha256()
+    if actual != expected:
+        raise IntegrityError(f"Checksum mismatch for {key}: expected sha256 {expected}, got {actual}")
+
+    logger.info(f"Checksum verified: {key}")
+    return True
+
+
+def _sample_offsets(size: int) -> list[int]:
+    """Return the start of every range a quick verification reads, the last one ending the object."""
+    if size <= SAMPLE_COUNT * SAMPLE_SIZE:
+        return list(range(0, size, SAMPLE_SIZE))
+    return [index * (size - SAMPLE_SIZE) // (SAMPLE_COUNT - 1) for index in range(SAMPLE_COUNT)]
+
+
+def _quick_verify(storage_adapter: StorageAdapter, key: str, metadata: dict[str, str]) -> VerifyResult:
+    """Check a backup's stored size and read samples of it, without downloading it."""
+    expected = int(metadata["size"])
+    listed = next((obj for obj in storage_adapter.list(prefix=key) if obj.key == key), None)
+    if listed is None:
+        return VerifyResult(key, "corrupt", "object is missing")
+    if listed.size != expected:
+        return VerifyResult(key, "corrupt", f"object is {listed.size} bytes, but {expected} bytes were uploaded")
+
+    if not storage_adapter.supports_range_reads:
+        return VerifyResult(key, "verified", "size only, the storage cannot read ranges")
+
+    for offset in _sample_offsets(expected):
+        length = min(SAMPLE_SIZE, expected - offset)
+        data = storage_adapter.read_range(key, offset, length)
+        if len(data) != length:
+            return VerifyResult(key, "corrupt", f"read {len(data)} of {length} bytes at offset {offset}")
+
+    return VerifyResult(key, "verified", "size and sampled ranges")
+
+
+def verify_backup(storage_adapter: StorageAdapter, key: str, quick: bool = False) -> VerifyResult:
+    """Verify a stored backup against the size and checksum recorded at upload.
+
+    A full verification downloads the backup and compares its SHA-256. A
+    quick one compares the stored size and reads sampled ranges, which
+    catches truncated or unreadable objects, but not flipped bits.
+
+    Args:
+        storage_adapter: Storage adapter holding the backup
+        key: Key of the backup
+        quick: Sample the backup instead of downloading it
+
+    Returns:
+        Result of the verification; backups uploaded without a checksum are unverifiable
+
+    Raises:
+        StorageError: If the backup cannot be read
+    """
+    metadata = storage_adapter.get_metadata(key)
+    if "sha256" not in metadata or "size" not in metadata:
+        return VerifyResult(key, "unverifiable", "no checksum was recorded at upload")
+
+    if quick:
+        return _quick_verify(storage_adapter, key, metadata)
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / Path(key).name
+        storage_adapter.download(key, local_file)
+        try:
+            check_download(local_file, metadata, key)
+        except IntegrityError as e:
+            return VerifyResult(key, "corrupt", str(e))
+
+    return VerifyResult(key, "verified", "sha256")
+
+
+def log_result(result: VerifyResult) -> None:
+    """Log the outcome of a verification at the level it deserves."""
+    if result.status == "verified":
+        logger.info(f"Verified {result.key} ({result.detail})")
+    elif result.status == "unverifiable":
+        logger.warning(f"Unverifiable {result.key}: {result.detail}")
+    else:
+        logger.error(f"Corrupt {result.key}: {result.detail}")
+
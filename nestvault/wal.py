@@ -0,0 +1,220 @@
+"""Continuous archiving of PostgreSQL WAL segments next to physical base backups."""
+
+from __future__ import annotations
+
+import re
+import shutil
+import tempfile
+from pathlib import Path
+
+from nestvault.compression import compressed_extension, decompressed_name, open_reader, open_writer
+from nestvault.config import CompressionConfig
+from nestvault.encryption import Cipher, decrypted_name, encrypted_name
+from nestvault.exceptions import StorageError
+from nestvault.logging import get_logger
+from nestvault.manifest import list_backups
+from nestvault.storage.base import StorageAdapter, StorageObject
+from nestvault.verify import check_download, checksum_metadata, file_sha256
+
+logger = get_logger("wal")
+
+# Key prefix WAL is archived under, next to the base backups
+WAL_PREFIX = "wal/"
+
+# Segments, with the .partial and .backup files PostgreSQL archives too, and timeline history files
+SEGMENT_PATTERN = re.compile(r"[0-9A-F]{24}(\.partial|\.[0-9A-F]{8}\.backup)?")
+HISTORY_PATTERN = re.compile(r"[0-9A-F]{8}\.history")
+
+
+def is_wal_file(name: str) -> bool:
+    """Check whether a file name is one PostgreSQL hands to archive_command."""
+    return SEGMENT_PATTERN.fullmatch(name) is not None or HISTORY_PATTERN.fullmatch(name) is not None
+
+
+def wal_file_of(key: str) -> str:
+    """Return the WAL file an archived key holds, e.g. 'wal/<segment>.gz.age' -> '<segment>'."""
+    return decompressed_name(decrypted_name(Path(key).name))
+
+
+def wal_key(name: str, compression: CompressionConfig, cipher: Cipher | None = None) -> str:
+    """Return the key a WAL file is archived under."""
+    key = f"{WAL_PREFIX}{compressed_extension(name, compression)}"
+    return encrypted_name(key, cipher.mode) if cipher is not None else key
+
+
+def push_wal(
+    storage_adapter: StorageAdapter,
+    wal_path: Path,
+    compression: CompressionConfig,
+    cipher: Cipher | None = None,
+) -> str:
+    """Compress, optionally encrypt, and upload one WAL file; the archive_command target.
+
+    PostgreSQL retries archiving a file until the command succeeds, and may
+    retry one that was already uploaded. Pushing a file whose identical copy
+    is archived succeeds without uploading it again; one whose archived copy
+    differs is refused, so a second cluster writing to the same prefix cannot
+    overwrite the first's history.
+
+    Args:
+        storage_adapter: Storage adapter to archive to
+        wal_path: WAL file PostgreSQL asks to archive (%p)
+        compression: Compression to apply
+        cipher: Cipher to encrypt with, or None to upload plaintext
+
+    Returns:
+        Key the file was archived under
+
+    Raises:
+        StorageError: If the file is not a WAL file, differs from its archived copy, or the upload fails
+        BackupError: If compression or encryption fails
+    """
+    name = wal_path.name
+    if not is_wal_file(name):
+        raise StorageError(f"{name} is not a WAL segment or history file")
+
+    key = wal_key(name, compression, cipher)
+    try:
+        wal_sha256 = file_sha256(wal_path)
+    except OSError as e:
+        raise StorageError(f"Failed to read {wal_path}: {e}")
+
+    if any(obj.key == key for obj in storage_adapter.list(prefix=key)):
+        archived = storage_adapter.get_metadata(key).get("wal_sha256")
+        if archived == wal_sha256:
+            logger.info(f"WAL file {name} is already archived")
+            return key
+        raise StorageError(f"{key} is already archived with different contents, refusing to overwrite it")
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / compressed_extension(name, compression)
+        try:
+            with open(wal_path, "rb") as source, open_writer(local_file, compression) as destination:
+                shutil.copyfileobj(source, destination)
+        except OSError as e:
+            raise StorageError(f"Failed to compress {name}: {e}")
+
+        metadata = {"engine": "postgres", "wal": name, "wal_sha256": wal_sha256}
+        if compression.algorithm != "none":
+            metadata["compression"] = compression.algorithm
+
+        if cipher is not None:
+            encrypted = local_file.with_name(encrypted_name(local_file.name, cipher.mode))
+            metadata.update(cipher.encrypt(local_file, encrypted), encryption=cipher.mode)
+            local_file = encrypted
+
+        storage_adapter.upload(local_file, key, metadata={**metadata, **checksum_metadata(local_file)})
+
+    logger.info(f"WAL file archived: {key}")
+    return key
+
+
+def fetch_wal(
+    storage_adapter: StorageAdapter,
+    name: str,
+    destination: Path,
+    cipher: Cipher | None = None,
+) -> None:
+    """Download one archived WAL file, verify, decrypt and decompress it; the restore_command target.
+
+    Args:
+        storage_adapter: Storage adapter the WAL was archived to
+        name: WAL file PostgreSQL asks for (%f)
+        destination: Path to write the WAL file to (%p)
+        cipher: Cipher to decrypt with, required for encrypted WAL
+
+    Raises:
+        StorageError: If the file is not archived or cannot be downloaded
+        IntegrityError: If the download does not match its recorded checksum
+        BackupError: If decryption or decompression fails
+    """
+    objects = storage_adapter.list(prefix=f"{WAL_PREFIX}{name}")
+    key = next((obj.key for obj in objects if wal_file_of(obj.key) == name), None)
+    if key is None:
+        raise StorageError(f"WAL file {name} is not archived")
+
+    metadata = storage_adapter.get_metadata(key)
+
+    with tempfile.TemporaryDirectory() as temp_dir:
+        local_file = Path(temp_dir) / Path(key).name
+        storage_adapter.download(key, local_file)
+        check_download(local_file, metadata, key)
+
+        if "encryption" in metadata:
+            if cipher is None or cipher.mode != metadata["encryption"]:
+                raise StorageError(f"{key} is encrypted with {metadata['encryption']}, set ENCRYPTION to fetch it")
+            plaintext = local_file.with_name(decrypted_name(local_file.name))
+            cipher.decrypt(local_file, plaintext, metadata)
+            local_file = plaintext
+
+        partial = destination.with_name(f".{destination.name}.partial")
+        try:
+            with open_reader(local_file, metadata.get("compression", "none")) as source, open(partial, "wb") as target:
+                shutil.copyfileobj(source, target)
+            partial.replace(destination)
+        except OSError as e:
+            partial.unlink(missing_ok=True)
+            raise StorageError(f"Failed to write {destination}: {e}")
+
+    logger.info(f"WAL file fetched: {name}")
+
+
+def archived_segments(storage_adapter: StorageAdapter) -> list[StorageObject]:
+    """List archived WAL segments in WAL order, leaving out timeline history files."""
+    segments = [obj for obj in storage_adapter.list(prefix=WAL_PREFIX) if SEGMENT_PATTERN.match(wal_file_of(obj.key))]
+    return sorted(segments, key=lambda obj: (wal_file_of(obj.key)[8:], wal_file_of(obj.key)))
+
+
+def oldest_required_segment(
+    storage_adapter: StorageAdapter,
+    database_name: str,
+    prefix: str | None = None,
+) -> str | None:
+    """Return the first WAL segment any retained base backup needs, or None when none records one.
+
+    Base backups taken with archiving enabled record the segment their WAL
+    starts at; the WAL belonging to each runs from there up to the start of
+    the next base backup.
+    """
+    starts = [
+        manifest.metadata["wal_start"]
+        for manifest in list_backups(storage_adapter, database_name, prefix)
+        if "wal_start" in manifest.metadata
+    ]
+    return min(starts, key=lambda segment: segment[8:]) if starts else None
+
+
+def prune_wal(storage_adapter: StorageAdapter, database_name: str, prefix: str | None = None) -> int:
+    """Delete archived WAL that no retained base backup needs anymore.
+
+    Like pg_archivecleanup, segments are compared by position regardless of
+    timeline, so a segment at or after the oldest retained base backup's
+    start is kept on every timeline. Timeline history files are always kept.
+    Run this after retention has deleted expired base backups.
+
+    Args:
+        storage_adapter: Storage adapter holding the base backups and WAL
+        database_name: Database the base backups are named after
+        prefix: Key prefix the base backups are listed under, by default the database name
+
+    Returns:
+        Number of WAL files deleted
+
+    Raises:
+        StorageError: If listing or deleting fails
+    """
+    oldest = oldest_required_segment(storage_adapter, database_name, prefix)
+    if oldest is None:
+        logger.info("No retained base backup records its WAL start, keeping all archived WAL")
+        return 0
+
+    expired = []
+    for obj in storage_adapter.list(prefix=WAL_PREFIX):
+        name = wal_file_of(obj.key)
+        if SEGMENT_PATTERN.match(name) and name[8:24] < oldest[8:]:
+            expired.append(obj.key)
+
+    if expired:
+        storage_adapter.delete_many(expired)
+        logger.info(f"Deleted {len(expired)} WAL files older than {oldest}")
+    return len(expired)
@@ -0,0 +1,166 @@
+"""Backup windows, the hours of the day backups may run in, and the longest a backup may take."""
+
+from __future__ import annotations
+
+import os
+import signal
+import threading
+import time
+from collections.abc import Iterator
+from contextlib import contextmanager
+from contextvars import ContextVar
+from dataclasses import dataclass
+from datetime import datetime, timedelta, timezone, tzinfo
+from pathlib import Path
+
+from nestvault.exceptions import BackupError
+from nestvault.logging import get_logger
+
+logger = get_logger("window")
+
+
+def _clock(minute: int) -> str:
+    return f"{minute // 60:02d}:{minute % 60:02d}"
+
+
+@dataclass(frozen=True)
+class BackupWindow:
+    """Hours of the day backups of a target may start in, in the target's timezone."""
+
+    # (start, end) minutes of the day; a window whose end is before its start runs past midnight
+    windows: tuple[tuple[int, int], ...]
+    tz: tzinfo = timezone.utc
+
+    def _at(self, day: datetime, minute: int) -> datetime:
+        """Return a minute of a local day as a UTC time; 24:00 is midnight at the day's end."""
+        local = datetime(day.year, day.month, day.day) + timedelta(minutes=minute)
+        return local.replace(tzinfo=self.tz).astimezone(timezone.utc)
+
+    def contains(self, moment: datetime) -> bool:
+        """Return whether a moment falls in one of the windows."""
+        local = moment.astimezone(self.tz)
+        minute = local.hour * 60 + local.minute
+        return any(
+            start <= minute < end if start < end else minute >= start or minute < end
+            for start, end in self.windows
+        )
+
+    def opens_after(self, moment: datetime) -> datetime:
+        """Return the next time a window opens after a moment outside every window."""
+        day = moment.astimezone(self.tz)
+        return min(
+            opening
+            for offset in range(2)
+            for start, _ in self.windows
+            if (opening := self._at(day + timedelta(days=offset), start)) > moment
+        )
+
+    def closes_after(self, moment: datetime) -> datetime:
+        """Return when the window a moment falls in closes; the latest close of overlapping windows."""
+        day = moment.astimezone(self.tz)
+        closings = []
+        for start, end in self.windows:
+            # A window past midnight may have opened the day before
+            for date in (day - timedelta(days=1), day):
+                closing = self._at(date, end if start < end else end + 24 * 60)
+                if self._at(date, start) <= moment < closing:
+                    closings.append(closing)
+        return max(closings, default=moment)
+
+    def describe(self) -> str:
+        """Return e.g. '01:00-05:00 (Europe/Berlin)'."""
+        return f"{', '.join(f'{_clock(start)}-{_clock(end)}' for start, end in self.windows)} ({self.tz})"
+
+
+# Monotonic time the backup under way in this context must finish by, with its maximum runtime
+_deadline: ContextVar[tuple[float, timedelta] | None] = ContextVar("backup_deadline", default=None)
+
+
+def _children(thread_id: int) -> list[int]:
+    """Return the processes a thread of this process started that still run; none where /proc cannot tell."""
+    try:
+        return [int(pid) for pid in Path(f"/proc/{os.getpid()}/task/{thread_id}/children").read_text().split()]
+    except (OSError, ValueError):
+        return []
+
+
+def terminate_children(thread_id: int) -> int:
+    """Terminate the processes a thread of this process started, e.g. a run's dump tool, returning how many."""
+    children = _children(thread_id)
+    for pid in children:
+        try:
+            os.kill(pid, signal.SIGTERM)
+        except ProcessLookupError:
+            pass
+    return len(children)
+
+
+def _cancel(name: str, max_runtime: timedelta, thread_id: int) -> None:
+    """Terminate the processes a run started once it exceeded its maximum runtime."""
+    terminated = terminate_children(thread_id)
+    logger.error(
+        f"Target '{name}': exceeded its maximum runtime of {max_runtime.total_seconds():.0f}s, cancelling it"
+        f"{f' and terminating {terminated} processes it started' if terminated else ''}"
+    )
+
+
+@contextmanager
+def supervising(name: str, window: BackupWindow | None, max_runtime: timedelta | None) -> Iterator[None]:
+    """Log a backup run within the block that overruns its window, and cancel it past its maximum runtime.
+
+    A run that started in its window may finish after the window closed;
+    that is logged when the window closes and once the run is done. Past
+    its maximum runtime, the processes the run started in this thread are
+    terminated, which fails the dump under way, and check_runtime stops it
+    before it goes on to the next step.
+
+    Args:
+        name: Name of the run, e.g. 'billing/hourly'
+        window: Backup window the run started in, None for none
+        max_runtime: Longest the run may take, None for no limit
+    """
+    timers = []
+    started = datetime.now(timezone.utc)
+    closes = window.closes_after(started) if window is not None and window.contains(started) else None
+    if closes is not None:
+        timers.append(
+            threading.Timer(
+                (closes - started).total_seconds(),
+                lambda: logger.warning(f"Target '{name}': still running after its backup window {window.describe()}"),
+            )
+        )
+
+    token = None
+    if max_runtime is not None:
+        token = _deadline.set((time.monotonic() + max_runtime.total_seconds(), max_runtime))
+        timers.append(
+            threading.Timer(max_runtime.total_seconds(), _cancel, (name, max_runtime, threading.get_native_id()))
+        )
+
+    for timer in timers:
+        timer.daemon = True
+        timer.start()
+    try:
+        yield
+    finally:
+        for timer in timers:
+            timer.cancel()
+        if token is not None:
+            _deadline.reset(token)
+        finished = datetime.now(timezone.utc)
+        if closes is not None and finished > closes:
+            overrun = (finished - closes).total_seconds()
+            logger.warning(f"Target '{name}': overran its backup window {window.describe()} by {overrun:.0f}s")
+
+
+def check_runtime(step: str) -> None:
+    """Stop the backup under way before a step once it exceeded its maximum runtime.
+
+    Raises:
+        BackupError: If the backup has run longer than its maximum runtime
+    """
+    deadline = _deadline.get()
+    if deadline is not None and time.monotonic() >= deadline[0]:
+        raise BackupError(
+            f"Exceeded the maximum runtime of {deadline[1].total_seconds():.0f}s, cancelled before the {step}"
+        )
@@ -0,0 +1,34 @@
+"""Fixtures shared by the notifier tests."""
+
+import json
+from datetime import datetime, timezone
+from pathlib import Path
+
+import pytest
+
+from nestvault.notify.base import RunResult
+
+GOLDEN = Path(__file__).parent / "golden"
+
+# Fixed end of the runs, as the payloads in the golden files carry it
+FINISHED_AT = datetime(2024, 1, 15, 2, 5, 12, tzinfo=timezone.utc)
+
+
+@pytest.fixture
+def golden():
+    """Return a loader of the payloads stored in tests/golden, by file name."""
+
+    def load(name):
+        return json.loads((GOLDEN / name).read_text())
+
+    return load
+
+
+@pytest.fixture
+def run_result():
+    """Return a builder of run results that finished at FINISHED_AT, unless given another time."""
+
+    def build(target, database, status, **fields):
+        return RunResult(target, database, status, **{"finished_at": FINISHED_AT, **fields})
+
+    return build
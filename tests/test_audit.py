@@ -0,0 +1,149 @@
+"""Tests for restore audit records and the audit trail."""
+
+import json
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.audit import (
+    AUDIT_PREFIX,
+    TRAIL_PREFIX,
+    AuditEvent,
+    AuditTrail,
+    RestoreRecord,
+    read_trail,
+    record_outcome,
+    record_start,
+    render_trail,
+    strip_credentials,
+    write_restore_record,
+)
+from nestvault.config import LocalConfig
+from nestvault.exceptions import AuditError, StorageError
+from nestvault.manifest import Manifest, list_backups
+from nestvault.storage.local import LocalStorageAdapter
+
+STARTED = datetime(2024, 1, 16, 9, 0, tzinfo=timezone.utc)
+FINISHED = datetime(2024, 1, 16, 9, 5, tzinfo=timezone.utc)
+
+
+def _record(succeeded=True):
+    manifest = Manifest(
+        key="app_20240115_120000.sql.gz",
+        database="app",
+        finished_at=datetime(2024, 1, 15, 12, 0, tzinfo=timezone.utc),
+        size=100,
+        engine="postgres",
+        server_version="16.2",
+        labels={"env": "production"},
+    )
+    destination = mock.Mock(engine="postgres", location="staging:5432/app_copy")
+    return RestoreRecord.of(manifest, destination, STARTED, FINISHED, succeeded)
+
+
+class TestRestoreRecord:
+    """Tests for RestoreRecord and write_restore_record."""
+
+    def test_records_source_and_destination(self):
+        data = json.loads(_record().to_json())
+
+        assert data["backup"] == "app_20240115_120000.sql.gz"
+        assert data["source"]["database"] == "app"
+        assert data["source"]["labels"] == "env=production"
+        assert data["destination"] == {"engine": "postgres", "location": "staging:5432/app_copy"}
+        assert data["started_at"] == "2024-01-16T09:00:00+00:00"
+        assert data["succeeded"] is True
+        assert "@" in data["operator"]
+
+    def test_uploads_record_outside_backup_listings(self, tmp_path):
+        storage = LocalStorageAdapter(LocalConfig(root=str(tmp_path)))
+
+        key = write_restore_record(storage, _record(succeeded=False))
+
+        assert key.startswith(f"{AUDIT_PREFIX}20240116_090000_")
+        assert json.loads((tmp_path / key).read_text())["succeeded"] is False
+        assert list_backups(storage, prefix="") == []
+
+    def test_upload_failure_is_only_logged(self):
+        storage = mock.Mock()
+        storage.upload.side_effect = StorageError("access denied")
+
+        assert write_restore_record(storage, _record()) is None
+
+
+class TestAuditTrail:
+    """Tests for AuditTrail, record_start, record_outcome and read_trail."""
+
+    @pytest.fixture
+    def storage(self, tmp_path):
+        root = tmp_path / "bucket"
+        root.mkdir()
+        return LocalStorageAdapter(LocalConfig(root=str(root)))
+
+    def test_records_start_and_outcome_in_file_and_storage(self, tmp_path, storage):
+        path = tmp_path / "audit.jsonl"
+
+        with mock.patch("nestvault.audit._trail", AuditTrail(path, to_storage=True, user="alice")):
+            started = record_start(
+                storage, "restore", "app_20240115_120000.sql.gz", target="app", destination="postgresql://app@db/app"
+            )
+            record_outcome(storage, started, False, "pg_restore exited with 1")
+
+        lines = [json.loads(line) for line in path.read_text().splitlines()]
+        assert [(line["outcome"], line["user"], line["reason"]) for line in lines] == [
+            ("started", "alice", ""),
+            ("failure", "alice", "pg_restore exited with 1"),
+        ]
+        assert lines[0]["id"] == lines[1]["id"]
+        keys = sorted(obj.key for obj in storage.list(prefix=TRAIL_PREFIX))
+        assert [key.rsplit("_", 1)[1] for key in keys] == ["failure.json", "started.json"]
+        assert list_backups(storage, prefix="") == []
+
+    def test_read_trail_merges_file_and_storage(self, tmp_path, storage):
+        path = tmp_path / "audit.jsonl"
+        with mock.patch("nestvault.audit._trail", AuditTrail(path, to_storage=True)):
+            old = record_start(storage, "hold", "app_20240101_120000.sql.gz", at=STARTED - timedelta(days=40))
+            record_start(storage, "release", "app_20240115_120000.sql.gz", at=STARTED)
+        path.write_text(path.read_text() + "not json\n")
+
+        events = read_trail(path, [("app", storage)])
+        assert [(event.operation, event.target) for event in events] == [("hold", "app"), ("release", "app")]
+        assert events[0].id == old.id
+
+        recent = read_trail(None, [("app", storage)], since=STARTED - timedelta(days=30))
+        assert [event.operation for event in recent] == ["release"]
+
+    def test_unwritable_entry_is_logged_unless_strict(self, tmp_path):
+        event = AuditEvent("fetch", "app_20240115_120000.sql.gz", "started")
+
+        AuditTrail(tmp_path).record(event)
+
+        with pytest.raises(AuditError, match="fetch of app_20240115_120000.sql.gz"):
+            AuditTrail(tmp_path, strict=True).record(event)
+
+    def test_renders_table(self):
+        event = AuditEvent("prune", "app_20240101_120000.sql.gz", "success", STARTED, reason="older than 7 days")
+        event.user = "ops@nestvault"
+
+        lines = render_trail([event], "table").splitlines()
+
+        assert lines[0].split() == ["AT", "OPERATION", "OUTCOME", "TARGET", "BACKUP", "USER", "DESTINATION", "REASON"]
+        assert lines[1].split()[:4] == ["2024-01-16", "09:00:00", "prune", "success"]
+        assert lines[-1] == "(1 entries)"
+
+
+class TestStripCredentials:
+    """Tests for strip_credentials function."""
+
+    @pytest.mark.parametrize(
+        "dsn, expected",
+        [
+            ("postgresql://app:s3cret@db:5432/app", "postgresql://app@db:5432/app"),
+            ("postgresql://:s3cret@db/app", "postgresql://db/app"),
+            ("postgresql://app@db/app?password=s3cret", "postgresql://app@db/app?password=***"),
+            ("db.internal:5432/app", "db.internal:5432/app"),
+        ],
+    )
+    def test_strips_passwords(self, dsn, expected):
+        assert strip_credentials(dsn) == expected
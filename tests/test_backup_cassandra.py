@@ -0,0 +1,205 @@
+"""Tests for Cassandra backup adapter."""
+
+import subprocess
+import tarfile
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.cassandra import CassandraBackupAdapter
+from nestvault.config import CassandraConfig
+from nestvault.exceptions import BackupError
+
+
+class FakeNodetool:
+    """subprocess.run side effect that creates and clears snapshot directories."""
+
+    def __init__(self, data_dir):
+        self.data_dir = data_dir
+        self.commands = []
+
+    def __call__(self, cmd, **kwargs):
+        self.commands.append(cmd)
+        args = cmd[cmd.index("-p") + 2:]
+        if "-u" in args:
+            args = args[4:]
+
+        if args[0] == "snapshot":
+            tag = args[2]
+            for keyspace in args[4:]:
+                for table_dir in (self.data_dir / keyspace).iterdir():
+                    snapshot = table_dir / "snapshots" / tag
+                    snapshot.mkdir(parents=True)
+                    (snapshot / "nb-1-big-Data.db").write_bytes(f"{table_dir.name}-data".encode())
+                    (snapshot / "schema.cql").write_text("CREATE TABLE ...")
+        elif args[0] == "clearsnapshot":
+            for snapshot in self.data_dir.glob(f"*/*/snapshots/{args[2]}"):
+                for path in snapshot.iterdir():
+                    path.unlink()
+                snapshot.rmdir()
+
+        return mock.Mock(returncode=0, stdout=b"")
+
+
+@pytest.fixture(autouse=True)
+def client_binaries():
+    with mock.patch("shutil.which", return_value="/opt/cassandra/bin/nodetool"):
+        yield
+
+
+class TestCassandraBackupAdapter:
+    """Tests for CassandraBackupAdapter."""
+
+    @pytest.fixture
+    def data_dir(self, tmp_path):
+        data_dir = tmp_path / "data"
+        for table_dir in (
+            "shop/orders-5a1c395e1e4711efb0e1",
+            "shop/customers-7b2d4a6f1e4711efb0e1",
+            "audit/events-9c3e5b701e4711efb0e1",
+            "system/local-7ad54392bcdd35a684174e047860b377",
+        ):
+            (data_dir / table_dir).mkdir(parents=True)
+        return data_dir
+
+    @pytest.fixture
+    def config(self, data_dir):
+        return CassandraConfig(data_dir=str(data_dir), node_id="cassandra-0")
+
+    @pytest.fixture
+    def output(self, tmp_path):
+        path = tmp_path / "backup"
+        path.mkdir()
+        return path
+
+    def test_properties(self, config):
+        adapter = CassandraBackupAdapter(config)
+
+        assert adapter.database_name == "cassandra"
+        assert adapter.file_extension == "cassandra-0.cassandra.tar"
+        assert adapter.engine == "cassandra"
+
+    def test_is_own_backup(self, config):
+        adapter = CassandraBackupAdapter(config)
+
+        assert adapter.is_own_backup("cassandra_20240115_120000.cassandra-0.cassandra.tar")
+        assert not adapter.is_own_backup("cassandra_20240115_120000.cassandra-1.cassandra.tar")
+
+    def test_backup_archives_snapshot_and_clears_it(self, config, data_dir, output):
+        adapter = CassandraBackupAdapter(config)
+        fake = FakeNodetool(data_dir)
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            backup_file = adapter.backup(output)
+
+        tag = adapter.backup_metadata["snapshot_tag"]
+        assert fake.commands[0][-6:] == ["snapshot", "-t", tag, "--", "audit", "shop"]
+        assert fake.commands[-1][-6:] == ["clearsnapshot", "-t", tag, "--", "audit", "shop"]
+        assert list(data_dir.glob("*/*/snapshots/*")) == []
+
+        # Timestamp is truncated to the minute so every node shares it
+        assert backup_file.name.split(".")[0].endswith("00")
+        assert backup_file.name == f"cassandra_{tag.removeprefix('nestvault_')}.cassandra-0.cassandra.tar"
+
+        with tarfile.open(backup_file) as archive:
+            names = archive.getnames()
+        assert "shop/orders/nb-1-big-Data.db" in names
+        assert "audit/events/schema.cql" in names
+        assert not any(name.startswith("system/") for name in names)
+
+        assert adapter.backup_metadata["node"] == "cassandra-0"
+        assert adapter.backup_metadata["keyspaces"] == "audit,shop"
+
+    def test_backup_keyspace_filters(self, config, data_dir, output):
+        config.keyspaces = ["s*"]
+        config.exclude_keyspaces = ["system*"]
+        adapter = CassandraBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeNodetool(data_dir)):
+            adapter.backup(output)
+
+        assert adapter.backup_metadata["keyspaces"] == "shop"
+
+    def test_jmx_password_not_on_command_line(self, config, data_dir, output):
+        config.jmx_user = "cassandra"
+        config.jmx_password = "secret"
+        adapter = CassandraBackupAdapter(config)
+        fake = FakeNodetool(data_dir)
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.backup(output)
+
+        assert "-pwf" in fake.commands[0]
+        assert "secret" not in " ".join(fake.commands[0])
+
+    def test_snapshot_cleared_when_archiving_fails(self, config, data_dir, output):
+        adapter = CassandraBackupAdapter(config)
+        fake = FakeNodetool(data_dir)
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            with mock.patch("tarfile.TarFile.add", side_effect=OSError("No space left on device")):
+                with pytest.raises(BackupError):
+                    adapter.backup(output)
+
+        assert "clearsnapshot" in fake.commands[-1]
+        assert list(output.iterdir()) == []
+
+    def test_snapshot_failure(self, config, output):
+        adapter = CassandraBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(1, "nodetool", stderr=b"Connection refused")
+
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(output)
+
+            assert "Connection refused" in str(exc_info.value)
+
+    def test_restore_imports_into_existing_tables(self, config, data_dir, output):
+        adapter = CassandraBackupAdapter(config)
+        with mock.patch("subprocess.run", side_effect=FakeNodetool(data_dir)):
+            backup_file = adapter.backup(output)
+
+        # The restored cluster has new table IDs
+        restored = output.parent / "restored"
+        for table_dir in ("shop/orders-1111", "shop/customers-2222", "audit/events-3333"):
+            (restored / table_dir).mkdir(parents=True)
+        config.data_dir = str(restored)
+        fake = FakeNodetool(restored)
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file)
+
+        assert (restored / "shop/orders-1111/upload/nb-1-big-Data.db").read_bytes() == (
+            b"orders-5a1c395e1e4711efb0e1-data"
+        )
+        assert ["import", "--", "shop", "orders", str(restored / "shop/orders-1111/upload")] in [
+            cmd[-5:] for cmd in fake.commands
+        ]
+
+    def test_restore_scylla_uses_refresh(self, config, data_dir, output):
+        adapter = CassandraBackupAdapter(config)
+        with mock.patch("subprocess.run", side_effect=FakeNodetool(data_dir)):
+            backup_file = adapter.backup(output)
+
+        config.flavor = "scylla"
+        fake = FakeNodetool(data_dir)
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file)
+
+        assert all("refresh" in cmd for cmd in fake.commands)
+
+    def test_restore_requires_schema(self, config, data_dir, output):
+        adapter = CassandraBackupAdapter(config)
+        with mock.patch("subprocess.run", side_effect=FakeNodetool(data_dir)):
+            backup_file = adapter.backup(output)
+
+        empty = output.parent / "empty"
+        empty.mkdir()
+        config.data_dir = str(empty)
+
+        with mock.patch("subprocess.run", side_effect=FakeNodetool(empty)):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file)
+
+        assert "create the schema" in str(exc_info.value)
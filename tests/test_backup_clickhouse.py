@@ -0,0 +1,229 @@
+"""Tests for ClickHouse backup adapter."""
+
+import subprocess
+import tarfile
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.clickhouse import ClickHouseBackupAdapter
+from nestvault.config import ClickHouseConfig
+from nestvault.exceptions import BackupError
+
+
+class FakeClickHouse:
+    """subprocess.run side effect answering the queries the adapter issues."""
+
+    def __init__(self, tables, existing=None, row_count=0):
+        self.tables = tables
+        self.existing = existing or set()
+        self.row_count = row_count
+        self.queries = []
+        self.databases = {}
+        self.inserted = {}
+
+    def __call__(self, cmd, **kwargs):
+        query = cmd[cmd.index("--query") + 1]
+        self.queries.append(query)
+        self.databases[query] = cmd[cmd.index("--database") + 1]
+        output = b""
+
+        if "FROM system.tables" in query:
+            output = "".join(f"{name}\t{engine}\n" for name, engine in self.tables).encode()
+        elif query.startswith("SHOW CREATE TABLE"):
+            output = f"CREATE TABLE {query.split()[3]}".encode()
+        elif query.startswith("SELECT * FROM"):
+            kwargs["stdout"].write(b"native-data")
+        elif query.startswith("EXISTS TABLE"):
+            name = query.split(".")[-1].strip("`")
+            output = b"1" if name in self.existing else b"0"
+        elif query.startswith("SELECT count()"):
+            output = str(self.row_count).encode()
+        elif query.startswith("INSERT INTO"):
+            self.inserted[query.split()[2]] = kwargs["stdin"].read()
+
+        return mock.Mock(returncode=0, stdout=output)
+
+
+@pytest.fixture(autouse=True)
+def clickhouse_client():
+    with mock.patch("shutil.which", return_value="/usr/bin/clickhouse-client"):
+        yield
+
+
+class TestClickHouseBackupAdapter:
+    """Tests for ClickHouseBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return ClickHouseConfig(
+            host="localhost",
+            port=9000,
+            database="analytics",
+            user="backup",
+            password="secret",
+        )
+
+    @pytest.fixture
+    def tables(self):
+        return [("events", "MergeTree"), ("events_daily", "MaterializedView"), ("queue", "Kafka")]
+
+    def test_properties(self, config):
+        adapter = ClickHouseBackupAdapter(config)
+
+        assert adapter.database_name == "analytics"
+        assert adapter.file_extension == "clickhouse.tar.gz"
+        assert adapter.engine == "clickhouse"
+        assert adapter.backup_metadata == {"engine": "clickhouse", "method": "export"}
+
+    def test_export_backup(self, config, tables, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+        fake = FakeClickHouse(tables)
+
+        with mock.patch("subprocess.run", side_effect=fake) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+            cmd = mock_run.call_args_list[0][0][0]
+            assert cmd[cmd.index("--user") + 1] == "backup"
+            assert mock_run.call_args_list[0].kwargs["env"] == {"CLICKHOUSE_PASSWORD": "secret"}
+
+        assert backup_file.name.endswith(".clickhouse.tar.gz")
+
+        # Views and queue engines are exported as schema only
+        exports = [q for q in fake.queries if q.startswith("SELECT * FROM")]
+        assert exports == ["SELECT * FROM `analytics`.`events` FORMAT Native"]
+
+        with tarfile.open(backup_file) as archive:
+            names = archive.getnames()
+        assert "manifest.json" in names
+        assert "data/0000.native" in names
+        assert "schema/0002.sql" in names
+
+    def test_table_include_list(self, config, tables, tmp_path):
+        config.tables = ["events*"]
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeClickHouse(tables)):
+            assert [name for name, _ in adapter.list_tables()] == ["events", "events_daily"]
+
+    def test_backup_failure(self, config, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(
+                210, "clickhouse-client", stderr=b"Connection refused"
+            )
+
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+            assert "Connection refused" in str(exc_info.value)
+
+    def test_restore_creates_tables_before_views(self, config, tables, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeClickHouse(tables)):
+            backup_file = adapter.backup(tmp_path)
+
+        fake = FakeClickHouse(tables)
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file)
+
+        statements = [q for q in fake.queries if q.startswith(("CREATE", "INSERT"))]
+        assert statements == [
+            "CREATE DATABASE IF NOT EXISTS `analytics`",
+            "CREATE TABLE `analytics`.`events`",
+            "INSERT INTO `analytics`.`events` FORMAT Native",
+            "CREATE TABLE `analytics`.`queue`",
+            "CREATE TABLE `analytics`.`events_daily`",
+        ]
+        assert fake.inserted["`analytics`.`events`"] == b"native-data"
+
+    def test_restore_creates_database_from_the_default_one(self, config, tables, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeClickHouse(tables)):
+            backup_file = adapter.backup(tmp_path)
+
+        fake = FakeClickHouse(tables)
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file)
+
+        # Connecting to the database before it exists fails with UNKNOWN_DATABASE
+        assert fake.databases["CREATE DATABASE IF NOT EXISTS `analytics`"] == "default"
+        assert fake.databases["EXISTS TABLE `analytics`.`events`"] == "default"
+        assert fake.databases["CREATE TABLE `analytics`.`events`"] == "analytics"
+
+    def test_restore_refuses_non_empty_tables(self, config, tables, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeClickHouse(tables)):
+            backup_file = adapter.backup(tmp_path)
+
+        fake = FakeClickHouse(tables, existing={"events"}, row_count=10)
+        with mock.patch("subprocess.run", side_effect=fake):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file)
+
+        assert "events" in str(exc_info.value)
+        assert not any(q.startswith("INSERT") for q in fake.queries)
+
+    def test_restore_force_truncates_non_empty_tables(self, config, tables, tmp_path):
+        adapter = ClickHouseBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeClickHouse(tables)):
+            backup_file = adapter.backup(tmp_path)
+
+        fake = FakeClickHouse(tables, existing={"events"}, row_count=10)
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file, RestoreOptions(force=True))
+
+        assert "TRUNCATE TABLE `analytics`.`events`" in fake.queries
+        assert "`analytics`.`events`" in fake.inserted
+
+    def test_server_backup_collects_archive_from_disk(self, config, tmp_path):
+        disk = tmp_path / "disk"
+        disk.mkdir()
+        output = tmp_path / "out"
+        output.mkdir()
+        config.backup_disk = "backups"
+        config.backup_disk_path = str(disk)
+        adapter = ClickHouseBackupAdapter(config)
+
+        def fake_backup(cmd, **kwargs):
+            query = cmd[cmd.index("--query") + 1]
+            name = query.split("'")[3]
+            (disk / name).write_bytes(b"PK")
+            return mock.Mock(returncode=0, stdout=b"")
+
+        with mock.patch("subprocess.run", side_effect=fake_backup) as mock_run:
+            backup_file = adapter.backup(output)
+
+            query = mock_run.call_args[0][0][-1]
+            assert query.startswith("BACKUP DATABASE `analytics` TO Disk('backups', ")
+
+        assert backup_file.name.endswith(".clickhouse.zip")
+        assert backup_file.read_bytes() == b"PK"
+        assert adapter.backup_metadata["method"] == "server"
+        assert list(disk.iterdir()) == []
+
+    def test_server_restore_into_new_database_runs_from_the_default_one(self, config, tmp_path):
+        disk = tmp_path / "disk"
+        disk.mkdir()
+        config.backup_disk = "ops'backups"
+        config.backup_disk_path = str(disk)
+        backup_file = tmp_path / "analytics_20240115_020000.clickhouse.zip"
+        backup_file.write_bytes(b"PK")
+
+        fake = FakeClickHouse([])
+        with mock.patch("subprocess.run", side_effect=fake):
+            ClickHouseBackupAdapter(config).restore(backup_file, RestoreOptions(metadata={"method": "server"}))
+
+        [query] = fake.queries
+        assert query == (
+            "RESTORE DATABASE `analytics` FROM Disk('ops\\'backups', 'analytics_20240115_020000.clickhouse.zip')"
+        )
+        # Connecting to the database before it exists fails with UNKNOWN_DATABASE
+        assert fake.databases[query] == "default"
+        assert list(disk.iterdir()) == []
@@ -0,0 +1,192 @@
+"""Tests for CockroachDB backup adapter."""
+
+import json
+import subprocess
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.cockroachdb import CockroachDBBackupAdapter
+from nestvault.config import CockroachDBConfig
+from nestvault.exceptions import BackupError
+from nestvault.storage.base import StorageObject
+
+URI = "s3://backups/cockroachdb/bank?AWS_ACCESS_KEY_ID=AKIA&AWS_SECRET_ACCESS_KEY=secret"
+
+
+class FakeCockroach:
+    """subprocess.run side effect answering the statements the adapter sends."""
+
+    def __init__(self, job_states=("running\t0.5\t\t", "succeeded\t1\t\t2024-01-15 12:00:10"), databases="0"):
+        self.job_states = list(job_states)
+        self.databases = databases
+        self.statements = []
+
+    def __call__(self, cmd, input=None, **kwargs):
+        statement = input.decode()
+        self.statements.append(statement)
+
+        if statement.startswith(("BACKUP", "RESTORE")):
+            stdout = "912345678901\n"
+        elif "SHOW JOB" in statement:
+            stdout = self.job_states.pop(0) + "\n"
+        elif "SHOW BACKUPS" in statement:
+            stdout = "/2024/01/15-120000.00\n"
+        elif "SHOW DATABASES" in statement:
+            stdout = self.databases + "\n"
+        else:
+            stdout = ""
+
+        return mock.Mock(returncode=0, stdout=stdout.encode())
+
+
+@pytest.fixture(autouse=True)
+def client_binaries():
+    with mock.patch("shutil.which", return_value="/usr/bin/psql"), mock.patch("time.sleep"):
+        yield
+
+
+class TestCockroachDBBackupAdapter:
+    """Tests for CockroachDBBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return CockroachDBConfig(host="crdb.example.com", port=26257, database="bank", password="secret")
+
+    @pytest.fixture
+    def storage(self):
+        storage = mock.Mock()
+        storage.external_location.return_value.uri = URI
+        return storage
+
+    @pytest.fixture
+    def pointer(self, tmp_path):
+        pointer = tmp_path / "bank_20240115_120000.crdb.json"
+        pointer.write_text(json.dumps({
+            "database": "bank",
+            "job_id": "912345678901",
+            "collection": "cockroachdb/bank",
+            "path": "/2024/01/15-120000.00",
+            "end_time": "2024-01-15 12:00:10",
+        }))
+        return pointer
+
+    def test_properties(self, config):
+        adapter = CockroachDBBackupAdapter(config)
+
+        assert adapter.database_name == "bank"
+        assert adapter.file_extension == "crdb.json"
+        assert adapter.engine == "cockroachdb"
+        assert adapter.collection == "cockroachdb/bank"
+
+    def test_backup_runs_job_and_records_path(self, config, storage, tmp_path):
+        adapter = CockroachDBBackupAdapter(config, storage)
+        fake = FakeCockroach()
+
+        with mock.patch("subprocess.run", side_effect=fake) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+            cmd = mock_run.call_args[0][0]
+            assert mock_run.call_args.kwargs["env"] == {"PGPASSWORD": "secret"}
+            # Storage credentials only travel through stdin
+            assert "secret" not in " ".join(cmd)
+
+        storage.external_location.assert_called_with("cockroachdb/bank")
+        assert fake.statements[0].startswith(f"BACKUP DATABASE \"bank\" INTO '{URI}'")
+        assert fake.statements[0].endswith("WITH detached")
+        assert adapter.backup_metadata == {
+            "engine": "cockroachdb",
+            "job_id": "912345678901",
+            "collection": "cockroachdb/bank",
+            "path": "/2024/01/15-120000.00",
+            "end_time": "2024-01-15 12:00:10",
+        }
+        assert json.loads(backup_file.read_text())["path"] == "/2024/01/15-120000.00"
+
+    def test_backup_job_failure(self, config, storage, tmp_path):
+        adapter = CockroachDBBackupAdapter(config, storage)
+        fake = FakeCockroach(job_states=["failed\t0.2\tAccess Denied\t"])
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+        assert "Access Denied" in str(exc_info.value)
+        assert list(tmp_path.iterdir()) == []
+
+    def test_backup_requires_storage(self, config, tmp_path):
+        adapter = CockroachDBBackupAdapter(config)
+
+        with pytest.raises(BackupError) as exc_info:
+            adapter.backup(tmp_path)
+
+        assert "storage backend" in str(exc_info.value)
+
+    def test_statement_failure(self, config, storage, tmp_path):
+        adapter = CockroachDBBackupAdapter(config, storage)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(1, "psql", stderr=b"ERROR: user root does not have BACKUP privilege")
+
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+            assert "BACKUP privilege" in str(exc_info.value)
+
+    def test_restore_under_new_name(self, config, storage, pointer):
+        config.restore_database = "bank_restored"
+        adapter = CockroachDBBackupAdapter(config, storage)
+        fake = FakeCockroach(job_states=["succeeded\t1\t\t2024-01-16 08:00:00"])
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(pointer)
+
+        restore = next(s for s in fake.statements if s.startswith("RESTORE"))
+        assert restore == (
+            f"RESTORE DATABASE \"bank\" FROM '/2024/01/15-120000.00' IN '{URI}' "
+            "WITH new_db_name = 'bank_restored', detached"
+        )
+
+    def test_restore_refuses_existing_database(self, config, storage, pointer):
+        adapter = CockroachDBBackupAdapter(config, storage)
+
+        with mock.patch("subprocess.run", side_effect=FakeCockroach(databases="1")):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(pointer)
+
+        assert "--force" in str(exc_info.value)
+
+    def test_restore_force_drops_existing_database(self, config, storage, pointer):
+        adapter = CockroachDBBackupAdapter(config, storage)
+        fake = FakeCockroach(job_states=["succeeded\t1\t\t2024-01-16 08:00:00"], databases="1")
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(pointer, RestoreOptions(force=True))
+
+        assert 'DROP DATABASE "bank" CASCADE' in fake.statements
+        assert fake.statements[-2].endswith("WITH detached")
+
+    def test_delete_backup_data_removes_collection_files(self, config, storage):
+        storage.get_metadata.return_value = {"collection": "cockroachdb/bank", "path": "/2024/01/15-120000.00"}
+        storage.list.return_value = [
+            StorageObject(key=f"cockroachdb/bank/2024/01/15-120000.00/{name}", size=1, last_modified=datetime.now(timezone.utc))
+            for name in ("BACKUP_MANIFEST", "data/1.sst")
+        ]
+        adapter = CockroachDBBackupAdapter(config, storage)
+
+        adapter.delete_backup_data("bank_20240115_120000.crdb.json")
+
+        storage.list.assert_called_once_with(prefix="cockroachdb/bank/2024/01/15-120000.00/")
+        storage.delete_many.assert_called_once_with([
+            "cockroachdb/bank/2024/01/15-120000.00/BACKUP_MANIFEST",
+            "cockroachdb/bank/2024/01/15-120000.00/data/1.sst",
+        ])
+
+    def test_for_database_keeps_storage(self, config, storage):
+        adapter = CockroachDBBackupAdapter(config, storage).for_database("ledger")
+
+        assert adapter.database_name == "ledger"
+        assert adapter.storage is storage
+        assert adapter.collection == "cockroachdb/ledger"
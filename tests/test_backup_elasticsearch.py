@@ -0,0 +1,215 @@
+"""Tests for Elasticsearch backup adapter."""
+
+import io
+import json
+import urllib.error
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.elasticsearch import ElasticsearchBackupAdapter
+from nestvault.config import ElasticsearchConfig
+from nestvault.exceptions import BackupError
+from nestvault.storage.base import ExternalLocation
+
+
+class FakeCluster:
+    """urllib.request.urlopen side effect for the snapshot API."""
+
+    def __init__(self, repository=None, states=("IN_PROGRESS", "SUCCESS"), indices=(), failed_shards=0):
+        self.repository = repository
+        self.states = list(states)
+        self.indices = list(indices)
+        self.failed_shards = failed_shards
+        self.requests = []
+
+    def __call__(self, request, timeout=None, context=None):
+        path = request.full_url.removeprefix("https://es:9200")
+        body = json.loads(request.data) if request.data else None
+        method = request.get_method()
+        self.requests.append((method, path, body))
+
+        if path == "/_snapshot/nestvault" and method == "GET":
+            if self.repository is None:
+                raise urllib.error.HTTPError(request.full_url, 404, "missing", {}, io.BytesIO(b"{}"))
+            return self._json({"nestvault": self.repository})
+        if path == "/_snapshot/nestvault/_verify":
+            return self._json({"nodes": {"a": {}, "b": {}}})
+        if path.startswith("/_snapshot/nestvault/") and method == "GET":
+            state = self.states.pop(0)
+            return self._json({"snapshots": [{
+                "state": state,
+                "indices": ["logs-2024.01.15", "orders"],
+                "shards": {"total": 4, "successful": 4 - self.failed_shards, "failed": self.failed_shards},
+                "failures": [{"reason": "IndexShardSnapshotFailedException"}] if state == "FAILED" else [],
+            }]})
+        if path.startswith("/_cat/indices"):
+            return self._json([{"index": index} for index in self.indices])
+        if path.endswith("/_restore?wait_for_completion=true"):
+            return self._json({"snapshot": {"shards": {"total": 4, "successful": 4, "failed": 0}}})
+
+        return self._json({"acknowledged": True})
+
+    @staticmethod
+    def _json(payload):
+        return io.BytesIO(json.dumps(payload).encode())
+
+
+@pytest.fixture(autouse=True)
+def no_sleep():
+    with mock.patch("time.sleep"):
+        yield
+
+
+class TestElasticsearchBackupAdapter:
+    """Tests for ElasticsearchBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return ElasticsearchConfig(url="https://es:9200", api_key="a2V5OnNlY3JldA==", indices=["logs-*", "orders"])
+
+    @pytest.fixture
+    def storage(self):
+        storage = mock.Mock()
+        storage.external_location.side_effect = lambda key: ExternalLocation(
+            bucket="backups", key=f"prod/{key}", region="us-east-1", access_key="AKIA", secret_key="secret"
+        )
+        return storage
+
+    @pytest.fixture
+    def pointer(self, tmp_path):
+        pointer = tmp_path / "elasticsearch_20240115_120000.es-snapshot.json"
+        pointer.write_text(json.dumps({
+            "repository": "nestvault",
+            "snapshot": "elasticsearch_20240115_120000",
+            "indices": ["logs-2024.01.15", "orders"],
+        }))
+        return pointer
+
+    def test_properties(self, config):
+        adapter = ElasticsearchBackupAdapter(config)
+
+        assert adapter.database_name == "elasticsearch"
+        assert adapter.file_extension == "es-snapshot.json"
+        assert adapter.engine == "elasticsearch"
+
+    def test_backup_registers_repository_and_waits(self, config, storage, tmp_path):
+        adapter = ElasticsearchBackupAdapter(config, storage)
+        cluster = FakeCluster()
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster) as mock_urlopen:
+            backup_file = adapter.backup(tmp_path)
+
+            request = mock_urlopen.call_args[0][0]
+            assert request.get_header("Authorization") == "ApiKey a2V5OnNlY3JldA=="
+
+        register = next(r for r in cluster.requests if r[0] == "PUT" and r[1] == "/_snapshot/nestvault")
+        assert register[2] == {
+            "type": "s3",
+            "settings": {"bucket": "backups", "base_path": "prod/elasticsearch", "client": "default"},
+        }
+        create = next(r for r in cluster.requests if r[1].endswith("?wait_for_completion=false"))
+        assert create[2]["indices"] == "logs-*,orders"
+        assert create[2]["include_global_state"] is False
+
+        assert adapter.backup_metadata == {
+            "engine": "elasticsearch",
+            "repository": "nestvault",
+            "snapshot": backup_file.name.removesuffix(".es-snapshot.json"),
+            "state": "SUCCESS",
+            "shards_total": "4",
+            "shards_successful": "4",
+            "shards_failed": "0",
+        }
+
+    def test_basic_auth(self, config, storage, tmp_path):
+        config.api_key = None
+        config.user = "elastic"
+        config.password = "changeme"
+        adapter = ElasticsearchBackupAdapter(config, storage)
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeCluster()) as mock_urlopen:
+            adapter.backup(tmp_path)
+
+            request = mock_urlopen.call_args[0][0]
+            assert request.get_header("Authorization") == "Basic ZWxhc3RpYzpjaGFuZ2VtZQ=="
+
+    def test_existing_repository_elsewhere_is_rejected(self, config, storage, tmp_path):
+        adapter = ElasticsearchBackupAdapter(config, storage)
+        cluster = FakeCluster(repository={"type": "s3", "settings": {"bucket": "other", "base_path": "x"}})
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+        assert "s3://other/x" in str(exc_info.value)
+
+    def test_partial_snapshot_is_kept(self, config, storage, tmp_path):
+        adapter = ElasticsearchBackupAdapter(config, storage)
+        cluster = FakeCluster(
+            repository={"type": "s3", "settings": {"bucket": "backups", "base_path": "prod/elasticsearch"}},
+            states=["PARTIAL"],
+            failed_shards=1,
+        )
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster):
+            backup_file = adapter.backup(tmp_path)
+
+        assert backup_file.exists()
+        assert adapter.backup_metadata["state"] == "PARTIAL"
+        assert adapter.backup_metadata["shards_failed"] == "1"
+
+    def test_failed_snapshot(self, config, storage, tmp_path):
+        adapter = ElasticsearchBackupAdapter(config, storage)
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeCluster(states=["FAILED"])):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+        assert "IndexShardSnapshotFailedException" in str(exc_info.value)
+        assert list(tmp_path.iterdir()) == []
+
+    def test_restore_refuses_existing_indices(self, config, pointer):
+        adapter = ElasticsearchBackupAdapter(config)
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeCluster(indices=["orders"])):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(pointer)
+
+        assert "orders" in str(exc_info.value)
+        assert "--force" in str(exc_info.value)
+
+    def test_restore_force_closes_existing_indices(self, config, pointer):
+        adapter = ElasticsearchBackupAdapter(config)
+        cluster = FakeCluster(indices=["orders"])
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster):
+            adapter.restore(pointer, RestoreOptions(force=True))
+
+        paths = [path for _, path, _ in cluster.requests]
+        assert "/orders/_close" in paths
+        assert paths[-1] == "/_snapshot/nestvault/elasticsearch_20240115_120000/_restore?wait_for_completion=true"
+
+    def test_restore_with_rename(self, config, pointer):
+        config.rename_pattern = "(.+)"
+        config.rename_replacement = "restored-$1"
+        adapter = ElasticsearchBackupAdapter(config)
+        # Renamed indices do not collide with the originals
+        cluster = FakeCluster(indices=["orders"])
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster):
+            adapter.restore(pointer)
+
+        _, _, body = cluster.requests[-1]
+        assert body["rename_pattern"] == "(.+)"
+        assert body["rename_replacement"] == "restored-$1"
+
+    def test_delete_backup_data_deletes_snapshot(self, config):
+        adapter = ElasticsearchBackupAdapter(config)
+        cluster = FakeCluster()
+
+        with mock.patch("urllib.request.urlopen", side_effect=cluster):
+            adapter.delete_backup_data("elasticsearch_20240101_120000.es-snapshot.json")
+
+        assert cluster.requests == [("DELETE", "/_snapshot/nestvault/elasticsearch_20240101_120000", None)]
@@ -0,0 +1,173 @@
+"""Tests for etcd backup adapter."""
+
+import gzip
+import json
+import subprocess
+from pathlib import Path
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.etcd import EtcdBackupAdapter
+from nestvault.config import EtcdConfig
+from nestvault.exceptions import BackupError
+
+STATUS = {"hash": 3015703129, "revision": 48213, "totalKey": 1204, "totalSize": 4194304}
+
+
+class FakeEtcdctl:
+    """subprocess.run side effect for etcdctl/etcdutl."""
+
+    def __init__(self, failing_endpoints=(), status=None):
+        self.failing_endpoints = failing_endpoints
+        self.status = status or STATUS
+        self.commands = []
+
+    def __call__(self, cmd, **kwargs):
+        self.commands.append(cmd)
+
+        if "save" in cmd:
+            endpoint = cmd[cmd.index("--endpoints") + 1]
+            if endpoint in self.failing_endpoints:
+                raise subprocess.CalledProcessError(1, cmd, stderr=b"context deadline exceeded")
+            Path(cmd[-1]).write_bytes(b"bbolt-snapshot")
+        elif "status" in cmd:
+            return mock.Mock(returncode=0, stdout=json.dumps(self.status).encode())
+        elif "restore" in cmd:
+            data_dir = Path(cmd[cmd.index("--data-dir") + 1])
+            assert not data_dir.exists()
+            (data_dir / "member").mkdir(parents=True)
+
+        return mock.Mock(returncode=0, stdout=b"")
+
+
+@pytest.fixture(autouse=True)
+def client_binaries():
+    with mock.patch("shutil.which", side_effect=lambda name: f"/usr/local/bin/{name}"):
+        yield
+
+
+class TestEtcdBackupAdapter:
+    """Tests for EtcdBackupAdapter."""
+
+    @pytest.fixture
+    def config(self, tmp_path):
+        return EtcdConfig(
+            endpoints=["https://10.0.0.1:2379", "https://10.0.0.2:2379"],
+            ca_cert="/pki/ca.crt",
+            cert="/pki/client.crt",
+            key="/pki/client.key",
+            user="root",
+            password="secret",
+            restore_path=str(tmp_path / "restore" / "snapshot.db"),
+        )
+
+    @pytest.fixture
+    def backup_file(self, config, tmp_path):
+        adapter = EtcdBackupAdapter(config)
+        output = tmp_path / "backup"
+        output.mkdir()
+
+        with mock.patch("subprocess.run", side_effect=FakeEtcdctl()):
+            return adapter.backup(output)
+
+    def test_properties(self, config):
+        adapter = EtcdBackupAdapter(config)
+
+        assert adapter.database_name == "etcd"
+        assert adapter.file_extension == "snapshot.db.gz"
+        assert adapter.engine == "etcd"
+
+    def test_backup_records_revision_and_hash(self, config, tmp_path):
+        adapter = EtcdBackupAdapter(config)
+        fake = FakeEtcdctl()
+
+        with mock.patch("subprocess.run", side_effect=fake) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+            assert mock_run.call_args_list[0].kwargs["env"]["ETCDCTL_USER"] == "root:secret"
+
+        save = fake.commands[0]
+        assert save[save.index("--cacert") + 1] == "/pki/ca.crt"
+        assert save[save.index("--cert") + 1] == "/pki/client.crt"
+        assert "secret" not in " ".join(save)
+
+        assert adapter.backup_metadata == {
+            "engine": "etcd",
+            "compression": "gzip",
+            "compression_level": "9",
+            "revision": "48213",
+            "hash": "3015703129",
+            "total_keys": "1204",
+        }
+        with gzip.open(backup_file, "rb") as f:
+            assert f.read() == b"bbolt-snapshot"
+
+    def test_backup_falls_back_to_next_endpoint(self, config, tmp_path):
+        adapter = EtcdBackupAdapter(config)
+        fake = FakeEtcdctl(failing_endpoints=("https://10.0.0.1:2379",))
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.backup(tmp_path)
+
+        saves = [c for c in fake.commands if "save" in c]
+        assert [c[c.index("--endpoints") + 1] for c in saves] == ["https://10.0.0.1:2379", "https://10.0.0.2:2379"]
+
+    def test_backup_fails_when_all_endpoints_fail(self, config, tmp_path):
+        adapter = EtcdBackupAdapter(config)
+        fake = FakeEtcdctl(failing_endpoints=tuple(config.endpoints))
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+        assert "every endpoint" in str(exc_info.value)
+
+    def test_restore_writes_snapshot(self, config, backup_file):
+        adapter = EtcdBackupAdapter(config)
+        options = RestoreOptions(metadata={"engine": "etcd", "hash": "3015703129"})
+
+        with mock.patch("subprocess.run", side_effect=FakeEtcdctl()):
+            adapter.restore(backup_file, options)
+
+        assert Path(config.restore_path).read_bytes() == b"bbolt-snapshot"
+
+    def test_restore_rejects_hash_mismatch(self, config, backup_file):
+        adapter = EtcdBackupAdapter(config)
+        options = RestoreOptions(metadata={"engine": "etcd", "hash": "12345"})
+
+        with mock.patch("subprocess.run", side_effect=FakeEtcdctl()):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file, options)
+
+        assert "does not match" in str(exc_info.value)
+        assert not Path(config.restore_path).exists()
+
+    def test_restore_into_data_dir(self, config, backup_file, tmp_path):
+        config.restore_data_dir = str(tmp_path / "etcd-data")
+        config.restore_member_name = "etcd-0"
+        (tmp_path / "etcd-data").mkdir()
+        adapter = EtcdBackupAdapter(config)
+        fake = FakeEtcdctl()
+
+        with mock.patch("subprocess.run", side_effect=fake):
+            adapter.restore(backup_file)
+
+        restore = fake.commands[-1]
+        assert restore[1:3] == ["snapshot", "restore"]
+        assert restore[restore.index("--name") + 1] == "etcd-0"
+        assert (tmp_path / "etcd-data" / "member").is_dir()
+
+    def test_restore_refuses_non_empty_data_dir(self, config, backup_file, tmp_path):
+        data_dir = tmp_path / "etcd-data"
+        data_dir.mkdir()
+        (data_dir / "member").mkdir()
+        config.restore_data_dir = str(data_dir)
+        adapter = EtcdBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=FakeEtcdctl()):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file)
+
+        assert "non-empty" in str(exc_info.value)
@@ -0,0 +1,264 @@
+"""Tests for InfluxDB backup adapter."""
+
+import io
+import json
+import tarfile
+import urllib.error
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.influxdb import InfluxDBBackupAdapter
+from nestvault.config import InfluxDBConfig
+from nestvault.exceptions import BackupError
+
+BOUNDARY = "influx-boundary"
+
+
+def _bucket(org, name, bucket_id, shard_ids):
+    return {
+        "organizationID": f"{org}-id",
+        "organizationName": org,
+        "bucketID": bucket_id,
+        "bucketName": name,
+        "defaultRetentionPolicy": "autogen",
+        "retentionPolicies": [
+            {
+                "name": "autogen",
+                "shardGroups": [{"id": 1, "shards": [{"id": shard_id} for shard_id in shard_ids]}],
+            }
+        ],
+    }
+
+
+BUCKETS = [
+    _bucket("acme", "telegraf", "b1", [11, 12]),
+    _bucket("acme", "metrics", "b2", [21]),
+    _bucket("other", "logs", "b3", [31]),
+]
+
+
+def _multipart(parts):
+    body = b""
+    for name, payload in parts.items():
+        body += (
+            f"--{BOUNDARY}\r\n"
+            f'Content-Disposition: attachment; name="{name}"\r\n'
+            f"Content-Type: application/octet-stream\r\n\r\n"
+        ).encode() + payload + b"\r\n"
+    return body + f"--{BOUNDARY}--\r\n".encode()
+
+
+class FakeResponse(io.BytesIO):
+    """Minimal stand-in for an http.client.HTTPResponse."""
+
+    def __init__(self, body=b"", content_type="application/json"):
+        super().__init__(body)
+        self.headers = {"Content-Type": content_type}
+
+
+class FakeInfluxDB:
+    """urllib.request.urlopen side effect for the InfluxDB backup/restore API."""
+
+    def __init__(self, failures=None, missing_shards=()):
+        # Number of times each shard download fails before succeeding
+        self.failures = dict(failures or {})
+        self.missing_shards = missing_shards
+        self.requests = []
+
+    def _error(self, request, code):
+        return urllib.error.HTTPError(request.full_url, code, "error", {}, io.BytesIO(b'{"message":"boom"}'))
+
+    def __call__(self, request, timeout=None):
+        path = request.full_url.removeprefix("http://influxdb:8086")
+        self.requests.append((request.get_method(), path, request.data))
+
+        if path == "/api/v2/backup/metadata":
+            body = _multipart({"kv": b"BOLT", "sql": b"SQLITE", "buckets": json.dumps(BUCKETS).encode()})
+            return FakeResponse(body, f'multipart/mixed; boundary="{BOUNDARY}"')
+
+        if path.startswith("/api/v2/backup/shards/"):
+            shard_id = int(path.rsplit("/", 1)[1])
+            if shard_id in self.missing_shards:
+                raise self._error(request, 404)
+            if self.failures.get(shard_id):
+                self.failures[shard_id] -= 1
+                raise self._error(request, 500)
+            return FakeResponse(f"shard-{shard_id}".encode())
+
+        if path.startswith("/api/v2/orgs?org="):
+            org = path.split("=", 1)[1]
+            return FakeResponse(json.dumps({"orgs": [{"id": f"{org}-new-id", "name": org}]}).encode())
+
+        if path == "/api/v2/restore/bucketMetadata":
+            manifest = json.loads(request.data)
+            mappings = [
+                {"oldId": shard["id"], "newId": shard["id"] + 100}
+                for policy in manifest["retentionPolicies"]
+                for group in policy["shardGroups"]
+                for shard in group["shards"]
+            ]
+            return FakeResponse(json.dumps({"id": "new-bucket", "shardMappings": mappings}).encode())
+
+        if path.startswith("/api/v2/restore/"):
+            return FakeResponse()
+
+        raise AssertionError(f"Unexpected request: {path}")
+
+
+@pytest.fixture(autouse=True)
+def no_sleep():
+    with mock.patch("time.sleep"):
+        yield
+
+
+class TestInfluxDBBackupAdapter:
+    """Tests for InfluxDBBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return InfluxDBConfig(url="http://influxdb:8086", token="op-token")
+
+    def _backup(self, config, tmp_path, fake=None):
+        adapter = InfluxDBBackupAdapter(config)
+        with mock.patch("urllib.request.urlopen", side_effect=fake or FakeInfluxDB()):
+            return adapter, adapter.backup(tmp_path)
+
+    def test_properties(self, config):
+        adapter = InfluxDBBackupAdapter(config)
+
+        assert adapter.database_name == "influxdb"
+        assert adapter.file_extension == "influx.tar"
+        assert adapter.engine == "influxdb"
+
+    def test_full_backup(self, config, tmp_path):
+        fake = FakeInfluxDB()
+        _, backup_file = self._backup(config, tmp_path, fake)
+
+        with tarfile.open(backup_file) as archive:
+            names = sorted(archive.getnames())
+            manifest = json.load(archive.extractfile("manifest.json"))
+            assert archive.extractfile("shards/12.tar.gz").read() == b"shard-12"
+
+        assert names == [
+            "kv.bolt", "manifest.json", "shards/11.tar.gz", "shards/12.tar.gz",
+            "shards/21.tar.gz", "shards/31.tar.gz", "sql.sqlite",
+        ]
+        assert manifest["full"] is True
+        assert manifest["shards"] == [11, 12, 21, 31]
+        assert all(method == "GET" for method, _, _ in fake.requests)
+
+    def test_backup_sends_token(self, config, tmp_path):
+        adapter = InfluxDBBackupAdapter(config)
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeInfluxDB()) as mock_urlopen:
+            adapter.backup(tmp_path)
+
+            request = mock_urlopen.call_args_list[0][0][0]
+            assert request.get_header("Authorization") == "Token op-token"
+
+    def test_backup_specific_buckets(self, config, tmp_path):
+        config.buckets = ["metrics"]
+        adapter, backup_file = self._backup(config, tmp_path)
+
+        with tarfile.open(backup_file) as archive:
+            names = sorted(archive.getnames())
+
+        # Instance-wide metadata is left out of partial backups
+        assert names == ["manifest.json", "shards/21.tar.gz"]
+        assert adapter.backup_metadata == {"engine": "influxdb", "buckets": "metrics"}
+
+    def test_backup_scoped_to_org(self, config, tmp_path):
+        config.org = "acme"
+        adapter, _ = self._backup(config, tmp_path)
+
+        assert adapter.backup_metadata["buckets"] == "telegraf,metrics"
+
+    def test_backup_unknown_bucket(self, config, tmp_path):
+        config.buckets = ["missing"]
+
+        with pytest.raises(BackupError) as exc_info:
+            self._backup(config, tmp_path)
+
+        assert "missing" in str(exc_info.value)
+
+    def test_shard_download_is_retried(self, config, tmp_path):
+        fake = FakeInfluxDB(failures={12: 2})
+        _, backup_file = self._backup(config, tmp_path, fake)
+
+        shard_requests = [path for _, path, _ in fake.requests if path.endswith("/shards/12")]
+        assert len(shard_requests) == 3
+        with tarfile.open(backup_file) as archive:
+            assert "shards/12.tar.gz" in archive.getnames()
+
+    def test_shard_failure_fails_backup(self, config, tmp_path):
+        config.shard_retries = 1
+        fake = FakeInfluxDB(failures={12: 5})
+
+        with pytest.raises(BackupError) as exc_info:
+            self._backup(config, tmp_path, fake)
+
+        assert "shard 12 after 2 attempts" in str(exc_info.value)
+        assert list(tmp_path.glob("*.influx.tar")) == []
+
+    def test_deleted_shard_is_skipped(self, config, tmp_path):
+        fake = FakeInfluxDB(missing_shards=(11,))
+        _, backup_file = self._backup(config, tmp_path, fake)
+
+        with tarfile.open(backup_file) as archive:
+            manifest = json.load(archive.extractfile("manifest.json"))
+
+        assert manifest["shards"] == [12, 21, 31]
+
+    def test_restore_into_other_org_and_bucket(self, config, tmp_path):
+        config.buckets = ["metrics"]
+        _, backup_file = self._backup(config, tmp_path)
+
+        restore_config = InfluxDBConfig(
+            url="http://influxdb:8086", token="op-token", restore_org="staging", restore_bucket="metrics_copy"
+        )
+        fake = FakeInfluxDB()
+        with mock.patch("urllib.request.urlopen", side_effect=fake):
+            InfluxDBBackupAdapter(restore_config).restore(backup_file)
+
+        _, _, body = next(r for r in fake.requests if r[1] == "/api/v2/restore/bucketMetadata")
+        bucket = json.loads(body)
+        assert bucket["organizationID"] == "staging-new-id"
+        assert bucket["bucketName"] == "metrics_copy"
+        assert "bucketID" not in bucket
+
+        shard_uploads = [(path, data) for method, path, data in fake.requests if "/restore/shards/" in path]
+        assert shard_uploads == [("/api/v2/restore/shards/121", b"shard-21")]
+
+    def test_restore_bucket_requires_single_bucket_backup(self, config, tmp_path):
+        _, backup_file = self._backup(config, tmp_path)
+        config.restore_bucket = "copy"
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeInfluxDB()):
+            with pytest.raises(BackupError) as exc_info:
+                InfluxDBBackupAdapter(config).restore(backup_file)
+
+        assert "single bucket" in str(exc_info.value)
+
+    def test_full_restore(self, config, tmp_path):
+        _, backup_file = self._backup(config, tmp_path)
+        config.restore_full = True
+        fake = FakeInfluxDB()
+
+        with mock.patch("urllib.request.urlopen", side_effect=fake):
+            InfluxDBBackupAdapter(config).restore(backup_file)
+
+        paths = [path for method, path, _ in fake.requests if method == "POST"]
+        assert paths[:2] == ["/api/v2/restore/kv", "/api/v2/restore/sql"]
+        assert paths[2:] == [f"/api/v2/restore/shards/{shard_id}" for shard_id in (11, 12, 21, 31)]
+
+    def test_full_restore_requires_full_backup(self, config, tmp_path):
+        config.org = "acme"
+        _, backup_file = self._backup(config, tmp_path)
+        config.restore_full = True
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeInfluxDB()):
+            with pytest.raises(BackupError) as exc_info:
+                InfluxDBBackupAdapter(config).restore(backup_file)
+
+        assert "whole instance" in str(exc_info.value)
@@ -47,6 +47,10 @@ class TestMongoDBBackupAdapter:
                 assert "testdb" in backup_file.name
                 assert backup_file.name.endswith(".archive.gz")
 
+    def test_engine(self, adapter):
+        assert adapter.engine == "mongodb"
+        assert adapter.backup_metadata == {"engine": "mongodb"}
+
     def test_backup_failure(self, adapter):
         with mock.patch("subprocess.run") as mock_run:
             mock_run.side_effect = subprocess.CalledProcessError(
@@ -79,3 +83,35 @@ class TestMongoDBBackupAdapter:
                 assert "testdb" in cmd
                 assert "--archive" in cmd
                 assert "--gzip" in cmd
+
+    def test_backup_scoping_and_read_preference(self):
+        adapter = MongoDBBackupAdapter(
+            MongoDBConfig(
+                uri="mongodb://localhost:27017",
+                database="testdb",
+                collection="orders",
+                read_preference="secondary",
+            )
+        )
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(returncode=0)
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+            cmd = mock_run.call_args[0][0]
+            assert cmd[cmd.index("--collection") + 1] == "orders"
+            assert cmd[cmd.index("--readPreference") + 1] == "secondary"
+
+    def test_backup_all_databases(self):
+        adapter = MongoDBBackupAdapter(MongoDBConfig(uri="mongodb://localhost:27017"))
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(returncode=0)
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                backup_file = adapter.backup(Path(temp_dir))
+
+            assert "--db" not in mock_run.call_args[0][0]
+            assert backup_file.name.startswith("mongodb_")
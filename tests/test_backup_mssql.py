@@ -0,0 +1,208 @@
+"""Tests for SQL Server backup adapter."""
+
+import gzip
+import subprocess
+from pathlib import Path
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.mssql import MSSQLBackupAdapter
+from nestvault.config import MSSQLConfig
+from nestvault.exceptions import BackupError
+
+
+def _query(cmd):
+    """Return the query passed to sqlcmd without the SET NOCOUNT prefix."""
+    return cmd[cmd.index("-Q") + 1].removeprefix("SET NOCOUNT ON; ")
+
+
+@pytest.fixture(autouse=True)
+def client_binaries():
+    with mock.patch("shutil.which", side_effect=lambda name: f"/opt/mssql-tools18/bin/{name}"):
+        yield
+
+
+class TestMSSQLBackupAdapter:
+    """Tests for MSSQLBackupAdapter."""
+
+    @pytest.fixture
+    def shared_dir(self, tmp_path):
+        path = tmp_path / "shared"
+        path.mkdir()
+        return path
+
+    @pytest.fixture
+    def config(self, shared_dir):
+        return MSSQLConfig(
+            host="sql.example.com",
+            port=1433,
+            database="billing",
+            user="backup",
+            password="secret",
+            backup_dir="/var/opt/mssql/backup",
+            local_backup_dir=str(shared_dir),
+        )
+
+    def test_properties(self, config):
+        adapter = MSSQLBackupAdapter(config)
+
+        assert adapter.database_name == "billing"
+        assert adapter.file_extension == "bak.gz"
+        assert adapter.engine == "mssql"
+
+    def test_native_backup_is_copy_only(self, config, shared_dir, tmp_path):
+        adapter = MSSQLBackupAdapter(config)
+        queries = []
+
+        def fake_sqlcmd(cmd, **kwargs):
+            query = _query(cmd)
+            queries.append(query)
+            if "recovery_model_desc" in query:
+                return mock.Mock(stdout=b"FULL\n")
+            if query.startswith("BACKUP DATABASE"):
+                name = query.split("'")[1].rsplit("/", 1)[1]
+                (shared_dir / name).write_bytes(b"TAPE")
+            return mock.Mock(stdout=b"")
+
+        with mock.patch("subprocess.run", side_effect=fake_sqlcmd) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+            assert mock_run.call_args.kwargs["env"] == {"SQLCMDPASSWORD": "secret"}
+
+        backup_query = next(q for q in queries if q.startswith("BACKUP DATABASE"))
+        assert backup_query.startswith("BACKUP DATABASE [billing] TO DISK = N'/var/opt/mssql/backup/billing_")
+        assert "WITH COPY_ONLY, CHECKSUM" in backup_query
+
+        with gzip.open(backup_file, "rb") as f:
+            assert f.read() == b"TAPE"
+        assert list(shared_dir.iterdir()) == []
+        assert adapter.backup_metadata == {
+            "engine": "mssql",
+            "compression": "gzip",
+            "compression_level": "9",
+            "method": "native",
+            "recovery_model": "FULL",
+        }
+
+    def test_backup_missing_database(self, config, tmp_path):
+        adapter = MSSQLBackupAdapter(config)
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"")):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+            assert "does not exist" in str(exc_info.value)
+
+    def test_bacpac_backup(self, config, tmp_path):
+        config.method = "bacpac"
+        adapter = MSSQLBackupAdapter(config)
+
+        response_files = []
+
+        def fake_run(cmd, **kwargs):
+            if cmd[0].endswith("sqlpackage"):
+                response_file = Path(cmd[2].removeprefix("@"))
+                response_files.append((response_file, response_file.stat().st_mode & 0o777, response_file.read_text()))
+                Path(cmd[-1].removeprefix("/TargetFile:")).write_bytes(b"PK")
+                return mock.Mock(stdout=b"")
+            return mock.Mock(stdout=b"SIMPLE\n")
+
+        with mock.patch("subprocess.run", side_effect=fake_run) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+            cmd = mock_run.call_args[0][0]
+            assert "/Action:Export" in cmd
+            assert not any("secret" in arg for arg in cmd)
+
+        [(response_file, mode, properties)] = response_files
+        assert mode == 0o600
+        assert "/SourceDatabaseName:billing\n" in properties and "/SourcePassword:secret\n" in properties
+        assert not response_file.exists()
+
+        assert backup_file.name.endswith(".bacpac")
+        assert adapter.backup_metadata["recovery_model"] == "SIMPLE"
+
+    def test_restore_statement_moves_files(self, config):
+        config.restore_data_dir = "/var/opt/mssql/data"
+        adapter = MSSQLBackupAdapter(config)
+
+        filelist = b"billing\tD:\\Data\\billing.mdf\tD\tPRIMARY\nbilling_log\tD:\\Data\\billing_log.ldf\tL\tNULL\n"
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=filelist)):
+            statement = adapter.restore_statement("/var/opt/mssql/backup/billing.bak")
+
+        assert statement == (
+            "RESTORE DATABASE [billing] FROM DISK = N'/var/opt/mssql/backup/billing.bak' WITH "
+            "MOVE N'billing' TO N'/var/opt/mssql/data/billing_billing.mdf', "
+            "MOVE N'billing_log' TO N'/var/opt/mssql/data/billing_billing_log.ldf', "
+            "RECOVERY, STATS = 10"
+        )
+
+    def test_restore_refuses_existing_database(self, config, tmp_path):
+        adapter = MSSQLBackupAdapter(config)
+        backup_file = tmp_path / "billing_20240115_120000.bak.gz"
+        backup_file.write_bytes(gzip.compress(b"TAPE"))
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"5\n")):
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file)
+
+            assert "--force" in str(exc_info.value)
+
+    def test_restore_runs_statement_with_data_dir(self, config, shared_dir, tmp_path):
+        config.restore_data_dir = "/var/opt/mssql/data"
+        adapter = MSSQLBackupAdapter(config)
+        backup_file = tmp_path / "billing_20240115_120000.bak.gz"
+        backup_file.write_bytes(gzip.compress(b"TAPE"))
+        queries = []
+
+        def fake_sqlcmd(cmd, **kwargs):
+            query = _query(cmd)
+            queries.append(query)
+            if query.startswith("SELECT DB_ID"):
+                return mock.Mock(stdout=b"5\n")
+            if query.startswith("RESTORE FILELISTONLY"):
+                assert (shared_dir / "billing_20240115_120000.bak").read_bytes() == b"TAPE"
+                return mock.Mock(stdout=b"billing\t/data/billing.mdf\tD\n")
+            return mock.Mock(stdout=b"")
+
+        with mock.patch("subprocess.run", side_effect=fake_sqlcmd):
+            adapter.restore(backup_file, RestoreOptions(force=True))
+
+        assert queries[-1].startswith("RESTORE DATABASE [billing]")
+        assert queries[-1].endswith("REPLACE")
+        assert list(shared_dir.iterdir()) == []
+
+    def test_restore_without_data_dir_keeps_recorded_paths(self, config, shared_dir, tmp_path):
+        adapter = MSSQLBackupAdapter(config)
+        backup_file = tmp_path / "billing_20240115_120000.bak.gz"
+        backup_file.write_bytes(gzip.compress(b"TAPE"))
+        queries = []
+
+        def fake_sqlcmd(cmd, **kwargs):
+            query = _query(cmd)
+            queries.append(query)
+            if query.startswith("RESTORE FILELISTONLY"):
+                return mock.Mock(stdout=b"billing\t/data/billing.mdf\tD\n")
+            if query.startswith("RESTORE DATABASE"):
+                raise subprocess.CalledProcessError(1, "sqlcmd", stderr=b"Directory lookup for the file failed")
+            return mock.Mock(stdout=b"NULL\n")
+
+        with mock.patch("subprocess.run", side_effect=fake_sqlcmd):
+            with pytest.raises(BackupError, match="Directory lookup"):
+                adapter.restore(backup_file)
+
+        assert "MOVE N'billing' TO N'/data/billing.mdf'" in queries[-1]
+        assert list(shared_dir.iterdir()) == []
+
+    def test_sqlcmd_failure(self, config, tmp_path):
+        adapter = MSSQLBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(1, "sqlcmd", stderr=b"Login failed")
+
+            with pytest.raises(BackupError) as exc_info:
+                adapter.backup(tmp_path)
+
+            assert "Login failed" in str(exc_info.value)
@@ -0,0 +1,140 @@
+"""Tests for MySQL backup adapter."""
+
+import gzip
+import subprocess
+import tempfile
+from pathlib import Path
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.mysql import MySQLBackupAdapter
+from nestvault.backup.base import RestoreOptions
+from nestvault.config import CompressionConfig, MySQLConfig
+from nestvault.exceptions import BackupError
+
+
+class TestMySQLBackupAdapter:
+    """Tests for MySQLBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return MySQLConfig(
+            host="localhost",
+            port=3306,
+            database="testdb",
+            user="testuser",
+            password="testpass",
+        )
+
+    @pytest.fixture
+    def adapter(self, config):
+        return MySQLBackupAdapter(config)
+
+    @pytest.fixture
+    def mysqldump_only(self):
+        with mock.patch("shutil.which") as mock_which:
+            mock_which.side_effect = lambda name: f"/usr/bin/{name}" if name in ("mysqldump", "mysql") else None
+            yield mock_which
+
+    def test_database_name(self, adapter):
+        assert adapter.database_name == "testdb"
+
+    def test_file_extension(self, adapter):
+        assert adapter.file_extension == "sql.gz"
+
+    def test_backup_success(self, adapter, mysqldump_only):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(
+                stdout=b"-- MySQL dump\nCREATE TABLE test;",
+                returncode=0,
+            )
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                backup_file = adapter.backup(Path(temp_dir))
+
+                assert backup_file.exists()
+                assert backup_file.name.endswith(".sql.gz")
+                assert "testdb" in backup_file.name
+
+    def test_backup_command_args(self, adapter, mysqldump_only):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"", returncode=0)
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+                cmd = mock_run.call_args[0][0]
+                env = mock_run.call_args[1]["env"]
+
+                assert cmd[0] == "mysqldump"
+                assert "--single-transaction" in cmd
+                assert cmd[-1] == "testdb"
+                assert "testpass" not in cmd
+                assert env["MYSQL_PWD"] == "testpass"
+
+    def test_prefers_mariadb_dump(self, adapter):
+        with mock.patch("shutil.which", return_value="/usr/bin/mariadb-dump"):
+            with mock.patch("subprocess.run") as mock_run:
+                mock_run.return_value = mock.Mock(stdout=b"", returncode=0)
+
+                with tempfile.TemporaryDirectory() as temp_dir:
+                    adapter.backup(Path(temp_dir))
+
+                assert mock_run.call_args[0][0][0] == "mariadb-dump"
+
+    def test_backup_without_single_transaction(self, config, mysqldump_only):
+        config.single_transaction = False
+        adapter = MySQLBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"", returncode=0)
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+            assert "--single-transaction" not in mock_run.call_args[0][0]
+
+    def test_missing_dump_binary(self, adapter):
+        with mock.patch("shutil.which", return_value=None):
+            with tempfile.TemporaryDirectory() as temp_dir:
+                with pytest.raises(BackupError) as exc_info:
+                    adapter.backup(Path(temp_dir))
+
+                assert "mysqldump" in str(exc_info.value)
+
+    def test_backup_failure(self, adapter, mysqldump_only):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(
+                returncode=2,
+                cmd=["mysqldump"],
+                stderr=b"Access denied for user",
+            )
+
+            with tempfile.TemporaryDirectory() as temp_dir:
+                with pytest.raises(BackupError) as exc_info:
+                    adapter.backup(Path(temp_dir))
+
+                assert "Access denied" in str(exc_info.value)
+
+    def test_zstd_backup(self, config, mysqldump_only, tmp_path):
+        config.compression = CompressionConfig(algorithm="zstd")
+        adapter = MySQLBackupAdapter(config)
+
+        with mock.patch("subprocess.run"):
+            backup_file = adapter.backup(tmp_path)
+
+        assert backup_file.name.endswith(".sql.zst")
+        assert backup_file.read_bytes().startswith(b"\x28\xb5\x2f\xfd")
+        assert adapter.backup_metadata == {"engine": "mysql", "compression": "zstd", "compression_level": "3"}
+
+    def test_restore_detects_gzip_backup(self, config, mysqldump_only, tmp_path):
+        config.compression = CompressionConfig(algorithm="zstd")
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        with gzip.open(backup_file, "wb") as f:
+            f.write(b"SELECT 1;")
+
+        with mock.patch("subprocess.run") as mock_run:
+            MySQLBackupAdapter(config).restore(backup_file, RestoreOptions(metadata={"engine": "mysql"}))
+
+        assert mock_run.call_args[1]["input"] == b"SELECT 1;"
@@ -1,15 +1,28 @@
 """Tests for PostgreSQL backup adapter."""
 
+import gzip
 import subprocess
+import tarfile
 import tempfile
+from dataclasses import replace
 from pathlib import Path
 from unittest import mock
 
 import pytest
 
-from nestvault.backup.postgres import PostgresBackupAdapter
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.postgres import (
+    PostgresBackupAdapter,
+    command_line,
+    dump_scope_of,
+    filter_databases,
+    format_mismatch,
+    schema_sha256,
+    table_args,
+)
 from nestvault.config import PostgresConfig
 from nestvault.exceptions import BackupError
+from nestvault.progress import Progress
 
 
 class TestPostgresBackupAdapter:
@@ -50,6 +63,35 @@ class TestPostgresBackupAdapter:
                 assert backup_file.suffix == ".gz"
                 assert "testdb" in backup_file.name
 
+    def test_database_size(self, adapter):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"8405487\n", returncode=0)
+
+            assert adapter.database_size() == 8405487
+            assert "pg_database_size(current_database())" in mock_run.call_args.args[0][-1]
+
+    def test_database_size_unknown_when_query_fails(self, adapter):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(returncode=2, cmd=["psql"])
+
+            assert adapter.database_size() is None
+
+    def test_fingerprint_changes_with_row_counters(self, adapter):
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"16384 10 2 0\ncatalog 731 702\n", returncode=0)
+            before = adapter.fingerprint()
+            mock_run.return_value = mock.Mock(stdout=b"16384 11 2 0\ncatalog 731 702\n", returncode=0)
+
+            assert before != adapter.fingerprint()
+            assert "pg_stat_user_tables" in mock_run.call_args.args[0][-1]
+
+    def test_fingerprint_unknown_for_physical_backups(self, config):
+        adapter = PostgresBackupAdapter(replace(config, mode="physical"))
+
+        with mock.patch("subprocess.run") as mock_run:
+            assert adapter.fingerprint() is None
+        mock_run.assert_not_called()
+
     def test_backup_failure(self, adapter):
         with mock.patch("subprocess.run") as mock_run:
             mock_run.side_effect = subprocess.CalledProcessError(
@@ -81,3 +123,852 @@ class TestPostgresBackupAdapter:
                 assert "localhost" in cmd
                 assert "-d" in cmd
                 assert "testdb" in cmd
+
+    def test_table_patterns_passed_and_recorded(self, config):
+        config.include_tables = ["public.*"]
+        config.exclude_tables = ["*.events", "public.audit_*"]
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"", returncode=0)
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[-6:] == ["-t", "public.*", "-T", "*.events", "-T", "public.audit_*"]
+        assert adapter.backup_metadata["include_tables"] == "public.*"
+        assert adapter.backup_metadata["exclude_tables"] == "*.events,public.audit_*"
+
+    def test_extra_dump_args_appended_and_recorded(self, config):
+        config.dump_format = "custom"
+        config.extra_dump_args = ["--no-owner", "--exclude-table-data", "audit.*"]
+        adapter = PostgresBackupAdapter(config)
+
+        def fake_dump(cmd, **kwargs):
+            Path(cmd[cmd.index("-f") + 1]).write_bytes(b"PGDMP")
+
+        with mock.patch("subprocess.run", side_effect=fake_dump) as mock_run:
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[-6:-2] == ["-Fc", "--no-owner", "--exclude-table-data", "audit.*"]
+        recorded = adapter.backup_metadata["dump_command"]
+        assert recorded.startswith("pg_dump -h localhost -p 5432 -U testuser -d testdb")
+        assert recorded.endswith("-Fc --no-owner --exclude-table-data 'audit.*'")
+
+    def test_command_line_masks_passwords(self):
+        cmd = ["pg_dump", "--dbname=postgresql://app:s3cret@db/app", "--comment=testpass"]
+
+        assert command_line(cmd, "testpass") == "pg_dump --dbname=postgresql://app:***@db/app --comment=***"
+
+    def test_tls_settings_passed_to_client_tools(self, config):
+        adapter = PostgresBackupAdapter(replace(config, sslmode="verify-full", sslrootcert="/certs/ca.pem"))
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"16.2\n", returncode=0)) as mock_run:
+            adapter.server_version()
+
+        assert mock_run.call_args[1]["env"] == {
+            "PGPASSWORD": "testpass",
+            "PGSSLMODE": "verify-full",
+            "PGSSLROOTCERT": "/certs/ca.pem",
+        }
+        assert adapter.dsn.endswith("/testdb?sslmode=verify-full&sslrootcert=%2Fcerts%2Fca.pem")
+
+    def test_connects_through_the_tunnel_port(self, config):
+        adapter = PostgresBackupAdapter(config)
+        adapter.use_tunnel(40123)
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"16.2\n", returncode=0)) as mock_run:
+            adapter.for_database("other").server_version()
+        adapter.use_tunnel(None)
+
+        cmd, env = mock_run.call_args[0][0], mock_run.call_args[1]["env"]
+        assert cmd[1:5] == ["-h", "localhost", "-p", "40123"]
+        assert env["PGHOSTADDR"] == "127.0.0.1"
+        assert adapter.dsn == "postgresql://testuser@localhost:5432/testdb"
+        assert "PGHOSTADDR" not in adapter._env()
+
+    def test_check_tls_returns_certificate_subject(self, config):
+        adapter = PostgresBackupAdapter(replace(config, sslmode="require"))
+        sock = mock.MagicMock()
+        sock.__enter__.return_value.recv.return_value = b"S"
+
+        with (
+            mock.patch("socket.create_connection", return_value=sock),
+            mock.patch("ssl.SSLContext") as context,
+            mock.patch("nestvault.backup.postgres.x509") as x509,
+        ):
+            x509.load_der_x509_certificate.return_value.subject.rfc4514_string.return_value = "CN=db.internal"
+            assert adapter.check_tls() == "CN=db.internal"
+
+        sock.__enter__.return_value.sendall.assert_called_once_with(b"\x00\x00\x00\x08\x04\xd2\x16\x2f")
+        context.return_value.load_verify_locations.assert_not_called()
+
+    def test_check_tls_fails_when_server_refuses_required_tls(self, config):
+        adapter = PostgresBackupAdapter(replace(config, sslmode="verify-ca", sslrootcert="/certs/ca.pem"))
+        sock = mock.MagicMock()
+        sock.__enter__.return_value.recv.return_value = b"N"
+
+        with mock.patch("socket.create_connection", return_value=sock), mock.patch("ssl.SSLContext"):
+            with pytest.raises(BackupError, match="does not offer TLS, which sslmode verify-ca requires"):
+                adapter.check_tls()
+
+    def test_check_tls_skipped_without_encryption(self, config):
+        with mock.patch("socket.create_connection") as connect:
+            assert PostgresBackupAdapter(replace(config, sslmode="disable")).check_tls() is None
+            assert PostgresBackupAdapter(replace(config, host="/var/run/postgresql")).check_tls() is None
+
+        connect.assert_not_called()
+
+
+def _fake_basebackup(cmd, **kwargs):
+    """Write base.tar and pg_wal.tar like pg_basebackup --format=tar does."""
+    target = Path(cmd[cmd.index("-D") + 1])
+    parts = {
+        "base.tar": {
+            "PG_VERSION": "16",
+            "backup_label": (
+                "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\nCHECKPOINT LOCATION: 0/2000060\n"
+            ),
+        },
+        "pg_wal.tar": {"000000010000000000000002": "16"},
+    }
+
+    for name, members in parts.items():
+        with tarfile.open(target / name, "w") as archive:
+            for member, content in members.items():
+                source = target / member
+                source.write_text(content)
+                archive.add(source, arcname=member)
+                source.unlink()
+
+    return mock.Mock(returncode=0)
+
+
+class TestPostgresPhysicalBackup:
+    """Tests for pg_basebackup based physical backups."""
+
+    @pytest.fixture
+    def config(self):
+        return PostgresConfig(
+            host="localhost",
+            port=5432,
+            database="testdb",
+            user="replicator",
+            password="testpass",
+            mode="physical",
+            checkpoint="spread",
+            max_rate="100M",
+        )
+
+    def test_file_extension_and_metadata(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        assert adapter.file_extension == "tar.gz"
+        assert adapter.backup_metadata == {"engine": "postgres", "mode": "physical"}
+
+    def test_backup_command_args(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=_fake_basebackup) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[0] == "pg_basebackup"
+        assert "--format=tar" in cmd
+        assert "--wal-method=stream" in cmd
+        assert "--checkpoint=spread" in cmd
+        assert "--max-rate=100M" in cmd
+
+        with tarfile.open(backup_file) as bundle:
+            assert sorted(bundle.getnames()) == ["base.tar", "pg_wal.tar"]
+
+    def test_wal_start_recorded_from_backup_label(self, config, tmp_path):
+        config.wal_archive = True
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=_fake_basebackup):
+            adapter.backup(tmp_path)
+
+        assert adapter.archives_wal is True
+        assert adapter.backup_metadata["wal_start"] == "000000010000000000000002"
+
+    def test_restore_extracts_into_data_dir(self, config, tmp_path):
+        config.restore_data_dir = str(tmp_path / "pgdata")
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=_fake_basebackup):
+            backup_file = adapter.backup(tmp_path)
+
+        adapter.restore(backup_file, RestoreOptions(metadata=adapter.backup_metadata))
+
+        assert (tmp_path / "pgdata" / "PG_VERSION").read_text() == "16"
+        assert (tmp_path / "pgdata" / "pg_wal" / "000000010000000000000002").exists()
+
+    def test_restore_writes_recovery_settings(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=_fake_basebackup):
+            backup_file = adapter.backup(tmp_path)
+
+        data_dir = tmp_path / "pitr" / "data"
+        options = RestoreOptions(
+            metadata=adapter.backup_metadata,
+            data_dir=data_dir,
+            recovery={"restore_command": "nestvault wal-fetch %f %p", "recovery_target_time": "2024-06-01 14:32:00"},
+        )
+        adapter.restore(backup_file, options)
+
+        assert (data_dir / "recovery.signal").exists()
+        auto_conf = (data_dir / "postgresql.auto.conf").read_text()
+        assert "restore_command = 'nestvault wal-fetch %f %p'" in auto_conf
+        assert "recovery_target_time = '2024-06-01 14:32:00'" in auto_conf
+
+    def test_restore_refuses_non_empty_data_dir(self, config, tmp_path):
+        data_dir = tmp_path / "pgdata"
+        data_dir.mkdir()
+        (data_dir / "postmaster.pid").write_text("123")
+        config.restore_data_dir = str(data_dir)
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", side_effect=_fake_basebackup):
+            backup_file = adapter.backup(tmp_path)
+
+        with pytest.raises(BackupError) as exc_info:
+            adapter.restore(backup_file, RestoreOptions(metadata={"mode": "physical"}))
+
+        assert "non-empty" in str(exc_info.value)
+
+    def test_physical_backup_not_replayed_with_psql(self, tmp_path):
+        adapter = PostgresBackupAdapter(
+            PostgresConfig(host="localhost", port=5432, database="testdb", user="u", password="p")
+        )
+        backup_file = tmp_path / "testdb_20240115_120000.tar.gz"
+        backup_file.write_bytes(b"")
+
+        with mock.patch("subprocess.run") as mock_run:
+            with pytest.raises(BackupError) as exc_info:
+                adapter.restore(backup_file, RestoreOptions(metadata={"mode": "physical"}))
+
+        assert "PG_RESTORE_DATA_DIR" in str(exc_info.value)
+        mock_run.assert_not_called()
+
+
+class TestPostgresDumpFormats:
+    """Tests for custom and directory pg_dump formats."""
+
+    @pytest.fixture
+    def config(self):
+        return PostgresConfig(
+            host="localhost",
+            port=5432,
+            database="testdb",
+            user="testuser",
+            password="testpass",
+        )
+
+    def test_custom_format_backup(self, config, tmp_path):
+        config.dump_format = "custom"
+        config.dump_compress = 0
+        adapter = PostgresBackupAdapter(config)
+
+        def fake_dump(cmd, **kwargs):
+            Path(cmd[cmd.index("-f") + 1]).write_bytes(b"PGDMP")
+            return mock.Mock(returncode=0)
+
+        with mock.patch("subprocess.run", side_effect=fake_dump) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+        cmd = mock_run.call_args[0][0]
+        assert "-Fc" in cmd
+        assert cmd[cmd.index("-Z") + 1] == "0"
+        assert backup_file.name.endswith(".dump")
+        assert adapter.backup_metadata["format"] == "custom"
+
+    def test_stream_plain_dump(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("nestvault.backup.postgres.command_output", return_value=(chunk for chunk in [b"SELECT 1;"])) as mock_output:
+            with adapter.stream_backup() as (name, stream):
+                data = stream.read()
+
+        assert name.startswith("testdb_") and name.endswith(".sql.gz")
+        assert gzip.decompress(data) == b"SELECT 1;"
+        assert mock_output.call_args[0][0][0] == "pg_dump"
+
+    def test_stream_custom_dump(self, config):
+        config.dump_format = "custom"
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("nestvault.backup.postgres.command_output", return_value=(chunk for chunk in [b"PGDMP"])) as mock_output:
+            with adapter.stream_backup() as (name, stream):
+                assert stream.read() == b"PGDMP"
+
+        assert "-Fc" in mock_output.call_args[0][0]
+        assert "-f" not in mock_output.call_args[0][0]
+        assert name.endswith(".dump")
+
+    def test_directory_format_cannot_stream(self, config):
+        config.dump_format = "directory"
+        adapter = PostgresBackupAdapter(config)
+
+        assert adapter.supports_streaming is False
+        with pytest.raises(BackupError):
+            with adapter.stream_backup():
+                pass
+
+    def test_directory_format_backup(self, config, tmp_path):
+        config.dump_format = "directory"
+        config.dump_jobs = 4
+        adapter = PostgresBackupAdapter(config)
+
+        def fake_dump(cmd, **kwargs):
+            dump_dir = Path(cmd[cmd.index("-f") + 1])
+            dump_dir.mkdir()
+            (dump_dir / "toc.dat").write_bytes(b"PGDMP")
+            return mock.Mock(returncode=0)
+
+        with mock.patch("subprocess.run", side_effect=fake_dump) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+        cmd = mock_run.call_args[0][0]
+        assert "-Fd" in cmd
+        assert cmd[cmd.index("-j") + 1] == "4"
+        assert backup_file.name.endswith(".dir.tar")
+
+        with tarfile.open(backup_file) as archive:
+            assert "dump/toc.dat" in archive.getnames()
+
+    def test_restore_uses_pg_restore_for_recorded_format(self, config, tmp_path):
+        config.restore_jobs = 3
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file, RestoreOptions(metadata={"mode": "logical", "format": "custom"}))
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[0] == "pg_restore"
+        assert cmd[cmd.index("-j") + 1] == "3"
+        assert cmd[-1] == str(backup_file)
+
+    def test_restore_appends_extra_restore_args(self, config, tmp_path):
+        config.extra_restore_args = ["--no-owner", "--single-transaction"]
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file, RestoreOptions(metadata={"mode": "logical", "format": "custom"}))
+
+        assert mock_run.call_args[0][0][-3:] == ["--no-owner", "--single-transaction", str(backup_file)]
+
+    def test_restore_without_owner_and_with_session_timeouts(self, config, tmp_path):
+        config.restore_no_owner = True
+        config.restore_no_acl = True
+        config.restore_statement_timeout = "30min"
+        config.restore_lock_timeout = "10s"
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file, RestoreOptions(metadata={"mode": "logical", "format": "custom"}))
+
+        cmd = mock_run.call_args[0][0]
+        assert "--no-owner" in cmd and "--no-acl" in cmd
+        assert mock_run.call_args[1]["env"]["PGOPTIONS"] == "-c statement_timeout=30min -c lock_timeout=10s"
+
+    def test_restore_directory_dump_without_metadata(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        dump_dir = tmp_path / "dump"
+        dump_dir.mkdir()
+        (dump_dir / "toc.dat").write_bytes(b"PGDMP")
+        backup_file = tmp_path / "testdb_20240115_120000.dir.tar"
+        with tarfile.open(backup_file, "w") as archive:
+            archive.add(dump_dir, arcname="dump")
+
+        def fake_restore(cmd, **kwargs):
+            assert (Path(cmd[-1]) / "toc.dat").exists()
+            return mock.Mock(returncode=0)
+
+        with mock.patch("subprocess.run", side_effect=fake_restore) as mock_run:
+            adapter.restore(backup_file)
+
+        assert mock_run.call_args[0][0][0] == "pg_restore"
+
+    def test_restore_selected_tables(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+        options = RestoreOptions(
+            metadata={"mode": "logical", "format": "custom"}, tables=["public.users", "public.orders"]
+        )
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file, options)
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[cmd.index("-n"):-1] == ["-n", "public", "-t", "users", "-t", "orders"]
+
+    def test_clean_restore_drops_objects_first(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+        options = RestoreOptions(metadata={"mode": "logical", "format": "custom"}, clean=True)
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file, options)
+
+        cmd = mock_run.call_args[0][0]
+        assert cmd[cmd.index("--clean"):cmd.index("--clean") + 2] == ["--clean", "--if-exists"]
+
+    def test_clean_restore_refuses_plain_dump(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        backup_file.write_bytes(gzip.compress(b"SELECT 1;"))
+        options = RestoreOptions(metadata={"mode": "logical", "format": "plain"}, clean=True)
+
+        with mock.patch("subprocess.run") as mock_run:
+            with pytest.raises(BackupError, match="--drop-existing"):
+                adapter.restore(backup_file, options)
+
+        mock_run.assert_not_called()
+
+    def test_restore_counts_tables_with_progress(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+        toc = b"215; 1259 16386 TABLE public users postgres\n3361; 0 16386 TABLE DATA public users postgres\n"
+        progress = Progress("restore")
+        options = RestoreOptions(metadata={"mode": "logical", "format": "custom"}, progress=progress)
+
+        def fake_run(cmd, env, description, on_stderr):
+            assert on_stderr(b"pg_restore: creating TABLE \"public.users\"\n") is False
+            assert on_stderr(b'pg_restore: processing data for table "public.users"\n') is False
+            assert on_stderr(b"pg_restore: error: could not execute query\n") is True
+            return b""
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=toc)) as mock_run, mock.patch(
+            "nestvault.backup.postgres.command_run", side_effect=fake_run
+        ) as mock_command:
+            adapter.restore(backup_file, options)
+
+        assert mock_run.call_args[0][0] == ["pg_restore", "--list", str(backup_file)]
+        assert mock_command.call_args[0][0][:2] == ["pg_restore", "--verbose"]
+        assert (progress.done, progress.total, progress.unit) == (1, 1, "tables")
+
+    def test_table_args(self):
+        assert table_args([]) == []
+        assert table_args(["users"]) == ["-t", "users"]
+        with pytest.raises(ValueError, match="different schemas"):
+            table_args(["public.users", "audit.events"])
+        with pytest.raises(ValueError, match="different schemas"):
+            table_args(["public.users", "events"])
+
+    def test_selective_restore_refuses_plain_dump(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        backup_file.write_bytes(gzip.compress(b"SELECT 1;"))
+        options = RestoreOptions(metadata={"mode": "logical", "format": "plain"}, tables=["users"])
+
+        with mock.patch("subprocess.run") as mock_run:
+            with pytest.raises(BackupError, match="PG_DUMP_FORMAT=custom"):
+                adapter.restore(backup_file, options)
+            with pytest.raises(BackupError, match="PG_DUMP_FORMAT=custom"):
+                adapter.restore_stream(backup_file.name, mock.Mock(), options)
+
+        mock_run.assert_not_called()
+
+    def test_list_contents_of_custom_dump(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(b"PGDMP")
+        toc = b"215; 1259 16386 TABLE public users postgres\n"
+        options = RestoreOptions(metadata={"mode": "logical", "format": "custom"}, list_contents=True)
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=toc, returncode=0)) as mock_run:
+            adapter.restore(backup_file, options)
+
+        assert mock_run.call_args[0][0] == ["pg_restore", "--list", str(backup_file)]
+        assert options.contents == toc.decode()
+
+    def test_plain_restore_uses_psql(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        with gzip.open(backup_file, "wb") as f:
+            f.write(b"SELECT 1;")
+
+        with mock.patch("subprocess.run") as mock_run:
+            adapter.restore(backup_file)
+
+        assert mock_run.call_args[0][0][0] == "psql"
+        assert mock_run.call_args[1]["input"] == b"SELECT 1;"
+
+    def test_restore_creates_database(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(replace(config, database='app "copy"'))
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        backup_file.write_bytes(gzip.compress(b"SELECT 1;"))
+        options = RestoreOptions(create_database=True, drop_existing=True)
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"", returncode=0)) as mock_run:
+            adapter.restore(backup_file, options)
+
+        statements = [call[0][0][-1] for call in mock_run.call_args_list[:3]]
+        assert statements == [
+            'DROP DATABASE IF EXISTS "app ""copy"""',
+            "SELECT 1 FROM pg_database WHERE datname = 'app \"copy\"'",
+            'CREATE DATABASE "app ""copy"""',
+        ]
+        assert mock_run.call_args[0][0][0] == "psql"
+
+    def test_restore_into_existing_database_skips_create(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        backup_file.write_bytes(gzip.compress(b"SELECT 1;"))
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"1", returncode=0)) as mock_run:
+            adapter.restore(backup_file, RestoreOptions(create_database=True))
+
+        assert not any("CREATE DATABASE" in " ".join(call[0][0]) for call in mock_run.call_args_list)
+        assert adapter.location == "localhost:5432/testdb"
+
+    def test_dsn_leaves_out_the_password(self, config):
+        config.user = "app user"
+        adapter = PostgresBackupAdapter(config)
+
+        assert adapter.dsn == "postgresql://app%20user@localhost:5432/testdb"
+        assert config.password not in adapter.dsn
+
+    def test_query_and_drop_database(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"t\n", returncode=0)) as mock_run:
+            assert adapter.query("SELECT count(*) > 0 FROM todos") == "t"
+            adapter.drop_database()
+
+        query, drop = (call[0][0] for call in mock_run.call_args_list)
+        assert query[query.index("-d") + 1] == "testdb"
+        assert drop[drop.index("-d") + 1] == "postgres"
+        assert drop[-1] == 'DROP DATABASE IF EXISTS "testdb"'
+
+    def test_restore_commands_mask_the_password(self, config):
+        config.password = "s3cret"
+        adapter = PostgresBackupAdapter(config)
+        options = RestoreOptions(
+            metadata={"mode": "logical", "format": "custom"}, create_database=True, tables=["public.users"]
+        )
+
+        create, restore = adapter.restore_commands("db_20240115_120000.dump", options, streamed=True)
+
+        assert "CREATE DATABASE" in create and "unless it exists" in create
+        assert restore.startswith("pg_restore -h localhost")
+        assert restore.endswith("-n public -t users < db_20240115_120000.dump")
+        assert "s3cret" not in create + restore
+
+        with pytest.raises(BackupError, match="PG_DUMP_FORMAT=custom"):
+            adapter.restore_commands("db.sql.gz", RestoreOptions(tables=["public.users"]), streamed=False)
+
+    def test_inspect_destination(self, config):
+        adapter = PostgresBackupAdapter(config)
+        results = [mock.Mock(stdout=b"1\n", returncode=0), mock.Mock(stdout=b"12\n", returncode=0)]
+
+        with mock.patch("subprocess.run", side_effect=results):
+            state = adapter.inspect_destination()
+        assert state.describe() == "exists, 12 tables"
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"", returncode=0)):
+            assert adapter.inspect_destination().describe() == "does not exist"
+
+    def test_streaming_restore_of_plain_and_custom_dumps(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        assert adapter.supports_streaming_restore({"mode": "logical", "format": "plain"}) is True
+        assert adapter.supports_streaming_restore({"mode": "logical", "format": "custom"}) is True
+        assert adapter.supports_streaming_restore({"mode": "logical", "format": "directory"}) is False
+        assert adapter.supports_streaming_restore({"mode": "physical"}) is False
+        assert adapter.supports_streaming_restore({}) is False
+
+        config.restore_jobs = 4
+        assert adapter.supports_streaming_restore({"mode": "logical", "format": "custom"}) is False
+
+    def test_restore_stream_decompresses_into_psql(self, config):
+        import io
+
+        adapter = PostgresBackupAdapter(config)
+        metadata = {"mode": "logical", "format": "plain", "compression": "gzip"}
+
+        def fake_input(cmd, env, source, description, on_stderr=None):
+            assert source.read() == b"SELECT 1;"
+            return b""
+
+        stream = io.BytesIO(gzip.compress(b"SELECT 1;"))
+        with mock.patch("nestvault.backup.postgres.command_input", side_effect=fake_input) as mock_input:
+            adapter.restore_stream("testdb_20240115_120000.sql.gz", stream, RestoreOptions(metadata=metadata))
+
+        assert mock_input.call_args[0][0][0] == "psql"
+
+    def test_restore_stream_pipes_custom_dump_into_pg_restore(self, config):
+        import io
+
+        config.extra_restore_args = ["--no-owner"]
+        adapter = PostgresBackupAdapter(config)
+        stream = io.BytesIO(b"PGDMP dump")
+
+        def fake_input(cmd, env, source, description, on_stderr=None):
+            # The header read to check the format is fed to pg_restore with the rest
+            assert source.read() == b"PGDMP dump"
+            return b""
+
+        with mock.patch("nestvault.backup.postgres.command_input", side_effect=fake_input) as mock_input:
+            adapter.restore_stream(
+                "testdb_20240115_120000.dump", stream, RestoreOptions(metadata={"mode": "logical", "format": "custom"})
+            )
+
+        cmd = mock_input.call_args[0][0]
+        assert cmd[0] == "pg_restore" and "-j" not in cmd
+        assert cmd[-1] == "--no-owner"
+        assert stream.closed
+
+    def test_restore_refuses_dump_contradicting_its_format(self, config, tmp_path):
+        import io
+
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.dump"
+        backup_file.write_bytes(gzip.compress(b"SELECT 1;"))
+        custom = RestoreOptions(metadata={"mode": "logical", "format": "custom"})
+        mysql = gzip.compress(b"-- MySQL dump 10.13  Distrib 8.0.36\n")
+        plain = RestoreOptions(metadata={"mode": "logical", "format": "plain", "compression": "gzip"})
+
+        with mock.patch("subprocess.run") as mock_run, mock.patch(
+            "nestvault.backup.postgres.command_input"
+        ) as mock_input:
+            with pytest.raises(BackupError, match="does not start with the PGDMP header"):
+                adapter.restore(backup_file, custom)
+            with pytest.raises(BackupError, match="it is a MySQL dump; pass --ignore-engine-mismatch"):
+                adapter.restore_stream("testdb_20240115_120000.sql.gz", io.BytesIO(mysql), plain)
+            mock_run.assert_not_called()
+            mock_input.assert_not_called()
+
+            custom.ignore_mismatch = True
+            adapter.restore(backup_file, custom)
+            mock_run.assert_called_once()
+
+    def test_format_mismatch(self):
+        import io
+        import tarfile
+
+        tarball = io.BytesIO()
+        with tarfile.open(fileobj=tarball, mode="w") as archive:
+            archive.addfile(tarfile.TarInfo("dump"))
+
+        assert format_mismatch(b"PGDMP\x01\x0e", "custom") is None
+        assert format_mismatch(tarball.getvalue()[:512], "directory") is None
+        assert format_mismatch(b"PGDMP", "directory") is not None
+        assert format_mismatch(b"--\n-- PostgreSQL database dump\n", "plain") is None
+        assert format_mismatch(b"PGDMP", "plain") == "it is a custom format dump"
+        assert format_mismatch(b"-- MariaDB dump 10.19\n", "plain") == "it is a MySQL dump"
+
+
+class TestPostgresDumpScopes:
+    """Tests for schema-only and data-only dumps."""
+
+    @pytest.fixture
+    def config(self):
+        return PostgresConfig(host="localhost", port=5432, database="testdb", user="testuser", password="testpass")
+
+    def test_schema_only_dump(self, config, tmp_path):
+        config.dump_scope = "schema-only"
+        adapter = PostgresBackupAdapter(config)
+
+        dump = mock.Mock(stdout=b"CREATE TABLE t ();", returncode=0)
+        with mock.patch("subprocess.run", return_value=dump) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+        assert mock_run.call_count == 1
+        assert "--schema-only" in mock_run.call_args[0][0]
+        assert backup_file.name.endswith(".schema.sql.gz")
+        assert adapter.backup_metadata["dump_scope"] == "schema-only"
+        assert "schema_sha256" not in adapter.backup_metadata
+
+    def test_data_only_dump_records_schema_hash(self, config, tmp_path):
+        config.dump_scope = "data-only"
+        adapter = PostgresBackupAdapter(config)
+        schema = b"-- Dumped by pg_dump version 16.2\nCREATE TABLE t ();\n"
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=schema, returncode=0)) as mock_run:
+            backup_file = adapter.backup(tmp_path)
+
+        schema_cmd, dump_cmd = (call[0][0] for call in mock_run.call_args_list)
+        assert "--schema-only" in schema_cmd
+        assert "--data-only" in dump_cmd
+        assert backup_file.name.endswith(".data.sql.gz")
+        assert adapter.backup_metadata["schema_sha256"] == schema_sha256(b"CREATE TABLE t ();")
+
+    def test_restore_warns_on_changed_schema(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+        backup_file = tmp_path / "testdb_20240115_120000.data.sql.gz"
+        backup_file.write_bytes(gzip.compress(b"COPY t FROM stdin;"))
+        metadata = {"dump_scope": "data-only", "schema_sha256": schema_sha256(b"CREATE TABLE t ();")}
+
+        with mock.patch("subprocess.run", return_value=mock.Mock(stdout=b"CREATE TABLE t (id int);", returncode=0)):
+            with mock.patch("nestvault.backup.postgres.logger") as mock_logger:
+                adapter.restore(backup_file, RestoreOptions(metadata=metadata))
+
+        assert "differs" in mock_logger.warning.call_args[0][0]
+
+    def test_schema_hash_ignores_comments_and_restrict_keys(self):
+        assert schema_sha256(b"-- version 16\n\\restrict abc\nCREATE TABLE t ();\n\\unrestrict abc\n") == schema_sha256(
+            b"-- version 17\n\\restrict xyz\nCREATE TABLE t ();\n\\unrestrict xyz\n"
+        )
+
+    def test_backups_of_other_scopes_are_not_own(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        assert dump_scope_of("testdb_20240115_120000.schema.sql.gz.age") == "schema-only"
+        assert adapter.is_own_backup("testdb_20240115_120000.sql.gz")
+        assert not adapter.is_own_backup("testdb_20240115_120000.data.dump")
+
+
+class TestPostgresAllDatabases:
+    """Tests for backing up every database on a server."""
+
+    @pytest.fixture
+    def config(self):
+        return PostgresConfig(
+            host="localhost",
+            port=5432,
+            database="postgres",
+            user="testuser",
+            password="testpass",
+            all_databases=True,
+        )
+
+    def test_filter_databases(self):
+        databases = ["app", "tenant_a", "tenant_b", "tenant_staging"]
+
+        assert filter_databases(databases, []) == databases
+        assert filter_databases(databases, ["tenant_*"]) == ["tenant_a", "tenant_b", "tenant_staging"]
+        assert filter_databases(databases, ["tenant_*", "!tenant_staging"]) == ["tenant_a", "tenant_b"]
+        assert filter_databases(databases, ["!tenant_*"]) == ["app"]
+
+    def test_expand_discovers_databases(self, config):
+        config.database_patterns = ["!tenant_staging"]
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"app\ntenant_a\ntenant_staging\n")
+            adapters = adapter.expand()
+
+            cmd = mock_run.call_args[0][0]
+            assert cmd[0] == "psql"
+            assert "-At" in cmd
+            assert "pg_database" in cmd[-1]
+
+        assert [a.database_name for a in adapters] == ["app", "tenant_a"]
+        assert all(not a.config.all_databases for a in adapters)
+        assert all(a.config.host == "localhost" for a in adapters)
+
+    def test_expand_without_all_databases(self):
+        adapter = PostgresBackupAdapter(
+            PostgresConfig(host="localhost", port=5432, database="testdb", user="u", password="p")
+        )
+
+        with mock.patch("subprocess.run") as mock_run:
+            assert adapter.expand() == [adapter]
+            mock_run.assert_not_called()
+
+    def test_expand_failure(self, config):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(2, "psql", stderr=b"connection refused")
+
+            with pytest.raises(BackupError) as exc_info:
+                adapter.expand()
+
+            assert "connection refused" in str(exc_info.value)
+
+
+class TestPostgresGlobals:
+    """Tests for pg_dumpall globals companions."""
+
+    @pytest.fixture
+    def config(self):
+        return PostgresConfig(
+            host="localhost",
+            port=5432,
+            database="testdb",
+            user="testuser",
+            password="testpass",
+            backup_globals=True,
+        )
+
+    def test_companions_disabled_by_default(self, tmp_path):
+        adapter = PostgresBackupAdapter(
+            PostgresConfig(host="localhost", port=5432, database="testdb", user="u", password="p")
+        )
+
+        with mock.patch("subprocess.run") as mock_run:
+            assert adapter.backup_companions(tmp_path / "testdb_20240115_120000.sql.gz") == {}
+            mock_run.assert_not_called()
+
+    def test_dumps_globals(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stdout=b"CREATE ROLE app;")
+            companions = adapter.backup_companions(tmp_path / "testdb_20240115_120000.sql.gz")
+
+            cmd = mock_run.call_args[0][0]
+            assert cmd[0] == "pg_dumpall"
+            assert "--globals-only" in cmd
+
+        globals_file = companions["globals"]
+        assert globals_file.name == "testdb_20240115_120000.globals.sql.gz"
+        with gzip.open(globals_file, "rb") as f:
+            assert f.read() == b"CREATE ROLE app;"
+
+    def test_skips_globals_without_superuser(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(
+                1, "pg_dumpall", stderr=b"ERROR:  permission denied for table pg_authid"
+            )
+
+            assert adapter.backup_companions(tmp_path / "testdb_20240115_120000.sql.gz") == {}
+
+    def test_globals_failure(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.side_effect = subprocess.CalledProcessError(
+                1, "pg_dumpall", stderr=b"could not connect to server"
+            )
+
+            with pytest.raises(BackupError):
+                adapter.backup_companions(tmp_path / "testdb_20240115_120000.sql.gz")
+
+    def test_restore_applies_globals_first(self, config, tmp_path):
+        adapter = PostgresBackupAdapter(config)
+
+        backup_file = tmp_path / "testdb_20240115_120000.sql.gz"
+        globals_file = tmp_path / "testdb_20240115_120000.globals.sql.gz"
+        for path, content in ((backup_file, b"SELECT 1;"), (globals_file, b"CREATE ROLE app;")):
+            with gzip.open(path, "wb") as f:
+                f.write(content)
+
+        options = RestoreOptions(companions={"globals": globals_file})
+
+        with mock.patch("subprocess.run") as mock_run:
+            mock_run.return_value = mock.Mock(stderr=b"")
+            adapter.restore(backup_file, options)
+
+            first, second = mock_run.call_args_list
+            assert first.kwargs["input"] == b"CREATE ROLE app;"
+            assert first.args[0][first.args[0].index("-d") + 1] == "postgres"
+            assert second.kwargs["input"] == b"SELECT 1;"
@@ -0,0 +1,116 @@
+"""Tests for Redis backup adapter."""
+
+import gzip
+import subprocess
+import tempfile
+from pathlib import Path
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.redis import RedisBackupAdapter
+from nestvault.config import RedisConfig
+from nestvault.exceptions import BackupError
+
+
+def _fake_rdb(content: bytes):
+    """Return a subprocess.run side effect writing an RDB file to the --rdb path."""
+
+    def run(cmd, **kwargs):
+        Path(cmd[cmd.index("--rdb") + 1]).write_bytes(content)
+        return mock.Mock(returncode=0)
+
+    return run
+
+
+class TestRedisBackupAdapter:
+    """Tests for RedisBackupAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return RedisConfig(
+            host="localhost",
+            port=6379,
+            password="secret",
+            user="backup",
+            tls=True,
+            ca_cert="/certs/ca.pem",
+            timeout=60,
+        )
+
+    @pytest.fixture
+    def adapter(self, config):
+        with mock.patch("shutil.which", return_value="/usr/bin/redis-cli"):
+            yield RedisBackupAdapter(config)
+
+    def test_database_name(self, adapter):
+        assert adapter.database_name == "redis"
+
+    def test_file_extension(self, adapter):
+        assert adapter.file_extension == "rdb.gz"
+
+    def test_backup_success(self, adapter):
+        with mock.patch("subprocess.run", side_effect=_fake_rdb(b"REDIS0011snapshot")):
+            with tempfile.TemporaryDirectory() as temp_dir:
+                backup_file = adapter.backup(Path(temp_dir))
+
+                assert backup_file.name.endswith(".rdb.gz")
+                with gzip.open(backup_file, "rb") as f:
+                    assert f.read() == b"REDIS0011snapshot"
+                # The uncompressed snapshot is removed after compression
+                assert list(Path(temp_dir).glob("*.rdb")) == []
+
+    def test_backup_command_args(self, adapter):
+        with mock.patch("subprocess.run", side_effect=_fake_rdb(b"REDIS0011")) as mock_run:
+            with tempfile.TemporaryDirectory() as temp_dir:
+                adapter.backup(Path(temp_dir))
+
+            cmd = mock_run.call_args[0][0]
+            kwargs = mock_run.call_args[1]
+
+            assert cmd[0] == "redis-cli"
+            assert "--tls" in cmd
+            assert cmd[cmd.index("--cacert") + 1] == "/certs/ca.pem"
+            assert cmd[cmd.index("--user") + 1] == "backup"
+            assert "secret" not in cmd
+            assert kwargs["env"]["REDISCLI_AUTH"] == "secret"
+            assert kwargs["timeout"] == 60
+
+    def test_backup_timeout(self, adapter):
+        with mock.patch("subprocess.run", side_effect=subprocess.TimeoutExpired(["redis-cli"], 60)):
+            with tempfile.TemporaryDirectory() as temp_dir:
+                with pytest.raises(BackupError) as exc_info:
+                    adapter.backup(Path(temp_dir))
+
+                assert "timed out" in str(exc_info.value)
+
+    def test_backup_rejects_invalid_snapshot(self, adapter):
+        with mock.patch("subprocess.run", side_effect=_fake_rdb(b"-ERR unknown")):
+            with tempfile.TemporaryDirectory() as temp_dir:
+                with pytest.raises(BackupError):
+                    adapter.backup(Path(temp_dir))
+
+    def test_restore_writes_rdb(self, config, tmp_path):
+        config.restore_path = str(tmp_path / "data" / "dump.rdb")
+        adapter = RedisBackupAdapter(config)
+
+        backup_file = tmp_path / "redis_20240115_120000.rdb.gz"
+        with gzip.open(backup_file, "wb") as f:
+            f.write(b"REDIS0011snapshot")
+
+        adapter.restore(backup_file)
+
+        assert (tmp_path / "data" / "dump.rdb").read_bytes() == b"REDIS0011snapshot"
+
+    def test_restore_rejects_bad_header(self, config, tmp_path):
+        config.restore_path = str(tmp_path / "dump.rdb")
+        adapter = RedisBackupAdapter(config)
+
+        backup_file = tmp_path / "redis_20240115_120000.rdb.gz"
+        with gzip.open(backup_file, "wb") as f:
+            f.write(b"not an rdb file")
+
+        with pytest.raises(BackupError):
+            adapter.restore(backup_file)
+
+        assert not (tmp_path / "dump.rdb").exists()
@@ -0,0 +1,116 @@
+"""Tests for SQLite backup adapter."""
+
+import gzip
+import sqlite3
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.sqlite import SQLiteBackupAdapter
+from nestvault.config import SQLiteConfig
+from nestvault.exceptions import BackupError
+
+
+class TestSQLiteBackupAdapter:
+    """Tests for SQLiteBackupAdapter."""
+
+    @pytest.fixture
+    def database(self, tmp_path):
+        path = tmp_path / "app.db"
+        conn = sqlite3.connect(path)
+        conn.execute("PRAGMA journal_mode=WAL")
+        conn.execute("CREATE TABLE todos (id INTEGER PRIMARY KEY, title TEXT)")
+        conn.execute("INSERT INTO todos (title) VALUES ('write tests')")
+        conn.commit()
+        # Keep the connection open so the row only lives in the WAL file
+        yield path
+        conn.close()
+
+    @pytest.fixture
+    def adapter(self, database):
+        return SQLiteBackupAdapter(SQLiteConfig(path=str(database)))
+
+    def test_database_name(self, adapter):
+        assert adapter.database_name == "app"
+
+    def test_file_extension(self, adapter):
+        assert adapter.file_extension == "sqlite.gz"
+
+    def test_backup_includes_wal_contents(self, adapter, tmp_path):
+        output = tmp_path / "out"
+        output.mkdir()
+
+        backup_file = adapter.backup(output)
+
+        assert backup_file.name.startswith("app_")
+        assert backup_file.name.endswith(".sqlite.gz")
+        assert [p.name for p in output.iterdir()] == [backup_file.name]
+
+        restored = tmp_path / "restored.db"
+        with gzip.open(backup_file, "rb") as f:
+            restored.write_bytes(f.read())
+
+        conn = sqlite3.connect(restored)
+        assert conn.execute("PRAGMA journal_mode").fetchone()[0] == "delete"
+        assert conn.execute("SELECT title FROM todos").fetchall() == [("write tests",)]
+        conn.close()
+
+    def test_backup_missing_file(self, tmp_path):
+        adapter = SQLiteBackupAdapter(SQLiteConfig(path=str(tmp_path / "missing.db")))
+
+        with pytest.raises(BackupError) as exc_info:
+            adapter.backup(tmp_path)
+
+        assert "not found" in str(exc_info.value)
+
+    def test_restore_refuses_to_overwrite(self, adapter, tmp_path):
+        backup_file = adapter.backup(tmp_path)
+
+        with pytest.raises(BackupError) as exc_info:
+            adapter.restore(backup_file)
+
+        assert "--force" in str(exc_info.value)
+
+    def test_restore_to_new_path(self, adapter, tmp_path):
+        backup_file = adapter.backup(tmp_path)
+        target = tmp_path / "restore" / "app.db"
+
+        SQLiteBackupAdapter(SQLiteConfig(path=str(target))).restore(backup_file)
+
+        conn = sqlite3.connect(target)
+        assert conn.execute("SELECT count(*) FROM todos").fetchone()[0] == 1
+        conn.close()
+
+    def test_restore_with_force_replaces_file(self, tmp_path):
+        target = tmp_path / "app.db"
+        conn = sqlite3.connect(target)
+        conn.execute("CREATE TABLE todos (id INTEGER PRIMARY KEY, title TEXT)")
+        conn.execute("INSERT INTO todos (title) VALUES ('first')")
+        conn.commit()
+        conn.close()
+
+        adapter = SQLiteBackupAdapter(SQLiteConfig(path=str(target)))
+        backup_file = adapter.backup(tmp_path)
+
+        conn = sqlite3.connect(target)
+        conn.execute("DELETE FROM todos")
+        conn.commit()
+        conn.close()
+
+        adapter.restore(backup_file, RestoreOptions(force=True))
+
+        conn = sqlite3.connect(target)
+        assert conn.execute("SELECT title FROM todos").fetchall() == [("first",)]
+        conn.close()
+
+    def test_restore_rejects_corrupt_backup(self, tmp_path):
+        backup_file = tmp_path / "app_20240115_120000.sqlite.gz"
+        with gzip.open(backup_file, "wb") as f:
+            f.write(b"definitely not sqlite")
+
+        adapter = SQLiteBackupAdapter(SQLiteConfig(path=str(tmp_path / "app.db")))
+
+        with pytest.raises(BackupError):
+            adapter.restore(backup_file)
+
+        assert not (tmp_path / "app.db").exists()
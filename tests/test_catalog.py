@@ -0,0 +1,212 @@
+"""Tests for catalog module."""
+
+import csv
+import io
+import json
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.catalog import BackupQuery, Catalog, Entry, parse_time, read_catalog, render
+from nestvault.config import LocalConfig
+from nestvault.hold import place_hold
+from nestvault.manifest import Manifest, manifest_key
+from nestvault.scheduler import BackupTarget
+from nestvault.storage.local import LocalStorageAdapter
+
+NOW = datetime(2024, 1, 15, 2, 0, tzinfo=timezone.utc)
+
+
+def backup(day: int, size: int = 100, **fields) -> Manifest:
+    finished_at = NOW - timedelta(days=day)
+    return Manifest(
+        key=f"db_{finished_at:%Y%m%d_%H%M%S}.sql.gz",
+        database=fields.pop("database", "db"),
+        finished_at=finished_at,
+        size=size,
+        engine="postgres",
+        started_at=finished_at - timedelta(seconds=size),
+        **fields,
+    )
+
+
+@pytest.fixture
+def entries():
+    return [
+        Entry("billing", backup(0, 300, labels={"tier": "daily"})),
+        Entry("billing", backup(1, 100, labels={"tier": "hourly"})),
+        Entry("billing", backup(2, 200, exclude_tables=["audit_*"], labels={"tier": "daily"})),
+        Entry("crm", backup(1, 50, database="crm")),
+        Entry("crm", legacy(backup(3, 400, database="crm"))),
+    ]
+
+
+def legacy(manifest: Manifest) -> Manifest:
+    return Manifest(manifest.key, manifest.database, manifest.finished_at, manifest.size, legacy=True)
+
+
+def keys(entries):
+    return [entry.manifest.key for entry in entries]
+
+
+class TestBackupQuery:
+    """Tests for BackupQuery class."""
+
+    def test_newest_first_by_default(self, entries):
+        selected = BackupQuery().select(entries)
+
+        assert [entry.manifest.finished_at for entry in selected] == sorted(
+            (entry.manifest.finished_at for entry in entries), reverse=True
+        )
+
+    def test_filters(self, entries):
+        assert [e.target for e in BackupQuery(target="crm").select(entries)] == ["crm", "crm"]
+        assert keys(BackupQuery(since=NOW - timedelta(days=1), until=NOW).select(entries)) == [
+            entries[1].manifest.key,
+            entries[3].manifest.key,
+        ]
+        assert [e.status for e in BackupQuery(status="partial").select(entries)] == ["partial"]
+        assert [e.status for e in BackupQuery(status="legacy").select(entries)] == ["legacy"]
+        assert [e.manifest.size for e in BackupQuery(labels={"tier": "daily"}).select(entries)] == [300, 200]
+
+    def test_unknown_sort_values_come_last(self, entries):
+        by_duration = BackupQuery(sort="duration", order="asc").select(entries)
+
+        assert [e.manifest.duration for e in by_duration] == [50.0, 100.0, 200.0, 300.0, None]
+
+    def test_pages(self, entries):
+        page = BackupQuery(sort="size", limit=2, offset=1).page(entries)
+
+        assert [entry.manifest.size for entry in page.entries] == [300, 200]
+        assert (page.total, page.offset, page.limit) == (5, 1, 2)
+
+    @pytest.mark.parametrize(
+        "fields, message",
+        [
+            ({"status": "failed"}, "Invalid status"),
+            ({"sort": "name"}, "Invalid sort"),
+            ({"order": "up"}, "Invalid order"),
+            ({"limit": 0}, "Invalid limit"),
+            ({"offset": -1}, "Invalid offset"),
+        ],
+    )
+    def test_rejects_invalid_fields(self, fields, message):
+        with pytest.raises(ValueError, match=message):
+            BackupQuery(**fields)
+
+    def test_from_params(self):
+        query = BackupQuery.from_params(
+            {"target": ["billing"], "since": ["2024-01-10"], "label": ["tier=daily"], "limit": ["20"]}
+        )
+
+        assert query == BackupQuery(
+            target="billing",
+            since=datetime(2024, 1, 10, tzinfo=timezone.utc),
+            labels={"tier": "daily"},
+            limit=20,
+        )
+        assert BackupQuery.from_params({}).limit == 100
+
+    @pytest.mark.parametrize(
+        "invalid",
+        [{"limit": ["many"]}, {"limit": ["5000"]}, {"since": ["yesterday"]}, {"label": ["tier"]}],
+    )
+    def test_from_params_rejects_invalid_params(self, invalid):
+        with pytest.raises(ValueError):
+            BackupQuery.from_params(invalid)
+
+
+class TestParseTime:
+    """Tests for parse_time function."""
+
+    def test_times_without_offset_are_utc(self):
+        assert parse_time("2024-01-15T02:00:00", "--since") == NOW
+        assert parse_time("2024-01-15T02:00:00Z", "--since") == NOW
+        assert parse_time("2024-01-15T03:00:00+01:00", "--since") == NOW
+
+    def test_ages_count_back_from_now(self):
+        assert parse_time("30d", "--since", NOW) == NOW - timedelta(days=30)
+        assert parse_time("12h", "--since", NOW) == NOW - timedelta(hours=12)
+        assert parse_time("2w", "--since", NOW) == NOW - timedelta(weeks=2)
+
+    def test_rejects_malformed_time(self):
+        with pytest.raises(ValueError, match="Invalid --until"):
+            parse_time("last week", "--until")
+
+
+class TestReadCatalog:
+    """Tests for read_catalog function and Catalog class."""
+
+    @pytest.fixture
+    def target(self, tmp_path):
+        root = tmp_path / "nas"
+        root.mkdir()
+        storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+        for manifest in (backup(0), backup(1, exclude_tables=["audit_*"])):
+            local_file = tmp_path / "object"
+            local_file.write_bytes(b"data")
+            storage.upload(local_file, manifest.key)
+            local_file.write_text(manifest.to_json())
+            storage.upload(local_file, manifest_key(manifest.key))
+        place_hold(storage, backup(1).key, "before the orders migration")
+
+        backup_adapter = mock.Mock(database_name="db")
+        backup_adapter.expand.return_value = [backup_adapter]
+        backup_adapter.is_own_backup.return_value = True
+        return BackupTarget("billing", "@daily", 7, backup_adapter, storage)
+
+    def test_reads_backups_with_their_holds(self, target):
+        entries = read_catalog([target])
+
+        assert keys(entries) == [backup(0).key, backup(1).key]
+        assert [(entry.target, entry.status) for entry in entries] == [("billing", "complete"), ("billing", "partial")]
+        assert entries[0].hold is None
+        assert entries[1].hold.reason == "before the orders migration"
+
+    def test_catalog_is_read_again_once_stale(self, target):
+        catalog = Catalog([target], max_age=60.0)
+
+        with mock.patch("nestvault.catalog.read_catalog", wraps=read_catalog) as reading:
+            with mock.patch("nestvault.catalog.time.monotonic", side_effect=[0.0, 30.0, 90.0, 90.0]):
+                catalog.entries()
+                catalog.entries()
+                assert reading.call_count == 1
+                assert len(catalog.entries()) == 2
+
+        assert reading.call_count == 2
+
+
+class TestRender:
+    """Tests for render function."""
+
+    def test_table(self, entries):
+        lines = render(BackupQuery(limit=2).page(entries), "table").splitlines()
+
+        assert lines[0].split() == ["TARGET", "DATABASE", "FINISHED", "AT", "SIZE", "STATUS", "KEY", "LABELS", "HOLD"]
+        assert lines[1].split()[:4] == ["billing", "db", "2024-01-15", "02:00:00"]
+        assert lines[-1] == "(1-2 of 5 backups)"
+
+    def test_json(self, entries):
+        document = json.loads(render(BackupQuery(target="crm", limit=1).page(entries), "json"))
+
+        assert (document["total"], document["offset"], document["limit"]) == (2, 0, 1)
+        [crm] = document["backups"]
+        assert crm["key"] == entries[3].manifest.key
+        assert (crm["status"], crm["size"], crm["held"]) == ("complete", 50, False)
+
+    def test_csv(self, entries):
+        rows = list(csv.DictReader(io.StringIO(render(BackupQuery(status="partial").page(entries), "csv"))))
+
+        assert rows == [
+            {
+                "target": "billing",
+                "database": "db",
+                "finished_at": entries[2].manifest.finished_at.isoformat(),
+                "size": "200",
+                "status": "partial",
+                "key": entries[2].manifest.key,
+                "labels": "tier=daily",
+                "hold": "",
+            }
+        ]
@@ -0,0 +1,41 @@
+"""Tests for catchup module."""
+
+from datetime import datetime, timezone
+from unittest import mock
+
+from nestvault.catchup import SCHEDULE_PREFIX, last_run, record_run, run_record_key
+from nestvault.config import LocalConfig
+from nestvault.exceptions import StorageError
+from nestvault.manifest import list_backups
+from nestvault.storage.local import LocalStorageAdapter
+
+DUE = datetime(2024, 1, 15, 2, 0, tzinfo=timezone.utc)
+FINISHED = datetime(2024, 1, 15, 2, 4, tzinfo=timezone.utc)
+
+
+class TestRunRecords:
+    """Tests for record_run and last_run functions."""
+
+    def test_records_last_run_outside_backup_listings(self, tmp_path):
+        storage = LocalStorageAdapter(LocalConfig(root=str(tmp_path)))
+
+        record_run(storage, "billing/daily", datetime(2024, 1, 14, 2, 0, tzinfo=timezone.utc), FINISHED)
+        record_run(storage, "billing/daily", DUE, FINISHED)
+
+        assert run_record_key("billing/daily") == f"{SCHEDULE_PREFIX}billing/daily.json"
+        assert last_run(storage, "billing/daily") == DUE
+        assert last_run(storage, "billing/hourly") is None
+        assert list_backups(storage, prefix="") == []
+
+    def test_unreadable_record_is_ignored(self, tmp_path):
+        storage = LocalStorageAdapter(LocalConfig(root=str(tmp_path)))
+        (tmp_path / SCHEDULE_PREFIX).mkdir()
+        (tmp_path / run_record_key("billing")).write_text("{}")
+
+        assert last_run(storage, "billing") is None
+
+    def test_upload_failure_is_only_logged(self):
+        storage = mock.Mock()
+        storage.upload.side_effect = StorageError("access denied")
+
+        record_run(storage, "billing", DUE, FINISHED)
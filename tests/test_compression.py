@@ -0,0 +1,136 @@
+"""Tests for backup compression."""
+
+import gzip
+import subprocess
+
+import pytest
+
+from nestvault.compression import (
+    compress_chunks,
+    compressed_extension,
+    compressing_pipe,
+    decompressed_name,
+    detect_algorithm,
+    open_reader,
+    open_stream_reader,
+    open_writer,
+)
+from nestvault.config import CompressionConfig
+from nestvault.exceptions import BackupError
+from nestvault.stats import collecting
+
+
+class TestCompression:
+    """Tests for the compression helpers."""
+
+    def test_extensions(self):
+        assert compressed_extension("sql", CompressionConfig()) == "sql.gz"
+        assert compressed_extension("sql", CompressionConfig(algorithm="zstd")) == "sql.zst"
+        assert decompressed_name("db_20240115_120000.bak.zst") == "db_20240115_120000.bak"
+        assert decompressed_name("db_20240115_120000.bak.gz") == "db_20240115_120000.bak"
+        assert compressed_extension("sql", CompressionConfig(algorithm="lz4")) == "sql.lz4"
+        assert compressed_extension("sql", CompressionConfig(algorithm="none")) == "sql"
+
+    @pytest.mark.parametrize(
+        "compression",
+        [
+            CompressionConfig(level=1),
+            CompressionConfig(algorithm="zstd", level=19, long_window=True),
+            CompressionConfig(algorithm="lz4"),
+        ],
+    )
+    def test_round_trip(self, compression, tmp_path):
+        path = tmp_path / "backup"
+        with open_writer(path, compression) as f:
+            f.write(b"SELECT 1;")
+
+        assert detect_algorithm(path) == compression.algorithm
+        with open_reader(path, compression.algorithm) as f:
+            assert f.read() == b"SELECT 1;"
+
+    @pytest.mark.parametrize("algorithm", ["gzip", "zstd", "lz4", "none"])
+    def test_stream_reader_decompresses_as_read(self, algorithm, tmp_path):
+        path = tmp_path / "backup"
+        with open_writer(path, CompressionConfig(algorithm=algorithm)) as f:
+            f.write(b"SELECT 1; " * 1000)
+
+        with open(path, "rb") as stream:
+            assert open_stream_reader(stream, algorithm).read() == b"SELECT 1; " * 1000
+
+    def test_uncompressed(self, tmp_path):
+        path = tmp_path / "db.dump"
+        with open_writer(path, CompressionConfig(algorithm="none")) as f:
+            f.write(b"PGDMP")
+
+        assert path.read_bytes() == b"PGDMP"
+        with open_reader(path, "none") as f:
+            assert f.read() == b"PGDMP"
+
+    def test_reader_detects_algorithm_without_metadata(self, tmp_path):
+        path = tmp_path / "db_20240115_120000.sql.gz"
+        with gzip.open(path, "wb") as f:
+            f.write(b"SELECT 1;")
+
+        with open_reader(path) as f:
+            assert f.read() == b"SELECT 1;"
+
+    def test_detect_rejects_uncompressed_file(self, tmp_path):
+        path = tmp_path / "db.sql"
+        path.write_bytes(b"SELECT 1;")
+
+        with pytest.raises(BackupError):
+            detect_algorithm(path)
+
+    def test_writer_uses_partial_name_until_closed(self, tmp_path):
+        path = tmp_path / "db.sql.gz"
+
+        with open_writer(path, CompressionConfig()) as f:
+            f.write(b"SELECT 1;")
+            assert [p.name for p in tmp_path.iterdir()] == ["db.sql.gz.partial"]
+
+        assert [p.name for p in tmp_path.iterdir()] == ["db.sql.gz"]
+        assert gzip.decompress(path.read_bytes()) == b"SELECT 1;"
+
+        with pytest.raises(OSError):
+            with open_writer(tmp_path / "failed.sql.gz", CompressionConfig()) as f:
+                f.write(b"SELECT")
+                raise OSError("disk full")
+        assert [p.name for p in tmp_path.iterdir()] == ["db.sql.gz"]
+
+    def test_compressing_pipe(self, tmp_path):
+        path = tmp_path / "db.sql.zst"
+
+        with compressing_pipe(path, CompressionConfig(algorithm="zstd")) as pipe:
+            subprocess.run(["echo", "SELECT 1;"], stdout=pipe, check=True)
+
+        with open_reader(path) as f:
+            assert f.read() == b"SELECT 1;\n"
+
+    @pytest.mark.parametrize(
+        "compression",
+        [
+            CompressionConfig(level=1),
+            CompressionConfig(algorithm="zstd", long_window=True),
+            CompressionConfig(algorithm="lz4"),
+            CompressionConfig(algorithm="none"),
+        ],
+    )
+    def test_compress_chunks_matches_file_format(self, compression, tmp_path):
+        path = tmp_path / "backup"
+        path.write_bytes(b"".join(compress_chunks([b"SELECT", b" 1;"], compression)))
+
+        with open_reader(path, compression.algorithm) as f:
+            assert f.read() == b"SELECT 1;"
+
+    def test_compression_recorded_in_backup_stats(self, tmp_path):
+        path = tmp_path / "db.sql.zst"
+
+        with collecting() as stats:
+            with compressing_pipe(path, CompressionConfig(algorithm="zstd")) as pipe:
+                subprocess.run(["printf", "SELECT 1;" * 1000], stdout=pipe, check=True)
+            streamed = b"".join(compress_chunks([b"SELECT", b" 1;"], CompressionConfig()))
+
+        phase = stats.phases["compress"]
+        assert phase.bytes_in == 9000 + 9
+        assert phase.bytes_out == path.stat().st_size + len(streamed)
+        assert phase.ratio > 1
@@ -0,0 +1,229 @@
+"""Tests for credentials module."""
+
+import io
+import json
+import urllib.error
+from unittest import mock
+
+import pytest
+
+from nestvault.config import VaultConfig
+from nestvault.credentials import (
+    CredentialProvider,
+    Lease,
+    LeaseKeeper,
+    VaultCredentialProvider,
+    leased_credentials,
+)
+from nestvault.exceptions import CredentialError
+
+CREDENTIALS = {
+    "lease_id": "database/creds/nestvault/abc",
+    "lease_duration": 3600,
+    "renewable": True,
+    "data": {"username": "v-nestvault-xyz", "password": "s3cret-from-vault"},
+}
+
+
+def answer(body: dict) -> mock.MagicMock:
+    """Return a urlopen response answering with a JSON body."""
+    response = mock.MagicMock()
+    response.__enter__.return_value.read.return_value = json.dumps(body).encode()
+    return response
+
+
+def error(code: int, errors: list[str]) -> urllib.error.HTTPError:
+    body = io.BytesIO(json.dumps({"errors": errors}).encode())
+    return urllib.error.HTTPError("https://vault:8200", code, "error", {}, body)
+
+
+@pytest.fixture
+def urlopen():
+    with (
+        mock.patch("nestvault.credentials.urllib.request.urlopen") as patched,
+        mock.patch("nestvault.credentials.time.sleep"),
+    ):
+        yield patched
+
+
+def sent(urlopen):
+    return [
+        (call.args[0].get_method(), call.args[0].full_url, json.loads(call.args[0].data or b"null"))
+        for call in urlopen.call_args_list
+    ]
+
+
+def vault(**overrides) -> VaultConfig:
+    settings = {"address": "https://vault:8200/", "credentials_path": "database/creds/nestvault", "token": "root"}
+    return VaultConfig(**{**settings, **overrides})
+
+
+class TestVaultCredentialProvider:
+    """Tests for VaultCredentialProvider class."""
+
+    def test_reads_credentials_with_configured_token(self, urlopen):
+        urlopen.return_value = answer(CREDENTIALS)
+
+        lease = VaultCredentialProvider(vault(namespace="team-a")).acquire()
+
+        assert lease == Lease("v-nestvault-xyz", "s3cret-from-vault", "database/creds/nestvault/abc", 3600, True)
+        [request] = [call.args[0] for call in urlopen.call_args_list]
+        assert (request.get_method(), request.full_url) == ("GET", "https://vault:8200/v1/database/creds/nestvault")
+        assert request.get_header("X-vault-token") == "root"
+        assert request.get_header("X-vault-namespace") == "team-a"
+
+    def test_logs_in_with_approle(self, urlopen):
+        login = answer({"auth": {"client_token": "login-token", "renewable": True}})
+        urlopen.side_effect = [login, answer(CREDENTIALS)]
+        config = vault(auth_method="approle", token=None, role_id="role", secret_id="secret", auth_mount="ci-approle")
+
+        VaultCredentialProvider(config).acquire()
+
+        assert sent(urlopen)[0] == (
+            "POST", "https://vault:8200/v1/auth/ci-approle/login", {"role_id": "role", "secret_id": "secret"}
+        )
+        assert urlopen.call_args_list[1].args[0].get_header("X-vault-token") == "login-token"
+
+    def test_logs_in_with_the_kubernetes_service_account(self, urlopen, tmp_path):
+        jwt = tmp_path / "token"
+        jwt.write_text("eyJhbGciOi\n")
+        urlopen.side_effect = [answer({"auth": {"client_token": "login-token"}}), answer(CREDENTIALS)]
+        config = vault(auth_method="kubernetes", token=None, kubernetes_role="nestvault", jwt_path=str(jwt))
+
+        VaultCredentialProvider(config).acquire()
+
+        assert sent(urlopen)[0] == (
+            "POST", "https://vault:8200/v1/auth/kubernetes/login", {"role": "nestvault", "jwt": "eyJhbGciOi"}
+        )
+
+    def test_unreadable_service_account_token_fails(self, urlopen, tmp_path):
+        config = vault(auth_method="kubernetes", token=None, kubernetes_role="nestvault", jwt_path=str(tmp_path / "x"))
+
+        with pytest.raises(CredentialError, match="service account token"):
+            VaultCredentialProvider(config).acquire()
+        urlopen.assert_not_called()
+
+    def test_retries_sealed_vault_with_backoff(self, urlopen):
+        urlopen.side_effect = [error(503, ["Vault is sealed"]), urllib.error.URLError("refused"), answer(CREDENTIALS)]
+
+        with mock.patch("nestvault.credentials.time.sleep") as sleep:
+            VaultCredentialProvider(vault(retries=2)).acquire()
+
+        assert urlopen.call_count == 3
+        assert [call.args[0] for call in sleep.call_args_list] == [1.0, 2.0]
+
+    def test_gives_up_after_retries(self, urlopen):
+        urlopen.side_effect = [error(503, ["Vault is sealed"]), error(503, ["Vault is sealed"])]
+
+        with pytest.raises(CredentialError, match="HTTP 503: Vault is sealed"):
+            VaultCredentialProvider(vault(retries=1)).acquire()
+        assert urlopen.call_count == 2
+
+    def test_client_errors_are_not_retried(self, urlopen):
+        urlopen.side_effect = error(403, ["permission denied"])
+
+        with pytest.raises(CredentialError, match="HTTP 403: permission denied"):
+            VaultCredentialProvider(vault()).acquire()
+        assert urlopen.call_count == 1
+
+    def test_response_without_credentials_fails(self, urlopen):
+        urlopen.return_value = answer({"data": {"username": "v-nestvault-xyz"}})
+
+        with pytest.raises(CredentialError, match="no username and password"):
+            VaultCredentialProvider(vault()).acquire()
+
+    def test_renews_login_token_and_lease(self, urlopen):
+        urlopen.side_effect = [
+            answer({"auth": {"client_token": "login-token", "renewable": True}}),
+            answer(CREDENTIALS),
+            answer({}),
+            answer({"lease_id": CREDENTIALS["lease_id"], "lease_duration": 1800, "renewable": True}),
+        ]
+        provider = VaultCredentialProvider(vault(auth_method="approle", token=None, role_id="r", secret_id="s"))
+
+        renewed = provider.renew(provider.acquire())
+
+        assert renewed.duration == 1800
+        assert sent(urlopen)[2:] == [
+            ("POST", "https://vault:8200/v1/auth/token/renew-self", {}),
+            ("PUT", "https://vault:8200/v1/sys/leases/renew", {"lease_id": CREDENTIALS["lease_id"], "increment": 3600}),
+        ]
+
+    def test_revokes_lease_and_login_token(self, urlopen):
+        login = answer({"auth": {"client_token": "login-token"}})
+        urlopen.side_effect = [login, answer(CREDENTIALS), answer({}), answer({})]
+        provider = VaultCredentialProvider(vault(auth_method="approle", token=None, role_id="r", secret_id="s"))
+
+        provider.revoke(provider.acquire())
+
+        assert sent(urlopen)[2:] == [
+            ("PUT", "https://vault:8200/v1/sys/leases/revoke", {"lease_id": CREDENTIALS["lease_id"]}),
+            ("POST", "https://vault:8200/v1/auth/token/revoke-self", {}),
+        ]
+
+    def test_configured_token_is_not_revoked(self, urlopen):
+        urlopen.side_effect = [answer(CREDENTIALS), answer({})]
+        provider = VaultCredentialProvider(vault())
+
+        provider.revoke(provider.acquire())
+
+        assert [method_url[:2] for method_url in sent(urlopen)] == [
+            ("GET", "https://vault:8200/v1/database/creds/nestvault"),
+            ("PUT", "https://vault:8200/v1/sys/leases/revoke"),
+        ]
+
+
+class TestLeaseKeeper:
+    """Tests for LeaseKeeper class."""
+
+    def test_renews_until_max_ttl(self):
+        provider = mock.Mock(spec=CredentialProvider)
+        provider.renew.side_effect = [Lease("u", "p", "id", 10, True), Lease("u", "p", "id", 4, True)]
+        keeper = LeaseKeeper(provider, Lease("u", "p", "id", 10, True))
+
+        with mock.patch.object(keeper.stopped, "wait", return_value=False):
+            keeper._run()
+
+        assert provider.renew.call_count == 2
+        assert keeper.lease.duration == 4
+
+    def test_stop_revokes_the_renewed_lease(self):
+        provider = mock.Mock(spec=CredentialProvider)
+        keeper = LeaseKeeper(provider, Lease("u", "p", "id", 0, False))
+
+        keeper.start()
+        keeper.stop()
+
+        assert not keeper.thread.is_alive()
+        provider.revoke.assert_called_once_with(Lease("u", "p", "id", 0, False))
+
+    def test_failed_revoke_is_only_logged(self):
+        provider = mock.Mock(spec=CredentialProvider)
+        provider.revoke.side_effect = CredentialError("Vault is sealed")
+
+        LeaseKeeper(provider, Lease("u", "p", "id")).stop()
+
+
+class TestLeasedCredentials:
+    """Tests for leased_credentials."""
+
+    def test_adapter_connects_with_the_lease_until_it_is_revoked(self):
+        provider = mock.Mock(spec=CredentialProvider)
+        provider.name = "vault"
+        provider.acquire.return_value = Lease("v-nestvault-xyz", "s3cret-from-vault")
+        adapter = mock.Mock()
+
+        with leased_credentials(provider, adapter) as lease:
+            adapter.use_credentials.assert_called_once_with("v-nestvault-xyz", "s3cret-from-vault")
+            provider.revoke.assert_not_called()
+
+        provider.revoke.assert_called_once_with(lease)
+
+    def test_failed_acquisition_raises(self):
+        provider = mock.Mock(spec=CredentialProvider)
+        provider.acquire.side_effect = CredentialError("Vault at https://vault:8200 is not reachable")
+
+        with pytest.raises(CredentialError):
+            with leased_credentials(provider, mock.Mock()):
+                pass
+        provider.revoke.assert_not_called()
@@ -0,0 +1,215 @@
+"""Tests for dedup module and DedupBackupAdapter."""
+
+import gzip
+import io
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import RestoreOptions
+from nestvault.backup.deduplicated import DedupBackupAdapter
+from nestvault.config import CompressionConfig, DedupConfig, LocalConfig
+from nestvault.dedup import CHUNK_PREFIX, GC_LOCK, LOCK_PREFIX, collect_chunks, lock_backup, split_chunks
+from nestvault.exceptions import BackupError
+from nestvault.storage.base import StorageObject
+from nestvault.storage.local import LocalStorageAdapter
+
+
+def _dump(rows=20000, changed=None):
+    lines = [f"INSERT INTO orders VALUES ({i}, 'customer {i % 97}', {i * 3});\n" for i in range(rows)]
+    if changed is not None:
+        lines[changed] = "INSERT INTO orders VALUES (0, 'changed', 0);\n"
+    return "".join(lines).encode()
+
+
+@pytest.fixture
+def storage(tmp_path):
+    root = tmp_path / "nas"
+    root.mkdir()
+    return LocalStorageAdapter(LocalConfig(root=str(root)))
+
+
+@pytest.fixture
+def inner():
+    adapter = mock.Mock()
+    adapter.engine = "postgres"
+    adapter.file_extension = "sql.gz"
+    adapter.compression = CompressionConfig(algorithm="gzip")
+    adapter.backup_metadata = {"engine": "postgres", "compression": "gzip"}
+    adapter.content = _dump()
+
+    def backup(output_path):
+        backup_file = output_path / "db_20240115_120000.sql.gz"
+        backup_file.write_bytes(gzip.compress(adapter.content))
+        return backup_file
+
+    adapter.backup.side_effect = backup
+    adapter.restore.side_effect = lambda backup_file, options: setattr(
+        adapter, "restored", (backup_file.read_bytes(), options.metadata["compression"])
+    )
+    return adapter
+
+
+def _backup(adapter, storage, tmp_path, name):
+    """Run a backup and upload its index the way the scheduler does."""
+    work = tmp_path / name
+    work.mkdir()
+    index_file = adapter.backup(work)
+    key = index_file.name.replace("20240115", name)
+    storage.upload(index_file, key, metadata=adapter.backup_metadata)
+    return key
+
+
+def _chunks(storage):
+    return {obj.key for obj in storage.list(prefix=CHUNK_PREFIX) if not obj.key.startswith(LOCK_PREFIX)}
+
+
+class TestSplitChunks:
+    """Tests for split_chunks function."""
+
+    def test_chunks_rejoin_to_the_stream(self):
+        data = _dump()
+
+        chunks = list(split_chunks(io.BytesIO(data), 16 * 1024))
+
+        assert b"".join(chunks) == data
+        assert all(len(chunk) <= 64 * 1024 for chunk in chunks)
+        assert len(chunks) > 20
+
+    def test_change_only_affects_nearby_chunks(self):
+        before = list(split_chunks(io.BytesIO(_dump()), 16 * 1024))
+        after = list(split_chunks(io.BytesIO(_dump(changed=10000)), 16 * 1024))
+
+        assert len(set(after) - set(before)) <= 2
+
+    def test_data_without_newlines_is_cut_at_the_maximum(self):
+        chunks = list(split_chunks(io.BytesIO(b"x" * 100_000), 16 * 1024))
+
+        assert [len(chunk) for chunk in chunks] == [65536, 100_000 - 65536]
+
+
+class TestDedupBackupAdapter:
+    """Tests for DedupBackupAdapter."""
+
+    @pytest.fixture
+    def adapter(self, inner, storage):
+        adapter = DedupBackupAdapter(inner, DedupConfig(enabled=True, chunk_size_kb=64))
+        adapter.use_storage(storage)
+        return adapter
+
+    def test_backup_uploads_chunks_and_returns_index(self, adapter, storage, tmp_path):
+        index_file = adapter.backup(tmp_path)
+
+        assert index_file.name == "db_20240115_120000.sql.gz.dedup"
+        assert [p.name for p in tmp_path.iterdir() if p.is_file()] == [index_file.name]
+        assert adapter.file_extension == "sql.gz.dedup"
+        metadata = adapter.backup_metadata
+        assert metadata["dedup"] == "chunks"
+        assert metadata["uncompressed_size"] == str(len(_dump()))
+        assert metadata["dedup_new_chunks"] == metadata["dedup_chunks"]
+        assert len(_chunks(storage)) == int(metadata["dedup_chunks"])
+
+    def test_unchanged_chunks_are_not_uploaded_again(self, adapter, inner, storage, tmp_path):
+        _backup(adapter, storage, tmp_path, "20240115")
+        stored = len(_chunks(storage))
+
+        _backup(adapter, storage, tmp_path, "20240116")
+        assert adapter.backup_metadata["dedup_new_chunks"] == "0"
+
+        inner.content = _dump(changed=10000)
+        _backup(adapter, storage, tmp_path, "20240117")
+        assert 0 < int(adapter.backup_metadata["dedup_new_chunks"]) <= 2
+        assert len(_chunks(storage)) == stored + int(adapter.backup_metadata["dedup_new_chunks"])
+
+    def test_restore_reassembles_the_backup(self, adapter, inner, storage, tmp_path):
+        index_file = adapter.backup(tmp_path)
+
+        adapter.restore(index_file, RestoreOptions(metadata={"engine": "postgres", "dedup": "chunks"}))
+
+        assert inner.restored == (_dump(), "none")
+        assert inner.restore.call_args[0][0].name == "db_20240115_120000.sql"
+
+    def test_restore_detects_corrupt_chunk(self, adapter, storage, tmp_path):
+        index_file = adapter.backup(tmp_path)
+        chunk = sorted(_chunks(storage))[0]
+        (tmp_path / "nas" / chunk).write_bytes(gzip.compress(b"tampered"))
+
+        with pytest.raises(BackupError):
+            adapter.restore(index_file, RestoreOptions(metadata={"engine": "postgres", "dedup": "chunks"}))
+
+    def test_restore_passes_plain_backup_through(self, adapter, inner, tmp_path):
+        backup_file = tmp_path / "db_20240115_120000.sql.gz"
+        backup_file.write_bytes(b"SELECT 1;")
+
+        adapter.restore(backup_file, RestoreOptions(metadata={"engine": "postgres", "compression": "gzip"}))
+
+        assert inner.restored == (b"SELECT 1;", "gzip")
+
+    def test_delegates_with_backup_keys(self, adapter, inner):
+        adapter.is_own_backup("db_20240115_120000.sql.gz.dedup")
+
+        inner.is_own_backup.assert_called_once_with("db_20240115_120000.sql.gz")
+        wrapped = adapter.for_database("other")
+        assert isinstance(wrapped, DedupBackupAdapter)
+        assert wrapped.storage is adapter.storage
+
+
+class TestCollectChunks:
+    """Tests for collect_chunks function."""
+
+    @pytest.fixture
+    def adapter(self, inner, storage):
+        adapter = DedupBackupAdapter(inner, DedupConfig(enabled=True, chunk_size_kb=64))
+        adapter.use_storage(storage)
+        return adapter
+
+    def test_deletes_chunks_of_expired_backups_only(self, adapter, inner, storage, tmp_path):
+        first = _backup(adapter, storage, tmp_path, "20240115")
+        inner.content = _dump(changed=10000)
+        _backup(adapter, storage, tmp_path, "20240116")
+        new_chunks = int(adapter.backup_metadata["dedup_new_chunks"])
+        stored = _chunks(storage)
+
+        assert collect_chunks(storage) == 0
+
+        storage.delete(first)
+        assert collect_chunks(storage) == new_chunks
+        assert len(_chunks(storage)) == len(stored) - new_chunks
+        assert storage.list(prefix=LOCK_PREFIX) == []
+
+    def test_skips_while_a_backup_is_running(self, adapter, storage, tmp_path):
+        adapter.backup(tmp_path)
+        stored = _chunks(storage)
+
+        # The index was never uploaded, as if the backup were still running
+        assert collect_chunks(storage) == 0
+        assert _chunks(storage) == stored
+
+    def test_lock_of_a_dead_backup_expires(self, adapter, storage, tmp_path):
+        adapter.backup(tmp_path)
+        lock = storage.list(prefix=LOCK_PREFIX)[0]
+        stale = StorageObject(lock.key, lock.size, datetime.now(timezone.utc) - timedelta(days=2))
+        real_list = storage.list
+
+        def listing(prefix=""):
+            return [stale if obj.key == lock.key else obj for obj in real_list(prefix)]
+
+        with mock.patch.object(storage, "list", side_effect=listing):
+            assert collect_chunks(storage) > 0
+        assert _chunks(storage) == set()
+        assert storage.list(prefix=LOCK_PREFIX) == []
+
+
+class TestLockBackup:
+    """Tests for lock_backup function."""
+
+    def test_waits_for_a_running_cleanup(self, storage, tmp_path):
+        (tmp_path / "lock").write_text("gc")
+        storage.upload(tmp_path / "lock", GC_LOCK)
+
+        with mock.patch("nestvault.dedup.GC_WAIT_SECONDS", 0):
+            with pytest.raises(BackupError):
+                lock_backup(storage, "db_20240115_120000.sql.gz.dedup")
+
+        assert [obj.key for obj in storage.list(prefix=LOCK_PREFIX)] == [GC_LOCK]
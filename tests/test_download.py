@@ -0,0 +1,138 @@
+"""Tests for download module."""
+
+import hashlib
+from unittest import mock
+
+import pytest
+
+from nestvault.config import LocalConfig
+from nestvault.download import RetryPolicy, download_backup, kept_download_path
+from nestvault.exceptions import StorageError
+from nestvault.storage.local import LocalStorageAdapter
+
+KEY = "db_20240115_120000.sql.gz"
+DATA = bytes(range(256)) * 64
+
+
+@pytest.fixture
+def storage(tmp_path):
+    root = tmp_path / "nas"
+    root.mkdir()
+    storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+    backup = tmp_path / "backup"
+    backup.write_bytes(DATA)
+    storage.upload(backup, KEY)
+    return storage
+
+
+@pytest.fixture
+def metadata():
+    return {"size": str(len(DATA)), "sha256": hashlib.sha256(DATA).hexdigest()}
+
+
+@pytest.fixture(autouse=True)
+def isolated(tmp_path, monkeypatch):
+    """Keep partial downloads in the test's directory, in ranges of 1 KiB, without waiting between retries."""
+    temp_dir = tmp_path / "tmp"
+    temp_dir.mkdir()
+    monkeypatch.setattr("tempfile.tempdir", str(temp_dir))
+    monkeypatch.setattr("nestvault.download.RANGE_SIZE", 1024)
+    with mock.patch("time.sleep"):
+        yield
+
+
+def failing_reads(storage, failures):
+    """Make reads of the storage fail at the given offsets, once each."""
+    read_range = storage.read_range
+    pending = set(failures)
+
+    def read(key, start, length):
+        if start in pending:
+            pending.remove(start)
+            raise StorageError(f"Connection reset at byte {start}")
+        return read_range(key, start, length)
+
+    return mock.patch.object(storage, "read_range", side_effect=read)
+
+
+class TestRetryPolicy:
+    """Tests for RetryPolicy class."""
+
+    def test_delay_doubles_with_jitter_up_to_max(self):
+        policy = RetryPolicy(retries=10, max_delay=5.0)
+
+        for failure, ceiling in [(1, 1.0), (2, 2.0), (3, 4.0), (4, 5.0), (9, 5.0)]:
+            assert ceiling / 2 <= policy.delay(failure) <= ceiling
+
+
+class TestDownloadBackup:
+    """Tests for download_backup function."""
+
+    def test_retries_failed_range_where_it_stopped(self, storage, metadata, tmp_path):
+        output = tmp_path / "out"
+
+        with failing_reads(storage, [4096, 4096 + 1024]) as read:
+            download_backup(storage, KEY, output, metadata, RetryPolicy(retries=2))
+
+        assert output.read_bytes() == DATA
+        # Every range is read once, plus one read for each failure
+        assert read.call_count == len(DATA) // 1024 + 2
+        assert not kept_download_path(KEY, metadata).exists()
+
+    def test_keeps_partial_download_when_retries_run_out(self, storage, metadata, tmp_path):
+        output = tmp_path / "out"
+
+        with failing_reads(storage, [4096]), pytest.raises(StorageError, match="byte 4096"):
+            download_backup(storage, KEY, output, metadata)
+
+        assert not output.exists()
+        assert kept_download_path(KEY, metadata).read_bytes() == DATA[:4096]
+
+    def test_resume_continues_partial_download(self, storage, metadata, tmp_path):
+        output = tmp_path / "out"
+        kept_download_path(KEY, metadata).write_bytes(DATA[:4096])
+
+        with failing_reads(storage, []) as read:
+            download_backup(storage, KEY, output, metadata, resume=True)
+
+        assert output.read_bytes() == DATA
+        assert read.call_args_list[0] == mock.call(KEY, 4096, 1024)
+
+    def test_discards_partial_download_without_resume(self, storage, metadata, tmp_path):
+        output = tmp_path / "out"
+        kept_download_path(KEY, metadata).write_bytes(b"stale")
+
+        download_backup(storage, KEY, output, metadata)
+
+        assert output.read_bytes() == DATA
+
+    def test_partial_download_is_tied_to_checksum(self, metadata):
+        other = dict(metadata, sha256=hashlib.sha256(b"other").hexdigest())
+
+        assert kept_download_path(KEY, metadata) != kept_download_path(KEY, other)
+
+    def test_downloads_whole_object_again_without_range_reads(self, metadata, tmp_path):
+        storage = mock.Mock(supports_range_reads=False)
+        attempts = []
+
+        def download(key, path):
+            attempts.append(key)
+            if len(attempts) == 1:
+                raise StorageError("Connection reset")
+            path.write_bytes(DATA)
+
+        storage.download.side_effect = download
+        output = tmp_path / "out"
+
+        download_backup(storage, KEY, output, metadata, RetryPolicy(retries=1))
+
+        assert output.read_bytes() == DATA
+        assert len(attempts) == 2
+
+    def test_whole_download_fails_once_retries_run_out(self, metadata, tmp_path):
+        storage = mock.Mock(supports_range_reads=False)
+        storage.download.side_effect = StorageError("Connection reset")
+
+        with pytest.raises(StorageError, match="Connection reset"):
+            download_backup(storage, KEY, tmp_path / "out", metadata, RetryPolicy(retries=2))
+        assert storage.download.call_count == 3
@@ -0,0 +1,394 @@
+"""Tests for backup encryption."""
+
+from unittest import mock
+
+import pgpy
+import pyrage
+import pytest
+from pgpy.constants import CompressionAlgorithm, HashAlgorithm, KeyFlags, PubKeyAlgorithm, SymmetricKeyAlgorithm
+
+from nestvault.backup.base import RestoreOptions, is_companion
+from nestvault.backup.encrypted import EncryptedBackupAdapter
+from nestvault.config import EncryptionConfig
+from nestvault.encryption import (
+    AESGCMCipher,
+    AgeCipher,
+    GPGCipher,
+    KMSCipher,
+    decrypted_name,
+    encrypted_name,
+    fingerprint,
+)
+from nestvault.exceptions import BackupError, IntegrityError
+
+
+@pytest.fixture
+def identity():
+    return pyrage.x25519.Identity.generate()
+
+
+@pytest.fixture
+def cipher(identity):
+    return AgeCipher(
+        EncryptionConfig(mode="age", age_recipients=[str(identity.to_public())], age_identity=str(identity))
+    )
+
+
+class TestAgeCipher:
+    """Tests for AgeCipher."""
+
+    def test_names(self):
+        assert encrypted_name("db_20240115_120000.sql.gz", "age") == "db_20240115_120000.sql.gz.age"
+        assert decrypted_name("db_20240115_120000.sql.gz.age") == "db_20240115_120000.sql.gz"
+        assert decrypted_name("db_20240115_120000.sql.gz") == "db_20240115_120000.sql.gz"
+        assert is_companion("db_20240115_120000.globals.sql.gz.age")
+
+    def test_round_trip(self, cipher, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+
+        cipher.encrypt(tmp_path / "backup", tmp_path / "backup.age")
+        cipher.decrypt(tmp_path / "backup.age", tmp_path / "restored", {})
+
+        assert b"SELECT 1;" not in (tmp_path / "backup.age").read_bytes()
+        assert (tmp_path / "restored").read_bytes() == b"SELECT 1;"
+
+    def test_identity_file(self, identity, tmp_path):
+        identity_file = tmp_path / "key.txt"
+        identity_file.write_text(f"# created: 2024-01-15\n{identity}\n")
+        config = EncryptionConfig(mode="age", age_recipients=[str(identity.to_public())])
+        (tmp_path / "backup").write_bytes(b"data")
+
+        AgeCipher(config).encrypt(tmp_path / "backup", tmp_path / "backup.age")
+        config.age_identity_file = str(identity_file)
+        AgeCipher(config).decrypt(tmp_path / "backup.age", tmp_path / "restored", {})
+
+        assert (tmp_path / "restored").read_bytes() == b"data"
+
+    def test_encrypt_requires_recipients(self, tmp_path):
+        (tmp_path / "backup").write_bytes(b"data")
+
+        with pytest.raises(BackupError) as exc_info:
+            AgeCipher(EncryptionConfig(mode="age")).encrypt(tmp_path / "backup", tmp_path / "backup.age")
+        assert "no recipients" in str(exc_info.value)
+
+    def test_decrypt_requires_identity(self, identity, tmp_path):
+        config = EncryptionConfig(mode="age", age_recipients=[str(identity.to_public())])
+        (tmp_path / "backup").write_bytes(b"data")
+        AgeCipher(config).encrypt(tmp_path / "backup", tmp_path / "backup.age")
+
+        with pytest.raises(BackupError) as exc_info:
+            AgeCipher(config).decrypt(tmp_path / "backup.age", tmp_path / "restored", {})
+        assert "AGE_IDENTITY" in str(exc_info.value)
+
+    def test_decrypt_with_wrong_identity(self, cipher, tmp_path):
+        (tmp_path / "backup").write_bytes(b"data")
+        cipher.encrypt(tmp_path / "backup", tmp_path / "backup.age")
+        other = EncryptionConfig(mode="age", age_identity=str(pyrage.x25519.Identity.generate()))
+
+        with pytest.raises(BackupError):
+            AgeCipher(other).decrypt(tmp_path / "backup.age", tmp_path / "restored", {})
+
+
+def gpg_key(passphrase=None):
+    """Generate an OpenPGP key that can encrypt."""
+    key = pgpy.PGPKey.new(PubKeyAlgorithm.RSAEncryptOrSign, 2048)
+    key.add_uid(
+        pgpy.PGPUID.new("Backups", email="ops@example.com"),
+        usage={KeyFlags.EncryptCommunications, KeyFlags.EncryptStorage},
+        hashes=[HashAlgorithm.SHA256],
+        ciphers=[SymmetricKeyAlgorithm.AES256],
+        compression=[CompressionAlgorithm.Uncompressed],
+    )
+    if passphrase:
+        key.protect(passphrase, SymmetricKeyAlgorithm.AES256, HashAlgorithm.SHA256)
+    return key
+
+
+class TestGPGCipher:
+    """Tests for GPGCipher."""
+
+    @pytest.fixture(scope="class")
+    def keys(self):
+        return [gpg_key("hunter2"), gpg_key()]
+
+    def test_round_trip_to_every_key(self, keys, tmp_path):
+        config = EncryptionConfig(mode="gpg", gpg_public_keys=[str(key.pubkey) for key in keys])
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+
+        metadata = GPGCipher(config).encrypt(tmp_path / "backup", tmp_path / "backup.gpg")
+
+        assert metadata == {"gpg_fingerprints": ",".join(fingerprint(key) for key in keys)}
+        assert b"SELECT 1;" not in (tmp_path / "backup.gpg").read_bytes()
+
+        for key, passphrase in zip(keys, ["hunter2", None]):
+            (tmp_path / "key.asc").write_text(str(key))
+            config = EncryptionConfig(
+                mode="gpg", gpg_private_key_file=str(tmp_path / "key.asc"), gpg_passphrase=passphrase
+            )
+            GPGCipher(config).decrypt(tmp_path / "backup.gpg", tmp_path / "restored", metadata)
+
+            assert (tmp_path / "restored").read_bytes() == b"SELECT 1;"
+
+    def test_encrypt_requires_public_keys(self, tmp_path):
+        (tmp_path / "backup").write_bytes(b"data")
+
+        with pytest.raises(BackupError) as exc_info:
+            GPGCipher(EncryptionConfig(mode="gpg")).encrypt(tmp_path / "backup", tmp_path / "backup.gpg")
+        assert "no public keys" in str(exc_info.value)
+
+    def test_rejects_private_key_as_public_key(self, keys):
+        with pytest.raises(BackupError) as exc_info:
+            GPGCipher(EncryptionConfig(mode="gpg", gpg_public_keys=[str(keys[1])]))
+        assert "private key" in str(exc_info.value)
+
+    def test_protected_key_requires_passphrase(self, keys, tmp_path):
+        (tmp_path / "key.asc").write_text(str(keys[0]))
+        config = EncryptionConfig(mode="gpg", gpg_private_key_file=str(tmp_path / "key.asc"))
+
+        with pytest.raises(BackupError) as exc_info:
+            GPGCipher(config).decrypt(tmp_path / "backup.gpg", tmp_path / "restored", {})
+        assert "GPG_PASSPHRASE" in str(exc_info.value)
+
+    def test_names_retired_key(self, keys, tmp_path):
+        (tmp_path / "key.asc").write_text(str(keys[1]))
+        config = EncryptionConfig(mode="gpg", gpg_private_key_file=str(tmp_path / "key.asc"))
+
+        with pytest.raises(BackupError) as exc_info:
+            GPGCipher(config).decrypt(tmp_path / "backup.gpg", tmp_path / "restored", {"gpg_fingerprints": "ABCD"})
+        assert "encrypted to ABCD" in str(exc_info.value)
+
+
+class TestAESGCMCipher:
+    """Tests for AESGCMCipher."""
+
+    @pytest.fixture(autouse=True)
+    def small_chunks(self):
+        # Cheap scrypt and tiny chunks, so a short file spans several chunks
+        with mock.patch.dict("nestvault.encryption.SCRYPT_PARAMS", {"n": 2**10}), mock.patch(
+            "nestvault.encryption.AES_GCM_CHUNK_SIZE", 16
+        ):
+            yield
+
+    @pytest.fixture
+    def cipher(self):
+        return AESGCMCipher(EncryptionConfig(mode="aes-gcm", passphrase="correct horse"))
+
+    @pytest.fixture
+    def encrypted(self, cipher, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1; " * 10)
+        cipher.encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        return tmp_path / "backup.enc"
+
+    @pytest.mark.parametrize("data", [b"", b"x" * 16, b"SELECT 1; " * 10])
+    def test_round_trip(self, cipher, data, tmp_path):
+        (tmp_path / "backup").write_bytes(data)
+
+        cipher.encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        cipher.decrypt(tmp_path / "backup.enc", tmp_path / "restored", {})
+
+        assert (tmp_path / "restored").read_bytes() == data
+
+    def test_streamed_encryption_decrypts_like_a_file(self, cipher, tmp_path):
+        from nestvault.streaming import IteratorReader
+
+        chunks, metadata = cipher.encrypt_stream(IteratorReader([b"SELECT 1; ", b"SELECT 2; " * 5]))
+        (tmp_path / "backup.enc").write_bytes(b"".join(chunks))
+        cipher.decrypt(tmp_path / "backup.enc", tmp_path / "restored", metadata)
+
+        assert (tmp_path / "restored").read_bytes() == b"SELECT 1; " + b"SELECT 2; " * 5
+
+    def test_streamed_decryption(self, cipher, encrypted):
+        with open(encrypted, "rb") as f:
+            assert b"".join(cipher.decrypt_stream(f, encrypted.name, {})) == b"SELECT 1; " * 10
+
+    def test_streamed_decryption_stops_at_modified_chunk(self, cipher, encrypted):
+        data = bytearray(encrypted.read_bytes())
+        data[-40] ^= 1
+        encrypted.write_bytes(bytes(data))
+
+        with open(encrypted, "rb") as f:
+            chunks = cipher.decrypt_stream(f, encrypted.name, {})
+            with pytest.raises(IntegrityError):
+                for _ in chunks:
+                    pass
+
+    def test_header_holds_kdf_parameters(self, encrypted):
+        header = encrypted.read_bytes()
+        assert header.startswith(b"NVAESGCM")
+        assert b'"kdf": "scrypt"' in header and b'"n": 1024' in header
+
+    def test_modified_byte_fails_integrity(self, cipher, encrypted, tmp_path):
+        data = bytearray(encrypted.read_bytes())
+        data[-40] ^= 1
+        encrypted.write_bytes(bytes(data))
+
+        with pytest.raises(IntegrityError) as exc_info:
+            cipher.decrypt(encrypted, tmp_path / "restored", {})
+        assert "Integrity check failed" in str(exc_info.value)
+
+    def test_truncation_fails_integrity(self, cipher, encrypted, tmp_path):
+        # Drop the last chunk (4 of the 100 bytes plus its tag), leaving a file that ends on a chunk boundary
+        encrypted.write_bytes(encrypted.read_bytes()[:-20])
+
+        with pytest.raises(IntegrityError):
+            cipher.decrypt(encrypted, tmp_path / "restored", {})
+
+    def test_plaintext_fails_integrity(self, cipher, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+
+        with pytest.raises(IntegrityError):
+            cipher.decrypt(tmp_path / "backup", tmp_path / "restored", {})
+
+    def test_wrong_passphrase(self, encrypted, tmp_path):
+        cipher = AESGCMCipher(EncryptionConfig(mode="aes-gcm", passphrase="wrong"))
+
+        with pytest.raises(BackupError) as exc_info:
+            cipher.decrypt(encrypted, tmp_path / "restored", {})
+        assert not isinstance(exc_info.value, IntegrityError)
+        assert "Wrong NESTVAULT_ENCRYPTION_PASSPHRASE" in str(exc_info.value)
+
+
+class TestKMSCipher:
+    """Tests for KMSCipher."""
+
+    @pytest.fixture
+    def provider(self):
+        provider = mock.Mock()
+        provider.name = "aws"
+        provider.key_id = "alias/backups"
+        provider.generate_data_key.return_value = (b"k" * 32, b"wrapped-0")
+        provider.decrypt_data_key.return_value = b"k" * 32
+        return provider
+
+    def test_round_trip_unwraps_data_key(self, provider, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1; " * 10)
+        cipher = KMSCipher(provider)
+
+        metadata = cipher.encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        cipher.decrypt(tmp_path / "backup.enc", tmp_path / "restored", metadata)
+
+        assert metadata == {"kms_provider": "aws", "kms_key_id": "alias/backups", "kms_wrapped_key": "d3JhcHBlZC0w"}
+        provider.decrypt_data_key.assert_called_once_with(b"wrapped-0")
+        assert (tmp_path / "restored").read_bytes() == b"SELECT 1; " * 10
+
+    def test_modified_byte_fails_integrity(self, provider, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+        cipher = KMSCipher(provider)
+        cipher.encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        data = bytearray((tmp_path / "backup.enc").read_bytes())
+        data[-1] ^= 1
+        (tmp_path / "backup.enc").write_bytes(bytes(data))
+
+        with pytest.raises(IntegrityError):
+            cipher.decrypt(tmp_path / "backup.enc", tmp_path / "restored", {})
+
+    def test_refuses_other_provider(self, provider, tmp_path):
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+        KMSCipher(provider).encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        provider.name = "gcp"
+
+        with pytest.raises(BackupError) as exc_info:
+            KMSCipher(provider).decrypt(tmp_path / "backup.enc", tmp_path / "restored", {})
+        assert "encrypted with aws KMS" in str(exc_info.value)
+        provider.decrypt_data_key.assert_not_called()
+
+
+class TestEncryptedBackupAdapter:
+    """Tests for EncryptedBackupAdapter."""
+
+    @pytest.fixture
+    def inner(self, tmp_path):
+        adapter = mock.Mock()
+        adapter.engine = "postgres"
+        adapter.file_extension = "sql.gz"
+        adapter.backup_metadata = {"engine": "postgres", "compression": "gzip"}
+
+        def backup(output_path):
+            backup_file = output_path / "db_20240115_120000.sql.gz"
+            backup_file.write_bytes(b"SELECT 1;")
+            return backup_file
+
+        def companions(backup_file):
+            globals_file = backup_file.with_name("db_20240115_120000.globals.sql.gz")
+            globals_file.write_bytes(b"CREATE ROLE app;")
+            return {"globals": globals_file}
+
+        adapter.backup.side_effect = backup
+        adapter.backup_companions.side_effect = companions
+        adapter.restore.side_effect = lambda backup_file, options: setattr(
+            adapter, "restored", backup_file.read_bytes()
+        )
+        return adapter
+
+    def test_backup_leaves_no_plaintext(self, inner, cipher, tmp_path):
+        adapter = EncryptedBackupAdapter(inner, cipher)
+
+        backup_file = adapter.backup(tmp_path)
+        globals_file = adapter.backup_companions(backup_file)["globals"]
+
+        assert backup_file.name == "db_20240115_120000.sql.gz.age"
+        assert globals_file.name == "db_20240115_120000.globals.sql.gz.age"
+        assert sorted(p.name for p in tmp_path.iterdir()) == [globals_file.name, backup_file.name]
+        assert inner.backup_companions.call_args[0][0].name == "db_20240115_120000.sql.gz"
+        assert adapter.backup_metadata == {"engine": "postgres", "compression": "gzip", "encryption": "age"}
+        assert adapter.file_extension == "sql.gz.age"
+
+    def test_missing_recipients_fails_backup(self, inner, identity, tmp_path):
+        adapter = EncryptedBackupAdapter(inner, AgeCipher(EncryptionConfig(mode="age", age_identity=str(identity))))
+
+        with pytest.raises(BackupError):
+            adapter.backup(tmp_path)
+
+        assert list(tmp_path.iterdir()) == []
+
+    def test_restore_decrypts(self, inner, cipher, tmp_path):
+        adapter = EncryptedBackupAdapter(inner, cipher)
+        backup_file = adapter.backup(tmp_path)
+
+        adapter.restore(backup_file, RestoreOptions(metadata={"engine": "postgres", "encryption": "age"}))
+
+        assert inner.restored == b"SELECT 1;"
+
+    def test_streaming_restore_needs_streaming_cipher(self, inner, cipher):
+        inner.supports_streaming_restore.return_value = True
+        adapter = EncryptedBackupAdapter(inner, cipher)
+
+        assert adapter.supports_streaming_restore({"engine": "postgres"}) is True
+        assert adapter.supports_streaming_restore({"engine": "postgres", "encryption": "age"}) is False
+
+    def test_restore_stream_decrypts(self, inner, tmp_path):
+        import io
+
+        cipher = AESGCMCipher(EncryptionConfig(mode="aes-gcm", passphrase="correct horse"))
+        (tmp_path / "backup").write_bytes(b"SELECT 1;")
+        with mock.patch.dict("nestvault.encryption.SCRYPT_PARAMS", {"n": 2**10}):
+            cipher.encrypt(tmp_path / "backup", tmp_path / "backup.enc")
+        inner.restore_stream.side_effect = lambda name, stream, options: setattr(
+            inner, "restored", (name, stream.read())
+        )
+
+        EncryptedBackupAdapter(inner, cipher).restore_stream(
+            "db_20240115_120000.sql.gz.enc",
+            io.BytesIO((tmp_path / "backup.enc").read_bytes()),
+            RestoreOptions(metadata={"engine": "postgres", "encryption": "aes-gcm"}),
+        )
+
+        assert inner.restored == ("db_20240115_120000.sql.gz", b"SELECT 1;")
+
+    def test_restore_passes_plaintext_backup_through(self, inner, cipher, tmp_path):
+        backup_file = tmp_path / "db_20240115_120000.sql.gz"
+        backup_file.write_bytes(b"SELECT 1;")
+
+        EncryptedBackupAdapter(inner, cipher).restore(backup_file, RestoreOptions(metadata={"engine": "postgres"}))
+
+        assert inner.restored == b"SELECT 1;"
+
+    def test_delegates_with_plaintext_keys(self, inner, cipher):
+        adapter = EncryptedBackupAdapter(inner, cipher)
+
+        adapter.delete_backup_data("db_20240115_120000.sql.gz.age")
+        adapter.is_own_backup("db_20240115_120000.sql.gz.age")
+
+        inner.delete_backup_data.assert_called_once_with("db_20240115_120000.sql.gz")
+        inner.is_own_backup.assert_called_once_with("db_20240115_120000.sql.gz")
+        assert isinstance(adapter.for_database("other"), EncryptedBackupAdapter)
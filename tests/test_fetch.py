@@ -0,0 +1,87 @@
+"""Tests for fetch module."""
+
+import gzip
+import hashlib
+import io
+from unittest import mock
+
+import pytest
+
+from nestvault.config import LocalConfig
+from nestvault.exceptions import BackupError, IntegrityError
+from nestvault.fetch import fetch_backup
+from nestvault.storage.local import LocalStorageAdapter
+
+KEY = "db_20240115_120000.sql.gz"
+DUMP = gzip.compress(b"SELECT 1;")
+
+
+@pytest.fixture
+def storage(tmp_path):
+    root = tmp_path / "nas"
+    root.mkdir()
+    storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+    backup = tmp_path / "backup"
+    backup.write_bytes(DUMP)
+    metadata = {
+        "engine": "postgres",
+        "compression": "gzip",
+        "size": str(len(DUMP)),
+        "sha256": hashlib.sha256(DUMP).hexdigest(),
+    }
+    storage.upload(backup, KEY, metadata=metadata)
+    return storage
+
+
+class TestFetchBackup:
+    """Tests for fetch_backup function."""
+
+    def test_writes_backup_as_stored_readable_by_owner_only(self, storage, tmp_path):
+        output = tmp_path / "db.sql.gz"
+
+        fetch_backup(storage, KEY, str(output))
+
+        assert output.read_bytes() == DUMP
+        assert output.stat().st_mode & 0o777 == 0o600
+
+    def test_decompresses(self, storage, tmp_path):
+        output = tmp_path / "db.sql"
+
+        fetch_backup(storage, KEY, str(output), decompress=True)
+
+        assert output.read_bytes() == b"SELECT 1;"
+
+    def test_refuses_to_overwrite_without_force(self, storage, tmp_path):
+        output = tmp_path / "db.sql.gz"
+        output.write_bytes(b"keep")
+
+        with pytest.raises(BackupError, match="--force"):
+            fetch_backup(storage, KEY, str(output))
+        assert output.read_bytes() == b"keep"
+
+        fetch_backup(storage, KEY, str(output), force=True)
+        assert output.read_bytes() == DUMP
+
+    def test_writes_to_stdout(self, storage):
+        stdout = mock.Mock(buffer=io.BytesIO())
+
+        with mock.patch("sys.stdout", stdout):
+            fetch_backup(storage, KEY, "-", decompress=True)
+
+        assert stdout.buffer.getvalue() == b"SELECT 1;"
+
+    def test_corrupt_backup_is_not_written(self, storage, tmp_path):
+        (storage.root / KEY).write_bytes(b"corrupt")
+        output = tmp_path / "db.sql.gz"
+
+        with pytest.raises(IntegrityError):
+            fetch_backup(storage, KEY, str(output))
+        assert not output.exists()
+
+    def test_decompressing_encrypted_backup_needs_decrypt(self, tmp_path):
+        storage = mock.Mock()
+        storage.get_metadata.return_value = {"encryption": "age"}
+
+        with pytest.raises(BackupError, match="--decrypt"):
+            fetch_backup(storage, KEY, str(tmp_path / "db.sql"), decompress=True)
+        storage.download.assert_not_called()
@@ -0,0 +1,92 @@
+"""Tests for hold module."""
+
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.config import LocalConfig
+from nestvault.exceptions import StorageError
+from nestvault.hold import place_hold, read_holds, release_hold
+from nestvault.manifest import hold_key, manifest_key
+from nestvault.retention import prune_backups
+from nestvault.storage.local import LocalStorageAdapter
+
+HELD = "db_20240101_120000.sql.gz"
+OTHER = "db_20240102_120000.sql.gz"
+
+
+@pytest.fixture
+def storage(tmp_path):
+    root = tmp_path / "nas"
+    root.mkdir()
+    storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+    for key in (HELD, manifest_key(HELD), OTHER):
+        local_file = tmp_path / "object"
+        local_file.write_bytes(b"data")
+        storage.upload(local_file, key)
+    return storage
+
+
+def prune_a_year_later(storage, dry_run=False):
+    with mock.patch("nestvault.retention.datetime") as clock:
+        clock.now.return_value = datetime.now(timezone.utc) + timedelta(days=365)
+        return prune_backups(storage, retention_days=7, prefix="db", dry_run=dry_run)
+
+
+class TestHolds:
+    """Tests for place_hold, read_holds and release_hold functions."""
+
+    def test_retention_keeps_held_backup(self, storage):
+        place_hold(storage, HELD, "before the orders migration")
+
+        report = prune_a_year_later(storage)
+
+        remaining = sorted(obj.key for obj in storage.list())
+        assert remaining == [HELD, hold_key(HELD), manifest_key(HELD)]
+        assert report.held == [HELD]
+        assert report.deleted == 1
+        held = next(decision for decision in report.decisions if decision.key == HELD)
+        assert held.reason.endswith("before the orders migration, though older than 7 days")
+
+    def test_released_backup_is_pruned(self, storage):
+        place_hold(storage, HELD)
+
+        released = release_hold(storage, HELD)
+        prune_a_year_later(storage)
+
+        assert released.backup == HELD
+        assert release_hold(storage, HELD) is None
+        assert storage.list() == []
+
+    def test_records_who_held_the_backup_and_why(self, storage):
+        with mock.patch("nestvault.hold.operator", return_value="root@nestvault"):
+            place_hold(storage, HELD, "before the orders migration")
+
+        [hold] = read_holds(storage, storage.list()).values()
+
+        assert hold.describe().startswith("held by root@nestvault since ")
+        assert hold.describe().endswith(": before the orders migration")
+
+    def test_unreadable_hold_still_holds(self, storage, tmp_path):
+        (tmp_path / "nas" / hold_key(OTHER)).write_text("{")
+
+        report = prune_a_year_later(storage, dry_run=True)
+
+        assert report.held == [OTHER]
+        assert [decision.key for decision in report.decisions if decision.delete] == [HELD, manifest_key(HELD)]
+
+    def test_missing_backup_cannot_be_held(self, storage):
+        with pytest.raises(StorageError, match="Backup not found"):
+            place_hold(storage, "db_20240103_120000.sql.gz")
+
+    def test_legal_hold_covers_every_object_of_the_backup(self):
+        storage = mock.Mock()
+        storage.list.return_value = [
+            mock.Mock(key=HELD), mock.Mock(key=manifest_key(HELD)), mock.Mock(key=hold_key(HELD))
+        ]
+        storage.download.side_effect = StorageError("no manifest")
+
+        place_hold(storage, HELD, legal_hold=True)
+
+        assert storage.set_legal_hold.call_args_list == [mock.call(HELD, True), mock.call(manifest_key(HELD), True)]
@@ -0,0 +1,113 @@
+"""Tests for hooks module."""
+
+import time
+
+import pytest
+
+from nestvault.exceptions import HookError
+from nestvault.hooks import HookContext, run_post_hooks, run_pre_backup_hooks, run_pre_restore_hooks
+
+
+@pytest.fixture
+def context():
+    return HookContext(target="default", database="mydb")
+
+
+class TestRunPreBackupHooks:
+    """Tests for run_pre_backup_hooks function."""
+
+    def test_commands_see_the_job_environment(self, context, tmp_path):
+        output = tmp_path / "env"
+
+        run_pre_backup_hooks([f'echo "$NESTVAULT_TARGET $NESTVAULT_DATABASE $NESTVAULT_STATUS" > {output}'], context, 5)
+
+        assert output.read_text() == "default mydb running\n"
+
+    def test_failure_aborts_with_hook_error(self, context, tmp_path):
+        later = tmp_path / "later"
+
+        with pytest.raises(HookError) as exc_info:
+            run_pre_backup_hooks(["exit 3", f"touch {later}"], context, 5)
+
+        assert "exited with status 3" in str(exc_info.value)
+        assert not later.exists()
+
+    def test_timeout_aborts(self, context):
+        with pytest.raises(HookError) as exc_info:
+            run_pre_backup_hooks(["sleep 5"], context, 1)
+
+        assert "timed out after 1 seconds" in str(exc_info.value)
+
+    def test_timeout_kills_what_the_command_started(self, context, tmp_path):
+        late = tmp_path / "late"
+
+        with pytest.raises(HookError):
+            run_pre_backup_hooks([f"(sleep 2 && touch {late}) & wait"], context, 1)
+
+        time.sleep(1.5)
+        assert not late.exists()
+
+
+class TestRunPreRestoreHooks:
+    """Tests for run_pre_restore_hooks function."""
+
+    def test_commands_see_the_backup_and_destination(self, tmp_path):
+        output = tmp_path / "env"
+        context = HookContext(
+            target="default",
+            database="mydb",
+            backup_key="mydb_20240115_120000.dump",
+            event="restore",
+            destination="postgresql://app@staging:5432/mydb",
+        )
+
+        command = f'echo "$NESTVAULT_EVENT $NESTVAULT_BACKUP_KEY $NESTVAULT_DESTINATION" > {output}'
+        run_pre_restore_hooks([command], context, 5)
+
+        assert output.read_text() == "restore mydb_20240115_120000.dump postgresql://app@staging:5432/mydb\n"
+
+    def test_failure_aborts_with_hook_error(self, context):
+        with pytest.raises(HookError) as exc_info:
+            run_pre_restore_hooks(["exit 2"], context, 5)
+
+        assert str(exc_info.value) == "Pre-restore hook 'exit 2' exited with status 2"
+
+
+class TestRunPostHooks:
+    """Tests for run_post_hooks function."""
+
+    def test_exposes_backup_key_size_and_status(self, tmp_path):
+        output = tmp_path / "env"
+        context = HookContext(
+            target="nightly", database="mydb", backup_key="mydb_20240115_120000.sql.gz", size=1024, status="success"
+        )
+
+        command = f'echo "$NESTVAULT_BACKUP_KEY $NESTVAULT_BACKUP_SIZE $NESTVAULT_STATUS" > {output}'
+        failures = run_post_hooks("post_backup", [command], context, 5)
+
+        assert failures == []
+        assert output.read_text() == "mydb_20240115_120000.sql.gz 1024 success\n"
+
+    def test_exposes_labels(self, tmp_path):
+        output = tmp_path / "env"
+        context = HookContext(target="default", database="mydb", labels="reason=pre-migration", status="success")
+
+        run_post_hooks("post_backup", [f'echo "$NESTVAULT_LABELS" > {output}'], context, 5)
+
+        assert output.read_text() == "reason=pre-migration\n"
+
+    def test_exposes_event(self, tmp_path):
+        output = tmp_path / "env"
+        context = HookContext(target="default", database="mydb", status="failure", event="restore_verification")
+
+        run_post_hooks("post_failure", [f'echo "$NESTVAULT_EVENT" > {output}'], context, 5)
+
+        assert output.read_text() == "restore_verification\n"
+
+    def test_every_command_runs_and_failures_are_returned(self, context, tmp_path):
+        later = tmp_path / "later"
+
+        failures = run_post_hooks("post_failure", ["echo oops >&2; exit 1", f"touch {later}"], context, 5)
+
+        assert failures == ["'echo oops >&2; exit 1' exited with status 1"]
+        assert later.exists()
@@ -0,0 +1,52 @@
+"""Tests for KMS key providers."""
+
+from unittest import mock
+
+import pytest
+from botocore.exceptions import ClientError
+
+from nestvault.config import EncryptionConfig
+from nestvault.exceptions import BackupError
+from nestvault.kms import ENCRYPTION_CONTEXT, AWSKMSKeyProvider
+
+
+class TestAWSKMSKeyProvider:
+    """Tests for AWSKMSKeyProvider."""
+
+    @pytest.fixture
+    def client(self):
+        with mock.patch("boto3.client") as mock_client:
+            yield mock_client
+
+    def test_generates_data_key(self, client):
+        client.return_value.generate_data_key.return_value = {"Plaintext": b"key", "CiphertextBlob": b"wrapped"}
+        provider = AWSKMSKeyProvider(EncryptionConfig(mode="kms", kms_key_id="alias/backups", kms_region="eu-west-1"))
+
+        assert provider.generate_data_key() == (b"key", b"wrapped")
+
+        client.assert_called_once_with("kms", region_name="eu-west-1")
+        client.return_value.generate_data_key.assert_called_once_with(
+            KeyId="alias/backups", KeySpec="AES_256", EncryptionContext=ENCRYPTION_CONTEXT
+        )
+
+    def test_generate_requires_key_id(self, client):
+        with pytest.raises(BackupError) as exc_info:
+            AWSKMSKeyProvider(EncryptionConfig(mode="kms")).generate_data_key()
+        assert "KMS_KEY_ID" in str(exc_info.value)
+
+    def test_decrypts_without_key_id(self, client):
+        client.return_value.decrypt.return_value = {"Plaintext": b"key"}
+
+        assert AWSKMSKeyProvider(EncryptionConfig(mode="kms")).decrypt_data_key(b"wrapped") == b"key"
+        client.return_value.decrypt.assert_called_once_with(
+            CiphertextBlob=b"wrapped", EncryptionContext=ENCRYPTION_CONTEXT
+        )
+
+    def test_access_denied(self, client):
+        client.return_value.decrypt.side_effect = ClientError(
+            {"Error": {"Code": "AccessDeniedException", "Message": "not authorized"}}, "Decrypt"
+        )
+
+        with pytest.raises(BackupError) as exc_info:
+            AWSKMSKeyProvider(EncryptionConfig(mode="kms")).decrypt_data_key(b"wrapped")
+        assert "Decrypt" in str(exc_info.value)
@@ -0,0 +1,139 @@
+"""Tests for lock module."""
+
+import json
+import threading
+import time
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.config import LocalConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.lock import check_lock, lock_key, target_lock
+from nestvault.manifest import list_backups
+from nestvault.storage.local import LocalStorageAdapter
+
+TTL = timedelta(minutes=10)
+ACQUIRED_AT = "2024-01-15T02:00:00+00:00"
+
+
+@pytest.fixture
+def storage(tmp_path):
+    return LocalStorageAdapter(LocalConfig(root=str(tmp_path)))
+
+
+def stored_lock(tmp_path, name, owner, expires_at):
+    path = tmp_path / lock_key(name)
+    path.parent.mkdir(parents=True, exist_ok=True)
+    path.write_text(json.dumps({"owner": owner, "acquired_at": ACQUIRED_AT, "expires_at": expires_at.isoformat()}))
+    return path
+
+
+class TestTargetLock:
+    """Tests for target_lock function."""
+
+    def test_run_under_way_in_this_process_holds_the_lock(self):
+        with target_lock("billing") as outer:
+            with target_lock("billing") as inner, target_lock("orders") as other:
+                assert (outer, inner, other) == (True, False, True)
+
+        with target_lock("billing") as again:
+            assert again
+
+    def test_lock_object_is_created_and_released(self, storage, tmp_path):
+        with target_lock("billing", storage, TTL) as acquired:
+            assert acquired
+            record = json.loads((tmp_path / lock_key("billing")).read_text())
+            assert datetime.fromisoformat(record["expires_at"]) > datetime.now(timezone.utc) + TTL / 2
+            assert list_backups(storage, prefix="") == []
+
+        assert not (tmp_path / lock_key("billing")).exists()
+
+    def test_lock_held_by_another_replica_is_not_acquired(self, storage, tmp_path):
+        path = stored_lock(tmp_path, "billing", "replica-2", datetime.now(timezone.utc) + TTL)
+
+        with target_lock("billing", storage, TTL) as acquired:
+            assert not acquired
+
+        assert json.loads(path.read_text())["owner"] == "replica-2"
+
+    def test_expired_lock_is_taken_over(self, storage, tmp_path):
+        path = stored_lock(tmp_path, "billing", "crashed", datetime.now(timezone.utc) - timedelta(seconds=1))
+
+        with target_lock("billing", storage, TTL) as acquired:
+            assert acquired
+            assert json.loads(path.read_text())["owner"] != "crashed"
+
+        assert not path.exists()
+
+    def test_only_one_of_two_replicas_takes_over_an_expired_lock(self, storage, tmp_path):
+        stored_lock(tmp_path, "billing", "crashed", datetime.now(timezone.utc) - timedelta(seconds=1))
+        # Both replicas read the expired lock before either writes it
+        both_read, both_tried = threading.Barrier(2), threading.Barrier(2)
+        read_versioned = storage.read_versioned
+        results = []
+
+        def read_together(key):
+            found = read_versioned(key)
+            if found is not None and b"crashed" in found[0]:
+                both_read.wait(5)
+            return found
+
+        def replica():
+            with target_lock("billing", storage, TTL) as acquired:
+                results.append(acquired)
+                both_tried.wait(5)
+
+        # Each replica is a process of its own, which the lock of this process does not hold back
+        running = mock.MagicMock()
+        running.__contains__.return_value = False
+        with mock.patch("nestvault.lock._running", running), \
+                mock.patch.object(storage, "read_versioned", side_effect=read_together):
+            replicas = [threading.Thread(target=replica) for _ in range(2)]
+            for thread in replicas:
+                thread.start()
+            for thread in replicas:
+                thread.join()
+
+        assert sorted(results) == [False, True]
+
+    def test_lock_is_renewed(self, storage, tmp_path):
+        with target_lock("billing", storage, timedelta(seconds=0.3)):
+            first = json.loads((tmp_path / lock_key("billing")).read_text())["expires_at"]
+            time.sleep(0.25)
+            assert json.loads((tmp_path / lock_key("billing")).read_text())["expires_at"] > first
+            check_lock("upload")
+
+    def test_run_that_lost_its_lock_is_cancelled(self, storage, tmp_path):
+        with mock.patch("nestvault.lock.terminate_children", return_value=1) as terminate:
+            with target_lock("billing", storage, timedelta(seconds=0.3)):
+                path = stored_lock(tmp_path, "billing", "replica-2", datetime.now(timezone.utc) + TTL)
+                time.sleep(0.25)
+                with pytest.raises(BackupError, match="Lost lock locks/billing.json to another run"):
+                    check_lock("upload")
+
+        terminate.assert_called_once_with(threading.get_native_id())
+        assert json.loads(path.read_text())["owner"] == "replica-2"
+        # Outside a run there is no lock to lose
+        check_lock("upload")
+
+    def test_lock_taken_over_meanwhile_is_left_in_place(self, storage, tmp_path):
+        with target_lock("billing", storage, TTL) as acquired:
+            assert acquired
+            path = stored_lock(tmp_path, "billing", "replica-2", datetime.now(timezone.utc) + TTL)
+
+        assert path.exists()
+
+    def test_unreadable_storage_raises(self):
+        storage = mock.Mock()
+        storage.create_exclusive.return_value = False
+        storage.read_versioned.side_effect = StorageError("access denied")
+
+        with pytest.raises(StorageError, match="access denied"):
+            with target_lock("billing", storage, TTL):
+                pass
+
+        # A later run is not refused as if one were still under way
+        with target_lock("billing") as acquired:
+            assert acquired
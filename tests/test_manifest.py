@@ -0,0 +1,221 @@
+"""Tests for manifest module."""
+
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import is_companion
+from nestvault.config import LocalConfig
+from nestvault.manifest import (
+    Manifest,
+    backup_objects,
+    build_manifest,
+    format_labels,
+    list_backups,
+    manifest_key,
+    unchanged_key,
+    write_manifest,
+    write_unchanged_record,
+)
+from nestvault.storage.local import LocalStorageAdapter
+
+STARTED = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+FINISHED = datetime(2024, 1, 15, 12, 5, 0, tzinfo=timezone.utc)
+
+
+class TestManifest:
+    """Tests for the Manifest record."""
+
+    def test_round_trip(self):
+        manifest = Manifest(
+            key="db_20240115_120000.sql.gz",
+            database="db",
+            finished_at=FINISHED,
+            size=100,
+            engine="postgres",
+            started_at=STARTED,
+            server_version="16.2",
+            compression="gzip",
+            sha256="0" * 64,
+            labels={"reason": "pre-migration"},
+        )
+
+        assert Manifest.from_json(manifest.to_json()) == manifest
+
+    def test_ignores_unknown_fields(self):
+        text = (
+            '{"format": 2, "key": "db.sql.gz", "database": "db", "size": 1, '
+            '"finished_at": "2024-01-15T12:05:00+00:00", "added_later": true}'
+        )
+
+        assert Manifest.from_json(text).key == "db.sql.gz"
+
+    def test_rejects_incomplete_manifest(self):
+        with pytest.raises(ValueError):
+            Manifest.from_json('{"key": "db.sql.gz"}')
+
+    def test_manifest_is_a_companion(self):
+        assert manifest_key("db_20240115_120000.sql.gz.age") == "db_20240115_120000.sql.gz.age.manifest.json"
+        assert is_companion(manifest_key("db_20240115_120000.sql.gz.age"))
+
+    def test_build_manifest(self):
+        adapter = mock.Mock()
+        adapter.database_name = "db"
+        adapter.engine = "postgres"
+        adapter.server_version.return_value = "16.2"
+        metadata = {"engine": "postgres", "encryption": "age", "size": "100", "sha256": "f" * 64}
+
+        manifest = build_manifest(adapter, "db_20240115_120000.sql.gz.age", metadata, STARTED, FINISHED)
+
+        assert manifest.encryption == "age"
+        assert manifest.size == 100
+        assert manifest.sha256 == "f" * 64
+        assert manifest.server_version == "16.2"
+        assert manifest.nestvault_version
+        assert not manifest.partial
+
+    def test_build_manifest_records_table_exclusions(self):
+        adapter = mock.Mock()
+        adapter.database_name = "db"
+        adapter.engine = "postgres"
+        adapter.server_version.return_value = None
+        metadata = {"engine": "postgres", "exclude_tables": "*.events,public.audit_*", "size": "100"}
+
+        manifest = build_manifest(adapter, "db_20240115_120000.sql.gz", metadata, STARTED, FINISHED)
+
+        assert manifest.exclude_tables == ["*.events", "public.audit_*"]
+        assert manifest.partial
+        assert Manifest.from_json(manifest.to_json()).exclude_tables == ["*.events", "public.audit_*"]
+
+
+    def test_build_manifest_records_size_estimate(self):
+        adapter = mock.Mock()
+        adapter.database_name = "db"
+        adapter.engine = "postgres"
+        adapter.server_version.return_value = None
+        metadata = {"engine": "postgres", "estimated_size": "120", "database_size": "400", "size": "100"}
+
+        manifest = build_manifest(adapter, "db_20240115_120000.sql.gz", metadata, STARTED, FINISHED)
+
+        assert (manifest.estimated_size, manifest.database_size, manifest.size) == (120, 400, 100)
+
+    def test_build_manifest_records_labels(self):
+        adapter = mock.Mock()
+        adapter.database_name = "db"
+        adapter.engine = "postgres"
+        adapter.server_version.return_value = None
+        labels = format_labels({"reason": "pre-migration", "env": "prod"})
+        metadata = {"engine": "postgres", "labels": labels, "size": "100"}
+
+        manifest = build_manifest(adapter, "db_20240115_120000.sql.gz", metadata, STARTED, FINISHED)
+
+        assert labels == "env=prod,reason=pre-migration"
+        assert manifest.labels == {"env": "prod", "reason": "pre-migration"}
+
+class TestListBackups:
+    """Tests for list_backups function."""
+
+    @pytest.fixture
+    def storage(self, tmp_path):
+        root = tmp_path / "nas"
+        root.mkdir()
+        return LocalStorageAdapter(LocalConfig(root=str(root)))
+
+    def _upload(self, storage, tmp_path, key):
+        backup = tmp_path / "backup"
+        backup.write_bytes(b"backup data")
+        storage.upload(backup, key)
+
+    def test_reads_manifests_and_falls_back_for_legacy_backups(self, storage, tmp_path):
+        self._upload(storage, tmp_path, "db_20240114_120000.sql.gz")
+        self._upload(storage, tmp_path, "db_20240115_120000.sql.gz")
+        self._upload(storage, tmp_path, "db_staging_20240115_120000.sql.gz")
+        manifest = Manifest(
+            key="db_20240115_120000.sql.gz",
+            database="db",
+            finished_at=datetime.now(timezone.utc),
+            size=11,
+            engine="postgres",
+        )
+        write_manifest(storage, manifest, tmp_path)
+
+        newest, legacy = list_backups(storage, "db")
+
+        assert newest == manifest
+        assert legacy.key == "db_20240114_120000.sql.gz"
+        assert legacy.legacy
+        assert legacy.database == "db"
+        assert legacy.size == 11
+
+    def test_unreadable_manifest_is_ignored(self, storage, tmp_path):
+        self._upload(storage, tmp_path, "db_20240115_120000.sql.gz")
+        self._upload(storage, tmp_path, manifest_key("db_20240115_120000.sql.gz"))
+
+        [backup] = list_backups(storage, "db")
+
+        assert backup.legacy
+
+    def test_guesses_database_of_legacy_backups(self, storage, tmp_path):
+        self._upload(storage, tmp_path, "db_staging_20240115_120000.sql.gz")
+
+        assert [backup.database for backup in list_backups(storage)] == ["db_staging"]
+
+    def _templated(self, storage, tmp_path, key, database):
+        self._upload(storage, tmp_path, key)
+        manifest = Manifest(key=key, database=database, finished_at=FINISHED, size=11, metadata={"globals": f"{key}.g"})
+        write_manifest(storage, manifest, tmp_path)
+        return manifest
+
+    def test_lists_templated_keys_by_manifest(self, storage, tmp_path):
+        manifest = self._templated(storage, tmp_path, "prod/db/2024/01/15/120000.sql.gz", "db")
+        self._templated(storage, tmp_path, "prod/db_staging/2024/01/15/120000.sql.gz", "db_staging")
+
+        assert list_backups(storage, "db", prefix="prod/") == [manifest]
+
+    def test_backup_objects_follow_manifests(self, storage, tmp_path):
+        self._templated(storage, tmp_path, "prod/db/120000.sql.gz", "db")
+        self._upload(storage, tmp_path, "prod/db/120000.sql.gz.g")
+        self._templated(storage, tmp_path, "prod/other/120000.sql.gz", "other")
+        self._upload(storage, tmp_path, "db_20240114_120000.sql.gz")
+
+        objects = backup_objects(storage, storage.list(prefix=""), "db")
+
+        assert sorted(obj.key for obj in objects) == [
+            "db_20240114_120000.sql.gz",
+            "prod/db/120000.sql.gz",
+            "prod/db/120000.sql.gz.g",
+            "prod/db/120000.sql.gz.manifest.json",
+        ]
+
+    def test_backup_objects_of_tier(self, storage, tmp_path):
+        for key, labels in (
+            ("db_20240115_120000.sql.gz", {"tier": "hourly"}),
+            ("db_20240115_130000.sql.gz", {"tier": "daily"}),
+            ("db_20240115_140000.sql.gz", {}),
+        ):
+            self._upload(storage, tmp_path, key)
+            manifest = Manifest(key=key, database="db", finished_at=FINISHED, size=11, labels=labels)
+            write_manifest(storage, manifest, tmp_path)
+        self._upload(storage, tmp_path, "db_20240114_120000.sql.gz")
+
+        hourly = backup_objects(storage, storage.list(prefix=""), "db", tier="hourly")
+        adhoc = backup_objects(storage, storage.list(prefix=""), "db", tier="adhoc")
+
+        assert [obj.key for obj in hourly if not obj.key.endswith(".json")] == ["db_20240115_120000.sql.gz"]
+        # Backups recording no tier, with a manifest or without, count as ad hoc
+        assert sorted(obj.key for obj in adhoc if not obj.key.endswith(".json")) == [
+            "db_20240114_120000.sql.gz",
+            "db_20240115_140000.sql.gz",
+        ]
+
+    def test_unchanged_record_belongs_to_its_backup(self, storage, tmp_path):
+        manifest = self._templated(storage, tmp_path, "prod/db/120000.sql.gz", "db")
+        write_unchanged_record(storage, manifest, FINISHED, tmp_path)
+        write_unchanged_record(storage, manifest, FINISHED, tmp_path)
+
+        objects = backup_objects(storage, storage.list(prefix=""), "db")
+
+        assert unchanged_key(manifest.key) in [obj.key for obj in objects]
+        assert is_companion(unchanged_key(manifest.key))
+        assert list_backups(storage, "db", prefix="prod/") == [manifest]
@@ -0,0 +1,232 @@
+"""Tests for metrics module."""
+
+import json
+import urllib.error
+import urllib.request
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault import status
+from nestvault.exceptions import ConfigError, StorageError
+from nestvault.metrics import (
+    BACKUPS,
+    LAST_RAW_SIZE,
+    LAST_SIZE,
+    LAST_SUCCESS,
+    UPLOAD_DURATION,
+    UPLOADED_BYTES,
+    Counter,
+    Gauge,
+    Histogram,
+    record_backup,
+    serve,
+)
+from nestvault.stats import BackupStats
+
+
+class TestMetrics:
+    """Tests for the Counter, Gauge and Histogram classes."""
+
+    def test_counter_renders_a_series_per_label_set(self):
+        counter = Counter("backups_total", "Backups.", ("target", "status"))
+        counter.inc(target="billing", status="success")
+        counter.inc(2, target="billing", status="success")
+        counter.inc(target='a "quoted" one', status="failure")
+
+        assert counter.render() == (
+            "# HELP backups_total Backups.\n"
+            "# TYPE backups_total counter\n"
+            'backups_total{target="a \\"quoted\\" one",status="failure"} 1\n'
+            'backups_total{target="billing",status="success"} 3\n'
+        )
+
+    def test_counter_rejects_wrong_labels_and_decreases(self):
+        counter = Counter("backups_total", "Backups.", ("target",))
+
+        with pytest.raises(ValueError, match="takes labels target"):
+            counter.inc(status="success")
+        with pytest.raises(ValueError, match="can only increase"):
+            counter.inc(-1, target="billing")
+
+    def test_gauge_keeps_the_last_value(self):
+        gauge = Gauge("size_bytes", "Size.")
+        gauge.set(10)
+        gauge.set(2.5)
+
+        assert gauge.samples() == ["size_bytes 2.5"]
+
+    def test_histogram_buckets_are_cumulative(self):
+        histogram = Histogram("duration_seconds", "Duration.", ("target",), buckets=(10, 60))
+        for seconds in (5, 30, 45, 600):
+            histogram.observe(seconds, target="billing")
+
+        assert histogram.samples() == [
+            'duration_seconds_bucket{target="billing",le="10"} 1',
+            'duration_seconds_bucket{target="billing",le="60"} 3',
+            'duration_seconds_bucket{target="billing",le="+Inf"} 4',
+            'duration_seconds_sum{target="billing"} 680',
+            'duration_seconds_count{target="billing"} 4',
+        ]
+
+
+class TestRecordBackup:
+    """Tests for record_backup function."""
+
+    def test_success_sets_the_last_backup(self):
+        stats = BackupStats()
+        stats.add("compress", 2.0, bytes_in=4000, bytes_out=1000)
+        stats.add("upload", 3.0, bytes_out=1000)
+
+        record_backup("metrics-success", True, 12.0, 1705284000.0, 1000, stats)
+
+        assert BACKUPS.value(target="metrics-success", status="success") == 1
+        assert LAST_SUCCESS.value(target="metrics-success") == 1705284000.0
+        assert LAST_SIZE.value(target="metrics-success") == 1000
+        assert LAST_RAW_SIZE.value(target="metrics-success") == 4000
+        assert UPLOAD_DURATION.count(target="metrics-success") == 1
+        assert UPLOADED_BYTES.value(target="metrics-success") == 1000
+
+    def test_failure_leaves_the_last_success_in_place(self):
+        record_backup("metrics-failure", True, 12.0, 1705284000.0, 1000, BackupStats())
+
+        record_backup("metrics-failure", False, 3.0, 1705370400.0, None, BackupStats())
+
+        assert BACKUPS.value(target="metrics-failure", status="failure") == 1
+        assert LAST_SUCCESS.value(target="metrics-failure") == 1705284000.0
+
+
+class TestServe:
+    """Tests for serve function."""
+
+    def test_serves_metrics(self):
+        record_backup("metrics-served", True, 1.0, 1705284000.0, 10, BackupStats())
+        server = serve("127.0.0.1", 0)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            with urllib.request.urlopen(f"{url}/metrics", timeout=5) as response:
+                body = response.read().decode()
+                assert response.headers["Content-Type"].startswith("text/plain; version=0.0.4")
+
+            with pytest.raises(urllib.error.HTTPError, match="404"):
+                urllib.request.urlopen(f"{url}/other", timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
+
+        assert 'nestvault_last_success_timestamp_seconds{target="metrics-served"} 1705284000' in body
+        assert "# TYPE nestvault_backup_duration_seconds histogram" in body
+
+    def test_serves_status_and_health(self):
+        due = datetime.now(timezone.utc) + timedelta(hours=1)
+        upcoming = {"billing": {"next_run": due.isoformat(), "due": due.isoformat()}}
+
+        with mock.patch.dict(status._targets, clear=True):
+            status.register(["billing", "crm"])
+            with status.tracking("billing") as run:
+                run.succeeded = True
+            server = serve("127.0.0.1", 0, lambda: upcoming, timedelta(hours=1))
+            url = f"http://127.0.0.1:{server.server_address[1]}"
+            try:
+                with urllib.request.urlopen(f"{url}/status", timeout=5) as response:
+                    assert response.headers["Content-Type"] == "application/json"
+                    targets = json.loads(response.read())
+                with urllib.request.urlopen(f"{url}/status/billing", timeout=5) as response:
+                    billing = json.loads(response.read())
+                with pytest.raises(urllib.error.HTTPError, match="404"):
+                    urllib.request.urlopen(f"{url}/status/unknown", timeout=5)
+                with urllib.request.urlopen(f"{url}/healthz", timeout=5) as response:
+                    assert json.loads(response.read()) == {"status": "ok"}
+
+                with status.tracking("crm"):
+                    pass
+                with pytest.raises(urllib.error.HTTPError, match="503") as exc_info:
+                    urllib.request.urlopen(f"{url}/healthz", timeout=5)
+                health = json.loads(exc_info.value.read())
+            finally:
+                server.shutdown()
+                server.server_close()
+
+        assert list(targets) == ["billing", "crm"]
+        assert billing == targets["billing"]
+        assert (billing["status"], billing["next_run"], billing["in_progress"]) == ("success", due.isoformat(), False)
+        assert health["status"] == "unhealthy"
+        assert health["problems"][0].startswith("crm: last run failed at ")
+
+    def test_serves_backups(self):
+        catalog = mock.Mock()
+        catalog.query.return_value = {"total": 0, "offset": 0, "limit": 100, "backups": []}
+        server = serve("127.0.0.1", 0, backups=catalog.query)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            query = "target=billing&since=2024-01-10&label=tier%3Ddaily"
+            with urllib.request.urlopen(f"{url}/backups?{query}", timeout=5) as response:
+                page = json.loads(response.read())
+
+            catalog.query.side_effect = ValueError("Invalid limit")
+            with pytest.raises(urllib.error.HTTPError, match="400"):
+                urllib.request.urlopen(f"{url}/backups?limit=0", timeout=5)
+            catalog.query.side_effect = StorageError("bucket unreachable")
+            with pytest.raises(urllib.error.HTTPError, match="503"):
+                urllib.request.urlopen(f"{url}/backups", timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
+
+        assert page["backups"] == []
+        assert catalog.query.call_args_list[0] == mock.call(
+            {"target": ["billing"], "since": ["2024-01-10"], "label": ["tier=daily"]}
+        )
+
+    def test_backups_are_not_served_without_catalog(self):
+        server = serve("127.0.0.1", 0)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            with pytest.raises(urllib.error.HTTPError, match="404"):
+                urllib.request.urlopen(f"{url}/backups", timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
+
+    def test_serves_reload(self):
+        reload = mock.Mock()
+        server = serve("127.0.0.1", 0, reload=reload)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            with urllib.request.urlopen(urllib.request.Request(f"{url}/reload", method="POST"), timeout=5) as response:
+                reloaded = json.loads(response.read())
+
+            reload.side_effect = ConfigError("Invalid BACKUP_SCHEDULE")
+            with pytest.raises(urllib.error.HTTPError, match="422") as rejected:
+                urllib.request.urlopen(urllib.request.Request(f"{url}/reload", method="POST"), timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
+
+        assert reloaded == {"status": "reloaded"}
+        assert json.loads(rejected.value.read()) == {"status": "rejected", "error": "Invalid BACKUP_SCHEDULE"}
+        assert reload.call_count == 2
+
+    def test_reload_reports_unexpected_failures(self):
+        reload = mock.Mock(side_effect=ValueError("Invalid endpoint URL"))
+        server = serve("127.0.0.1", 0, reload=reload)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            with pytest.raises(urllib.error.HTTPError, match="500") as failed:
+                urllib.request.urlopen(urllib.request.Request(f"{url}/reload", method="POST"), timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
+
+        assert json.loads(failed.value.read()) == {"status": "failed", "error": "Invalid endpoint URL"}
+
+    def test_reload_is_not_served_without_reloading(self):
+        server = serve("127.0.0.1", 0)
+        url = f"http://127.0.0.1:{server.server_address[1]}"
+        try:
+            with pytest.raises(urllib.error.HTTPError, match="404"):
+                urllib.request.urlopen(urllib.request.Request(f"{url}/reload", method="POST"), timeout=5)
+        finally:
+            server.shutdown()
+            server.server_close()
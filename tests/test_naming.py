@@ -0,0 +1,73 @@
+"""Tests for naming module."""
+
+from unittest import mock
+
+import pytest
+
+from nestvault.naming import DEFAULT_KEY_TEMPLATE, KeyTemplate, listing_prefix
+
+
+@pytest.fixture
+def adapter():
+    adapter = mock.Mock()
+    adapter.database_name = "orders"
+    adapter.engine = "postgres"
+    adapter.backup_metadata = {"engine": "postgres", "dump_scope": "schema-only"}
+    return adapter
+
+
+class TestKeyTemplate:
+    """Tests for KeyTemplate class."""
+
+    def test_default_template_keeps_file_names(self, adapter):
+        template = KeyTemplate(DEFAULT_KEY_TEMPLATE, hostname="db-1")
+
+        assert template.key(adapter, "orders_20240115_120000.schema.sql.gz") == "orders_20240115_120000.schema.sql.gz"
+        assert template.prefix(adapter) == "orders_"
+
+    def test_renders_variables_and_keeps_extensions(self, adapter):
+        template = KeyTemplate(
+            "{{.Target}}/{{ .Engine }}/{{.Database}}/{{.Year}}/{{.Month}}/{{.Day}}/"
+            "{{.Hostname}}-{{.Scope}}-{{.Timestamp}}",
+            target="nightly",
+            hostname="db-1",
+        )
+
+        key = template.key(adapter, "orders_20240115_120000.schema.sql.gz")
+        companion = template.key(adapter, "orders_20240115_120000.globals.sql.gz")
+
+        assert key == "nightly/postgres/orders/2024/01/15/db-1-schema-only-20240115_120000.schema.sql.gz"
+        assert companion == "nightly/postgres/orders/2024/01/15/db-1-schema-only-20240115_120000.globals.sql.gz"
+        assert template.prefix(adapter) == "nightly/postgres/orders/"
+
+    def test_renders_labels(self, adapter):
+        template = KeyTemplate("{{.Labels.env}}/{{.Database}}/{{.Timestamp}}", labels={"env": "prod"})
+        template.validate()
+
+        assert template.key(adapter, "orders_20240115_120000.sql.gz") == "prod/orders/20240115_120000.sql.gz"
+
+    def test_name_without_timestamp_is_kept(self, adapter):
+        assert KeyTemplate("x/{{.Timestamp}}").key(adapter, "latest.sql.gz") == "latest.sql.gz"
+
+    def test_listing_prefix_without_template_is_the_database(self, adapter):
+        assert listing_prefix(None, adapter) == "orders"
+
+    @pytest.mark.parametrize(
+        "template,message",
+        [
+            ("{{.Database}}", "must contain {{.Timestamp}}"),
+            ("{{.Database}}/{{.Timestamp", "unbalanced braces"),
+            ("{{.Database | upper}}/{{.Timestamp}}", "is not a variable"),
+            ("{{.Region}}/{{.Timestamp}}", "unknown variable"),
+            ("{{.Labels.env}}/{{.Timestamp}}", "label 'env' is not defined"),
+            ("{{.Database}}//{{.Timestamp}}", "empty, '.' or '..' path segment"),
+            ("/{{.Database}}/{{.Timestamp}}", "empty, '.' or '..' path segment"),
+            ("../{{.Timestamp}}", "empty, '.' or '..' path segment"),
+            ("wal/{{.Timestamp}}", "NestVault keeps other objects in"),
+            ("{{.Database}} {{.Timestamp}}", "whitespace"),
+        ],
+    )
+    def test_validate_rejects(self, template, message):
+        with pytest.raises(ValueError) as exc_info:
+            KeyTemplate(template).validate()
+        assert message in str(exc_info.value)
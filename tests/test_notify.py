@@ -0,0 +1,213 @@
+"""Tests for notify.base module."""
+
+import io
+import json
+import urllib.error
+from datetime import datetime, timedelta, timezone
+from email.message import Message
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify import base
+from nestvault.notify.base import Notifier, RunResult, format_duration, format_size, notify, post_json, request
+from nestvault.notify.streak import StreakState
+
+
+class RecordingNotifier(Notifier):
+    name = "recording"
+
+    def __init__(self, policy="failures-and-recovery"):
+        super().__init__(policy)
+        self.sent = []
+
+    def send(self, result):
+        self.sent.append((result.status, result.recovered))
+
+
+WEBHOOK_URL = "https://discord.com/api/webhooks/1234/token"
+
+
+def rate_limited(body=b"", retry_after=None):
+    headers = Message()
+    if retry_after is not None:
+        headers["Retry-After"] = retry_after
+    return urllib.error.HTTPError(WEBHOOK_URL, 429, "Too Many Requests", headers, io.BytesIO(body))
+
+
+def server_error():
+    return urllib.error.HTTPError(WEBHOOK_URL, 503, "Service Unavailable", Message(), io.BytesIO(b"busy"))
+
+
+def run(notifiers, status, database="db"):
+    notify(notifiers, RunResult(target="notify-test", database=database, status=status))
+
+
+class TestNotify:
+    """Tests for notify function and notification policies."""
+
+    @pytest.mark.parametrize(
+        "policy, expected",
+        [
+            ("always", [("success", False), ("failure", False), ("success", True), ("success", False)]),
+            ("failures", [("failure", False), ("success", True)]),
+            ("failures-and-recovery", [("failure", False), ("success", True)]),
+        ],
+    )
+    def test_policies(self, policy, expected):
+        notifier = RecordingNotifier(policy)
+
+        for status in ("success", "failure", "success", "success"):
+            run([notifier], status, database=policy)
+
+        assert notifier.sent == expected
+
+    def test_failed_delivery_is_logged_not_raised(self):
+        notifier = RecordingNotifier("always")
+        notifier.send = mock.Mock(side_effect=NotifyError("HTTP 500"))
+        other = RecordingNotifier("always")
+
+        run([notifier, other], "failure")
+
+        assert other.sent == [("failure", False)]
+
+    def test_unknown_policy_is_rejected(self):
+        with pytest.raises(ValueError, match="Unknown notification policy"):
+            RecordingNotifier("sometimes")
+
+
+class TestStreaks:
+    """Tests for the failure streaks results are given."""
+
+    @pytest.fixture
+    def state_file(self, tmp_path):
+        path = tmp_path / "state" / "notify.json"
+        with mock.patch.object(base, "_streaks", StreakState(path)):
+            yield path
+
+    def result(self, status, day):
+        finished_at = datetime(2024, 6, 2, 2, 11, tzinfo=timezone.utc) + timedelta(days=day)
+        return RunResult(target="billing", database="billing", status=status, finished_at=finished_at)
+
+    def test_failures_are_counted_from_the_last_success(self, state_file):
+        results = [self.result(status, day) for day, status in enumerate(("success", "failure", "failure", "aborted"))]
+        for result in results:
+            notify([], result)
+
+        assert [result.streak for result in results] == [
+            "",
+            "first failure, last success 2024-06-02 02:11",
+            "2nd consecutive failure, last success 2024-06-02 02:11",
+            "3rd consecutive failure, last success 2024-06-02 02:11",
+        ]
+        assert ("Streak", results[3].streak) in results[3].fields()
+        assert results[3].template_data()["ConsecutiveFailures"] == 3
+        assert results[3].template_data()["LastSuccess"] == "2024-06-02T02:11:00+00:00"
+
+    def test_streak_survives_a_restart(self, state_file):
+        notify([], self.result("failure", 0))
+        notify([], self.result("failure", 1))
+
+        with mock.patch.object(base, "_streaks", StreakState(state_file)):
+            recovery = self.result("success", 2)
+            notify([RecordingNotifier("failures")], recovery)
+
+        assert recovery.recovered is True
+        assert (recovery.consecutive_failures, recovery.last_success) == (2, None)
+        assert recovery.streak == "recovered after 2 consecutive failures"
+        assert json.loads(state_file.read_text()) == {
+            "billing/billing": {"failures": 0, "last_success": recovery.finished_at.isoformat()}
+        }
+
+    def test_unreadable_state_starts_over(self, tmp_path):
+        path = tmp_path / "notify.json"
+        path.write_text("not json")
+
+        assert StreakState(path).streaks == {}
+
+    def test_first_failure_without_success(self):
+        result = RunResult("billing", "billing", "failure", consecutive_failures=1)
+
+        assert result.streak == "first failure, no success recorded"
+        assert RunResult("billing", "billing", "failure", consecutive_failures=21).streak.startswith("21st ")
+        assert RunResult("billing", "billing", "failure", consecutive_failures=12).streak.startswith("12th ")
+
+
+class TestFormatting:
+    """Tests for format_size and format_duration functions."""
+
+    def test_format_size(self):
+        assert [format_size(size) for size in (None, 2048, 325_219_942, 5 * 1024**3)] == [
+            "-", "2.0 KiB", "310.2 MiB", "5.00 GiB"
+        ]
+
+    def test_format_duration(self):
+        assert [format_duration(seconds) for seconds in (None, 12.34, 252, 7380)] == [
+            "-", "12.3s", "4m 12s", "2h 3m"
+        ]
+
+    def test_headline(self):
+        assert RunResult("billing", "billing", "failure").headline == "Backup of billing failed"
+        reload = RunResult("configuration", "-", "success", recovered=True, subject="Configuration reload")
+        assert reload.headline == "Configuration reload recovered"
+
+
+class TestRequest:
+    """Tests for request and post_json functions."""
+
+    @pytest.fixture
+    def urlopen(self):
+        with mock.patch("nestvault.notify.base.urllib.request.urlopen") as patched, \
+                mock.patch("nestvault.notify.base.time.sleep") as sleep:
+            patched.sleep = sleep
+            yield patched
+
+    def test_rate_limited_request_is_sent_again_after_the_wait(self, urlopen):
+        response = mock.MagicMock()
+        response.__enter__.return_value.read.return_value = b"ok"
+        urlopen.side_effect = [
+            rate_limited(b'{"retry_after": 1.5, "global": false}'), rate_limited(retry_after="2"), response
+        ]
+
+        assert post_json(WEBHOOK_URL, {"content": "hi"}) == b"ok"
+
+        assert urlopen.sleep.call_args_list == [mock.call(1.5), mock.call(2.0)]
+
+    def test_rate_limit_wait_read_from_parameters(self, urlopen):
+        response = mock.MagicMock()
+        response.__enter__.return_value.read.return_value = b"ok"
+        urlopen.side_effect = [rate_limited(b'{"ok": false, "parameters": {"retry_after": 3}}'), response]
+
+        assert post_json(WEBHOOK_URL, {}) == b"ok"
+        urlopen.sleep.assert_called_once_with(3.0)
+
+    def test_long_or_repeated_rate_limits_fail(self, urlopen):
+        urlopen.side_effect = [rate_limited(retry_after="3600")]
+        with pytest.raises(NotifyError, match="HTTP 429"):
+            post_json(WEBHOOK_URL, {})
+
+        urlopen.side_effect = [rate_limited(retry_after="1")] * 4
+        with pytest.raises(NotifyError, match="HTTP 429"):
+            post_json(WEBHOOK_URL, {})
+        assert urlopen.sleep.call_count == 3
+
+    def test_error_status_fails(self, urlopen):
+        urlopen.side_effect = urllib.error.HTTPError(
+            WEBHOOK_URL, 404, "Not Found", Message(), io.BytesIO(b"Unknown Webhook")
+        )
+
+        with pytest.raises(NotifyError, match="HTTP 404: Unknown Webhook"):
+            post_json(WEBHOOK_URL, {})
+
+    def test_server_errors_are_retried_with_backoff(self, urlopen):
+        response = mock.MagicMock()
+        response.__enter__.return_value.read.return_value = b"ok"
+        urlopen.side_effect = [server_error(), urllib.error.URLError("refused"), response]
+
+        assert request(WEBHOOK_URL, b"{}", retries=3) == b"ok"
+        assert urlopen.sleep.call_args_list == [mock.call(1.0), mock.call(2.0)]
+
+        urlopen.side_effect = [server_error() for _ in range(3)]
+        with pytest.raises(NotifyError, match="HTTP 503: busy"):
+            request(WEBHOOK_URL, b"{}", retries=2)
@@ -0,0 +1,57 @@
+"""Tests for notify.discord module."""
+
+from unittest import mock
+
+import pytest
+
+from nestvault.notify.discord import MAX_FIELD_CHARS, DiscordNotifier
+
+WEBHOOK_URL = "https://discord.com/api/webhooks/1234/token"
+
+
+@pytest.fixture
+def failure(run_result):
+    """A failure whose error mentions everyone and holds a code fence, as a hook's output may."""
+    return run_result(
+        "minecraft",
+        "world.db",
+        "failure",
+        duration=41.0,
+        error="pre-backup hook exited with 1:\n```\nrcon: connection refused, @everyone is the server up?\n```",
+    )
+
+
+@pytest.fixture
+def recovery(run_result):
+    return run_result(
+        "minecraft",
+        "world.db",
+        "success",
+        duration=96.4,
+        size=1_288_490_189,
+        backup_key="minecraft/world.db_20240115_020000.db.zst",
+        recovered=True,
+    )
+
+
+class TestDiscordNotifier:
+    """Tests for DiscordNotifier class."""
+
+    def test_failure_payload(self, failure, golden):
+        assert DiscordNotifier(WEBHOOK_URL).payload(failure) == golden("discord_failure.json")
+
+    def test_recovery_payload(self, recovery, golden):
+        assert DiscordNotifier(WEBHOOK_URL).payload(recovery) == golden("discord_recovery.json")
+
+    def test_long_field_is_cut(self, run_result):
+        result = run_result("minecraft", "world.db", "success", backup_key="minecraft/" + "x" * 2000)
+
+        fields = DiscordNotifier(WEBHOOK_URL).payload(result)["embeds"][0]["fields"]
+
+        assert fields[-1] == {"name": "Backup", "value": ("minecraft/" + "x" * 2000)[:MAX_FIELD_CHARS], "inline": False}
+
+    def test_sends_to_webhook(self, failure, golden):
+        with mock.patch("nestvault.notify.discord.post_json", return_value=b"") as post:
+            DiscordNotifier(WEBHOOK_URL).send(failure)
+
+        post.assert_called_once_with(WEBHOOK_URL, golden("discord_failure.json"), timeout=10)
@@ -0,0 +1,133 @@
+"""Tests for notify.escalation, notify.pagerduty and notify.opsgenie modules."""
+
+import json
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import RunResult
+from nestvault.notify.escalation import EscalationNotifier, EscalationState
+from nestvault.notify.opsgenie import OpsgenieNotifier
+from nestvault.notify.pagerduty import EVENTS_URL, PagerDutyNotifier
+
+
+class RecordingEscalation(EscalationNotifier):
+    name = "recording"
+
+    def __init__(self, state, after_failures=2):
+        super().__init__(state, after_failures)
+        self.events = []
+
+    def trigger(self, result, failures):
+        self.events.append(("trigger", failures))
+
+    def resolve(self, result):
+        self.events.append(("resolve", None))
+
+
+def result(status, database="billing"):
+    error = "pg_dump: connection refused" if status != "success" else ""
+    return RunResult(target="billing", database=database, status=status, error=error)
+
+
+def run(notifier, *statuses):
+    for status in statuses:
+        notifier.send(result(status))
+
+
+class TestEscalationNotifier:
+    """Tests for EscalationNotifier class."""
+
+    def test_opens_after_consecutive_failures_and_resolves_on_success(self, tmp_path):
+        notifier = RecordingEscalation(EscalationState(tmp_path / "escalation.json"))
+
+        run(notifier, "failure", "success", "failure", "failure", "aborted", "success", "success")
+
+        assert notifier.events == [("trigger", 2), ("resolve", None)]
+
+    def test_count_survives_restarts(self, tmp_path):
+        path = tmp_path / "state" / "escalation.json"
+        run(RecordingEscalation(EscalationState(path), after_failures=3), "failure", "failure")
+
+        restarted = RecordingEscalation(EscalationState(path), after_failures=3)
+        run(restarted, "failure")
+        assert restarted.events == [("trigger", 3)]
+
+        restarted = RecordingEscalation(EscalationState(path), after_failures=3)
+        run(restarted, "success")
+        assert restarted.events == [("resolve", None)]
+        assert json.loads(path.read_text()) == {}
+
+    def test_databases_escalate_on_their_own(self, tmp_path):
+        notifier = RecordingEscalation(EscalationState(tmp_path / "escalation.json"))
+
+        for database in ("billing", "invoices", "billing"):
+            notifier.send(result("failure", database))
+
+        assert notifier.events == [("trigger", 2)]
+
+    def test_failed_trigger_is_sent_again(self, tmp_path):
+        notifier = RecordingEscalation(EscalationState(tmp_path / "escalation.json"))
+        notifier.trigger = mock.Mock(side_effect=[NotifyError("HTTP 503"), None])
+
+        with pytest.raises(NotifyError):
+            run(notifier, "failure", "failure")
+        run(notifier, "failure", "failure")
+
+        assert [call.args[1] for call in notifier.trigger.call_args_list] == [2, 3]
+
+    def test_unreadable_state_starts_over(self, tmp_path):
+        path = tmp_path / "escalation.json"
+        path.write_text("{not json")
+
+        notifier = RecordingEscalation(EscalationState(path))
+        run(notifier, "failure", "failure")
+
+        assert notifier.events == [("trigger", 2)]
+
+    def test_every_result_counts_whatever_the_policy(self, tmp_path):
+        notifier = RecordingEscalation(EscalationState(tmp_path / "escalation.json"))
+
+        assert notifier.wants(result("success"))
+
+
+class TestPagerDutyNotifier:
+    """Tests for PagerDutyNotifier class."""
+
+    def test_triggers_and_resolves_with_stable_dedup_key(self, tmp_path):
+        notifier = PagerDutyNotifier("R0UT1NGKEY", EscalationState(tmp_path / "escalation.json"))
+
+        with mock.patch("nestvault.notify.pagerduty.post_json", return_value=b"") as post:
+            run(notifier, "failure", "failure", "success")
+
+        [(url, trigger), (_, resolve)] = [call.args for call in post.call_args_list]
+        assert url == EVENTS_URL
+        assert (trigger["event_action"], resolve["event_action"]) == ("trigger", "resolve")
+        assert trigger["dedup_key"] == resolve["dedup_key"] == "nestvault/billing/billing"
+        assert trigger["routing_key"] == "R0UT1NGKEY"
+        assert trigger["payload"]["summary"] == "Backup of billing failed 2 times in a row"
+        assert trigger["payload"]["severity"] == "critical"
+        assert trigger["payload"]["custom_details"]["error"] == "pg_dump: connection refused"
+        assert "payload" not in resolve
+
+
+class TestOpsgenieNotifier:
+    """Tests for OpsgenieNotifier class."""
+
+    def test_creates_and_closes_alert_by_alias(self, tmp_path):
+        notifier = OpsgenieNotifier(
+            "genie-key", EscalationState(tmp_path / "escalation.json"), api_url="https://api.eu.opsgenie.com/"
+        )
+
+        with mock.patch("nestvault.notify.opsgenie.post_json", return_value=b"{}") as post:
+            run(notifier, "failure", "failure", "success")
+
+        [(create_url, alert, headers, _), (close_url, _, _, _)] = [call.args for call in post.call_args_list]
+        assert create_url == "https://api.eu.opsgenie.com/v2/alerts"
+        assert close_url == (
+            "https://api.eu.opsgenie.com/v2/alerts/nestvault%2Fbilling%2Fbilling/close?identifierType=alias"
+        )
+        assert headers == {"Authorization": "GenieKey genie-key"}
+        assert (alert["alias"], alert["priority"]) == ("nestvault/billing/billing", "P1")
+        assert alert["details"]["consecutive_failures"] == "2"
@@ -0,0 +1,73 @@
+"""Tests for notify.ntfy module."""
+
+from unittest import mock
+
+import pytest
+
+from nestvault.notify.base import RunResult
+from nestvault.notify.ntfy import NtfyNotifier
+
+SERVER_URL = "https://ntfy.example.com"
+
+
+@pytest.fixture
+def failure(run_result):
+    """A first failure of a target whose name needs quoting in the click URL, with a multi-line error."""
+    return run_result(
+        "nas/immich",
+        "immich",
+        "failure",
+        duration=7.9,
+        error=(
+            "pg_dump: error: query failed: ERROR:  permission denied for table assets\n"
+            "pg_dump: detail: Query was: LOCK TABLE public.assets IN ACCESS SHARE MODE"
+        ),
+        consecutive_failures=1,
+    )
+
+
+@pytest.fixture
+def recovery(run_result):
+    return run_result(
+        "nas/immich",
+        "immich",
+        "success",
+        duration=3725,
+        size=5_368_709_120,
+        backup_key="nas/immich/immich_20240115_020000.sql.zst",
+        recovered=True,
+        consecutive_failures=1,
+    )
+
+
+class TestNtfyNotifier:
+    """Tests for NtfyNotifier class."""
+
+    def test_failure_payload(self, failure, golden):
+        notifier = NtfyNotifier(SERVER_URL, "homelab-backups", click_url="https://nestvault.example.com/")
+
+        assert notifier.payload(failure) == golden("ntfy_failure.json")
+
+    def test_recovery_payload(self, recovery, golden):
+        assert NtfyNotifier(SERVER_URL, "homelab-backups").payload(recovery) == golden("ntfy_recovery.json")
+
+    def test_aborted_backup_is_a_warning(self):
+        payload = NtfyNotifier(SERVER_URL, "homelab-backups").payload(
+            RunResult(target="ha", database="ha.db", status="aborted", error="pre-backup hook exited with 1")
+        )
+
+        assert (payload["title"], payload["priority"], payload["tags"]) == ("Backup of ha aborted", 3, ["warning"])
+
+    def test_sends_with_token(self, recovery, golden):
+        with mock.patch("nestvault.notify.ntfy.post_json", return_value=b"{}") as post:
+            NtfyNotifier(SERVER_URL + "/", "homelab-backups", token="tk_secret").send(recovery)
+
+        post.assert_called_once_with(
+            SERVER_URL, golden("ntfy_recovery.json"), {"Authorization": "Bearer tk_secret"}, timeout=10
+        )
+
+    def test_sends_with_credentials(self):
+        notifier = NtfyNotifier(SERVER_URL, "homelab-backups", username="phil", password="s3cret")
+
+        assert notifier.headers() == {"Authorization": "Basic cGhpbDpzM2NyZXQ="}
+        assert NtfyNotifier(SERVER_URL, "homelab-backups").headers() == {}
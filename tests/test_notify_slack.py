@@ -0,0 +1,81 @@
+"""Tests for notify.slack module."""
+
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import RunResult
+from nestvault.notify.slack import POST_MESSAGE_URL, SlackNotifier
+
+WEBHOOK_URL = "https://hooks.slack.com/services/T000/B000/XXXX"
+
+
+@pytest.fixture
+def failure(run_result):
+    """A failure with the characters mrkdwn escapes in its target and error, and a code fence in the error."""
+    return run_result(
+        "r&d-wiki",
+        "wiki",
+        "failure",
+        duration=84.2,
+        error=(
+            "pg_dump: error: connection to server at \"db\" (10.0.0.5), port 5432 failed: FATAL: <too many clients>\n"
+            "```\nHINT: raise max_connections\n```"
+        ),
+    )
+
+
+@pytest.fixture
+def recovery(run_result):
+    return run_result(
+        "r&d-wiki",
+        "wiki",
+        "success",
+        duration=312.0,
+        size=325_219_942,
+        backup_key="r&d-wiki/wiki_20240115_020000.sql.gz",
+        recovered=True,
+    )
+
+
+class TestSlackNotifier:
+    """Tests for SlackNotifier class."""
+
+    def test_failure_payload(self, failure, golden):
+        assert SlackNotifier(WEBHOOK_URL).payload(failure) == golden("slack_failure.json")
+
+    def test_recovery_payload(self, recovery, golden):
+        assert SlackNotifier(WEBHOOK_URL).payload(recovery) == golden("slack_recovery.json")
+
+    def test_bot_payload_names_the_channel(self, failure, golden):
+        notifier = SlackNotifier(bot_token="xoxb-token", channel="#ops")
+
+        assert notifier.payload(failure) == {**golden("slack_failure.json"), "channel": "#ops"}
+
+    def test_long_error_is_cut(self):
+        result = RunResult("billing", "billing", "failure", error="x" * 2000)
+
+        excerpt = SlackNotifier(WEBHOOK_URL).payload(result)["attachments"][0]["blocks"][-1]["text"]["text"]
+
+        assert excerpt == "```" + "x" * 499 + "…```"
+
+    def test_sends_to_webhook(self, failure, golden):
+        with mock.patch("nestvault.notify.slack.post_json", return_value=b"ok") as post:
+            SlackNotifier(WEBHOOK_URL).send(failure)
+
+        post.assert_called_once_with(WEBHOOK_URL, golden("slack_failure.json"), timeout=10)
+
+    def test_bot_error_raises(self, failure):
+        notifier = SlackNotifier(bot_token="xoxb-token", channel="#ops")
+
+        with mock.patch("nestvault.notify.slack.post_json", return_value=b'{"ok": false, "error": "not_in_channel"}') \
+                as post, pytest.raises(NotifyError, match="not_in_channel"):
+            notifier.send(failure)
+
+        assert post.call_args.args[0] == POST_MESSAGE_URL
+        assert post.call_args.kwargs["headers"] == {"Authorization": "Bearer xoxb-token"}
+
+    def test_needs_a_webhook_or_a_bot_and_channel(self):
+        with pytest.raises(ValueError, match="webhook URL, or a bot token and a channel"):
+            SlackNotifier(bot_token="xoxb-token")
@@ -0,0 +1,155 @@
+"""Tests for notify.smtp module."""
+
+import base64
+import email
+import socketserver
+import threading
+from datetime import datetime, timezone
+from email import policy
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import RunResult
+from nestvault.notify.smtp import EmailNotifier
+
+FAILURE = RunResult(
+    target="billing",
+    database="billing",
+    status="failure",
+    duration=84.2,
+    error="pg_dump: error: connection to server at \"db\" failed: <too many clients>",
+    finished_at=datetime(2024, 1, 15, 2, 5, 12, tzinfo=timezone.utc),
+    log=[f"line {number}" for number in range(100)],
+)
+SUCCESS = RunResult(
+    target="billing",
+    database="billing",
+    status="success",
+    size=2048,
+    backup_key="billing/billing_20240115_020000.sql.gz",
+    log=["Backup job took 1.2s"],
+)
+
+
+class SMTPHandler(socketserver.StreamRequestHandler):
+    """Speaks just enough SMTP to accept a message, recording the dialog on the server."""
+
+    def reply(self, line):
+        self.wfile.write(f"{line}\r\n".encode())
+
+    def handle(self):
+        server = self.server
+        self.reply("220 localhost ESMTP test")
+        while line := self.rfile.readline().decode().rstrip("\r\n"):
+            verb, _, argument = line.partition(" ")
+            verb = verb.upper()
+            server.commands.append(verb)
+            if verb == "EHLO":
+                self.wfile.write(b"250-localhost\r\n250 AUTH PLAIN\r\n")
+            elif verb == "AUTH":
+                _, username, password = base64.b64decode(argument.split()[1]).decode().split("\0")
+                server.login = (username, password)
+                if password == "secret":
+                    self.reply("235 2.7.0 Authentication successful")
+                else:
+                    self.reply("535 5.7.8 Bad credentials")
+            elif verb == "MAIL":
+                server.sender = argument
+                self.reply("250 OK")
+            elif verb == "RCPT":
+                server.recipients.append(argument)
+                self.reply("250 OK")
+            elif verb == "DATA":
+                self.reply("354 End data with <CR><LF>.<CR><LF>")
+                data = []
+                while (chunk := self.rfile.readline()) != b".\r\n":
+                    data.append(chunk[1:] if chunk.startswith(b"..") else chunk)
+                server.messages.append(email.message_from_bytes(b"".join(data), policy=policy.default))
+                self.reply("250 OK queued")
+            elif verb == "QUIT":
+                self.reply("221 Bye")
+                return
+            else:
+                self.reply("502 Command not implemented")
+
+
+@pytest.fixture
+def smtp_server():
+    server = socketserver.ThreadingTCPServer(("127.0.0.1", 0), SMTPHandler)
+    server.daemon_threads = True
+    server.commands, server.recipients, server.messages = [], [], []
+    server.sender = server.login = None
+    thread = threading.Thread(target=server.serve_forever, daemon=True)
+    thread.start()
+    yield server
+    server.shutdown()
+    server.server_close()
+
+
+def notifier(server, **kwargs):
+    return EmailNotifier(
+        "127.0.0.1",
+        server.server_address[1],
+        "NestVault <nestvault@example.com>",
+        ["ops@example.com"],
+        tls="none",
+        **kwargs,
+    )
+
+
+class TestEmailNotifier:
+    """Tests for EmailNotifier class."""
+
+    def test_failure_email(self, smtp_server):
+        notifier(smtp_server, cc=["dba@example.com"], username="nestvault", password="secret").send(FAILURE)
+
+        assert smtp_server.login == ("nestvault", "secret")
+        assert smtp_server.sender.startswith("FROM:<nestvault@example.com>")
+        assert smtp_server.recipients == ["TO:<ops@example.com>", "TO:<dba@example.com>"]
+
+        [message] = smtp_server.messages
+        assert message["Subject"] == "[NestVault] Backup of billing failed"
+        assert (message["To"], message["Cc"]) == ("ops@example.com", "dba@example.com")
+
+        text = message.get_body(("plain",)).get_content()
+        assert "Duration: 1m 24s" in text and "<too many clients>" in text
+        html = message.get_body(("html",)).get_content()
+        assert "&lt;too many clients&gt;" in html and "#e01e5a" in html
+
+        [attachment] = message.iter_attachments()
+        assert attachment.get_filename() == "nestvault-billing-billing.log"
+        assert attachment.get_content().splitlines() == FAILURE.log
+
+    def test_success_email_has_no_log(self, smtp_server):
+        notifier(smtp_server).send(SUCCESS)
+
+        [message] = smtp_server.messages
+        assert "AUTH" not in smtp_server.commands
+        assert message["Subject"] == "[NestVault] Backup of billing succeeded"
+        assert "Backup: billing/billing_20240115_020000.sql.gz" in message.get_body(("plain",)).get_content()
+        assert list(message.iter_attachments()) == []
+
+    def test_rejected_login_fails(self, smtp_server):
+        with pytest.raises(NotifyError, match="Bad credentials"):
+            notifier(smtp_server, username="nestvault", password="wrong").send(FAILURE)
+
+        assert smtp_server.messages == []
+
+    def test_unreachable_server_fails(self, smtp_server):
+        port = smtp_server.server_address[1]
+        smtp_server.shutdown()
+        smtp_server.server_close()
+
+        with pytest.raises(NotifyError, match=f"SMTP 127.0.0.1:{port}"):
+            notifier(smtp_server).send(FAILURE)
+
+    @pytest.mark.parametrize("tls, implicit, starttls", [("implicit", True, False), ("starttls", False, True)])
+    def test_tls_modes(self, tls, implicit, starttls):
+        with mock.patch("nestvault.notify.smtp.smtplib") as smtplib:
+            smtplib.SMTPException = Exception
+            EmailNotifier("mail.example.com", 465, "nestvault@example.com", ["ops@example.com"], tls=tls).send(SUCCESS)
+
+        assert smtplib.SMTP_SSL.called == implicit
+        assert smtplib.SMTP.return_value.starttls.called == starttls
@@ -0,0 +1,78 @@
+"""Tests for notify.teams module."""
+
+import json
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.notify.base import ERROR_EXCERPT_CHARS, RunResult
+from nestvault.notify.teams import TeamsNotifier
+
+WEBHOOK_URL = "https://example.webhook.office.com/webhookb2/abc/IncomingWebhook/def/ghi"
+
+
+@pytest.fixture
+def failure(run_result):
+    """A failure in a streak, which the card lists as a fact and links to the status of."""
+    return run_result(
+        "home assistant",
+        "ha.db",
+        "failure",
+        duration=84.2,
+        error="sqlite3: disk I/O error (code 10)",
+        consecutive_failures=2,
+        last_success=datetime(2024, 1, 14, 2, 1, tzinfo=timezone.utc),
+    )
+
+
+@pytest.fixture
+def recovery(run_result):
+    return run_result(
+        "home assistant",
+        "ha.db",
+        "success",
+        duration=3.5,
+        size=2048,
+        backup_key="ha/ha.db_20240115_020000.db.gz",
+        recovered=True,
+        consecutive_failures=2,
+    )
+
+
+class TestTeamsNotifier:
+    """Tests for TeamsNotifier class."""
+
+    def test_failure_payload(self, failure, golden):
+        notifier = TeamsNotifier(WEBHOOK_URL, status_url="https://nestvault.example.com/")
+
+        assert notifier.payload(failure) == golden("teams_failure.json")
+
+    def test_recovery_payload(self, recovery, golden):
+        assert TeamsNotifier(WEBHOOK_URL).payload(recovery) == golden("teams_recovery.json")
+
+    def test_long_error_is_truncated(self):
+        error = "pg_dump: error: " + "x" * 2000
+        result = RunResult(target="billing", database="billing", status="failure", error=error)
+
+        card = TeamsNotifier(WEBHOOK_URL, status_url="https://nestvault.example.com").card(result)
+
+        excerpt, note = card["body"][2:]
+        assert len(excerpt["text"]) == ERROR_EXCERPT_CHARS
+        assert error not in json.dumps(card)
+        assert note["text"] == "The error is cut short, see the status of the target for all of it."
+        assert card["actions"][0]["url"] == "https://nestvault.example.com/status/billing"
+
+    def test_aborted_backup_is_a_warning(self):
+        card = TeamsNotifier(WEBHOOK_URL).card(
+            RunResult(target="ha", database="ha.db", status="aborted", error="pre-backup hook exited with 1")
+        )
+
+        assert card["body"][0]["style"] == "warning"
+        assert "actions" not in card
+
+    def test_sends_with_retries(self, recovery, golden):
+        with mock.patch("nestvault.notify.teams.post_json", return_value=b"1") as post:
+            TeamsNotifier(WEBHOOK_URL, retries=5).send(recovery)
+
+        post.assert_called_once_with(WEBHOOK_URL, golden("teams_recovery.json"), timeout=10, retries=5)
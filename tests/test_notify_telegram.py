@@ -0,0 +1,107 @@
+"""Tests for notify.telegram module."""
+
+import json
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import RunResult
+from nestvault.notify.telegram import MAX_MESSAGE_CHARS, TelegramNotifier
+
+BOT_TOKEN = "123456:ABC-token"
+CHAT_ID = "-1001234567890"
+SEND_URL = f"https://api.telegram.org/bot{BOT_TOKEN}/sendMessage"
+
+@pytest.fixture
+def failure(run_result):
+    return run_result(
+        "home_assistant",
+        "ha.db",
+        "failure",
+        duration=84.2,
+        error="sqlite3: disk I/O error (code 10) in `backup`",
+    )
+
+
+@pytest.fixture
+def recovery(run_result):
+    return run_result(
+        "home_assistant",
+        "ha.db",
+        "success",
+        duration=3.5,
+        size=2048,
+        backup_key="ha/ha.db_20240115_020000.db.gz",
+        recovered=True,
+    )
+
+
+def ok():
+    return json.dumps({"ok": True, "result": {}}).encode()
+
+
+class TestTelegramNotifier:
+    """Tests for TelegramNotifier class."""
+
+    def test_failure_message(self, failure):
+        [message] = TelegramNotifier(BOT_TOKEN, CHAT_ID).messages(failure)
+
+        assert message == (
+            "❌ *Backup of home\\_assistant failed*\n"
+            "\n"
+            "*Target:* home\\_assistant\n"
+            "*Database:* ha\\.db\n"
+            "*Status:* failure\n"
+            "*Duration:* 1m 24s\n"
+            "*Size:* \\-\n"
+            "\n"
+            "```\n"
+            "sqlite3: disk I/O error (code 10) in \\`backup\\`\n"
+            "```"
+        )
+
+    def test_recovery_message(self, recovery):
+        [message] = TelegramNotifier(BOT_TOKEN, CHAT_ID).messages(recovery)
+
+        assert message.startswith("✅ *Backup of home\\_assistant recovered*")
+        assert "*Backup:* ha/ha\\.db\\_20240115\\_020000\\.db\\.gz" in message
+        assert "```" not in message
+
+    def test_long_error_is_split_not_truncated(self):
+        lines = [f"ERROR: relation \"table_{number}\" does not exist" for number in range(300)]
+        result = RunResult(target="billing", database="billing", status="failure", error="\n".join(lines))
+
+        summary, *errors = TelegramNotifier(BOT_TOKEN, CHAT_ID).messages(result)
+
+        assert "```" not in summary and len(errors) > 1
+        assert all(len(message) <= MAX_MESSAGE_CHARS for message in errors)
+        assert all(message.startswith("```\n") and message.endswith("\n```") for message in errors)
+        assert "\n".join(message[4:-4] for message in errors) == result.error
+
+    def test_split_of_one_long_line_keeps_escapes_whole(self):
+        error = "x" * (MAX_MESSAGE_CHARS - 9) + "`" * 10
+        result = RunResult(target="billing", database="billing", status="failure", error=error)
+
+        _, first, second = TelegramNotifier(BOT_TOKEN, CHAT_ID).messages(result)
+
+        assert not first[4:-4].endswith("\\")
+        assert (first[4:-4] + second[4:-4]).replace("\\`", "`") == error
+
+    def test_sends_each_message(self):
+        result = RunResult(target="billing", database="billing", status="failure", error="e" * 5000)
+
+        with mock.patch("nestvault.notify.telegram.post_json", return_value=ok()) as post:
+            TelegramNotifier(BOT_TOKEN, CHAT_ID, timeout=5).send(result)
+
+        assert [call.args[0] for call in post.call_args_list] == [SEND_URL] * 3
+        payload = post.call_args_list[0].args[1]
+        assert (payload["chat_id"], payload["parse_mode"]) == (CHAT_ID, "MarkdownV2")
+        assert post.call_args.kwargs == {"timeout": 5}
+
+    def test_api_error_fails(self, failure):
+        response = json.dumps({"ok": False, "description": "Bad Request: chat not found"}).encode()
+
+        with mock.patch("nestvault.notify.telegram.post_json", return_value=response):
+            with pytest.raises(NotifyError, match="chat not found"):
+                TelegramNotifier(BOT_TOKEN, CHAT_ID).send(failure)
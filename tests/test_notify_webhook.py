@@ -0,0 +1,91 @@
+"""Tests for notify.webhook module."""
+
+import hashlib
+import hmac
+import json
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import NotifyError
+from nestvault.notify.base import RunResult
+from nestvault.notify.webhook import SIGNATURE_HEADER, WebhookNotifier, sign
+
+URL = "https://incidents.example.com/api/events"
+
+FAILURE = RunResult(
+    target="billing",
+    database="billing",
+    status="failure",
+    duration=84.2,
+    raw_size=1_048_576,
+    phase_durations={"dump": 80.1},
+    error='pg_dump: error: connection to server at "db" failed',
+    labels={"env": "prod"},
+    finished_at=datetime(2024, 1, 15, 2, 5, 12, tzinfo=timezone.utc),
+)
+
+TEMPLATE = """{
+  "source": "nestvault",
+  "severity": {{if .Succeeded}}"info"{{else}}"critical"{{end}},
+  "summary": {{.Headline | json}},
+  "env": {{.Labels.env | json}},
+  "error": {{.Error | json}},
+  "dump_seconds": {{.Phases.dump}}
+}"""
+
+
+class TestWebhookNotifier:
+    """Tests for WebhookNotifier class."""
+
+    def test_default_body_has_every_field(self):
+        body = json.loads(WebhookNotifier(URL).body(FAILURE))
+
+        assert body["Target"] == "billing" and body["Status"] == "failure"
+        assert (body["Size"], body["RawSize"], body["Phases"]) == (None, 1_048_576, {"dump": 80.1})
+        assert body["FinishedAt"] == "2024-01-15T02:05:12+00:00"
+        assert body["Labels"] == {"env": "prod"}
+
+    def test_templated_body(self):
+        body = json.loads(WebhookNotifier(URL, body_template=TEMPLATE).body(FAILURE))
+
+        assert body == {
+            "source": "nestvault",
+            "severity": "critical",
+            "summary": "Backup of billing failed",
+            "env": "prod",
+            "error": 'pg_dump: error: connection to server at "db" failed',
+            "dump_seconds": 80.1,
+        }
+
+    def test_unknown_variable_is_rejected(self):
+        with pytest.raises(ValueError, match="unknown variable .Host"):
+            WebhookNotifier(URL, body_template="{{.Host}}")
+
+    def test_sends_signed_body(self):
+        notifier = WebhookNotifier(
+            URL, "PUT", {"Authorization": "Bearer token"}, TEMPLATE, secret="shared", retries=2, timeout=5
+        )
+
+        with mock.patch("nestvault.notify.webhook.request", return_value=b"") as request:
+            notifier.send(FAILURE)
+
+        [(url, body, method, headers)] = [call.args for call in request.call_args_list]
+        assert (url, method, request.call_args.kwargs) == (URL, "PUT", {"timeout": 5, "retries": 2})
+        assert headers["Authorization"] == "Bearer token"
+        assert headers["Content-Type"] == "application/json"
+        expected = hmac.new(b"shared", body, hashlib.sha256).hexdigest()
+        assert headers[SIGNATURE_HEADER] == f"sha256={expected}" == sign(body, "shared")
+
+    def test_unsigned_without_secret(self):
+        with mock.patch("nestvault.notify.webhook.request", return_value=b"") as request:
+            WebhookNotifier(URL).send(FAILURE)
+
+        assert SIGNATURE_HEADER not in request.call_args.args[3]
+
+    def test_render_failure_is_a_notify_error(self):
+        notifier = WebhookNotifier(URL, body_template="{{.Error.detail}}")
+
+        with pytest.raises(NotifyError, match="failed to render the webhook body"):
+            notifier.body(FAILURE)
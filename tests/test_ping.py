@@ -0,0 +1,51 @@
+"""Tests for ping module."""
+
+import urllib.error
+from unittest import mock
+
+import pytest
+
+from nestvault.ping import MAX_BODY_BYTES, Pinger
+
+
+@pytest.fixture
+def urlopen():
+    with mock.patch("nestvault.ping.urllib.request.urlopen") as patched, mock.patch("nestvault.ping.time.sleep"):
+        yield patched
+
+
+def sent(urlopen):
+    return [(call.args[0].get_method(), call.args[0].full_url, call.args[0].data) for call in urlopen.call_args_list]
+
+
+class TestPinger:
+    """Tests for Pinger class."""
+
+    def test_pings_start_and_success(self, urlopen):
+        pinger = Pinger("https://hc-ping.com/check")
+
+        run_id = pinger.start()
+        pinger.finish(run_id, True, ["Backup uploaded", "Backup job completed successfully"])
+
+        assert sent(urlopen) == [
+            ("GET", f"https://hc-ping.com/check/start?rid={run_id}", None),
+            ("POST", f"https://hc-ping.com/check?rid={run_id}", b"Backup uploaded\nBackup job completed successfully"),
+        ]
+        assert urlopen.call_args.kwargs == {"timeout": 10}
+
+    def test_pings_failure_with_the_log_tail(self, urlopen):
+        pinger = Pinger("https://cronitor.link/p/key/billing?env=prod")
+
+        pinger.finish("run-1", False, ["x" * MAX_BODY_BYTES, "Backup failed: pg_dump exited with 1"])
+
+        [(method, url, body)] = sent(urlopen)
+        assert (method, url) == ("POST", "https://cronitor.link/p/key/billing/fail?env=prod&rid=run-1")
+        assert len(body) == MAX_BODY_BYTES
+        assert body.endswith(b"\nBackup failed: pg_dump exited with 1")
+
+    def test_failed_ping_is_retried_and_never_raises(self, urlopen):
+        urlopen.side_effect = urllib.error.URLError("timed out")
+
+        Pinger("https://hc-ping.com/check", retries=2).start()
+
+        assert urlopen.call_count == 3
@@ -0,0 +1,92 @@
+"""Tests for preflight module."""
+
+from collections import namedtuple
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.config import PreflightConfig
+from nestvault.exceptions import BackupError
+from nestvault.manifest import Manifest
+from nestvault.preflight import check_temp_space, estimate_backup_size
+
+DiskUsage = namedtuple("DiskUsage", "total used free")
+
+
+def _adapter(database_size):
+    adapter = mock.Mock()
+    adapter.database_name = "mydb"
+    adapter.database_size.return_value = database_size
+    adapter.is_own_backup.return_value = True
+    return adapter
+
+
+def _previous(size, database_size=None):
+    return Manifest(
+        key="mydb_20240115_120000.sql.gz",
+        database="mydb",
+        finished_at=datetime(2024, 1, 15, 12, tzinfo=timezone.utc),
+        size=size,
+        database_size=database_size,
+    )
+
+
+class TestEstimateBackupSize:
+    """Tests for estimate_backup_size function."""
+
+    def test_scales_database_size_by_configured_ratio_without_history(self):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[]):
+            estimate = estimate_backup_size(_adapter(1000), mock.Mock(), 0.5)
+
+        assert estimate.size == 500
+        assert estimate.metadata == {"estimated_size": "500", "database_size": "1000"}
+
+    def test_learns_ratio_from_previous_backup(self):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[_previous(300, database_size=1000)]):
+            estimate = estimate_backup_size(_adapter(2000), mock.Mock(), 0.5)
+
+        assert estimate.size == 600
+        assert "0.30" in estimate.basis
+
+    def test_falls_back_to_previous_backup_size(self):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[_previous(4096)]):
+            estimate = estimate_backup_size(_adapter(None), mock.Mock(), 0.5)
+
+        assert estimate.size == 4096
+        assert estimate.metadata == {"estimated_size": "4096"}
+
+    def test_ignores_backups_of_other_adapters(self):
+        adapter = _adapter(None)
+        adapter.is_own_backup.return_value = False
+
+        with mock.patch("nestvault.preflight.list_backups", return_value=[_previous(4096)]):
+            assert estimate_backup_size(adapter, mock.Mock(), 0.5) is None
+
+
+class TestCheckTempSpace:
+    """Tests for check_temp_space function."""
+
+    def test_passes_with_room_for_estimate_and_margin(self, tmp_path):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[]), \
+                mock.patch("shutil.disk_usage", return_value=DiskUsage(10000, 8800, 1200)):
+            estimate = check_temp_space(_adapter(2000), mock.Mock(), tmp_path, PreflightConfig(enabled=True))
+
+        assert estimate.size == 1000
+
+    def test_fails_when_margin_does_not_fit(self, tmp_path):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[]), \
+                mock.patch("shutil.disk_usage", return_value=DiskUsage(10000, 8801, 1199)):
+            with pytest.raises(BackupError) as exc_info:
+                check_temp_space(_adapter(2000), mock.Mock(), tmp_path, PreflightConfig(enabled=True))
+
+        assert "estimated at 1000 bytes" in str(exc_info.value)
+        assert "1200 bytes are needed" in str(exc_info.value)
+        assert "1199 bytes are free" in str(exc_info.value)
+
+    def test_fails_without_anything_to_estimate_from(self, tmp_path):
+        with mock.patch("nestvault.preflight.list_backups", return_value=[]):
+            with pytest.raises(BackupError) as exc_info:
+                check_temp_space(_adapter(None), mock.Mock(), tmp_path, PreflightConfig(enabled=True))
+
+        assert "--skip-preflight" in str(exc_info.value)
@@ -0,0 +1,61 @@
+"""Tests for restore progress reporting."""
+
+import io
+
+from nestvault.progress import MIB, Progress, ProgressReader, active, reporting, watching
+
+
+class TestProgress:
+    """Tests for Progress."""
+
+    def test_describes_bytes_with_rate_and_time_left(self):
+        progress = Progress("download", total=4 * MIB)
+        progress.started -= 10
+        progress.advance(MIB)
+
+        description = progress.describe()
+        assert description.startswith("1.0 MiB of 4.0 MiB (25%), 0.1 MiB/s, ")
+        assert description.endswith("s left")
+        assert progress.bar().startswith("Download [#####---------------] ")
+
+    def test_unknown_total(self):
+        progress = Progress("restore", unit="tables")
+        progress.advance(3)
+
+        assert progress.fraction is None and progress.eta is None
+        assert progress.describe().startswith("3 tables, ")
+        assert progress.describe(finished=True) == "3 tables"
+
+    def test_active_phases_are_listed_while_reported(self):
+        with reporting(Progress("restore", total=10, unit="tables")) as progress:
+            progress.advance(4)
+            assert [(phase["phase"], phase["done"], phase["total"]) for phase in active()] == [("restore", 4, 10)]
+
+        assert active() == []
+
+
+class TestProgressReader:
+    """Tests for ProgressReader."""
+
+    def test_counts_bytes_and_markers_split_between_reads(self):
+        progress = Progress("restore")
+        data = b"SET x;\nCOPY a FROM stdin;\n1\n\\.\nCOPY b FROM stdin;\n\\.\n"
+        reader = ProgressReader(io.BytesIO(data), progress, b"\nCOPY ")
+
+        while reader.read(5):
+            pass
+
+        assert progress.done == len(data)
+        assert progress.tables == 2
+
+
+class TestWatching:
+    """Tests for watching."""
+
+    def test_counts_bytes_written_into_directory(self, tmp_path):
+        progress = Progress("download")
+
+        with watching(tmp_path, progress):
+            (tmp_path / "db.sql.gz.a1b2").write_bytes(b"x" * 100)
+
+        assert progress.done == 100
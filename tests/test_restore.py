@@ -0,0 +1,409 @@
+"""Tests for restore module."""
+
+import os
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.backup.base import DestinationState, RestoreOptions
+from nestvault.config import CompressionConfig, LocalConfig
+from nestvault.exceptions import BackupError, StorageError
+from nestvault.manifest import Manifest, write_manifest
+from nestvault.restore import (
+    list_available_backups,
+    plan_point_in_time,
+    plan_restore,
+    restore_backup,
+    restore_latest_backup,
+    restore_to_time,
+)
+from nestvault.storage.base import StorageObject
+from nestvault.storage.local import LocalStorageAdapter
+from nestvault.wal import push_wal
+
+
+class TestRestoreBackup:
+    """Tests for restore_backup function."""
+
+    @pytest.fixture
+    def backup_adapter(self):
+        adapter = mock.Mock()
+        adapter.engine = "postgres"
+        adapter.database_name = "db"
+        adapter.supports_streaming_restore.return_value = False
+        adapter.inspect_destination.return_value = None
+        return adapter
+
+    def test_restores_matching_engine(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "postgres"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz") is True
+        backup_adapter.restore.assert_called_once()
+
+    def test_refuses_non_empty_destination_without_force(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "postgres"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+        backup_adapter.inspect_destination.return_value = DestinationState(exists=True, tables=12)
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.dump") is False
+        mock_storage.download.assert_not_called()
+        backup_adapter.restore.assert_not_called()
+
+        for options in (RestoreOptions(force=True), RestoreOptions(clean=True)):
+            assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.dump", options) is True
+        assert backup_adapter.restore.call_count == 2
+
+    def test_refuses_missing_destination_without_create_database(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "postgres"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+        backup_adapter.inspect_destination.return_value = DestinationState(exists=False)
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.dump") is False
+        options = RestoreOptions(create_database=True)
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.dump", options) is True
+
+    def test_refuses_engine_mismatch(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "mongodb"}
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.archive.gz") is False
+        mock_storage.download.assert_not_called()
+        backup_adapter.restore.assert_not_called()
+
+    def test_restores_engine_mismatch_when_ignored(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "mysql"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+        options = RestoreOptions(ignore_mismatch=True)
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz", options) is True
+        backup_adapter.restore.assert_called_once()
+
+    def test_restores_legacy_backup_without_metadata(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz") is True
+
+    def test_restores_backup_matching_checksum(self, backup_adapter):
+        import hashlib
+
+        mock_storage = mock.Mock(supports_range_reads=False)
+        mock_storage.get_metadata.return_value = {
+            "engine": "postgres",
+            "size": "4",
+            "sha256": hashlib.sha256(b"data").hexdigest(),
+        }
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz") is True
+        backup_adapter.restore.assert_called_once()
+
+    def test_refuses_corrupt_backup(self, backup_adapter):
+        import hashlib
+
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {
+            "engine": "postgres",
+            "size": "4",
+            "sha256": hashlib.sha256(b"data").hexdigest(),
+        }
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"dat\x00")
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz") is False
+        backup_adapter.restore.assert_not_called()
+
+    def test_with_globals_downloads_companion(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {
+            "engine": "postgres",
+            "globals": "db_20240115_120000.globals.sql.gz",
+        }
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        options = RestoreOptions(with_globals=True)
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz", options) is True
+
+        downloaded = [c.args[0] for c in mock_storage.download.call_args_list]
+        assert downloaded == ["db_20240115_120000.sql.gz", "db_20240115_120000.globals.sql.gz"]
+        assert options.companions["globals"].name == "db_20240115_120000.globals.sql.gz"
+
+    def test_with_globals_requires_companion(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "postgres"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        options = RestoreOptions(with_globals=True)
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz", options) is False
+        backup_adapter.restore.assert_not_called()
+
+
+    def test_refuses_encrypted_backup_without_encryption(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.get_metadata.return_value = {"engine": "postgres", "encryption": "age"}
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz.age") is False
+        mock_storage.download.assert_not_called()
+        backup_adapter.restore.assert_not_called()
+
+
+class TestStreamedRestore:
+    """Tests for restore_backup with adapters that restore from a stream."""
+
+    @pytest.fixture
+    def storage(self, tmp_path):
+        import hashlib
+
+        root = tmp_path / "nas"
+        root.mkdir()
+        storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+        backup = tmp_path / "backup"
+        backup.write_bytes(b"dump data")
+        metadata = {"engine": "postgres", "size": "9", "sha256": hashlib.sha256(b"dump data").hexdigest()}
+        storage.upload(backup, "db_20240115_120000.sql.gz", metadata=metadata)
+        return storage
+
+    @pytest.fixture
+    def backup_adapter(self):
+        adapter = mock.Mock()
+        adapter.engine = "postgres"
+        adapter.supports_streaming_restore.return_value = True
+        adapter.inspect_destination.return_value = DestinationState(exists=True, tables=0)
+        adapter.restore_stream.side_effect = lambda name, stream, options: stream.read(4)
+        return adapter
+
+    def test_streams_from_storage_without_download(self, storage, backup_adapter):
+        with mock.patch.object(storage, "download") as download:
+            assert restore_backup(storage, backup_adapter, "db_20240115_120000.sql.gz") is True
+
+        download.assert_not_called()
+        backup_adapter.restore.assert_not_called()
+        assert backup_adapter.restore_stream.call_args.args[0] == "db_20240115_120000.sql.gz"
+
+    def test_reports_checksum_mismatch_after_streaming(self, storage, backup_adapter, tmp_path):
+        (tmp_path / "nas" / "db_20240115_120000.sql.gz").write_bytes(b"dump dat\x00")
+
+        assert restore_backup(storage, backup_adapter, "db_20240115_120000.sql.gz") is False
+        backup_adapter.restore_stream.assert_called_once()
+
+    def test_streams_downloaded_copy_when_storage_cannot_stream(self, backup_adapter):
+        mock_storage = mock.Mock()
+        mock_storage.supports_streaming_download = False
+        mock_storage.get_metadata.return_value = {"engine": "postgres"}
+        mock_storage.download.side_effect = lambda key, path: path.write_bytes(b"data")
+
+        assert restore_backup(mock_storage, backup_adapter, "db_20240115_120000.sql.gz") is True
+        mock_storage.download.assert_called_once()
+        backup_adapter.restore_stream.assert_called_once()
+
+    def test_lists_contents_from_a_download(self, storage, backup_adapter):
+        options = RestoreOptions(list_contents=True)
+        backup_adapter.restore.side_effect = lambda path, options: setattr(options, "contents", path.read_text())
+
+        assert restore_backup(storage, backup_adapter, "db_20240115_120000.sql.gz", options) is True
+        backup_adapter.restore_stream.assert_not_called()
+        assert options.contents == "dump data"
+
+
+class TestPlanRestore:
+    """Tests for plan_restore function."""
+
+    @pytest.fixture
+    def manifest(self):
+        return Manifest(key="db_20240115_120000.dump", database="db", finished_at=datetime.now(timezone.utc), size=100)
+
+    @pytest.fixture
+    def backup_adapter(self):
+        adapter = mock.Mock()
+        adapter.engine = "postgres"
+        adapter.database_name = "db"
+        adapter.supports_streaming_restore.return_value = True
+        adapter.restore_commands.return_value = ["pg_restore -d db"]
+        adapter.inspect_destination.return_value = DestinationState(exists=True, tables=0)
+        return adapter
+
+    def test_plans_without_side_effects(self, manifest, backup_adapter):
+        storage = mock.Mock(supports_streaming_download=True)
+        storage.get_metadata.return_value = {"engine": "postgres"}
+
+        plan = plan_restore(storage, backup_adapter, manifest)
+
+        assert plan.possible
+        assert plan.streamed and not plan.downloaded
+        assert plan.download_size == 100
+        assert plan.commands == ["pg_restore -d db"]
+        storage.download.assert_not_called()
+        backup_adapter.restore.assert_not_called()
+        backup_adapter.restore_stream.assert_not_called()
+
+    def test_reports_why_the_restore_is_impossible(self, manifest, backup_adapter):
+        storage = mock.Mock(supports_streaming_download=True)
+        storage.get_metadata.return_value = {"engine": "mongodb"}
+        backup_adapter.inspect_destination.side_effect = BackupError("connection refused")
+
+        plan = plan_restore(storage, backup_adapter, manifest)
+
+        assert not plan.possible
+        assert "'mongodb' engine" in plan.problems[0]
+        assert "unreachable: connection refused" in plan.problems[1]
+
+    def test_missing_destination_needs_create_database(self, manifest, backup_adapter):
+        storage = mock.Mock(supports_streaming_download=True)
+        storage.get_metadata.return_value = {"engine": "postgres"}
+        backup_adapter.inspect_destination.return_value = DestinationState(exists=False)
+
+        assert "--create-database" in plan_restore(storage, backup_adapter, manifest).problems[0]
+        assert plan_restore(storage, backup_adapter, manifest, RestoreOptions(create_database=True)).possible
+
+    def test_non_empty_destination_needs_force(self, manifest, backup_adapter):
+        storage = mock.Mock(supports_streaming_download=True)
+        storage.get_metadata.return_value = {"engine": "postgres"}
+        backup_adapter.inspect_destination.return_value = DestinationState(exists=True, tables=3)
+
+        assert "holds 3 tables" in plan_restore(storage, backup_adapter, manifest).problems[0]
+        assert plan_restore(storage, backup_adapter, manifest, RestoreOptions(force=True)).possible
+
+    def test_missing_backup(self, manifest, backup_adapter):
+        storage = mock.Mock()
+        storage.get_metadata.side_effect = StorageError("not found")
+
+        assert "not found" in plan_restore(storage, backup_adapter, manifest).problems[0]
+
+
+class TestListAvailableBackups:
+    """Tests for list_available_backups function."""
+
+    def test_excludes_companion_objects(self):
+        from datetime import datetime, timezone
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject(
+                key="db_20240115_120000.globals.sql.gz",
+                size=10,
+                last_modified=datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc),
+            ),
+            StorageObject(
+                key="db_20240115_120000.sql.gz",
+                size=100,
+                last_modified=datetime(2024, 1, 15, 12, 0, 1, tzinfo=timezone.utc),
+            ),
+        ]
+
+        assert list_available_backups(mock_storage, "db") == ["db_20240115_120000.sql.gz"]
+
+
+class TestRestoreLatestBackup:
+    """Tests for restore_latest_backup function."""
+
+    def test_skips_backups_of_other_nodes(self):
+        from datetime import datetime, timezone
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject(
+                key=f"cassandra_20240115_120000.{node}.cassandra.tar",
+                size=100,
+                last_modified=datetime(2024, 1, 15, 12, 0, second, tzinfo=timezone.utc),
+            )
+            for second, node in ((5, "node-a"), (9, "node-b"))
+        ]
+        backup_adapter = mock.Mock()
+        backup_adapter.database_name = "cassandra"
+        backup_adapter.is_own_backup.side_effect = lambda key: ".node-a." in key
+
+        with mock.patch("nestvault.restore.restore_backup", return_value=True) as mock_restore:
+            assert restore_latest_backup(mock_storage, backup_adapter) is True
+
+        assert mock_restore.call_args[0][2] == "cassandra_20240115_120000.node-a.cassandra.tar"
+
+
+def _at(hour, minute=0):
+    return datetime(2024, 6, 1, hour, minute, tzinfo=timezone.utc)
+
+
+class TestPointInTimeRestore:
+    """Tests for plan_point_in_time and restore_to_time."""
+
+    @pytest.fixture
+    def storage(self, tmp_path):
+        root = tmp_path / "nas"
+        root.mkdir()
+        storage = LocalStorageAdapter(LocalConfig(root=str(root)))
+
+        for key, finished_at, wal_start in (
+            ("postgres_20240601_100000.tar.gz", _at(10), "000000010000000000000002"),
+            ("postgres_20240601_120000.tar.gz", _at(12), "000000010000000000000005"),
+        ):
+            backup = tmp_path / "backup"
+            backup.write_bytes(b"base backup")
+            storage.upload(backup, key, metadata={"engine": "postgres"})
+            manifest = Manifest(
+                key=key,
+                database="postgres",
+                finished_at=finished_at,
+                size=11,
+                engine="postgres",
+                metadata={"mode": "physical", "wal_start": wal_start},
+            )
+            write_manifest(storage, manifest, tmp_path)
+
+        for number, archived_at in enumerate((_at(9), _at(10), _at(11), _at(11, 30), _at(12), _at(13), _at(14)), 1):
+            segment = tmp_path / f"00000001000000000000000{number}"
+            segment.write_bytes(b"wal record")
+            key = push_wal(storage, segment, CompressionConfig(algorithm="gzip"))
+            os.utime(root / key, (archived_at.timestamp(), archived_at.timestamp()))
+
+        return storage
+
+    @pytest.fixture
+    def backup_adapter(self):
+        adapter = mock.Mock()
+        adapter.engine = "postgres"
+        adapter.database_name = "postgres"
+        adapter.is_own_backup.return_value = True
+        adapter.supports_streaming_restore.return_value = False
+        adapter.inspect_destination.return_value = None
+        return adapter
+
+    def test_picks_newest_base_backup_before_target_and_its_wal(self, storage, backup_adapter):
+        base, wal_files = plan_point_in_time(storage, backup_adapter, datetime(2024, 6, 1, 11, 15))
+
+        assert base.key == "postgres_20240601_100000.tar.gz"
+        assert wal_files == [
+            "000000010000000000000002",
+            "000000010000000000000003",
+            "000000010000000000000004",
+        ]
+
+    def test_rejects_target_outside_recoverable_window(self, storage, backup_adapter):
+        for target_time in (_at(9), _at(15)):
+            with pytest.raises(BackupError) as exc_info:
+                plan_point_in_time(storage, backup_adapter, target_time)
+
+            assert "2024-06-01T10:00:00+00:00 to 2024-06-01T14:00:00+00:00" in str(exc_info.value)
+
+    def test_downloads_wal_and_sets_up_recovery(self, storage, backup_adapter, tmp_path):
+        data_dir = tmp_path / "restore" / "data"
+        wal_dir = tmp_path / "restore" / "wal"
+
+        assert restore_to_time(storage, backup_adapter, _at(13, 30), data_dir, wal_dir) is True
+
+        assert sorted(path.name for path in wal_dir.iterdir()) == [
+            "000000010000000000000005",
+            "000000010000000000000006",
+            "000000010000000000000007",
+        ]
+        assert (wal_dir / "000000010000000000000007").read_bytes() == b"wal record"
+
+        backup_file, options = backup_adapter.restore.call_args.args
+        assert backup_file.name == "postgres_20240601_120000.tar.gz"
+        assert options.data_dir == data_dir
+        assert options.recovery["recovery_target_time"] == "2024-06-01 13:30:00+00:00"
+        assert options.recovery["restore_command"].startswith("nestvault wal-fetch %f %p --source-dir ")
@@ -2,10 +2,26 @@
 
 from datetime import datetime, timedelta, timezone
 from unittest import mock
+from zoneinfo import ZoneInfo
 
 import pytest
 
-from nestvault.retention import get_expired_backups, cleanup_old_backups
+from nestvault.audit import AuditEvent, AuditTrail
+from nestvault.exceptions import RetentionError
+from nestvault.manifest import Manifest
+from nestvault.retention import (
+    Decision,
+    GfsPolicy,
+    PruneReport,
+    RetentionLimits,
+    cleanup_old_backups,
+    find_orphans,
+    get_expired_backups,
+    is_backup_of,
+    limit_backups,
+    plan_gfs,
+    prune_backups,
+)
 from nestvault.storage.base import StorageObject
 
 
@@ -163,3 +179,379 @@ class TestCleanupOldBackups:
 
         assert deleted_count == 0
         mock_storage.delete_many.assert_not_called()
+
+    def test_on_expire_failure_keeps_backup(self):
+        now = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        objects = [
+            StorageObject(
+                key=f"db_2024010{day}_120000.crdb.json",
+                size=100,
+                last_modified=datetime(2024, 1, day, 12, 0, 0, tzinfo=timezone.utc),
+            )
+            for day in (1, 2)
+        ]
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = objects
+
+        def on_expire(key):
+            if key.startswith("db_20240101"):
+                raise RuntimeError("access denied")
+
+        with mock.patch("nestvault.retention.datetime") as mock_datetime:
+            mock_datetime.now.return_value = now
+
+            deleted_count = cleanup_old_backups(
+                mock_storage, retention_days=7, prefix="db", on_expire=on_expire
+            )
+
+        assert deleted_count == 1
+        mock_storage.delete_many.assert_called_once_with(["db_20240102_120000.crdb.json"])
+
+    def test_deletions_are_audited(self, tmp_path):
+        now = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        objects = [
+            StorageObject(
+                key=f"db_2024010{day}_120000.crdb.json",
+                size=100,
+                last_modified=datetime(2024, 1, day, 12, 0, 0, tzinfo=timezone.utc),
+            )
+            for day in (1, 2)
+        ]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = objects
+        trail = tmp_path / "audit.jsonl"
+
+        def on_expire(key):
+            if key.startswith("db_20240101"):
+                raise RuntimeError("access denied")
+
+        with mock.patch("nestvault.audit._trail", AuditTrail(trail, user="ops")):
+            with mock.patch("nestvault.retention.datetime") as mock_datetime:
+                mock_datetime.now.return_value = now
+                cleanup_old_backups(mock_storage, retention_days=7, prefix="db", on_expire=on_expire)
+
+        events = [AuditEvent.from_json(line) for line in trail.read_text().splitlines()]
+        assert [(event.backup, event.outcome) for event in events] == [
+            ("db_20240101_120000.crdb.json", "started"),
+            ("db_20240102_120000.crdb.json", "started"),
+            ("db_20240101_120000.crdb.json", "failure"),
+            ("db_20240102_120000.crdb.json", "success"),
+        ]
+        assert {event.operation for event in events} == {"prune"}
+        assert events[2].reason == "deleting its data failed: access denied"
+        assert events[3].reason == "older than 7 days"
+
+    def test_strict_audit_failure_deletes_nothing(self, tmp_path):
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject("db_20240101_120000.sql.gz", 100, datetime(2024, 1, 1, 12, 0, tzinfo=timezone.utc))
+        ]
+        trail = AuditTrail(tmp_path, strict=True)
+
+        with mock.patch("nestvault.audit._trail", trail):
+            with pytest.raises(RetentionError, match="audit entry"):
+                cleanup_old_backups(mock_storage, retention_days=7)
+
+        mock_storage.delete_many.assert_not_called()
+
+    def test_only_considers_owned_backups(self):
+        now = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        objects = [
+            StorageObject(key=key, size=100, last_modified=datetime(2024, 1, 1, 12, 0, 0, tzinfo=timezone.utc))
+            for key in ("db_20240101_120000.sql.gz", "db_20240101_120000.schema.sql.gz")
+        ]
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = objects
+
+        with mock.patch("nestvault.retention.datetime") as mock_datetime:
+            mock_datetime.now.return_value = now
+
+            deleted_count = cleanup_old_backups(
+                mock_storage, retention_days=7, prefix="db", owns=lambda key: ".schema." not in key
+            )
+
+        assert deleted_count == 1
+        mock_storage.delete_many.assert_called_once_with(["db_20240101_120000.sql.gz"])
+
+    def test_selects_templated_backups_by_manifest(self):
+        from nestvault.manifest import Manifest
+
+        now = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        old = datetime(2024, 1, 1, 12, 0, 0, tzinfo=timezone.utc)
+        keys = [
+            "prod/db/2024/01/01.sql.gz",
+            "prod/db/2024/01/01.sql.gz.manifest.json",
+            "prod/db/2024/01/01.globals.sql.gz",
+            "prod/db_staging/2024/01/01.sql.gz",
+            "prod/db_staging/2024/01/01.sql.gz.manifest.json",
+        ]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [StorageObject(key=key, size=100, last_modified=old) for key in keys]
+
+        def read_manifest(storage, key):
+            database = key.split("/")[1]
+            metadata = {"globals": "prod/db/2024/01/01.globals.sql.gz"} if database == "db" else {}
+            return Manifest(key=key, database=database, finished_at=old, size=100, metadata=metadata)
+
+        with mock.patch("nestvault.retention.datetime") as mock_datetime, \
+                mock.patch("nestvault.manifest.read_manifest", side_effect=read_manifest):
+            mock_datetime.now.return_value = now
+
+            deleted_count = cleanup_old_backups(mock_storage, retention_days=7, prefix="prod/", database_name="db")
+
+        assert deleted_count == 3
+        mock_storage.delete_many.assert_called_once_with(keys[:3])
+
+
+def backup(finished_at: datetime, legacy: bool = False) -> Manifest:
+    return Manifest(
+        key=f"db_{finished_at:%Y%m%d_%H%M%S}.sql.gz", database="db", finished_at=finished_at, size=100, legacy=legacy
+    )
+
+
+class TestPlanGfs:
+    """Tests for plan_gfs function."""
+
+    def test_keeps_newest_of_each_period_for_every_reason(self):
+        start = datetime(2024, 1, 13, 0, 0, 0, tzinfo=timezone.utc)
+        backups = [backup(start + timedelta(hours=6 * i)) for i in range(12)]
+
+        kept = plan_gfs(backups, GfsPolicy(keep_hourly=2, keep_daily=3, keep_monthly=1))
+
+        assert kept == {
+            "db_20240115_180000.sql.gz": ["hourly 2024-01-15 18:00", "daily 2024-01-15", "monthly 2024-01"],
+            "db_20240115_120000.sql.gz": ["hourly 2024-01-15 12:00"],
+            "db_20240114_180000.sql.gz": ["daily 2024-01-14"],
+            "db_20240113_180000.sql.gz": ["daily 2024-01-13"],
+        }
+
+    def test_counts_periods_in_timezone(self):
+        backups = [
+            backup(datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)),
+            backup(datetime(2024, 1, 15, 23, 30, 0, tzinfo=timezone.utc)),
+        ]
+
+        assert len(plan_gfs(backups, GfsPolicy(keep_daily=2))) == 1
+        # 23:30 UTC is already the next day in Berlin
+        assert len(plan_gfs(backups, GfsPolicy(keep_daily=2, tz=ZoneInfo("Europe/Berlin")))) == 2
+
+    def test_weeks_are_iso_weeks(self):
+        backups = [backup(datetime(2024, 1, day, 12, 0, 0, tzinfo=timezone.utc)) for day in (6, 7, 8)]
+
+        assert plan_gfs(backups, GfsPolicy(keep_weekly=5)) == {
+            "db_20240108_120000.sql.gz": ["weekly 2024-W02"],
+            "db_20240107_120000.sql.gz": ["weekly 2024-W01"],
+        }
+
+    def test_keeps_only_successful_backup(self):
+        backups = [
+            backup(datetime(2024, 1, 14, 12, 0, 0, tzinfo=timezone.utc)),
+            backup(datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc), legacy=True),
+        ]
+
+        assert plan_gfs(backups, GfsPolicy(keep_daily=1)) == {
+            "db_20240115_120000.sql.gz": ["daily 2024-01-15"],
+            "db_20240114_120000.sql.gz": ["only successful backup left"],
+        }
+
+
+class TestCleanupGfs:
+    """Tests for cleanup_old_backups with a GFS policy."""
+
+    @pytest.fixture
+    def storage(self):
+        days = (13, 14, 15)
+        keys = [key for day in days for key in (
+            f"db_202401{day}_120000.sql.gz",
+            f"db_202401{day}_120000.sql.gz.manifest.json",
+            f"db_202401{day}_120000.globals.sql.gz",
+        )]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject(key=key, size=100, last_modified=datetime(2024, 1, 15, tzinfo=timezone.utc)) for key in keys
+        ]
+        return mock_storage
+
+    @pytest.fixture(autouse=True)
+    def manifests(self):
+        def read_manifest(storage, key):
+            finished_at = datetime.strptime(key[3:18], "%Y%m%d_%H%M%S").replace(tzinfo=timezone.utc)
+            globals_key = key.replace(".sql.gz", ".globals.sql.gz")
+            return Manifest(
+                key=key, database="db", finished_at=finished_at, size=100, metadata={"globals": globals_key}
+            )
+
+        with mock.patch("nestvault.manifest.read_manifest", side_effect=read_manifest):
+            yield
+
+    def test_deletes_unkept_backups_with_their_objects(self, storage):
+        deleted_count = cleanup_old_backups(storage, None, database_name="db", policy=GfsPolicy(keep_daily=2))
+
+        assert deleted_count == 3
+        storage.delete_many.assert_called_once_with([
+            "db_20240113_120000.sql.gz",
+            "db_20240113_120000.sql.gz.manifest.json",
+            "db_20240113_120000.globals.sql.gz",
+        ])
+
+    def test_dry_run_deletes_nothing(self, storage):
+        deleted_count = cleanup_old_backups(
+            storage, None, database_name="db", policy=GfsPolicy(keep_daily=1), dry_run=True
+        )
+
+        assert deleted_count == 6
+        storage.delete_many.assert_not_called()
+
+
+class TestPruneBackups:
+    """Tests for prune_backups function."""
+
+    def test_reports_decisions_and_bytes(self):
+        now = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        objects = [
+            StorageObject(key="db_20240101_120000.sql.gz", size=300, last_modified=now - timedelta(days=14)),
+            StorageObject(key="db_20240114_120000.sql.gz", size=200, last_modified=now - timedelta(days=1)),
+        ]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = objects
+
+        with mock.patch("nestvault.retention.datetime") as mock_datetime:
+            mock_datetime.now.return_value = now
+            report = prune_backups(mock_storage, retention_days=7, prefix="db", dry_run=True)
+
+        assert [(decision.key, decision.delete, decision.reason) for decision in report.decisions] == [
+            ("db_20240101_120000.sql.gz", True, "older than 7 days"),
+            ("db_20240114_120000.sql.gz", False, "newer than 7 days"),
+        ]
+        assert (report.deleted, report.reclaimed_bytes, report.remaining_bytes) == (1, 300, 200)
+        mock_storage.delete_many.assert_not_called()
+
+
+class TestLimitBackups:
+    """Tests for limit_backups function."""
+
+    NOW = datetime(2024, 6, 30, 12, 0, 0, tzinfo=timezone.utc)
+
+    @pytest.fixture
+    def storage(self):
+        # One backup of 100 bytes on the first of every month, each with a manifest of 10 bytes
+        keys = [key for month in range(1, 7) for key in (
+            f"db_20240{month}01_120000.sql.gz", f"db_20240{month}01_120000.sql.gz.manifest.json"
+        )]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject(key=key, size=10 if key.endswith(".json") else 100, last_modified=self.NOW) for key in keys
+        ]
+        return mock_storage
+
+    @pytest.fixture(autouse=True)
+    def manifests(self):
+        def read_manifest(storage, key):
+            finished_at = datetime.strptime(key[3:18], "%Y%m%d_%H%M%S").replace(tzinfo=timezone.utc)
+            return Manifest(key=key, database="db", finished_at=finished_at, size=100)
+
+        with mock.patch("nestvault.manifest.read_manifest", side_effect=read_manifest), \
+                mock.patch("nestvault.retention.datetime") as mock_datetime:
+            mock_datetime.now.return_value = self.NOW
+            yield
+
+    def deleted_backups(self, storage):
+        [keys] = storage.delete_many.call_args.args
+        return sorted(key for key in keys if not key.endswith(".json"))
+
+    def test_deletes_oldest_backups_beyond_total_size(self, storage):
+        report = limit_backups(storage, RetentionLimits(max_total_size=350), database_name="db")
+
+        assert self.deleted_backups(storage) == [
+            "db_20240101_120000.sql.gz", "db_20240201_120000.sql.gz", "db_20240301_120000.sql.gz"
+        ]
+        assert (report.reclaimed_bytes, report.remaining_bytes) == (330, 330)
+
+    def test_deletes_backups_past_max_age(self, storage):
+        limit_backups(storage, RetentionLimits(max_age_days=135), database_name="db")
+
+        assert self.deleted_backups(storage) == ["db_20240101_120000.sql.gz", "db_20240201_120000.sql.gz"]
+
+    def test_limits_combine(self, storage):
+        report = limit_backups(storage, RetentionLimits(max_total_size=350, max_age_days=160), database_name="db")
+
+        reasons = {decision.key: decision.reason for decision in report.decisions if decision.delete}
+        assert reasons["db_20240101_120000.sql.gz"] == "older than 160 days"
+        assert reasons["db_20240201_120000.sql.gz"] == "newer backups fill the 350 bytes size limit"
+        assert reasons["db_20240301_120000.sql.gz"] == "newer backups fill the 350 bytes size limit"
+        assert len(reasons) == 6
+
+    def test_skips_backups_retention_already_pruned(self, storage):
+        pruned = {"db_20240601_120000.sql.gz", "db_20240601_120000.sql.gz.manifest.json"}
+
+        report = limit_backups(storage, RetentionLimits(max_total_size=250), database_name="db", pruned=pruned)
+
+        assert self.deleted_backups(storage) == [f"db_20240{month}01_120000.sql.gz" for month in range(1, 4)]
+        assert report.remaining_bytes == 220
+
+    def test_keeps_only_successful_backup(self, storage):
+        report = limit_backups(storage, RetentionLimits(max_total_size=50, max_age_days=1), database_name="db")
+
+        assert "db_20240601_120000.sql.gz" not in self.deleted_backups(storage)
+        assert report.remaining_bytes == 110
+
+
+class TestPruneReport:
+    """Tests for PruneReport class."""
+
+    def test_combined_keeps_first_reason_unless_later_run_deletes(self):
+        rules = PruneReport([Decision("a", 1, False, "newer than 7 days"), Decision("b", 1, False, "kept")])
+        limits = PruneReport([Decision("a", 1, False, "within the limits"), Decision("b", 1, True, "past 5 days")])
+
+        combined = PruneReport.combined([rules, limits])
+
+        assert [(decision.key, decision.delete, decision.reason) for decision in combined.decisions] == [
+            ("a", False, "newer than 7 days"),
+            ("b", True, "past 5 days"),
+        ]
+
+
+class TestFindOrphans:
+    """Tests for find_orphans function."""
+
+    def test_lists_objects_of_no_configured_database(self):
+        now = datetime.now(timezone.utc)
+        keys = [
+            "app/app_20240101_120000.sql.gz",
+            "app/app_20240101_120000.sql.gz.sha256",
+            "gone/gone_20240101_120000.sql.gz",
+            "wal/app/000000010000000000000001",
+            "notes.txt",
+        ]
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [StorageObject(key=key, size=10, last_modified=now) for key in keys]
+
+        orphans = find_orphans(mock_storage, [("app/", "app", lambda key: True)])
+
+        assert [orphan.key for orphan in orphans] == ["gone/gone_20240101_120000.sql.gz", "notes.txt"]
+        assert not any(orphan.delete for orphan in orphans)
+        mock_storage.delete_many.assert_not_called()
+
+    def test_skips_backups_owned_by_other_nodes_of_a_database(self):
+        now = datetime.now(timezone.utc)
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject(key="db_20240101_120000.node1.tar.gz", size=10, last_modified=now),
+            StorageObject(key="db_20240101_120000.node2.tar.gz", size=10, last_modified=now),
+        ]
+        owners = [("", "db", lambda key: "node1" in key), ("", "db", lambda key: "node2" in key)]
+
+        assert find_orphans(mock_storage, owners) == []
+
+
+class TestIsBackupOf:
+    """Tests for is_backup_of function."""
+
+    def test_matches_own_backups(self):
+        assert is_backup_of("tenant_20240101_120000.sql.gz", "tenant")
+
+    def test_ignores_databases_sharing_a_prefix(self):
+        assert not is_backup_of("tenant_staging_20240101_120000.sql.gz", "tenant")
+        assert not is_backup_of("tenants_20240101_120000.sql.gz", "tenant")
@@ -0,0 +1,67 @@
+"""Tests for scratch databases backups are test-restored into."""
+
+from unittest import mock
+
+import pytest
+
+from nestvault.config import RestoreVerifyConfig
+from nestvault.exceptions import BackupError
+from nestvault.sandbox import docker_server, run_checks, scratch_server
+
+
+class TestDockerServer:
+    """Tests for docker_server."""
+
+    def test_starts_and_removes_container(self):
+        config = RestoreVerifyConfig(docker_image="postgres:16")
+
+        def fake_run(cmd, **kwargs):
+            stdout = b"172.17.0.5\n" if cmd[:2] == ["docker", "inspect"] else b""
+            return mock.Mock(stdout=stdout, returncode=0)
+
+        with mock.patch("subprocess.run", side_effect=fake_run) as mock_run:
+            with docker_server(config) as dsn:
+                assert dsn.startswith("postgresql://postgres:")
+                assert dsn.endswith("@172.17.0.5:5432/postgres?sslmode=disable")
+
+        commands = [call[0][0] for call in mock_run.call_args_list]
+        name = commands[0][commands[0].index("--name") + 1]
+        assert commands[0][:3] == ["docker", "run", "-d"] and commands[0][-1] == "postgres:16"
+        assert commands[-1] == ["docker", "rm", "-f", name]
+
+    def test_removes_container_that_never_becomes_ready(self):
+        config = RestoreVerifyConfig(docker_image="postgres:16", docker_network="backups", timeout_seconds=1)
+
+        def fake_run(cmd, **kwargs):
+            return mock.Mock(stdout=b"", stderr=b"connection refused", returncode=2 if cmd[0] == "psql" else 0)
+
+        with mock.patch("subprocess.run", side_effect=fake_run) as mock_run, \
+                mock.patch("nestvault.sandbox.time.sleep"), \
+                mock.patch("nestvault.sandbox.time.monotonic", side_effect=[0, 0.5, 2]):
+            with pytest.raises(BackupError, match="within 1 seconds: connection refused"):
+                with docker_server(config):
+                    pass
+
+        assert mock_run.call_args[0][0][:3] == ["docker", "rm", "-f"]
+
+    def test_dsn_server_is_used_as_is(self):
+        config = RestoreVerifyConfig(dsn="postgresql://sandbox/postgres")
+
+        with mock.patch("subprocess.run") as mock_run:
+            with scratch_server(config) as dsn:
+                assert dsn == "postgresql://sandbox/postgres"
+
+        mock_run.assert_not_called()
+
+
+class TestRunChecks:
+    """Tests for run_checks."""
+
+    def test_checks_pass_only_when_true(self):
+        adapter = mock.Mock()
+        adapter.query.side_effect = ["t", "f", BackupError("relation \"todos\" does not exist")]
+
+        results = run_checks(adapter, ["SELECT true", "SELECT false", "SELECT count(*) > 0 FROM todos"])
+
+        assert [result.passed for result in results] == [True, False, False]
+        assert "does not exist" in results[2].output
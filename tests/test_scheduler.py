@@ -1,11 +1,43 @@
 """Tests for scheduler module."""
 
-from datetime import datetime, timezone
+from datetime import datetime, timedelta, timezone
 from unittest import mock
+from zoneinfo import ZoneInfo
 
 import pytest
 
-from nestvault.scheduler import get_next_run_time, run_backup_job
+from nestvault.exceptions import BackupError
+from nestvault.scheduler import get_next_run_time, run_backup_cycle, run_backup_job
+
+CHECKSUM = {"size": "6", "sha256": "0" * 64}
+
+
+@pytest.fixture(autouse=True)
+def checksum_metadata():
+    """Backup files in these tests are mocks or paths that do not exist, so there is nothing to hash."""
+    with mock.patch("nestvault.scheduler.checksum_metadata", return_value=CHECKSUM) as patched:
+        yield patched
+
+
+@pytest.fixture(autouse=True)
+def write_manifest():
+    """Manifests are uploaded through the same mocked storage; keep them out of its upload calls."""
+    with mock.patch("nestvault.scheduler.write_manifest") as patched:
+        yield patched
+
+
+@pytest.fixture(autouse=True)
+def prune_wal():
+    """Mock backup adapters report archives_wal as truthy; keep WAL cleanup off their mocked storage."""
+    with mock.patch("nestvault.scheduler.prune_wal") as patched:
+        yield patched
+
+
+@pytest.fixture(autouse=True)
+def collect_chunks():
+    """Mock backup adapters report deduplicates as truthy; keep chunk cleanup off their mocked storage."""
+    with mock.patch("nestvault.scheduler.collect_chunks") as patched:
+        yield patched
 
 
 class TestGetNextRunTime:
@@ -40,6 +72,45 @@ class TestGetNextRunTime:
         assert next_run.hour == 14
         assert next_run.minute == 30
 
+    def test_evaluated_in_timezone(self):
+        base_time = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        next_run = get_next_run_time("@daily", base_time, ZoneInfo("Europe/Berlin"))
+
+        # Midnight in Berlin, an hour before midnight UTC in winter
+        assert next_run == datetime(2024, 1, 15, 23, 0, 0, tzinfo=timezone.utc)
+
+    def test_time_skipped_by_dst_runs_once_later(self):
+        berlin = ZoneInfo("Europe/Berlin")
+        # Clocks go from 02:00 to 03:00 on 2024-03-31
+        base_time = datetime(2024, 3, 30, 2, 30, 0, tzinfo=berlin)
+
+        next_run = get_next_run_time("30 2 * * *", base_time, berlin)
+        assert next_run.astimezone(berlin) == datetime(2024, 3, 31, 3, 30, 0, tzinfo=berlin)
+
+        following = get_next_run_time("30 2 * * *", next_run, berlin)
+        assert following.astimezone(berlin) == datetime(2024, 4, 1, 2, 30, 0, tzinfo=berlin)
+
+    def test_time_repeated_by_dst_runs_once(self):
+        berlin = ZoneInfo("Europe/Berlin")
+        # Clocks go from 03:00 back to 02:00 on 2024-10-27, so 02:30 comes twice
+        base_time = datetime(2024, 10, 26, 2, 30, 0, tzinfo=berlin)
+
+        next_run = get_next_run_time("30 2 * * *", base_time, berlin)
+        assert next_run == datetime(2024, 10, 27, 0, 30, 0, tzinfo=timezone.utc)
+
+        following = get_next_run_time("30 2 * * *", next_run, berlin)
+        assert following == datetime(2024, 10, 28, 1, 30, 0, tzinfo=timezone.utc)
+
+    def test_runs_strictly_later_across_dst(self):
+        berlin = ZoneInfo("Europe/Berlin")
+        runs = [datetime(2024, 10, 26, 22, 0, 0, tzinfo=timezone.utc)]
+        for _ in range(12):
+            runs.append(get_next_run_time("*/30 * * * *", runs[-1], berlin))
+
+        assert runs == sorted(set(runs))
+        wall_clock = [run.astimezone(berlin).replace(tzinfo=None) for run in runs]
+        assert len(set(wall_clock)) == len(wall_clock)
+
 
 class TestRunBackupJob:
     """Tests for run_backup_job function."""
@@ -48,6 +119,8 @@ class TestRunBackupJob:
         mock_backup = mock.Mock()
         mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
         mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
 
         mock_storage = mock.Mock()
         mock_storage.list.return_value = []
@@ -71,11 +144,334 @@ class TestRunBackupJob:
         assert result is False
         mock_storage.upload.assert_not_called()
 
+    def test_outcome_recorded_in_metrics(self):
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        with mock.patch("nestvault.scheduler.record_backup") as record_backup:
+            run_backup_job(mock_backup, mock_storage, retention_days=7, target_name="billing")
+            mock_backup.backup.side_effect = BackupError("pg_dump failed")
+            run_backup_job(mock_backup, mock_storage, retention_days=7, target_name="billing")
+
+        [succeeded, failed] = record_backup.call_args_list
+        assert succeeded.args[:2] == ("billing", True)
+        assert succeeded.args[5].phases["upload"].bytes_out == 6
+        assert failed.args[:2] == ("billing", False)
+
+    def test_failure_reported_to_notifiers(self):
+        mock_backup = mock.Mock()
+        mock_backup.database_name = "testdb"
+        mock_backup.backup.side_effect = BackupError("pg_dump failed")
+
+        with mock.patch("nestvault.scheduler.notify") as notify:
+            run_backup_job(mock_backup, mock.Mock(), retention_days=7, target_name="billing", notifiers=["slack"])
+
+        [(notifiers, result)] = [call.args for call in notify.call_args_list]
+        assert notifiers == ["slack"]
+        assert (result.target, result.database, result.status) == ("billing", "testdb", "failure")
+        assert result.error == "pg_dump failed"
+        assert result.duration is not None
+        assert any("Backup failed: pg_dump failed" in line for line in result.log)
+
+    def test_retention_only_prunes_tier(self):
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        with mock.patch("nestvault.scheduler.cleanup_old_backups", return_value=0) as cleanup:
+            assert run_backup_job(mock_backup, mock.Mock(), retention_days=2, tier="hourly") is True
+
+        assert cleanup.call_args.args[1] == 2
+        assert cleanup.call_args.kwargs["tier"] == "hourly"
+
+    def test_companions_uploaded_and_linked(self):
+        from pathlib import Path
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = Path("/tmp/testdb_20240115_120000.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.engine = "postgres"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {
+            "globals": Path("/tmp/testdb_20240115_120000.globals.sql.gz"),
+        }
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+
+        companion_call, backup_call = mock_storage.upload.call_args_list
+        assert companion_call.args[1] == "testdb_20240115_120000.globals.sql.gz"
+        assert companion_call.kwargs["metadata"] == {"engine": "postgres", "companion": "globals", **CHECKSUM}
+        assert backup_call.args[1] == "testdb_20240115_120000.sql.gz"
+        assert backup_call.kwargs["metadata"] == {
+            "engine": "postgres",
+            "globals": "testdb_20240115_120000.globals.sql.gz",
+            **CHECKSUM,
+        }
+
+    def test_keys_rendered_from_key_template(self, write_manifest):
+        from pathlib import Path
+
+        from nestvault.naming import KeyTemplate
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = Path("/tmp/testdb_20240115_120000.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.engine = "postgres"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {
+            "globals": Path("/tmp/testdb_20240115_120000.globals.sql.gz"),
+        }
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        template = KeyTemplate("prod/{{.Database}}/{{.Year}}/{{.Timestamp}}")
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, key_template=template) is True
+
+        companion_call, backup_call = mock_storage.upload.call_args_list
+        assert companion_call.args[1] == "prod/testdb/2024/20240115_120000.globals.sql.gz"
+        assert backup_call.args[1] == "prod/testdb/2024/20240115_120000.sql.gz"
+        assert backup_call.kwargs["metadata"]["globals"] == "prod/testdb/2024/20240115_120000.globals.sql.gz"
+        assert write_manifest.call_args.args[1].key == "prod/testdb/2024/20240115_120000.sql.gz"
+        mock_storage.list.assert_called_with(prefix="prod/testdb/")
+
+    def test_labels_recorded_with_backup(self, write_manifest):
+        from pathlib import Path
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = Path("/tmp/testdb_20240115_120000.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        labels = {"reason": "pre-migration", "env": "prod"}
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, labels=labels) is True
+
+        metadata = mock_storage.upload.call_args.kwargs["metadata"]
+        assert metadata["labels"] == "env=prod,reason=pre-migration"
+        assert write_manifest.call_args.args[1].labels == labels
+
+    def test_manifest_written_after_upload(self, write_manifest):
+        from pathlib import Path
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = Path("/tmp/testdb_20240115_120000.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.engine = "postgres"
+        mock_backup.backup_metadata = {"engine": "postgres", "compression": "zstd"}
+        mock_backup.backup_companions.return_value = {}
+        mock_backup.server_version.return_value = "16.2"
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+
+        storage, manifest, _ = write_manifest.call_args.args
+        assert storage is mock_storage
+        assert manifest.key == "testdb_20240115_120000.sql.gz"
+        assert manifest.database == "testdb"
+        assert manifest.server_version == "16.2"
+        assert manifest.compression == "zstd"
+        assert manifest.size == 6
+        assert manifest.sha256 == CHECKSUM["sha256"]
+        assert manifest.started_at <= manifest.finished_at
+        assert list(manifest.phases) == ["dump", "upload"]
+        assert manifest.phases["upload"]["bytes_out"] == 6
+
+    def test_manifest_failure_does_not_fail_backup(self, write_manifest):
+        from nestvault.exceptions import StorageError
+
+        write_manifest.side_effect = StorageError("Access Denied")
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+
+    def test_skips_backup_of_unchanged_database(self):
+        from nestvault.manifest import Manifest
+
+        mock_backup = mock.Mock()
+        mock_backup.database_name = "testdb"
+        mock_backup.fingerprint.return_value = "f1"
+        latest = Manifest(
+            "testdb_20240115_120000.sql.gz", "testdb", datetime.now(timezone.utc) - timedelta(days=2), 6,
+            metadata={"fingerprint": "f1"},
+        )
+        mock_storage = mock.Mock()
+
+        with mock.patch("nestvault.scheduler.list_backups", return_value=[latest]), \
+                mock.patch("nestvault.scheduler.write_unchanged_record") as record, \
+                mock.patch("nestvault.scheduler.cleanup_old_backups", return_value=0) as cleanup:
+            assert run_backup_job(mock_backup, mock_storage, 7, skip_unchanged=timedelta(days=7)) is True
+
+        mock_backup.backup.assert_not_called()
+        mock_storage.upload.assert_not_called()
+        assert record.call_args.args[1] is latest
+        cleanup.assert_called_once()
+
+    def test_backs_up_changed_or_long_unchanged_database(self, write_manifest):
+        from pathlib import Path
+
+        from nestvault.manifest import Manifest
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = Path("/tmp/testdb_20240115_120000.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+        mock_backup.fingerprint.return_value = "f2"
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        now = datetime.now(timezone.utc)
+
+        for fingerprint, age in [("f1", timedelta(days=1)), ("f2", timedelta(days=7))]:
+            metadata = {"fingerprint": fingerprint}
+            latest = Manifest("testdb_20240108_120000.sql.gz", "testdb", now - age, 6, metadata=metadata)
+            with mock.patch("nestvault.scheduler.list_backups", return_value=[latest]):
+                assert run_backup_job(mock_backup, mock_storage, 30, skip_unchanged=timedelta(days=7)) is True
+
+        assert mock_backup.backup.call_count == 2
+        assert mock_storage.upload.call_args.kwargs["metadata"]["fingerprint"] == "f2"
+
+    def test_wal_pruned_after_retention_when_archiving(self, prune_wal):
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="postgres_20240115_120000.tar.gz")
+        mock_backup.database_name = "postgres"
+        mock_backup.backup_metadata = {"engine": "postgres", "mode": "physical"}
+        mock_backup.backup_companions.return_value = {}
+        mock_backup.archives_wal = True
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+        prune_wal.assert_called_once_with(mock_storage, "postgres", "postgres")
+
+        prune_wal.reset_mock()
+        mock_backup.archives_wal = False
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+        prune_wal.assert_not_called()
+
+    def test_chunks_collected_after_retention_when_deduplicating(self, collect_chunks):
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="testdb_20240115_120000.sql.gz.dedup")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres", "dedup": "chunks"}
+        mock_backup.backup_companions.return_value = {}
+        mock_backup.deduplicates = True
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+        collect_chunks.assert_called_once_with(mock_storage)
+
+        collect_chunks.reset_mock()
+        mock_backup.deduplicates = False
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7) is True
+        collect_chunks.assert_not_called()
+
+    def test_failing_pre_backup_hook_aborts_backup(self):
+        from nestvault.config import HooksConfig
+
+        mock_backup = mock.Mock()
+        mock_backup.database_name = "testdb"
+        mock_storage = mock.Mock()
+        hooks = HooksConfig(pre_backup=["exit 1"], post_failure=["true"])
+
+        with mock.patch("nestvault.scheduler.run_post_hooks", return_value=[]) as post_hooks:
+            result = run_backup_job(mock_backup, mock_storage, retention_days=7, hooks=hooks, target_name="nightly")
+
+        assert result is False
+        mock_backup.backup.assert_not_called()
+        mock_storage.upload.assert_not_called()
+        stage, commands, context, _ = post_hooks.call_args.args
+        assert (stage, commands, context.target, context.status) == ("post_failure", ["true"], "nightly", "aborted")
+
+    def test_failing_post_backup_hook_does_not_fail_backup(self):
+        from nestvault.config import HooksConfig
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        hooks = HooksConfig(post_backup=["exit 1"])
+
+        failures = ["'exit 1' exited with status 1"]
+        with mock.patch("nestvault.scheduler.run_post_hooks", return_value=failures) as post_hooks:
+            result = run_backup_job(mock_backup, mock_storage, retention_days=7, hooks=hooks)
+
+        assert result is True
+        stage, _, context, _ = post_hooks.call_args.args
+        assert (stage, context.status) == ("post_backup", "success")
+        assert context.backup_key == mock_backup.backup.return_value.name
+
+    def test_failed_preflight_skips_backup(self):
+        from nestvault.config import PreflightConfig
+        from nestvault.exceptions import BackupError
+
+        mock_backup = mock.Mock()
+        mock_backup.database_name = "testdb"
+        mock_storage = mock.Mock()
+        preflight = PreflightConfig(enabled=True)
+
+        with mock.patch("nestvault.scheduler.check_temp_space", side_effect=BackupError("Not enough space")):
+            result = run_backup_job(mock_backup, mock_storage, retention_days=7, preflight=preflight)
+
+        assert result is False
+        mock_backup.backup.assert_not_called()
+
+    def test_preflight_estimate_recorded_with_backup(self):
+        from nestvault.config import PreflightConfig
+        from nestvault.preflight import SizeEstimate
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        estimate = SizeEstimate(size=500, basis="test", database_size=1000)
+        preflight = PreflightConfig(enabled=True)
+
+        with mock.patch("nestvault.scheduler.check_temp_space", return_value=estimate):
+            result = run_backup_job(mock_backup, mock_storage, retention_days=7, preflight=preflight)
+
+        assert result is True
+        metadata = mock_storage.upload.call_args.kwargs["metadata"]
+        assert metadata["estimated_size"] == "500"
+        assert metadata["database_size"] == "1000"
+
     def test_storage_failure(self):
         from nestvault.exceptions import StorageError
 
         mock_backup = mock.Mock()
         mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
 
         mock_storage = mock.Mock()
         mock_storage.upload.side_effect = StorageError("S3 upload failed")
@@ -83,3 +479,910 @@ class TestRunBackupJob:
         result = run_backup_job(mock_backup, mock_storage, retention_days=7)
 
         assert result is False
+
+    def _replica(self, name, retention_days=30, error=None):
+        from nestvault.scheduler import Replica
+
+        storage = mock.Mock()
+        storage.list.return_value = []
+        if error:
+            storage.upload.side_effect = error
+        return Replica(name, storage, retention_days)
+
+    def test_backup_copied_to_every_replica(self):
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        replica = self._replica("sftp")
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, replicas=[replica]) is True
+
+        assert replica.storage_adapter.upload.call_args == mock_storage.upload.call_args
+
+    def test_failed_replica_is_degraded_not_failed(self):
+        from nestvault.exceptions import StorageError
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        broken = self._replica("sftp", error=StorageError("Connection refused"))
+        working = self._replica("local")
+
+        with mock.patch("nestvault.scheduler.logger") as mock_logger:
+            result = run_backup_job(mock_backup, mock_storage, retention_days=7, replicas=[broken, working])
+
+        assert result is True
+        working.storage_adapter.upload.assert_called_once()
+        assert "degraded" in mock_logger.warning.call_args[0][0]
+
+    def test_primary_failure_skips_replicas(self):
+        from nestvault.exceptions import StorageError
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        mock_storage = mock.Mock()
+        mock_storage.upload.side_effect = StorageError("R2 unavailable")
+        replica = self._replica("sftp")
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, replicas=[replica]) is False
+        replica.storage_adapter.upload.assert_not_called()
+
+    def test_replicas_pruned_with_own_retention(self):
+        from datetime import timedelta
+
+        from nestvault.storage.base import StorageObject
+
+        mock_backup = mock.Mock()
+        mock_backup.backup.return_value = mock.Mock(name="test_backup.sql.gz")
+        mock_backup.database_name = "testdb"
+        mock_backup.backup_metadata = {"engine": "postgres"}
+        mock_backup.backup_companions.return_value = {}
+
+        old = StorageObject(
+            key="testdb_20240101_120000.sql.gz",
+            size=100,
+            last_modified=datetime.now(timezone.utc) - timedelta(days=20),
+        )
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [old]
+        short = self._replica("local", retention_days=7)
+        short.storage_adapter.list.return_value = [old]
+        long = self._replica("sftp", retention_days=365)
+        long.storage_adapter.list.return_value = [old]
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=30, replicas=[short, long]) is True
+
+        mock_storage.delete_many.assert_not_called()
+        short.storage_adapter.delete_many.assert_called_once_with(["testdb_20240101_120000.sql.gz"])
+        long.storage_adapter.delete_many.assert_not_called()
+        # Engine data lives with the primary backup only
+        mock_backup.delete_backup_data.assert_not_called()
+
+
+class TestFailover:
+    """Tests for failing over to fallback storage and reconciling afterwards."""
+
+    def _backup_adapter(self):
+        adapter = mock.Mock()
+        adapter.backup.return_value = mock.Mock(name="testdb_20240115_120000.sql.gz")
+        adapter.backup.return_value.name = "testdb_20240115_120000.sql.gz"
+        adapter.database_name = "testdb"
+        adapter.backup_metadata = {"engine": "postgres"}
+        adapter.backup_companions.return_value = {}
+        return adapter
+
+    def _fallback(self, name, error=None):
+        from nestvault.scheduler import Fallback
+
+        storage = mock.Mock()
+        storage.list.return_value = []
+        if error:
+            storage.upload.side_effect = error
+        return Fallback(name, storage)
+
+    def test_upload_retried_before_failing_over(self):
+        from nestvault.exceptions import StorageError
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        mock_storage.upload.side_effect = [StorageError("503 Service Unavailable"), None]
+        fallback = self._fallback("local")
+
+        with mock.patch("nestvault.scheduler.time.sleep") as mock_sleep:
+            result = run_backup_job(
+                self._backup_adapter(), mock_storage, retention_days=7, failover=[fallback], upload_retries=2
+            )
+
+        assert result is True
+        mock_sleep.assert_called_once_with(1)
+        fallback.storage_adapter.upload.assert_not_called()
+
+    def test_fails_over_in_order(self):
+        from nestvault.exceptions import StorageError
+
+        mock_storage = mock.Mock()
+        mock_storage.upload.side_effect = StorageError("R2 unavailable")
+        broken = self._fallback("sftp", error=StorageError("Connection refused"))
+        working = self._fallback("local")
+
+        with mock.patch("nestvault.scheduler.logger") as mock_logger:
+            result = run_backup_job(self._backup_adapter(), mock_storage, retention_days=7, failover=[broken, working])
+
+        assert result is True
+        assert working.storage_adapter.upload.call_args.kwargs["metadata"] == {
+            "engine": "postgres",
+            "failover": "true",
+            **CHECKSUM,
+        }
+        # The primary is unreachable, so it is neither reconciled nor pruned
+        mock_storage.list.assert_not_called()
+        assert "via fallback destination local" in mock_logger.warning.call_args[0][0]
+
+    def test_every_fallback_failing_fails_the_job(self):
+        from nestvault.exceptions import StorageError
+
+        mock_storage = mock.Mock()
+        mock_storage.upload.side_effect = StorageError("R2 unavailable")
+        fallback = self._fallback("local", error=StorageError("No space left on device"))
+
+        assert run_backup_job(self._backup_adapter(), mock_storage, retention_days=7, failover=[fallback]) is False
+
+    def test_failed_over_backups_reconciled_after_next_upload(self):
+        from nestvault.storage.base import StorageObject
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        fallback = self._fallback("local")
+        fallback.storage_adapter.list.return_value = [
+            StorageObject(
+                key="testdb_20240114_120000.sql.gz", size=100, last_modified=datetime.now(timezone.utc)
+            ),
+        ]
+        fallback.storage_adapter.get_metadata.return_value = {"engine": "postgres", "failover": "true"}
+        fallback.storage_adapter.download.side_effect = lambda key, path: path.write_bytes(b"backup")
+
+        assert run_backup_job(self._backup_adapter(), mock_storage, retention_days=7, failover=[fallback]) is True
+
+        reconciled = mock_storage.upload.call_args_list[-1]
+        assert reconciled.args[1] == "testdb_20240114_120000.sql.gz"
+        assert reconciled.kwargs["metadata"] == {"engine": "postgres", "failover": "true"}
+        fallback.storage_adapter.delete_many.assert_called_once_with(["testdb_20240114_120000.sql.gz"])
+
+    def test_reconcile_copies_companions_first_and_skips_present(self):
+        from nestvault.scheduler import reconcile_failover
+        from nestvault.storage.base import StorageObject
+
+        now = datetime.now(timezone.utc)
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [StorageObject("testdb_20240113_120000.sql.gz", 100, now)]
+        fallback = self._fallback("local")
+        fallback.storage_adapter.list.return_value = [
+            StorageObject("testdb_20240113_120000.sql.gz", 100, now),
+            StorageObject("testdb_20240114_120000.sql.gz", 100, now),
+            StorageObject("testdb_20240114_120000.globals.sql.gz", 10, now),
+            StorageObject("testdb_staging_20240114_120000.sql.gz", 100, now),
+        ]
+        fallback.storage_adapter.get_metadata.side_effect = lambda key: (
+            {"companion": "globals"} if "globals" in key else {"globals": "testdb_20240114_120000.globals.sql.gz"}
+        )
+        fallback.storage_adapter.download.side_effect = lambda key, path: path.write_bytes(b"backup")
+
+        assert reconcile_failover("testdb", mock_storage, fallback) == 2
+
+        assert [c.args[1] for c in mock_storage.upload.call_args_list] == [
+            "testdb_20240114_120000.globals.sql.gz",
+            "testdb_20240114_120000.sql.gz",
+        ]
+
+    def _streaming_backup_adapter(self):
+        import contextlib
+        import io
+
+        mock_backup = self._backup_adapter()
+        mock_backup.supports_streaming = True
+        mock_backup.stream_backup.return_value = contextlib.nullcontext(
+            ("testdb_20240115_120000.sql.gz", io.BytesIO(b"backup"))
+        )
+        return mock_backup
+
+    def test_streams_backup_without_temp_file(self):
+        from nestvault.storage.base import StreamedUpload
+
+        mock_backup = self._streaming_backup_adapter()
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        mock_storage.upload_stream.return_value = StreamedUpload(size=6, sha256="abc")
+
+        with mock.patch("nestvault.scheduler.record_backup") as record_backup:
+            assert run_backup_job(mock_backup, mock_storage, retention_days=7, stream=True) is True
+
+        mock_backup.backup.assert_not_called()
+        assert record_backup.call_args.args[4] == 6
+        call = mock_storage.upload_stream.call_args
+        assert call.args[1] == "testdb_20240115_120000.sql.gz"
+        assert call.kwargs["metadata"] == {"engine": "postgres"}
+        assert call.kwargs["expected_size"] is None
+
+    def test_stream_expects_size_of_previous_backup(self):
+        from nestvault.storage.base import StorageObject, StreamedUpload
+
+        mock_backup = self._streaming_backup_adapter()
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = [
+            StorageObject("testdb_20240113_120000.sql.gz", 100, datetime(2024, 1, 13, tzinfo=timezone.utc)),
+            StorageObject("testdb_20240114_120000.sql.gz", 120, datetime(2024, 1, 14, tzinfo=timezone.utc)),
+            StorageObject("testdb_20240114_120000.globals.sql.gz", 5, datetime(2024, 1, 14, 1, tzinfo=timezone.utc)),
+        ]
+        mock_storage.upload_stream.return_value = StreamedUpload(size=6, sha256="abc")
+
+        with mock.patch("nestvault.scheduler.cleanup_old_backups", return_value=0):
+            assert run_backup_job(mock_backup, mock_storage, retention_days=7, stream=True) is True
+
+        assert mock_storage.upload_stream.call_args.kwargs["expected_size"] == 120
+
+    def test_streamed_backup_failure_fails_job(self):
+        from nestvault.exceptions import BackupError
+
+        mock_backup = self._streaming_backup_adapter()
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        mock_storage.upload_stream.side_effect = BackupError("pg_dump failed")
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, stream=True) is False
+        mock_storage.upload.assert_not_called()
+
+    def test_replicas_use_temp_file_instead_of_streaming(self):
+        from nestvault.scheduler import Replica
+
+        mock_backup = self._streaming_backup_adapter()
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+        replica = Replica("sftp", mock.Mock(), 30)
+        replica.storage_adapter.list.return_value = []
+
+        assert run_backup_job(mock_backup, mock_storage, retention_days=7, replicas=[replica], stream=True) is True
+
+        mock_backup.backup.assert_called_once()
+        mock_storage.upload_stream.assert_not_called()
+
+
+class TestRunBackupCycle:
+    """Tests for run_backup_cycle function."""
+
+    def _adapter(self, name, error=None):
+        adapter = mock.Mock()
+        adapter.database_name = name
+        adapter.backup_metadata = {"engine": "postgres"}
+        adapter.backup_companions.return_value = {}
+        if error:
+            adapter.backup.side_effect = error
+        else:
+            adapter.backup.return_value = mock.Mock(name=f"{name}_backup.sql.gz")
+        return adapter
+
+    def test_single_database(self):
+        mock_backup = self._adapter("testdb")
+        mock_backup.expand.return_value = [mock_backup]
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_cycle(mock_backup, mock_storage, retention_days=7) is True
+        mock_backup.backup.assert_called_once()
+
+    def test_failure_does_not_abort_other_databases(self):
+        from nestvault.exceptions import BackupError
+
+        first = self._adapter("tenant_a", error=BackupError("pg_dump failed"))
+        second = self._adapter("tenant_b")
+
+        mock_backup = mock.Mock()
+        mock_backup.expand.return_value = [first, second]
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        result = run_backup_cycle(mock_backup, mock_storage, retention_days=7)
+
+        assert result is False
+        second.backup.assert_called_once()
+        mock_storage.upload.assert_called_once()
+
+    def test_retention_applied_per_database(self):
+        first = self._adapter("tenant_a")
+        second = self._adapter("tenant_b")
+
+        mock_backup = mock.Mock()
+        mock_backup.expand.return_value = [first, second]
+
+        mock_storage = mock.Mock()
+        mock_storage.list.return_value = []
+
+        assert run_backup_cycle(mock_backup, mock_storage, retention_days=7) is True
+
+        prefixes = [c.kwargs["prefix"] for c in mock_storage.list.call_args_list]
+        assert prefixes == ["tenant_a", "tenant_b"]
+
+    def test_discovery_failure(self):
+        from nestvault.exceptions import BackupError
+
+        mock_backup = mock.Mock()
+        mock_backup.expand.side_effect = BackupError("psql failed")
+
+        mock_storage = mock.Mock()
+
+        assert run_backup_cycle(mock_backup, mock_storage, retention_days=7) is False
+        mock_storage.upload.assert_not_called()
+
+
+class TestResumeUploads:
+    """Tests for resume_uploads function."""
+
+    @staticmethod
+    def _interrupted(key, local_path, age=timedelta(minutes=10)):
+        from nestvault.storage.base import InterruptedUpload
+
+        return InterruptedUpload(key, local_path, datetime.now(timezone.utc) - age, {"engine": "postgres"})
+
+    def test_resumes_upload_of_remaining_temp_file(self, tmp_path):
+        from nestvault.scheduler import resume_uploads
+
+        backup_file = tmp_path / "db.sql.gz"
+        backup_file.write_bytes(b"backup")
+        storage = mock.Mock()
+        storage.interrupted_uploads.return_value = [self._interrupted("db.sql.gz", backup_file)]
+
+        assert resume_uploads(storage, timedelta(hours=24)) == 1
+
+        storage.upload.assert_called_once_with(backup_file, "db.sql.gz", {"engine": "postgres"})
+        storage.abort_upload.assert_not_called()
+        assert not backup_file.exists()
+
+    def test_aborts_streamed_upload(self):
+        from nestvault.scheduler import resume_uploads
+
+        upload = self._interrupted("db.sql.gz", None)
+        storage = mock.Mock()
+        storage.interrupted_uploads.return_value = [upload]
+
+        assert resume_uploads(storage, timedelta(hours=24)) == 0
+
+        storage.abort_upload.assert_called_once_with(upload)
+        storage.upload.assert_not_called()
+
+    def test_aborts_upload_whose_file_is_gone_or_too_old(self, tmp_path):
+        from nestvault.scheduler import resume_uploads
+
+        old_file = tmp_path / "db_old.sql.gz"
+        old_file.write_bytes(b"backup")
+        gone = self._interrupted("db_gone.sql.gz", tmp_path / "db_gone.sql.gz")
+        old = self._interrupted("db_old.sql.gz", old_file, age=timedelta(days=2))
+        storage = mock.Mock()
+        storage.interrupted_uploads.return_value = [gone, old]
+
+        assert resume_uploads(storage, timedelta(hours=24)) == 0
+
+        assert storage.abort_upload.call_args_list == [mock.call(gone), mock.call(old)]
+        storage.upload.assert_not_called()
+
+
+class TestRunScheduler:
+    """Tests for run_scheduler function."""
+
+    def test_targets_follow_their_own_schedules(self):
+        from nestvault.scheduler import BackupTarget, run_scheduler
+
+        hourly = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock())
+        weekly = BackupTarget("analytics", "0 0 * * 0", 90, mock.Mock(), mock.Mock())
+        for target in (hourly, weekly):
+            target.storage_adapter.interrupted_uploads.return_value = []
+
+        runs = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            runs.append(retention_days)
+            if len(runs) == 3:
+                raise KeyboardInterrupt
+            return True
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle), \
+                mock.patch("nestvault.scheduler.time.sleep"):
+            with pytest.raises(KeyboardInterrupt):
+                run_scheduler([hourly, weekly])
+
+        # Both targets run on start, then the hourly one comes due first
+        assert runs == [7, 90, 7]
+
+    def test_tiers_follow_their_own_schedules_and_retention(self):
+        from nestvault.scheduler import BackupTarget, Tier, run_scheduler
+
+        tiers = [Tier("hourly", "0 * * * *", 2), Tier("daily", "0 0 * * *", 30), Tier("adhoc", None, 14)]
+        target = BackupTarget("billing", "", 7, mock.Mock(), mock.Mock(), tiers=tiers, labels={"env": "prod"})
+        target.storage_adapter.interrupted_uploads.return_value = []
+        runs = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            runs.append((options["tier"], retention_days, options["labels"]))
+            if len(runs) == 3:
+                raise KeyboardInterrupt
+            return True
+
+        # Started before midnight, so the hourly and daily tiers fall due together; the midnight run takes 5 minutes
+        times = [
+            datetime(2024, 1, 15, 23, 30, 0, tzinfo=timezone.utc),
+            datetime(2024, 1, 16, 0, 5, 0, tzinfo=timezone.utc),
+        ]
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle), \
+                mock.patch("nestvault.scheduler.time.sleep"), \
+                mock.patch("nestvault.scheduler.datetime") as clock:
+            clock.now.side_effect = lambda tz=None: times[0 if len(runs) < 2 else 1]
+            with pytest.raises(KeyboardInterrupt):
+                run_scheduler([target])
+
+        # On start in the ad hoc tier, then once at midnight as the daily, then hourly again
+        assert runs == [
+            ("adhoc", 14, {"env": "prod", "tier": "adhoc"}),
+            ("daily", 30, {"env": "prod", "tier": "daily"}),
+            ("hourly", 2, {"env": "prod", "tier": "hourly"}),
+        ]
+
+    def test_logs_and_publishes_next_runs_in_target_timezone(self):
+        import threading
+
+        from nestvault.scheduler import BackupTarget, run_scheduler, upcoming
+
+        target = BackupTarget("billing", "@daily", 7, mock.Mock(), mock.Mock(), tz=ZoneInfo("Europe/Berlin"))
+        target.storage_adapter.interrupted_uploads.return_value = []
+        stop = threading.Event()
+        stop.set()
+
+        with mock.patch("nestvault.scheduler.logger") as logger:
+            run_scheduler([target], run_immediately=False, stop=stop)
+
+        next_run = upcoming()["billing"]
+        assert next_run["schedule"] == "@daily"
+        assert next_run["timezone"] == "Europe/Berlin"
+        assert datetime.fromisoformat(next_run["next_run"]).astimezone(ZoneInfo("Europe/Berlin")).hour == 0
+        assert any("next run at" in str(call) and "(Europe/Berlin)" in str(call) for call in logger.info.call_args_list)
+
+    def test_publishes_start_delayed_by_jitter(self):
+        import threading
+
+        from nestvault.scheduler import BackupTarget, run_scheduler, upcoming
+
+        target = BackupTarget("billing", "@daily", 7, mock.Mock(), mock.Mock(), jitter=timedelta(minutes=30))
+        stop = threading.Event()
+        stop.set()
+
+        with mock.patch("nestvault.scheduler.random.uniform", return_value=600.0):
+            run_scheduler([target], run_immediately=False, stop=stop)
+
+        next_run = upcoming()["billing"]
+        delay = datetime.fromisoformat(next_run["next_run"]) - datetime.fromisoformat(next_run["due"])
+        assert delay == timedelta(minutes=10)
+
+    def test_stops_once_signalled(self):
+        import threading
+
+        from nestvault.scheduler import BackupTarget, run_scheduler
+
+        hourly = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock())
+        hourly.storage_adapter.interrupted_uploads.return_value = []
+        stop = threading.Event()
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            # A SIGTERM during a backup lets it finish
+            stop.set()
+            return True
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle) as cycle:
+            run_scheduler([hourly], stop=stop)
+
+        cycle.assert_called_once()
+
+    def test_reschedules_once_the_runs_under_way_finish(self):
+        import threading
+
+        from nestvault.scheduler import BackupTarget, Schedule, reschedule, run_scheduler, upcoming
+
+        hourly = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock())
+        yearly = BackupTarget("orders", "0 0 1 1 *", 14, mock.Mock(), mock.Mock())
+        for target in (hourly, yearly):
+            target.storage_adapter.interrupted_uploads.return_value = []
+        stop = threading.Event()
+        scheduled = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            # A reload during the initial backup lets it finish with the targets it started with
+            reschedule(Schedule([yearly]))
+            return True
+
+        def fake_wait(stop, seconds):
+            scheduled.append(set(upcoming()))
+            return True
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle) as cycle, \
+                mock.patch("nestvault.scheduler._wait", side_effect=fake_wait):
+            run_scheduler([hourly], stop=stop)
+
+        assert [call.args[2] for call in cycle.call_args_list] == [7]
+        assert "orders" in scheduled[0] and "billing" not in scheduled[0]
+
+    def test_tasks_run_on_their_own_schedule(self):
+        from nestvault.scheduler import BackupTarget, ScheduledTask, run_scheduler
+
+        yearly = BackupTarget("billing", "0 0 1 1 *", 7, mock.Mock(), mock.Mock())
+        yearly.storage_adapter.interrupted_uploads.return_value = []
+        task = mock.Mock(side_effect=[RuntimeError("no backups"), KeyboardInterrupt])
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle, \
+                mock.patch("nestvault.scheduler.time.sleep"):
+            with pytest.raises(KeyboardInterrupt):
+                run_scheduler([yearly], tasks=[ScheduledTask("restore verification", "* * * * *", task)])
+
+        # The target runs on start; the task is not, and a failing run does not stop the loop
+        assert cycle.call_count == 1
+        assert task.call_count == 2
+
+    def test_skips_and_records_runs_while_paused(self):
+        from nestvault.scheduler import BackupTarget, pause, resume, run_scheduler
+
+        minutely = BackupTarget("billing", "* * * * *", 7, mock.Mock(), mock.Mock())
+        minutely.storage_adapter.interrupted_uploads.return_value = []
+        sleeps, ended = [], []
+
+        def sleep(seconds):
+            # Resumed before the second run, stopped before the third
+            sleeps.append(seconds)
+            if len(sleeps) == 2:
+                ended.append(resume())
+            elif len(sleeps) == 3:
+                raise KeyboardInterrupt
+
+        pause()
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle, \
+                mock.patch("nestvault.scheduler.time.sleep", side_effect=sleep):
+            with pytest.raises(KeyboardInterrupt):
+                run_scheduler([minutely], run_immediately=False)
+
+        [pause_ended] = ended
+        assert [name for name, _ in pause_ended.skipped] == ["billing"]
+        cycle.assert_called_once()
+
+    def test_pause_resumes_once_its_duration_is_over(self):
+        from nestvault.scheduler import pause, paused
+
+        pause(timedelta(hours=1))
+        assert paused() is not None
+
+        with mock.patch("nestvault.scheduler.datetime") as clock:
+            clock.now.return_value = datetime.now(timezone.utc) + timedelta(hours=2)
+            assert paused() is None
+        assert paused() is None
+
+    def test_catches_up_on_run_missed_while_down(self):
+        from nestvault.scheduler import BackupTarget, run_scheduler
+
+        daily = BackupTarget("billing", "0 2 * * *", 7, mock.Mock(), mock.Mock())
+        daily.storage_adapter.interrupted_uploads.return_value = []
+        now = datetime.now(timezone.utc)
+        last_due = now.replace(hour=2, minute=0, second=0, microsecond=0) - timedelta(days=3)
+        missed = get_next_run_time("0 2 * * *", now - timedelta(days=1))
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle, \
+                mock.patch("nestvault.scheduler.last_run", return_value=last_due), \
+                mock.patch("nestvault.scheduler.record_run") as record, \
+                mock.patch("nestvault.scheduler.time.sleep", side_effect=KeyboardInterrupt):
+            with pytest.raises(KeyboardInterrupt):
+                run_scheduler([daily], catch_up=timedelta(0))
+
+        # The catch-up takes the place of the initial backup
+        cycle.assert_called_once()
+        assert cycle.call_args.kwargs["labels"] == {"catch_up": missed.isoformat()}
+        assert record.call_args.args[1:3] == ("billing", missed)
+
+    def test_refuses_backup_outside_window_unless_ignored(self):
+        from nestvault.scheduler import BackupTarget, run_once
+        from nestvault.window import BackupWindow
+
+        now = datetime.now(timezone.utc)
+        # A window of one hour, half a day from now
+        start = (now.hour * 60 + now.minute + 12 * 60) % (24 * 60)
+        window = BackupWindow(((start, (start + 60) % (24 * 60) or 24 * 60),))
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), window=window)
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle:
+            assert run_once([target]) == {"billing": False}
+            cycle.assert_not_called()
+
+            assert run_once([target], ignore_window=True) == {"billing": True}
+            cycle.assert_called_once()
+
+    def test_waits_for_window_to_open(self):
+        from nestvault.scheduler import BackupTarget, run_once
+
+        window = mock.Mock(tz=timezone.utc)
+        window.contains.return_value = False
+        window.opens_after.side_effect = lambda now: now + timedelta(hours=2)
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), window=window)
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle, \
+                mock.patch("nestvault.scheduler.time.sleep") as sleep, \
+                mock.patch("nestvault.scheduler.supervising"):
+            assert run_once([target], wait_for_window=True) == {"billing": True}
+
+        sleep.assert_called_once_with(7200.0)
+        cycle.assert_called_once()
+
+    def test_skips_target_locked_by_another_replica(self, tmp_path):
+        from nestvault.config import LocalConfig
+        from nestvault.lock import lock_key
+        from nestvault.scheduler import BackupTarget, run_once
+        from nestvault.storage.local import LocalStorageAdapter
+
+        storage = LocalStorageAdapter(LocalConfig(root=str(tmp_path)))
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), storage, lock_ttl=timedelta(minutes=10))
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=True) as cycle:
+            assert run_once([target]) == {"billing": True}
+            cycle.assert_called_once()
+
+            held = ({"expires_at": "9999-01-01T00:00:00+00:00"}, "v1")
+            with mock.patch.object(storage, "create_exclusive", return_value=False), \
+                    mock.patch("nestvault.lock._read_record", return_value=held):
+                assert run_once([target]) == {"billing": True}
+            cycle.assert_called_once()
+
+        assert not (tmp_path / lock_key("billing")).exists()
+
+    def test_run_pinged_with_its_log(self):
+        from nestvault.scheduler import BackupTarget, run_once
+
+        ping = mock.Mock()
+        ping.start.return_value = "run-1"
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), ping=ping)
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", return_value=False):
+            assert run_once([target]) == {"billing": False}
+
+        ping.start.assert_called_once()
+        [(run_id, succeeded, log)] = [call.args for call in ping.finish.call_args_list]
+        assert (run_id, succeeded) == ("run-1", False)
+        assert any("Running backup target 'billing'" in line for line in log)
+
+    def test_backs_up_with_leased_credentials(self):
+        from nestvault.credentials import CredentialProvider, Lease
+        from nestvault.scheduler import BackupTarget, run_once
+
+        credentials = mock.Mock(spec=CredentialProvider)
+        credentials.name = "vault"
+        credentials.acquire.return_value = lease = Lease("v-nestvault-xyz", "s3cret-from-vault")
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), credentials=credentials)
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            backup_adapter.use_credentials.assert_called_once_with("v-nestvault-xyz", "s3cret-from-vault")
+            credentials.revoke.assert_not_called()
+            return True
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle):
+            assert run_once([target]) == {"billing": True}
+
+        credentials.revoke.assert_called_once_with(lease)
+
+    def test_failed_credential_acquisition_is_notified(self):
+        from nestvault.credentials import CredentialProvider
+        from nestvault.exceptions import CredentialError
+        from nestvault.scheduler import BackupTarget, run_once
+
+        credentials = mock.Mock(spec=CredentialProvider)
+        credentials.acquire.side_effect = CredentialError("Vault answered GET database/creds/nestvault with HTTP 403")
+        notifier = mock.Mock()
+        target = BackupTarget(
+            "billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), credentials=credentials, notifiers=[notifier]
+        )
+        target.backup_adapter.database_name = "billing"
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle") as cycle, \
+                mock.patch("nestvault.scheduler.notify") as notify:
+            assert run_once([target]) == {"billing": False}
+
+        cycle.assert_not_called()
+        [result] = [call.args[1] for call in notify.call_args_list]
+        assert result.status == "failure"
+        assert result.error.startswith("Credential acquisition failed: Vault answered GET")
+
+    def test_backs_up_through_the_ssh_tunnel(self):
+        from nestvault.scheduler import BackupTarget, run_once
+        from nestvault.tunnel import SshTunnel
+
+        tunnel = mock.MagicMock(spec=SshTunnel)
+        tunnel.open.return_value.__enter__.return_value = 40123
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), tunnel=tunnel)
+        target.storage_adapter.interrupted_uploads.return_value = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            backup_adapter.use_tunnel.assert_called_once_with(40123)
+            return True
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle):
+            assert run_once([target]) == {"billing": True}
+
+        target.backup_adapter.use_tunnel.assert_called_with(None)
+        tunnel.open.return_value.__exit__.assert_called_once()
+
+    def test_failed_ssh_tunnel_is_notified_and_counted(self):
+        from nestvault.exceptions import TunnelError
+        from nestvault.metrics import TUNNEL_FAILURES
+        from nestvault.scheduler import BackupTarget, run_once
+        from nestvault.tunnel import SshTunnel
+
+        tunnel = mock.MagicMock(spec=SshTunnel)
+        tunnel.open.return_value.__enter__.side_effect = TunnelError("Jump host bastion:22 is not reachable")
+        notifier = mock.Mock()
+        target = BackupTarget("billing", "0 * * * *", 7, mock.Mock(), mock.Mock(), tunnel=tunnel, notifiers=[notifier])
+        target.backup_adapter.database_name = "billing"
+        failures = TUNNEL_FAILURES.value(target="billing")
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle") as cycle, \
+                mock.patch("nestvault.scheduler.notify") as notify:
+            assert run_once([target]) == {"billing": False}
+
+        cycle.assert_not_called()
+        [result] = [call.args[1] for call in notify.call_args_list]
+        assert result.error == "SSH tunnel failed: Jump host bastion:22 is not reachable"
+        assert TUNNEL_FAILURES.value(target="billing") == failures + 1
+
+    def test_concurrent_targets_serialized_by_concurrency_key(self):
+        import threading
+        import time
+
+        from nestvault.scheduler import BackupTarget, run_once
+
+        targets = [
+            BackupTarget(name, "0 * * * *", days, mock.Mock(), mock.Mock(), concurrency_key=key)
+            for name, days, key in (("billing", 1, "primary"), ("orders", 2, "primary"), ("analytics", 3, ""))
+        ]
+        for target in targets:
+            target.storage_adapter.interrupted_uploads.return_value = []
+
+        lock = threading.Lock()
+        running: set[int] = set()
+        starts = []
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            with lock:
+                starts.append((retention_days, set(running)))
+                running.add(retention_days)
+            time.sleep(0.1)
+            with lock:
+                running.discard(retention_days)
+            return retention_days != 2
+
+        with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle):
+            assert run_once(targets, max_concurrent=3) == {"billing": True, "orders": False, "analytics": True}
+
+        # billing and orders share a key, so they never overlap; analytics runs alongside them
+        assert [days for days, _ in starts if days != 3] == [1, 2]
+        assert not any({1, 2} <= others | {days} for days, others in starts)
+        assert any(others for _, others in starts)
+
+    def test_concurrent_target_leaves_uploads_of_a_running_target_alone(self, tmp_path):
+        import threading
+
+        from nestvault.config import S3Config
+        from nestvault.scheduler import BackupTarget, resume_uploads, run_once
+        from nestvault.storage.s3 import S3StorageAdapter
+        from nestvault.storage.upload_state import UploadState
+
+        config = S3Config(
+            access_key="key",
+            secret_key="secret",
+            bucket="backups",
+            region="us-east-1",
+            upload_state_dir=str(tmp_path / "uploads"),
+            part_size_mb=5,
+            upload_concurrency=1,
+        )
+        archive_file = tmp_path / "billing_archive_20240115_020000.sql.gz"
+        archive_file.write_bytes(b"a" * 5 * 1024 * 1024 + b"b")
+        sending, resumed = threading.Event(), threading.Event()
+
+        def upload_part(**part):
+            sending.set()
+            resumed.wait(5)
+            return {"ETag": f"etag-{part['PartNumber']}"}
+
+        def fake_cycle(backup_adapter, storage_adapter, retention_days, **options):
+            if backup_adapter.database_name == "billing_archive":
+                storage_adapter.upload(archive_file, archive_file.name)
+            return True
+
+        def resume_while_sending(storage_adapter, max_age, prefix=""):
+            # billing starts while billing_archive is uploading a key under billing's prefix
+            if prefix != "billing":
+                return resume_uploads(storage_adapter, max_age, prefix)
+            assert sending.wait(5)
+            try:
+                return resume_uploads(storage_adapter, max_age, prefix)
+            finally:
+                resumed.set()
+
+        with mock.patch("boto3.client") as client:
+            client.return_value.create_multipart_upload.return_value = {"UploadId": "archive-upload"}
+            client.return_value.upload_part.side_effect = upload_part
+            targets = [
+                BackupTarget(name, "0 * * * *", 7, mock.Mock(), S3StorageAdapter(config))
+                for name in ("billing_archive", "billing")
+            ]
+            for target in targets:
+                target.backup_adapter.database_name = target.name
+            # An upload of billing's own that a run which died left behind
+            targets[1].storage_adapter.upload_state.save(
+                UploadState(
+                    "backups",
+                    "billing_20240114_020000.sql.gz",
+                    "leftover-upload",
+                    datetime.now(timezone.utc).isoformat(),
+                    local_path=str(tmp_path / "billing_20240114_020000.sql.gz"),
+                )
+            )
+
+            with mock.patch("nestvault.scheduler.run_backup_cycle", side_effect=fake_cycle), \
+                    mock.patch("nestvault.scheduler.resume_uploads", side_effect=resume_while_sending):
+                assert run_once(targets, max_concurrent=2) == {"billing_archive": True, "billing": True}
+
+        aborted = [call.kwargs["UploadId"] for call in client.return_value.abort_multipart_upload.call_args_list]
+        assert aborted == ["leftover-upload"]
+        assert client.return_value.complete_multipart_upload.call_args.kwargs["UploadId"] == "archive-upload"
+        assert archive_file.exists()
+        assert targets[0].storage_adapter.interrupted_uploads("") == []
+
+
+class TestDelayedStart:
+    """Tests for delayed_start function."""
+
+    DUE = datetime(2024, 1, 15, 2, 0, 0, tzinfo=timezone.utc)
+
+    def test_delays_by_random_part_of_jitter(self):
+        from nestvault.scheduler import BackupTarget, delayed_start
+
+        target = BackupTarget("billing", "@daily", 7, mock.Mock(), mock.Mock(), jitter=timedelta(minutes=30))
+
+        with mock.patch("nestvault.scheduler.random.uniform", return_value=600.0) as uniform:
+            assert delayed_start(target, self.DUE) == self.DUE + timedelta(minutes=10)
+        uniform.assert_called_once_with(0, 1800.0)
+
+    def test_starts_on_time_without_jitter(self):
+        from nestvault.scheduler import BackupTarget, delayed_start
+
+        target = BackupTarget("billing", "@daily", 7, mock.Mock(), mock.Mock())
+
+        assert delayed_start(target, self.DUE) == self.DUE
+
+    def test_caps_jitter_reaching_next_occurrence(self):
+        from nestvault.scheduler import BackupTarget, delayed_start
+
+        target = BackupTarget("billing", "@hourly", 7, mock.Mock(), mock.Mock(), jitter=timedelta(hours=2))
+
+        with mock.patch("nestvault.scheduler.random.uniform", side_effect=lambda low, high: high), \
+                mock.patch("nestvault.scheduler.logger") as logger:
+            assert delayed_start(target, self.DUE) == self.DUE + timedelta(minutes=30)
+        assert "capping it at 1800s" in logger.warning.call_args.args[0]
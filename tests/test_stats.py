@@ -0,0 +1,40 @@
+"""Tests for stats module."""
+
+from nestvault.stats import BackupStats, Phase, collecting, measure, record
+
+MIB = 1024 * 1024
+
+
+class TestBackupStats:
+    """Tests for BackupStats."""
+
+    def test_records_only_while_collecting(self):
+        record("compress", 1.0, 100, 10)
+
+        with collecting() as stats:
+            record("compress", 1.0, 100, 10)
+            record("compress", 0.5, 300, 30)
+
+        assert stats.phases == {"compress": Phase(1.5, 400, 40)}
+        assert stats.phases["compress"].ratio == 10
+
+    def test_measure_replaces_earlier_attempt(self):
+        with collecting() as stats:
+            for size in (10, 20):
+                with measure("upload") as phase:
+                    phase.bytes_out = size
+
+        assert stats.phases["upload"].bytes_out == 20
+        assert stats.phases["upload"].seconds >= 0
+
+    def test_summary_and_round_trip(self):
+        stats = BackupStats()
+        stats.add("upload", 2.0, bytes_out=20 * MIB)
+        stats.add("dump", 10.0)
+        stats.add("compress", 4.0, 80 * MIB, 20 * MIB)
+
+        assert stats.summary() == (
+            "dump 10.0s, compress 4.0s (80.0 MiB -> 20.0 MiB, ratio 4.00), upload 2.0s (20.0 MiB, 10.0 MiB/s)"
+        )
+        assert list(stats.to_dict()) == ["dump", "compress", "upload"]
+        assert BackupStats.from_dict({**stats.to_dict(), "bogus": {"speed": 1}}) == stats
@@ -0,0 +1,152 @@
+"""Tests for status module."""
+
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault import status
+from nestvault.stats import measure
+from nestvault.status import (
+    add_backup,
+    add_error,
+    current_run,
+    problems,
+    register,
+    report_progress,
+    snapshot,
+    tracking,
+)
+from nestvault.storage.base import TransferProgress
+
+NOW = datetime(2024, 1, 15, 3, 0, tzinfo=timezone.utc)
+
+
+@pytest.fixture
+def targets():
+    with mock.patch.dict(status._targets, clear=True):
+        yield status._targets
+
+
+def schedule(next_run: datetime, due: datetime | None = None) -> dict[str, str]:
+    return {
+        "schedule": "0 2 * * *",
+        "timezone": "UTC",
+        "next_run": next_run.isoformat(),
+        "due": (due or next_run).isoformat(),
+    }
+
+
+class TestTracking:
+    """Tests for tracking and the reports of a run under way."""
+
+    def test_registered_target_has_no_run_yet(self, targets):
+        register(["billing"])
+
+        assert snapshot({"billing": schedule(NOW)}) == {
+            "billing": {
+                "last_run": None,
+                "status": None,
+                "duration": None,
+                "size": None,
+                "next_run": NOW.isoformat(),
+                "in_progress": False,
+                "running_since": None,
+                "phase": None,
+                "progress": None,
+                "errors": {},
+            }
+        }
+
+    def test_run_under_way_shows_phase_and_progress(self, targets):
+        with tracking("billing") as run:
+            with measure("upload"):
+                progress = TransferProgress("billing.sql.gz", total=400)
+                progress(100)
+                running = snapshot({})["billing"]
+            run.succeeded = True
+
+        assert running["in_progress"] is True
+        assert (running["phase"], running["progress"]) == ("upload", 25.0)
+        finished = snapshot({})["billing"]
+        assert finished["in_progress"] is False
+        assert finished["status"] == "success"
+        assert (finished["phase"], finished["progress"]) == (None, None)
+        assert finished["duration"] >= 0
+
+    def test_size_adds_up_the_backups_of_the_run(self, targets):
+        with tracking("billing") as run:
+            add_backup(100)
+            add_backup(None)
+            add_backup(50)
+            run.succeeded = True
+
+        assert snapshot({})["billing"]["size"] == 150
+
+    def test_errors_of_the_last_run_are_kept_in_full(self, targets):
+        error = "pg_dump: error: " + "x" * 2000
+        with tracking("billing"):
+            add_error("billing", error)
+
+        assert snapshot({})["billing"]["errors"] == {"billing": error}
+
+        with tracking("billing") as run:
+            run.succeeded = True
+
+        assert snapshot({})["billing"]["errors"] == {}
+
+    def test_run_left_with_an_exception_failed(self, targets):
+        with pytest.raises(RuntimeError):
+            with tracking("billing"):
+                raise RuntimeError("cancelled")
+
+        assert snapshot({})["billing"]["status"] == "failure"
+
+    def test_reports_outside_a_run_are_ignored(self, targets):
+        add_backup(100)
+        report_progress(current_run(), 0.5)
+
+        assert targets == {}
+
+    def test_next_run_is_the_earliest_of_the_tiers(self, targets):
+        register(["billing"])
+        upcoming = {
+            "billing/daily": schedule(NOW + timedelta(hours=5)),
+            "billing/hourly": schedule(NOW + timedelta(minutes=20)),
+            "billing-archive": schedule(NOW + timedelta(minutes=5)),
+        }
+
+        assert snapshot(upcoming)["billing"]["next_run"] == (NOW + timedelta(minutes=20)).isoformat()
+
+
+class TestProblems:
+    """Tests for problems function."""
+
+    def test_healthy_when_runs_succeed_on_time(self, targets):
+        with tracking("billing") as run:
+            run.succeeded = True
+
+        assert problems({"billing": schedule(NOW + timedelta(hours=1))}, timedelta(hours=1), NOW) == []
+
+    def test_failed_last_run(self, targets):
+        with tracking("billing"):
+            pass
+
+        [problem] = problems({}, timedelta(hours=1), NOW)
+        assert problem.startswith("billing: last run failed at ")
+
+    def test_overdue_run(self, targets):
+        register(["billing"])
+        upcoming = {"billing": schedule(NOW - timedelta(minutes=90))}
+
+        assert problems(upcoming, timedelta(hours=2), NOW) == []
+        assert problems(upcoming, timedelta(hours=1), NOW) == [
+            f"billing: overdue, its run was due at {(NOW - timedelta(minutes=90)).isoformat()}"
+        ]
+
+    def test_running_target_is_not_overdue(self, targets):
+        upcoming = {"billing": schedule(NOW - timedelta(hours=3))}
+
+        with tracking("billing") as run:
+            assert problems(upcoming, timedelta(hours=1), NOW) == []
+            run.succeeded = True
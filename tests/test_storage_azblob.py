@@ -0,0 +1,150 @@
+"""Tests for Azure Blob Storage adapter."""
+
+import base64
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+from azure.core.exceptions import HttpResponseError, ResourceNotFoundError
+
+from nestvault.config import AzureBlobConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.azblob import AzureBlobStorageAdapter
+
+
+class TestAzureBlobStorageAdapter:
+    """Tests for AzureBlobStorageAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return AzureBlobConfig(container="backups", account_name="nestvault", account_key="a2V5", block_size_mb=1)
+
+    @pytest.fixture
+    def mock_service(self):
+        with mock.patch("nestvault.storage.azblob.BlobServiceClient") as mock_service:
+            yield mock_service
+
+    @pytest.fixture
+    def mock_container(self, mock_service):
+        container = mock.Mock()
+        mock_service.return_value.get_container_client.return_value = container
+        mock_service.from_connection_string.return_value.get_container_client.return_value = container
+        return container
+
+    def test_account_key_auth(self, config, mock_service):
+        AzureBlobStorageAdapter(config)
+
+        mock_service.assert_called_once_with(
+            "https://nestvault.blob.core.windows.net",
+            credential={"account_name": "nestvault", "account_key": "a2V5"},
+        )
+        mock_service.return_value.get_container_client.assert_called_once_with("backups")
+
+    def test_connection_string_auth(self, mock_service):
+        config = AzureBlobConfig(container="backups", connection_string="UseDevelopmentStorage=true")
+
+        AzureBlobStorageAdapter(config)
+
+        mock_service.from_connection_string.assert_called_once_with("UseDevelopmentStorage=true")
+
+    def test_sas_token_auth(self, mock_service):
+        config = AzureBlobConfig(container="backups", account_name="nestvault", sas_token="?sv=2022-11-02&sig=abc")
+
+        AzureBlobStorageAdapter(config)
+
+        assert mock_service.call_args[1]["credential"] == "sv=2022-11-02&sig=abc"
+
+    def test_managed_identity_auth(self, mock_service):
+        config = AzureBlobConfig(container="backups", account_name="nestvault", client_id="client-id")
+
+        with mock.patch("nestvault.storage.azblob.DefaultAzureCredential") as mock_credential:
+            AzureBlobStorageAdapter(config)
+
+        mock_credential.assert_called_once_with(managed_identity_client_id="client-id")
+        assert mock_service.call_args[1]["credential"] is mock_credential.return_value
+
+    def test_small_upload_is_single_request(self, config, mock_container, tmp_path):
+        config.access_tier = "Cool"
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"test data")
+
+        AzureBlobStorageAdapter(config).upload(backup, "backups/test.sql.gz", metadata={"engine": "postgres"})
+
+        blob = mock_container.get_blob_client.return_value
+        assert blob.upload_blob.call_args[1] == {
+            "overwrite": True,
+            "metadata": {"engine": "postgres"},
+            "standard_blob_tier": "Cool",
+        }
+        blob.stage_block.assert_not_called()
+
+    def test_large_upload_stages_blocks(self, config, mock_container, tmp_path):
+        config.access_tier = "Archive"
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"x" * (2 * 1024 * 1024 + 10))
+
+        AzureBlobStorageAdapter(config).upload(backup, "backups/test.sql.gz", metadata={"engine": "postgres"})
+
+        blob = mock_container.get_blob_client.return_value
+        staged = [call[0] for call in blob.stage_block.call_args_list]
+        assert [len(data) for _, data in staged] == [1024 * 1024, 1024 * 1024, 10]
+        assert base64.b64decode(staged[2][0]) == b"00000002"
+
+        blocks, = blob.commit_block_list.call_args[0]
+        assert [block.id for block in blocks] == [block_id for block_id, _ in staged]
+        assert blob.commit_block_list.call_args[1] == {"metadata": {"engine": "postgres"}, "standard_blob_tier": "Archive"}
+        blob.upload_blob.assert_not_called()
+
+    def test_list_flags_archived_blobs(self, config, mock_container):
+        hot = mock.Mock(size=1024, last_modified=datetime(2024, 1, 15, tzinfo=timezone.utc), blob_tier="Hot")
+        hot.name = "db_20240115_120000.sql.gz"
+        archived = mock.Mock(size=2048, last_modified=datetime(2024, 1, 1, tzinfo=timezone.utc), blob_tier="Archive")
+        archived.name = "db_20240101_120000.sql.gz"
+        mock_container.list_blobs.return_value = iter([hot, archived])
+
+        objects = AzureBlobStorageAdapter(config).list(prefix="db")
+
+        mock_container.list_blobs.assert_called_once_with(name_starts_with="db")
+        assert [(obj.key, obj.archived) for obj in objects] == [
+            ("db_20240115_120000.sql.gz", False),
+            ("db_20240101_120000.sql.gz", True),
+        ]
+
+    def test_get_metadata(self, config, mock_container):
+        mock_container.get_blob_client.return_value.get_blob_properties.return_value.metadata = {"engine": "mysql"}
+
+        assert AzureBlobStorageAdapter(config).get_metadata("db.sql.gz") == {"engine": "mysql"}
+
+    def test_delete_missing_blob_is_ignored(self, config, mock_container):
+        mock_container.delete_blob.side_effect = ResourceNotFoundError("BlobNotFound")
+
+        AzureBlobStorageAdapter(config).delete("db.sql.gz")
+
+    def test_delete_many_batches(self, config, mock_container):
+        keys = [f"db_{i}.sql.gz" for i in range(300)]
+        mock_container.delete_blobs.side_effect = lambda *batch, **kwargs: [mock.Mock(status_code=202)] * len(batch)
+
+        AzureBlobStorageAdapter(config).delete_many(keys)
+
+        assert [len(call[0]) for call in mock_container.delete_blobs.call_args_list] == [256, 44]
+
+    def test_delete_many_reports_failures(self, config, mock_container):
+        mock_container.delete_blobs.return_value = [
+            mock.Mock(status_code=404),
+            mock.Mock(status_code=403, reason="AuthorizationPermissionMismatch"),
+        ]
+
+        with pytest.raises(StorageError) as exc_info:
+            AzureBlobStorageAdapter(config).delete_many(["a.sql.gz", "b.sql.gz"])
+
+        assert "HTTP 403" in str(exc_info.value)
+
+    def test_download_archived_blob(self, config, mock_container, tmp_path):
+        error = HttpResponseError("This operation is not permitted on an archived blob.")
+        error.error_code = "BlobArchived"
+        mock_container.get_blob_client.return_value.download_blob.side_effect = error
+
+        with pytest.raises(StorageError) as exc_info:
+            AzureBlobStorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "rehydrate" in str(exc_info.value)
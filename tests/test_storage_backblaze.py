@@ -0,0 +1,104 @@
+"""Tests for Backblaze B2 storage adapter."""
+
+import hashlib
+from unittest import mock
+
+import pytest
+from b2sdk.v2.exception import B2Error
+
+from nestvault.config import BackblazeConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.backblaze import BackblazeStorageAdapter
+
+CONTENT = b"0123456789" * 100
+
+
+class FakeDownload:
+    """DownloadedFile stand-in that writes part of its range, then optionally breaks off."""
+
+    def __init__(self, data, fail_after=None):
+        self.data = data
+        self.fail_after = fail_after
+
+    def save(self, f, allow_seeking=True):
+        assert allow_seeking is False
+        if self.fail_after is None:
+            f.write(self.data)
+            return
+        f.write(self.data[: self.fail_after])
+        raise ConnectionError("Connection reset by peer")
+
+
+class TestBackblazeStorageAdapter:
+    """Tests for BackblazeStorageAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return BackblazeConfig(key_id="key", application_key="secret", bucket="backups", region="us-east-005")
+
+    @pytest.fixture
+    def mock_bucket(self):
+        with mock.patch("nestvault.storage.backblaze.B2Api") as mock_api:
+            bucket = mock_api.return_value.get_bucket_by_name.return_value
+            bucket.get_file_info_by_name.return_value = mock.Mock(
+                file_name="db.sql.gz", size=len(CONTENT), content_sha1=hashlib.sha1(CONTENT).hexdigest(), file_info={}
+            )
+            yield bucket
+
+    def test_upload_uses_part_size(self, config, mock_bucket, tmp_path):
+        config.part_size_mb = 50
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(CONTENT)
+
+        BackblazeStorageAdapter(config).upload(backup, "db.sql.gz", metadata={"engine": "postgres"})
+
+        mock_bucket.upload_local_file.assert_called_once_with(
+            local_file=str(backup),
+            file_name="db.sql.gz",
+            file_infos={"engine": "postgres"},
+            min_part_size=50_000_000,
+            progress_listener=None,
+        )
+
+    def test_download(self, config, mock_bucket, tmp_path):
+        mock_bucket.download_file_by_name.return_value = FakeDownload(CONTENT)
+
+        BackblazeStorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert (tmp_path / "db.sql.gz").read_bytes() == CONTENT
+        mock_bucket.download_file_by_name.assert_called_once_with("db.sql.gz")
+
+    def test_interrupted_download_resumes_with_range(self, config, mock_bucket, tmp_path):
+        mock_bucket.download_file_by_name.side_effect = [
+            FakeDownload(CONTENT, fail_after=300),
+            FakeDownload(CONTENT[300:]),
+        ]
+
+        BackblazeStorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert (tmp_path / "db.sql.gz").read_bytes() == CONTENT
+        assert mock_bucket.download_file_by_name.call_args_list[1] == mock.call(
+            "db.sql.gz", range_=(300, len(CONTENT) - 1)
+        )
+
+    def test_resumed_download_checks_large_file_sha1(self, config, mock_bucket, tmp_path):
+        mock_bucket.get_file_info_by_name.return_value.content_sha1 = "none"
+        mock_bucket.get_file_info_by_name.return_value.file_info = {"large_file_sha1": "0" * 40}
+        mock_bucket.download_file_by_name.side_effect = [
+            FakeDownload(CONTENT, fail_after=300),
+            FakeDownload(CONTENT[300:]),
+        ]
+
+        with pytest.raises(StorageError) as exc_info:
+            BackblazeStorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "SHA1" in str(exc_info.value)
+
+    def test_download_gives_up_after_retries(self, config, mock_bucket, tmp_path):
+        config.download_retries = 1
+        mock_bucket.download_file_by_name.side_effect = B2Error("service unavailable")
+
+        with pytest.raises(StorageError):
+            BackblazeStorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert mock_bucket.download_file_by_name.call_count == 2
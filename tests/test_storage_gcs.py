@@ -0,0 +1,125 @@
+"""Tests for Google Cloud Storage adapter."""
+
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+from google.api_core.exceptions import Forbidden, NotFound
+
+from nestvault.config import GCSConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.gcs import GCSStorageAdapter
+
+
+class TestGCSStorageAdapter:
+    """Tests for GCSStorageAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return GCSConfig(bucket="test-bucket")
+
+    @pytest.fixture
+    def mock_client(self):
+        with mock.patch("google.cloud.storage.Client") as mock_client:
+            yield mock_client
+
+    @pytest.fixture
+    def mock_bucket(self, mock_client):
+        return mock_client.return_value.bucket.return_value
+
+    def test_uses_application_default_credentials(self, config, mock_client):
+        GCSStorageAdapter(config)
+
+        mock_client.assert_called_once_with(project=None, credentials=None)
+        mock_client.return_value.bucket.assert_called_once_with("test-bucket")
+
+    def test_uses_inline_service_account(self, config, mock_client):
+        config.credentials_json = '{"type": "service_account", "project_id": "acme"}'
+
+        with mock.patch("google.oauth2.service_account.Credentials.from_service_account_info") as from_info:
+            GCSStorageAdapter(config)
+
+        from_info.assert_called_once_with({"type": "service_account", "project_id": "acme"})
+        credentials = from_info.return_value
+        mock_client.assert_called_once_with(project=credentials.project_id, credentials=credentials)
+
+    def test_uses_service_account_file_with_explicit_project(self, config, mock_client):
+        config.credentials_file = "/secrets/sa.json"
+        config.project = "backups-prod"
+
+        with mock.patch("google.oauth2.service_account.Credentials.from_service_account_file") as from_file:
+            GCSStorageAdapter(config)
+
+        from_file.assert_called_once_with("/secrets/sa.json")
+        mock_client.assert_called_once_with(project="backups-prod", credentials=from_file.return_value)
+
+    def test_invalid_inline_service_account(self, config, mock_client):
+        config.credentials_json = "not json"
+
+        with pytest.raises(StorageError):
+            GCSStorageAdapter(config)
+
+    def test_upload_is_resumable_with_metadata(self, config, mock_bucket, tmp_path):
+        config.chunk_size_mb = 32
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"test data")
+
+        GCSStorageAdapter(config).upload(backup, "backups/test.sql.gz", metadata={"engine": "postgres"})
+
+        mock_bucket.blob.assert_called_once_with("backups/test.sql.gz", chunk_size=32 * 1024 * 1024)
+        blob = mock_bucket.blob.return_value
+        assert blob.metadata == {"engine": "postgres"}
+        blob.upload_from_filename.assert_called_once_with(str(backup))
+
+    def test_upload_failure(self, config, mock_bucket, tmp_path):
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"test data")
+        mock_bucket.blob.return_value.upload_from_filename.side_effect = Forbidden("storage.objects.create denied")
+
+        with pytest.raises(StorageError):
+            GCSStorageAdapter(config).upload(backup, "backups/test.sql.gz")
+
+    def test_list_objects(self, config, mock_client, mock_bucket):
+        blob = mock.Mock(size=1024, updated=datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc))
+        blob.name = "backups/db_20240115_120000.sql.gz"
+        mock_client.return_value.list_blobs.return_value = iter([blob])
+
+        objects = GCSStorageAdapter(config).list(prefix="backups/")
+
+        mock_client.return_value.list_blobs.assert_called_once_with(mock_bucket, prefix="backups/")
+        assert objects[0].key == "backups/db_20240115_120000.sql.gz"
+        assert objects[0].size == 1024
+        assert objects[0].last_modified.day == 15
+
+    def test_get_metadata(self, config, mock_bucket):
+        mock_bucket.get_blob.return_value.metadata = {"engine": "mongodb"}
+
+        assert GCSStorageAdapter(config).get_metadata("backups/test.archive.gz") == {"engine": "mongodb"}
+
+    def test_get_metadata_missing_object(self, config, mock_bucket):
+        mock_bucket.get_blob.return_value = None
+
+        with pytest.raises(StorageError) as exc_info:
+            GCSStorageAdapter(config).get_metadata("backups/missing.sql.gz")
+
+        assert "not found" in str(exc_info.value)
+
+    def test_delete_missing_object_is_ignored(self, config, mock_bucket):
+        mock_bucket.delete_blob.side_effect = NotFound("No such object")
+
+        GCSStorageAdapter(config).delete("backups/test.sql.gz")
+
+        mock_bucket.delete_blob.assert_called_once_with("backups/test.sql.gz")
+
+    def test_delete_many_objects(self, config, mock_bucket):
+        keys = ["backups/file1.sql.gz", "backups/file2.sql.gz"]
+
+        GCSStorageAdapter(config).delete_many(keys)
+
+        assert mock_bucket.delete_blobs.call_args[0][0] == keys
+
+    def test_download(self, config, mock_bucket, tmp_path):
+        GCSStorageAdapter(config).download("backups/test.sql.gz", tmp_path / "test.sql.gz")
+
+        mock_bucket.blob.assert_called_once_with("backups/test.sql.gz")
+        mock_bucket.blob.return_value.download_to_filename.assert_called_once_with(str(tmp_path / "test.sql.gz"))
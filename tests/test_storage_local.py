@@ -0,0 +1,146 @@
+"""Tests for local filesystem storage adapter."""
+
+import os
+from collections import namedtuple
+from unittest import mock
+
+import pytest
+
+from nestvault.config import LocalConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.local import LocalStorageAdapter
+
+DiskUsage = namedtuple("DiskUsage", "total used free")
+
+
+class TestLocalStorageAdapter:
+    """Tests for LocalStorageAdapter."""
+
+    @pytest.fixture
+    def root(self, tmp_path):
+        root = tmp_path / "nas"
+        root.mkdir()
+        return root
+
+    @pytest.fixture
+    def adapter(self, root):
+        return LocalStorageAdapter(LocalConfig(root=str(root)))
+
+    @pytest.fixture
+    def backup(self, tmp_path):
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(b"test data")
+        return backup
+
+    def test_upload_writes_file_and_metadata(self, adapter, root, backup):
+        adapter.upload(backup, "prod/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+
+        assert (root / "prod/db_20240115_120000.sql.gz").read_bytes() == b"test data"
+        assert sorted(p.name for p in (root / "prod").iterdir()) == [
+            "db_20240115_120000.sql.gz",
+            "db_20240115_120000.sql.gz.meta.json",
+        ]
+        assert adapter.get_metadata("prod/db_20240115_120000.sql.gz") == {"engine": "postgres"}
+
+    def test_upload_with_fsync(self, root, backup):
+        adapter = LocalStorageAdapter(LocalConfig(root=str(root), fsync=True))
+
+        with mock.patch("os.fsync") as mock_fsync:
+            adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        # The file, then the directory holding the renamed file
+        assert mock_fsync.call_count == 2
+
+    def test_failed_copy_leaves_no_backup(self, adapter, root, backup):
+        with mock.patch("shutil.copyfileobj", side_effect=OSError("No space left on device")):
+            with pytest.raises(StorageError):
+                adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        assert list(root.iterdir()) == []
+
+    def test_upload_refuses_when_disk_is_full(self, adapter, root, backup):
+        with mock.patch("shutil.disk_usage", return_value=DiskUsage(100, 96, 4)):
+            with pytest.raises(StorageError) as exc_info:
+                adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        assert "9 bytes, 4 bytes free" in str(exc_info.value)
+        assert list(root.iterdir()) == []
+
+    def test_check_free_space_uses_last_backup(self, adapter, root):
+        (root / "db_20240114_120000.sql.gz").write_bytes(b"x" * 10)
+        latest = root / "db_20240115_120000.sql.gz"
+        latest.write_bytes(b"x" * 50)
+        os.utime(root / "db_20240114_120000.sql.gz", (1, 1))
+
+        with mock.patch("shutil.disk_usage", return_value=DiskUsage(100, 70, 30)):
+            with pytest.raises(StorageError) as exc_info:
+                adapter.check_free_space("db")
+            assert "was 50 bytes, 30 bytes free" in str(exc_info.value)
+
+            adapter.check_free_space("other")
+
+    def test_list_skips_sidecars_and_partial_copies(self, adapter, root, backup):
+        adapter.upload(backup, "prod/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+        (root / "prod/.db_20240116_120000.sql.gz.partial").write_bytes(b"half")
+
+        objects = adapter.list(prefix="prod/db")
+
+        assert [obj.key for obj in objects] == ["prod/db_20240115_120000.sql.gz"]
+        assert objects[0].size == len(b"test data")
+
+    def test_create_exclusive_refuses_taken_key(self, adapter, root, backup, tmp_path):
+        other = tmp_path / "other"
+        other.write_bytes(b"other data")
+
+        assert adapter.create_exclusive(backup, "locks/billing.json") is True
+        assert adapter.create_exclusive(other, "locks/billing.json") is False
+
+        assert (root / "locks/billing.json").read_bytes() == b"test data"
+        assert [p.name for p in (root / "locks").iterdir()] == ["billing.json"]
+
+    def test_replace_if_unchanged_refuses_a_changed_file(self, adapter, root, backup, tmp_path):
+        other = tmp_path / "other"
+        other.write_bytes(b"other data")
+        adapter.create_exclusive(backup, "locks/billing.json")
+
+        content, version = adapter.read_versioned("locks/billing.json")
+        assert content == b"test data"
+        assert adapter.replace_if_unchanged(other, "locks/billing.json", version) is True
+        assert adapter.replace_if_unchanged(backup, "locks/billing.json", version) is False
+
+        assert (root / "locks/billing.json").read_bytes() == b"other data"
+        assert adapter.list(prefix="locks/") == [mock.ANY]
+        assert adapter.read_versioned("locks/orders.json") is None
+
+    def test_list_missing_directory(self, adapter):
+        assert adapter.list(prefix="missing/db") == []
+
+    def test_delete_removes_empty_directories(self, adapter, root, backup):
+        adapter.upload(backup, "prod/2024/01/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+        adapter.upload(backup, "prod/db_20240116_120000.sql.gz")
+
+        adapter.delete_many(["prod/2024/01/db_20240115_120000.sql.gz"])
+
+        assert [p.name for p in root.iterdir()] == ["prod"]
+        assert [p.name for p in (root / "prod").iterdir()] == ["db_20240116_120000.sql.gz"]
+
+    def test_key_outside_root_is_refused(self, adapter, tmp_path):
+        with pytest.raises(StorageError):
+            adapter.download("../secrets.txt", tmp_path / "out")
+
+    def test_download(self, adapter, backup, tmp_path):
+        adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        adapter.download("db_20240115_120000.sql.gz", tmp_path / "restored.sql.gz")
+
+        assert (tmp_path / "restored.sql.gz").read_bytes() == b"test data"
+
+    def test_read_range(self, adapter, backup):
+        adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        assert adapter.read_range("db_20240115_120000.sql.gz", 5, 4) == b"data"
+
+    def test_check_connectivity_leaves_nothing_behind(self, adapter, root):
+        adapter.check_connectivity(".nestvault-check")
+
+        assert list(root.iterdir()) == []
@@ -0,0 +1,92 @@
+"""Tests for prefixed storage adapter."""
+
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+from unittest import mock
+
+from nestvault.storage.base import InterruptedUpload, StorageObject
+from nestvault.storage.prefixed import PrefixedStorageAdapter
+
+
+class TestPrefixedStorageAdapter:
+    """Tests for PrefixedStorageAdapter."""
+
+    def test_upload_adds_prefix(self):
+        inner = mock.Mock()
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        storage.upload(Path("/tmp/db.sql.gz"), "db.sql.gz", metadata={"engine": "postgres"})
+
+        inner.upload.assert_called_once_with(
+            Path("/tmp/db.sql.gz"), "billing/db.sql.gz", metadata={"engine": "postgres"}
+        )
+
+    def test_list_strips_prefix(self):
+        inner = mock.Mock()
+        inner.list.return_value = [
+            StorageObject(
+                key="billing/db_20240101_120000.sql.gz",
+                size=100,
+                last_modified=datetime(2024, 1, 1, tzinfo=timezone.utc),
+            )
+        ]
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        objects = storage.list(prefix="db")
+
+        inner.list.assert_called_once_with(prefix="billing/db")
+        assert objects[0].key == "db_20240101_120000.sql.gz"
+        assert objects[0].size == 100
+
+    def test_delete_many_adds_prefix(self):
+        inner = mock.Mock()
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        storage.delete_many(["a.sql.gz", "b.sql.gz"])
+
+        inner.delete_many.assert_called_once_with(["billing/a.sql.gz", "billing/b.sql.gz"])
+
+    def test_external_location_adds_prefix(self):
+        inner = mock.Mock()
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        storage.external_location("cockroachdb/bank")
+
+        inner.external_location.assert_called_once_with("billing/cockroachdb/bank")
+
+    def test_check_free_space_adds_prefix(self):
+        inner = mock.Mock()
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        storage.check_free_space("db")
+
+        inner.check_free_space.assert_called_once_with("billing/db")
+
+    def test_check_connectivity_adds_prefix(self):
+        inner = mock.Mock()
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        storage.check_connectivity(".nestvault-check")
+
+        inner.check_connectivity.assert_called_once_with("billing/.nestvault-check")
+
+    def test_interrupted_uploads_strip_prefix(self):
+        started = datetime(2024, 1, 15, tzinfo=timezone.utc)
+        inner = mock.Mock()
+        inner.interrupted_uploads.return_value = [InterruptedUpload("billing/db.sql.gz", None, started)]
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        [upload] = storage.interrupted_uploads("db")
+        storage.abort_upload(upload)
+
+        inner.interrupted_uploads.assert_called_once_with("billing/db")
+        assert upload.key == "db.sql.gz"
+        assert inner.abort_upload.call_args.args[0].key == "billing/db.sql.gz"
+
+    def test_abort_stale_uploads_strips_prefix(self):
+        inner = mock.Mock()
+        inner.abort_stale_uploads.return_value = ["billing/db.sql.gz"]
+        storage = PrefixedStorageAdapter(inner, "billing/")
+
+        assert storage.abort_stale_uploads("", timedelta(hours=24)) == ["db.sql.gz"]
+        inner.abort_stale_uploads.assert_called_once_with("billing/", timedelta(hours=24))
@@ -1,7 +1,7 @@
 """Tests for S3 storage adapter."""
 
 import tempfile
-from datetime import datetime, timezone
+from datetime import datetime, timedelta, timezone
 from pathlib import Path
 from unittest import mock
 
@@ -9,19 +9,21 @@ import pytest
 
 from nestvault.config import S3Config
 from nestvault.exceptions import StorageError
-from nestvault.storage.s3 import S3StorageAdapter
+from nestvault.storage.base import TransferProgress
+from nestvault.storage.s3 import S3StorageAdapter, TLSOptions, build_tls_options
 
 
 class TestS3StorageAdapter:
     """Tests for S3StorageAdapter."""
 
     @pytest.fixture
-    def config(self):
+    def config(self, tmp_path):
         return S3Config(
             access_key="test_access_key",
             secret_key="test_secret_key",
             bucket="test-bucket",
             region="us-east-1",
+            upload_state_dir=str(tmp_path / "uploads"),
         )
 
     @pytest.fixture
@@ -62,6 +64,30 @@ class TestS3StorageAdapter:
         finally:
             temp_path.unlink()
 
+    def test_upload_with_metadata(self, config, mock_boto_client):
+        adapter = S3StorageAdapter(config)
+
+        with tempfile.NamedTemporaryFile(delete=False) as f:
+            f.write(b"test data")
+            temp_path = Path(f.name)
+
+        try:
+            adapter.upload(temp_path, "backups/test.sql.gz", metadata={"engine": "postgres"})
+            call_kwargs = mock_boto_client.upload_file.call_args[1]
+            assert call_kwargs["ExtraArgs"] == {"Metadata": {"engine": "postgres"}, "ContentType": "application/gzip"}
+        finally:
+            temp_path.unlink()
+
+    def test_get_metadata(self, config, mock_boto_client):
+        mock_boto_client.head_object.return_value = {"Metadata": {"engine": "mongodb"}}
+
+        adapter = S3StorageAdapter(config)
+
+        assert adapter.get_metadata("backups/test.archive.gz") == {"engine": "mongodb"}
+        mock_boto_client.head_object.assert_called_once_with(
+            Bucket="test-bucket", Key="backups/test.archive.gz"
+        )
+
     def test_list_objects(self, config, mock_boto_client):
         mock_paginator = mock.Mock()
         mock_boto_client.get_paginator.return_value = mock_paginator
@@ -128,3 +154,613 @@ class TestS3StorageAdapter:
 
             call_kwargs = mock_client.call_args[1]
             assert call_kwargs["endpoint_url"] == "https://custom.endpoint.com"
+
+    def test_external_location_includes_credentials(self, config, mock_boto_client):
+        config.endpoint = "https://account.r2.cloudflarestorage.com"
+        adapter = S3StorageAdapter(config)
+
+        location = adapter.external_location("cockroachdb/bank")
+
+        assert location.bucket == "test-bucket"
+        assert location.uri == (
+            "s3://test-bucket/cockroachdb/bank?AWS_ACCESS_KEY_ID=test_access_key"
+            "&AWS_SECRET_ACCESS_KEY=test_secret_key&AWS_REGION=us-east-1"
+            "&AWS_ENDPOINT=https%3A%2F%2Faccount.r2.cloudflarestorage.com"
+        )
+
+    def test_client_uses_credential_chain_without_keys(self, config):
+        config.access_key = config.secret_key = None
+
+        with mock.patch("boto3.Session") as session, mock.patch("boto3.client") as client:
+            session.return_value.get_credentials.return_value.method = "assume-role-with-web-identity"
+            adapter = S3StorageAdapter(config)
+
+            call_kwargs = session.return_value.client.call_args[1]
+            assert "aws_access_key_id" not in call_kwargs
+            assert call_kwargs["region_name"] == "us-east-1"
+            client.assert_not_called()
+            assert adapter.credential_source() == "web identity token file (AWS_WEB_IDENTITY_TOKEN_FILE)"
+
+    def test_credential_source_of_configured_keys(self, config, mock_boto_client):
+        assert S3StorageAdapter(config).credential_source() == "S3_ACCESS_KEY and S3_SECRET_KEY"
+
+    def test_credential_source_without_credentials(self, config):
+        config.access_key = config.secret_key = None
+
+        with mock.patch("boto3.Session") as session:
+            session.return_value.get_credentials.return_value = None
+            adapter = S3StorageAdapter(config)
+
+            with pytest.raises(StorageError, match="No S3 credentials found"):
+                adapter.credential_source()
+
+    def test_external_location_passes_current_role_credentials(self, config):
+        config.access_key = config.secret_key = None
+
+        with mock.patch("boto3.Session") as session:
+            frozen = session.return_value.get_credentials.return_value.get_frozen_credentials.return_value
+            frozen.access_key, frozen.secret_key, frozen.token = "ASIAROLE", "role_secret", "role_token"
+            location = S3StorageAdapter(config).external_location("es")
+
+        assert (location.access_key, location.secret_key, location.session_token) == (
+            "ASIAROLE",
+            "role_secret",
+            "role_token",
+        )
+
+    def test_client_uses_session_token_and_virtual_addressing(self, config):
+        config.session_token = "session"
+        config.addressing_style = "virtual"
+
+        with mock.patch("boto3.client") as mock_client:
+            S3StorageAdapter(config)
+
+            call_kwargs = mock_client.call_args[1]
+            assert call_kwargs["aws_session_token"] == "session"
+            assert call_kwargs["region_name"] == "us-east-1"
+            assert "endpoint_url" not in call_kwargs
+            assert call_kwargs["config"].s3 == {"addressing_style": "virtual"}
+
+    def test_upload_with_storage_class_and_bucket_owner(self, config, mock_boto_client, tmp_path):
+        config.storage_class = "GLACIER_IR"
+        config.expected_bucket_owner = "123456789012"
+        adapter = S3StorageAdapter(config)
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"test data")
+
+        adapter.upload(backup, "backups/test.sql.gz", metadata={"engine": "postgres"})
+
+        assert mock_boto_client.upload_file.call_args[1]["ExtraArgs"] == {
+            "Metadata": {"engine": "postgres"},
+            "ContentType": "application/gzip",
+            "StorageClass": "GLACIER_IR",
+            "ExpectedBucketOwner": "123456789012",
+        }
+
+    def test_expected_bucket_owner_sent_with_requests(self, config, mock_boto_client, tmp_path):
+        config.expected_bucket_owner = "123456789012"
+        adapter = S3StorageAdapter(config)
+
+        adapter.get_metadata("backups/test.sql.gz")
+        adapter.delete("backups/test.sql.gz")
+        adapter.download("backups/test.sql.gz", tmp_path / "test.sql.gz")
+
+        mock_boto_client.head_object.assert_called_once_with(
+            Bucket="test-bucket", ExpectedBucketOwner="123456789012", Key="backups/test.sql.gz"
+        )
+        mock_boto_client.delete_object.assert_called_once_with(
+            Bucket="test-bucket", ExpectedBucketOwner="123456789012", Key="backups/test.sql.gz"
+        )
+        assert mock_boto_client.download_file.call_args[1]["ExtraArgs"] == {"ExpectedBucketOwner": "123456789012"}
+
+    def test_external_location_includes_session_token(self, config, mock_boto_client):
+        config.session_token = "session"
+        adapter = S3StorageAdapter(config)
+
+        assert "AWS_SESSION_TOKEN=session" in adapter.external_location("es").uri
+
+    def test_client_disables_checksum_trailers(self, config):
+        config.endpoint = "http://minio:9000"
+        config.addressing_style = "path"
+        config.checksum_trailers = False
+
+        with mock.patch("boto3.client") as mock_client:
+            S3StorageAdapter(config)
+
+            client_config = mock_client.call_args[1]["config"]
+            assert client_config.s3 == {"addressing_style": "path"}
+            assert client_config.request_checksum_calculation == "when_required"
+            assert client_config.response_checksum_validation == "when_required"
+
+    def test_check_connectivity_round_trip(self, config, mock_boto_client):
+        mock_boto_client.download_file.side_effect = lambda bucket, key, path, **kwargs: Path(path).write_bytes(
+            b"nestvault connectivity check\n"
+        )
+
+        S3StorageAdapter(config).check_connectivity(".nestvault-check")
+
+        mock_boto_client.head_bucket.assert_called_once_with(Bucket="test-bucket")
+        assert mock_boto_client.upload_file.call_args[0][1:] == ("test-bucket", ".nestvault-check")
+        mock_boto_client.delete_object.assert_called_once_with(Bucket="test-bucket", Key=".nestvault-check")
+
+    def test_read_range(self, config, mock_boto_client):
+        mock_boto_client.get_object.return_value = {"Body": mock.Mock(read=mock.Mock(return_value=b"data"))}
+
+        assert S3StorageAdapter(config).read_range("db.sql.gz", 100, 4) == b"data"
+
+        mock_boto_client.get_object.assert_called_once_with(Bucket="test-bucket", Key="db.sql.gz", Range="bytes=100-103")
+
+    def test_create_exclusive_is_a_conditional_put(self, config, mock_boto_client, tmp_path):
+        from botocore.exceptions import ClientError
+
+        lock = tmp_path / "lock.json"
+        lock.write_text("{}")
+        adapter = S3StorageAdapter(config)
+
+        assert adapter.create_exclusive(lock, "locks/billing.json") is True
+        mock_boto_client.put_object.assert_called_once_with(
+            Bucket="test-bucket", Key="locks/billing.json", Body=b"{}", IfNoneMatch="*"
+        )
+
+        mock_boto_client.put_object.side_effect = ClientError(
+            {"Error": {"Code": "PreconditionFailed", "Message": "At least one of the pre-conditions failed"}},
+            "PutObject",
+        )
+        assert adapter.create_exclusive(lock, "locks/billing.json") is False
+
+    def test_replace_if_unchanged_is_conditional_on_the_etag(self, config, mock_boto_client, tmp_path):
+        from botocore.exceptions import ClientError
+
+        lock = tmp_path / "lock.json"
+        lock.write_text("{}")
+        body = mock.Mock(read=mock.Mock(return_value=b"old"))
+        mock_boto_client.get_object.return_value = {"Body": body, "ETag": '"abc"'}
+        adapter = S3StorageAdapter(config)
+
+        assert adapter.read_versioned("locks/billing.json") == (b"old", '"abc"')
+        assert adapter.replace_if_unchanged(lock, "locks/billing.json", '"abc"') is True
+        mock_boto_client.put_object.assert_called_once_with(
+            Bucket="test-bucket", Key="locks/billing.json", Body=b"{}", IfMatch='"abc"'
+        )
+
+        mock_boto_client.put_object.side_effect = ClientError(
+            {"Error": {"Code": "PreconditionFailed", "Message": "At least one of the pre-conditions failed"}},
+            "PutObject",
+        )
+        assert adapter.replace_if_unchanged(lock, "locks/billing.json", '"abc"') is False
+
+        mock_boto_client.get_object.side_effect = ClientError(
+            {"Error": {"Code": "NoSuchKey", "Message": "The specified key does not exist."}}, "GetObject"
+        )
+        assert adapter.read_versioned("locks/billing.json") is None
+
+    def test_set_legal_hold(self, config, mock_boto_client):
+        adapter = S3StorageAdapter(config)
+
+        adapter.set_legal_hold("db.sql.gz", True)
+        adapter.set_legal_hold("db.sql.gz", False)
+
+        assert mock_boto_client.put_object_legal_hold.call_args_list == [
+            mock.call(Bucket="test-bucket", Key="db.sql.gz", LegalHold={"Status": "ON"}),
+            mock.call(Bucket="test-bucket", Key="db.sql.gz", LegalHold={"Status": "OFF"}),
+        ]
+
+    def test_check_connectivity_missing_bucket(self, config, mock_boto_client):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.head_bucket.side_effect = ClientError(
+            {"Error": {"Code": "404", "Message": "Not Found"}}, "HeadBucket"
+        )
+
+        with pytest.raises(StorageError) as exc_info:
+            S3StorageAdapter(config).check_connectivity(".nestvault-check")
+
+        assert "test-bucket" in str(exc_info.value)
+        mock_boto_client.upload_file.assert_not_called()
+
+    def test_upload_stream_in_parts(self, config, mock_boto_client):
+        import hashlib
+        import io
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = lambda **kwargs: {"ETag": f"etag-{kwargs['PartNumber']}"}
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+
+        uploaded = adapter.upload_stream(io.BytesIO(b"0123456789"), "db.sql.gz", metadata={"engine": "postgres"})
+
+        assert uploaded.size == 10
+        assert uploaded.sha256 == hashlib.sha256(b"0123456789").hexdigest()
+        assert [c.kwargs["Body"] for c in mock_boto_client.upload_part.call_args_list] == [b"0123", b"4567", b"89"]
+        assert mock_boto_client.complete_multipart_upload.call_args.kwargs["MultipartUpload"] == {
+            "Parts": [{"PartNumber": n, "ETag": f"etag-{n}"} for n in (1, 2, 3)]
+        }
+        extra_args = mock_boto_client.copy.call_args.kwargs["ExtraArgs"]
+        assert extra_args["MetadataDirective"] == "REPLACE"
+        assert extra_args["Metadata"] == {"engine": "postgres", "size": "10", "sha256": uploaded.sha256}
+
+    def test_upload_parts_paced_by_shared_throttle(self, config, mock_boto_client):
+        import io
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = lambda **kwargs: {"ETag": f"etag-{kwargs['PartNumber']}"}
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+        throttle = mock.Mock()
+        adapter.limit_bandwidth(throttle, None)
+
+        adapter.upload_stream(io.BytesIO(b"0123456789"), "db.sql.gz")
+
+        assert sorted(c.args[0] for c in throttle.call_args_list) == [2, 4, 4]
+
+    def test_upload_stream_aborts_on_failure(self, config, mock_boto_client):
+        from nestvault.exceptions import BackupError
+        from nestvault.streaming import IteratorReader
+
+        def chunks():
+            yield b"0123"
+            raise BackupError("pg_dump failed")
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.return_value = {"ETag": "etag"}
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+
+        with pytest.raises(BackupError):
+            adapter.upload_stream(IteratorReader(chunks()), "db.sql.gz")
+
+        mock_boto_client.abort_multipart_upload.assert_called_once_with(
+            Bucket="test-bucket", Key="db.sql.gz", UploadId="upload-1"
+        )
+        mock_boto_client.complete_multipart_upload.assert_not_called()
+        mock_boto_client.copy.assert_not_called()
+
+    def test_upload_stream_aborts_when_a_part_fails(self, config, mock_boto_client):
+        import io
+
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = ClientError(
+            {"Error": {"Code": "SlowDown", "Message": "Slow Down"}}, "UploadPart"
+        )
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+
+        with pytest.raises(StorageError):
+            adapter.upload_stream(io.BytesIO(b"0123456789" * 10), "db.sql.gz")
+
+        mock_boto_client.abort_multipart_upload.assert_called_once()
+        mock_boto_client.complete_multipart_upload.assert_not_called()
+
+    def test_upload_stream_rejects_object_larger_than_max_parts(self, config, mock_boto_client):
+        import io
+
+        config.part_size_mb = 5
+        adapter = S3StorageAdapter(config)
+
+        with pytest.raises(StorageError) as exc_info:
+            adapter.upload_stream(io.BytesIO(b""), "db.sql.gz", expected_size=60 * 1024**3)
+
+        assert "S3_PART_SIZE_MB" in str(exc_info.value)
+        mock_boto_client.create_multipart_upload.assert_not_called()
+
+    def test_upload_stream_overlaps_part_uploads(self, config, mock_boto_client):
+        """Benchmark-style: parts that each wait on the network upload in parallel, never more than the limit."""
+        import io
+        import threading
+        import time
+
+        in_flight = []
+        peak = []
+        lock = threading.Lock()
+
+        def slow_upload_part(**kwargs):
+            with lock:
+                in_flight.append(kwargs["PartNumber"])
+                peak.append(len(in_flight))
+            time.sleep(0.1)
+            with lock:
+                in_flight.remove(kwargs["PartNumber"])
+            return {"ETag": f"etag-{kwargs['PartNumber']}"}
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = slow_upload_part
+        config.upload_concurrency = 4
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+
+        progress = []
+
+        class RecordedProgress(TransferProgress):
+            def __init__(self, *args, **kwargs):
+                super().__init__(*args, **kwargs)
+                progress.append(self)
+
+        started = time.monotonic()
+        with mock.patch("nestvault.storage.s3.TransferProgress", RecordedProgress):
+            uploaded = adapter.upload_stream(io.BytesIO(b"x" * 32), "db.sql.gz")
+        elapsed = time.monotonic() - started
+
+        # 8 parts of 0.1s each take 0.8s one after another, 0.2s with 4 workers
+        assert elapsed < 0.5
+        assert max(peak) == 4
+        assert uploaded.size == 32
+        assert progress[0].transferred == 32
+        parts = mock_boto_client.complete_multipart_upload.call_args.kwargs["MultipartUpload"]["Parts"]
+        assert [part["PartNumber"] for part in parts] == list(range(1, 9))
+        assert [part["ETag"] for part in parts] == [f"etag-{n}" for n in range(1, 9)]
+
+    def test_upload_file_uses_part_size_and_concurrency(self, config, mock_boto_client, tmp_path):
+        config.part_size_mb = 16
+        config.upload_concurrency = 8
+        backup = tmp_path / "test.sql.gz"
+        backup.write_bytes(b"test data")
+
+        S3StorageAdapter(config).upload(backup, "test.sql.gz")
+
+        transfer = mock_boto_client.upload_file.call_args.kwargs["Config"]
+        assert transfer.multipart_chunksize == 16 * 1024 * 1024
+        assert transfer.max_concurrency == 8
+
+    @pytest.fixture
+    def large_backup(self, config, tmp_path):
+        config.part_size_mb = 5
+        config.upload_concurrency = 1
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(b"a" * 5 * 1024 * 1024 + b"b" * 1024)
+        return backup
+
+    def test_upload_large_file_resumes_from_last_part(self, config, mock_boto_client, large_backup):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = [
+            {"ETag": "etag-1"},
+            ClientError({"Error": {"Code": "RequestTimeout", "Message": "Timeout"}}, "UploadPart"),
+        ]
+        adapter = S3StorageAdapter(config)
+
+        with pytest.raises(StorageError):
+            adapter.upload(large_backup, "db.sql.gz", {"engine": "postgres"})
+
+        mock_boto_client.abort_multipart_upload.assert_not_called()
+        [interrupted] = adapter.interrupted_uploads("db")
+        assert interrupted.key == "db.sql.gz"
+        assert interrupted.local_path == large_backup
+        assert interrupted.metadata == {"engine": "postgres"}
+
+        # A new process picks the upload up from the state file
+        mock_boto_client.upload_part.side_effect = None
+        mock_boto_client.upload_part.return_value = {"ETag": "etag-2"}
+        mock_boto_client.get_paginator.return_value.paginate.return_value = [
+            {"Parts": [{"PartNumber": 1, "ETag": "etag-1", "Size": 5 * 1024 * 1024}]}
+        ]
+        S3StorageAdapter(config).upload(large_backup, "db.sql.gz", {"engine": "postgres"})
+
+        mock_boto_client.create_multipart_upload.assert_called_once()
+        last_part = mock_boto_client.upload_part.call_args.kwargs
+        assert last_part["PartNumber"] == 2
+        assert last_part["Body"] == b"b" * 1024
+        assert mock_boto_client.complete_multipart_upload.call_args.kwargs["MultipartUpload"] == {
+            "Parts": [{"PartNumber": 1, "ETag": "etag-1"}, {"PartNumber": 2, "ETag": "etag-2"}]
+        }
+        assert adapter.interrupted_uploads("") == []
+
+    def test_upload_changed_file_starts_over(self, config, mock_boto_client, large_backup):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.create_multipart_upload.side_effect = [{"UploadId": "upload-1"}, {"UploadId": "upload-2"}]
+        mock_boto_client.upload_part.side_effect = ClientError(
+            {"Error": {"Code": "RequestTimeout", "Message": "Timeout"}}, "UploadPart"
+        )
+        adapter = S3StorageAdapter(config)
+        with pytest.raises(StorageError):
+            adapter.upload(large_backup, "db.sql.gz")
+
+        large_backup.write_bytes(b"c" * 6 * 1024 * 1024)
+        mock_boto_client.upload_part.side_effect = lambda **kwargs: {"ETag": f"etag-{kwargs['PartNumber']}"}
+        adapter.upload(large_backup, "db.sql.gz")
+
+        mock_boto_client.abort_multipart_upload.assert_called_once_with(
+            Bucket="test-bucket", Key="db.sql.gz", UploadId="upload-1"
+        )
+        assert mock_boto_client.complete_multipart_upload.call_args.kwargs["UploadId"] == "upload-2"
+
+    def test_upload_starts_over_when_recorded_upload_is_gone(self, config, mock_boto_client, large_backup):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.create_multipart_upload.side_effect = [{"UploadId": "upload-1"}, {"UploadId": "upload-2"}]
+        mock_boto_client.upload_part.side_effect = ClientError(
+            {"Error": {"Code": "RequestTimeout", "Message": "Timeout"}}, "UploadPart"
+        )
+        adapter = S3StorageAdapter(config)
+        with pytest.raises(StorageError):
+            adapter.upload(large_backup, "db.sql.gz")
+
+        mock_boto_client.get_paginator.return_value.paginate.side_effect = ClientError(
+            {"Error": {"Code": "NoSuchUpload", "Message": "Gone"}}, "ListParts"
+        )
+        mock_boto_client.upload_part.side_effect = lambda **kwargs: {"ETag": f"etag-{kwargs['PartNumber']}"}
+        adapter.upload(large_backup, "db.sql.gz")
+
+        assert mock_boto_client.upload_part.call_count == 3
+        assert mock_boto_client.complete_multipart_upload.call_args.kwargs["UploadId"] == "upload-2"
+
+    def test_stream_is_recorded_without_local_file(self, config, mock_boto_client):
+        import io
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        adapter = S3StorageAdapter(config)
+        adapter.part_size = 4
+        recorded = []
+        listed = []
+
+        def upload_part(**kwargs):
+            recorded.append(adapter.upload_state.load(adapter.bucket, "db.sql.gz"))
+            listed.extend(adapter.interrupted_uploads(""))
+            return {"ETag": "etag"}
+
+        mock_boto_client.upload_part.side_effect = upload_part
+        adapter.upload_stream(io.BytesIO(b"0123"), "db.sql.gz")
+
+        assert recorded[0].local_path is None
+        # Only uploads nothing is sending any more count as interrupted
+        assert listed == []
+        assert adapter.interrupted_uploads("") == []
+
+    def test_abort_upload_forgets_it(self, config, mock_boto_client, large_backup):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+        mock_boto_client.upload_part.side_effect = ClientError(
+            {"Error": {"Code": "RequestTimeout", "Message": "Timeout"}}, "UploadPart"
+        )
+        adapter = S3StorageAdapter(config)
+        with pytest.raises(StorageError):
+            adapter.upload(large_backup, "db.sql.gz")
+
+        [interrupted] = adapter.interrupted_uploads("")
+        adapter.abort_upload(interrupted)
+
+        mock_boto_client.abort_multipart_upload.assert_called_once_with(
+            Bucket="test-bucket", Key="db.sql.gz", UploadId="upload-1"
+        )
+        assert adapter.interrupted_uploads("") == []
+
+    def test_abort_stale_uploads(self, config, mock_boto_client):
+        now = datetime.now(timezone.utc)
+        mock_boto_client.get_paginator.return_value.paginate.return_value = [
+            {
+                "Uploads": [
+                    {"Key": "db_old.sql.gz", "UploadId": "old", "Initiated": now - timedelta(days=3)},
+                    {"Key": "db_new.sql.gz", "UploadId": "new", "Initiated": now - timedelta(minutes=5)},
+                ]
+            }
+        ]
+        adapter = S3StorageAdapter(config)
+
+        aborted = adapter.abort_stale_uploads("db", timedelta(hours=24))
+
+        assert aborted == ["db_old.sql.gz"]
+        mock_boto_client.get_paginator.assert_called_with("list_multipart_uploads")
+        mock_boto_client.get_paginator.return_value.paginate.assert_called_once_with(
+            Bucket="test-bucket", Prefix="db"
+        )
+        mock_boto_client.abort_multipart_upload.assert_called_once_with(
+            Bucket="test-bucket", Key="db_old.sql.gz", UploadId="old"
+        )
+
+    def test_list_flags_archived_objects(self, config, mock_boto_client):
+        modified = datetime(2024, 1, 15, 12, 0, 0, tzinfo=timezone.utc)
+        mock_boto_client.get_paginator.return_value.paginate.return_value = [
+            {
+                "Contents": [
+                    {"Key": "db_20240115_120000.sql.gz", "Size": 1, "LastModified": modified, "StorageClass": "STANDARD"},
+                    {"Key": "db_20240101_120000.sql.gz", "Size": 1, "LastModified": modified, "StorageClass": "GLACIER_IR"},
+                    {"Key": "db_20230101_120000.sql.gz", "Size": 1, "LastModified": modified, "StorageClass": "DEEP_ARCHIVE"},
+                ]
+            }
+        ]
+
+        objects = S3StorageAdapter(config).list()
+
+        assert [obj.archived for obj in objects] == [False, False, True]
+
+    @pytest.fixture
+    def archived(self, mock_boto_client):
+        from botocore.exceptions import ClientError
+
+        mock_boto_client.download_file.side_effect = ClientError(
+            {"Error": {"Code": "InvalidObjectState", "Message": "The operation is not valid"}}, "GetObject"
+        )
+        mock_boto_client.head_object.return_value = {"StorageClass": "GLACIER", "Metadata": {}}
+        return mock_boto_client
+
+    def test_download_archived_object_explains_restore(self, config, archived, tmp_path):
+        with pytest.raises(StorageError) as exc_info:
+            S3StorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "S3_RESTORE_TIER" in str(exc_info.value)
+        assert "Standard: 3-5 hours" in str(exc_info.value)
+        archived.restore_object.assert_not_called()
+
+    def test_download_archived_object_requests_restore(self, config, archived, tmp_path):
+        config.restore_tier = "Bulk"
+        config.restore_days = 3
+
+        with pytest.raises(StorageError) as exc_info:
+            S3StorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "Bulk restore was requested" in str(exc_info.value)
+        assert "5-12 hours" in str(exc_info.value)
+        archived.restore_object.assert_called_once_with(
+            Bucket="test-bucket",
+            Key="db.sql.gz",
+            RestoreRequest={"Days": 3, "GlacierJobParameters": {"Tier": "Bulk"}},
+        )
+
+    def test_deep_archive_restore_falls_back_to_standard(self, config, archived, tmp_path):
+        config.restore_tier = "Expedited"
+        archived.head_object.return_value = {"StorageClass": "DEEP_ARCHIVE"}
+
+        with pytest.raises(StorageError) as exc_info:
+            S3StorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "up to 12 hours" in str(exc_info.value)
+        assert archived.restore_object.call_args[1]["RestoreRequest"]["GlacierJobParameters"] == {"Tier": "Standard"}
+
+    def test_restore_in_progress_is_not_requested_again(self, config, archived, tmp_path):
+        config.restore_tier = "Standard"
+        archived.head_object.return_value = {"StorageClass": "GLACIER", "Restore": 'ongoing-request="true"'}
+
+        with pytest.raises(StorageError) as exc_info:
+            S3StorageAdapter(config).download("db.sql.gz", tmp_path / "db.sql.gz")
+
+        assert "already in progress" in str(exc_info.value)
+        archived.restore_object.assert_not_called()
+
+
+class TestBuildTLSOptions:
+    """Tests for build_tls_options."""
+
+    @pytest.fixture
+    def config(self):
+        return S3Config(access_key="key", secret_key="secret", bucket="backups", region="us-east-1")
+
+    def test_defaults(self, config):
+        assert build_tls_options(config) == TLSOptions()
+
+    def test_custom_ca_with_client_cert(self, config):
+        config.ca_cert_file = "/certs/ca.pem"
+        config.client_cert_file = "/certs/client.pem"
+        config.client_key_file = "/certs/client.key"
+
+        assert build_tls_options(config) == TLSOptions(
+            verify="/certs/ca.pem", client_cert=("/certs/client.pem", "/certs/client.key")
+        )
+
+    def test_combined_client_cert_file(self, config):
+        config.client_cert_file = "/certs/client-with-key.pem"
+
+        assert build_tls_options(config) == TLSOptions(client_cert="/certs/client-with-key.pem")
+
+    def test_skip_verify_warns(self, config):
+        config.insecure_skip_verify = True
+
+        with mock.patch("nestvault.storage.s3.logger") as mock_logger:
+            options = build_tls_options(config)
+
+        assert options == TLSOptions(verify=False)
+        assert "DISABLED" in mock_logger.warning.call_args[0][0]
+
+    def test_client_uses_tls_options(self, config):
+        config.ca_cert_file = "/certs/ca.pem"
+        config.client_cert_file = "/certs/client.pem"
+
+        with mock.patch("boto3.client") as mock_client:
+            S3StorageAdapter(config)
+
+        call_kwargs = mock_client.call_args[1]
+        assert call_kwargs["verify"] == "/certs/ca.pem"
+        assert call_kwargs["config"].client_cert == "/certs/client.pem"
@@ -0,0 +1,187 @@
+"""Tests for SFTP storage adapter."""
+
+import os
+import shutil
+from pathlib import Path
+from unittest import mock
+
+import paramiko
+import pytest
+
+from nestvault.config import SFTPConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.sftp import PinnedHostKeyPolicy, SFTPStorageAdapter, fingerprint
+
+
+class FakeSFTP:
+    """SFTPClient stand-in operating on a local directory."""
+
+    def __init__(self, root: Path, fail_put=False):
+        self.root = root
+        self.fail_put = fail_put
+        self.puts = []
+
+    def _local(self, path):
+        return self.root / path.lstrip("/")
+
+    def stat(self, path):
+        return os.stat(self._local(path))
+
+    def mkdir(self, path):
+        self._local(path).mkdir()
+
+    def put(self, local, remote, callback=None, confirm=True):
+        self.puts.append(remote)
+        shutil.copy(local, self._local(remote))
+        if self.fail_put:
+            raise OSError("Connection lost")
+
+    def posix_rename(self, source, target):
+        os.replace(self._local(source), self._local(target))
+
+    def remove(self, path):
+        os.remove(self._local(path))
+
+    def listdir_attr(self, path):
+        entries = []
+        for entry in self._local(path).iterdir():
+            attrs = paramiko.SFTPAttributes()
+            info = entry.stat()
+            attrs.filename, attrs.st_mode, attrs.st_size, attrs.st_mtime = (
+                entry.name, info.st_mode, info.st_size, info.st_mtime
+            )
+            entries.append(attrs)
+        return entries
+
+    def open(self, path):
+        return open(self._local(path), "rb")
+
+    def get(self, remote, local, callback=None):
+        shutil.copy(self._local(remote), local)
+
+    def close(self):
+        pass
+
+
+class TestSFTPStorageAdapter:
+    """Tests for SFTPStorageAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return SFTPConfig(host="sftp.example.com", user="backup", password="secret", root="/backups")
+
+    @pytest.fixture
+    def server(self, tmp_path):
+        root = tmp_path / "server"
+        (root / "backups").mkdir(parents=True)
+        return root
+
+    @pytest.fixture
+    def sftp(self, server):
+        fake = FakeSFTP(server)
+        with mock.patch("paramiko.SSHClient") as mock_client:
+            mock_client.return_value.open_sftp.return_value = fake
+            fake.client = mock_client.return_value
+            yield fake
+
+    @pytest.fixture
+    def backup(self, tmp_path):
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(b"test data")
+        return backup
+
+    def test_connects_with_known_hosts(self, config, sftp):
+        SFTPStorageAdapter(config).list()
+
+        sftp.client.load_host_keys.assert_called_once_with(os.path.expanduser("~/.ssh/known_hosts"))
+        assert isinstance(sftp.client.set_missing_host_key_policy.call_args[0][0], paramiko.RejectPolicy)
+        assert sftp.client.connect.call_args[1]["password"] == "secret"
+
+    def test_loads_encrypted_private_key(self, config):
+        config.private_key = "/keys/id_ed25519"
+        config.private_key_passphrase = "hunter2"
+
+        with mock.patch("paramiko.PKey.from_path") as from_path:
+            adapter = SFTPStorageAdapter(config)
+
+        from_path.assert_called_once_with("/keys/id_ed25519", passphrase="hunter2")
+        assert adapter.pkey is from_path.return_value
+
+    def test_pinned_fingerprint(self):
+        key = mock.Mock()
+        key.asbytes.return_value = b"host key"
+        policy = PinnedHostKeyPolicy(fingerprint(key))
+
+        policy.missing_host_key(None, "sftp.example.com", key)
+
+        with pytest.raises(paramiko.SSHException) as exc_info:
+            PinnedHostKeyPolicy("SHA256:other").missing_host_key(None, "sftp.example.com", key)
+        assert "expected pinned SHA256:other" in str(exc_info.value)
+
+    def test_upload_renames_into_place_with_metadata(self, config, sftp, server, backup):
+        SFTPStorageAdapter(config).upload(backup, "prod/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+
+        assert sftp.puts == [
+            "/backups/prod/.db_20240115_120000.sql.gz.meta.json.partial",
+            "/backups/prod/.db_20240115_120000.sql.gz.partial",
+        ]
+        assert sorted(p.name for p in (server / "backups/prod").iterdir()) == [
+            "db_20240115_120000.sql.gz",
+            "db_20240115_120000.sql.gz.meta.json",
+        ]
+        assert not backup.with_name(backup.name + ".meta.json").exists()
+
+    def test_failed_upload_leaves_no_backup(self, config, sftp, server, backup):
+        sftp.fail_put = True
+
+        with pytest.raises(StorageError):
+            SFTPStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        assert list((server / "backups").iterdir()) == []
+
+    def test_list_skips_sidecars_and_partial_uploads(self, config, sftp, server, backup):
+        adapter = SFTPStorageAdapter(config)
+        adapter.upload(backup, "prod/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+        (server / "backups/prod/.db_20240116_120000.sql.gz.partial").write_bytes(b"half")
+        (server / "backups/prod/other_20240115_120000.sql.gz").write_bytes(b"other")
+
+        objects = adapter.list(prefix="prod/db")
+
+        assert [obj.key for obj in objects] == ["prod/db_20240115_120000.sql.gz"]
+        assert objects[0].size == len(b"test data")
+        assert objects[0].last_modified.tzinfo is not None
+
+    def test_list_missing_directory(self, config, sftp):
+        assert SFTPStorageAdapter(config).list(prefix="missing/db") == []
+
+    def test_metadata_round_trip(self, config, sftp, backup):
+        adapter = SFTPStorageAdapter(config)
+        adapter.upload(backup, "db_20240115_120000.sql.gz", metadata={"engine": "mysql"})
+
+        assert adapter.get_metadata("db_20240115_120000.sql.gz") == {"engine": "mysql"}
+        assert adapter.get_metadata("db_20240101_120000.sql.gz") == {}
+
+    def test_delete_removes_sidecar(self, config, sftp, server, backup):
+        adapter = SFTPStorageAdapter(config)
+        adapter.upload(backup, "db_20240115_120000.sql.gz", metadata={"engine": "mysql"})
+
+        adapter.delete_many(["db_20240115_120000.sql.gz", "db_20240101_120000.sql.gz"])
+
+        assert list((server / "backups").iterdir()) == []
+
+    def test_download(self, config, sftp, backup, tmp_path):
+        adapter = SFTPStorageAdapter(config)
+        adapter.upload(backup, "db_20240115_120000.sql.gz")
+
+        adapter.download("db_20240115_120000.sql.gz", tmp_path / "restored.sql.gz")
+
+        assert (tmp_path / "restored.sql.gz").read_bytes() == b"test data"
+
+    def test_connection_failure(self, config):
+        with mock.patch("paramiko.SSHClient") as mock_client:
+            mock_client.return_value.connect.side_effect = paramiko.SSHException("Server not found in known_hosts")
+
+            with pytest.raises(StorageError) as exc_info:
+                SFTPStorageAdapter(config).list()
+
+        assert "known_hosts" in str(exc_info.value)
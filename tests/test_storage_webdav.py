@@ -0,0 +1,249 @@
+"""Tests for WebDAV storage adapter."""
+
+import io
+import urllib.error
+import urllib.parse
+from unittest import mock
+
+import pytest
+
+from nestvault.config import WebDAVConfig
+from nestvault.exceptions import StorageError
+from nestvault.storage.webdav import WebDAVStorageAdapter
+
+NEXTCLOUD = "https://cloud.example.com/remote.php/dav"
+
+
+class FakeDAV:
+    """urllib.request.urlopen side effect for a WebDAV server holding files in memory."""
+
+    def __init__(self, root, chunking=True):
+        self.root = urllib.parse.urlsplit(root).path
+        self.chunking = chunking
+        self.files = {}
+        self.collections = {self.root}
+        self.uploads = {}
+        self.requests = []
+
+    def _error(self, request, code):
+        return urllib.error.HTTPError(request.full_url, code, "error", {}, io.BytesIO())
+
+    def __call__(self, request, timeout=None, context=None):
+        method = request.get_method()
+        path = urllib.parse.unquote(urllib.parse.urlsplit(request.full_url).path)
+        self.requests.append((method, path))
+        data = request.data.read() if hasattr(request.data, "read") else request.data
+
+        if "/uploads/" in path:
+            return self._upload(request, method, path, data)
+
+        if method == "MKCOL":
+            if path in self.collections:
+                raise self._error(request, 405)
+            self.collections.add(path)
+        elif method == "PUT":
+            assert path.rsplit("/", 1)[0] in self.collections
+            self.files[path] = data
+        elif method == "MOVE":
+            self.files[self._destination(request)] = self.files.pop(path)
+        elif method == "DELETE":
+            if path not in self.files:
+                raise self._error(request, 404)
+            del self.files[path]
+        elif method == "GET":
+            if path not in self.files:
+                raise self._error(request, 404)
+            return io.BytesIO(self.files[path])
+        elif method == "PROPFIND":
+            assert request.get_header("Depth") == "1"
+            if path not in self.collections:
+                raise self._error(request, 404)
+            return io.BytesIO(self._multistatus(path))
+
+        return io.BytesIO()
+
+    def _destination(self, request):
+        return urllib.parse.unquote(urllib.parse.urlsplit(request.get_header("Destination")).path)
+
+    def _upload(self, request, method, path, data):
+        if not self.chunking:
+            raise self._error(request, 405)
+        upload, _, name = path.partition("/nestvault-")[2].partition("/")
+        if method == "MKCOL":
+            self.uploads[upload] = {}
+        elif method == "PUT":
+            self.uploads[upload][name] = data
+        elif method == "MOVE":
+            assert name == ".file"
+            chunks = self.uploads.pop(upload)
+            self.files[self._destination(request)] = b"".join(chunks[key] for key in sorted(chunks))
+        return io.BytesIO()
+
+    def _multistatus(self, directory):
+        entries = [(directory, None)]
+        entries += [
+            (path, None) for path in self.collections if path.rsplit("/", 1)[0] == directory and path != directory
+        ]
+        entries += [(path, data) for path, data in self.files.items() if path.rsplit("/", 1)[0] == directory]
+
+        responses = []
+        for path, data in entries:
+            href = urllib.parse.quote(path + ("/" if data is None else ""))
+            if data is None:
+                props = "<d:resourcetype><d:collection/></d:resourcetype>"
+            else:
+                props = (
+                    f"<d:resourcetype/><d:getcontentlength>{len(data)}</d:getcontentlength>"
+                    "<d:getlastmodified>Mon, 15 Jan 2024 12:00:00 GMT</d:getlastmodified>"
+                )
+            responses.append(
+                f"<d:response><d:href>{href}</d:href><d:propstat><d:prop>{props}</d:prop>"
+                "<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>"
+            )
+
+        return f'<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">{"".join(responses)}</d:multistatus>'.encode()
+
+
+class TestWebDAVStorageAdapter:
+    """Tests for WebDAVStorageAdapter."""
+
+    @pytest.fixture
+    def config(self):
+        return WebDAVConfig(url=f"{NEXTCLOUD}/files/backup/nestvault", user="backup", password="app-password")
+
+    @pytest.fixture
+    def backup(self, tmp_path):
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(b"test data")
+        return backup
+
+    def test_basic_auth(self, config, backup):
+        with mock.patch("urllib.request.urlopen", side_effect=FakeDAV(config.url)) as mock_urlopen:
+            WebDAVStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        request = mock_urlopen.call_args[0][0]
+        assert request.get_header("Authorization") == "Basic YmFja3VwOmFwcC1wYXNzd29yZA=="
+
+    def test_bearer_token_and_ca_cert(self, config):
+        config.user = config.password = None
+        config.token = "secret-token"
+        config.ca_cert = "/certs/internal-ca.pem"
+
+        with mock.patch("ssl.create_default_context") as mock_context:
+            adapter = WebDAVStorageAdapter(config)
+        mock_context.assert_called_once_with(cafile="/certs/internal-ca.pem")
+
+        with mock.patch("urllib.request.urlopen", side_effect=FakeDAV(config.url)) as mock_urlopen:
+            adapter.list()
+
+        request = mock_urlopen.call_args[0][0]
+        assert request.get_header("Authorization") == "Bearer secret-token"
+        assert mock_urlopen.call_args[1]["context"] is mock_context.return_value
+
+    def test_upload_creates_directories_and_moves_into_place(self, config, backup):
+        server = FakeDAV(config.url)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            WebDAVStorageAdapter(config).upload(
+                backup, "prod/2024/db_20240115_120000.sql.gz", metadata={"engine": "postgres"}
+            )
+
+        root = "/remote.php/dav/files/backup/nestvault"
+        assert ("MKCOL", f"{root}/prod") in server.requests
+        assert ("MKCOL", f"{root}/prod/2024") in server.requests
+        assert ("PUT", f"{root}/prod/2024/.db_20240115_120000.sql.gz.partial") in server.requests
+        assert sorted(server.files) == [
+            f"{root}/prod/2024/db_20240115_120000.sql.gz",
+            f"{root}/prod/2024/db_20240115_120000.sql.gz.meta.json",
+        ]
+
+    def test_large_upload_uses_nextcloud_chunking(self, config, tmp_path):
+        content = b"x" * (12 * 1024 * 1024)
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(content)
+        config.chunk_size_mb = 5
+        server = FakeDAV(config.url)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            WebDAVStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        chunk_puts = [path for method, path in server.requests if method == "PUT" and "/uploads/backup/" in path]
+        assert [path.rsplit("/", 1)[1] for path in chunk_puts] == ["00001", "00002", "00003"]
+        assert server.files["/remote.php/dav/files/backup/nestvault/db_20240115_120000.sql.gz"] == content
+
+    def test_large_upload_falls_back_to_put(self, config, tmp_path):
+        content = b"x" * (6 * 1024 * 1024)
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(content)
+        config.chunk_size_mb = 5
+        server = FakeDAV(config.url, chunking=False)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            WebDAVStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        assert server.files["/remote.php/dav/files/backup/nestvault/db_20240115_120000.sql.gz"] == content
+
+    def test_plain_webdav_server_never_chunks(self, tmp_path):
+        config = WebDAVConfig(url="https://dav.example.com/backups", token="t", chunk_size_mb=5)
+        backup = tmp_path / "db_20240115_120000.sql.gz"
+        backup.write_bytes(b"x" * (6 * 1024 * 1024))
+        server = FakeDAV(config.url)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            WebDAVStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        assert not any("/uploads/" in path for _, path in server.requests)
+        assert "/backups/db_20240115_120000.sql.gz" in server.files
+
+    def test_list_walks_collections(self, config, backup):
+        server = FakeDAV(config.url)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            adapter = WebDAVStorageAdapter(config)
+            adapter.upload(backup, "prod/2024/db_20240115_120000.sql.gz", metadata={"engine": "postgres"})
+            adapter.upload(backup, "prod/other_20240115_120000.sql.gz")
+            server.files["/remote.php/dav/files/backup/nestvault/prod/.db_20240116_120000.sql.gz.partial"] = b"half"
+
+            objects = adapter.list(prefix="prod/")
+
+        assert sorted(obj.key for obj in objects) == [
+            "prod/2024/db_20240115_120000.sql.gz",
+            "prod/other_20240115_120000.sql.gz",
+        ]
+        assert objects[0].size == len(b"test data")
+        assert objects[0].last_modified.tzinfo is not None
+
+    def test_list_missing_directory(self, config):
+        with mock.patch("urllib.request.urlopen", side_effect=FakeDAV(config.url)):
+            assert WebDAVStorageAdapter(config).list(prefix="missing/db") == []
+
+    def test_metadata_and_delete(self, config, backup):
+        server = FakeDAV(config.url)
+
+        with mock.patch("urllib.request.urlopen", side_effect=server):
+            adapter = WebDAVStorageAdapter(config)
+            adapter.upload(backup, "db_20240115_120000.sql.gz", metadata={"engine": "mysql"})
+
+            assert adapter.get_metadata("db_20240115_120000.sql.gz") == {"engine": "mysql"}
+            assert adapter.get_metadata("db_20240101_120000.sql.gz") == {}
+
+            adapter.delete_many(["db_20240115_120000.sql.gz", "db_20240101_120000.sql.gz"])
+
+        assert server.files == {}
+
+    def test_download(self, config, backup, tmp_path):
+        with mock.patch("urllib.request.urlopen", side_effect=FakeDAV(config.url)):
+            adapter = WebDAVStorageAdapter(config)
+            adapter.upload(backup, "db_20240115_120000.sql.gz")
+            adapter.download("db_20240115_120000.sql.gz", tmp_path / "restored.sql.gz")
+
+        assert (tmp_path / "restored.sql.gz").read_bytes() == b"test data"
+
+    def test_server_error(self, config, backup):
+        error = urllib.error.HTTPError(config.url, 507, "Insufficient Storage", {}, io.BytesIO())
+
+        with mock.patch("urllib.request.urlopen", side_effect=error):
+            with pytest.raises(StorageError) as exc_info:
+                WebDAVStorageAdapter(config).upload(backup, "db_20240115_120000.sql.gz")
+
+        assert "HTTP 507" in str(exc_info.value)
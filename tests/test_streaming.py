@@ -0,0 +1,110 @@
+"""Tests for streamed backups."""
+
+import pytest
+
+from nestvault.exceptions import BackupError
+from nestvault.streaming import IteratorReader, command_input, command_output, command_run
+
+
+class TestCommandOutput:
+    """Tests for command_output."""
+
+    def test_yields_stdout(self):
+        output = b"".join(command_output(["sh", "-c", "echo 'SELECT 1;'"], {}, "pg_dump"))
+
+        assert output == b"SELECT 1;\n"
+
+    def test_failure_raises_after_output(self):
+        chunks = command_output(["sh", "-c", "echo partial; echo 'connection refused' >&2; exit 1"], {}, "pg_dump")
+
+        assert next(chunks) == b"partial\n"
+        with pytest.raises(BackupError, match="pg_dump failed: connection refused"):
+            next(chunks)
+
+    def test_missing_binary(self):
+        with pytest.raises(BackupError, match="Failed to run pg_dump"):
+            next(command_output(["nestvault-missing-binary"], {}, "pg_dump"))
+
+    def test_close_stops_command(self):
+        chunks = command_output(["sh", "-c", "echo started; sleep 30"], {}, "pg_dump")
+
+        assert next(chunks) == b"started\n"
+        chunks.close()
+
+
+class TestCommandInput:
+    """Tests for command_input."""
+
+    def test_feeds_stdin(self, tmp_path):
+        import io
+
+        output = tmp_path / "restored"
+        command_input(["sh", "-c", f"cat > {output}"], {}, io.BytesIO(b"SELECT 1;" * 100000), "psql")
+
+        assert output.read_bytes() == b"SELECT 1;" * 100000
+
+    def test_failure_raises_with_stderr(self):
+        import io
+
+        with pytest.raises(BackupError, match="pg_restore failed: input file is too short"):
+            command_input(
+                ["sh", "-c", "echo 'input file is too short' >&2; exit 1"], {}, io.BytesIO(b"PGDMP"), "pg_restore"
+            )
+
+    def test_source_errors_stop_command(self):
+        def chunks():
+            yield b"SELECT 1;"
+            raise BackupError("chunk 1 failed authentication")
+
+        with pytest.raises(BackupError, match="authentication"):
+            command_input(["sh", "-c", "cat > /dev/null"], {}, IteratorReader(chunks()), "psql")
+
+
+class TestCommandRun:
+    """Tests for command_run."""
+
+    def test_passes_stderr_lines_as_written(self):
+        lines = []
+
+        def on_line(line):
+            lines.append(line)
+            return not line.startswith(b"progress")
+
+        script = "echo progress 1 >&2; echo warning >&2; echo progress 2 >&2"
+        kept = command_run(["sh", "-c", script], {}, "pg_restore", on_line)
+
+        assert lines == [b"progress 1\n", b"warning\n", b"progress 2\n"]
+        assert kept == b"warning\n"
+
+    def test_failure_raises_with_kept_lines(self):
+        with pytest.raises(BackupError, match="pg_restore failed: could not connect$"):
+            command_run(
+                ["sh", "-c", "echo processing >&2; echo 'could not connect' >&2; exit 1"],
+                {},
+                "pg_restore",
+                lambda line: line != b"processing\n",
+            )
+
+
+class TestIteratorReader:
+    """Tests for IteratorReader."""
+
+    def test_reads_fill_requested_size(self):
+        reader = IteratorReader([b"ab", b"cde", b"f"])
+
+        assert reader.read(4) == b"abcd"
+        assert reader.read(4) == b"ef"
+        assert reader.read(4) == b""
+
+    def test_read_all(self):
+        assert IteratorReader(iter([b"ab", b"cd"])).read() == b"abcd"
+
+    def test_iterator_errors_surface_from_read(self):
+        def chunks():
+            yield b"ab"
+            raise BackupError("pg_dump failed")
+
+        reader = IteratorReader(chunks())
+
+        with pytest.raises(BackupError):
+            reader.read(4)
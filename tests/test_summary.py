@@ -0,0 +1,93 @@
+"""Tests for summary module."""
+
+import io
+import json
+from unittest import mock
+
+import pytest
+
+from nestvault.notify import RunResult, notify
+from nestvault.summary import EXIT_FAILURE, EXIT_PARTIAL, EXIT_SUCCESS, RunSummary, exit_code, write_summary
+
+
+class TestExitCode:
+    """Tests for exit_code function."""
+
+    @pytest.mark.parametrize(
+        "results, expected",
+        [
+            ({"billing": True}, EXIT_SUCCESS),
+            ({"billing": True, "crm": True}, EXIT_SUCCESS),
+            ({"billing": False}, EXIT_FAILURE),
+            ({"billing": False, "crm": False}, EXIT_FAILURE),
+            ({"billing": True, "crm": False}, EXIT_PARTIAL),
+        ],
+    )
+    def test_partial_only_with_several_targets(self, results, expected):
+        assert exit_code(results) == expected
+
+
+class TestRunSummary:
+    """Tests for RunSummary class."""
+
+    def test_targets_with_their_backups(self):
+        summary = RunSummary("backup")
+        notify(
+            [summary.collector],
+            RunResult("billing", "billing", "success", duration=84.2134, size=300, backup_key="billing.sql.zst"),
+        )
+        notify([summary.collector], RunResult("crm", "crm", "failure", duration=2.5, error="connection refused"))
+        summary.targets = {"billing": True, "crm": False, "orders": True, "legacy": False}
+
+        document = summary.to_dict(exit_code(summary.targets))
+
+        assert (document["command"], document["status"], document["exit_code"]) == ("backup", "partial", 3)
+        assert document["error"] is None
+        billing, crm, orders, legacy = document["targets"]
+        assert (billing["status"], billing["size"], billing["duration"], billing["error"]) == (
+            "success",
+            300,
+            84.213,
+            None,
+        )
+        assert [backup["backup_key"] for backup in billing["backups"]] == ["billing.sql.zst"]
+        assert (crm["status"], crm["size"], crm["error"]) == ("failure", 0, "crm: connection refused")
+        assert crm["backups"][0]["backup_key"] is None
+        assert (orders["status"], orders["backups"]) == ("skipped", [])
+        assert legacy["status"] == "failure"
+        assert legacy["error"].startswith("not backed up")
+
+    def test_failed_run_without_targets(self):
+        summary = RunSummary("backup", error="Configuration error: STORAGE_TYPE is required")
+
+        document = summary.to_dict(2)
+
+        assert (document["status"], document["error"], document["targets"]) == (
+            "usage_error",
+            "Configuration error: STORAGE_TYPE is required",
+            [],
+        )
+
+
+class TestWriteSummary:
+    """Tests for write_summary function."""
+
+    def test_writes_file(self, tmp_path):
+        path = tmp_path / "summary.json"
+        path.write_text("{}")
+
+        write_summary(str(path), {"status": "success"})
+
+        assert json.loads(path.read_text()) == {"status": "success"}
+        assert [file.name for file in tmp_path.iterdir()] == ["summary.json"]
+
+    def test_writes_stdout(self):
+        with mock.patch("sys.stdout", new_callable=io.StringIO) as stdout:
+            write_summary("-", {"status": "failure"})
+
+        assert json.loads(stdout.getvalue()) == {"status": "failure"}
+
+    def test_unwritable_summary_is_logged(self, tmp_path):
+        write_summary(str(tmp_path / "missing" / "summary.json"), {"status": "success"})
+
+        assert not (tmp_path / "missing").exists()
@@ -0,0 +1,52 @@
+"""Tests for tempdir module."""
+
+import os
+import tempfile
+import time
+
+import pytest
+
+from nestvault.tempdir import sweep_orphans, use_temp_dir
+
+
+class TestUseTempDir:
+    """Tests for use_temp_dir function."""
+
+    @pytest.fixture(autouse=True)
+    def restore_tempdir(self):
+        previous = tempfile.tempdir
+        yield
+        tempfile.tempdir = previous
+
+    def test_creates_private_directory_used_by_tempfile(self, tmp_path):
+        temp_dir = use_temp_dir(str(tmp_path / "spool" / "nestvault"))
+
+        assert temp_dir.is_dir()
+        assert temp_dir.stat().st_mode & 0o777 == 0o700
+        with tempfile.TemporaryDirectory() as scratch:
+            assert os.path.dirname(scratch) == str(temp_dir)
+
+
+class TestSweepOrphans:
+    """Tests for sweep_orphans function."""
+
+    def test_removes_only_old_nestvault_entries(self, tmp_path):
+        old = time.time() - 48 * 3600
+        crashed = tmp_path / "nestvault-k2j4h1"
+        crashed.mkdir()
+        (crashed / "db_20240115_120000.sql.gz.partial").write_bytes(b"SELECT")
+        state = tmp_path / "nestvault-uploads"
+        state.mkdir()
+        other = tmp_path / "other-tool"
+        other.mkdir()
+        running = tmp_path / "nestvault-a81kd3"
+        running.mkdir()
+        for path in (crashed, state, other):
+            os.utime(path, (old, old))
+
+        removed = sweep_orphans(tmp_path, 24, keep=[str(state)])
+
+        assert removed == [crashed]
+        assert sorted(path.name for path in tmp_path.iterdir()) == [
+            "nestvault-a81kd3", "nestvault-uploads", "other-tool"
+        ]
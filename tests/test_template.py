@@ -0,0 +1,55 @@
+"""Tests for template module."""
+
+import pytest
+
+from nestvault.template import RESULT_VARIABLES, Template
+
+DATA = {
+    "Target": "billing",
+    "Status": "failure",
+    "Error": 'pg_dump: "db" refused',
+    "Size": None,
+    "Duration": 84.0,
+    "Labels": {"env": "prod"},
+}
+
+
+class TestTemplate:
+    """Tests for Template class."""
+
+    @pytest.mark.parametrize(
+        "source, expected",
+        [
+            ("{{.Target}} {{.Labels.env}}", "billing prod"),
+            ("{{.Error | json}}", '"pg_dump: \\"db\\" refused"'),
+            ("{{.Size}}|{{.Size | json}}|{{.Labels.missing | json}}", "|null|null"),
+            ("{{.Duration}}s", "84s"),
+            ("{{if eq .Status \"success\"}}ok{{else}}{{.Status}}{{end}}", "failure"),
+            ("{{if not .Size}}no size{{end}}", "no size"),
+            ("{{if and .Error .Size}}both{{else}}one{{end}}", "one"),
+            ("a {{- /* comment */ -}} \n b", "ab"),
+            ("{{json .Labels}}", '{"env": "prod"}'),
+        ],
+    )
+    def test_render(self, source, expected):
+        assert Template(source, RESULT_VARIABLES).render(DATA) == expected
+
+    @pytest.mark.parametrize(
+        "source, match",
+        [
+            ("{{.Nope}}", "unknown variable .Nope"),
+            ("{{upper .Target}}", "unknown function 'upper'"),
+            ("{{if .Error}}x", "without an {{end}}"),
+            ("{{end}}", "without an {{if}}"),
+            ("{{else}}", "outside of an {{if}}"),
+            ("{{.Target}", "unbalanced braces"),
+            ("{{}}", "empty action"),
+        ],
+    )
+    def test_malformed_templates_are_rejected(self, source, match):
+        with pytest.raises(ValueError, match=match):
+            Template(source, RESULT_VARIABLES)
+
+    def test_lookup_in_a_value_that_is_not_a_map_fails(self):
+        with pytest.raises(ValueError, match="cannot look up"):
+            Template("{{.Target.name}}", RESULT_VARIABLES).render(DATA)
@@ -0,0 +1,111 @@
+"""Tests for throttle module."""
+
+import io
+from datetime import datetime, timezone
+from unittest import mock
+
+from nestvault.throttle import BandwidthLimit, Throttle, ThrottledReader, TokenBucket, cumulative, shared_throttle
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 0.0
+        self.slept = []
+
+    def __call__(self):
+        return self.now
+
+    def sleep(self, seconds):
+        self.slept.append(seconds)
+        self.now += seconds
+
+
+class TestTokenBucket:
+    """Tests for TokenBucket."""
+
+    def test_burst_up_to_rate_then_waits(self):
+        clock = FakeClock()
+        bucket = TokenBucket(1000, clock=clock, sleep=clock.sleep)
+
+        bucket.consume(1000)
+        assert clock.slept == []
+
+        bucket.consume(500)
+        assert clock.slept == [0.5]
+
+    def test_concurrent_callers_share_the_rate(self):
+        clock = FakeClock()
+        bucket = TokenBucket(1000, clock=clock, sleep=clock.sleep)
+        bucket.tokens = 0.0
+
+        # Two workers asking at the same instant: the second waits for both
+        waits = []
+        for _ in range(2):
+            with mock.patch.object(bucket, "sleep", waits.append):
+                bucket.consume(1000)
+
+        assert waits == [1.0, 2.0]
+
+    def test_refills_while_idle(self):
+        clock = FakeClock()
+        bucket = TokenBucket(1000, clock=clock, sleep=clock.sleep)
+        bucket.consume(1000)
+
+        clock.now += 10
+        bucket.consume(1000)
+
+        assert clock.slept == []
+
+
+class TestBandwidthLimit:
+    """Tests for BandwidthLimit."""
+
+    def test_applies_all_day_without_windows(self):
+        assert BandwidthLimit(1000).applies_at(datetime(2024, 1, 15, 3, 0, tzinfo=timezone.utc))
+
+    def test_applies_only_within_windows(self):
+        limit = BandwidthLimit(1000, ((6 * 60, 24 * 60),))
+
+        assert not limit.applies_at(datetime(2024, 1, 15, 3, 0, tzinfo=timezone.utc))
+        assert limit.applies_at(datetime(2024, 1, 15, 6, 0, tzinfo=timezone.utc))
+        assert limit.applies_at(datetime(2024, 1, 15, 23, 59, tzinfo=timezone.utc))
+
+    def test_window_past_midnight(self):
+        limit = BandwidthLimit(1000, ((22 * 60, 2 * 60),))
+
+        assert limit.applies_at(datetime(2024, 1, 15, 23, 0, tzinfo=timezone.utc))
+        assert limit.applies_at(datetime(2024, 1, 15, 1, 0, tzinfo=timezone.utc))
+        assert not limit.applies_at(datetime(2024, 1, 15, 12, 0, tzinfo=timezone.utc))
+
+
+class TestThrottle:
+    """Tests for Throttle."""
+
+    def test_passes_transfers_outside_the_limit_hours(self):
+        throttle = Throttle("upload", BandwidthLimit(1000, ((0, 60),)))
+
+        with mock.patch.object(throttle.bucket, "consume") as consume, \
+                mock.patch("nestvault.throttle.datetime") as clock:
+            clock.now.return_value = datetime(2024, 1, 15, 12, 0, tzinfo=timezone.utc)
+            throttle(5000)
+
+        consume.assert_not_called()
+
+    def test_reader_and_cumulative_callbacks_pace_every_chunk(self):
+        throttle = Throttle("download", BandwidthLimit(1000))
+
+        with mock.patch.object(throttle.bucket, "consume") as consume:
+            reader = ThrottledReader(io.BytesIO(b"x" * 10), throttle)
+            assert reader.read(4) == b"xxxx"
+            assert reader.read() == b"xxxxxx"
+
+            callback = cumulative(throttle)
+            callback(100, 300)
+            callback(300, 300)
+
+        assert [c.args[0] for c in consume.call_args_list] == [4, 6, 100, 200]
+
+    def test_shared_by_direction_and_limit(self):
+        assert shared_throttle("upload", 1000, []) is shared_throttle("upload", 1000, [])
+        assert shared_throttle("upload", 1000, []) is not shared_throttle("download", 1000, [])
+        assert shared_throttle("upload", None, []) is None
@@ -0,0 +1,164 @@
+"""Tests for tracing module."""
+
+import io
+from unittest import mock
+
+import pytest
+from opentelemetry.sdk.trace import TracerProvider
+from opentelemetry.sdk.trace.export import SimpleSpanProcessor
+from opentelemetry.sdk.trace.export.in_memory_span_exporter import InMemorySpanExporter
+from opentelemetry.trace import StatusCode
+
+from nestvault import tracing
+from nestvault.config import S3Config
+from nestvault.exceptions import NotifyError
+from nestvault.notify import Notifier, RunResult, notify
+from nestvault.stats import collecting, measure
+from nestvault.storage.s3 import S3StorageAdapter
+from nestvault.tracing import enabled, setup_tracing, span, start_span
+
+
+@pytest.fixture
+def exporter():
+    exporter = InMemorySpanExporter()
+    provider = TracerProvider()
+    provider.add_span_processor(SimpleSpanProcessor(exporter))
+    with mock.patch.object(tracing, "_tracer", provider.get_tracer("test")):
+        yield exporter
+
+
+def spans(exporter):
+    return {span.name: span for span in exporter.get_finished_spans()}
+
+
+class TestSetup:
+    """Tests for enabled and setup_tracing functions."""
+
+    @pytest.mark.parametrize(
+        "environ, expected",
+        [
+            ({}, False),
+            ({"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, True),
+            ({"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/v1/traces"}, True),
+            ({"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}, False),
+            ({"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_EXPORTER": "none"}, False),
+        ],
+    )
+    def test_enabled_only_with_an_endpoint(self, environ, expected):
+        assert enabled(environ) is expected
+
+    def test_setup_without_endpoint_keeps_tracing_off(self):
+        with mock.patch.object(tracing, "_tracer", None):
+            assert setup_tracing({}) is False
+            assert tracing._tracer is None
+
+    def test_setup_rejects_unknown_protocol(self):
+        environ = {"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "http/json"}
+
+        with mock.patch.object(tracing, "_tracer", None):
+            assert setup_tracing(environ) is False
+            assert tracing._tracer is None
+
+    def test_spans_do_nothing_while_off(self):
+        with mock.patch.object(tracing, "_tracer", None):
+            with span("dump", backup_key="db.sql.gz") as traced:
+                traced.set(bytes_out=10)
+                traced.fail("failed")
+            start_span("upload parts").end()
+
+
+class TestSpans:
+    """Tests for span and start_span functions."""
+
+    def test_attributes_are_namespaced_without_unset_ones(self, exporter):
+        with span("backup job", database="app", size=None) as traced:
+            traced.set(backup_key="app.sql.gz")
+
+        assert dict(spans(exporter)["backup job"].attributes) == {
+            "nestvault.database": "app",
+            "nestvault.backup_key": "app.sql.gz",
+        }
+
+    def test_exception_is_recorded_on_its_span(self, exporter):
+        with pytest.raises(ValueError):
+            with span("backup job"):
+                with span("dump"):
+                    raise ValueError("pg_dump exited with 1")
+
+        dump = spans(exporter)["dump"]
+        assert dump.status.status_code == StatusCode.ERROR
+        assert [event.name for event in dump.events] == ["exception"]
+        assert dump.parent.span_id == spans(exporter)["backup job"].context.span_id
+
+    def test_failure_without_exception(self, exporter):
+        with span("manifest write") as traced:
+            traced.fail("bucket is read-only")
+
+        manifest = spans(exporter)["manifest write"]
+        assert manifest.status.status_code == StatusCode.ERROR
+        assert manifest.status.description == "bucket is read-only"
+
+    def test_started_span_is_a_child_but_not_current(self, exporter):
+        with span("upload"):
+            batch = start_span("upload parts", first_part=1)
+            with span("manifest write"):
+                pass
+        batch.end()
+
+        finished = spans(exporter)
+        upload_id = finished["upload"].context.span_id
+        assert finished["upload parts"].parent.span_id == upload_id
+        assert finished["manifest write"].parent.span_id == upload_id
+
+    def test_measure_traces_the_phase_with_its_bytes(self, exporter):
+        with collecting():
+            with measure("upload") as phase:
+                phase.bytes_out = 2048
+
+        upload = spans(exporter)["upload"]
+        assert upload.attributes["nestvault.bytes_out"] == 2048
+        assert "nestvault.bytes_in" not in upload.attributes
+
+
+class TestInstrumentation:
+    """Tests for the spans of uploads and notifications."""
+
+    def test_multipart_upload_is_traced_in_batches(self, exporter, tmp_path):
+        config = S3Config(
+            access_key="key",
+            secret_key="secret",
+            bucket="bucket",
+            region="us-east-1",
+            upload_state_dir=str(tmp_path / "uploads"),
+            upload_concurrency=2,
+        )
+        with mock.patch("boto3.client") as client:
+            client.return_value.create_multipart_upload.return_value = {"UploadId": "upload-1"}
+            client.return_value.upload_part.side_effect = lambda **kwargs: {"ETag": f"etag-{kwargs['PartNumber']}"}
+            adapter = S3StorageAdapter(config)
+            adapter.part_size = 4
+            adapter.upload_stream(io.BytesIO(b"0123456789"), "db.sql.gz")
+
+        batches = sorted(
+            (dict(span.attributes) for span in exporter.get_finished_spans() if span.name == "upload parts"),
+            key=lambda attributes: attributes["nestvault.first_part"],
+        )
+        assert [(b["nestvault.first_part"], b["nestvault.parts"], b["nestvault.bytes_out"]) for b in batches] == [
+            (1, 2, 8),
+            (3, 1, 2),
+        ]
+        assert {b["nestvault.backup_key"] for b in batches} == {"db.sql.gz"}
+
+    def test_failed_notification_is_recorded_on_its_notifier_span(self, exporter):
+        class Failing(Notifier):
+            name = "failing"
+
+            def send(self, result):
+                raise NotifyError("HTTP 500")
+
+        notify([Failing("always")], RunResult(target="app", database="app", status="success"))
+
+        finished = spans(exporter)
+        assert finished["notify failing"].status.status_code == StatusCode.ERROR
+        assert finished["notify failing"].parent.span_id == finished["notify"].context.span_id
+        assert finished["notify"].attributes["nestvault.status"] == "success"
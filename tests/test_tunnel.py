@@ -0,0 +1,124 @@
+"""Tests for tunnel module."""
+
+import base64
+import hashlib
+import io
+import subprocess
+from unittest import mock
+
+import pytest
+
+from nestvault.config import SshTunnelConfig
+from nestvault.exceptions import TunnelError
+from nestvault.tunnel import SshTunnel, fingerprint, tunneled
+
+KEY = base64.b64encode(b"\x00\x00\x00\x0bssh-ed25519 jump host key").decode()
+FINGERPRINT = "SHA256:" + base64.b64encode(hashlib.sha256(base64.b64decode(KEY)).digest()).decode().rstrip("=")
+
+
+def tunnel(**overrides) -> SshTunnel:
+    settings = {"host": "bastion.example.com", "user": "backup", "known_hosts_file": "/etc/nestvault/known_hosts"}
+    return SshTunnel(SshTunnelConfig(**{**settings, **overrides}), "db.internal", 5432)
+
+
+def keyscan(stdout: str, stderr: str = "") -> mock.Mock:
+    return mock.Mock(stdout=stdout.encode(), stderr=stderr.encode(), returncode=0)
+
+
+class TestSshTunnel:
+    """Tests for SshTunnel class."""
+
+    def test_fingerprint(self):
+        assert fingerprint(KEY) == FINGERPRINT
+        with pytest.raises(ValueError):
+            fingerprint("not base64!")
+
+    def test_command_forwards_to_the_database_with_keepalives(self):
+        cmd = tunnel(port=2222, key_file="/keys/id_ed25519", keepalive_seconds=15).command(40123, "/tmp/known_hosts")
+
+        assert cmd[:2] == ["ssh", "-N"] and cmd[-1] == "bastion.example.com"
+        assert cmd[cmd.index("-L") + 1] == "127.0.0.1:40123:db.internal:5432"
+        assert cmd[cmd.index("-p") + 1] == "2222" and cmd[cmd.index("-l") + 1] == "backup"
+        assert cmd[cmd.index("-i") + 1] == "/keys/id_ed25519"
+        options = [cmd[i + 1] for i, arg in enumerate(cmd) if arg == "-o"]
+        assert {"BatchMode=yes", "StrictHostKeyChecking=yes", "ServerAliveInterval=15"} <= set(options)
+        assert "UserKnownHostsFile=/tmp/known_hosts" in options
+
+    def test_command_uses_the_agent_without_key_file(self):
+        cmd = tunnel().command(40123, "/tmp/known_hosts")
+
+        assert "-i" not in cmd
+
+    def test_pins_the_host_key_by_fingerprint(self, tmp_path):
+        other = base64.b64encode(b"another key").decode()
+        scanned = f"# bastion.example.com:22 SSH-2.0-OpenSSH_9.6\nbastion.example.com ssh-rsa {other}\n"
+        scanned += f"bastion.example.com ssh-ed25519 {KEY}\n"
+
+        with mock.patch("subprocess.run", return_value=keyscan(scanned)):
+            path = tunnel(known_hosts_file=None, host_key_fingerprint=FINGERPRINT)._pinned_known_hosts(str(tmp_path))
+
+        with open(path) as f:
+            assert f.read() == f"bastion.example.com ssh-ed25519 {KEY}\n"
+
+    def test_refuses_a_host_key_without_the_fingerprint(self, tmp_path):
+        scanned = f"bastion.example.com ssh-ed25519 {base64.b64encode(b'impostor').decode()}\n"
+
+        with mock.patch("subprocess.run", return_value=keyscan(scanned)):
+            with pytest.raises(TunnelError, match="no host key with the fingerprint"):
+                tunnel(known_hosts_file=None, host_key_fingerprint=FINGERPRINT)._pinned_known_hosts(str(tmp_path))
+
+    def test_unreachable_jump_host_fails(self, tmp_path):
+        scanned = keyscan("", "connect to host bastion port 22: No route to host")
+
+        with mock.patch("subprocess.run", return_value=scanned):
+            with pytest.raises(TunnelError, match="is not reachable: connect to host bastion port 22"):
+                tunnel(known_hosts_file=None, host_key_fingerprint=FINGERPRINT)._pinned_known_hosts(str(tmp_path))
+
+    def test_failed_login_raises_with_the_error_of_ssh(self):
+        process = mock.Mock(returncode=255, stderr=io.BytesIO(b"backup@bastion: Permission denied (publickey).\n"))
+        process.poll.return_value = 255
+
+        with mock.patch("subprocess.Popen", return_value=process):
+            with pytest.raises(TunnelError, match=r"failed: backup@bastion: Permission denied \(publickey\)"):
+                with tunnel().open():
+                    pass
+
+    def test_open_yields_the_forwarded_port_and_stops_ssh(self):
+        process = mock.Mock(returncode=None, stderr=io.BytesIO())
+        process.poll.return_value = None
+
+        with (
+            mock.patch("subprocess.Popen", return_value=process) as popen,
+            mock.patch("socket.create_connection"),
+        ):
+            with tunnel().open() as port:
+                assert f"127.0.0.1:{port}:db.internal:5432" in popen.call_args.args[0]
+                process.terminate.assert_not_called()
+
+        process.terminate.assert_called_once()
+        process.wait.assert_called_once_with(5)
+
+    def test_ssh_that_does_not_exit_is_killed(self):
+        process = mock.Mock(returncode=None, stderr=io.BytesIO())
+        process.poll.return_value = None
+        process.wait.side_effect = [subprocess.TimeoutExpired("ssh", 5), None]
+
+        with mock.patch("subprocess.Popen", return_value=process), mock.patch("socket.create_connection"):
+            with tunnel().open():
+                pass
+
+        process.kill.assert_called_once()
+
+
+class TestTunneled:
+    """Tests for tunneled."""
+
+    def test_adapter_connects_through_the_tunnel_until_it_closes(self):
+        ssh = mock.MagicMock(spec=SshTunnel)
+        ssh.open.return_value.__enter__.return_value = 40123
+        adapter = mock.Mock()
+
+        with tunneled(ssh, adapter):
+            adapter.use_tunnel.assert_called_once_with(40123)
+
+        adapter.use_tunnel.assert_called_with(None)
@@ -0,0 +1,125 @@
+"""Tests for verify module."""
+
+import hashlib
+from datetime import datetime, timezone
+from unittest import mock
+
+import pytest
+
+from nestvault.exceptions import IntegrityError
+from nestvault.storage.base import StorageObject
+from nestvault.verify import ChecksumReader, check_download, check_stream, checksum_metadata, verify_backup
+
+DATA = bytes(range(256)) * 4096
+CHECKSUM = {"engine": "postgres", "size": str(len(DATA)), "sha256": hashlib.sha256(DATA).hexdigest()}
+
+
+class TestChecksums:
+    """Tests for checksum_metadata and check_download."""
+
+    def test_checksum_metadata(self, tmp_path):
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(DATA)
+
+        assert checksum_metadata(backup) == {"size": CHECKSUM["size"], "sha256": CHECKSUM["sha256"]}
+
+    def test_check_download_matches(self, tmp_path):
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(DATA)
+
+        assert check_download(backup, CHECKSUM, "db.sql.gz") is True
+
+    def test_check_download_detects_truncation(self, tmp_path):
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(DATA[:-1])
+
+        with pytest.raises(IntegrityError) as exc_info:
+            check_download(backup, CHECKSUM, "db.sql.gz")
+        assert "bytes were uploaded" in str(exc_info.value)
+
+    def test_check_download_detects_flipped_bit(self, tmp_path):
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(b"\xff" + DATA[1:])
+
+        with pytest.raises(IntegrityError) as exc_info:
+            check_download(backup, CHECKSUM, "db.sql.gz")
+        assert "Checksum mismatch" in str(exc_info.value)
+
+    def test_check_download_without_checksum(self, tmp_path):
+        backup = tmp_path / "db.sql.gz"
+        backup.write_bytes(DATA)
+
+        assert check_download(backup, {"engine": "postgres"}, "db.sql.gz") is False
+
+    def test_check_stream_hashes_unread_data(self):
+        import io
+
+        reader = ChecksumReader(io.BytesIO(DATA))
+        reader.read(100)
+
+        assert check_stream(reader, CHECKSUM, "db.sql.gz") is True
+        assert reader.size == len(DATA)
+
+    def test_check_stream_detects_flipped_bit(self):
+        import io
+
+        with pytest.raises(IntegrityError):
+            check_stream(ChecksumReader(io.BytesIO(b"\xff" + DATA[1:])), CHECKSUM, "db.sql.gz")
+
+
+class TestVerifyBackup:
+    """Tests for verify_backup function."""
+
+    @staticmethod
+    def _storage(data=DATA, metadata=CHECKSUM):
+        storage = mock.Mock()
+        storage.get_metadata.return_value = metadata
+        storage.download.side_effect = lambda key, path: path.write_bytes(data)
+        storage.list.return_value = [StorageObject("db.sql.gz", len(data), datetime.now(timezone.utc))]
+        storage.supports_range_reads = True
+        storage.read_range.side_effect = lambda key, start, length: data[start:start + length]
+        return storage
+
+    def test_full_verification(self):
+        assert verify_backup(self._storage(), "db.sql.gz").status == "verified"
+
+    def test_full_verification_detects_corruption(self):
+        result = verify_backup(self._storage(data=b"\xff" + DATA[1:]), "db.sql.gz")
+
+        assert result.status == "corrupt"
+        assert "Checksum mismatch" in result.detail
+
+    def test_legacy_backup_is_unverifiable(self):
+        storage = self._storage(metadata={"engine": "postgres"})
+
+        assert verify_backup(storage, "db.sql.gz").status == "unverifiable"
+        storage.download.assert_not_called()
+
+    def test_quick_verification_samples_ranges(self):
+        storage = self._storage()
+
+        result = verify_backup(storage, "db.sql.gz", quick=True)
+
+        assert result.status == "verified"
+        storage.download.assert_not_called()
+        ranges = [c.args[1:] for c in storage.read_range.call_args_list]
+        assert len(ranges) == 8
+        assert ranges[0][0] == 0
+        assert sum(ranges[-1]) == len(DATA)
+
+    def test_quick_verification_detects_truncation(self):
+        storage = self._storage(data=DATA[:-10])
+
+        result = verify_backup(storage, "db.sql.gz", quick=True)
+
+        assert result.status == "corrupt"
+        storage.read_range.assert_not_called()
+
+    def test_quick_verification_without_range_reads(self):
+        storage = self._storage()
+        storage.supports_range_reads = False
+
+        result = verify_backup(storage, "db.sql.gz", quick=True)
+
+        assert result.status == "verified"
+        assert "size only" in result.detail
@@ -0,0 +1,140 @@
+"""Tests for wal module."""
+
+import gzip
+from datetime import datetime, timezone
+
+import pytest
+
+from nestvault.config import CompressionConfig, LocalConfig
+from nestvault.exceptions import StorageError
+from nestvault.manifest import Manifest, write_manifest
+from nestvault.storage.local import LocalStorageAdapter
+from nestvault.wal import fetch_wal, is_wal_file, prune_wal, push_wal, wal_file_of
+
+GZIP = CompressionConfig(algorithm="gzip")
+
+
+@pytest.fixture
+def storage(tmp_path):
+    root = tmp_path / "nas"
+    root.mkdir()
+    return LocalStorageAdapter(LocalConfig(root=str(root)))
+
+
+def _segment(tmp_path, name, content=b"wal record"):
+    path = tmp_path / "pg_wal" / name
+    path.parent.mkdir(exist_ok=True)
+    path.write_bytes(content)
+    return path
+
+
+class TestPushWal:
+    """Tests for push_wal function."""
+
+    def test_compresses_and_uploads_under_wal_prefix(self, storage, tmp_path):
+        key = push_wal(storage, _segment(tmp_path, "000000010000000000000002"), GZIP)
+
+        assert key == "wal/000000010000000000000002.gz"
+        metadata = storage.get_metadata(key)
+        assert metadata["wal"] == "000000010000000000000002"
+        assert metadata["compression"] == "gzip"
+        assert "sha256" in metadata
+
+        download = tmp_path / "download.gz"
+        storage.download(key, download)
+        assert gzip.decompress(download.read_bytes()) == b"wal record"
+
+    def test_pushing_the_same_file_again_succeeds(self, storage, tmp_path):
+        segment = _segment(tmp_path, "000000010000000000000002")
+        push_wal(storage, segment, GZIP)
+
+        assert push_wal(storage, segment, GZIP) == "wal/000000010000000000000002.gz"
+
+    def test_refuses_to_overwrite_different_contents(self, storage, tmp_path):
+        push_wal(storage, _segment(tmp_path, "000000010000000000000002"), GZIP)
+
+        with pytest.raises(StorageError) as exc_info:
+            push_wal(storage, _segment(tmp_path, "000000010000000000000002", b"other cluster"), GZIP)
+
+        assert "different contents" in str(exc_info.value)
+
+    def test_rejects_files_that_are_not_wal(self, storage, tmp_path):
+        with pytest.raises(StorageError):
+            push_wal(storage, _segment(tmp_path, "postgresql.conf"), GZIP)
+
+    def test_wal_file_names(self):
+        assert is_wal_file("000000010000000000000002")
+        assert is_wal_file("000000010000000000000002.partial")
+        assert is_wal_file("000000010000000000000002.00000028.backup")
+        assert is_wal_file("00000002.history")
+        assert not is_wal_file("00000001000000000000002")
+        assert wal_file_of("wal/00000002.history.zst.age") == "00000002.history"
+
+
+class TestFetchWal:
+    """Tests for fetch_wal function."""
+
+    def test_fetches_decompressed_copy(self, storage, tmp_path):
+        push_wal(storage, _segment(tmp_path, "00000002.history", b"1\t0/3000000\tno recovery target"), GZIP)
+
+        fetch_wal(storage, "00000002.history", tmp_path / "RECOVERYHISTORY")
+
+        assert (tmp_path / "RECOVERYHISTORY").read_bytes() == b"1\t0/3000000\tno recovery target"
+
+    def test_missing_file_raises(self, storage, tmp_path):
+        push_wal(storage, _segment(tmp_path, "000000010000000000000002"), GZIP)
+
+        with pytest.raises(StorageError):
+            fetch_wal(storage, "000000010000000000000003", tmp_path / "RECOVERYXLOG")
+        assert not (tmp_path / "RECOVERYXLOG").exists()
+
+
+class TestPruneWal:
+    """Tests for prune_wal function."""
+
+    def _base_backup(self, storage, tmp_path, key, wal_start):
+        backup = tmp_path / "backup"
+        backup.write_bytes(b"base backup")
+        storage.upload(backup, key)
+        manifest = Manifest(
+            key=key,
+            database="postgres",
+            finished_at=datetime.now(timezone.utc),
+            size=11,
+            engine="postgres",
+            metadata={"mode": "physical", "wal_start": wal_start},
+        )
+        write_manifest(storage, manifest, tmp_path)
+
+    def test_keeps_wal_of_oldest_retained_base_backup(self, storage, tmp_path):
+        for name in (
+            "000000010000000000000001",
+            "000000010000000000000002",
+            "000000010000000000000002.00000028.backup",
+            "000000010000000000000003",
+            "00000002.history",
+            "000000020000000000000004",
+        ):
+            push_wal(storage, _segment(tmp_path, name), GZIP)
+        self._base_backup(storage, tmp_path, "postgres_20240115_120000.tar.gz", "000000010000000000000002")
+        self._base_backup(storage, tmp_path, "postgres_20240116_120000.tar.gz", "000000020000000000000004")
+
+        assert prune_wal(storage, "postgres") == 1
+
+        remaining = sorted(wal_file_of(obj.key) for obj in storage.list(prefix="wal/"))
+        assert remaining == [
+            "000000010000000000000002",
+            "000000010000000000000002.00000028.backup",
+            "000000010000000000000003",
+            "00000002.history",
+            "000000020000000000000004",
+        ]
+
+    def test_keeps_everything_without_a_recorded_wal_start(self, storage, tmp_path):
+        push_wal(storage, _segment(tmp_path, "000000010000000000000001"), GZIP)
+        backup = tmp_path / "backup"
+        backup.write_bytes(b"base backup")
+        storage.upload(backup, "postgres_20240115_120000.tar.gz")
+
+        assert prune_wal(storage, "postgres") == 0
+        assert len(storage.list(prefix="wal/")) == 1
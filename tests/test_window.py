@@ -0,0 +1,77 @@
+"""Tests for window module."""
+
+import time
+from datetime import datetime, timedelta, timezone
+from unittest import mock
+from zoneinfo import ZoneInfo
+
+import pytest
+
+from nestvault.exceptions import BackupError
+from nestvault.window import BackupWindow, check_runtime, supervising
+
+BERLIN = ZoneInfo("Europe/Berlin")
+
+
+class TestBackupWindow:
+    """Tests for BackupWindow class."""
+
+    def test_contains_times_in_its_timezone(self):
+        window = BackupWindow(((60, 300),), BERLIN)
+
+        # 01:30 and 05:30 in Berlin
+        assert window.contains(datetime(2024, 1, 15, 0, 30, tzinfo=timezone.utc))
+        assert not window.contains(datetime(2024, 1, 15, 4, 30, tzinfo=timezone.utc))
+
+    def test_window_past_midnight(self):
+        window = BackupWindow(((22 * 60, 2 * 60),))
+        moment = datetime(2024, 1, 15, 1, 0, tzinfo=timezone.utc)
+
+        assert window.contains(moment)
+        assert window.closes_after(moment) == datetime(2024, 1, 15, 2, 0, tzinfo=timezone.utc)
+
+    def test_opens_after(self):
+        window = BackupWindow(((60, 300),), BERLIN)
+
+        assert window.opens_after(datetime(2024, 1, 15, 12, 0, tzinfo=timezone.utc)) == datetime(
+            2024, 1, 16, 0, 0, tzinfo=timezone.utc
+        )
+
+    def test_describe(self):
+        assert BackupWindow(((60, 300), (22 * 60, 24 * 60)), BERLIN).describe() == (
+            "01:00-05:00, 22:00-24:00 (Europe/Berlin)"
+        )
+
+
+class TestSupervising:
+    """Tests for supervising function."""
+
+    def test_cancels_run_past_max_runtime(self):
+        with mock.patch("nestvault.window._children", return_value=[4242]), \
+                mock.patch("nestvault.window.os.kill") as kill:
+            with supervising("billing", None, timedelta(seconds=0.05)):
+                time.sleep(0.2)
+                with pytest.raises(BackupError, match="maximum runtime of 0s, cancelled before the upload"):
+                    check_runtime("upload")
+
+        assert kill.call_args.args[0] == 4242
+
+    def test_run_within_max_runtime_carries_on(self):
+        with mock.patch("nestvault.window.os.kill") as kill:
+            with supervising("billing", None, timedelta(hours=1)):
+                check_runtime("upload")
+
+        kill.assert_not_called()
+        # Outside a run there is no runtime to exceed
+        check_runtime("upload")
+
+    def test_logs_overrun_of_window(self):
+        window = mock.Mock(describe=mock.Mock(return_value="01:00-05:00 (UTC)"))
+        window.contains.return_value = True
+        window.closes_after.return_value = datetime.now(timezone.utc) - timedelta(minutes=1)
+
+        with mock.patch("nestvault.window.logger") as logger:
+            with supervising("billing", window, None):
+                pass
+
+        assert any("overran its backup window" in str(call) for call in logger.warning.call_args_list)